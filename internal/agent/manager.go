@@ -3,28 +3,47 @@ package agent
 import (
 	"context"
 	"fmt"
-	"hash/fnv"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/mjshashank/dabbi/internal/httpkit"
 	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/portmap"
+	"github.com/mjshashank/dabbi/internal/proxy"
 )
 
 const (
-	agentPort     = 1234  // opencode port inside VM
-	basePort      = 11000 // start of agent port range
-	portRange     = 1000  // number of ports in range
+	agentPort      = 1234 // opencode port inside VM
 	startupTimeout = 30 * time.Second
+	serviceName    = "dabbi-opencode.service" // systemd unit installed by cloud-init
+	unitPath       = "/etc/systemd/system/" + serviceName
 )
 
+// Default host ports agent listeners are assigned from
+const (
+	DefaultBasePort  = 11000 // first port
+	DefaultPortRange = 1000  // number of ports
+)
+
+// readHeaderTimeout bounds how long a client may take to send request headers
+const readHeaderTimeout = 10 * time.Second
+
 // Manager manages HTTP reverse proxy listeners for VM agents
 type Manager struct {
 	mp        multipass.Client
-	listeners sync.Map // vmName -> *listener
+	listeners sync.Map   // vmName -> *listener
+	authToken string     // expected OPENCODE_SERVER_PASSWORD, re-injected by Heal
+	autoHeal  bool       // restart an inactive opencode service in GetURL
+	subnet    *net.IPNet // preferred VM network when a VM has several IPs
+	basePort  int        // first host port of the listener range
+	portRange int        // number of ports in the range
 }
 
 type listener struct {
@@ -32,18 +51,54 @@ type listener struct {
 	listener net.Listener
 	vmName   string
 	port     int
+	done     chan struct{} // closed once the server stops serving
 }
 
 // NewManager creates a new agent manager
 func NewManager(mp multipass.Client) *Manager {
-	return &Manager{mp: mp}
+	return &Manager{mp: mp, basePort: DefaultBasePort, portRange: DefaultPortRange}
+}
+
+// SetPortRange sets the host ports listeners are assigned from: count
+// ports starting at base. Zero keeps the default for either. Changing the
+// range moves every VM's port, so set it before starting listeners.
+func (m *Manager) SetPortRange(base, count int) error {
+	if base == 0 {
+		base = DefaultBasePort
+	}
+	if count == 0 {
+		count = DefaultPortRange
+	}
+	if base < 1 || count < 1 || base+count-1 > 65535 {
+		return fmt.Errorf("invalid agent port range: %d ports from %d must fit in 1-65535", count, base)
+	}
+	m.basePort, m.portRange = base, count
+	return nil
+}
+
+// PortRange returns the first port and number of ports listeners use
+func (m *Manager) PortRange() (base, count int) {
+	return m.basePort, m.portRange
+}
+
+// SetAuthToken sets the token Heal writes into the opencode unit when it is missing
+func (m *Manager) SetAuthToken(token string) {
+	m.authToken = token
+}
+
+// SetAutoHeal controls whether GetURL restarts an inactive opencode service first
+func (m *Manager) SetAutoHeal(enabled bool) {
+	m.autoHeal = enabled
+}
+
+// SetPreferredSubnet sets the network whose VM addresses are proxied to first
+func (m *Manager) SetPreferredSubnet(subnet *net.IPNet) {
+	m.subnet = subnet
 }
 
 // PortForVM returns the deterministic port for a VM based on its name
-func PortForVM(vmName string) int {
-	h := fnv.New32a()
-	h.Write([]byte(vmName))
-	return basePort + int(h.Sum32()%portRange)
+func (m *Manager) PortForVM(vmName string) int {
+	return portmap.Port(vmName, m.basePort, m.portRange)
 }
 
 // Start starts the agent proxy listener for a VM
@@ -63,12 +118,12 @@ func (m *Manager) Start(vmName string) error {
 		return fmt.Errorf("VM '%s' is not running (state: %s)", vmName, info.State)
 	}
 
-	if len(info.IPv4) == 0 {
+	vmIP := multipass.PickReachableIP(vmName, info, agentPort, m.subnet)
+	if vmIP == "" {
 		return fmt.Errorf("VM '%s' has no IP address", vmName)
 	}
 
-	vmIP := info.IPv4[0]
-	port := PortForVM(vmName)
+	port := m.PortForVM(vmName)
 
 	// Create listener on the determined port
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
@@ -77,35 +132,15 @@ func (m *Manager) Start(vmName string) error {
 	}
 
 	// Create reverse proxy to VM
-	target, _ := url.Parse(fmt.Sprintf("http://%s:%d", vmIP, agentPort))
-	proxy := httputil.NewSingleHostReverseProxy(target)
-
-	// Custom director to set headers
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		req.Header.Set("X-Forwarded-Host", req.Host)
-		req.Header.Set("X-Forwarded-Proto", "http")
-	}
-
-	// Error handler
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		http.Error(w, fmt.Sprintf("Agent proxy error: %v", err), http.StatusBadGateway)
-	}
-
-	// Create HTTP server
-	server := &http.Server{
-		Handler:      proxy,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
-	}
+	target, _ := url.Parse("http://" + net.JoinHostPort(vmIP, strconv.Itoa(agentPort)))
+	server := newProxyServer(vmName, target)
 
 	l := &listener{
 		server:   server,
 		listener: ln,
 		vmName:   vmName,
 		port:     port,
+		done:     make(chan struct{}),
 	}
 
 	m.listeners.Store(vmName, l)
@@ -115,12 +150,53 @@ func (m *Manager) Start(vmName string) error {
 		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
 			// Log error but don't crash - listener might have been stopped
 		}
+		close(l.done)
 		m.listeners.Delete(vmName)
 	}()
 
 	return nil
 }
 
+// newProxyServer creates the HTTP server that reverse proxies to an agent.
+// opencode keeps websocket and SSE connections open for the whole session,
+// so there is no read or write timeout (a 30s WriteTimeout would cut them);
+// ReadHeaderTimeout still drops slow-loris clients that never finish a request.
+func newProxyServer(vmName string, target *url.URL) *http.Server {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	// Flush every write immediately so streamed events aren't buffered
+	proxy.FlushInterval = -1
+
+	// Custom director to set headers
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		originalDirector(req)
+		req.Header.Set("X-Forwarded-Host", req.Host)
+		req.Header.Set("X-Forwarded-Proto", "http")
+		if id := httpkit.GetRequestID(req); id != "" {
+			req.Header.Set(httpkit.RequestIDHeader, id)
+		}
+	}
+
+	// Error handler
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		multipass.ForgetReachableIP(vmName)
+		msg := fmt.Sprintf("Agent proxy error: %v", err)
+		if id := httpkit.GetRequestID(r); id != "" {
+			msg += fmt.Sprintf(" (request %s)", id)
+		}
+		http.Error(w, msg, http.StatusBadGateway)
+	}
+
+	// This server doesn't go through the daemon's router, so it assigns
+	// request IDs itself
+	return &http.Server{
+		Handler:           httpkit.RequestID(proxy),
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       120 * time.Second,
+	}
+}
+
 // Stop stops the agent proxy listener for a VM
 func (m *Manager) Stop(vmName string) {
 	if val, exists := m.listeners.LoadAndDelete(vmName); exists {
@@ -133,12 +209,16 @@ func (m *Manager) Stop(vmName string) {
 
 // GetURL returns the agent URL for a VM, starting the listener if needed
 func (m *Manager) GetURL(vmName, host string) (string, error) {
+	if err := m.MaybeHeal(vmName); err != nil {
+		return "", err
+	}
+
 	// Start listener if not running
 	if err := m.Start(vmName); err != nil {
 		return "", err
 	}
 
-	port := PortForVM(vmName)
+	port := m.PortForVM(vmName)
 
 	// Extract hostname without port from the host header
 	hostname := host
@@ -158,26 +238,130 @@ func (m *Manager) StopAll() {
 	})
 }
 
+// Assignment is the host port an agent listener holds for a VM
+type Assignment struct {
+	VM      string `json:"vm"`
+	Port    int    `json:"port"`
+	Running bool   `json:"running"` // false once the listener has stopped serving
+}
+
+// List returns the current listeners, sorted by VM name
+func (m *Manager) List() []Assignment {
+	var list []Assignment
+	m.listeners.Range(func(key, value any) bool {
+		l := value.(*listener)
+		a := Assignment{VM: l.vmName, Port: l.port, Running: true}
+		select {
+		case <-l.done:
+			a.Running = false
+		default:
+		}
+		list = append(list, a)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].VM < list[j].VM })
+	return list
+}
+
 // IsRunning checks if a listener is running for a VM
 func (m *Manager) IsRunning(vmName string) bool {
 	_, exists := m.listeners.Load(vmName)
 	return exists
 }
 
+// Status reports the health of the opencode agent inside a VM
+type Status struct {
+	ServiceActive bool `json:"service_active"` // systemd unit is active
+	PortOpen      bool `json:"port_open"`      // agent port accepts connections
+}
+
+// Status checks the opencode service and port inside a running VM
+func (m *Manager) Status(vmName string) (*Status, error) {
+	info, err := m.runningInfo(vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	// `systemctl is-active` exits non-zero for anything but "active"
+	out, err := m.mp.Exec(vmName, "systemctl", "is-active", serviceName)
+
+	return &Status{
+		ServiceActive: err == nil && strings.TrimSpace(out) == "active",
+		PortOpen:      proxy.PortOpen(multipass.PickReachableIP(vmName, info, agentPort, m.subnet), agentPort, 2*time.Second),
+	}, nil
+}
+
+// Heal restarts the opencode service inside a VM if it is not active,
+// first restoring the auth token in its unit file if that has gone missing
+func (m *Manager) Heal(vmName string) error {
+	out, err := m.mp.Exec(vmName, "systemctl", "is-active", serviceName)
+	if err == nil && strings.TrimSpace(out) == "active" {
+		return nil
+	}
+
+	if m.authToken != "" {
+		if err := m.injectAuthToken(vmName); err != nil {
+			return err
+		}
+	}
+
+	if _, err := m.mp.Exec(vmName, "sudo", "systemctl", "restart", serviceName); err != nil {
+		return fmt.Errorf("opencode is not running in VM '%s' and could not be restarted: %w", vmName, err)
+	}
+	return nil
+}
+
+// MaybeHeal calls Heal when auto-heal is enabled
+func (m *Manager) MaybeHeal(vmName string) error {
+	if !m.autoHeal {
+		return nil
+	}
+	return m.Heal(vmName)
+}
+
+// injectAuthToken rewrites the unit's OPENCODE_SERVER_PASSWORD if it does not
+// already hold the daemon's token (e.g. the cloud-init placeholder was left in)
+func (m *Manager) injectAuthToken(vmName string) error {
+	env := "OPENCODE_SERVER_PASSWORD=" + m.authToken
+	if _, err := m.mp.Exec(vmName, "grep", "-qxF", `Environment="`+env+`"`, unitPath); err == nil {
+		return nil
+	}
+
+	expr := fmt.Sprintf(`s|^Environment="OPENCODE_SERVER_PASSWORD=.*"$|Environment="%s"|`, sedEscape(env))
+	if _, err := m.mp.Exec(vmName, "sudo", "sed", "-i", expr, unitPath); err != nil {
+		return fmt.Errorf("failed to update %s in VM '%s': %w", serviceName, vmName, err)
+	}
+	if _, err := m.mp.Exec(vmName, "sudo", "systemctl", "daemon-reload"); err != nil {
+		return fmt.Errorf("failed to reload systemd in VM '%s': %w", vmName, err)
+	}
+	return nil
+}
+
+// sedEscape escapes characters that are special in a sed replacement using | as the delimiter
+func sedEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, `&`, `\&`).Replace(s)
+}
+
 // VerifyVM checks if a VM exists and is running (without starting a listener)
 func (m *Manager) VerifyVM(vmName string) error {
+	_, err := m.runningInfo(vmName)
+	return err
+}
+
+// runningInfo returns VM info if the VM is running and has an IP address
+func (m *Manager) runningInfo(vmName string) (*multipass.InstanceInfo, error) {
 	info, err := m.mp.Info(vmName)
 	if err != nil {
-		return fmt.Errorf("VM '%s' not found: %w", vmName, err)
+		return nil, fmt.Errorf("VM '%s' not found: %w", vmName, err)
 	}
 
 	if info.State != multipass.StateRunning {
-		return fmt.Errorf("VM '%s' is not running (state: %s)", vmName, info.State)
+		return nil, fmt.Errorf("VM '%s' is not running (state: %s)", vmName, info.State)
 	}
 
 	if len(info.IPv4) == 0 {
-		return fmt.Errorf("VM '%s' has no IP address", vmName)
+		return nil, fmt.Errorf("VM '%s' has no IP address", vmName)
 	}
 
-	return nil
+	return info, nil
 }
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_Heal(t *testing.T) {
+	t.Run("active_service_is_left_alone", func(t *testing.T) {
+		mockMP := new(testutil.MockMultipassClient)
+		mockMP.On("Exec", "test-vm", []string{"systemctl", "is-active", serviceName}).Return("active\n", nil)
+
+		m := NewManager(mockMP)
+		m.SetAuthToken("token")
+
+		assert.NoError(t, m.Heal("test-vm"))
+		mockMP.AssertExpectations(t)
+		mockMP.AssertNumberOfCalls(t, "Exec", 1)
+	})
+
+	t.Run("inactive_service_is_restarted", func(t *testing.T) {
+		mockMP := new(testutil.MockMultipassClient)
+		mockMP.On("Exec", "test-vm", []string{"systemctl", "is-active", serviceName}).
+			Return("inactive\n", errors.New("exit status 3"))
+		mockMP.On("Exec", "test-vm", []string{"grep", "-qxF", `Environment="OPENCODE_SERVER_PASSWORD=token"`, unitPath}).
+			Return("", nil)
+		mockMP.On("Exec", "test-vm", []string{"sudo", "systemctl", "restart", serviceName}).Return("", nil)
+
+		m := NewManager(mockMP)
+		m.SetAuthToken("token")
+
+		assert.NoError(t, m.Heal("test-vm"))
+		mockMP.AssertExpectations(t)
+	})
+
+	t.Run("missing_token_is_reinjected", func(t *testing.T) {
+		mockMP := new(testutil.MockMultipassClient)
+		mockMP.On("Exec", "test-vm", []string{"systemctl", "is-active", serviceName}).
+			Return("inactive\n", errors.New("exit status 3"))
+		mockMP.On("Exec", "test-vm", []string{"grep", "-qxF", `Environment="OPENCODE_SERVER_PASSWORD=a&b"`, unitPath}).
+			Return("", errors.New("exit status 1"))
+		mockMP.On("Exec", "test-vm", []string{"sudo", "sed", "-i",
+			`s|^Environment="OPENCODE_SERVER_PASSWORD=.*"$|Environment="OPENCODE_SERVER_PASSWORD=a\&b"|`, unitPath}).
+			Return("", nil)
+		mockMP.On("Exec", "test-vm", []string{"sudo", "systemctl", "daemon-reload"}).Return("", nil)
+		mockMP.On("Exec", "test-vm", []string{"sudo", "systemctl", "restart", serviceName}).Return("", nil)
+
+		m := NewManager(mockMP)
+		m.SetAuthToken("a&b")
+
+		assert.NoError(t, m.Heal("test-vm"))
+		mockMP.AssertExpectations(t)
+	})
+
+	t.Run("restart_failure", func(t *testing.T) {
+		mockMP := new(testutil.MockMultipassClient)
+		mockMP.On("Exec", "test-vm", []string{"systemctl", "is-active", serviceName}).
+			Return("failed\n", errors.New("exit status 3"))
+		mockMP.On("Exec", "test-vm", []string{"sudo", "systemctl", "restart", serviceName}).
+			Return("", errors.New("unit not found"))
+
+		m := NewManager(mockMP)
+
+		err := m.Heal("test-vm")
+		assert.ErrorContains(t, err, "could not be restarted")
+		mockMP.AssertExpectations(t)
+	})
+}
+
+func TestManager_MaybeHeal_Disabled(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+
+	m := NewManager(mockMP)
+	assert.NoError(t, m.MaybeHeal("test-vm"))
+	mockMP.AssertNotCalled(t, "Exec", mock.Anything, mock.Anything)
+}
+
+func TestNewProxyServer_Streams(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: second\n\n")
+	}))
+	defer upstream.Close()
+	defer close(release)
+
+	target, _ := url.Parse(upstream.URL)
+	srv := newProxyServer("test-vm", target)
+
+	// No read/write deadline may cut a long-lived websocket or SSE stream
+	assert.Zero(t, srv.ReadTimeout)
+	assert.Zero(t, srv.WriteTimeout)
+	assert.Equal(t, readHeaderTimeout, srv.ReadHeaderTimeout)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// The first event must arrive while upstream is still holding the stream open
+	lines := make(chan string)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+
+	select {
+	case line := <-lines:
+		assert.Equal(t, "data: first\n", line)
+	case <-time.After(2 * time.Second):
+		t.Fatal("streamed event was buffered by the proxy")
+	}
+}
+
+func TestManager_SetPortRange(t *testing.T) {
+	m := NewManager(new(testutil.MockMultipassClient))
+
+	base, count := m.PortRange()
+	assert.Equal(t, DefaultBasePort, base)
+	assert.Equal(t, DefaultPortRange, count)
+
+	require.NoError(t, m.SetPortRange(20000, 10))
+	for _, vm := range []string{"a", "b", "dev", "some-longer-vm-name"} {
+		port := m.PortForVM(vm)
+		assert.GreaterOrEqual(t, port, 20000, vm)
+		assert.Less(t, port, 20010, vm)
+	}
+
+	// Zero keeps the default for either value
+	require.NoError(t, m.SetPortRange(0, 5))
+	base, count = m.PortRange()
+	assert.Equal(t, DefaultBasePort, base)
+	assert.Equal(t, 5, count)
+
+	assert.Error(t, m.SetPortRange(65000, 1000))
+	assert.Error(t, m.SetPortRange(-1, 10))
+	assert.Error(t, m.SetPortRange(20000, -10))
+	base, count = m.PortRange()
+	assert.Equal(t, DefaultBasePort, base, "a rejected range leaves the old one")
+	assert.Equal(t, 5, count)
+}
+
+func TestManager_StartUsesPortRange(t *testing.T) {
+	// A one-port range on a port known to be free
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "dev").Return(testutil.RunningVM("dev", "192.0.2.1"), nil)
+
+	m := NewManager(mockMP)
+	require.NoError(t, m.SetPortRange(port, 1))
+	require.NoError(t, m.Start("dev"))
+	defer m.StopAll()
+
+	assert.Equal(t, []Assignment{{VM: "dev", Port: port, Running: true}}, m.List())
+
+	m.Stop("dev")
+	assert.Empty(t, m.List())
+}
@@ -0,0 +1,199 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/config"
+)
+
+const logFile = "audit.log"
+
+// Sources of audit entries
+const (
+	SourceAPI = "api"
+	SourceCLI = "cli"
+)
+
+// Results of audited actions
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+// Entry is one audited action. Credentials are identified by how they were
+// presented, never by value.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`              // "api" or "cli"
+	Action   string    `json:"action"`              // route ("POST /api/vms/{name}/state") or command ("snapshot restore")
+	VM       string    `json:"vm,omitempty"`        // VM acted on, if any
+	Detail   string    `json:"detail,omitempty"`    // handler-supplied specifics, e.g. "stop"
+	Auth     string    `json:"auth,omitempty"`      // "cookie", "bearer" or "key:<name>" for the API, the local user for the CLI
+	ClientIP string    `json:"client_ip,omitempty"` // API caller address
+	Status   int       `json:"status,omitempty"`    // HTTP status of API calls
+	Result   string    `json:"result"`              // "ok" or "error"
+	Error    string    `json:"error,omitempty"`     // CLI error message
+}
+
+// defaultMaxSize is the size at which the log is rotated
+const defaultMaxSize = 10 << 20
+
+// recentChunk is how much of the log Recent reads at a time, from the end
+const recentChunk = 64 << 10
+
+// Log appends audit entries as JSON lines to ~/.dabbi/audit.log. The CLI and
+// daemon both write to it; O_APPEND keeps their lines from interleaving.
+// Once the file reaches its size limit it is moved to audit.log.1, replacing
+// the previous one, so at most two files are kept.
+type Log struct {
+	path    string
+	maxSize int64
+	mu      sync.Mutex
+}
+
+// NewLog creates an audit log backed by the given file
+func NewLog(path string) *Log {
+	return &Log{path: path, maxSize: defaultMaxSize}
+}
+
+// DefaultPath returns the path to the audit log (~/.dabbi/audit.log)
+func DefaultPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, config.ConfigDir, logFile), nil
+}
+
+// Append writes an entry, stamping it with the current time if unset
+func (l *Log) Append(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(l.path); err == nil && fi.Size()+int64(len(line)) >= l.maxSize {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Recent returns up to limit of the latest entries, newest first, reading
+// back from the end of the log and into the rotated file if needed. Lines
+// that don't parse are skipped.
+func (l *Log) Recent(limit int) ([]Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []Entry{}
+	for _, path := range []string{l.path, l.path + ".1"} {
+		var err error
+		if entries, err = readBackwards(path, entries, limit); err != nil {
+			return nil, err
+		}
+		if len(entries) >= limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// readBackwards appends entries from the end of the file at path to
+// entries, newest first, until there are limit of them. A missing file has
+// none.
+func readBackwards(path string, entries []Entry, limit int) ([]Entry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	off, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	// partial is the start of the file's last unread line, which continues
+	// from the chunk before it
+	var partial []byte
+	for off > 0 && len(entries) < limit {
+		n := min(off, recentChunk)
+		off -= n
+		chunk := make([]byte, n, n+int64(len(partial)))
+		if _, err := f.ReadAt(chunk, off); err != nil {
+			return nil, err
+		}
+		lines := bytes.Split(append(chunk, partial...), []byte{'\n'})
+		first := 0
+		if off > 0 {
+			partial, first = lines[0], 1
+		}
+		for i := len(lines) - 1; i >= first && len(entries) < limit; i-- {
+			var e Entry
+			if err := json.Unmarshal(lines[i], &e); err == nil {
+				entries = append(entries, e)
+			}
+		}
+	}
+	return entries, nil
+}
+
+type noteKey struct{}
+
+// Note holds what handlers add to the audit entry of their request
+type Note struct {
+	VM     string
+	Detail string
+}
+
+// WithNote returns a context carrying a Note for SetVM and SetDetail. The
+// audit middleware adds it to each audited request.
+func WithNote(ctx context.Context) (context.Context, *Note) {
+	note := new(Note)
+	return context.WithValue(ctx, noteKey{}, note), note
+}
+
+// SetVM names the VM an audited request acts on, for routes where it is in
+// the body rather than the URL. It does nothing for unaudited requests.
+func SetVM(ctx context.Context, vm string) {
+	if note, ok := ctx.Value(noteKey{}).(*Note); ok {
+		note.VM = vm
+	}
+}
+
+// SetDetail records specifics of an audited request, such as the requested
+// state change. It does nothing for unaudited requests.
+func SetDetail(ctx context.Context, detail string) {
+	if note, ok := ctx.Value(noteKey{}).(*Note); ok {
+		note.Detail = detail
+	}
+}
@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLog(t *testing.T) *Log {
+	return NewLog(filepath.Join(t.TempDir(), "audit.log"))
+}
+
+func TestLog_AppendRecent(t *testing.T) {
+	log := newTestLog(t)
+
+	entries, err := log.Recent(10)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, vm := range []string{"vm1", "vm2", "vm3"} {
+		require.NoError(t, log.Append(Entry{
+			Time:   base.Add(time.Duration(i) * time.Minute),
+			Source: SourceAPI,
+			Action: "DELETE /api/vms/{name}",
+			VM:     vm,
+			Result: ResultOK,
+		}))
+	}
+
+	entries, err = log.Recent(2)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "vm3", entries[0].VM)
+	assert.Equal(t, "vm2", entries[1].VM)
+	assert.Equal(t, base.Add(2*time.Minute), entries[0].Time)
+
+	entries, err = log.Recent(10)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
+func TestLog_AppendStampsTime(t *testing.T) {
+	log := newTestLog(t)
+	require.NoError(t, log.Append(Entry{Source: SourceCLI, Action: "stop", Result: ResultOK}))
+
+	entries, err := log.Recent(1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.WithinDuration(t, time.Now(), entries[0].Time, time.Minute)
+}
+
+func TestLog_RecentSkipsBadLines(t *testing.T) {
+	log := newTestLog(t)
+	require.NoError(t, log.Append(Entry{Action: "first", Result: ResultOK}))
+
+	f, err := os.OpenFile(log.path, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteString("{truncated\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	require.NoError(t, log.Append(Entry{Action: "second", Result: ResultOK}))
+
+	entries, err := log.Recent(10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "second", entries[0].Action)
+	assert.Equal(t, "first", entries[1].Action)
+}
+
+func TestLog_Rotates(t *testing.T) {
+	log := newTestLog(t)
+	log.maxSize = 300
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, log.Append(Entry{Action: fmt.Sprintf("action-%d", i), Result: ResultOK}))
+	}
+
+	info, err := os.Stat(log.path)
+	require.NoError(t, err)
+	assert.Less(t, info.Size(), log.maxSize)
+	_, err = os.Stat(log.path + ".1")
+	require.NoError(t, err, "the full log is kept as audit.log.1")
+
+	// Recent reads on into the rotated file
+	entries, err := log.Recent(4)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	for i, e := range entries {
+		assert.Equal(t, fmt.Sprintf("action-%d", 9-i), e.Action)
+	}
+}
+
+func TestLog_RecentReadsFromEnd(t *testing.T) {
+	log := newTestLog(t)
+	log.maxSize = 1 << 30
+
+	// Enough entries that the latest ones span several chunks
+	n := 3 * recentChunk / 60
+	for i := 0; i < n; i++ {
+		require.NoError(t, log.Append(Entry{Action: fmt.Sprintf("action-%d", i), Result: ResultOK}))
+	}
+
+	entries, err := log.Recent(n)
+	require.NoError(t, err)
+	require.Len(t, entries, n)
+	for i, e := range entries {
+		require.Equal(t, fmt.Sprintf("action-%d", n-1-i), e.Action)
+	}
+}
+
+func TestNote(t *testing.T) {
+	// Without a note in the context these are no-ops
+	SetVM(context.Background(), "vm1")
+	SetDetail(context.Background(), "stop")
+
+	ctx, note := WithNote(context.Background())
+	SetVM(ctx, "vm1")
+	SetDetail(ctx, "stop")
+	assert.Equal(t, Note{VM: "vm1", Detail: "stop"}, *note)
+}
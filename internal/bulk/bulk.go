@@ -0,0 +1,161 @@
+package bulk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// Action is a state change applied to many VMs at once
+type Action string
+
+const (
+	ActionStart Action = "start"
+	ActionStop  Action = "stop"
+)
+
+// Result statuses
+const (
+	StatusOK      = "ok"
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+)
+
+// DefaultParallel is how many VMs are started or stopped at once when
+// Options.Parallel is unset
+const DefaultParallel = 4
+
+// Options selects the VMs an action applies to
+type Options struct {
+	Names         []string // VMs to act on; empty means every VM
+	SkipUserStops bool     // start: skip VMs the user stopped on purpose
+	Parallel      int      // VMs acted on at once (0 = DefaultParallel)
+}
+
+// Result is what happened to one VM
+type Result struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`           // ok, skipped, or failed
+	Detail string `json:"detail,omitempty"` // why it was skipped, or the error
+}
+
+// ParseAction validates an action name
+func ParseAction(s string) (Action, error) {
+	switch a := Action(s); a {
+	case ActionStart, ActionStop:
+		return a, nil
+	}
+	return "", fmt.Errorf("invalid action %q, must be 'start' or 'stop'", s)
+}
+
+// Run applies action to the selected VMs, a few at a time, and returns a
+// result for each, sorted by name. Stop only touches running VMs and start
+// only stopped or suspended ones; the rest are reported as skipped. Only
+// listing the VMs can fail Run itself.
+func Run(mp multipass.Client, ls *labels.Store, action Action, opts Options) ([]Result, error) {
+	vms, err := mp.List()
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]string, len(vms))
+	for _, vm := range vms {
+		states[vm.Name] = vm.State
+	}
+
+	names := opts.Names
+	if len(names) == 0 {
+		for _, vm := range vms {
+			names = append(names, vm.Name)
+		}
+	}
+	sort.Strings(names)
+
+	var userStopped map[string]map[string]string
+	if action == ActionStart && opts.SkipUserStops && ls != nil {
+		if userStopped, err = ls.All(); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]Result, len(names))
+	var targets []int
+	for i, name := range names {
+		results[i] = Result{Name: name}
+		state, ok := states[name]
+		switch {
+		case !ok:
+			results[i].Status, results[i].Detail = StatusFailed, "not found"
+		case action == ActionStop && state != multipass.StateRunning:
+			results[i].Status, results[i].Detail = StatusSkipped, "not running ("+strings.ToLower(state)+")"
+		case action == ActionStart && state != multipass.StateStopped && state != multipass.StateSuspended:
+			results[i].Status, results[i].Detail = StatusSkipped, strings.ToLower(state)
+		case action == ActionStart && userStopped[name][labels.StoppedByUserKey] != "":
+			results[i].Status, results[i].Detail = StatusSkipped, "stopped by user"
+		default:
+			targets = append(targets, i)
+		}
+	}
+
+	parallel := opts.Parallel
+	if parallel <= 0 {
+		parallel = DefaultParallel
+	}
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for _, i := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(r *Result) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			var err error
+			if action == ActionStart {
+				err = mp.Start(r.Name)
+			} else {
+				err = mp.Stop(r.Name)
+			}
+			if err != nil {
+				r.Status, r.Detail = StatusFailed, err.Error()
+				return
+			}
+			r.Status = StatusOK
+		}(&results[i])
+	}
+	wg.Wait()
+
+	// A started VM is no longer one the user chose to keep stopped
+	if action == ActionStart && ls != nil {
+		for _, i := range targets {
+			if results[i].Status == StatusOK {
+				_ = ls.Remove(results[i].Name, labels.StoppedByUserKey)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// Summary counts results by status, e.g. "3 stopped, 1 skipped, 0 failed"
+func Summary(action Action, results []Result) string {
+	var ok, skipped, failed int
+	for _, r := range results {
+		switch r.Status {
+		case StatusOK:
+			ok++
+		case StatusSkipped:
+			skipped++
+		case StatusFailed:
+			failed++
+		}
+	}
+	done := "started"
+	if action == ActionStop {
+		done = "stopped"
+	}
+	return fmt.Sprintf("%d %s, %d skipped, %d failed", ok, done, skipped, failed)
+}
@@ -0,0 +1,124 @@
+package bulk
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLabelStore(t *testing.T) *labels.Store {
+	return labels.NewStore(filepath.Join(t.TempDir(), "labels.json"))
+}
+
+var testVMs = []multipass.ListInstance{
+	{Name: "web", State: multipass.StateRunning},
+	{Name: "db", State: multipass.StateRunning},
+	{Name: "old", State: multipass.StateStopped},
+	{Name: "paused", State: multipass.StateSuspended},
+}
+
+func TestRun_StopAll(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(testVMs, nil)
+	mockMP.On("Stop", "web").Return(nil)
+	mockMP.On("Stop", "db").Return(errors.New("timed out"))
+
+	results, err := Run(mockMP, newTestLabelStore(t), ActionStop, Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, []Result{
+		{Name: "db", Status: StatusFailed, Detail: "timed out"},
+		{Name: "old", Status: StatusSkipped, Detail: "not running (stopped)"},
+		{Name: "paused", Status: StatusSkipped, Detail: "not running (suspended)"},
+		{Name: "web", Status: StatusOK},
+	}, results)
+	assert.Equal(t, "1 stopped, 2 skipped, 1 failed", Summary(ActionStop, results))
+	mockMP.AssertExpectations(t)
+}
+
+func TestRun_StartSkipsUserStops(t *testing.T) {
+	ls := newTestLabelStore(t)
+	require.NoError(t, ls.Mark("old", labels.StoppedByUserKey))
+	require.NoError(t, ls.Mark("paused", labels.StoppedByUserKey))
+	require.NoError(t, ls.Set("paused", map[string]string{"team": "a"}))
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(testVMs, nil)
+
+	results, err := Run(mockMP, ls, ActionStart, Options{SkipUserStops: true})
+	require.NoError(t, err)
+	for _, r := range results {
+		assert.Equal(t, StatusSkipped, r.Status, r.Name)
+	}
+	mockMP.AssertNotCalled(t, "Start", mock.Anything)
+
+	// Without the flag they are started, and the marker is cleared
+	mockMP.On("Start", "old").Return(nil)
+	mockMP.On("Start", "paused").Return(nil)
+	results, err = Run(mockMP, ls, ActionStart, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "2 started, 2 skipped, 0 failed", Summary(ActionStart, results))
+
+	all, err := ls.All()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"paused": {"team": "a"}}, all)
+}
+
+func TestRun_Names(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(testVMs, nil)
+	mockMP.On("Stop", "web").Return(nil)
+
+	results, err := Run(mockMP, nil, ActionStop, Options{Names: []string{"web", "ghost"}})
+	require.NoError(t, err)
+	assert.Equal(t, []Result{
+		{Name: "ghost", Status: StatusFailed, Detail: "not found"},
+		{Name: "web", Status: StatusOK},
+	}, results)
+}
+
+func TestRun_Parallel(t *testing.T) {
+	var vms []multipass.ListInstance
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		vms = append(vms, multipass.ListInstance{Name: name, State: multipass.StateRunning})
+	}
+
+	var running, peak int32
+	var mu sync.Mutex
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(vms, nil)
+	mockMP.On("Stop", mock.Anything).Run(func(mock.Arguments) {
+		n := atomic.AddInt32(&running, 1)
+		mu.Lock()
+		if n > peak {
+			peak = n
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}).Return(nil)
+
+	results, err := Run(mockMP, nil, ActionStop, Options{Parallel: 2})
+	require.NoError(t, err)
+	assert.Len(t, results, 6)
+	assert.Equal(t, int32(2), peak)
+}
+
+func TestParseAction(t *testing.T) {
+	a, err := ParseAction("stop")
+	require.NoError(t, err)
+	assert.Equal(t, ActionStop, a)
+
+	_, err = ParseAction("restart")
+	assert.Error(t, err)
+}
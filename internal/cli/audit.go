@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"os/user"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/audit"
+	"github.com/spf13/cobra"
+)
+
+// auditAnnotation marks commands that change VMs directly through multipass.
+// Commands that go through the daemon are audited there instead.
+const auditAnnotation = "dabbi/audit"
+
+// audited marks cmd to be recorded in the audit log when it runs
+func audited(cmd *cobra.Command) *cobra.Command {
+	if cmd.Annotations == nil {
+		cmd.Annotations = make(map[string]string)
+	}
+	cmd.Annotations[auditAnnotation] = "true"
+	return cmd
+}
+
+// auditCommand records an audited command and its outcome. Only the
+// command and its first argument (the VM) are logged, never flag values.
+func auditCommand(cmd *cobra.Command, runErr error) {
+	if cmd == nil || cmd.Annotations[auditAnnotation] == "" {
+		return
+	}
+	path, err := audit.DefaultPath()
+	if err != nil {
+		return
+	}
+
+	entry := audit.Entry{
+		Source: audit.SourceCLI,
+		Action: strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" "),
+		Result: audit.ResultOK,
+	}
+	if args := cmd.Flags().Args(); len(args) > 0 && cmd.Name() != "raw" {
+		entry.VM = args[0]
+	}
+	if u, err := user.Current(); err == nil {
+		entry.Auth = u.Username
+	}
+	if runErr != nil {
+		entry.Result = audit.ResultError
+		entry.Error = runErr.Error()
+	}
+	_ = audit.NewLog(path).Append(entry)
+}
@@ -0,0 +1,102 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func newExportCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "export <vm-name>",
+		Short: "Export a VM's setup as a JSON bundle",
+		Long: `Print a JSON bundle describing a running VM: CPUs, memory, disk, Ubuntu
+release, network restrictions, mounts, and labels. Disk contents are not
+included. Recreate the VM elsewhere with 'dabbi import'.
+
+Requires the daemon to be running.
+
+Example:
+  dabbi export my-vm > my-vm.json`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var bundle json.RawMessage
+			if err := daemonRequest(http.MethodGet, "/vms/"+url.PathEscape(args[0])+"/export", nil, &bundle); err != nil {
+				return err
+			}
+
+			out, err := json.MarshalIndent(bundle, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+			return nil
+		},
+	}
+}
+
+func newImportCmd() *cobra.Command {
+	var name string
+
+	cmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "Create a VM from an exported bundle",
+		Long: `Create a VM from a bundle written by 'dabbi export', then recreate its
+mounts and labels. The bundle is read from the file, or from stdin if no
+file is given. Mounts whose host path doesn't exist here are reported and
+skipped.
+
+Requires the daemon to be running.
+
+Examples:
+  dabbi import < my-vm.json
+  dabbi import my-vm.json --name my-vm-copy`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var data []byte
+			var err error
+			if len(args) == 1 {
+				data, err = os.ReadFile(args[0])
+			} else {
+				data, err = io.ReadAll(os.Stdin)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read bundle: %w", err)
+			}
+			if !json.Valid(data) {
+				return fmt.Errorf("bundle is not valid JSON")
+			}
+
+			path := "/vms/import"
+			if name != "" {
+				path += "?name=" + url.QueryEscape(name)
+			}
+
+			fmt.Println("Creating VM from bundle (this may take a few minutes)...")
+
+			var resp struct {
+				Name   string            `json:"name"`
+				Failed map[string]string `json:"failed"`
+			}
+			// Launching waits for cloud-init, so don't time out
+			if err := daemonRequestWithTimeout(http.MethodPost, path, json.RawMessage(data), &resp, 0); err != nil {
+				return err
+			}
+
+			fmt.Printf("VM '%s' created\n", resp.Name)
+			for vmPath, msg := range resp.Failed {
+				fmt.Fprintf(os.Stderr, "Warning: could not mount %s: %s\n", vmPath, msg)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&name, "name", "", "Name for the new VM (default: the name in the bundle)")
+
+	return cmd
+}
@@ -1,29 +1,116 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/quota"
 	"github.com/spf13/cobra"
 )
 
 func newCloneCmd() *cobra.Command {
-	return &cobra.Command{
+	var snapshot string
+	var cpus int
+	var memory, disk string
+
+	cmd := &cobra.Command{
 		Use:   "clone <source> <new_name>",
 		Short: "Clone a VM",
 		Long: `Clone an existing VM to create a new instance.
 
-This creates a deep copy of the VM including disk and state.`,
+This creates a deep copy of the VM including disk and state. The source VM
+must be stopped. Use --snapshot to clone the VM as it was at a snapshot, and
+--cpu/--mem/--disk to resize the clone. Multipass can only clone a VM as it
+is now, so with --snapshot the VM is restored to the snapshot for the clone
+and then back to its current state.
+
+Example:
+  dabbi clone myvm myvm-copy
+  dabbi clone myvm experiment --snapshot clean-slate --mem 8G`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			source := args[0]
 			dest := args[1]
+			if err := multipass.ValidateVMName(dest); err != nil {
+				return err
+			}
+
+			if memory != "" {
+				if _, err := multipass.ParseSize(memory); err != nil {
+					return fmt.Errorf("--mem: %w", err)
+				}
+			}
+			if disk != "" {
+				if _, err := multipass.ParseSize(disk); err != nil {
+					return fmt.Errorf("--disk: %w", err)
+				}
+			}
+
+			info, err := mpClient.Info(source)
+			if err != nil {
+				return err
+			}
+			if info.State != multipass.StateStopped {
+				return fmt.Errorf("VM '%s' is %s; stop it before cloning", source, strings.ToLower(info.State))
+			}
+			limits, err := quota.FromConfig(cfg)
+			if err != nil {
+				return err
+			}
+			if err := quota.CheckClone(mpClient, limits); err != nil {
+				return err
+			}
 
 			fmt.Printf("Cloning VM '%s' to '%s'...\n", source, dest)
-			if err := mpClient.Clone(source, dest); err != nil {
+			if snapshot != "" {
+				err = mpClient.CloneFromSnapshot(source, snapshot, dest)
+			} else {
+				err = mpClient.Clone(source, dest)
+			}
+			if err != nil {
 				return err
 			}
+
+			if cpus > 0 || memory != "" || disk != "" {
+				if err := mpClient.SetResources(dest, cpus, memory, disk); err != nil {
+					return fmt.Errorf("VM cloned to '%s', but resizing it failed: %w", dest, err)
+				}
+			}
+			recordClone(source, dest, cpus, memory, disk)
 			fmt.Printf("VM '%s' cloned to '%s'\n", source, dest)
 			return nil
 		},
 	}
+
+	cmd.Flags().StringVar(&snapshot, "snapshot", "", "Clone the VM as it was at this snapshot")
+	cmd.Flags().IntVar(&cpus, "cpu", 0, "Number of CPUs for the clone")
+	cmd.Flags().StringVar(&memory, "mem", "", "Memory size for the clone, e.g., 8G")
+	cmd.Flags().StringVar(&disk, "disk", "", "Disk size for the clone, e.g., 40G (can only grow)")
+
+	return cmd
+}
+
+// recordClone saves the clone's spec from its source's, so `dabbi recreate`
+// works on it too. Sources without a spec are skipped.
+func recordClone(source, dest string, cpus int, memory, disk string) {
+	store, err := specStore()
+	if err == nil {
+		overrides := map[string]interface{}{}
+		if cpus > 0 {
+			overrides["cpu"] = cpus
+		}
+		if memory != "" {
+			overrides["mem"] = memory
+		}
+		if disk != "" {
+			overrides["disk"] = disk
+		}
+		err = store.Copy(source, dest, overrides)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Warning: failed to save VM spec: %v\n", err)
+	}
 }
@@ -0,0 +1,54 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// errNeedsConfirmation is returned for destructive commands run without a
+// terminal to ask on and without --yes
+var errNeedsConfirmation = errors.New("not running in a terminal, so can't ask for confirmation; pass --yes (or --force) to go ahead")
+
+// addYesFlags registers --yes/-y, and --force as another name for it, on a
+// destructive command
+func addYesFlags(cmd *cobra.Command, yes *bool) {
+	cmd.Flags().BoolVarP(yes, "yes", "y", false, "Don't ask for confirmation")
+	cmd.Flags().BoolVar(yes, "force", false, "Same as --yes")
+}
+
+// confirmAction asks prompt before a destructive action unless yes is set,
+// and reports whether to go ahead. Scripts can't answer a prompt, so
+// without a terminal it fails with errNeedsConfirmation rather than
+// waiting on stdin or proceeding unasked.
+func confirmAction(prompt string, yes bool) (bool, error) {
+	if yes {
+		return true, nil
+	}
+	if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+		return false, errNeedsConfirmation
+	}
+	if !confirm(prompt) {
+		fmt.Println("Aborted")
+		return false, nil
+	}
+	return true, nil
+}
+
+// confirm prints prompt and reports whether the user answered yes
+func confirm(prompt string) bool {
+	fmt.Print(prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
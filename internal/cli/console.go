@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/console"
+	"github.com/spf13/cobra"
+)
+
+// consoleFollowInterval is how often `dabbi console --follow` re-reads the log
+const consoleFollowInterval = 2 * time.Second
+
+func newConsoleCmd() *cobra.Command {
+	var (
+		follow bool
+		lines  int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "console <vm_name>",
+		Short: "Show a VM's boot/console log",
+		Long: `Show the end of a VM's boot/console log, to diagnose VMs that won't
+boot or never get an IP address.
+
+A running VM with an address shows its kernel log (dmesg). Otherwise the
+host-side multipass log is read instead: multipassd's log on macOS, or the
+file set with console_log_path, where "{vm}" is replaced by the VM name.
+
+Use --follow to keep printing new lines until interrupted.`,
+		Example: `  dabbi console dev
+  dabbi console dev --lines 50 --follow`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+			reader := console.NewReader(mpClient, cfg.ConsoleLogPath)
+
+			info, err := mpClient.Info(vmName)
+			if err != nil {
+				return err
+			}
+			log, err := reader.Read(vmName, info, lines)
+			if err != nil {
+				return err
+			}
+			if log.Note != "" {
+				fmt.Fprintf(os.Stderr, "%s; showing %s\n", log.Note, log.Source)
+			}
+			printLines(log.Lines)
+			if !follow {
+				return nil
+			}
+
+			interrupt := make(chan os.Signal, 1)
+			signal.Notify(interrupt, os.Interrupt)
+			defer signal.Stop(interrupt)
+			ticker := time.NewTicker(consoleFollowInterval)
+			defer ticker.Stop()
+
+			prev := log
+			for {
+				select {
+				case <-interrupt:
+					return nil
+				case <-ticker.C:
+				}
+
+				info, err := mpClient.Info(vmName)
+				if err != nil {
+					return err
+				}
+				cur, err := reader.Read(vmName, info, lines)
+				if err != nil {
+					continue // e.g. rebooting between dmesg and the host log
+				}
+				if cur.Source != prev.Source {
+					fmt.Fprintf(os.Stderr, "--- reading %s ---\n", cur.Source)
+					printLines(cur.Lines)
+				} else {
+					printLines(console.NewLines(prev.Lines, cur.Lines))
+				}
+				prev = cur
+			}
+		},
+	}
+
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep printing new lines")
+	cmd.Flags().IntVarP(&lines, "lines", "n", console.DefaultLines, "Number of lines to show")
+	return cmd
+}
+
+func printLines(lines []string) {
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+}
@@ -7,7 +7,9 @@ import (
 )
 
 func newCpCmd() *cobra.Command {
-	return &cobra.Command{
+	var recursive bool
+
+	cmd := &cobra.Command{
 		Use:   "cp <source> <dest>",
 		Short: "Copy files between host and VM",
 		Long: `Copy files between the host and a VM.
@@ -21,18 +23,26 @@ Examples:
   # Copy from VM to host
   dabbi cp my-vm:/home/ubuntu/remote.txt ./local.txt
 
-  # Copy directories (multipass supports this)
-  dabbi cp ./mydir my-vm:/home/ubuntu/`,
+  # Copy directories (needs multipass 1.11 or newer)
+  dabbi cp -r ./mydir my-vm:/home/ubuntu/`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			src, dst := args[0], args[1]
 
 			fmt.Printf("Copying %s -> %s...\n", src, dst)
-			if err := mpClient.Transfer(src, dst); err != nil {
+			transfer := mpClient.Transfer
+			if recursive {
+				transfer = mpClient.TransferRecursive
+			}
+			if err := transfer(src, dst); err != nil {
 				return err
 			}
 			fmt.Println("Copy complete")
 			return nil
 		},
 	}
+
+	cmd.Flags().BoolVarP(&recursive, "recursive", "r", false, "Copy directories recursively")
+
+	return cmd
 }
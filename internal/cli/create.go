@@ -1,6 +1,7 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,9 +10,71 @@ import (
 	"github.com/mjshashank/dabbi/internal/config"
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/network"
+	"github.com/mjshashank/dabbi/internal/quota"
+	"github.com/mjshashank/dabbi/internal/sshagent"
+	"github.com/mjshashank/dabbi/internal/vmspec"
 	"github.com/spf13/cobra"
 )
 
+// createSpec mirrors the daemon's CreateVMRequest, which is what
+// GET /api/vms/{name}/spec returns
+type createSpec struct {
+	Name            string                   `json:"name"`
+	CPUs            int                      `json:"cpu,omitempty"`
+	Memory          string                   `json:"mem,omitempty"`
+	Disk            string                   `json:"disk,omitempty"`
+	CloudInit       string                   `json:"cloud_init,omitempty"`
+	Image           string                   `json:"image,omitempty"`
+	ImageChecksum   string                   `json:"image_checksum,omitempty"`
+	Networks        []string                 `json:"networks,omitempty"`
+	Network         *multipass.NetworkConfig `json:"network,omitempty"`
+	Packages        []string                 `json:"packages,omitempty"`
+	ForwardSSHAgent bool                     `json:"forward_ssh_agent,omitempty"`
+	Netplan         string                   `json:"netplan,omitempty"`
+}
+
+// withLaunchHint adds advice to a launch failure multipass reported in a
+// recognizable way, such as a full disk or a name that's taken
+func withLaunchHint(err error) error {
+	var mpErr *multipass.MultipassError
+	if errors.As(err, &mpErr) {
+		if hint := mpErr.Classify().Suggestion; hint != "" {
+			return fmt.Errorf("%w\n%s", err, hint)
+		}
+	}
+	return err
+}
+
+// specStore opens the record of what each VM was launched with
+func specStore() (*vmspec.Store, error) {
+	dir, err := vmspec.DefaultDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate VM specs: %w", err)
+	}
+	return vmspec.NewStore(dir), nil
+}
+
+// sshAgentSecret returns a fresh secret for a VM's SSH agent relay, or ""
+// when forwarding is off
+func sshAgentSecret(forward bool) (string, error) {
+	if !forward {
+		return "", nil
+	}
+	return sshagent.NewSecret()
+}
+
+// enableSSHAgent grants a launched VM the host's SSH agent through the
+// daemon, with the secret its cloud-init was given
+func enableSSHAgent(name, secret string) {
+	store, err := specStore()
+	if err == nil {
+		err = store.GrantSSHAgent(name, secret)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to enable SSH agent forwarding: %v\n", err)
+	}
+}
+
 func newCreateCmd() *cobra.Command {
 	var (
 		cpus         int
@@ -19,9 +82,17 @@ func newCreateCmd() *cobra.Command {
 		disk         string
 		cloudInit    string
 		image        string
+		imageSum     string
+		bridges      []string
 		networkMode  string
 		networkAllow []string
+		allowPresets []string
 		networkBlock []string
+		networkDNS   []string
+		packages     []string
+		forwardAgent bool
+		netplan      string
+		dryRun       bool
 	)
 
 	cmd := &cobra.Command{
@@ -33,20 +104,81 @@ If options are not provided, defaults from ~/.dabbi/config.json are used.
 
 Network restrictions can be applied at creation time:
   dabbi create my-vm --network-mode allowlist --allow github.com
-  dabbi create my-vm --network-mode isolated`,
+  dabbi create my-vm --network-mode allowlist --allow-preset github --allow-preset pypi
+  dabbi create my-vm --network-mode isolated
+
+Custom images can be given as a local file or URL; they are passed to
+multipass as-is. Local files can be checked against a sha256 checksum:
+  dabbi create my-vm --image file:///home/me/images/custom.img --image-checksum <sha256>
+  dabbi create my-vm --image https://example.com/images/custom.img
+
+Install extra apt packages without editing the cloud-init file:
+  dabbi create my-vm --package htop --package ripgrep
+
+Use --dry-run to print the exact cloud-init the VM would get, without
+creating it:
+  dabbi create my-vm --package htop --dry-run
+
+Use --network to add a NIC bridged onto a host interface so the VM is
+reachable on the LAN (see 'multipass networks' for available names):
+  dabbi create my-vm --network eth0
+
+Use --netplan to give the VM a netplan config, e.g. a static IP or
+specific DNS servers. Multipass can't take one directly, so it's written
+to /etc/netplan/90-dabbi.yaml by cloud-init and applied on first boot:
+  dabbi create my-vm --network eth0 --netplan ./static-ip.yaml
+
+Use --forward-ssh-agent to let the VM use the SSH agent of the host's
+dabbi daemon (for git over SSH, say) without copying keys into it. Keys
+never leave the host, but anyone who can run commands in the VM can use
+them while the daemon runs. Revoke it with 'dabbi ssh-agent revoke':
+  dabbi create my-vm --forward-ssh-agent
+  dabbi ssh-agent revoke my-vm`,
 		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			name := args[0]
+			if err := multipass.ValidateVMName(name); err != nil {
+				return err
+			}
+
+			if image == "" {
+				image = cfg.Defaults.Image
+			}
+			if err := multipass.ValidateImage(image, imageSum); err != nil {
+				return err
+			}
+			if err := multipass.ValidateNetworks(bridges); err != nil {
+				return err
+			}
+			if err := config.ValidatePackages(packages); err != nil {
+				return fmt.Errorf("--package: %w", err)
+			}
 
-			// Use defaults from config if not specified
+			// Use defaults from config if not specified, with the same
+			// fallbacks as the daemon for ones the config leaves empty
 			if cpus == 0 {
 				cpus = cfg.Defaults.CPU
+				if cpus == 0 {
+					cpus = 2
+				}
 			}
 			if memory == "" {
 				memory = cfg.Defaults.Mem
+				if memory == "" {
+					memory = "4G"
+				}
 			}
 			if disk == "" {
 				disk = cfg.Defaults.Disk
+				if disk == "" {
+					disk = "20G"
+				}
+			}
+			if _, err := multipass.ParseSize(memory); err != nil {
+				return fmt.Errorf("--mem: %w", err)
+			}
+			if _, err := multipass.ParseSize(disk); err != nil {
+				return fmt.Errorf("--disk: %w", err)
 			}
 
 			// Resolve cloud-init path (explicit > config default > ~/.dabbi/cloud-init.yaml)
@@ -55,123 +187,66 @@ Network restrictions can be applied at creation time:
 			// Build network config if specified
 			var netConfig *multipass.NetworkConfig
 			if networkMode != "" {
-				var mode multipass.NetworkMode
-				switch networkMode {
-				case "none":
-					mode = multipass.NetworkModeNone
-				case "allowlist":
-					mode = multipass.NetworkModeAllowlist
-				case "blocklist":
-					mode = multipass.NetworkModeBlocklist
-				case "isolated":
-					mode = multipass.NetworkModeIsolated
-				default:
-					return fmt.Errorf("invalid network mode: %s", networkMode)
-				}
-
-				var rules []multipass.NetworkRule
-				if mode == multipass.NetworkModeAllowlist {
-					for _, host := range networkAllow {
-						rules = append(rules, parseNetworkHost(host))
-					}
-					if len(rules) == 0 {
-						return fmt.Errorf("allowlist mode requires at least one --allow")
-					}
-				} else if mode == multipass.NetworkModeBlocklist {
-					for _, host := range networkBlock {
-						rules = append(rules, parseNetworkHost(host))
-					}
-					if len(rules) == 0 {
-						return fmt.Errorf("blocklist mode requires at least one --block")
-					}
-				}
-
-				netConfig = &multipass.NetworkConfig{Mode: mode, Rules: rules}
-
-				if err := network.ValidateConfig(netConfig); err != nil {
-					return fmt.Errorf("invalid network config: %w", err)
+				var err error
+				netConfig, err = buildNetworkConfig(networkMode, networkAllow, allowPresets, networkBlock, networkDNS)
+				if err != nil {
+					return err
 				}
+			} else if len(allowPresets) > 0 {
+				return fmt.Errorf("--allow-preset needs --network-mode=allowlist")
 			} else if cfg.Defaults.NetworkConfig != nil && cfg.Defaults.NetworkConfig.Mode != multipass.NetworkModeNone {
 				// Use default network config if set
 				netConfig = cfg.Defaults.NetworkConfig
 			}
 
-			// If we have network config, generate modified cloud-init
-			var finalCloudInit string
-			var tempCloudInitFile string
-			if netConfig != nil && netConfig.Mode != multipass.NetworkModeNone {
-				// Read base cloud-init
-				var baseContent string
-				if resolvedCloudInit != "" {
-					data, err := os.ReadFile(resolvedCloudInit)
-					if err != nil {
-						return fmt.Errorf("failed to read cloud-init: %w", err)
-					}
-					baseContent = string(data)
-				} else {
-					baseContent = config.DefaultCloudInit
-				}
-
-				// Generate cloud-init with network config
-				modifiedContent, err := config.GenerateCloudInitWithNetwork(baseContent, netConfig)
-				if err != nil {
-					return fmt.Errorf("failed to generate cloud-init with network: %w", err)
-				}
-
-				// Inject auth token for OpenCode
-				modifiedContent = config.GenerateCloudInitWithAuthToken(modifiedContent, cfg.AuthToken)
-
-				// Write to temp file in home directory (snap multipass can't access /tmp)
-				homeDir, err := os.UserHomeDir()
-				if err != nil {
-					return fmt.Errorf("failed to get home dir: %w", err)
-				}
-				tmpDir, err := os.MkdirTemp(homeDir, "dabbi-cloudinit-*")
+			if netplan == "" {
+				netplan = cfg.Defaults.Netplan
+			}
+			if netplan != "" {
+				// Absolute, so the recorded spec works from any directory
+				abs, err := filepath.Abs(netplan)
 				if err != nil {
-					return fmt.Errorf("failed to create temp dir: %w", err)
+					return err
 				}
-				defer os.RemoveAll(tmpDir)
+				netplan = abs
+			}
 
-				tempCloudInitFile = filepath.Join(tmpDir, "cloud-init.yaml")
-				if err := os.WriteFile(tempCloudInitFile, []byte(modifiedContent), 0644); err != nil {
-					return fmt.Errorf("failed to write temp cloud-init: %w", err)
-				}
+			agentSecret, err := sshAgentSecret(forwardAgent)
+			if err != nil {
+				return err
+			}
 
-				finalCloudInit = tempCloudInitFile
-				fmt.Printf("Network mode: %s\n", netConfig.Mode)
-			} else {
-				// No network config, but still need to inject auth token for OpenCode
-				var baseContent string
-				if resolvedCloudInit != "" {
-					data, err := os.ReadFile(resolvedCloudInit)
-					if err != nil {
-						return fmt.Errorf("failed to read cloud-init: %w", err)
-					}
-					baseContent = string(data)
-				} else {
-					baseContent = config.DefaultCloudInit
-				}
+			// Render the cloud-init exactly as the daemon's API would
+			content, err := cfg.RenderCloudInit(resolvedCloudInit, packages, netConfig, agentSecret, netplan)
+			if err != nil {
+				return err
+			}
 
-				// Inject auth token
-				modifiedContent := config.GenerateCloudInitWithAuthToken(baseContent, cfg.AuthToken)
+			if dryRun {
+				fmt.Print(content)
+				return nil
+			}
 
-				// Write to temp file in home directory (snap multipass can't access /tmp)
-				homeDir, err := os.UserHomeDir()
-				if err != nil {
-					return fmt.Errorf("failed to get home dir: %w", err)
-				}
-				tmpDir, err := os.MkdirTemp(homeDir, "dabbi-cloudinit-*")
-				if err != nil {
-					return fmt.Errorf("failed to create temp dir: %w", err)
-				}
-				defer os.RemoveAll(tmpDir)
+			limits, err := quota.FromConfig(cfg)
+			if err != nil {
+				return err
+			}
+			if err := quota.CheckLaunch(mpClient, limits, cpus, memory); err != nil {
+				return err
+			}
 
-				tempCloudInitFile = filepath.Join(tmpDir, "cloud-init.yaml")
-				if err := os.WriteFile(tempCloudInitFile, []byte(modifiedContent), 0644); err != nil {
-					return fmt.Errorf("failed to write temp cloud-init: %w", err)
+			// The file must survive until multipass has read it, i.e. until Launch returns
+			launchFile, err := cfg.WriteLaunchFile(name, content)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := launchFile.Release(); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 				}
-
-				finalCloudInit = tempCloudInitFile
+			}()
+			if netConfig != nil && netConfig.Mode != multipass.NetworkModeNone {
+				fmt.Printf("Network mode: %s\n", netConfig.Mode)
 			}
 
 			opts := multipass.LaunchOptions{
@@ -179,8 +254,10 @@ Network restrictions can be applied at creation time:
 				CPUs:          cpus,
 				Memory:        memory,
 				Disk:          disk,
-				CloudInit:     finalCloudInit,
+				CloudInit:     launchFile.Path,
 				Image:         image,
+				ImageChecksum: imageSum,
+				Networks:      bridges,
 				NetworkConfig: netConfig,
 			}
 
@@ -191,7 +268,31 @@ Network restrictions can be applied at creation time:
 			}
 
 			if err := mpClient.Launch(opts); err != nil {
-				return err
+				return withLaunchHint(err)
+			}
+
+			// Keep what the VM was launched with, as the daemon does
+			spec := createSpec{
+				Name:            name,
+				CPUs:            cpus,
+				Memory:          memory,
+				Disk:            disk,
+				CloudInit:       resolvedCloudInit,
+				Image:           image,
+				ImageChecksum:   imageSum,
+				Networks:        bridges,
+				Network:         netConfig,
+				Packages:        packages,
+				ForwardSSHAgent: forwardAgent,
+				Netplan:         netplan,
+			}
+			if store, err := specStore(); err == nil {
+				if err := store.Save(name, content, spec); err != nil {
+					fmt.Printf("Warning: failed to save VM spec: %v\n", err)
+				}
+			}
+			if forwardAgent {
+				enableSSHAgent(name, agentSecret)
 			}
 
 			fmt.Printf("VM '%s' created successfully\n", name)
@@ -203,16 +304,34 @@ Network restrictions can be applied at creation time:
 	cmd.Flags().StringVar(&memory, "mem", "", "Memory size, e.g., 4G (default from config)")
 	cmd.Flags().StringVar(&disk, "disk", "", "Disk size, e.g., 20G (default from config)")
 	cmd.Flags().StringVar(&cloudInit, "cloud-init", "", "Path to cloud-init file (default: ~/.dabbi/cloud-init.yaml if exists)")
-	cmd.Flags().StringVar(&image, "image", "", "Image to use, e.g., 22.04 or jammy")
+	cmd.Flags().StringVar(&image, "image", "", "Image to use, e.g., 22.04, jammy, file:///path.img or https://... URL (default from 'dabbi defaults')")
+	cmd.Flags().StringVar(&imageSum, "image-checksum", "", "Expected sha256 of a file:// image")
+	cmd.Flags().StringArrayVar(&packages, "package", nil, "Extra apt package to install, on top of defaults.extra_packages (repeatable)")
+	cmd.Flags().StringArrayVar(&bridges, "network", nil, "Host interface to bridge an extra NIC onto, e.g., eth0 (repeatable)")
 	cmd.Flags().StringVar(&networkMode, "network-mode", "", "Network restriction mode: none, allowlist, blocklist, isolated")
-	cmd.Flags().StringArrayVar(&networkAllow, "allow", nil, "Host to allow (use with --network-mode=allowlist)")
-	cmd.Flags().StringArrayVar(&networkBlock, "block", nil, "Host to block (use with --network-mode=blocklist)")
+	cmd.Flags().StringArrayVar(&networkAllow, "allow", nil, "Host to allow, optionally with a comment as host#comment (use with --network-mode=allowlist)")
+	cmd.Flags().StringArrayVar(&allowPresets, "allow-preset", nil, "Allow a preset's hosts: "+strings.Join(network.PresetNames(), ", ")+" (use with --network-mode=allowlist, repeatable)")
+	cmd.Flags().StringArrayVar(&networkBlock, "block", nil, "Host to block, optionally with a comment as host#comment (use with --network-mode=blocklist)")
+	cmd.Flags().StringArrayVar(&networkDNS, "dns", nil, "DNS server IP the VM may query (use with --network-mode=allowlist, default: the VM's own resolvers)")
+	cmd.Flags().StringVar(&netplan, "netplan", "", "Netplan config for the VM's interfaces, e.g. static IPs or DNS servers (default from config)")
+	cmd.Flags().BoolVar(&forwardAgent, "forward-ssh-agent", false, "Relay the daemon's SSH agent into the VM (see above for the trade-off)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the rendered cloud-init instead of creating the VM")
 
 	return cmd
 }
 
-// parseNetworkHost converts a host string to a NetworkRule
+// parseNetworkHost converts a host string to a NetworkRule. Anything after
+// a '#' becomes the rule's comment, e.g. "github.com#GitHub API".
 func parseNetworkHost(host string) multipass.NetworkRule {
+	host, comment, _ := strings.Cut(host, "#")
+	host = strings.TrimSpace(host)
+	rule := parseNetworkValue(host)
+	rule.Comment = strings.TrimSpace(comment)
+	return rule
+}
+
+// parseNetworkValue detects whether a host is a CIDR, IP, or domain
+func parseNetworkValue(host string) multipass.NetworkRule {
 	if strings.Contains(host, "/") {
 		return multipass.NetworkRule{Type: "cidr", Value: host}
 	}
@@ -0,0 +1,104 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/config"
+)
+
+// daemonURL is the base URL of the running dabbi daemon, used by commands
+// that change live daemon state rather than multipass directly
+var daemonURL = "http://localhost"
+
+// configuredDaemonURL is where a daemon serving with cfg answers API
+// requests: its API port if it has one, else its main port, over HTTPS when
+// it serves TLS (at its domain, if it has one, so the certificate matches)
+func configuredDaemonURL(cfg *config.Config) string {
+	scheme, host, port := "http", "localhost", cfg.Port
+	if cfg.TLSCertFile != "" || cfg.Domain != "" {
+		scheme = "https"
+		if cfg.Domain != "" {
+			host = cfg.Domain
+		}
+		// Let's Encrypt certificates are only served on 443
+		if port == 0 || cfg.TLSCertFile == "" {
+			port = 443
+		}
+	}
+	if cfg.APIPort != 0 {
+		port = cfg.APIPort
+	}
+	if port == 0 || (scheme == "http" && port == 80) || (scheme == "https" && port == 443) {
+		return scheme + "://" + host
+	}
+	return fmt.Sprintf("%s://%s:%d", scheme, host, port)
+}
+
+// errDaemonUnreachable indicates no daemon answered at daemonURL
+var errDaemonUnreachable = errors.New("daemon not reachable")
+
+// daemonRequestTimeout bounds ordinary daemon requests
+const daemonRequestTimeout = 30 * time.Second
+
+// daemonRequest sends an authenticated JSON request to the running daemon
+// and decodes the JSON response into out (if non-nil)
+func daemonRequest(method, path string, body, out interface{}) error {
+	return daemonRequestWithTimeout(method, path, body, out, daemonRequestTimeout)
+}
+
+// daemonRequestWithTimeout is daemonRequest for calls that may run long,
+// such as launching a VM. A zero timeout waits indefinitely.
+func daemonRequestWithTimeout(method, path string, body, out interface{}, timeout time.Duration) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(daemonURL, "/")+"/api"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.AuthToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w at %s: %v", errDaemonUnreachable, daemonURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		data, _ := io.ReadAll(resp.Body)
+		var apiErr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+				Hint    string `json:"hint"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+			if apiErr.Error.Hint != "" {
+				return fmt.Errorf("daemon: %s\n%s", apiErr.Error.Message, apiErr.Error.Hint)
+			}
+			return fmt.Errorf("daemon: %s", apiErr.Error.Message)
+		}
+		return fmt.Errorf("daemon returned %s", resp.Status)
+	}
+
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
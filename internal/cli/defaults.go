@@ -0,0 +1,185 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/spf13/cobra"
+)
+
+// vmDefaults mirrors the daemon's GET /api/defaults payload
+type vmDefaults struct {
+	CPU       int    `json:"cpu"`
+	Mem       string `json:"mem"`
+	Disk      string `json:"disk"`
+	Image     string `json:"image,omitempty"`
+	CloudInit string `json:"cloud_init,omitempty"`
+}
+
+// vmDefaultsUpdate mirrors the daemon's PUT /api/defaults payload; nil
+// fields are left unchanged
+type vmDefaultsUpdate struct {
+	CPU       *int    `json:"cpu,omitempty"`
+	Mem       *string `json:"mem,omitempty"`
+	Disk      *string `json:"disk,omitempty"`
+	Image     *string `json:"image,omitempty"`
+	CloudInit *string `json:"cloud_init,omitempty"`
+}
+
+func newDefaultsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "defaults",
+		Short: "Manage defaults for new VMs",
+		Long: `View or change the CPU, memory, disk, image, and cloud-init file used
+by 'dabbi create' when they aren't given.
+
+Changes are applied to the running daemon immediately and saved to
+~/.dabbi/config.json. If the daemon isn't running, only the config is updated.`,
+	}
+
+	cmd.AddCommand(
+		newDefaultsGetCmd(),
+		newDefaultsSetCmd(),
+	)
+
+	return cmd
+}
+
+func newDefaultsGetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get",
+		Short: "Show the defaults for new VMs",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var d vmDefaults
+			err := daemonRequest(http.MethodGet, "/defaults", nil, &d)
+			if errors.Is(err, errDaemonUnreachable) {
+				d = vmDefaults{
+					CPU:       cfg.Defaults.CPU,
+					Mem:       cfg.Defaults.Mem,
+					Disk:      cfg.Defaults.Disk,
+					Image:     cfg.Defaults.Image,
+					CloudInit: cfg.Defaults.CloudInit,
+				}
+				fmt.Println("(from config, daemon not running)")
+			} else if err != nil {
+				return err
+			}
+
+			image := d.Image
+			if image == "" {
+				image = "multipass default"
+			}
+			cloudInit := d.CloudInit
+			if cloudInit == "" {
+				cloudInit = "~/.dabbi/cloud-init.yaml if it exists"
+			}
+			fmt.Printf("CPUs:       %d\n", d.CPU)
+			fmt.Printf("Memory:     %s\n", d.Mem)
+			fmt.Printf("Disk:       %s\n", d.Disk)
+			fmt.Printf("Image:      %s\n", image)
+			fmt.Printf("Cloud-init: %s\n", cloudInit)
+			return nil
+		},
+	}
+}
+
+func newDefaultsSetCmd() *cobra.Command {
+	var cpus int
+	var memory, disk, image, cloudInit string
+
+	cmd := &cobra.Command{
+		Use:   "set",
+		Short: "Change the defaults for new VMs",
+		Long: `Change the defaults for new VMs. Only the given flags are changed.
+Pass --image "" to go back to multipass's default image, and
+--cloud-init "" to go back to ~/.dabbi/cloud-init.yaml.
+
+Examples:
+  dabbi defaults set --image 24.04
+  dabbi defaults set --cpu 4 --mem 8G
+  dabbi defaults set --cloud-init ~/team/cloud-init.yaml`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var update vmDefaultsUpdate
+			if cmd.Flags().Changed("cpu") {
+				if cpus < 1 {
+					return fmt.Errorf("--cpu must be at least 1")
+				}
+				update.CPU = &cpus
+			}
+			if cmd.Flags().Changed("mem") {
+				if _, err := multipass.ParseSize(memory); err != nil {
+					return fmt.Errorf("--mem: %w", err)
+				}
+				update.Mem = &memory
+			}
+			if cmd.Flags().Changed("disk") {
+				if _, err := multipass.ParseSize(disk); err != nil {
+					return fmt.Errorf("--disk: %w", err)
+				}
+				update.Disk = &disk
+			}
+			if cmd.Flags().Changed("image") {
+				if err := multipass.ValidateImage(image, ""); err != nil {
+					return fmt.Errorf("--image: %w", err)
+				}
+				update.Image = &image
+			}
+			if cmd.Flags().Changed("cloud-init") {
+				if cloudInit != "" {
+					abs, err := filepath.Abs(cloudInit)
+					if err != nil {
+						return fmt.Errorf("--cloud-init: %w", err)
+					}
+					cloudInit = abs
+				}
+				update.CloudInit = &cloudInit
+			}
+			if update == (vmDefaultsUpdate{}) {
+				return fmt.Errorf("nothing to change; pass --cpu, --mem, --disk, --image, or --cloud-init")
+			}
+
+			err := daemonRequest(http.MethodPut, "/defaults", update, nil)
+			if errors.Is(err, errDaemonUnreachable) {
+				if update.CPU != nil {
+					cfg.Defaults.CPU = cpus
+				}
+				if update.Mem != nil {
+					cfg.Defaults.Mem = memory
+				}
+				if update.Disk != nil {
+					cfg.Defaults.Disk = disk
+				}
+				if update.Image != nil {
+					cfg.Defaults.Image = image
+				}
+				if update.CloudInit != nil {
+					cfg.Defaults.CloudInit = cloudInit
+				}
+				if err := cfg.Save(); err != nil {
+					return fmt.Errorf("failed to save config: %w", err)
+				}
+				fmt.Println("Defaults saved (daemon not running, applies on next start)")
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Println("Defaults updated")
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&cpus, "cpu", 0, "Default number of CPUs")
+	cmd.Flags().StringVar(&memory, "mem", "", "Default memory size, e.g., 4G")
+	cmd.Flags().StringVar(&disk, "disk", "", "Default disk size, e.g., 20G")
+	cmd.Flags().StringVar(&image, "image", "", "Default image, e.g., 24.04 (empty for multipass's default)")
+	cmd.Flags().StringVar(&cloudInit, "cloud-init", "", "Default cloud-init file (empty for ~/.dabbi/cloud-init.yaml)")
+
+	return cmd
+}
@@ -0,0 +1,281 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/spf13/cobra"
+)
+
+// Doctor check outcomes
+const (
+	checkPass = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// doctorCheck is the outcome of one environment check
+type doctorCheck struct {
+	Name   string
+	Status string // ok, warn, or fail
+	Detail string
+	Hint   string // what to do about a warn or fail
+}
+
+// minFreeDisk is the free space below which doctor warns when no default
+// disk size is configured
+const minFreeDisk = 20 << 30
+
+func newDoctorCmd() *cobra.Command {
+	var port int
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Check that this machine is ready to run dabbi",
+		Long: `Check the environment dabbi depends on and suggest fixes: multipass is
+installed and its daemon answers, ~/.dabbi is writable and the config
+loads, the daemon port can be bound (or dabbi already serves it), there is
+disk space for VMs, and the default cloud-init exists.
+
+Exits non-zero if any check fails; warnings alone don't.
+
+Examples:
+  dabbi doctor
+  dabbi doctor --port 8080`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			checks := []doctorCheck{checkMultipassInstalled()}
+			if checks[0].Status == checkPass {
+				checks = append(checks, checkMultipassVersion())
+			}
+			checks = append(checks, checkConfigDir())
+			loaded, configCheck := checkConfig()
+			checks = append(checks, configCheck)
+			if !cmd.Flags().Changed("port") && loaded != nil && loaded.Port != 0 {
+				port = loaded.Port
+			}
+			checks = append(checks,
+				checkPort(port),
+				checkDiskSpace(loaded),
+				checkCloudInit(loaded),
+			)
+
+			failed := 0
+			for _, c := range checks {
+				fmt.Printf("[%-4s] %s: %s\n", c.Status, c.Name, c.Detail)
+				if c.Hint != "" && c.Status != checkPass {
+					fmt.Printf("       %s\n", c.Hint)
+				}
+				if c.Status == checkFail {
+					failed++
+				}
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+			}
+			fmt.Println("\nAll required checks passed")
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&port, "port", 80, "Port 'dabbi serve' will listen on")
+
+	return cmd
+}
+
+func checkMultipassInstalled() doctorCheck {
+	c := doctorCheck{Name: "multipass installed"}
+	path, err := exec.LookPath("multipass")
+	if err != nil {
+		c.Status, c.Detail = checkFail, "multipass is not on PATH"
+		c.Hint = "Install it from https://multipass.run/install (macOS: brew install multipass, Linux: sudo snap install multipass)"
+		return c
+	}
+	c.Status, c.Detail = checkPass, path
+	return c
+}
+
+func checkMultipassVersion() doctorCheck {
+	c := doctorCheck{Name: "multipass responds"}
+	mp := multipass.NewRealClient()
+	v, err := mp.Version()
+	if err != nil {
+		c.Status, c.Detail = checkFail, fmt.Sprintf("'multipass version' failed: %v", err)
+		c.Hint = "Make sure the multipass daemon (multipassd) is running and your user may use it"
+		return c
+	}
+
+	c.Status, c.Detail = checkPass, "version "+v.String()
+	var missing []string
+	for _, f := range []multipass.Feature{multipass.FeatureSnapshots, multipass.FeatureClone} {
+		if !mp.Supports(f) {
+			missing = append(missing, string(f))
+		}
+	}
+	if len(missing) > 0 {
+		c.Status = checkWarn
+		c.Detail += " (no " + strings.Join(missing, ", ") + ")"
+		c.Hint = "Upgrade multipass to use every dabbi feature"
+	}
+	return c
+}
+
+func checkConfigDir() doctorCheck {
+	c := doctorCheck{Name: "config directory writable"}
+	path, err := config.ConfigPath()
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		c.Hint = "Set HOME to your home directory"
+		return c
+	}
+	dir := filepath.Dir(path)
+
+	err = os.MkdirAll(dir, 0700)
+	if err == nil {
+		var f *os.File
+		if f, err = os.CreateTemp(dir, ".doctor-*"); err == nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		c.Hint = fmt.Sprintf("Make %s writable by your user (a 'sudo dabbi' run may have left it owned by root: sudo chown -R $USER %s)", dir, dir)
+		return c
+	}
+	c.Status, c.Detail = checkPass, dir
+	return c
+}
+
+// checkConfig loads the config, creating the default one if missing, as
+// every other command does. The config is nil if it can't be loaded.
+func checkConfig() (*config.Config, doctorCheck) {
+	c := doctorCheck{Name: "config loads"}
+	path, _ := config.ConfigPath()
+	loaded, err := config.Load()
+	if err != nil {
+		c.Status, c.Detail = checkFail, err.Error()
+		c.Hint = fmt.Sprintf("Fix the JSON in %s, or move it aside to start from the defaults", path)
+		return nil, c
+	}
+	c.Status, c.Detail = checkPass, path
+	return loaded, c
+}
+
+func checkPort(port int) doctorCheck {
+	c := doctorCheck{Name: "daemon port"}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err == nil {
+		l.Close()
+		c.Status, c.Detail = checkPass, fmt.Sprintf("port %d is free", port)
+		return c
+	}
+	if dabbiServes(port) {
+		c.Status, c.Detail = checkPass, fmt.Sprintf("dabbi is already serving port %d", port)
+		return c
+	}
+
+	c.Status = checkFail
+	switch {
+	case errors.Is(err, syscall.EACCES):
+		c.Detail = fmt.Sprintf("not allowed to bind port %d", port)
+		c.Hint = "Ports below 1024 need root: run 'sudo dabbi serve', or use a higher port ('dabbi serve --port 8080')"
+	case errors.Is(err, syscall.EADDRINUSE):
+		c.Detail = fmt.Sprintf("port %d is used by another program", port)
+		c.Hint = "Stop that program or pick another port ('dabbi serve --port 8080')"
+	default:
+		c.Detail = err.Error()
+	}
+	return c
+}
+
+// dabbiServes reports whether a dabbi daemon answers its health check on
+// port
+func dabbiServes(port int) bool {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://localhost:%d/health", port))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 16))
+	return resp.StatusCode == http.StatusOK && string(body) == "OK"
+}
+
+// multipassDataDirs are where multipass keeps images and VM disks, checked
+// for free space before falling back to the home directory
+var multipassDataDirs = []string{
+	"/var/snap/multipass/common",                       // Linux (snap)
+	"/var/root/Library/Application Support/multipassd", // macOS
+}
+
+func checkDiskSpace(cfg *config.Config) doctorCheck {
+	c := doctorCheck{Name: "disk space"}
+
+	dir, _ := os.UserHomeDir()
+	for _, d := range multipassDataDirs {
+		if _, err := os.Stat(d); err == nil {
+			dir = d
+			break
+		}
+	}
+
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		c.Status, c.Detail = checkWarn, fmt.Sprintf("couldn't check free space in %s: %v", dir, err)
+		return c
+	}
+
+	want := int64(minFreeDisk)
+	if cfg != nil {
+		if size, err := multipass.ParseSize(cfg.Defaults.Disk); err == nil {
+			want = size
+		}
+	}
+
+	c.Detail = fmt.Sprintf("%s free in %s", multipass.FormatBytes(free), dir)
+	if free < want {
+		c.Status = checkWarn
+		c.Hint = fmt.Sprintf("A new VM may use up to %s; free some space or create VMs with a smaller --disk", multipass.FormatBytes(want))
+		return c
+	}
+	c.Status = checkPass
+	return c
+}
+
+func checkCloudInit(cfg *config.Config) doctorCheck {
+	c := doctorCheck{Name: "default cloud-init"}
+	if cfg != nil && cfg.Defaults.CloudInit != "" {
+		if _, err := os.Stat(cfg.Defaults.CloudInit); err != nil {
+			c.Status, c.Detail = checkWarn, fmt.Sprintf("defaults.cloud_init %s: %v", cfg.Defaults.CloudInit, err)
+			c.Hint = "New VMs fall back to ~/.dabbi/cloud-init.yaml; fix the path with 'dabbi defaults' or in config.json"
+			return c
+		}
+		c.Status, c.Detail = checkPass, cfg.Defaults.CloudInit
+		return c
+	}
+
+	path, err := config.DefaultCloudInitPath()
+	if err == nil {
+		_, err = os.Stat(path)
+	}
+	if err != nil {
+		c.Status, c.Detail = checkWarn, "not found, new VMs use the built-in default"
+		c.Hint = "Run 'dabbi serve' once to write ~/.dabbi/cloud-init.yaml, then edit it to customize new VMs"
+		return c
+	}
+	c.Status, c.Detail = checkPass, path
+	return c
+}
@@ -0,0 +1,215 @@
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/mjshashank/dabbi/internal/hosts"
+	"github.com/spf13/cobra"
+)
+
+func newHostsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "hosts",
+		Short: "Make VM proxy hostnames resolve on systems that need it",
+		Long: `The proxy serves apps at http://<vm>-<port>.localhost, which relies on
+the system resolving every .localhost name to 127.0.0.1. macOS and
+systemd-resolved do; some other setups don't.
+
+'dabbi hosts check' tells you whether yours does. If not, 'dabbi hosts sync'
+writes entries for your VMs into a managed block of the hosts file, or
+'dabbi hosts dnsmasq' prints a wildcard dnsmasq config that covers every
+VM and port.`,
+	}
+
+	cmd.AddCommand(
+		newHostsCheckCmd(),
+		newHostsSyncCmd(),
+		newHostsRemoveCmd(),
+		newHostsDnsmasqCmd(),
+	)
+
+	return cmd
+}
+
+func newHostsCheckCmd() *cobra.Command {
+	var file string
+
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "Check whether .localhost names resolve",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if hosts.ResolvesLocalhost() {
+				fmt.Println("This system resolves *.localhost to loopback; no hosts entries are needed.")
+			} else {
+				fmt.Println("This system doesn't resolve arbitrary .localhost names.")
+				fmt.Println("Run 'dabbi hosts sync' after creating VMs, or set up 'dabbi hosts dnsmasq'.")
+			}
+
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if names := hosts.Managed(string(content)); len(names) > 0 {
+				fmt.Printf("%s has %d dabbi entries.\n", file, len(names))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&file, "file", hosts.DefaultPath(), "Hosts file")
+	return cmd
+}
+
+func newHostsSyncCmd() *cobra.Command {
+	var (
+		file   string
+		ports  []int
+		dryRun bool
+		force  bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "sync",
+		Short: "Write hosts entries for every VM's proxy hostnames",
+		Long: `Write <vm>-<port>.localhost entries for every VM into a managed block of
+the hosts file, replacing the block from the last sync. The rest of the
+file is left alone, and running it again with no new VMs changes nothing.
+
+Hosts files can't hold wildcards, so only the listed ports get entries:
+--port, else hosts_ports from the config, else 1234 (the agent), 3000,
+5173, 8000, and 8080. Run it again after creating or deleting VMs.
+
+When the hosts file isn't writable, it's written through 'sudo tee'.`,
+		Example: `  dabbi hosts sync
+  dabbi hosts sync --port 3000 --port 4000 --dry-run`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !force && hosts.ResolvesLocalhost() {
+				fmt.Println("This system already resolves *.localhost; nothing to do (use --force to write entries anyway).")
+				return nil
+			}
+
+			if len(ports) == 0 {
+				ports = cfg.HostsPorts
+			}
+			if len(ports) == 0 {
+				ports = hosts.DefaultPorts
+			}
+			for _, p := range ports {
+				if p < 1 || p > 65535 {
+					return fmt.Errorf("invalid port: %d", p)
+				}
+			}
+
+			vms, err := mpClient.List()
+			if err != nil {
+				return err
+			}
+			names := make([]string, len(vms))
+			for i, vm := range vms {
+				names[i] = vm.Name
+			}
+
+			hostnames := hosts.Hostnames(names, ports)
+			if err := updateHostsFile(file, hosts.Block(hostnames), dryRun); err != nil {
+				return err
+			}
+			if !dryRun {
+				fmt.Printf("%d hostnames for %d VMs in %s\n", len(hostnames), len(names), file)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&file, "file", hosts.DefaultPath(), "Hosts file")
+	cmd.Flags().IntSliceVar(&ports, "port", nil, "VM port to add hostnames for (repeatable)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Print the block instead of writing it")
+	cmd.Flags().BoolVar(&force, "force", false, "Write entries even if .localhost already resolves")
+	return cmd
+}
+
+func newHostsRemoveCmd() *cobra.Command {
+	var file string
+
+	cmd := &cobra.Command{
+		Use:   "remove",
+		Short: "Remove dabbi's block from the hosts file",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return updateHostsFile(file, "", false)
+		},
+	}
+
+	cmd.Flags().StringVar(&file, "file", hosts.DefaultPath(), "Hosts file")
+	return cmd
+}
+
+func newHostsDnsmasqCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "dnsmasq",
+		Short: "Print a dnsmasq config resolving every .localhost name",
+		Long: `Print a dnsmasq config that resolves every .localhost name to this
+machine, covering all VMs and ports without hosts entries. Save it as e.g.
+/etc/dnsmasq.d/dabbi.conf and restart dnsmasq. The system must use dnsmasq
+for lookups (NetworkManager's dns=dnsmasq mode, or a local dnsmasq listed
+in /etc/resolv.conf).`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Print(hosts.DnsmasqConfig())
+		},
+	}
+}
+
+// updateHostsFile replaces the managed block of the hosts file at path
+func updateHostsFile(path, block string, dryRun bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	updated, changed, err := hosts.Update(string(content), block)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Print(block)
+		return nil
+	}
+	if !changed {
+		fmt.Printf("%s is up to date\n", path)
+		return nil
+	}
+	return writeHostsFile(path, []byte(updated))
+}
+
+// writeHostsFile writes the hosts file in place, keeping its owner and
+// mode. If it isn't writable, the content is piped to 'sudo tee' so only
+// that write runs as root, not dabbi (whose config lives in the user's home).
+func writeHostsFile(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, data, info.Mode().Perm())
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("%w: run dabbi from an administrator terminal to edit %s", err, path)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s needs root to write; running sudo tee %s\n", path, path)
+	tee := exec.Command("sudo", "tee", path)
+	tee.Stdin = bytes.NewReader(data)
+	tee.Stderr = os.Stderr
+	if err := tee.Run(); err != nil {
+		return fmt.Errorf("sudo tee %s: %w", path, err)
+	}
+	return nil
+}
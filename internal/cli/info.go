@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/spf13/cobra"
+)
+
+// vmInfoOutput is the --json shape of `dabbi info`, with multipass's
+// string-typed numeric fields converted to numbers
+type vmInfoOutput struct {
+	Name          string             `json:"name"`
+	State         string             `json:"state"`
+	Release       string             `json:"release"`
+	ImageRelease  string             `json:"image_release"`
+	CPUs          int                `json:"cpus"`
+	IPv4          []string           `json:"ipv4"`
+	Memory        vmUsage            `json:"memory"`
+	Disks         map[string]vmUsage `json:"disks"`
+	Load          []float64          `json:"load"`
+	Mounts        map[string]string  `json:"mounts"` // vm path -> host path
+	SnapshotCount int                `json:"snapshot_count"`
+	Pinned        bool               `json:"pinned"` // excluded from prune and auto-shutdown
+}
+
+// vmUsage holds used/total bytes for memory or a disk
+type vmUsage struct {
+	Used  int64 `json:"used"`
+	Total int64 `json:"total"`
+}
+
+func newInfoCmd() *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "info <vm_name>",
+		Short: "Show details for a VM",
+		Long: `Show details for a VM: state, release, CPUs, IP addresses,
+memory and disk usage, load averages, mounts, snapshot count, and whether
+it is pinned.
+
+Use --json for machine-readable output.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+			info, err := mpClient.Info(vmName)
+			if err != nil {
+				return err
+			}
+
+			out := vmInfoOutput{
+				Name:          vmName,
+				State:         info.State,
+				Release:       info.Release,
+				ImageRelease:  info.ImageRelease,
+				CPUs:          info.CPUs(),
+				IPv4:          info.IPv4,
+				Memory:        vmUsage{Used: info.Memory.Used, Total: info.Memory.Total},
+				Disks:         make(map[string]vmUsage),
+				Load:          info.Load,
+				Mounts:        make(map[string]string),
+				SnapshotCount: info.Snapshots(),
+			}
+			if store, err := labelStore(); err == nil {
+				if vmLabels, err := store.Get(vmName); err == nil {
+					out.Pinned = labels.IsPinned(vmLabels)
+				}
+			}
+			for dev, d := range info.Disks {
+				out.Disks[dev] = vmUsage{Used: d.UsedBytes(), Total: d.TotalBytes()}
+			}
+			for target, m := range info.Mounts {
+				out.Mounts[target] = m.SourcePath
+			}
+
+			if jsonOutput {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return enc.Encode(out)
+			}
+
+			return printVMInfo(out)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Output as JSON")
+
+	return cmd
+}
+
+func printVMInfo(info vmInfoOutput) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(w, "State:\t%s\n", info.State)
+	if info.Pinned {
+		fmt.Fprintf(w, "Pinned:\tyes (excluded from prune and auto-shutdown)\n")
+	}
+	fmt.Fprintf(w, "Release:\t%s\n", valueOrDash(info.Release))
+	fmt.Fprintf(w, "CPUs:\t%s\n", countOrDash(info.CPUs))
+
+	ipv4 := "-"
+	if len(info.IPv4) > 0 {
+		ipv4 = strings.Join(info.IPv4, ", ")
+	}
+	fmt.Fprintf(w, "IPv4:\t%s\n", ipv4)
+	fmt.Fprintf(w, "Memory:\t%s\n", formatUsage(info.Memory))
+
+	devices := make([]string, 0, len(info.Disks))
+	for dev := range info.Disks {
+		devices = append(devices, dev)
+	}
+	sort.Strings(devices)
+	if len(devices) == 0 {
+		fmt.Fprintf(w, "Disk:\t-\n")
+	}
+	for _, dev := range devices {
+		fmt.Fprintf(w, "Disk (%s):\t%s\n", dev, formatUsage(info.Disks[dev]))
+	}
+
+	load := "-"
+	if len(info.Load) > 0 {
+		parts := make([]string, len(info.Load))
+		for i, l := range info.Load {
+			parts[i] = fmt.Sprintf("%.2f", l)
+		}
+		load = strings.Join(parts, " ")
+	}
+	fmt.Fprintf(w, "Load:\t%s\n", load)
+
+	targets := make([]string, 0, len(info.Mounts))
+	for target := range info.Mounts {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	if len(targets) == 0 {
+		fmt.Fprintf(w, "Mounts:\t-\n")
+	}
+	for i, target := range targets {
+		label := ""
+		if i == 0 {
+			label = "Mounts:"
+		}
+		fmt.Fprintf(w, "%s\t%s => %s\n", label, info.Mounts[target], target)
+	}
+
+	fmt.Fprintf(w, "Snapshots:\t%d\n", info.SnapshotCount)
+
+	return w.Flush()
+}
+
+// formatUsage renders "used / total (pct%)", or "-" when unknown (e.g., VM stopped)
+func formatUsage(u vmUsage) string {
+	if u.Total <= 0 {
+		return "-"
+	}
+	pct := float64(u.Used) / float64(u.Total) * 100
+	return fmt.Sprintf("%s / %s (%.0f%%)", multipass.FormatBytes(u.Used), multipass.FormatBytes(u.Total), pct)
+}
+
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func countOrDash(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", n)
+}
@@ -0,0 +1,143 @@
+package cli
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/spf13/cobra"
+)
+
+func newLabelCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "label",
+		Short: "Manage VM labels",
+		Long: `Attach key=value labels to VMs to group them (e.g. project=foo, env=ci).
+
+Labels are stored on the host in ~/.dabbi/labels.json and are removed when
+the VM is deleted. Filter the API's VM list with GET /api/vms?label=key=value.`,
+	}
+
+	cmd.AddCommand(
+		audited(newLabelSetCmd()),
+		newLabelGetCmd(),
+		audited(newLabelRmCmd()),
+	)
+
+	return cmd
+}
+
+func newLabelSetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set <vm-name> <key=value>...",
+		Short: "Add or update labels on a VM",
+		Long: `Add or update labels on a VM. Existing labels with other keys are kept.
+
+Examples:
+  dabbi label set my-vm project=foo env=ci`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+
+			toSet := make(map[string]string, len(args)-1)
+			for _, arg := range args[1:] {
+				key, value, err := labels.Parse(arg)
+				if err != nil {
+					return err
+				}
+				toSet[key] = value
+			}
+
+			if _, err := mpClient.Info(vmName); err != nil {
+				return fmt.Errorf("VM not found: %w", err)
+			}
+
+			store, err := labelStore()
+			if err != nil {
+				return err
+			}
+			if err := store.Set(vmName, toSet); err != nil {
+				return err
+			}
+
+			fmt.Printf("Labels updated for VM '%s'\n", vmName)
+			return nil
+		},
+	}
+}
+
+func newLabelGetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get <vm-name>",
+		Short: "Show the labels on a VM",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := labelStore()
+			if err != nil {
+				return err
+			}
+			vmLabels, err := store.Get(args[0])
+			if err != nil {
+				return err
+			}
+
+			if len(vmLabels) == 0 {
+				fmt.Println("No labels")
+				return nil
+			}
+
+			keys := make([]string, 0, len(vmLabels))
+			for k := range vmLabels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf("%s=%s\n", k, vmLabels[k])
+			}
+			return nil
+		},
+	}
+}
+
+func newLabelRmCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "rm <vm-name> <key>...",
+		Short:   "Remove labels from a VM",
+		Aliases: []string{"remove"},
+		Long: `Remove labels from a VM by key (a key=value argument removes that key).
+
+Examples:
+  dabbi label rm my-vm env`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+
+			keys := make([]string, 0, len(args)-1)
+			for _, arg := range args[1:] {
+				key, _, _ := strings.Cut(arg, "=")
+				keys = append(keys, key)
+			}
+
+			store, err := labelStore()
+			if err != nil {
+				return err
+			}
+			if err := store.Remove(vmName, keys...); err != nil {
+				return err
+			}
+
+			fmt.Printf("Labels removed from VM '%s'\n", vmName)
+			return nil
+		},
+	}
+}
+
+// labelStore opens the host-side label store shared with the daemon
+func labelStore() (*labels.Store, error) {
+	path, err := labels.DefaultPath()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate labels file: %w", err)
+	}
+	return labels.NewStore(path), nil
+}
@@ -1,43 +1,196 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
 
+	"github.com/mjshashank/dabbi/internal/bulk"
+	"github.com/mjshashank/dabbi/internal/labels"
 	"github.com/spf13/cobra"
 )
 
 func newStartCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "start <name>",
+	var all, skipStopped bool
+	var parallel int
+
+	cmd := &cobra.Command{
+		Use:   "start <name> | --all",
 		Short: "Start a stopped VM",
-		Args:  cobra.ExactArgs(1),
+		Long: `Start a stopped or suspended VM.
+
+With --all, start every stopped or suspended VM, a few at a time, and print
+a summary. --skip-stopped leaves out VMs that were stopped one at a time with
+'dabbi stop <name>', so after maintenance only the VMs that were running
+before 'dabbi stop --all' come back.
+
+Examples:
+  dabbi start my-vm
+  dabbi start --all --skip-stopped`,
+		Args: nameOrAll(&all),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if all {
+				return runBulk(bulk.ActionStart, skipStopped, parallel)
+			}
+
 			name := args[0]
 			fmt.Printf("Starting VM '%s'...\n", name)
 			if err := mpClient.Start(name); err != nil {
 				return err
 			}
+			if store, err := labelStore(); err == nil {
+				_ = store.Remove(name, labels.StoppedByUserKey)
+			}
 			fmt.Printf("VM '%s' started\n", name)
 			return nil
 		},
 	}
+
+	cmd.Flags().BoolVar(&all, "all", false, "Start every stopped or suspended VM")
+	cmd.Flags().BoolVar(&skipStopped, "skip-stopped", false, "With --all, skip VMs stopped with 'dabbi stop <name>'")
+	cmd.Flags().IntVar(&parallel, "parallel", bulk.DefaultParallel, "With --all, how many VMs to start at once")
+
+	return cmd
 }
 
 func newStopCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "stop <name>",
+	var all, force bool
+	var parallel int
+
+	cmd := &cobra.Command{
+		Use:   "stop <name> | --all",
 		Short: "Stop a running VM",
-		Args:  cobra.ExactArgs(1),
+		Long: `Stop a running VM.
+
+With --all, stop every running VM, a few at a time, and print a summary
+(e.g. before rebooting the host). VMs stopped this way are started again by
+'dabbi start --all --skip-stopped'; VMs stopped one at a time are not.
+
+With --force, the VM is powered off without waiting for a clean shutdown,
+for a guest that hangs on stop. Unsaved data in the VM may be lost.
+
+Examples:
+  dabbi stop my-vm
+  dabbi stop my-vm --force
+  dabbi stop --all`,
+		Args: nameOrAll(&all),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if all {
+				if force {
+					return fmt.Errorf("--force can't be combined with --all")
+				}
+				return runBulk(bulk.ActionStop, false, parallel)
+			}
+
 			name := args[0]
 			fmt.Printf("Stopping VM '%s'...\n", name)
-			if err := mpClient.Stop(name); err != nil {
+
+			// Through the daemon, so it also closes its tunnels and agent
+			// listener for the VM
+			err := daemonRequestWithTimeout(http.MethodPost, "/vms/"+url.PathEscape(name)+"/state",
+				map[string]interface{}{"action": "stop", "force": force}, nil, 0)
+			if errors.Is(err, errDaemonUnreachable) {
+				err = stopLocal(name, force)
+			}
+			if err != nil {
 				return err
 			}
 			fmt.Printf("VM '%s' stopped\n", name)
 			return nil
 		},
 	}
+
+	cmd.Flags().BoolVar(&all, "all", false, "Stop every running VM")
+	cmd.Flags().BoolVar(&force, "force", false, "Power off without waiting for a clean shutdown")
+	cmd.Flags().IntVar(&parallel, "parallel", bulk.DefaultParallel, "With --all, how many VMs to stop at once")
+
+	return cmd
+}
+
+// stopLocal stops a VM directly through multipass when the daemon isn't
+// running
+func stopLocal(name string, force bool) error {
+	var err error
+	if force {
+		err = mpClient.StopWithOptions(name, true, 0)
+	} else {
+		err = mpClient.Stop(name)
+	}
+	if err != nil {
+		return err
+	}
+	if store, err := labelStore(); err == nil {
+		_ = store.Mark(name, labels.StoppedByUserKey)
+	}
+	return nil
+}
+
+// nameOrAll accepts exactly one VM name, or none when --all is set
+func nameOrAll(all *bool) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if *all {
+			if len(args) > 0 {
+				return fmt.Errorf("--all can't be combined with a VM name")
+			}
+			return nil
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	}
+}
+
+// runBulk starts or stops every VM through the daemon, or directly if it
+// isn't running, and prints a table of the results
+func runBulk(action bulk.Action, skipUserStops bool, parallel int) error {
+	if parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+
+	var resp struct {
+		Results []bulk.Result `json:"results"`
+	}
+	req := map[string]interface{}{
+		"action":          action,
+		"all":             true,
+		"skip_user_stops": skipUserStops,
+		"parallel":        parallel,
+	}
+	// Stopping VMs can take a while, so don't time out
+	err := daemonRequestWithTimeout(http.MethodPost, "/vms/bulk", req, &resp, 0)
+	if errors.Is(err, errDaemonUnreachable) {
+		store, _ := labelStore()
+		resp.Results, err = bulk.Run(mpClient, store, action, bulk.Options{
+			SkipUserStops: skipUserStops,
+			Parallel:      parallel,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Results) == 0 {
+		fmt.Println("No VMs")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tRESULT\tDETAIL")
+	fmt.Fprintln(w, "----\t------\t------")
+	var failed int
+	for _, r := range resp.Results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Status, r.Detail)
+		if r.Status == bulk.StatusFailed {
+			failed++
+		}
+	}
+	w.Flush()
+
+	fmt.Printf("\n%s\n", bulk.Summary(action, resp.Results))
+	if failed > 0 {
+		return fmt.Errorf("%d VM(s) failed to %s", failed, action)
+	}
+	return nil
 }
 
 func newRestartCmd() *cobra.Command {
@@ -59,18 +212,40 @@ func newRestartCmd() *cobra.Command {
 
 func newDeleteCmd() *cobra.Command {
 	var keepRecoverable bool
+	var yes bool
 
 	cmd := &cobra.Command{
 		Use:   "delete <name>",
 		Short: "Delete a VM",
 		Long: `Delete a VM permanently.
 
-Use --keep-recoverable to allow recovery with 'multipass recover'.`,
+Use --keep-recoverable to allow recovery with 'multipass recover'.
+Asks for confirmation first unless --yes is given; without a terminal,
+--yes is required.`,
 		Args: cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			name := args[0]
+			prompt := fmt.Sprintf("Delete '%s'? Its disk and snapshots will be lost. [y/N] ", name)
+			if keepRecoverable {
+				prompt = fmt.Sprintf("Delete '%s'? It can be recovered with 'multipass recover' until purged. [y/N] ", name)
+			}
+			if ok, err := confirmAction(prompt, yes); !ok {
+				return err
+			}
+
 			fmt.Printf("Deleting VM '%s'...\n", name)
-			if err := mpClient.Delete(name, !keepRecoverable); err != nil {
+
+			// A purge goes through the daemon, so it also closes its tunnels
+			// and agent listener for the VM. The API always purges, so
+			// --keep-recoverable goes straight to multipass.
+			err := errDaemonUnreachable
+			if !keepRecoverable {
+				err = daemonRequestWithTimeout(http.MethodDelete, "/vms/"+url.PathEscape(name), nil, nil, 0)
+			}
+			if errors.Is(err, errDaemonUnreachable) {
+				err = deleteLocal(name, keepRecoverable)
+			}
+			if err != nil {
 				return err
 			}
 			fmt.Printf("VM '%s' deleted\n", name)
@@ -79,6 +254,36 @@ Use --keep-recoverable to allow recovery with 'multipass recover'.`,
 	}
 
 	cmd.Flags().BoolVar(&keepRecoverable, "keep-recoverable", false, "Keep VM recoverable (don't purge)")
+	addYesFlags(cmd, &yes)
 
 	return cmd
 }
+
+// deleteLocal deletes a VM directly through multipass
+func deleteLocal(name string, keepRecoverable bool) error {
+	if err := mpClient.Delete(name, !keepRecoverable); err != nil {
+		return err
+	}
+	if keepRecoverable {
+		return nil
+	}
+
+	// A purged VM can't come back, so drop its host-side labels, spec,
+	// and mount records too
+	if store, err := labelStore(); err == nil {
+		if err := store.Delete(name); err != nil {
+			fmt.Printf("Warning: failed to remove labels: %v\n", err)
+		}
+	}
+	if specs, err := specStore(); err == nil {
+		if err := specs.Delete(name); err != nil {
+			fmt.Printf("Warning: failed to remove VM spec: %v\n", err)
+		}
+	}
+	if store, err := mountStore(); err == nil {
+		if err := store.Delete(name); err != nil {
+			fmt.Printf("Warning: failed to remove mount records: %v\n", err)
+		}
+	}
+	return nil
+}
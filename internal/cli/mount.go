@@ -2,7 +2,13 @@ package cli
 
 import (
 	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
 
+	"github.com/mjshashank/dabbi/internal/mounts"
+	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/spf13/cobra"
 )
 
@@ -12,12 +18,15 @@ func newMountCmd() *cobra.Command {
 		Short: "Manage VM mounts",
 		Long: `Mount or unmount host directories to VMs.
 
-Mounts persist across VM reboots (managed by multipass).`,
+Mounts persist across VM reboots (managed by multipass). dabbi also records
+how each mount was added in ~/.dabbi/mounts, so 'dabbi mount restore' can
+apply them again after a VM is recreated.`,
 	}
 
 	cmd.AddCommand(
-		newMountAddCmd(),
-		newMountRemoveCmd(),
+		audited(newMountAddCmd()),
+		audited(newMountRemoveCmd()),
+		audited(newMountRestoreCmd()),
 		newMountListCmd(),
 	)
 
@@ -25,25 +34,61 @@ Mounts persist across VM reboots (managed by multipass).`,
 }
 
 func newMountAddCmd() *cobra.Command {
-	return &cobra.Command{
+	var (
+		uidMaps   []string
+		gidMaps   []string
+		mountType string
+	)
+
+	cmd := &cobra.Command{
 		Use:   "add <vm_name> <host_path> <vm_path>",
 		Short: "Mount host directory to VM",
 		Long: `Mount a host directory into a VM.
 
-Example:
-  dabbi mount add my-vm /home/user/projects /home/ubuntu/projects`,
+--uid-map and --gid-map map host ids to VM ids (<host>:<vm>, repeatable),
+so files you own on the host are owned by the right user in the VM.
+Without them multipass maps your user to the VM's default user.
+
+--type native uses the hypervisor's file sharing instead of SSHFS. It is
+faster but can only be added to a stopped VM.
+
+Examples:
+  dabbi mount add my-vm /home/user/projects /home/ubuntu/projects
+  dabbi mount add my-vm ~/src /home/ubuntu/src --uid-map 501:1000 --gid-map 20:1000
+  dabbi mount add my-vm ~/data /data --type native`,
 		Args: cobra.ExactArgs(3),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			vmName, hostPath, vmPath := args[0], args[1], args[2]
+			opts := multipass.MountOptions{
+				HostPath: args[1],
+				VMPath:   args[2],
+				UIDMaps:  uidMaps,
+				GIDMaps:  gidMaps,
+				Type:     mountType,
+			}
+			if err := multipass.ValidateMount(opts); err != nil {
+				return err
+			}
+			vmName := args[0]
 
-			fmt.Printf("Mounting %s -> %s:%s...\n", hostPath, vmName, vmPath)
-			if err := mpClient.Mount(vmName, hostPath, vmPath); err != nil {
+			fmt.Printf("Mounting %s -> %s:%s...\n", opts.HostPath, vmName, opts.VMPath)
+			if err := mpClient.Mount(vmName, opts); err != nil {
 				return err
 			}
+			if store, err := mountStore(); err == nil {
+				if err := store.Add(vmName, mounts.EntryFromOptions(opts)); err != nil {
+					fmt.Printf("Warning: failed to record mount: %v\n", err)
+				}
+			}
 			fmt.Println("Mount added")
 			return nil
 		},
 	}
+
+	cmd.Flags().StringArrayVar(&uidMaps, "uid-map", nil, "Map a host uid to a VM uid (<host>:<vm>, repeatable)")
+	cmd.Flags().StringArrayVar(&gidMaps, "gid-map", nil, "Map a host gid to a VM gid (<host>:<vm>, repeatable)")
+	cmd.Flags().StringVar(&mountType, "type", "", "Mount type: classic (SSHFS, default) or native")
+
+	return cmd
 }
 
 func newMountRemoveCmd() *cobra.Command {
@@ -59,19 +104,91 @@ func newMountRemoveCmd() *cobra.Command {
 			if err := mpClient.Unmount(vmName, vmPath); err != nil {
 				return err
 			}
+			if store, err := mountStore(); err == nil {
+				if err := store.Remove(vmName, vmPath); err != nil {
+					fmt.Printf("Warning: failed to forget mount: %v\n", err)
+				}
+			}
 			fmt.Println("Mount removed")
 			return nil
 		},
 	}
 }
 
-func newMountListCmd() *cobra.Command {
+func newMountRestoreCmd() *cobra.Command {
 	return &cobra.Command{
-		Use:     "list <vm_name>",
-		Short:   "List mounts for a VM",
+		Use:   "restore <vm_name>",
+		Short: "Re-apply a VM's recorded mounts",
+		Long: `Mount again every directory dabbi recorded for a VM that the VM doesn't
+currently have, with the same id mappings and type. Use it after
+'dabbi recreate', since multipass mounts don't always survive a rebuild.
+
+Mounts already in place are skipped.
+
+Example:
+  dabbi mount restore my-vm`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+
+			store, err := mountStore()
+			if err != nil {
+				return err
+			}
+			results, err := mounts.Restore(mpClient, store, vmName)
+			if err != nil {
+				return err
+			}
+			if len(results) == 0 {
+				fmt.Printf("No mounts recorded for VM '%s'\n", vmName)
+				return nil
+			}
+
+			var failed int
+			for _, r := range results {
+				line := fmt.Sprintf("  [%s] %s -> %s", r.Status, r.HostPath, r.VMPath)
+				if r.Detail != "" {
+					line += " (" + r.Detail + ")"
+				}
+				fmt.Println(line)
+				if r.Status == mounts.StatusFailed {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d mount(s) could not be restored", failed)
+			}
+			return nil
+		},
+	}
+}
+
+func newMountListCmd() *cobra.Command {
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:     "list <vm_name> | --all",
+		Short:   "List mounts for a VM, or every VM",
 		Aliases: []string{"ls"},
-		Args:    cobra.ExactArgs(1),
+		Long: `List the mounts of a VM.
+
+With --all, list every VM's mounts instead, marking host directories
+that no longer exist, e.g. after a project was moved. Those mounts are
+stale: remove them and mount the new location.
+
+Examples:
+  dabbi mount list my-vm
+  dabbi mount list --all`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if all {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.ExactArgs(1)(cmd, args)
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if all {
+				return listAllMounts()
+			}
 			vmName := args[0]
 
 			info, err := mpClient.Info(vmName)
@@ -84,11 +201,85 @@ func newMountListCmd() *cobra.Command {
 				return nil
 			}
 
+			recorded := make(map[string]mounts.Entry)
+			if store, err := mountStore(); err == nil {
+				entries, _ := store.List(vmName)
+				for _, e := range entries {
+					recorded[e.VMPath] = e
+				}
+			}
+
+			vmPaths := make([]string, 0, len(info.Mounts))
+			for vmPath := range info.Mounts {
+				vmPaths = append(vmPaths, vmPath)
+			}
+			sort.Strings(vmPaths)
+
 			fmt.Printf("Mounts for VM '%s':\n", vmName)
-			for vmPath, mount := range info.Mounts {
-				fmt.Printf("  %s -> %s\n", mount.SourcePath, vmPath)
+			for _, vmPath := range vmPaths {
+				mount := info.Mounts[vmPath]
+				line := fmt.Sprintf("  %s -> %s", mount.SourcePath, vmPath)
+				var details []string
+				if rec, ok := recorded[vmPath]; ok && rec.HostPath == mount.SourcePath && rec.Type != "" {
+					details = append(details, "type "+rec.Type)
+				}
+				if len(mount.UIDMappings) > 0 {
+					details = append(details, "uid "+strings.Join(mount.UIDMappings, ","))
+				}
+				if len(mount.GIDMappings) > 0 {
+					details = append(details, "gid "+strings.Join(mount.GIDMappings, ","))
+				}
+				if len(details) > 0 {
+					line += " (" + strings.Join(details, "; ") + ")"
+				}
+				fmt.Println(line)
 			}
 			return nil
 		},
 	}
+
+	cmd.Flags().BoolVar(&all, "all", false, "List the mounts of every VM")
+
+	return cmd
+}
+
+// listAllMounts prints every VM's mounts, flagging missing host directories
+func listAllMounts() error {
+	found, failed, err := mounts.All(mpClient, 0)
+	if err != nil {
+		return err
+	}
+	for _, f := range failed {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't read mounts of VM '%s': %s\n", f.VM, f.Error)
+	}
+	if len(found) == 0 {
+		fmt.Println("No mounts")
+		return nil
+	}
+
+	var missing int
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VM\tHOST PATH\tVM PATH\tHOST PATH EXISTS")
+	for _, m := range found {
+		exists := "yes"
+		if !m.HostPathExists {
+			exists = "no"
+			missing++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.VM, m.HostPath, m.VMPath, exists)
+	}
+	w.Flush()
+
+	if missing > 0 {
+		fmt.Printf("\n%d mount(s) point at host directories that no longer exist\n", missing)
+	}
+	return nil
+}
+
+func mountStore() (*mounts.Store, error) {
+	dir, err := mounts.DefaultDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate mount records: %w", err)
+	}
+	return mounts.NewStore(dir), nil
 }
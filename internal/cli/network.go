@@ -1,9 +1,15 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
 	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/mjshashank/dabbi/internal/config"
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/network"
 	"github.com/spf13/cobra"
@@ -23,9 +29,14 @@ Supports three modes:
 
 	cmd.AddCommand(
 		newNetworkGetCmd(),
-		newNetworkSetCmd(),
-		newNetworkRemoveCmd(),
-		newNetworkApplyCmd(),
+		audited(newNetworkSetCmd()),
+		audited(newNetworkRemoveCmd()),
+		audited(newNetworkApplyCmd()),
+		audited(newNetworkPauseCmd()),
+		audited(newNetworkResumeCmd()),
+		newNetworkTestCmd(),
+		audited(newNetworkVerifyCmd()),
+		newNetworkDefaultsCmd(),
 	)
 
 	return cmd
@@ -49,27 +60,15 @@ func newNetworkGetCmd() *cobra.Command {
 				return fmt.Errorf("VM must be running to query network config (current state: %s)", info.State)
 			}
 
-			applier := network.NewApplier(mpClient)
+			applier := newApplier()
 			config, err := applier.GetCurrentConfig(vmName)
 			if err != nil {
 				return fmt.Errorf("failed to get network config: %w", err)
 			}
 
-			if config == nil || config.Mode == multipass.NetworkModeNone {
-				fmt.Printf("Network mode: none (no restrictions)\n")
-				return nil
-			}
-
-			fmt.Printf("Network mode: %s\n", config.Mode)
-			if len(config.Rules) > 0 {
-				fmt.Printf("Rules:\n")
-				for _, rule := range config.Rules {
-					comment := ""
-					if rule.Comment != "" {
-						comment = fmt.Sprintf(" (%s)", rule.Comment)
-					}
-					fmt.Printf("  - %s: %s%s\n", rule.Type, rule.Value, comment)
-				}
+			printNetworkConfig(config)
+			if paused, _ := applier.IsPaused(vmName); paused {
+				fmt.Printf("\nRestrictions are paused; run 'dabbi network resume %s' to restore them\n", vmName)
 			}
 			return nil
 		},
@@ -78,75 +77,62 @@ func newNetworkGetCmd() *cobra.Command {
 
 func newNetworkSetCmd() *cobra.Command {
 	var (
-		mode        string
-		allowHosts  []string
-		blockHosts  []string
+		mode         string
+		allowHosts   []string
+		allowPresets []string
+		blockHosts   []string
+		dnsServers   []string
+		scope        string
+		all          bool
+		parallel     int
 	)
 
 	cmd := &cobra.Command{
-		Use:   "set <vm-name>",
+		Use:   "set <vm-name> | --all",
 		Short: "Set network restrictions for a VM",
 		Long: `Set network restrictions for a VM.
 
+With --all, apply the same restrictions to every running VM, a few at a
+time, and print a summary.
+
 Examples:
   # Allow only specific hosts
   dabbi network set my-vm --mode allowlist --allow github.com --allow 10.0.0.0/8
 
+  # Label rules with a comment (shown by "network get")
+  dabbi network set my-vm --mode allowlist --allow "github.com#GitHub API"
+
+  # Allow the hosts of common services (github, npm, pypi, ubuntu-apt)
+  dabbi network set my-vm --mode allowlist --allow-preset github --allow-preset npm
+
   # Block specific hosts
   dabbi network set my-vm --mode blocklist --block facebook.com --block 192.168.1.100
 
   # Completely isolate VM from network
-  dabbi network set my-vm --mode isolated`,
-		Args: cobra.ExactArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
-			vmName := args[0]
+  dabbi network set my-vm --mode isolated
 
-			// Validate mode
-			var networkMode multipass.NetworkMode
-			switch mode {
-			case "none":
-				networkMode = multipass.NetworkModeNone
-			case "allowlist":
-				networkMode = multipass.NetworkModeAllowlist
-			case "blocklist":
-				networkMode = multipass.NetworkModeBlocklist
-			case "isolated":
-				networkMode = multipass.NetworkModeIsolated
-			default:
-				return fmt.Errorf("invalid mode: %s (must be none, allowlist, blocklist, or isolated)", mode)
-			}
-
-			// Build rules
-			var rules []multipass.NetworkRule
-
-			if networkMode == multipass.NetworkModeAllowlist {
-				for _, host := range allowHosts {
-					rule := parseHostToRule(host)
-					rules = append(rules, rule)
-				}
-				if len(rules) == 0 {
-					return fmt.Errorf("allowlist mode requires at least one --allow flag")
-				}
-			} else if networkMode == multipass.NetworkModeBlocklist {
-				for _, host := range blockHosts {
-					rule := parseHostToRule(host)
-					rules = append(rules, rule)
-				}
-				if len(rules) == 0 {
-					return fmt.Errorf("blocklist mode requires at least one --block flag")
-				}
-			}
+  # Enforce the rules with the host's iptables, out of reach of the VM's
+  # root user (Linux hosts only; needs root or passwordless sudo)
+  dabbi network set my-vm --mode isolated --scope host
 
-			config := &multipass.NetworkConfig{
-				Mode:  networkMode,
-				Rules: rules,
+  # Allow only GitHub on every running VM
+  dabbi network set --all --mode allowlist --allow-preset github`,
+		Args: nameOrAll(&all),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := buildNetworkConfig(mode, allowHosts, allowPresets, blockHosts, dnsServers)
+			if err != nil {
+				return err
 			}
-
-			// Validate config
+			config.Scope = multipass.NetworkScope(scope)
 			if err := network.ValidateConfig(config); err != nil {
-				return fmt.Errorf("invalid config: %w", err)
+				return err
 			}
 
+			if all {
+				return runNetworkBulk(config, parallel)
+			}
+			vmName := args[0]
+
 			// Check if VM exists and is running
 			info, err := mpClient.Info(vmName)
 			if err != nil {
@@ -157,9 +143,9 @@ Examples:
 				return fmt.Errorf("VM must be running to set network config (current state: %s)", info.State)
 			}
 
-			fmt.Printf("Applying network config (mode=%s) to VM '%s'...\n", mode, vmName)
+			fmt.Printf("Applying network config (mode=%s) to VM '%s'...\n", config.Mode, vmName)
 
-			applier := network.NewApplier(mpClient)
+			applier := newApplier()
 			if err := applier.ApplyToVM(vmName, config); err != nil {
 				return fmt.Errorf("failed to apply network config: %w", err)
 			}
@@ -170,13 +156,222 @@ Examples:
 	}
 
 	cmd.Flags().StringVar(&mode, "mode", "", "Network mode: none, allowlist, blocklist, isolated (required)")
-	cmd.Flags().StringArrayVar(&allowHosts, "allow", nil, "Host to allow (IP, CIDR, or domain) - use with allowlist mode")
-	cmd.Flags().StringArrayVar(&blockHosts, "block", nil, "Host to block (IP, CIDR, or domain) - use with blocklist mode")
+	cmd.Flags().StringArrayVar(&allowHosts, "allow", nil, "Host to allow (IP, CIDR, or domain, optionally host#comment) - use with allowlist mode")
+	cmd.Flags().StringArrayVar(&allowPresets, "allow-preset", nil, "Allow a preset's hosts: "+strings.Join(network.PresetNames(), ", ")+" - use with allowlist mode")
+	cmd.Flags().StringArrayVar(&blockHosts, "block", nil, "Host to block (IP, CIDR, or domain, optionally host#comment) - use with blocklist mode")
+	cmd.Flags().StringArrayVar(&dnsServers, "dns", nil, "DNS server IP the VM may query in allowlist mode (default: the VM's own resolvers)")
+	cmd.Flags().StringVar(&scope, "scope", "vm", "Where to enforce the rules: vm (iptables in the VM) or host (the host's iptables, Linux only)")
+	cmd.Flags().BoolVar(&all, "all", false, "Apply to every running VM")
+	cmd.Flags().IntVar(&parallel, "parallel", network.DefaultBulkParallel, "With --all, how many VMs to apply to at once")
 	cmd.MarkFlagRequired("mode")
 
 	return cmd
 }
 
+// runNetworkBulk applies config to every running VM through the daemon, or
+// directly if it isn't running, and prints a table of the results
+func runNetworkBulk(config *multipass.NetworkConfig, parallel int) error {
+	if parallel < 1 {
+		return fmt.Errorf("--parallel must be at least 1")
+	}
+
+	var resp struct {
+		Results []network.BulkResult `json:"results"`
+	}
+	req := map[string]interface{}{
+		"all":      true,
+		"config":   config,
+		"parallel": parallel,
+	}
+	fmt.Printf("Applying network config (mode=%s) to all running VMs...\n", config.Mode)
+	// Applies can take a while (e.g. installing iptables), so don't time out
+	err := daemonRequestWithTimeout(http.MethodPost, "/network/apply-bulk", req, &resp, 0)
+	if errors.Is(err, errDaemonUnreachable) {
+		resp.Results, err = newApplier().ApplyBulk(nil, config, parallel)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Results) == 0 {
+		fmt.Println("No VMs")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tRESULT\tDETAIL")
+	fmt.Fprintln(w, "----\t------\t------")
+	var applied, skipped, failed int
+	for _, r := range resp.Results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Status, r.Detail)
+		switch r.Status {
+		case network.BulkStatusOK:
+			applied++
+		case network.BulkStatusSkipped:
+			skipped++
+		case network.BulkStatusFailed:
+			failed++
+		}
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d applied, %d skipped, %d failed\n", applied, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d VM(s) failed to apply network config", failed)
+	}
+	return nil
+}
+
+func newNetworkTestCmd() *cobra.Command {
+	var (
+		hosts   []string
+		timeout int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "test <vm-name> --host <host>...",
+		Short: "Check which hosts a VM can reach",
+		Long: `Check from inside a VM whether each host can be reached, to confirm the
+applied network rules work. A plain host is fetched over HTTPS (any HTTP
+answer counts as reachable); host:port gets a TCP connect instead.
+
+Examples:
+  dabbi network test my-vm --host github.com --host example.com
+  dabbi network test my-vm --host 10.0.0.5:5432 --timeout 10`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+
+			if len(hosts) == 0 {
+				return fmt.Errorf("at least one --host is required")
+			}
+			if len(hosts) > network.MaxProbeHosts {
+				return fmt.Errorf("at most %d hosts can be tested at once", network.MaxProbeHosts)
+			}
+			for _, host := range hosts {
+				if err := network.ValidateProbeHost(host); err != nil {
+					return err
+				}
+			}
+			if timeout < 1 || time.Duration(timeout)*time.Second > network.MaxProbeTimeout {
+				return fmt.Errorf("--timeout must be between 1 and %d seconds", int(network.MaxProbeTimeout.Seconds()))
+			}
+
+			info, err := mpClient.Info(vmName)
+			if err != nil {
+				return fmt.Errorf("VM not found: %w", err)
+			}
+			if info.State != multipass.StateRunning {
+				return fmt.Errorf("VM must be running to test its network (current state: %s)", info.State)
+			}
+
+			results := network.ProbeHosts(mpClient, vmName, hosts, time.Duration(timeout)*time.Second)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "HOST\tRESULT\tDETAIL")
+			reachable := 0
+			for _, r := range results {
+				switch {
+				case r.Reachable && r.HTTPStatus > 0:
+					reachable++
+					fmt.Fprintf(w, "%s\treachable\tHTTP %d\n", r.Host, r.HTTPStatus)
+				case r.Reachable:
+					reachable++
+					fmt.Fprintf(w, "%s\treachable\tconnected\n", r.Host)
+				default:
+					fmt.Fprintf(w, "%s\tblocked\t%s\n", r.Host, r.Error)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			fmt.Printf("\n%d reachable, %d blocked\n", reachable, len(results)-reachable)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringArrayVar(&hosts, "host", nil, "Host to check: a domain or IP, or host:port for a TCP connect (repeatable)")
+	cmd.Flags().IntVar(&timeout, "timeout", int(network.DefaultProbeTimeout.Seconds()), "Seconds each host gets to answer")
+
+	return cmd
+}
+
+func newNetworkVerifyCmd() *cobra.Command {
+	var apply bool
+
+	cmd := &cobra.Command{
+		Use:   "verify <vm-name>",
+		Short: "Check a VM's live network rules against its config",
+		Long: `Compare the iptables and ip6tables rules live inside a VM against its
+stored network configuration, listing rules that are missing or were added
+by hand (e.g. after someone ran iptables -F in the VM).
+
+When the rules have drifted you're asked whether to re-apply the stored
+configuration; --apply does so without asking. Without a terminal to ask
+on, drift makes the command fail so scripts can notice it.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+
+			info, err := mpClient.Info(vmName)
+			if err != nil {
+				return fmt.Errorf("VM not found: %w", err)
+			}
+
+			if info.State != multipass.StateRunning {
+				return fmt.Errorf("VM must be running to verify network rules (current state: %s)", info.State)
+			}
+
+			applier := newApplier()
+			config, err := applier.GetCurrentConfig(vmName)
+			if err != nil {
+				return fmt.Errorf("failed to get current config: %w", err)
+			}
+			if paused, _ := applier.IsPaused(vmName); paused {
+				return fmt.Errorf("network restrictions are paused; run 'dabbi network resume %s' first", vmName)
+			}
+
+			drift, err := applier.Verify(vmName, config)
+			if err != nil {
+				return fmt.Errorf("failed to verify network rules: %w", err)
+			}
+			if len(drift) == 0 {
+				fmt.Printf("Network rules in VM '%s' match its config\n", vmName)
+				return nil
+			}
+
+			fmt.Printf("Network rules in VM '%s' have drifted from its config:\n", vmName)
+			for _, d := range drift {
+				fmt.Printf("  %s\n", d)
+			}
+			fmt.Println()
+
+			if !apply {
+				if !isTerminal(os.Stdin) || !isTerminal(os.Stdout) {
+					return fmt.Errorf("%d rule(s) drifted; run 'dabbi network apply %s' to restore them", len(drift), vmName)
+				}
+				if !confirm("Re-apply the stored config? [y/N] ") {
+					return fmt.Errorf("%d rule(s) drifted", len(drift))
+				}
+			}
+
+			if config == nil {
+				err = applier.RemoveFromVM(vmName)
+			} else {
+				err = applier.ApplyToVM(vmName, config)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to apply network config: %w", err)
+			}
+			fmt.Printf("Network rules re-applied successfully\n")
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&apply, "apply", false, "Re-apply the stored config on drift without asking")
+
+	return cmd
+}
+
 func newNetworkRemoveCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "remove <vm-name>",
@@ -197,7 +392,7 @@ func newNetworkRemoveCmd() *cobra.Command {
 
 			fmt.Printf("Removing network restrictions from VM '%s'...\n", vmName)
 
-			applier := network.NewApplier(mpClient)
+			applier := newApplier()
 			if err := applier.RemoveFromVM(vmName); err != nil {
 				return fmt.Errorf("failed to remove network config: %w", err)
 			}
@@ -227,7 +422,7 @@ func newNetworkApplyCmd() *cobra.Command {
 				return fmt.Errorf("VM must be running to apply network config (current state: %s)", info.State)
 			}
 
-			applier := network.NewApplier(mpClient)
+			applier := newApplier()
 
 			// Get current config
 			config, err := applier.GetCurrentConfig(vmName)
@@ -251,38 +446,270 @@ func newNetworkApplyCmd() *cobra.Command {
 	}
 }
 
-// parseHostToRule converts a host string to a NetworkRule
-// It auto-detects the type based on the format
-func parseHostToRule(host string) multipass.NetworkRule {
-	// Check if it's a CIDR
-	if strings.Contains(host, "/") {
-		return multipass.NetworkRule{Type: "cidr", Value: host}
+func newNetworkPauseCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pause <vm-name>",
+		Short: "Temporarily lift a VM's network restrictions",
+		Long: `Temporarily lift a VM's network restrictions, keeping its configuration.
+
+Useful for e.g. installing a package an allowlist blocks. Restrictions come
+back with 'network resume' or when the VM restarts.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+
+			info, err := mpClient.Info(vmName)
+			if err != nil {
+				return fmt.Errorf("VM not found: %w", err)
+			}
+
+			if info.State != multipass.StateRunning {
+				return fmt.Errorf("VM must be running to pause network rules (current state: %s)", info.State)
+			}
+
+			if err := newApplier().Pause(vmName); err != nil {
+				return fmt.Errorf("failed to pause network rules: %w", err)
+			}
+
+			fmt.Printf("Network restrictions paused for VM '%s'\n", vmName)
+			fmt.Printf("Run 'dabbi network resume %s' to restore them (restarting the VM also does)\n", vmName)
+			return nil
+		},
+	}
+}
+
+func newNetworkResumeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "resume <vm-name>",
+		Short: "Restore a VM's paused network restrictions",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			vmName := args[0]
+
+			info, err := mpClient.Info(vmName)
+			if err != nil {
+				return fmt.Errorf("VM not found: %w", err)
+			}
+
+			if info.State != multipass.StateRunning {
+				return fmt.Errorf("VM must be running to resume network rules (current state: %s)", info.State)
+			}
+
+			if err := newApplier().Resume(vmName); err != nil {
+				return fmt.Errorf("failed to resume network rules: %w", err)
+			}
+
+			fmt.Printf("Network restrictions resumed for VM '%s'\n", vmName)
+			return nil
+		},
 	}
+}
 
-	// Check if it looks like an IP address
-	if isIPLike(host) {
-		return multipass.NetworkRule{Type: "ip", Value: host}
+func newNetworkDefaultsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "defaults",
+		Short: "Manage the default network restrictions for new VMs",
+		Long:  `Manage the network restrictions applied to VMs created without --network-mode.`,
 	}
 
-	// Otherwise, treat as domain
-	return multipass.NetworkRule{Type: "domain", Value: host}
+	cmd.AddCommand(
+		newNetworkDefaultsGetCmd(),
+		newNetworkDefaultsSetCmd(),
+	)
+
+	return cmd
 }
 
-// isIPLike checks if a string looks like an IP address
-func isIPLike(s string) bool {
-	parts := strings.Split(s, ".")
-	if len(parts) != 4 {
-		return false
+func newNetworkDefaultsGetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get",
+		Short: "Show the default network configuration for new VMs",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var resp networkConfigResponse
+			err := daemonRequest(http.MethodGet, "/network/defaults", nil, &resp)
+			if errors.Is(err, errDaemonUnreachable) {
+				printNetworkConfig(cfg.Defaults.NetworkConfig)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			printNetworkConfig(&multipass.NetworkConfig{
+				Mode:       multipass.NetworkMode(resp.Mode),
+				Rules:      resp.Rules,
+				DNSServers: resp.DNSServers,
+			})
+			return nil
+		},
 	}
-	for _, part := range parts {
-		if len(part) == 0 || len(part) > 3 {
-			return false
+}
+
+func newNetworkDefaultsSetCmd() *cobra.Command {
+	var (
+		mode         string
+		allowHosts   []string
+		allowPresets []string
+		blockHosts   []string
+		dnsServers   []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "set",
+		Short: "Set the default network restrictions for new VMs",
+		Long: `Set the network restrictions applied to VMs created without --network-mode.
+Existing VMs are not changed.
+
+Examples:
+  # New VMs may only reach GitHub
+  dabbi network defaults set --mode allowlist --allow github.com
+
+  # Clear the default
+  dabbi network defaults set --mode none`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := buildNetworkConfig(mode, allowHosts, allowPresets, blockHosts, dnsServers)
+			if err != nil {
+				return err
+			}
+
+			req := networkConfigRequest{Mode: string(config.Mode), Rules: config.Rules, DNSServers: config.DNSServers}
+			err = daemonRequest(http.MethodPut, "/network/defaults", req, nil)
+			if errors.Is(err, errDaemonUnreachable) {
+				cfg.Defaults.NetworkConfig = config
+				if err := cfg.Save(); err != nil {
+					return fmt.Errorf("failed to save config: %w", err)
+				}
+				fmt.Printf("Default network mode saved: %s (daemon not running, applies on next start)\n", config.Mode)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Default network mode set to %s\n", config.Mode)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&mode, "mode", "", "Network mode: none, allowlist, blocklist, isolated (required)")
+	cmd.Flags().StringArrayVar(&allowHosts, "allow", nil, "Host to allow (IP, CIDR, or domain, optionally host#comment) - use with allowlist mode")
+	cmd.Flags().StringArrayVar(&allowPresets, "allow-preset", nil, "Allow a preset's hosts: "+strings.Join(network.PresetNames(), ", ")+" - use with allowlist mode")
+	cmd.Flags().StringArrayVar(&blockHosts, "block", nil, "Host to block (IP, CIDR, or domain, optionally host#comment) - use with blocklist mode")
+	cmd.Flags().StringArrayVar(&dnsServers, "dns", nil, "DNS server IP the VM may query in allowlist mode (default: the VM's own resolvers)")
+	cmd.MarkFlagRequired("mode")
+
+	return cmd
+}
+
+// networkConfigRequest mirrors the daemon's network config request body
+type networkConfigRequest struct {
+	Mode       string                  `json:"mode"`
+	Rules      []multipass.NetworkRule `json:"rules"`
+	DNSServers []string                `json:"dns_servers,omitempty"`
+}
+
+// networkConfigResponse mirrors the daemon's network config response body
+type networkConfigResponse struct {
+	Mode       string                  `json:"mode"`
+	Rules      []multipass.NetworkRule `json:"rules"`
+	DNSServers []string                `json:"dns_servers,omitempty"`
+}
+
+// newApplier creates a network applier honoring the tool auto-install setting
+func newApplier() *network.Applier {
+	applier := network.NewApplier(mpClient)
+	applier.SetAutoInstall(cfg.NetworkAutoInstallTools)
+	if dir, err := config.HostNetworkPath(); err == nil {
+		applier.SetHostDir(dir)
+	}
+	return applier
+}
+
+// buildNetworkConfig turns --mode/--allow/--allow-preset/--block/--dns flag
+// values into a validated config. Preset rules come after the --allow ones.
+func buildNetworkConfig(mode string, allowHosts, allowPresets, blockHosts, dnsServers []string) (*multipass.NetworkConfig, error) {
+	var networkMode multipass.NetworkMode
+	switch mode {
+	case "none":
+		networkMode = multipass.NetworkModeNone
+	case "allowlist":
+		networkMode = multipass.NetworkModeAllowlist
+	case "blocklist":
+		networkMode = multipass.NetworkModeBlocklist
+	case "isolated":
+		networkMode = multipass.NetworkModeIsolated
+	default:
+		return nil, fmt.Errorf("invalid mode: %s (must be none, allowlist, blocklist, or isolated)", mode)
+	}
+
+	var rules []multipass.NetworkRule
+	if networkMode == multipass.NetworkModeAllowlist {
+		for _, host := range allowHosts {
+			rules = append(rules, parseNetworkHost(host))
+		}
+		presetRules, err := network.ExpandPresets(allowPresets)
+		if err != nil {
+			return nil, fmt.Errorf("--allow-preset: %w", err)
+		}
+		rules = append(rules, presetRules...)
+		if len(rules) == 0 {
+			return nil, fmt.Errorf("allowlist mode requires at least one --allow or --allow-preset flag")
+		}
+	} else if len(allowPresets) > 0 {
+		return nil, fmt.Errorf("--allow-preset only applies to allowlist mode")
+	}
+	if networkMode == multipass.NetworkModeBlocklist {
+		for _, host := range blockHosts {
+			rules = append(rules, parseNetworkHost(host))
 		}
-		for _, c := range part {
-			if c < '0' || c > '9' {
-				return false
+		if len(rules) == 0 {
+			return nil, fmt.Errorf("blocklist mode requires at least one --block flag")
+		}
+	}
+
+	config := &multipass.NetworkConfig{
+		Mode:  networkMode,
+		Rules: rules,
+	}
+	if networkMode == multipass.NetworkModeAllowlist {
+		config.DNSServers = dnsServers
+	} else if len(dnsServers) > 0 {
+		return nil, fmt.Errorf("--dns only applies to allowlist mode")
+	}
+	if err := network.ValidateConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+// printNetworkConfig prints a network config's mode and rules
+func printNetworkConfig(config *multipass.NetworkConfig) {
+	if config == nil || config.Mode == multipass.NetworkModeNone {
+		fmt.Printf("Network mode: none (no restrictions)\n")
+		return
+	}
+
+	fmt.Printf("Network mode: %s\n", config.Mode)
+	if config.HostScoped() {
+		fmt.Printf("Enforced on: host\n")
+	}
+	if len(config.Rules) > 0 {
+		fmt.Printf("Rules:\n")
+		for _, rule := range config.Rules {
+			comment := ""
+			if rule.Comment != "" {
+				comment = fmt.Sprintf(" (%s)", rule.Comment)
 			}
+			fmt.Printf("  - %s: %s%s\n", rule.Type, rule.Value, comment)
+		}
+	}
+	if config.Mode == multipass.NetworkModeAllowlist {
+		dns := "VM default resolvers"
+		if len(config.DNSServers) > 0 {
+			dns = strings.Join(config.DNSServers, ", ")
 		}
+		fmt.Printf("DNS: %s\n", dns)
 	}
-	return true
 }
@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+func newOpenCmd() *cobra.Command {
+	var (
+		agent bool
+		ui    bool
+		port  int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "open <name>",
+		Short: "Open a VM's page, agent, or app in the browser",
+		Long: `Open a VM in the default browser through the running daemon.
+
+By default this opens the VM's page in the web UI. --agent opens the
+OpenCode web UI running in the VM, already signed in. --port opens an app
+the VM serves on that port via http://<vm>-<port>.localhost (or the
+daemon's domain).
+
+The daemon must be running; see --daemon-url if it isn't on localhost.
+
+Examples:
+  dabbi open my-vm
+  dabbi open my-vm --agent
+  dabbi open my-vm --port 3000`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+
+			if port != 0 && (port < 1 || port > 65535) {
+				return fmt.Errorf("--port must be between 1 and 65535")
+			}
+
+			var target string
+			var err error
+			switch {
+			case agent:
+				target, err = agentURL(name)
+			case port != 0:
+				target, err = vmPortURL(name, port)
+			default:
+				target, err = vmPageURL(name)
+			}
+			if errors.Is(err, errDaemonUnreachable) {
+				return fmt.Errorf("the dabbi daemon isn't running at %s; start it with 'dabbi serve' (or point --daemon-url at it)", daemonURL)
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Opening %s\n", target)
+			if err := openBrowser(target); err != nil {
+				return fmt.Errorf("couldn't launch a browser (%v); open the URL above manually", err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&agent, "agent", false, "Open the OpenCode agent running in the VM")
+	cmd.Flags().BoolVar(&ui, "ui", false, "Open the VM's page in the web UI (default)")
+	cmd.Flags().IntVar(&port, "port", 0, "Open the app the VM serves on this port")
+	cmd.MarkFlagsMutuallyExclusive("agent", "ui", "port")
+
+	return cmd
+}
+
+// agentURL asks the daemon for the VM's agent URL, so the port matches the
+// listener it assigned. The token is added when the URL lacks it, so the
+// proxy lets the browser in without a login prompt.
+func agentURL(name string) (string, error) {
+	var resp struct {
+		URL string `json:"url"`
+	}
+	if err := daemonRequest(http.MethodGet, "/vms/"+url.PathEscape(name)+"/agent-url", nil, &resp); err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(resp.URL)
+	if err != nil {
+		return "", fmt.Errorf("daemon returned an invalid agent URL %q: %w", resp.URL, err)
+	}
+	q := u.Query()
+	if q.Get("token") == "" {
+		q.Set("token", cfg.AuthToken)
+		u.RawQuery = q.Encode()
+	}
+	return u.String(), nil
+}
+
+// vmPageURL returns the VM's page in the web UI, after checking with the
+// daemon that the VM exists
+func vmPageURL(name string) (string, error) {
+	if err := daemonRequest(http.MethodGet, "/vms/"+url.PathEscape(name), nil, nil); err != nil {
+		return "", err
+	}
+	base, err := url.Parse(daemonURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid --daemon-url: %w", err)
+	}
+	return base.JoinPath("vm", name).String(), nil
+}
+
+// vmPortURL returns the proxy URL for a port on the VM, which is the
+// daemon's host prefixed with <vm>-<port>. The proxy wakes the VM if needed.
+func vmPortURL(name string, port int) (string, error) {
+	if err := daemonRequest(http.MethodGet, "/vms/"+url.PathEscape(name), nil, nil); err != nil {
+		return "", err
+	}
+	base, err := url.Parse(daemonURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid --daemon-url: %w", err)
+	}
+	host := name + "-" + strconv.Itoa(port) + "." + base.Hostname()
+	p := base.Port()
+	if cfg.APIPort != 0 && p == strconv.Itoa(cfg.APIPort) {
+		// The daemon URL is the API's own port; VM traffic is on port
+		p = ""
+		if cfg.Port != 0 && cfg.Port != 80 {
+			p = strconv.Itoa(cfg.Port)
+		}
+	}
+	if p != "" {
+		host += ":" + p
+	}
+	return (&url.URL{Scheme: base.Scheme, Host: host, Path: "/"}).String(), nil
+}
+
+// openBrowser opens target in the user's default browser
+func openBrowser(target string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", target)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", target)
+	default:
+		cmd = exec.Command("xdg-open", target)
+	}
+	return cmd.Start()
+}
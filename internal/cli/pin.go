@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/spf13/cobra"
+)
+
+func newPinCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pin <vm_name>",
+		Short: "Protect a VM from prune and auto-shutdown",
+		Long: `Pin a VM so 'dabbi prune' never deletes it and the watchdog never stops
+or suspends it for inactivity. Stopping or deleting it by name still works.
+
+The pin is the dabbi/pinned label, stored with the VM's other labels.
+
+Examples:
+  dabbi pin my-vm
+  dabbi unpin my-vm`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return setPinned(args[0], true)
+		},
+	}
+}
+
+func newUnpinCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "unpin <vm_name>",
+		Short: "Let prune and auto-shutdown act on a VM again",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return setPinned(args[0], false)
+		},
+	}
+}
+
+func setPinned(vmName string, pinned bool) error {
+	if _, err := mpClient.Info(vmName); err != nil {
+		return fmt.Errorf("VM not found: %w", err)
+	}
+
+	store, err := labelStore()
+	if err != nil {
+		return err
+	}
+	if pinned {
+		err = store.Mark(vmName, labels.PinnedKey)
+	} else {
+		err = store.Remove(vmName, labels.PinnedKey)
+	}
+	if err != nil {
+		return err
+	}
+
+	if pinned {
+		fmt.Printf("VM '%s' pinned\n", vmName)
+	} else {
+		fmt.Printf("VM '%s' unpinned\n", vmName)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/prune"
+	"github.com/spf13/cobra"
+)
+
+func newPruneCmd() *cobra.Command {
+	var (
+		stopped   bool
+		olderThan string
+		dryRun    bool
+		yes       bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Delete stopped or idle VMs in bulk",
+		Long: `Delete VMs matching all of the given filters.
+
+--older-than uses each VM's last activity: the watchdog checkpoint for running
+VMs, or the time dabbi stopped it for stopped VMs. VMs with no known activity
+(e.g. stopped outside dabbi) are never matched by --older-than. Pinned VMs
+(see 'dabbi pin') are never pruned.
+
+Examples:
+  # Preview which stopped VMs would be removed
+  dabbi prune --stopped --dry-run
+
+  # Delete VMs that have been stopped for over a week
+  dabbi prune --stopped --older-than 7d`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := labelStore()
+			if err != nil {
+				return err
+			}
+			pinned, err := store.Pinned()
+			if err != nil {
+				return fmt.Errorf("failed to read pinned VMs: %w", err)
+			}
+
+			criteria := prune.Criteria{Stopped: stopped, Pinned: pinned}
+			if olderThan != "" {
+				age, err := prune.ParseAge(olderThan)
+				if err != nil {
+					return err
+				}
+				criteria.OlderThan = age
+			}
+
+			candidates, err := prune.Select(mpClient, stopLog, criteria, time.Now())
+			if err != nil {
+				return err
+			}
+
+			if len(candidates) == 0 {
+				fmt.Println("No VMs to prune")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tSTATE\tLAST ACTIVE")
+			fmt.Fprintln(w, "----\t-----\t-----------")
+			for _, c := range candidates {
+				lastActive := "-"
+				if c.LastActive != nil {
+					lastActive = c.LastActive.Local().Format(time.DateTime)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, c.State, lastActive)
+			}
+			w.Flush()
+
+			if dryRun {
+				fmt.Printf("\n%d VM(s) would be deleted (dry run)\n", len(candidates))
+				return nil
+			}
+
+			if ok, err := confirmAction(fmt.Sprintf("\nDelete %d VM(s)? [y/N] ", len(candidates)), yes); !ok {
+				return err
+			}
+
+			specs, _ := specStore()
+			mountRecords, _ := mountStore()
+			var failed int
+			for _, c := range candidates {
+				if err := mpClient.Delete(c.Name, true); err != nil {
+					fmt.Printf("Failed to delete '%s': %v\n", c.Name, err)
+					failed++
+					continue
+				}
+				_ = store.Delete(c.Name)
+				if specs != nil {
+					_ = specs.Delete(c.Name)
+				}
+				if mountRecords != nil {
+					_ = mountRecords.Delete(c.Name)
+				}
+				fmt.Printf("Deleted '%s'\n", c.Name)
+			}
+
+			if failed > 0 {
+				return fmt.Errorf("%d VM(s) could not be deleted", failed)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&stopped, "stopped", false, "Only prune stopped VMs")
+	cmd.Flags().StringVar(&olderThan, "older-than", "", "Only prune VMs inactive for longer than this (e.g. 7d, 12h)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show what would be deleted without deleting")
+	addYesFlags(cmd, &yes)
+
+	return cmd
+}
@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/spf13/cobra"
+)
+
+func newRawCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "raw -- <multipass args...>",
+		Short: "Run an arbitrary multipass command (unsupported)",
+		Long: `Pass arguments straight through to multipass.
+
+This is an unsupported escape hatch for multipass subcommands dabbi doesn't
+wrap. Output is printed as-is and dabbi's own bookkeeping (labels, stop times,
+network rules) is not updated, so prefer the regular commands where they exist.
+
+Examples:
+  dabbi raw -- get local.driver
+  dabbi raw -- networks
+  dabbi raw -- umount --all`,
+		Hidden: true,
+		Args:   cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			out, err := mpClient.Raw(args...)
+			os.Stdout.Write(out)
+
+			var mpErr *multipass.MultipassError
+			if errors.As(err, &mpErr) && mpErr.Stderr != "" {
+				fmt.Fprint(os.Stderr, mpErr.Stderr)
+				return fmt.Errorf("multipass exited with an error: %w", mpErr.Err)
+			}
+			return err
+		},
+	}
+}
@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/spf13/cobra"
+)
+
+func newRecreateCmd() *cobra.Command {
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:   "recreate <name>",
+		Short: "Rebuild a VM from the spec it was created with",
+		Long: `Delete and purge a VM, then launch it again with the same resources,
+image, network config, and cloud-init it was created with.
+
+Everything on the VM's disk and its snapshots are lost; labels and mount
+records are kept (see 'dabbi mount restore').
+Only VMs created by dabbi have a recorded spec.
+
+Examples:
+  dabbi recreate my-vm
+  dabbi recreate my-vm --yes`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			name := args[0]
+
+			if ok, err := confirmAction(fmt.Sprintf("Recreate '%s'? Its disk and snapshots will be lost. [y/N] ", name), yes); !ok {
+				return err
+			}
+
+			fmt.Printf("Recreating VM '%s' (this may take a few minutes)...\n", name)
+
+			// Through the daemon, so it also closes its tunnels and agent
+			// listener for the VM. Launching waits for cloud-init, so don't time out.
+			err := daemonRequestWithTimeout(http.MethodPost, "/vms/"+url.PathEscape(name)+"/recreate", nil, nil, 0)
+			if errors.Is(err, errDaemonUnreachable) {
+				err = recreateLocal(name)
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("VM '%s' recreated\n", name)
+			if store, err := mountStore(); err == nil {
+				if recorded, _ := store.List(name); len(recorded) > 0 {
+					fmt.Printf("It had %d mount(s); run 'dabbi mount restore %s' to apply them again\n", len(recorded), name)
+				}
+			}
+			return nil
+		},
+	}
+
+	addYesFlags(cmd, &yes)
+
+	return cmd
+}
+
+// recreateLocal rebuilds a VM directly through multipass when the daemon
+// isn't running
+func recreateLocal(name string) error {
+	store, err := specStore()
+	if err != nil {
+		return err
+	}
+	data, err := store.Spec(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no spec recorded for VM '%s', so it can't be recreated", name)
+	}
+	if err != nil {
+		return err
+	}
+	var spec createSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("corrupt spec for VM '%s': %w", name, err)
+	}
+	spec.Name = name
+
+	// Render before deleting anything, so a spec that no longer works
+	// leaves the VM alone
+	if err := multipass.ValidateImage(spec.Image, spec.ImageChecksum); err != nil {
+		return err
+	}
+	agentSecret, err := sshAgentSecret(spec.ForwardSSHAgent)
+	if err != nil {
+		return err
+	}
+	content, err := cfg.RenderCloudInit(spec.CloudInit, spec.Packages, spec.Network, agentSecret, spec.Netplan)
+	if err != nil {
+		return err
+	}
+
+	// The VM may already be gone if an earlier recreate failed to launch
+	if _, err := mpClient.Info(name); err == nil {
+		if err := mpClient.Delete(name, true); err != nil {
+			return err
+		}
+	}
+
+	launchFile, err := cfg.WriteLaunchFile(name, content)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := launchFile.Release(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}()
+
+	err = mpClient.Launch(multipass.LaunchOptions{
+		Name:          name,
+		CPUs:          spec.CPUs,
+		Memory:        spec.Memory,
+		Disk:          spec.Disk,
+		CloudInit:     launchFile.Path,
+		Image:         spec.Image,
+		ImageChecksum: spec.ImageChecksum,
+		Networks:      spec.Networks,
+		NetworkConfig: spec.Network,
+	})
+	if err != nil {
+		return withLaunchHint(fmt.Errorf("VM was deleted but relaunching failed (run recreate again to retry): %w", err))
+	}
+
+	if err := store.Save(name, content, spec); err != nil {
+		fmt.Printf("Warning: failed to save VM spec: %v\n", err)
+	}
+	if spec.ForwardSSHAgent {
+		enableSSHAgent(name, agentSecret)
+	}
+	return nil
+}
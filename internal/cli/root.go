@@ -1,17 +1,22 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
 	"github.com/mjshashank/dabbi/internal/config"
 	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/network"
+	"github.com/mjshashank/dabbi/internal/quota"
+	"github.com/mjshashank/dabbi/internal/watchdog"
 	"github.com/spf13/cobra"
 )
 
 var (
 	cfg       *config.Config
 	mpClient  multipass.Client
+	stopLog   *watchdog.StopLog
 	version   = "dev"
 	buildTime = "unknown"
 )
@@ -37,8 +42,8 @@ It provides:
   - Web terminal and file browser
   - Automatic inactivity shutdown`,
 		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-			// Skip config loading for help commands
-			if cmd.Name() == "help" || cmd.Name() == "version" {
+			// Skip config loading for help commands; doctor loads it itself to report failures
+			if cmd.Name() == "help" || cmd.Name() == "version" || cmd.Name() == "doctor" {
 				return nil
 			}
 
@@ -47,30 +52,75 @@ It provides:
 			if err != nil {
 				return fmt.Errorf("failed to load config: %w", err)
 			}
-			mpClient = multipass.NewRealClient()
+			// Find the daemon on the ports and scheme the config serves it with
+			if !cmd.Flags().Changed("daemon-url") {
+				daemonURL = configuredDaemonURL(cfg)
+			}
+			stopLogPath, err := watchdog.DefaultStopLogPath()
+			if err != nil {
+				return fmt.Errorf("failed to locate activity log: %w", err)
+			}
+			stopLog = watchdog.NewStopLog(stopLogPath)
+
+			launchEnv := cfg.LaunchEnvList()
+			if err := multipass.ValidateLaunchPassthrough(launchEnv, cfg.LaunchArgs); err != nil {
+				return fmt.Errorf("invalid config: %w", err)
+			}
+			mp := multipass.NewClientWithOptions(multipass.RealExecutor{}, multipass.ClientOptions{
+				MaxConcurrent: cfg.MultipassMaxConcurrent,
+				LaunchEnv:     launchEnv,
+				LaunchArgs:    cfg.LaunchArgs,
+			})
+			limits, err := quota.FromConfig(cfg)
+			if err != nil {
+				return fmt.Errorf("invalid config: %w", err)
+			}
+			// Record stop times host-side so `dabbi prune --older-than` can see stopped VMs
+			mpClient = watchdog.TrackStops(quota.LimitStarts(mp, limits), stopLog)
+			// Keep host-scoped network rules on each VM's current bridge port
+			mpClient = network.TrackHostRules(mpClient, newApplier())
 			return nil
 		},
-		SilenceUsage: true,
+		SilenceUsage:  true,
+		SilenceErrors: true, // printed by Execute
 	}
 
+	rootCmd.PersistentFlags().StringVar(&daemonURL, "daemon-url", daemonURL, "URL of the running dabbi daemon")
+
 	// Add subcommands
 	rootCmd.AddCommand(
 		newServeCmd(),
 		newListCmd(),
-		newCreateCmd(),
-		newStartCmd(),
-		newStopCmd(),
-		newRestartCmd(),
-		newDeleteCmd(),
-		newCloneCmd(),
+		newInfoCmd(),
+		newConsoleCmd(),
+		audited(newCreateCmd()),
+		audited(newStartCmd()),
+		audited(newStopCmd()),
+		audited(newRestartCmd()),
+		audited(newDeleteCmd()),
+		audited(newPruneCmd()),
+		audited(newCloneCmd()),
+		newRecreateCmd(),
+		newExportCmd(),
+		newImportCmd(),
+		newLabelCmd(),
+		audited(newPinCmd()),
+		audited(newUnpinCmd()),
+		newSSHAgentCmd(),
 		newSnapshotCmd(),
 		newShellCmd(),
+		newOpenCmd(),
 		newAgentCmd(),
 		newTunnelCmd(),
+		newHostsCmd(),
 		newMountCmd(),
 		newCpCmd(),
 		newNetworkCmd(),
+		newWatchdogCmd(),
+		newDefaultsCmd(),
+		newDoctorCmd(),
 		newVersionCmd(),
+		audited(newRawCmd()),
 	)
 
 	return rootCmd
@@ -78,17 +128,40 @@ It provides:
 
 // Execute runs the root command
 func Execute() {
-	if err := NewRootCmd().Execute(); err != nil {
+	cmd, err := NewRootCmd().ExecuteC()
+	auditCommand(cmd, err)
+	if err != nil {
+		printError(cmd, err)
 		os.Exit(1)
 	}
 }
 
+// printError reports a command's error as cobra would. A missing multipass
+// gets a short explanation instead of whichever call ran into it first.
+func printError(cmd *cobra.Command, err error) {
+	if errors.Is(err, multipass.ErrMultipassNotInstalled) {
+		fmt.Fprintln(os.Stderr, "Error: dabbi needs multipass, which isn't installed (or isn't on PATH).")
+		fmt.Fprintln(os.Stderr, "Install it from https://multipass.run/install, then run 'dabbi doctor' to check your setup.")
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	// The command line didn't resolve to a command (e.g. a typo)
+	if cmd != nil && cmd.CalledAs() == "" {
+		fmt.Fprintf(os.Stderr, "Run '%s --help' for usage.\n", cmd.CommandPath())
+	}
+}
+
 func newVersionCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "version",
 		Short: "Print version information",
 		Run: func(cmd *cobra.Command, args []string) {
 			fmt.Printf("dabbi version %s (built %s)\n", version, buildTime)
+			if v, err := multipass.NewRealClient().Version(); err == nil {
+				fmt.Printf("multipass version %s\n", v)
+			} else {
+				fmt.Println("multipass version unknown (is multipass installed?)")
+			}
 		},
 	}
 }
@@ -1,17 +1,33 @@
 package cli
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/mjshashank/dabbi/internal/audit"
 	"github.com/mjshashank/dabbi/internal/config"
 	"github.com/mjshashank/dabbi/internal/daemon"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/mounts"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/vmspec"
 	"github.com/spf13/cobra"
 )
 
 func newServeCmd() *cobra.Command {
 	var (
-		port   int
-		domain string
+		port    int
+		apiPort int
+		domain  string
+		bind    string
+		tlsCert string
+		tlsKey  string
 	)
 
 	cmd := &cobra.Command{
@@ -26,38 +42,178 @@ The daemon provides:
   - WebSocket terminal access
   - Web UI for VM management
 
+With --domain alone, certificates come from Let's Encrypt (needs a public
+domain with ports 80/443 reachable). For LAN or internal deployments, pass
+your own certificate instead, e.g. a self-signed or internal-CA wildcard:
+  dabbi serve --domain dabbi.local --tls-cert dabbi.crt --tls-key dabbi.key
+
+With --api-port, the API and web UI get their own port and --port only
+routes VM traffic, so the management API can stay private (firewalled, or
+reached over a VPN) while VM apps are public:
+  dabbi serve --port 80 --api-port 8443
+
+Every flag can also be set in the config file (port, api_port, domain,
+bind_address, tls_cert_file, tls_key_file) or with a DABBI_<KEY> environment variable,
+e.g. DABBI_PORT=8080. Flags win over the environment, which wins over the
+file.
+
 Note: Port 80 requires sudo or capabilities.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			// Flags override the config (file or environment)
+			if !cmd.Flags().Changed("port") && cfg.Port != 0 {
+				port = cfg.Port
+			}
+			if !cmd.Flags().Changed("api-port") {
+				apiPort = cfg.APIPort
+			}
+			if domain == "" {
+				domain = cfg.Domain
+			}
+			if bind == "" {
+				bind = cfg.BindAddress
+			}
+			if tlsCert == "" {
+				tlsCert = cfg.TLSCertFile
+			}
+			if tlsKey == "" {
+				tlsKey = cfg.TLSKeyFile
+			}
+			if (tlsCert == "") != (tlsKey == "") {
+				return fmt.Errorf("--tls-cert and --tls-key must be given together")
+			}
+			if tlsCert != "" && !cmd.Flags().Changed("port") && cfg.Port == 0 {
+				port = 443
+			}
+			if apiPort < 0 || apiPort > 65535 {
+				return fmt.Errorf("--api-port must be between 1 and 65535")
+			}
+			// VM traffic is on --port, or 443 (and 80 for certificate
+			// challenges) with Let's Encrypt
+			proxyPorts := []int{port}
+			if domain != "" && tlsCert == "" {
+				proxyPorts = []int{443, 80}
+			}
+			for _, p := range proxyPorts {
+				if apiPort == p {
+					return fmt.Errorf("--api-port %d is already used for VM traffic; pick another port", apiPort)
+				}
+			}
+
+			// Every route needs multipass, so don't start a daemon that can't reach it
+			if _, err := mpClient.Version(); errors.Is(err, multipass.ErrMultipassNotInstalled) {
+				return err
+			}
+
 			// Ensure default cloud-init exists
 			cloudInitPath, created, err := config.EnsureDefaultCloudInit()
 			if err != nil {
 				fmt.Printf("Warning: could not create default cloud-init: %v\n", err)
 			} else if created {
 				fmt.Printf("Created default cloud-init: %s\n", cloudInitPath)
+			} else if data, err := os.ReadFile(cloudInitPath); err == nil {
+				// A file from an older dabbi is kept, but misses newer settings
+				if missing := config.MissingCloudInitHooks(string(data)); len(missing) > 0 {
+					fmt.Printf("Warning: %s is missing %s; move it aside to get the current default\n",
+						cloudInitPath, strings.Join(missing, ", "))
+				}
+			}
+
+			// Refuse to start if another daemon is already running
+			pidPath, err := daemon.DefaultPIDPath()
+			if err != nil {
+				return fmt.Errorf("failed to locate PID file: %w", err)
+			}
+			pidFile, err := daemon.AcquirePIDFile(pidPath)
+			if err != nil {
+				return err
+			}
+			defer pidFile.Release()
+
+			labelsPath, err := labels.DefaultPath()
+			if err != nil {
+				return fmt.Errorf("failed to locate labels file: %w", err)
+			}
+
+			specsDir, err := vmspec.DefaultDir()
+			if err != nil {
+				return fmt.Errorf("failed to locate VM specs: %w", err)
+			}
+
+			mountsDir, err := mounts.DefaultDir()
+			if err != nil {
+				return fmt.Errorf("failed to locate mount records: %w", err)
+			}
+
+			auditPath, err := audit.DefaultPath()
+			if err != nil {
+				return fmt.Errorf("failed to locate audit log: %w", err)
 			}
 
 			srv := daemon.NewServer(daemon.ServerConfig{
 				Port:            port,
+				APIPort:         apiPort,
 				Domain:          domain,
+				BindAddress:     bind,
+				TLSCertFile:     tlsCert,
+				TLSKeyFile:      tlsKey,
 				Config:          cfg,
 				MultipassClient: mpClient,
+				Labels:          labels.NewStore(labelsPath),
+				Specs:           vmspec.NewStore(specsDir),
+				Mounts:          mounts.NewStore(mountsDir),
+				StopLog:         stopLog,
+				AuditLog:        audit.NewLog(auditPath),
 			})
 
+			if names := cfg.EnvOverrides(); len(names) > 0 {
+				fmt.Printf("Config overridden by environment: %s\n", strings.Join(names, ", "))
+			}
 			fmt.Printf("Starting dabbi daemon on port %d...\n", port)
-			if domain != "" {
+			if tlsCert != "" {
+				fmt.Printf("TLS enabled with certificate: %s\n", tlsCert)
+			} else if domain != "" {
 				fmt.Printf("TLS enabled for domain: %s\n", domain)
 			}
 			fmt.Printf("Auth token: %s\n", cfg.AuthToken)
+			uiPort := port
+			if apiPort != 0 {
+				uiPort = apiPort
+			}
 			fmt.Printf("\nVM routing: http://<vm>-<port>.localhost:%d\n", port)
-			fmt.Printf("API: http://localhost:%d/api/\n", port)
-			fmt.Printf("UI: http://localhost:%d/\n", port)
+			fmt.Printf("API: http://localhost:%d/api/\n", uiPort)
+			fmt.Printf("UI: http://localhost:%d/\n", uiPort)
+			// Other commands find the API through the config
+			served := *cfg
+			served.Port, served.APIPort, served.Domain, served.TLSCertFile = port, apiPort, domain, tlsCert
+			if u := configuredDaemonURL(&served); u != configuredDaemonURL(cfg) {
+				fmt.Printf("CLI: pass --daemon-url %s to reach the API\n", u)
+			}
+
+			errCh := make(chan error, 1)
+			go func() { errCh <- srv.ListenAndServe() }()
 
-			return srv.ListenAndServe()
+			// Shut down cleanly on Ctrl+C/SIGTERM so the PID file is removed
+			sigCh := make(chan os.Signal, 1)
+			signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+			select {
+			case err := <-errCh:
+				return err
+			case <-sigCh:
+				fmt.Println("\nShutting down...")
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				return srv.Shutdown(ctx)
+			}
 		},
 	}
 
 	cmd.Flags().IntVar(&port, "port", 80, "Port to listen on")
+	cmd.Flags().IntVar(&apiPort, "api-port", 0, "Serve the API and UI on this port instead, leaving --port to VM traffic")
 	cmd.Flags().StringVar(&domain, "domain", "", "Domain for automatic TLS (Let's Encrypt)")
+	cmd.Flags().StringVar(&bind, "bind", "", "Address to listen on (default all interfaces)")
+	cmd.Flags().StringVar(&tlsCert, "tls-cert", "", "TLS certificate file (PEM); skips Let's Encrypt, default port 443")
+	cmd.Flags().StringVar(&tlsKey, "tls-key", "", "TLS private key file (PEM) for --tls-cert")
 
 	return cmd
 }
@@ -3,8 +3,11 @@ package cli
 import (
 	"fmt"
 	"os"
+	"sort"
 	"text/tabwriter"
+	"time"
 
+	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/spf13/cobra"
 )
 
@@ -20,21 +23,30 @@ Note: VMs must be stopped before creating snapshots.`,
 
 	cmd.AddCommand(
 		newSnapshotListCmd(),
-		newSnapshotCreateCmd(),
-		newSnapshotRestoreCmd(),
-		newSnapshotDeleteCmd(),
+		audited(newSnapshotCreateCmd()),
+		audited(newSnapshotRestoreCmd()),
+		audited(newSnapshotDeleteCmd()),
 	)
 
 	return cmd
 }
 
 func newSnapshotListCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:     "list <vm_name>",
-		Short:   "List snapshots for a VM",
+	var all bool
+
+	cmd := &cobra.Command{
+		Use:   "list <vm_name> | --all",
+		Short: "List snapshots for a VM",
+		Long: `List snapshots for a VM.
+
+With --all, list every VM's snapshots in one table.`,
 		Aliases: []string{"ls"},
-		Args:    cobra.ExactArgs(1),
+		Args:    nameOrAll(&all),
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if all {
+				return listAllSnapshots()
+			}
+
 			vmName := args[0]
 			snapshots, err := mpClient.ListSnapshots(vmName)
 			if err != nil {
@@ -65,6 +77,52 @@ func newSnapshotListCmd() *cobra.Command {
 			return w.Flush()
 		},
 	}
+
+	cmd.Flags().BoolVar(&all, "all", false, "List snapshots for every VM")
+	return cmd
+}
+
+// listAllSnapshots prints every VM's snapshots, sorted by VM then name
+func listAllSnapshots() error {
+	all, err := mpClient.ListAllSnapshots()
+	if err != nil {
+		return err
+	}
+	if len(all) == 0 {
+		fmt.Println("No snapshots")
+		return nil
+	}
+
+	vms := make([]string, 0, len(all))
+	for vm := range all {
+		vms = append(vms, vm)
+	}
+	sort.Strings(vms)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VM\tNAME\tPARENT\tCOMMENT")
+	fmt.Fprintln(w, "--\t----\t------\t-------")
+	for _, vm := range vms {
+		names := make([]string, 0, len(all[vm]))
+		for name := range all[vm] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			snap := all[vm][name]
+			parent := snap.Parent
+			if parent == "" {
+				parent = "(base)"
+			}
+			comment := snap.Comment
+			if comment == "" {
+				comment = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", vm, name, parent, comment)
+		}
+	}
+	return w.Flush()
 }
 
 func newSnapshotCreateCmd() *cobra.Command {
@@ -95,18 +153,44 @@ If no name is provided, multipass will generate one.`,
 
 func newSnapshotRestoreCmd() *cobra.Command {
 	var destructive bool
+	var autoSnapshot bool
+	var yes bool
 
 	cmd := &cobra.Command{
 		Use:   "restore <vm_name> <snapshot_name>",
 		Short: "Restore a snapshot",
-		Long:  `Restore a VM to a previous snapshot state.`,
-		Args:  cobra.ExactArgs(2),
+		Long: `Restore a VM to a previous snapshot state.
+
+--destructive discards the VM's current state, so it asks for confirmation
+first unless --yes is given (without a terminal, --yes is required). With
+--destructive --auto-snapshot, the VM is stopped and its current state
+saved as snapshot pre-restore-<timestamp> before restoring, so the restore
+can itself be undone and isn't confirmed.`,
+		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			vmName := args[0]
 			snapshotName := args[1]
 
+			if autoSnapshot && !destructive {
+				return fmt.Errorf("--auto-snapshot only applies with --destructive")
+			}
+			if destructive && !autoSnapshot {
+				prompt := fmt.Sprintf("Restore '%s' to '%s'? Its current state will be lost. [y/N] ", vmName, snapshotName)
+				if ok, err := confirmAction(prompt, yes); !ok {
+					return err
+				}
+			}
+
 			fmt.Printf("Restoring snapshot '%s' for VM '%s'...\n", snapshotName, vmName)
-			if err := mpClient.RestoreSnapshot(vmName, snapshotName, destructive); err != nil {
+			if autoSnapshot {
+				safety, err := multipass.RestoreWithSafetySnapshot(mpClient, vmName, snapshotName, time.Now())
+				if safety != "" {
+					fmt.Printf("Saved current state as snapshot '%s'\n", safety)
+				}
+				if err != nil {
+					return err
+				}
+			} else if err := mpClient.RestoreSnapshot(vmName, snapshotName, destructive); err != nil {
 				return err
 			}
 			fmt.Println("Snapshot restored")
@@ -114,21 +198,32 @@ func newSnapshotRestoreCmd() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().BoolVarP(&destructive, "destructive", "d", false, "Discard current VM state without confirmation")
+	cmd.Flags().BoolVarP(&destructive, "destructive", "d", false, "Discard current VM state")
+	cmd.Flags().BoolVar(&autoSnapshot, "auto-snapshot", false, "With --destructive, snapshot the current state first")
+	addYesFlags(cmd, &yes)
 
 	return cmd
 }
 
 func newSnapshotDeleteCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:     "delete <vm_name> <snapshot_name>",
-		Short:   "Delete a snapshot",
+	var yes bool
+
+	cmd := &cobra.Command{
+		Use:   "delete <vm_name> <snapshot_name>",
+		Short: "Delete a snapshot",
+		Long: `Delete a snapshot. Asks for confirmation first unless --yes is given;
+without a terminal, --yes is required.`,
 		Aliases: []string{"rm"},
 		Args:    cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			vmName := args[0]
 			snapshotName := args[1]
 
+			prompt := fmt.Sprintf("Delete snapshot '%s' of '%s'? [y/N] ", snapshotName, vmName)
+			if ok, err := confirmAction(prompt, yes); !ok {
+				return err
+			}
+
 			fmt.Printf("Deleting snapshot '%s' for VM '%s'...\n", snapshotName, vmName)
 			if err := mpClient.DeleteSnapshot(vmName, snapshotName); err != nil {
 				return err
@@ -137,4 +232,8 @@ func newSnapshotDeleteCmd() *cobra.Command {
 			return nil
 		},
 	}
+
+	addYesFlags(cmd, &yes)
+
+	return cmd
 }
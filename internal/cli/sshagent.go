@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func newSSHAgentCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ssh-agent",
+		Short: "Manage SSH agent forwarding",
+		Long: `Manage the SSH agent access of VMs created with --forward-ssh-agent.
+
+Each such VM's cloud-init holds a secret its relay sends to the daemon;
+the daemon keeps it in ~/.dabbi/vms/<vm>/ssh-agent-secret and only relays
+connections that send a known secret. Recreating the VM grants it again
+with a new secret.`,
+	}
+
+	cmd.AddCommand(audited(newSSHAgentRevokeCmd()))
+
+	return cmd
+}
+
+func newSSHAgentRevokeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revoke <vm_name>",
+		Short: "Stop relaying the SSH agent to a VM",
+		Long: `Stop relaying the daemon's SSH agent to a VM. Takes effect immediately,
+including for a running daemon.
+
+Examples:
+  dabbi ssh-agent revoke my-vm`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := specStore()
+			if err != nil {
+				return err
+			}
+			if err := store.RevokeSSHAgent(args[0]); err != nil {
+				return err
+			}
+
+			fmt.Printf("SSH agent access revoked for VM '%s'\n", args[0])
+			return nil
+		},
+	}
+}
@@ -12,6 +12,11 @@ import (
 )
 
 func newTunnelCmd() *cobra.Command {
+	var (
+		rateLimit int
+		stable    bool
+	)
+
 	cmd := &cobra.Command{
 		Use:   "tunnel <vm_name> <vm_port>",
 		Short: "Create a TCP tunnel to a VM port",
@@ -23,9 +28,20 @@ or SSH access.
 
 The tunnel stays open until you press Ctrl+C.
 
+Use --rate-limit to cap bandwidth (KB/s, each direction) so large
+transfers don't saturate the host network.
+
+Use --stable to get the same local port for a VM port every time, so
+connection strings keep working. It's picked from the VM name and port
+(12000-12999 by default, see tunnel_port_base and tunnel_port_range), or
+the next free port if another program holds it.
+
 Example:
   dabbi tunnel my-db 5432
-  # Then connect to localhost:<printed_port>`,
+  # Then connect to localhost:<printed_port>
+
+  dabbi tunnel my-vm 8080 --rate-limit 512
+  dabbi tunnel my-db 5432 --stable`,
 		Args: cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			vmName := args[0]
@@ -36,15 +52,30 @@ Example:
 
 			// Create tunnel manager with multipass client
 			tm := tunnel.NewManager(mpClient)
+			subnet, err := cfg.PreferredSubnet()
+			if err != nil {
+				return err
+			}
+			tm.SetPreferredSubnet(subnet)
+			if err := tm.SetStablePortRange(cfg.TunnelPortBase, cfg.TunnelPortRange); err != nil {
+				return err
+			}
 
 			fmt.Printf("Creating tunnel to %s:%d...\n", vmName, vmPort)
 
-			t, err := tm.Create(vmName, vmPort)
+			create := tm.CreateWithRateLimit
+			if stable {
+				create = tm.CreateStable
+			}
+			t, err := create(vmName, vmPort, rateLimit)
 			if err != nil {
 				return fmt.Errorf("failed to create tunnel: %w", err)
 			}
 
 			fmt.Printf("Tunnel created: localhost:%d -> %s:%d\n", t.HostPort, vmName, vmPort)
+			if t.RateLimitKBps > 0 {
+				fmt.Printf("Rate limit: %d KB/s per direction\n", t.RateLimitKBps)
+			}
 			fmt.Println("Press Ctrl+C to close")
 
 			// Wait for interrupt
@@ -60,5 +91,8 @@ Example:
 		},
 	}
 
+	cmd.Flags().IntVar(&rateLimit, "rate-limit", 0, "Bandwidth limit in KB/s per direction (0 = unlimited)")
+	cmd.Flags().BoolVar(&stable, "stable", false, "Use a local port derived from the VM name and port")
+
 	return cmd
 }
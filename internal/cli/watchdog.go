@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/watchdog"
+	"github.com/spf13/cobra"
+)
+
+// watchdogTimeout mirrors the daemon's /api/watchdog/timeout payload
+type watchdogTimeout struct {
+	TimeoutMins int    `json:"timeout_mins"`
+	Timeout     string `json:"timeout,omitempty"`
+}
+
+func newWatchdogCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watchdog",
+		Short: "Manage the idle VM watchdog",
+		Long: `View or change how long a VM may be idle before the watchdog shuts it down.
+
+Changes are applied to the running daemon immediately and saved to
+~/.dabbi/config.json. If the daemon isn't running, only the config is updated.`,
+	}
+
+	cmd.AddCommand(
+		newWatchdogGetCmd(),
+		newWatchdogSetCmd(),
+	)
+
+	return cmd
+}
+
+func newWatchdogGetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get",
+		Short: "Show the inactivity timeout",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var resp watchdogTimeout
+			err := daemonRequest(http.MethodGet, "/watchdog/timeout", nil, &resp)
+			if errors.Is(err, errDaemonUnreachable) {
+				fmt.Printf("Inactivity timeout: %v (from config, daemon not running)\n",
+					time.Duration(cfg.ShutdownTimeoutMins)*time.Minute)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Inactivity timeout: %v\n", time.Duration(resp.TimeoutMins)*time.Minute)
+			return nil
+		},
+	}
+}
+
+func newWatchdogSetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "set <timeout>",
+		Short: "Set the inactivity timeout",
+		Long: `Set how long a VM may be idle before it is shut down.
+
+The timeout is a duration (e.g. 45m, 2h) or a plain number of minutes.
+
+Examples:
+  dabbi watchdog set 45m
+  dabbi watchdog set 2h
+  dabbi watchdog set 30`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			d, err := parseTimeout(args[0])
+			if err != nil {
+				return err
+			}
+			if err := watchdog.ValidateTimeout(d); err != nil {
+				return err
+			}
+			mins := int(d / time.Minute)
+
+			err = daemonRequest(http.MethodPut, "/watchdog/timeout", watchdogTimeout{TimeoutMins: mins}, nil)
+			if errors.Is(err, errDaemonUnreachable) {
+				cfg.ShutdownTimeoutMins = mins
+				if err := cfg.Save(); err != nil {
+					return fmt.Errorf("failed to save config: %w", err)
+				}
+				fmt.Printf("Inactivity timeout saved: %v (daemon not running, applies on next start)\n", d)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("Inactivity timeout set to %v\n", d)
+			return nil
+		},
+	}
+}
+
+// parseTimeout accepts a Go duration ("45m") or a bare number of minutes ("45")
+func parseTimeout(s string) (time.Duration, error) {
+	if mins, err := strconv.Atoi(s); err == nil {
+		return time.Duration(mins) * time.Minute, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: use a duration like 45m or 2h", s)
+	}
+	return d, nil
+}
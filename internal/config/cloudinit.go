@@ -2,18 +2,257 @@ package config
 
 import (
 	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/network"
 )
 
+// RenderCloudInit produces the cloud-init a VM is launched with: the base
+// file (or DefaultCloudInit when cloudInitPath is empty) plus extra packages
+// and commands, the agent service command, the auth token, SSH agent
+// forwarding when sshAgentSecret is set, the netplan config at netplanPath (if set), and
+// the network setup. `dabbi create`, the API and the preview endpoint all
+// use it, so previews match real launches.
+func (c *Config) RenderCloudInit(cloudInitPath string, packages []string, netConfig *multipass.NetworkConfig, sshAgentSecret string, netplanPath string) (string, error) {
+	content := DefaultCloudInit
+	if cloudInitPath != "" {
+		data, err := os.ReadFile(cloudInitPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to read cloud-init: %w", err)
+		}
+		content = string(data)
+	}
+
+	allPackages := append(append([]string{}, c.Defaults.ExtraPackages...), packages...)
+	content, err := GenerateCloudInitWithExtras(content, allPackages, c.Defaults.ExtraRuncmd)
+	if err != nil {
+		return "", err
+	}
+
+	agentCommand := c.Defaults.AgentCommand
+	if agentCommand == "" {
+		agentCommand = DefaultAgentCommand
+	}
+	content, err = GenerateCloudInitWithAgent(content, agentCommand, c.Defaults.AgentEnv)
+	if err != nil {
+		return "", err
+	}
+
+	content = GenerateCloudInitWithAuthToken(content, c.AuthToken)
+
+	if sshAgentSecret != "" {
+		content = GenerateCloudInitWithSSHAgent(content, c.SSHAgentListenPort(), sshAgentSecret)
+	}
+
+	// Before the iptables rules, which may depend on the interfaces it sets up
+	if netplanPath != "" {
+		netplan, err := LoadNetplan(netplanPath)
+		if err != nil {
+			return "", err
+		}
+		content = GenerateCloudInitWithNetplan(content, netplan)
+	}
+
+	content, err = GenerateCloudInitWithNetwork(content, netConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate cloud-init with network: %w", err)
+	}
+	return content, nil
+}
+
 // GenerateCloudInitWithAuthToken injects the auth token into cloud-init
 // It replaces the __DABBI_AUTH_TOKEN__ placeholder with the actual token
 func GenerateCloudInitWithAuthToken(base string, authToken string) string {
 	return strings.ReplaceAll(base, "__DABBI_AUTH_TOKEN__", authToken)
 }
 
+// DefaultAgentCommand is what the agent service (dabbi-opencode.service)
+// runs when agent_command isn't set
+const DefaultAgentCommand = "/home/ubuntu/.opencode/bin/opencode web --port 1234 --hostname 0.0.0.0"
+
+var (
+	// agentEnvPlaceholder matches the line of the agent service where its
+	// Environment= lines go, keeping the indentation
+	agentEnvPlaceholder = regexp.MustCompile(`(?m)^([ \t]*)__DABBI_AGENT_ENV__[ \t]*\n`)
+
+	// envNamePattern matches a shell/systemd environment variable name
+	envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// GenerateCloudInitWithAgent sets the command and extra environment of the
+// agent service. It replaces the __DABBI_AGENT_CMD__ placeholder with
+// command, which becomes the unit's ExecStart, and the __DABBI_AGENT_ENV__
+// line with one Environment= line per variable (or nothing). A cloud-init
+// without the placeholders is returned unchanged.
+func GenerateCloudInitWithAgent(base, command string, env map[string]string) (string, error) {
+	if strings.TrimSpace(command) == "" {
+		return "", fmt.Errorf("agent command is empty")
+	}
+	if strings.ContainsAny(command, "\r\n") {
+		return "", fmt.Errorf("agent command must be a single line")
+	}
+
+	names := make([]string, 0, len(env))
+	for name, value := range env {
+		if !envNamePattern.MatchString(name) {
+			return "", fmt.Errorf("invalid agent environment variable name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("agent environment variable %s must be a single line", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// systemd expands % specifiers in ExecStart
+	base = strings.ReplaceAll(base, "__DABBI_AGENT_CMD__", strings.ReplaceAll(command, "%", "%%"))
+	return agentEnvPlaceholder.ReplaceAllStringFunc(base, func(line string) string {
+		indent := agentEnvPlaceholder.FindStringSubmatch(line)[1]
+		var b strings.Builder
+		for _, name := range names {
+			fmt.Fprintf(&b, "%sEnvironment=%s\n", indent, systemdQuote(name+"="+env[name]))
+		}
+		return b.String()
+	}), nil
+}
+
+// cloudInitHooks are what dabbi relies on finding in a cloud-init, with
+// what goes missing without them
+var cloudInitHooks = []struct {
+	marker string
+	effect string
+}{
+	{"__DABBI_AGENT_CMD__", "agent_command is ignored"},
+	{"__DABBI_AGENT_ENV__", "agent_env is ignored"},
+	{multipass.InstallStatusPath, "install progress can't be reported"},
+}
+
+// MissingCloudInitHooks lists what a cloud-init written for an older dabbi
+// lacks, e.g. a ~/.dabbi/cloud-init.yaml created before the agent command
+// placeholders existed, as one "<marker> (<effect>)" entry each
+func MissingCloudInitHooks(content string) []string {
+	var missing []string
+	for _, h := range cloudInitHooks {
+		if !strings.Contains(content, h.marker) {
+			missing = append(missing, fmt.Sprintf("%s (%s)", h.marker, h.effect))
+		}
+	}
+	return missing
+}
+
+// systemdQuote double quotes a unit file value, escaping what systemd would
+// otherwise interpret (quotes, backslashes, and % specifiers)
+func systemdQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "%", "%%")
+	return `"` + s + `"`
+}
+
+// SSHAgentSocket is where a VM created with --forward-ssh-agent gets the
+// host's SSH agent
+const SSHAgentSocket = "/run/dabbi/ssh-agent.sock"
+
+// GenerateCloudInitWithSSHAgent sets a VM up to use the host's SSH agent.
+// A systemd service relays SSHAgentSocket to the daemon on the VM's default
+// gateway (the host) at port, opening each connection with secret so the
+// daemon knows which VM it is. A ~/.bashrc.d snippet exports SSH_AUTH_SOCK
+// when the socket is there. Custom cloud-inits need to source
+// ~/.bashrc.d/*.sh, as the default one does, for the export to apply.
+func GenerateCloudInitWithSSHAgent(base string, port int, secret string) string {
+	base = appendToList(base, "packages", yamlListItems([]string{"socat"}))
+	return appendToList(base, "runcmd", fmt.Sprintf(sshAgentSection, port, SSHAgentSocket, secret))
+}
+
+const sshAgentSection = `  # Dabbi SSH agent forwarding
+  - mkdir -p /opt/dabbi /home/ubuntu/.bashrc.d
+  - (umask 077 && echo %[3]s > /opt/dabbi/ssh-agent-secret)
+  - |
+    cat > /opt/dabbi/ssh-agent-connect.sh << 'DABBISSHAGENT'
+    #!/bin/sh
+    # The host running dabbi is the VM's default gateway
+    host=$(ip route show default | awk '{print $3; exit}')
+    { cat /opt/dabbi/ssh-agent-secret; cat; } | socat - TCP:"$host":%[1]d
+    DABBISSHAGENT
+  - |
+    cat > /opt/dabbi/ssh-agent-relay.sh << 'DABBISSHAGENT'
+    #!/bin/sh
+    exec socat UNIX-LISTEN:%[2]s,fork,unlink-early,user=ubuntu,group=ubuntu,mode=600 EXEC:/opt/dabbi/ssh-agent-connect.sh
+    DABBISSHAGENT
+  - chmod +x /opt/dabbi/ssh-agent-connect.sh /opt/dabbi/ssh-agent-relay.sh
+  - |
+    cat > /etc/systemd/system/dabbi-ssh-agent.service << 'DABBISSHAGENTSVC'
+    [Unit]
+    Description=Dabbi SSH agent forwarding
+    After=network-online.target
+    Wants=network-online.target
+
+    [Service]
+    RuntimeDirectory=dabbi
+    ExecStart=/opt/dabbi/ssh-agent-relay.sh
+    Restart=always
+    RestartSec=5
+
+    [Install]
+    WantedBy=multi-user.target
+    DABBISSHAGENTSVC
+  - systemctl daemon-reload
+  - systemctl enable --now dabbi-ssh-agent.service
+  - |
+    cat > /home/ubuntu/.bashrc.d/dabbi-ssh-agent.sh << 'BASHRC'
+    # SSH agent forwarded from the host by dabbi
+    if [ -S %[2]s ]; then
+      export SSH_AUTH_SOCK=%[2]s
+    fi
+    BASHRC
+  - chown -R ubuntu:ubuntu /home/ubuntu/.bashrc.d
+`
+
+// packagePattern matches an apt package name, optionally pinned (pkg=1.2-3)
+var packagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.+-]*(=[A-Za-z0-9.+:~-]+)?$`)
+
+// ValidatePackages checks that each entry is a plain apt package name
+func ValidatePackages(packages []string) error {
+	for _, p := range packages {
+		if !packagePattern.MatchString(p) {
+			return fmt.Errorf("invalid package name %q", p)
+		}
+	}
+	return nil
+}
+
+// GenerateCloudInitWithExtras adds packages and runcmd entries to a base
+// cloud-init, so small additions don't require copying the whole file.
+// Entries are appended to the existing lists (created if missing).
+func GenerateCloudInitWithExtras(base string, packages, runcmd []string) (string, error) {
+	if err := ValidatePackages(packages); err != nil {
+		return "", err
+	}
+
+	if len(packages) > 0 {
+		base = appendToList(base, "packages", yamlListItems(packages))
+	}
+	if len(runcmd) > 0 {
+		base = appendToList(base, "runcmd", "  # Extra commands from dabbi config\n"+yamlListItems(runcmd))
+	}
+	return base, nil
+}
+
+// yamlListItems renders values as YAML list items. Each value is double
+// quoted so shell syntax like ':' or '#' can't change the YAML structure.
+func yamlListItems(values []string) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = "  - " + strconv.Quote(v)
+	}
+	return strings.Join(items, "\n")
+}
+
 // GenerateCloudInitWithNetwork creates a cloud-init config with network rules
 // It takes the base cloud-init content and appends network configuration
 func GenerateCloudInitWithNetwork(base string, netConfig *multipass.NetworkConfig) (string, error) {
@@ -26,6 +265,10 @@ func GenerateCloudInitWithNetwork(base string, netConfig *multipass.NetworkConfi
 	if err := network.ValidateConfig(netConfig); err != nil {
 		return "", fmt.Errorf("invalid network config: %w", err)
 	}
+	// Host rules need the VM's address, so they can only go in once it's up
+	if netConfig.HostScoped() {
+		return "", fmt.Errorf("host-scoped network rules can't be set at launch; apply them with 'dabbi network set --scope host' once the VM is running")
+	}
 
 	// Generate the iptables script
 	script, err := network.GenerateIptablesScript(netConfig)
@@ -98,46 +341,52 @@ DABBISERVICE
 }
 
 func appendToCloudInit(base, networkSection string) string {
-	// Find the runcmd section and append to it
+	return appendToList(base, "runcmd", networkSection)
+}
+
+// appendToList inserts section at the end of the top-level YAML list under
+// key (e.g. runcmd or packages), adding the key if base doesn't have it
+func appendToList(base, key, section string) string {
 	lines := strings.Split(base, "\n")
 	result := make([]string, 0, len(lines)+50)
-	inRuncmd := false
+	inList := false
 	inserted := false
 
 	for _, line := range lines {
-		// Check if we're entering the runcmd section
-		if strings.HasPrefix(strings.TrimSpace(line), "runcmd:") {
-			inRuncmd = true
+		// Check if we're entering the list
+		if strings.HasPrefix(strings.TrimSpace(line), key+":") {
+			inList = true
 			result = append(result, line)
 			continue
 		}
 
-		// If we're in runcmd, look for the last item
-		if inRuncmd {
+		// If we're in the list, look for the last item
+		if inList {
 			trimmed := strings.TrimSpace(line)
-			// Check if we've exited runcmd (new top-level key or end of file)
+			// Check if we've exited the list (new top-level key or end of file)
 			if len(trimmed) > 0 && !strings.HasPrefix(trimmed, "-") && !strings.HasPrefix(trimmed, "#") && !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") {
-				// We've exited runcmd, insert network section before this line
+				// We've exited the list, insert section before this line
 				if !inserted {
-					result = append(result, networkSection)
+					result = append(result, section)
 					inserted = true
 				}
-				inRuncmd = false
+				inList = false
 			}
 		}
 
 		result = append(result, line)
 	}
 
-	// If we were still in runcmd at end of file, append the network section
-	if inRuncmd && !inserted {
-		result = append(result, networkSection)
+	// If we were still in the list at end of file, append the section
+	if inList && !inserted {
+		result = append(result, section)
+		inserted = true
 	}
 
-	// If there was no runcmd section, add one
+	// If there was no such list, add one
 	if !inserted {
-		result = append(result, "\nruncmd:")
-		result = append(result, networkSection)
+		result = append(result, "\n"+key+":")
+		result = append(result, section)
 	}
 
 	return strings.Join(result, "\n")
@@ -0,0 +1,174 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateCloudInitWithExtras(t *testing.T) {
+	out, err := GenerateCloudInitWithExtras(DefaultCloudInit,
+		[]string{"htop", "ripgrep"},
+		[]string{"echo 'hello: world' # not a comment"})
+	require.NoError(t, err)
+
+	// Packages land in the existing list, before the next top-level key
+	assert.Equal(t, 1, strings.Count(out, "\npackages:"))
+	pkgs := out[strings.Index(out, "\npackages:"):strings.Index(out, "\nusers:")]
+	assert.Contains(t, pkgs, "  - git\n")
+	assert.Contains(t, pkgs, `  - "htop"`)
+	assert.Contains(t, pkgs, `  - "ripgrep"`)
+
+	// runcmd is the last key in the default; extras go at its end, quoted
+	assert.Equal(t, 1, strings.Count(out, "\nruncmd:"))
+	assert.True(t, strings.HasSuffix(strings.TrimSpace(out), `  - "echo 'hello: world' # not a comment"`))
+}
+
+func TestGenerateCloudInitWithExtras_MissingLists(t *testing.T) {
+	out, err := GenerateCloudInitWithExtras("#cloud-config\ntimezone: UTC\n", []string{"htop"}, []string{"touch /done"})
+	require.NoError(t, err)
+
+	assert.Contains(t, out, "\npackages:\n  - \"htop\"")
+	assert.Contains(t, out, "\nruncmd:\n")
+	assert.Contains(t, out, `  - "touch /done"`)
+}
+
+func TestGenerateCloudInitWithExtras_None(t *testing.T) {
+	out, err := GenerateCloudInitWithExtras(DefaultCloudInit, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultCloudInit, out)
+}
+
+func TestValidatePackages(t *testing.T) {
+	assert.NoError(t, ValidatePackages([]string{"htop", "g++", "libssl3", "python3.12", "nodejs=20.11.0-1nodesource1"}))
+	assert.Error(t, ValidatePackages([]string{"htop; rm -rf /"}))
+	assert.Error(t, ValidatePackages([]string{"-y"}))
+	assert.Error(t, ValidatePackages([]string{""}))
+}
+
+func TestAppendToCloudInit_RuncmdLast(t *testing.T) {
+	out := appendToCloudInit(DefaultCloudInit, "  - /opt/dabbi/network/apply-rules.sh")
+
+	// A second runcmd key would replace the whole base runcmd
+	assert.Equal(t, 1, strings.Count(out, "\nruncmd:"))
+	assert.Equal(t, 1, strings.Count(out, "apply-rules.sh"))
+}
+
+func TestRenderCloudInit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Defaults.ExtraPackages = []string{"ripgrep"}
+	cfg.Defaults.ExtraRuncmd = []string{"touch /done"}
+
+	out, err := cfg.RenderCloudInit("", []string{"htop"}, &multipass.NetworkConfig{
+		Mode:  multipass.NetworkModeAllowlist,
+		Rules: []multipass.NetworkRule{{Type: "domain", Value: "github.com"}},
+	}, "", "")
+	require.NoError(t, err)
+
+	assert.Contains(t, out, `  - "ripgrep"`)
+	assert.Contains(t, out, `  - "htop"`)
+	assert.Contains(t, out, `  - "touch /done"`)
+	assert.Contains(t, out, "/opt/dabbi/network/apply-rules.sh")
+	assert.NotContains(t, out, "__DABBI_AUTH_TOKEN__")
+	assert.Contains(t, out, cfg.AuthToken)
+	assert.NotContains(t, out, "ssh-agent")
+}
+
+func TestRenderCloudInit_ForwardSSHAgent(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SSHAgentPort = 9000
+
+	out, err := cfg.RenderCloudInit("", nil, nil, "s3cret", "")
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, strings.Count(out, "\npackages:"))
+	assert.Contains(t, out, `  - "socat"`)
+	assert.Equal(t, 1, strings.Count(out, "\nruncmd:"))
+	assert.Contains(t, out, `TCP:"$host":9000`)
+	assert.Contains(t, out, "echo s3cret > /opt/dabbi/ssh-agent-secret")
+	assert.Contains(t, out, "UNIX-LISTEN:"+SSHAgentSocket+",")
+	assert.Contains(t, out, "systemctl enable --now dabbi-ssh-agent.service")
+	assert.Contains(t, out, "export SSH_AUTH_SOCK="+SSHAgentSocket)
+}
+
+func TestGenerateCloudInitWithSSHAgent_MissingLists(t *testing.T) {
+	out := GenerateCloudInitWithSSHAgent("#cloud-config\ntimezone: UTC\n", DefaultSSHAgentPort, "s3cret")
+
+	assert.Contains(t, out, "\npackages:\n  - \"socat\"")
+	assert.Contains(t, out, "\nruncmd:\n  # Dabbi SSH agent forwarding")
+	assert.Contains(t, out, `TCP:"$host":7322`)
+}
+
+func TestRenderCloudInit_DefaultAgentCommand(t *testing.T) {
+	cfg := DefaultConfig()
+	out, err := cfg.RenderCloudInit("", nil, nil, "", "")
+	require.NoError(t, err)
+
+	// No extra variables leaves no line behind in the unit
+	assert.Contains(t, out, "OPENCODE_SERVER_PASSWORD="+cfg.AuthToken+"\"\n    ExecStart="+DefaultAgentCommand+"\n")
+	assert.NotContains(t, out, "__DABBI_AGENT_")
+}
+
+func TestRenderCloudInit_AgentCommand(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Defaults.AgentCommand = "/usr/local/bin/my-agent serve --port 1234"
+	cfg.Defaults.AgentEnv = map[string]string{"MODEL": "big", "GREETING": `say "hi" 100%`}
+
+	out, err := cfg.RenderCloudInit("", nil, nil, "", "")
+	require.NoError(t, err)
+
+	assert.Contains(t, out, "    ExecStart=/usr/local/bin/my-agent serve --port 1234\n")
+	assert.NotContains(t, out, DefaultAgentCommand)
+	assert.Contains(t, out, "    Environment=\"GREETING=say \\\"hi\\\" 100%%\"\n    Environment=\"MODEL=big\"\n    ExecStart=")
+	assert.NotContains(t, out, "__DABBI_AGENT_")
+}
+
+func TestGenerateCloudInitWithAgent_EscapesSpecifiers(t *testing.T) {
+	out, err := GenerateCloudInitWithAgent("ExecStart=__DABBI_AGENT_CMD__\n", "agent --log /tmp/%H.log", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "ExecStart=agent --log /tmp/%%H.log\n", out)
+}
+
+func TestMissingCloudInitHooks(t *testing.T) {
+	assert.Empty(t, MissingCloudInitHooks(DefaultCloudInit))
+
+	// A cloud-init from before the agent placeholders existed
+	old := strings.ReplaceAll(DefaultCloudInit, "__DABBI_AGENT_ENV__\n", "")
+	old = strings.ReplaceAll(old, "__DABBI_AGENT_CMD__", DefaultAgentCommand)
+	missing := MissingCloudInitHooks(old)
+	require.Len(t, missing, 2)
+	assert.Contains(t, missing[0], "__DABBI_AGENT_CMD__")
+	assert.Contains(t, missing[1], "agent_env is ignored")
+
+	assert.Len(t, MissingCloudInitHooks("#cloud-config\n"), 3)
+}
+
+func TestGenerateCloudInitWithAgent_Invalid(t *testing.T) {
+	base := "ExecStart=__DABBI_AGENT_CMD__\n"
+	tests := []struct {
+		name    string
+		command string
+		env     map[string]string
+		wantErr string
+	}{
+		{"empty command", "  ", nil, "agent command is empty"},
+		{"multi-line command", "agent\nrm -rf /", nil, "single line"},
+		{"bad variable name", "agent", map[string]string{"BAD-NAME": "x"}, "invalid agent environment variable name"},
+		{"multi-line value", "agent", map[string]string{"KEY": "a\nb"}, "single line"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := GenerateCloudInitWithAgent(base, tt.command, tt.env)
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestRenderCloudInit_MissingFile(t *testing.T) {
+	_, err := DefaultConfig().RenderCloudInit(filepath.Join(t.TempDir(), "missing.yaml"), nil, nil, "", "")
+	assert.ErrorContains(t, err, "failed to read cloud-init")
+}
@@ -2,8 +2,15 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/mjshashank/dabbi/internal/multipass"
@@ -13,13 +20,92 @@ const (
 	ConfigDir            = ".dabbi"
 	ConfigFile           = "config.json"
 	DefaultCloudInitFile = "cloud-init.yaml"
+	DefaultMaxUploadMB   = 100
+	RecordingsDir        = "recordings"
+	HostNetworkDir       = "network"
+
+	// DefaultShellResumeGraceSecs is how long a disconnected shell stays resumable
+	DefaultShellResumeGraceSecs = 120
+
+	// DefaultShellScrollbackKB is how much recent shell output is replayed on reattach
+	DefaultShellScrollbackKB = 64
+
+	// Default timeouts of the daemon's HTTP server; long-running routes lift
+	// the read and write ones
+	DefaultServerReadTimeoutSecs  = 30
+	DefaultServerWriteTimeoutSecs = 30
+	DefaultServerIdleTimeoutSecs  = 120
+
+	// DefaultSSHAgentPort is where the daemon relays VMs to the host's SSH agent
+	DefaultSSHAgentPort = 7322
 )
 
 // Config holds the application configuration
 type Config struct {
-	AuthToken           string   `json:"auth_token"`
-	Defaults            Defaults `json:"defaults"`
-	ShutdownTimeoutMins int      `json:"shutdown_timeout_mins"`
+	AuthToken                string            `json:"auth_token"`
+	Defaults                 Defaults          `json:"defaults"`
+	ShutdownTimeoutMins      int               `json:"shutdown_timeout_mins"`
+	WatchdogAction           string            `json:"watchdog_action,omitempty"`              // "stop" (default) or "suspend"
+	WatchdogLoadThreshold    float64           `json:"watchdog_load_threshold,omitempty"`      // 1-minute load average above which a VM counts as active (default 0.1)
+	WatchdogNoiseBytesPerMin int               `json:"watchdog_noise_bytes_per_min,omitempty"` // network traffic ignored as background noise (default 100000)
+	MaxUploadMB              int               `json:"max_upload_mb,omitempty"`                // file upload size limit (default 100)
+	AllowedOrigins           []string          `json:"allowed_origins,omitempty"`              // extra origins (scheme://host[:port]) allowed to open shell websockets and call the API cross-origin (CORS)
+	CORSAllowedHeaders       []string          `json:"cors_allowed_headers,omitempty"`         // request headers allowed cross-origin besides Authorization and Content-Type
+	ShellResumeGraceSecs     int               `json:"shell_resume_grace_secs,omitempty"`      // keep dropped shells resumable this long (default 120, negative disables)
+	ShellScrollbackKB        int               `json:"shell_scrollback_kb,omitempty"`          // output replayed on reattach (default 64, negative disables)
+	AgentAutoHeal            bool              `json:"agent_auto_heal,omitempty"`              // restart an inactive opencode service when the agent is opened
+	NetworkAutoInstallTools  bool              `json:"network_auto_install_tools,omitempty"`   // apt-get install iptables/dig in VMs that lack them instead of failing
+	CookieDomain             string            `json:"cookie_domain,omitempty"`                // e.g. ".example.com" to share auth cookies with <vm>-<port> subdomains (default host-only)
+	TLSCertFile              string            `json:"tls_cert_file,omitempty"`                // serve HTTPS with this certificate instead of Let's Encrypt
+	TLSKeyFile               string            `json:"tls_key_file,omitempty"`                 // private key for tls_cert_file
+	KeepCloudInit            bool              `json:"keep_cloud_init,omitempty"`              // save each VM's rendered cloud-init to ~/.dabbi/cloudinit-debug/<vm>.yaml
+	ConsoleLogPath           string            `json:"console_log_path,omitempty"`             // host-side log shown by 'dabbi console' when a VM can't run dmesg; "{vm}" is replaced by the VM name (default: multipassd's log on macOS)
+	HostsPorts               []int             `json:"hosts_ports,omitempty"`                  // VM ports 'dabbi hosts sync' writes <vm>-<port>.localhost entries for (default 1234, 3000, 5173, 8000, 8080)
+	VMSubnet                 string            `json:"vm_subnet,omitempty"`                    // CIDR of the multipass network, preferred when a VM has several IPs
+	ProxyStripHeaders        []string          `json:"proxy_strip_headers,omitempty"`          // request headers removed before proxying to VMs
+	ProxySetHeaders          map[string]string `json:"proxy_set_headers,omitempty"`            // request headers added when proxying to VMs
+	APIKeys                  []APIKey          `json:"api_keys,omitempty"`                     // extra bearer tokens for API clients
+	LoadingPage              LoadingPage       `json:"loading_page,omitempty"`                 // customizes the page shown while a VM wakes
+	MultipassMaxConcurrent   int               `json:"multipass_max_concurrent,omitempty"`     // max multipass commands running at once (default 0 = unlimited)
+	LaunchEnv                map[string]string `json:"launch_env,omitempty"`                   // MULTIPASS_* variables set for every multipass launch, e.g. proxy credentials for private image mirrors
+	LaunchArgs               []string          `json:"launch_args,omitempty"`                  // extra flags passed to every multipass launch
+	SSHAgentPort             int               `json:"ssh_agent_port,omitempty"`               // host port VMs created with --forward-ssh-agent reach the SSH agent on (default 7322)
+	AgentPortBase            int               `json:"agent_port_base,omitempty"`              // first host port of the agent (opencode) listeners (default 11000)
+	AgentPortRange           int               `json:"agent_port_range,omitempty"`             // number of ports agent listeners are spread over (default 1000)
+	TunnelPortBase           int               `json:"tunnel_port_base,omitempty"`             // first host port of stable tunnels (default 12000)
+	TunnelPortRange          int               `json:"tunnel_port_range,omitempty"`            // number of ports stable tunnels are spread over (default 1000)
+	ServerReadTimeoutSecs    int               `json:"server_read_timeout_secs,omitempty"`     // max time to read a request, body included (default 30, negative disables)
+	ServerWriteTimeoutSecs   int               `json:"server_write_timeout_secs,omitempty"`    // max time to write a response (default 30, negative disables)
+	ServerIdleTimeoutSecs    int               `json:"server_idle_timeout_secs,omitempty"`     // how long idle keep-alive connections stay open (default 120, negative disables)
+	RequestTimeoutSecs       int               `json:"request_timeout_secs,omitempty"`         // API requests are canceled after this long, streaming routes excepted (default: the write timeout, negative disables)
+	MaxVMs                   int               `json:"max_vms,omitempty"`                      // refuse to create more VMs than this (default 0 = unlimited)
+	MaxTotalCPU              int               `json:"max_total_cpu,omitempty"`                // refuse creates that would take running VMs past this many CPUs (0 = unlimited)
+	MaxTotalMemory           string            `json:"max_total_memory,omitempty"`             // same for memory, e.g. "32G" (empty = unlimited)
+	Port                     int               `json:"port,omitempty"`                         // port 'dabbi serve' listens on (default 80, or 443 with a TLS certificate)
+	APIPort                  int               `json:"api_port,omitempty"`                     // serve the API and UI on this port, leaving port to VM traffic (default 0 = both on port)
+	Domain                   string            `json:"domain,omitempty"`                       // domain 'dabbi serve' gets Let's Encrypt certificates for
+	BindAddress              string            `json:"bind_address,omitempty"`                 // address 'dabbi serve' listens on (default all interfaces)
+
+	overrides []override // values set by environment variables, see applyEnv
+}
+
+// LoadingPage customizes the page the proxy shows while a stopped VM starts.
+// Empty fields keep the defaults.
+type LoadingPage struct {
+	Title       string `json:"title,omitempty"`        // heading (default "Starting VM")
+	LogoURL     string `json:"logo_url,omitempty"`     // image shown above the heading
+	Message     string `json:"message,omitempty"`      // extra text below the default one
+	CancelURL   string `json:"cancel_url,omitempty"`   // "Cancel" link target, e.g. the dashboard
+	RefreshSecs int    `json:"refresh_secs,omitempty"` // no-JS meta-refresh interval (default 2)
+	RefreshURL  string `json:"refresh_url,omitempty"`  // page to load once ready (default the requested URL)
+}
+
+// APIKey is an additional bearer token for the API. A read-only key can use
+// GET routes but not change VMs or open shells.
+type APIKey struct {
+	Name     string `json:"name"`
+	Token    string `json:"token"`
+	ReadOnly bool   `json:"read_only,omitempty"`
 }
 
 // Defaults holds default VM configuration
@@ -27,8 +113,14 @@ type Defaults struct {
 	CPU           int                      `json:"cpu"`
 	Mem           string                   `json:"mem"`
 	Disk          string                   `json:"disk"`
-	CloudInit     string                   `json:"cloud_init,omitempty"`  // path to default cloud-init file
-	NetworkConfig *multipass.NetworkConfig `json:"network,omitempty"`     // default network restrictions
+	Image         string                   `json:"image,omitempty"`          // image for new VMs, e.g. "24.04" (default: multipass's)
+	CloudInit     string                   `json:"cloud_init,omitempty"`     // path to default cloud-init file
+	NetworkConfig *multipass.NetworkConfig `json:"network,omitempty"`        // default network restrictions
+	Netplan       string                   `json:"netplan,omitempty"`        // path to a netplan config (static IPs, DNS) for new VMs
+	ExtraPackages []string                 `json:"extra_packages,omitempty"` // apt packages added to the cloud-init of new VMs
+	ExtraRuncmd   []string                 `json:"extra_runcmd,omitempty"`   // commands appended to the cloud-init runcmd of new VMs
+	AgentCommand  string                   `json:"agent_command,omitempty"`  // command the agent service runs in new VMs (default: opencode web on port 1234)
+	AgentEnv      map[string]string        `json:"agent_env,omitempty"`      // extra environment variables for the agent service
 }
 
 // DefaultConfig returns a new config with sensible defaults
@@ -44,6 +136,109 @@ func DefaultConfig() *Config {
 	}
 }
 
+// MaxUploadBytes returns the file upload size limit in bytes
+func (c *Config) MaxUploadBytes() int64 {
+	mb := c.MaxUploadMB
+	if mb <= 0 {
+		mb = DefaultMaxUploadMB
+	}
+	return int64(mb) << 20
+}
+
+// ShellResumeGrace returns how long a shell survives after its websocket drops.
+// Zero means resume is disabled.
+func (c *Config) ShellResumeGrace() time.Duration {
+	secs := c.ShellResumeGraceSecs
+	if secs < 0 {
+		return 0
+	}
+	if secs == 0 {
+		secs = DefaultShellResumeGraceSecs
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// ShellScrollbackBytes returns the per-session scrollback buffer size.
+// Zero means no scrollback is kept.
+func (c *Config) ShellScrollbackBytes() int {
+	kb := c.ShellScrollbackKB
+	if kb < 0 {
+		return 0
+	}
+	if kb == 0 {
+		kb = DefaultShellScrollbackKB
+	}
+	return kb << 10
+}
+
+// ServerReadTimeout returns the daemon's HTTP read timeout. Zero means none.
+func (c *Config) ServerReadTimeout() time.Duration {
+	return timeoutSecs(c.ServerReadTimeoutSecs, DefaultServerReadTimeoutSecs)
+}
+
+// ServerWriteTimeout returns the daemon's HTTP write timeout. Zero means none.
+func (c *Config) ServerWriteTimeout() time.Duration {
+	return timeoutSecs(c.ServerWriteTimeoutSecs, DefaultServerWriteTimeoutSecs)
+}
+
+// ServerIdleTimeout returns how long the daemon keeps idle connections open.
+// Zero means none.
+func (c *Config) ServerIdleTimeout() time.Duration {
+	return timeoutSecs(c.ServerIdleTimeoutSecs, DefaultServerIdleTimeoutSecs)
+}
+
+// RequestTimeout returns how long an API request may run before its context
+// is canceled. It defaults to the write timeout, past which the response
+// couldn't be sent anyway. Zero means none.
+func (c *Config) RequestTimeout() time.Duration {
+	if c.RequestTimeoutSecs == 0 {
+		return c.ServerWriteTimeout()
+	}
+	return timeoutSecs(c.RequestTimeoutSecs, 0)
+}
+
+// timeoutSecs converts a configured timeout, where 0 means the default and
+// a negative value disables it
+func timeoutSecs(secs, def int) time.Duration {
+	if secs < 0 {
+		return 0
+	}
+	if secs == 0 {
+		secs = def
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// LaunchEnvList returns launch_env as NAME=value pairs, sorted by name
+func (c *Config) LaunchEnvList() []string {
+	env := make([]string, 0, len(c.LaunchEnv))
+	for name, value := range c.LaunchEnv {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// SSHAgentListenPort returns the port the daemon's SSH agent relay listens on
+func (c *Config) SSHAgentListenPort() int {
+	if c.SSHAgentPort <= 0 {
+		return DefaultSSHAgentPort
+	}
+	return c.SSHAgentPort
+}
+
+// PreferredSubnet parses VMSubnet. It returns nil when no subnet is configured.
+func (c *Config) PreferredSubnet() (*net.IPNet, error) {
+	if c.VMSubnet == "" {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(c.VMSubnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vm_subnet %q: %w", c.VMSubnet, err)
+	}
+	return subnet, nil
+}
+
 // ConfigPath returns the path to the config file
 func ConfigPath() (string, error) {
 	home, err := os.UserHomeDir()
@@ -62,6 +257,26 @@ func DefaultCloudInitPath() (string, error) {
 	return filepath.Join(home, ConfigDir, DefaultCloudInitFile), nil
 }
 
+// RecordingsPath returns the directory shell recordings are saved to
+// (~/.dabbi/recordings)
+func RecordingsPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ConfigDir, RecordingsDir), nil
+}
+
+// HostNetworkPath returns the directory host-scoped network rules are
+// kept in (~/.dabbi/network)
+func HostNetworkPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ConfigDir, HostNetworkDir), nil
+}
+
 // GetCloudInitPath returns the cloud-init path to use
 // Priority: explicit path > config default > ~/.dabbi/cloud-init.yaml (if exists)
 func (c *Config) GetCloudInitPath(explicit string) string {
@@ -172,9 +387,30 @@ runcmd:
   - |
     cat > /opt/dabbi-install.sh << 'SCRIPT'
     #!/bin/bash
-    set -e
+    set -eE -o pipefail
     LOG=/var/log/dabbi-install.log
+    STATUS=/home/ubuntu/.dabbi-install-status
     exec > >(tee -a $LOG) 2>&1
+
+    # Progress read by dabbi (GET /api/vms/<name>/ready): running, then
+    # complete or failed with the command that failed
+    write_status() {
+      printf 'status=%s\nupdated=%s\nerror=%s\n' "$1" "$(date -u +%Y-%m-%dT%H:%M:%SZ)" "$2" > $STATUS.tmp
+      chown ubuntu:ubuntu $STATUS.tmp
+      mv $STATUS.tmp $STATUS
+    }
+    on_error() {
+      trap - ERR
+      echo "[$(date)] Installation failed at line $2: $3 (exit $1)"
+      write_status failed "line $2: $3 (exit $1)"
+      touch /home/ubuntu/.dabbi-install-failed
+      chown ubuntu:ubuntu /home/ubuntu/.dabbi-install-failed
+      exit $1
+    }
+    trap 'on_error $? $LINENO "$BASH_COMMAND"' ERR
+    rm -f /home/ubuntu/.dabbi-install-failed /home/ubuntu/.dabbi-install-complete
+    write_status running ""
+
     echo "[$(date)] Starting background tool installation..."
 
     # Install htop, unzip
@@ -201,6 +437,7 @@ runcmd:
     sudo -u ubuntu bash -c 'curl -fsSL https://opencode.ai/install | bash'
 
     echo "[$(date)] Background installation complete!"
+    write_status complete ""
     touch /home/ubuntu/.dabbi-install-complete
     chown ubuntu:ubuntu /home/ubuntu/.dabbi-install-complete
     SCRIPT
@@ -220,7 +457,8 @@ runcmd:
     WorkingDirectory=/home/ubuntu
     Environment="HOME=/home/ubuntu"
     Environment="OPENCODE_SERVER_PASSWORD=__DABBI_AUTH_TOKEN__"
-    ExecStart=/home/ubuntu/.opencode/bin/opencode web --port 1234 --hostname 0.0.0.0
+    __DABBI_AGENT_ENV__
+    ExecStart=__DABBI_AGENT_CMD__
     Restart=always
     RestartSec=10
 
@@ -263,8 +501,21 @@ func EnsureDefaultCloudInit() (string, bool, error) {
 	return path, true, nil
 }
 
-// Load loads the configuration from disk, creating a default one if it doesn't exist
+// Load loads the configuration from disk, creating a default one if it
+// doesn't exist, then applies DABBI_* environment overrides. Precedence is
+// environment, then file, then defaults.
 func Load() (*Config, error) {
+	cfg, err := loadFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func loadFile() (*Config, error) {
 	path, err := ConfigPath()
 	if err != nil {
 		return nil, err
@@ -290,8 +541,76 @@ func Load() (*Config, error) {
 	return &cfg, nil
 }
 
-// Save persists the configuration to disk
+// mu guards configs shared by the daemon's handlers: Update and Save hold it
+// to change and write them, Snapshot to read them. It serializes writers so
+// they can't lose each other's changes or interleave their writes.
+var mu sync.RWMutex
+
+// Save persists the configuration to disk. Values still as an environment
+// variable set them are written with their file values instead.
 func (c *Config) Save() error {
+	mu.Lock()
+	defer mu.Unlock()
+	return c.save()
+}
+
+// Update applies change to the configuration and saves it, restoring the
+// previous values if the save fails. Writers that can run concurrently use
+// it rather than changing fields and calling Save.
+func (c *Config) Update(change func(*Config)) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	prev := c.clone()
+	change(c)
+	if err := c.save(); err != nil {
+		*c = *prev
+		return err
+	}
+	return nil
+}
+
+// Snapshot returns a copy of the configuration that Update can't change
+// underneath the caller. Code reading fields Update changes (the defaults,
+// the shutdown timeout) while the daemon runs reads them from a snapshot.
+func (c *Config) Snapshot() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return c.clone()
+}
+
+// clone returns a deep copy of c, so changes to either don't show in the other
+func (c *Config) clone() *Config {
+	cp := *c
+	cp.Defaults = c.Defaults.clone()
+	cp.AllowedOrigins = slices.Clone(c.AllowedOrigins)
+	cp.CORSAllowedHeaders = slices.Clone(c.CORSAllowedHeaders)
+	cp.HostsPorts = slices.Clone(c.HostsPorts)
+	cp.ProxyStripHeaders = slices.Clone(c.ProxyStripHeaders)
+	cp.ProxySetHeaders = maps.Clone(c.ProxySetHeaders)
+	cp.APIKeys = slices.Clone(c.APIKeys)
+	cp.LaunchEnv = maps.Clone(c.LaunchEnv)
+	cp.LaunchArgs = slices.Clone(c.LaunchArgs)
+	cp.overrides = slices.Clone(c.overrides)
+	return &cp
+}
+
+// clone returns a deep copy of d
+func (d Defaults) clone() Defaults {
+	cp := d
+	if d.NetworkConfig != nil {
+		nc := *d.NetworkConfig
+		nc.Rules = slices.Clone(d.NetworkConfig.Rules)
+		nc.DNSServers = slices.Clone(d.NetworkConfig.DNSServers)
+		cp.NetworkConfig = &nc
+	}
+	cp.ExtraPackages = slices.Clone(d.ExtraPackages)
+	cp.ExtraRuncmd = slices.Clone(d.ExtraRuncmd)
+	cp.AgentEnv = maps.Clone(d.AgentEnv)
+	return cp
+}
+
+func (c *Config) save() error {
 	path, err := ConfigPath()
 	if err != nil {
 		return err
@@ -303,7 +622,7 @@ func (c *Config) Save() error {
 		return err
 	}
 
-	data, err := json.MarshalIndent(c, "", "  ")
+	data, err := json.MarshalIndent(c.withoutEnv(), "", "  ")
 	if err != nil {
 		return err
 	}
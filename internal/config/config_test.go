@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -236,6 +239,97 @@ func TestConfigSave_CreatesDirectory(t *testing.T) {
 	assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), "Config dir should have restrictive permissions")
 }
 
+func TestConfig_Update(t *testing.T) {
+	tmpHome := t.TempDir()
+	origHome := os.Getenv("HOME")
+	os.Setenv("HOME", tmpHome)
+	defer os.Setenv("HOME", origHome)
+
+	cfg := DefaultConfig()
+
+	// Concurrent writers each keep their change
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, cfg.Update(func(c *Config) {
+				if i%2 == 0 {
+					c.Defaults.CPU = 8
+				} else {
+					c.ShutdownTimeoutMins = 90
+				}
+			}))
+		}(i)
+	}
+	wg.Wait()
+
+	loaded, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, 8, loaded.Defaults.CPU)
+	assert.Equal(t, 90, loaded.ShutdownTimeoutMins)
+
+	// A failed save leaves the config as it was
+	path := filepath.Join(tmpHome, ConfigDir, ConfigFile)
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.Mkdir(path, 0700))
+	err = cfg.Update(func(c *Config) { c.Defaults.CPU = 1 })
+	require.Error(t, err)
+	assert.Equal(t, 8, cfg.Defaults.CPU)
+
+	// ...including what change wrote through maps and slices
+	cfg.Defaults.AgentEnv = map[string]string{"A": "1"}
+	cfg.Defaults.ExtraPackages = []string{"htop"}
+	err = cfg.Update(func(c *Config) {
+		c.Defaults.AgentEnv["A"] = "2"
+		c.Defaults.ExtraPackages[0] = "vim"
+	})
+	require.Error(t, err)
+	assert.Equal(t, map[string]string{"A": "1"}, cfg.Defaults.AgentEnv)
+	assert.Equal(t, []string{"htop"}, cfg.Defaults.ExtraPackages)
+}
+
+func TestConfig_Snapshot(t *testing.T) {
+	tmpHome := t.TempDir()
+	origHome := os.Getenv("HOME")
+	os.Setenv("HOME", tmpHome)
+	defer os.Setenv("HOME", origHome)
+
+	cfg := DefaultConfig()
+	cfg.Defaults.NetworkConfig = &multipass.NetworkConfig{
+		Mode:  multipass.NetworkModeAllowlist,
+		Rules: []multipass.NetworkRule{{Type: "domain", Value: "github.com"}},
+	}
+	cfg.APIKeys = []APIKey{{Name: "ci", Token: "t"}}
+
+	snap := cfg.Snapshot()
+	require.NoError(t, cfg.Update(func(c *Config) {
+		c.Defaults.CPU = 16
+		c.Defaults.NetworkConfig.Rules[0].Value = "example.com"
+	}))
+	cfg.APIKeys[0].Name = "changed"
+
+	// Later changes don't show in the snapshot
+	assert.Equal(t, 2, snap.Defaults.CPU)
+	assert.Equal(t, "github.com", snap.Defaults.NetworkConfig.Rules[0].Value)
+	assert.Equal(t, "ci", snap.APIKeys[0].Name)
+
+	// Readers and writers can run at once (go test -race)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_ = cfg.Snapshot().Defaults.CPU
+		}()
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, cfg.Update(func(c *Config) { c.Defaults.CPU = i + 1 }))
+		}(i)
+	}
+	wg.Wait()
+}
+
 func TestConfig_JSONMarshal(t *testing.T) {
 	cfg := DefaultConfig()
 	cfg.Defaults.CloudInit = "/path/to/cloud-init.yaml"
@@ -251,3 +345,87 @@ func TestConfig_JSONMarshal(t *testing.T) {
 	assert.Equal(t, cfg.Defaults.CPU, unmarshaled.Defaults.CPU)
 	assert.Equal(t, cfg.Defaults.CloudInit, unmarshaled.Defaults.CloudInit)
 }
+
+func TestConfig_MaxUploadBytes(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Equal(t, int64(DefaultMaxUploadMB)<<20, cfg.MaxUploadBytes())
+
+	cfg.MaxUploadMB = 5
+	assert.Equal(t, int64(5)<<20, cfg.MaxUploadBytes())
+}
+
+func TestConfig_ShellResumeGrace(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Equal(t, DefaultShellResumeGraceSecs*time.Second, cfg.ShellResumeGrace())
+
+	cfg.ShellResumeGraceSecs = 30
+	assert.Equal(t, 30*time.Second, cfg.ShellResumeGrace())
+
+	cfg.ShellResumeGraceSecs = -1
+	assert.Equal(t, time.Duration(0), cfg.ShellResumeGrace())
+}
+
+func TestConfig_ShellScrollbackBytes(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Equal(t, DefaultShellScrollbackKB<<10, cfg.ShellScrollbackBytes())
+
+	cfg.ShellScrollbackKB = 8
+	assert.Equal(t, 8<<10, cfg.ShellScrollbackBytes())
+
+	cfg.ShellScrollbackKB = -1
+	assert.Equal(t, 0, cfg.ShellScrollbackBytes())
+}
+
+func TestConfig_ServerTimeouts(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Equal(t, DefaultServerReadTimeoutSecs*time.Second, cfg.ServerReadTimeout())
+	assert.Equal(t, DefaultServerWriteTimeoutSecs*time.Second, cfg.ServerWriteTimeout())
+	assert.Equal(t, DefaultServerIdleTimeoutSecs*time.Second, cfg.ServerIdleTimeout())
+
+	cfg.ServerReadTimeoutSecs = 300
+	cfg.ServerWriteTimeoutSecs = -1
+	cfg.ServerIdleTimeoutSecs = 60
+	assert.Equal(t, 300*time.Second, cfg.ServerReadTimeout())
+	assert.Equal(t, time.Duration(0), cfg.ServerWriteTimeout())
+	assert.Equal(t, 60*time.Second, cfg.ServerIdleTimeout())
+}
+
+func TestConfig_LaunchEnvList(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Empty(t, cfg.LaunchEnvList())
+
+	cfg.LaunchEnv = map[string]string{"MULTIPASS_B": "2", "MULTIPASS_A": "a=1"}
+	assert.Equal(t, []string{"MULTIPASS_A=a=1", "MULTIPASS_B=2"}, cfg.LaunchEnvList())
+}
+
+func TestConfig_RequestTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	assert.Equal(t, DefaultServerWriteTimeoutSecs*time.Second, cfg.RequestTimeout())
+
+	// Follows the write timeout unless set
+	cfg.ServerWriteTimeoutSecs = 120
+	assert.Equal(t, 120*time.Second, cfg.RequestTimeout())
+	cfg.ServerWriteTimeoutSecs = -1
+	assert.Equal(t, time.Duration(0), cfg.RequestTimeout())
+
+	cfg.RequestTimeoutSecs = 10
+	assert.Equal(t, 10*time.Second, cfg.RequestTimeout())
+	cfg.RequestTimeoutSecs = -1
+	assert.Equal(t, time.Duration(0), cfg.RequestTimeout())
+}
+
+func TestConfig_PreferredSubnet(t *testing.T) {
+	cfg := DefaultConfig()
+	subnet, err := cfg.PreferredSubnet()
+	require.NoError(t, err)
+	assert.Nil(t, subnet)
+
+	cfg.VMSubnet = "192.168.64.0/24"
+	subnet, err = cfg.PreferredSubnet()
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.64.0/24", subnet.String())
+
+	cfg.VMSubnet = "192.168.64.1"
+	_, err = cfg.PreferredSubnet()
+	assert.ErrorContains(t, err, "invalid vm_subnet")
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix starts every environment variable that overrides a config value
+const EnvPrefix = "DABBI_"
+
+// EnvName returns the environment variable that overrides the top-level
+// config key with the given JSON name, e.g. DABBI_AUTH_TOKEN for auth_token
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(key)
+}
+
+// override is a config value an environment variable replaced at Load
+type override struct {
+	field   int    // index of the field in Config
+	env     string // variable name
+	fileVal any    // value before the override, from the file or defaults
+	envVal  any    // value the variable set
+}
+
+// applyEnv overrides top-level string, integer, boolean, and string-list
+// values with DABBI_<KEY> environment variables. Lists are comma-separated.
+// Nested settings (defaults, loading_page, api_keys, ...) are only read from
+// the file.
+func (c *Config) applyEnv() error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := jsonKey(t.Field(i))
+		if key == "" || !envSettable(t.Field(i).Type) {
+			continue
+		}
+		name := EnvName(key)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		f := v.Field(i)
+		before := f.Interface()
+		if err := setFromEnv(f, raw); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		c.overrides = append(c.overrides, override{field: i, env: name, fileVal: before, envVal: f.Interface()})
+	}
+	return nil
+}
+
+// EnvOverrides returns the environment variables that replaced config
+// values, in field order
+func (c *Config) EnvOverrides() []string {
+	names := make([]string, len(c.overrides))
+	for i, o := range c.overrides {
+		names[i] = o.env
+	}
+	return names
+}
+
+// withoutEnv returns the config as it should be written to disk: values an
+// environment variable set go back to what the file had, so env-only
+// settings (a token from a secret store, say) never end up in config.json.
+// A value changed since Load, e.g. through the API, is kept.
+func (c *Config) withoutEnv() *Config {
+	if len(c.overrides) == 0 {
+		return c
+	}
+	out := *c
+	v := reflect.ValueOf(&out).Elem()
+	for _, o := range c.overrides {
+		f := v.Field(o.field)
+		if reflect.DeepEqual(f.Interface(), o.envVal) {
+			f.Set(reflect.ValueOf(o.fileVal))
+		}
+	}
+	return &out
+}
+
+// jsonKey returns the JSON name of an exported field, or "" if it has none
+func jsonKey(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	return name
+}
+
+func envSettable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Int, reflect.Bool:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+func setFromEnv(f reflect.Value, raw string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		f.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		f.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfigFile saves cfg as config.json under a fresh HOME
+func writeConfigFile(t *testing.T, cfg *Config) string {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	require.NoError(t, cfg.Save())
+	path, err := ConfigPath()
+	require.NoError(t, err)
+	return path
+}
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "DABBI_AUTH_TOKEN", EnvName("auth_token"))
+	assert.Equal(t, "DABBI_SHUTDOWN_TIMEOUT_MINS", EnvName("shutdown_timeout_mins"))
+}
+
+func TestLoad_EnvOverridesFile(t *testing.T) {
+	file := DefaultConfig()
+	file.AuthToken = "from-file"
+	file.ShutdownTimeoutMins = 10
+	file.Port = 8080
+	file.CookieDomain = ".file.example.com"
+	writeConfigFile(t, file)
+
+	t.Setenv("DABBI_AUTH_TOKEN", "from-env")
+	t.Setenv("DABBI_PORT", "9090")
+	t.Setenv("DABBI_DOMAIN", "dabbi.example.com")
+	t.Setenv("DABBI_BIND_ADDRESS", "127.0.0.1")
+	t.Setenv("DABBI_SHUTDOWN_TIMEOUT_MINS", " 30 ")
+	t.Setenv("DABBI_AGENT_AUTO_HEAL", "true")
+	t.Setenv("DABBI_ALLOWED_ORIGINS", "https://a.example.com, https://b.example.com,")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+
+	assert.Equal(t, "from-env", cfg.AuthToken)
+	assert.Equal(t, 9090, cfg.Port)
+	assert.Equal(t, "dabbi.example.com", cfg.Domain)
+	assert.Equal(t, "127.0.0.1", cfg.BindAddress)
+	assert.Equal(t, 30, cfg.ShutdownTimeoutMins)
+	assert.True(t, cfg.AgentAutoHeal)
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, cfg.AllowedOrigins)
+
+	// Values without a variable still come from the file, then defaults
+	assert.Equal(t, ".file.example.com", cfg.CookieDomain)
+	assert.Equal(t, 2, cfg.Defaults.CPU)
+
+	assert.Equal(t, []string{
+		"DABBI_AUTH_TOKEN", "DABBI_SHUTDOWN_TIMEOUT_MINS", "DABBI_ALLOWED_ORIGINS",
+		"DABBI_AGENT_AUTO_HEAL", "DABBI_PORT", "DABBI_DOMAIN", "DABBI_BIND_ADDRESS",
+	}, cfg.EnvOverrides())
+}
+
+func TestLoad_EnvOverridesDefaults(t *testing.T) {
+	// No config file yet: the generated default is saved without the env value
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("DABBI_AUTH_TOKEN", "from-env")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, "from-env", cfg.AuthToken)
+
+	path, err := ConfigPath()
+	require.NoError(t, err)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "from-env")
+}
+
+func TestLoad_InvalidEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"DABBI_PORT", "eighty"},
+		{"DABBI_KEEP_CLOUD_INIT", "maybe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfigFile(t, DefaultConfig())
+			t.Setenv(tt.name, tt.value)
+
+			_, err := Load()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.name)
+		})
+	}
+}
+
+func TestLoad_NestedValuesIgnoreEnv(t *testing.T) {
+	writeConfigFile(t, DefaultConfig())
+	t.Setenv("DABBI_DEFAULTS", "ignored")
+	t.Setenv("DABBI_API_KEYS", "ignored")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+	assert.Equal(t, "4G", cfg.Defaults.Mem)
+	assert.Empty(t, cfg.APIKeys)
+	assert.Empty(t, cfg.EnvOverrides())
+}
+
+func TestSave_KeepsFileValuesForEnvOverrides(t *testing.T) {
+	file := DefaultConfig()
+	file.AuthToken = "from-file"
+	file.ShutdownTimeoutMins = 10
+	file.WatchdogAction = "stop"
+	path := writeConfigFile(t, file)
+
+	t.Setenv("DABBI_AUTH_TOKEN", "from-env")
+	t.Setenv("DABBI_SHUTDOWN_TIMEOUT_MINS", "30")
+	t.Setenv("DABBI_WATCHDOG_ACTION", "suspend")
+
+	cfg, err := Load()
+	require.NoError(t, err)
+
+	// What the API writes back: a changed default and a changed timeout
+	cfg.Defaults.CPU = 4
+	cfg.ShutdownTimeoutMins = 15
+	require.NoError(t, cfg.Save())
+
+	// The in-memory config is untouched by saving
+	assert.Equal(t, "from-env", cfg.AuthToken)
+	assert.Equal(t, "suspend", cfg.WatchdogAction)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var saved Config
+	require.NoError(t, json.Unmarshal(data, &saved))
+
+	// Env values never reach the file; values changed since Load do
+	assert.Equal(t, "from-file", saved.AuthToken)
+	assert.Equal(t, "stop", saved.WatchdogAction)
+	assert.Equal(t, 15, saved.ShutdownTimeoutMins)
+	assert.Equal(t, 4, saved.Defaults.CPU)
+}
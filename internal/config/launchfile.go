@@ -0,0 +1,104 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// CloudInitDebugDir holds copies of rendered cloud-inits when keep_cloud_init is set
+	CloudInitDebugDir = "cloudinit-debug"
+
+	// cloudInitDebugRetention is how long debug copies are kept
+	cloudInitDebugRetention = 7 * 24 * time.Hour
+)
+
+// LaunchFile is a rendered cloud-init written where multipass can read it.
+// It must outlive the launch, so callers Release it once Launch returns.
+type LaunchFile struct {
+	Path   string
+	dir    string
+	vmName string
+	keep   bool
+}
+
+// WriteLaunchFile writes a VM's rendered cloud-init to a temp file in the
+// home directory (snap multipass can't access /tmp)
+func (c *Config) WriteLaunchFile(vmName, content string) (*LaunchFile, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get home dir: %w", err)
+	}
+	dir, err := os.MkdirTemp(home, "dabbi-cloudinit-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+
+	path := filepath.Join(dir, "cloud-init.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to write temp cloud-init: %w", err)
+	}
+
+	return &LaunchFile{Path: path, dir: dir, vmName: vmName, keep: c.KeepCloudInit}, nil
+}
+
+// Release removes the temp file. With keep_cloud_init set, a copy is first
+// saved to ~/.dabbi/cloudinit-debug/<vm>.yaml and copies older than a week
+// are pruned. The temp file is removed even if keeping the copy fails.
+func (f *LaunchFile) Release() error {
+	defer os.RemoveAll(f.dir)
+
+	if !f.keep {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return err
+	}
+	dir, err := cloudInitDebugPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Mode 0600: the rendered file contains the auth token
+	if err := os.WriteFile(filepath.Join(dir, f.vmName+".yaml"), data, 0600); err != nil {
+		return fmt.Errorf("failed to keep cloud-init for debugging: %w", err)
+	}
+	return pruneCloudInitDebug(dir, time.Now())
+}
+
+// cloudInitDebugPath returns the path to ~/.dabbi/cloudinit-debug
+func cloudInitDebugPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ConfigDir, CloudInitDebugDir), nil
+}
+
+// pruneCloudInitDebug removes debug copies not written within the retention period
+func pruneCloudInitDebug(dir string, now time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".yaml" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()) > cloudInitDebugRetention {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLaunchFile_Release(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	cfg := DefaultConfig()
+	f, err := cfg.WriteLaunchFile("vm1", "#cloud-config\n")
+	require.NoError(t, err)
+
+	// Readable until released
+	data, err := os.ReadFile(f.Path)
+	require.NoError(t, err)
+	assert.Equal(t, "#cloud-config\n", string(data))
+
+	require.NoError(t, f.Release())
+	_, err = os.Stat(f.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	// Nothing kept without keep_cloud_init
+	_, err = os.Stat(filepath.Join(home, ConfigDir, CloudInitDebugDir))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLaunchFile_ReleaseKeepsDebugCopy(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	debugDir := filepath.Join(home, ConfigDir, CloudInitDebugDir)
+
+	// An old copy from a previous launch should be pruned
+	require.NoError(t, os.MkdirAll(debugDir, 0700))
+	stale := filepath.Join(debugDir, "old-vm.yaml")
+	require.NoError(t, os.WriteFile(stale, []byte("old"), 0600))
+	old := time.Now().Add(-2 * cloudInitDebugRetention)
+	require.NoError(t, os.Chtimes(stale, old, old))
+
+	cfg := DefaultConfig()
+	cfg.KeepCloudInit = true
+	f, err := cfg.WriteLaunchFile("vm1", "#cloud-config\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Release())
+
+	_, err = os.Stat(f.Path)
+	assert.True(t, os.IsNotExist(err))
+
+	kept := filepath.Join(debugDir, "vm1.yaml")
+	data, err := os.ReadFile(kept)
+	require.NoError(t, err)
+	assert.Equal(t, "#cloud-config\n", string(data))
+	info, err := os.Stat(kept)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NetplanPath is where a VM created with a netplan config gets it. Netplan
+// reads /etc/netplan in lexical order, so it overrides the 50-cloud-init.yaml
+// multipass generates.
+const NetplanPath = "/etc/netplan/90-dabbi.yaml"
+
+// LoadNetplan reads a netplan config (static IPs, DNS servers, routes) and
+// checks that it is YAML with a top-level network key. This is the VM's own
+// interface setup, unrelated to the iptables rules of NetworkConfig.
+func LoadNetplan(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read netplan config: %w", err)
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("netplan config %s is not valid YAML: %w", path, err)
+	}
+	if _, ok := doc["network"]; !ok {
+		return "", fmt.Errorf("netplan config %s has no top-level 'network' key", path)
+	}
+	return string(data), nil
+}
+
+// GenerateCloudInitWithNetplan writes a netplan config to NetplanPath and
+// applies it. Multipass has no --network-config flag, so the config goes
+// through runcmd like dabbi's other setup; it runs after first boot's
+// networking is up, and a config that drops the default interface cuts the
+// VM off from multipass.
+func GenerateCloudInitWithNetplan(base, netplan string) string {
+	lines := strings.Split(strings.TrimRight(netplan, "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = "    " + l
+	}
+	return appendToList(base, "runcmd", fmt.Sprintf(netplanSection, NetplanPath, strings.Join(lines, "\n")))
+}
+
+const netplanSection = `  # Dabbi netplan config
+  - |
+    cat > %[1]s << 'DABBINETPLAN'
+%[2]s
+    DABBINETPLAN
+  - chmod 600 %[1]s
+  - netplan apply
+`
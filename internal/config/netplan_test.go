@@ -0,0 +1,60 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const staticNetplan = `network:
+  version: 2
+  ethernets:
+    enp0s2:
+      addresses: [192.168.64.50/24]
+      nameservers:
+        addresses: [1.1.1.1]
+`
+
+func writeNetplan(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "netplan.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoadNetplan(t *testing.T) {
+	out, err := LoadNetplan(writeNetplan(t, staticNetplan))
+	require.NoError(t, err)
+	assert.Equal(t, staticNetplan, out)
+
+	_, err = LoadNetplan(writeNetplan(t, "network:\n  version: [2\n"))
+	assert.ErrorContains(t, err, "not valid YAML")
+
+	_, err = LoadNetplan(writeNetplan(t, "version: 2\n"))
+	assert.ErrorContains(t, err, "no top-level 'network' key")
+
+	_, err = LoadNetplan(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorContains(t, err, "failed to read netplan config")
+}
+
+func TestGenerateCloudInitWithNetplan(t *testing.T) {
+	out := GenerateCloudInitWithNetplan("#cloud-config\nruncmd:\n  - echo hi\n", staticNetplan)
+
+	assert.Equal(t, 1, strings.Count(out, "\nruncmd:"))
+	assert.Contains(t, out, "cat > "+NetplanPath+" << 'DABBINETPLAN'\n    network:\n      version: 2\n")
+	assert.Contains(t, out, "        addresses: [1.1.1.1]\n    DABBINETPLAN\n")
+	assert.Contains(t, out, "  - netplan apply\n")
+	assert.Less(t, strings.Index(out, "echo hi"), strings.Index(out, "netplan apply"))
+}
+
+func TestRenderCloudInit_Netplan(t *testing.T) {
+	out, err := DefaultConfig().RenderCloudInit("", nil, nil, "", writeNetplan(t, staticNetplan))
+	require.NoError(t, err)
+	assert.Contains(t, out, NetplanPath)
+
+	_, err = DefaultConfig().RenderCloudInit("", nil, nil, "", writeNetplan(t, "- not a mapping\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,190 @@
+package console
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+const (
+	// DefaultLines is how many lines Read returns when asked for 0
+	DefaultLines = 200
+
+	// MaxLines caps how many lines Read returns
+	MaxLines = 5000
+
+	// maxHostRead is how much of the end of a host log is read
+	maxHostRead = 4 << 20
+
+	// VMPlaceholder in a host log path is replaced by the VM name
+	VMPlaceholder = "{vm}"
+
+	// SourceDmesg is the source of logs read from the VM's kernel ring buffer
+	SourceDmesg = "dmesg"
+)
+
+// ErrUnavailable is wrapped by the error Read returns when neither the VM
+// nor the host has a log to show
+var ErrUnavailable = errors.New("console log unavailable")
+
+// Log is the end of a VM's boot/console log
+type Log struct {
+	VM     string   `json:"vm"`
+	Source string   `json:"source"`         // "dmesg", or the host log file read
+	Note   string   `json:"note,omitempty"` // why the VM's own log wasn't used
+	Lines  []string `json:"lines"`
+}
+
+// DefaultHostPath returns the host-side log read when a VM can't run
+// dmesg, or "" if the platform has none. Multipass on macOS logs every
+// instance to one daemon log; on Linux it logs to the systemd journal.
+func DefaultHostPath() string {
+	if runtime.GOOS == "darwin" {
+		return "/Library/Logs/Multipass/multipassd.log"
+	}
+	return ""
+}
+
+// Reader reads console logs, from inside the VM while it can run commands
+// and from a host-side log otherwise
+type Reader struct {
+	mp       multipass.Client
+	hostPath string
+}
+
+// NewReader creates a reader. hostPath is the host-side log; "{vm}" in it
+// is replaced by the VM name, and a path without it is a shared log, like
+// multipassd's, whose lines tagged "[<vm>]" are kept. An empty hostPath
+// means DefaultHostPath.
+func NewReader(mp multipass.Client, hostPath string) *Reader {
+	if hostPath == "" {
+		hostPath = DefaultHostPath()
+	}
+	return &Reader{mp: mp, hostPath: hostPath}
+}
+
+// Read returns the last lines of a VM's console log (DefaultLines if
+// lines is 0). A running VM with an address is asked for its kernel log,
+// which covers boot and network setup; the host log is the fallback for
+// VMs that are stopped, still booting, or never got an IP. info is the
+// VM's current state, already fetched by the caller.
+func (r *Reader) Read(name string, info *multipass.InstanceInfo, lines int) (*Log, error) {
+	if lines <= 0 {
+		lines = DefaultLines
+	}
+	if lines > MaxLines {
+		lines = MaxLines
+	}
+
+	var note string
+	switch {
+	case !multipass.CanExec(info.State):
+		note = fmt.Sprintf("VM is %s", strings.ToLower(info.State))
+	case len(info.IPv4) == 0:
+		note = "VM has no IPv4 address"
+	default:
+		out, err := r.mp.Exec(name, "sudo", "dmesg")
+		if err == nil {
+			return &Log{VM: name, Source: SourceDmesg, Lines: tail(splitLines(out), lines)}, nil
+		}
+		note = fmt.Sprintf("dmesg failed: %v", err)
+	}
+
+	if r.hostPath == "" {
+		return nil, fmt.Errorf("%w: %s and no host log is configured (set console_log_path)", ErrUnavailable, note)
+	}
+	path, shared := r.hostPath, true
+	if strings.Contains(path, VMPlaceholder) {
+		path, shared = strings.ReplaceAll(path, VMPlaceholder, name), false
+	}
+	all, err := readEnd(path, maxHostRead)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s and the host log can't be read: %v", ErrUnavailable, note, err)
+	}
+	found := splitLines(all)
+	if shared {
+		found = mentioning(found, name)
+	}
+	return &Log{VM: name, Source: path, Note: note, Lines: tail(found, lines)}, nil
+}
+
+// NewLines returns the lines of cur that come after the last line of prev,
+// for following a log by reading it repeatedly. If that line is gone (the
+// log rotated or the source changed), all of cur is new.
+func NewLines(prev, cur []string) []string {
+	if len(prev) == 0 {
+		return cur
+	}
+	last := prev[len(prev)-1]
+	for i := len(cur) - 1; i >= 0; i-- {
+		if cur[i] == last {
+			return cur[i+1:]
+		}
+	}
+	return cur
+}
+
+// readEnd reads up to max bytes from the end of a file, dropping the
+// partial first line when it starts mid-file
+func readEnd(path string, max int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := fi.Size() - max
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, offset, fi.Size()-offset))
+	if err != nil {
+		return "", err
+	}
+	s := string(data)
+	if offset > 0 {
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[i+1:]
+		}
+	}
+	return s, nil
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimRight(s, "\n")
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, "\n")
+}
+
+// mentioning keeps the lines of a shared log tagged with the VM's name
+func mentioning(lines []string, vm string) []string {
+	tag := "[" + vm + "]"
+	var out []string
+	for _, l := range lines {
+		if strings.Contains(l, tag) {
+			out = append(out, l)
+		}
+	}
+	if out == nil {
+		return []string{}
+	}
+	return out
+}
+
+func tail(lines []string, n int) []string {
+	if len(lines) > n {
+		return lines[len(lines)-n:]
+	}
+	return lines
+}
@@ -0,0 +1,101 @@
+package console
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeLog(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+}
+
+func TestReader_Dmesg(t *testing.T) {
+	mp := new(testutil.MockMultipassClient)
+	mp.On("Exec", "dev", []string{"sudo", "dmesg"}).Return("boot\nnet up\ncloud-init done\n", nil)
+
+	log, err := NewReader(mp, "").Read("dev", testutil.RunningVM("dev", "192.168.64.2"), 2)
+	require.NoError(t, err)
+	assert.Equal(t, SourceDmesg, log.Source)
+	assert.Empty(t, log.Note)
+	assert.Equal(t, []string{"net up", "cloud-init done"}, log.Lines)
+}
+
+func TestReader_HostLogPerVM(t *testing.T) {
+	dir := t.TempDir()
+	writeLog(t, filepath.Join(dir, "dev.log"), "serial 1", "serial 2")
+
+	// Running but without an address: dmesg isn't attempted
+	mp := new(testutil.MockMultipassClient)
+	info := &multipass.InstanceInfo{State: multipass.StateRunning}
+
+	log, err := NewReader(mp, filepath.Join(dir, "{vm}.log")).Read("dev", info, 0)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "dev.log"), log.Source)
+	assert.Equal(t, "VM has no IPv4 address", log.Note)
+	assert.Equal(t, []string{"serial 1", "serial 2"}, log.Lines)
+	mp.AssertNotCalled(t, "Exec")
+}
+
+func TestReader_SharedHostLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "multipassd.log")
+	writeLog(t, path,
+		"[info] [dev] starting",
+		"[info] [devbox] starting",
+		"[warning] [dev] no IP address yet",
+		"[info] [daemon] ready",
+	)
+
+	// dmesg fails, so the host log is read
+	mp := new(testutil.MockMultipassClient)
+	mp.On("Exec", "dev", []string{"sudo", "dmesg"}).Return("", errors.New("ssh failed"))
+
+	log, err := NewReader(mp, path).Read("dev", testutil.RunningVM("dev", "192.168.64.2"), 0)
+	require.NoError(t, err)
+	assert.Contains(t, log.Note, "ssh failed")
+	assert.Equal(t, []string{"[info] [dev] starting", "[warning] [dev] no IP address yet"}, log.Lines)
+}
+
+func TestReader_Unavailable(t *testing.T) {
+	mp := new(testutil.MockMultipassClient)
+	stopped := &multipass.InstanceInfo{State: multipass.StateStopped}
+
+	_, err := (&Reader{mp: mp}).Read("dev", stopped, 0)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Contains(t, err.Error(), "console_log_path")
+
+	_, err = NewReader(mp, filepath.Join(t.TempDir(), "missing.log")).Read("dev", stopped, 0)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.Contains(t, err.Error(), "VM is stopped")
+}
+
+func TestReadEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.log")
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("line %02d", i))
+	}
+	writeLog(t, path, lines...)
+
+	// 8 bytes per line: the cut lands mid-line, which is dropped
+	s, err := readEnd(path, 8*10+4)
+	require.NoError(t, err)
+	assert.Equal(t, lines[90:], splitLines(s))
+}
+
+func TestNewLines(t *testing.T) {
+	assert.Equal(t, []string{"a", "b"}, NewLines(nil, []string{"a", "b"}))
+	assert.Equal(t, []string{"c", "d"}, NewLines([]string{"a", "b"}, []string{"b", "c", "d"}))
+	assert.Empty(t, NewLines([]string{"a", "b"}, []string{"a", "b"}))
+	// Rotated: the last line seen is gone
+	assert.Equal(t, []string{"x"}, NewLines([]string{"a"}, []string{"x"}))
+}
@@ -30,23 +30,48 @@ func NewAgentHandler(am *agent.Manager, domain, authToken string, useTLS bool) *
 	}
 }
 
+// AgentsResponse lists the agent listeners and the port range they use
+type AgentsResponse struct {
+	BasePort  int                `json:"base_port"`
+	PortRange int                `json:"port_range"`
+	Agents    []agent.Assignment `json:"agents"`
+}
+
+// List returns the host port of each VM's agent listener, so the range can
+// be firewalled and collisions spotted
+// GET /api/agents
+func (h *AgentHandler) List(w http.ResponseWriter, r *http.Request) {
+	base, count := h.am.PortRange()
+	agents := h.am.List()
+	if agents == nil {
+		agents = []agent.Assignment{}
+	}
+	respondJSON(w, http.StatusOK, AgentsResponse{BasePort: base, PortRange: count, Agents: agents})
+}
+
 // GetURL returns the URL to access the agent for a VM
 // When TLS is enabled, returns subdomain-based HTTPS URL to avoid WebSocket bugs
 func (h *AgentHandler) GetURL(w http.ResponseWriter, r *http.Request) {
 	vmName := chi.URLParam(r, "name")
 	if vmName == "" {
-		http.Error(w, "VM name required", http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "VM name required")
 		return
 	}
 
 	// Verify VM exists and is running
 	if err := h.am.VerifyVM(vmName); err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		apiError(w, http.StatusServiceUnavailable, ErrCodeUnavailable, err.Error())
 		return
 	}
 
 	var agentURL string
 	if h.useTLS && h.domain != "" {
+		// The manager's GetURL heals on its own; the subdomain path bypasses it
+		if err := h.am.MaybeHeal(vmName); err != nil {
+			apiError(w, http.StatusServiceUnavailable, ErrCodeUnavailable, err.Error())
+			return
+		}
+
 		// Subdomain-based HTTPS URL: https://<vm>-1234.<domain>?token=xxx
 		agentURL = fmt.Sprintf("https://%s-%d.%s/?token=%s",
 			vmName, agentPort, h.domain, url.QueryEscape(h.authToken))
@@ -55,7 +80,7 @@ func (h *AgentHandler) GetURL(w http.ResponseWriter, r *http.Request) {
 		var err error
 		agentURL, err = h.am.GetURL(vmName, r.Host)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			apiError(w, http.StatusServiceUnavailable, ErrCodeUnavailable, err.Error())
 			return
 		}
 	}
@@ -65,3 +90,17 @@ func (h *AgentHandler) GetURL(w http.ResponseWriter, r *http.Request) {
 		"url": agentURL,
 	})
 }
+
+// Status reports whether the opencode service is active and its port is open
+// GET /api/vms/{name}/agent-status
+func (h *AgentHandler) Status(w http.ResponseWriter, r *http.Request) {
+	vmName := chi.URLParam(r, "name")
+
+	status, err := h.am.Status(vmName)
+	if err != nil {
+		apiError(w, http.StatusServiceUnavailable, ErrCodeUnavailable, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/agent"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAgentStatusRequest(vmName string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/"+vmName+"/agent-status", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", vmName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestAgentHandler_Status(t *testing.T) {
+	tests := []struct {
+		name          string
+		execOut       string
+		execErr       error
+		serviceActive bool
+	}{
+		{"service_active", "active\n", nil, true},
+		{"service_inactive", "inactive\n", errors.New("exit status 3"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockMP := new(testutil.MockMultipassClient)
+			// 192.0.2.0/24 is reserved for documentation, so the port check fails fast
+			mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.0.2.1"), nil)
+			mockMP.On("Exec", "test-vm", []string{"systemctl", "is-active", "dabbi-opencode.service"}).
+				Return(tt.execOut, tt.execErr)
+
+			handler := NewAgentHandler(agent.NewManager(mockMP), "", "token", false)
+			rec := httptest.NewRecorder()
+			handler.Status(rec, newAgentStatusRequest("test-vm"))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+
+			var status agent.Status
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&status))
+			assert.Equal(t, tt.serviceActive, status.ServiceActive)
+			assert.False(t, status.PortOpen)
+			mockMP.AssertExpectations(t)
+		})
+	}
+}
+
+func TestAgentHandler_Status_VMNotRunning(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "stopped-vm").Return(testutil.StoppedVM("stopped-vm"), nil)
+
+	handler := NewAgentHandler(agent.NewManager(mockMP), "", "token", false)
+	rec := httptest.NewRecorder()
+	handler.Status(rec, newAgentStatusRequest("stopped-vm"))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrCodeUnavailable)
+	mockMP.AssertNotCalled(t, "Exec")
+}
+
+func TestAgentHandler_List(t *testing.T) {
+	am := agent.NewManager(new(testutil.MockMultipassClient))
+	require.NoError(t, am.SetPortRange(20000, 100))
+	handler := NewAgentHandler(am, "", "token", false)
+
+	rec := httptest.NewRecorder()
+	handler.List(rec, httptest.NewRequest(http.MethodGet, "/api/agents", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp AgentsResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, 20000, resp.BasePort)
+	assert.Equal(t, 100, resp.PortRange)
+	assert.NotNil(t, resp.Agents)
+	assert.Empty(t, resp.Agents)
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mjshashank/dabbi/internal/audit"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditHandler serves the audit log
+type AuditHandler struct {
+	log *audit.Log
+}
+
+// NewAuditHandler creates a new audit handler
+func NewAuditHandler(log *audit.Log) *AuditHandler {
+	return &AuditHandler{log: log}
+}
+
+// List returns the most recent audit entries, newest first
+// GET /api/audit?limit=100
+func (h *AuditHandler) List(w http.ResponseWriter, r *http.Request) {
+	limit := defaultAuditLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxAuditLimit)
+	}
+
+	entries, err := h.log.Recent(limit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/audit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditHandler_List(t *testing.T) {
+	al := audit.NewLog(filepath.Join(t.TempDir(), "audit.log"))
+	for i := 0; i < 5; i++ {
+		require.NoError(t, al.Append(audit.Entry{
+			Source: audit.SourceCLI,
+			Action: "stop",
+			VM:     fmt.Sprintf("vm%d", i),
+			Result: audit.ResultOK,
+		}))
+	}
+	handler := NewAuditHandler(al)
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedLen    int
+	}{
+		{"default_limit", "", http.StatusOK, 5},
+		{"limit", "?limit=2", http.StatusOK, 2},
+		{"zero_limit", "?limit=0", http.StatusBadRequest, 0},
+		{"bad_limit", "?limit=abc", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/audit"+tt.query, nil)
+			rec := httptest.NewRecorder()
+
+			handler.List(rec, req)
+
+			require.Equal(t, tt.expectedStatus, rec.Code)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			var entries []audit.Entry
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&entries))
+			require.Len(t, entries, tt.expectedLen)
+			assert.Equal(t, "vm4", entries[0].VM)
+		})
+	}
+}
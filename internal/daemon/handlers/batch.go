@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/daemon/mw"
+	"github.com/mjshashank/dabbi/internal/httpkit"
+)
+
+const (
+	// maxBatchRequests caps the sub-requests in one batch
+	maxBatchRequests = 50
+
+	// batchParallel is how many sub-requests run at once
+	batchParallel = 4
+
+	// maxBatchResponseBytes caps each sub-request's buffered response
+	maxBatchResponseBytes = 1 << 20
+)
+
+// BatchHandler runs several API reads in one round trip, for clients (the
+// UI) on high-latency links
+type BatchHandler struct {
+	router http.Handler
+}
+
+// NewBatchHandler creates a batch handler that dispatches sub-requests to
+// router, the daemon's full router, so each one gets the same middleware,
+// auth, and handlers as if it had been sent on its own
+func NewBatchHandler(router http.Handler) *BatchHandler {
+	return &BatchHandler{router: router}
+}
+
+// BatchRequest is one sub-request. Path is an API path, query included,
+// e.g. "/api/vms?activity=true".
+type BatchRequest struct {
+	Method string `json:"method,omitempty"` // only GET (the default)
+	Path   string `json:"path"`
+}
+
+// BatchResult is a sub-request's response. Body is the JSON the route
+// returned, or a string for responses that aren't JSON.
+type BatchResult struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// Run executes the sub-requests in the body (a JSON array) and returns
+// their results in the same order. Only GETs are allowed: batches save
+// round trips for dashboards, and reads can run in parallel without one
+// failure leaving the rest half-applied. Long-running routes (streams,
+// downloads) are refused by mw.NoDeadline, and responses over
+// maxBatchResponseBytes aren't kept. A failed sub-request is reported in
+// its result rather than failing the batch.
+// POST /api/batch
+func (h *BatchHandler) Run(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	if mw.InBatch(r) {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "batches can't be nested")
+		return
+	}
+
+	var reqs []BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if len(reqs) == 0 {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "batch is empty")
+		return
+	}
+	if len(reqs) > maxBatchRequests {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest,
+			fmt.Sprintf("batch has %d requests, the limit is %d", len(reqs), maxBatchRequests))
+		return
+	}
+
+	// Check everything first, so a bad entry doesn't run half the batch
+	targets := make([]*url.URL, len(reqs))
+	for i, req := range reqs {
+		target, err := batchTarget(req)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("request %d: %v", i, err))
+			return
+		}
+		targets[i] = target
+	}
+
+	// Sub-requests are routed from scratch, so they mustn't inherit the
+	// batch's chi routing context
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, (*chi.Context)(nil))
+	ctx = mw.WithBatch(ctx)
+	results := make([]BatchResult, len(reqs))
+	slots := make(chan struct{}, batchParallel)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, target *url.URL) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			results[i] = h.dispatch(ctx, r, i, target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	respondJSON(w, http.StatusOK, results)
+}
+
+// batchTarget validates a sub-request and returns its URL
+func batchTarget(req BatchRequest) (*url.URL, error) {
+	if req.Method != "" && !strings.EqualFold(req.Method, http.MethodGet) {
+		return nil, fmt.Errorf("method %s is not allowed, batches only run GET requests", req.Method)
+	}
+	target, err := url.Parse(req.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path: %w", err)
+	}
+	if target.Scheme != "" || target.Host != "" || !strings.HasPrefix(target.Path, "/api/") {
+		return nil, fmt.Errorf("path must be an API path starting with /api/, got %q", req.Path)
+	}
+	if path.Clean(target.Path) == "/api/batch" {
+		return nil, fmt.Errorf("batches can't be nested")
+	}
+	return target, nil
+}
+
+// dispatch runs one sub-request through the router with the batch's
+// credentials and caller address
+func (h *BatchHandler) dispatch(ctx context.Context, parent *http.Request, i int, target *url.URL) BatchResult {
+	sub, err := http.NewRequestWithContext(ctx, http.MethodGet, target.RequestURI(), nil)
+	if err != nil {
+		return BatchResult{Status: http.StatusBadRequest}
+	}
+	sub.RequestURI = target.RequestURI()
+	sub.Host = parent.Host
+	sub.RemoteAddr = parent.RemoteAddr
+	sub.Header = parent.Header.Clone()
+	sub.Header.Del("Content-Type")
+	sub.Header.Del("Content-Length")
+	// Each sub-request logs under its own ID, traceable to the batch's
+	if id := httpkit.GetRequestID(parent); id != "" {
+		sub.Header.Set(httpkit.RequestIDHeader, id+"-"+strconv.Itoa(i))
+	}
+
+	rec := &cappedRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.router.ServeHTTP(rec, sub)
+	if rec.overflow {
+		body, _ := json.Marshal(errorResponse{Error: APIError{
+			Code:    ErrCodeInvalidRequest,
+			Message: fmt.Sprintf("response is over the %d MiB a batch keeps, request it on its own", maxBatchResponseBytes>>20),
+		}})
+		return BatchResult{Status: http.StatusRequestEntityTooLarge, Body: body}
+	}
+
+	result := BatchResult{Status: rec.Code}
+	body := rec.Body.Bytes()
+	switch {
+	case len(body) == 0:
+	case strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") && json.Valid(body):
+		result.Body = body
+	default:
+		result.Body, _ = json.Marshal(string(body))
+	}
+	return result
+}
+
+// errBatchResponseTooLarge fails writes past maxBatchResponseBytes, so the
+// handler stops producing a response that won't be kept
+var errBatchResponseTooLarge = errors.New("response too large to batch")
+
+// cappedRecorder buffers a sub-request's response up to maxBatchResponseBytes
+type cappedRecorder struct {
+	*httptest.ResponseRecorder
+	overflow bool
+}
+
+func (c *cappedRecorder) Write(b []byte) (int, error) {
+	if c.overflow || c.Body.Len()+len(b) > maxBatchResponseBytes {
+		c.overflow = true
+		return 0, errBatchResponseTooLarge
+	}
+	return c.ResponseRecorder.Write(b)
+}
+
+func (c *cappedRecorder) WriteString(str string) (int, error) {
+	return c.Write([]byte(str))
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/daemon/mw"
+	"github.com/mjshashank/dabbi/internal/httpkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const batchTestToken = "secret"
+
+// newBatchRouter wires a batch handler into a router the way the daemon
+// does, with a few stand-in API routes
+func newBatchRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Use(httpkit.RequestID)
+
+	batch := NewBatchHandler(r)
+	r.With(mw.BearerAuth(batchTestToken, nil)).HandleFunc("/api/batch", batch.Run)
+
+	r.Route("/api", func(r chi.Router) {
+		r.Use(mw.BearerAuth(batchTestToken, nil))
+		r.Get("/vms", func(w http.ResponseWriter, r *http.Request) {
+			respondJSON(w, http.StatusOK, []string{"vm1", "vm2"})
+		})
+		r.Get("/vms/{name}", func(w http.ResponseWriter, r *http.Request) {
+			name := chi.URLParam(r, "name")
+			if name == "missing" {
+				apiError(w, http.StatusNotFound, ErrCodeVMNotFound, "VM not found")
+				return
+			}
+			respondJSON(w, http.StatusOK, map[string]string{
+				"name":       name,
+				"activity":   r.URL.Query().Get("activity"),
+				"request_id": httpkit.GetRequestID(r),
+			})
+		})
+		r.Get("/text", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("plain"))
+		})
+		r.With(mw.NoDeadline).Get("/stream", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("streamed"))
+		})
+		r.Get("/large", func(w http.ResponseWriter, r *http.Request) {
+			chunk := []byte(strings.Repeat("x", 64<<10))
+			for i := 0; i < 2*maxBatchResponseBytes/len(chunk); i++ {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+			}
+		})
+	})
+	return r
+}
+
+func sendBatch(router http.Handler, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/batch", bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set(httpkit.RequestIDHeader, "batch-1")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBatchHandler_Run(t *testing.T) {
+	router := newBatchRouter()
+
+	rec := sendBatch(router, `[
+		{"method": "GET", "path": "/api/vms"},
+		{"path": "/api/vms/dev?activity=true"},
+		{"path": "/api/vms/missing"},
+		{"path": "/api/text"},
+		{"path": "/api/nope"}
+	]`, batchTestToken)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var results []BatchResult
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	require.Len(t, results, 5)
+
+	// Results come back in request order
+	assert.Equal(t, http.StatusOK, results[0].Status)
+	assert.JSONEq(t, `["vm1","vm2"]`, string(results[0].Body))
+
+	// Route params and queries reach the handler; the sub-request's ID
+	// points back at the batch
+	assert.Equal(t, http.StatusOK, results[1].Status)
+	var vm map[string]string
+	require.NoError(t, json.Unmarshal(results[1].Body, &vm))
+	assert.Equal(t, "dev", vm["name"])
+	assert.Equal(t, "true", vm["activity"])
+	assert.Equal(t, "batch-1-1", vm["request_id"])
+
+	// Errors are reported per sub-request
+	assert.Equal(t, http.StatusNotFound, results[2].Status)
+	assert.Contains(t, string(results[2].Body), ErrCodeVMNotFound)
+
+	// Non-JSON bodies come back as strings
+	assert.Equal(t, http.StatusOK, results[3].Status)
+	assert.JSONEq(t, `"plain"`, string(results[3].Body))
+
+	assert.Equal(t, http.StatusNotFound, results[4].Status)
+}
+
+func TestBatchHandler_LongRunningAndLarge(t *testing.T) {
+	rec := sendBatch(newBatchRouter(), `[
+		{"path": "/api/stream"},
+		{"path": "/api/large"},
+		{"path": "/api/vms"}
+	]`, batchTestToken)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var results []BatchResult
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&results))
+	require.Len(t, results, 3)
+
+	// Routes that lift the request deadline are refused
+	assert.Equal(t, http.StatusBadRequest, results[0].Status)
+	assert.Contains(t, string(results[0].Body), "can't be batched")
+
+	// Oversized responses are dropped rather than buffered
+	assert.Equal(t, http.StatusRequestEntityTooLarge, results[1].Status)
+	assert.Contains(t, string(results[1].Body), "on its own")
+	assert.Less(t, len(rec.Body.Bytes()), maxBatchResponseBytes)
+
+	// Neither affects the rest of the batch
+	assert.Equal(t, http.StatusOK, results[2].Status)
+}
+
+func TestBatchHandler_RequiresAuth(t *testing.T) {
+	rec := sendBatch(newBatchRouter(), `[{"path": "/api/vms"}]`, "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestBatchHandler_InvalidRequest(t *testing.T) {
+	tooMany := make([]string, maxBatchRequests+1)
+	for i := range tooMany {
+		tooMany[i] = `{"path": "/api/vms"}`
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"invalid_json", `{`, ""},
+		{"not_an_array", `{"path": "/api/vms"}`, ""},
+		{"empty", `[]`, "empty"},
+		{"too_many", "[" + strings.Join(tooMany, ",") + "]", fmt.Sprintf("limit is %d", maxBatchRequests)},
+		{"write_method", `[{"path": "/api/vms"}, {"method": "DELETE", "path": "/api/vms/dev"}]`, "request 1"},
+		{"not_api", `[{"path": "/health"}]`, "/api/"},
+		{"absolute_url", `[{"path": "http://example.com/api/vms"}]`, "/api/"},
+		{"nested", `[{"path": "/api/batch"}]`, "nested"},
+		{"nested_unclean", `[{"path": "/api/./batch/"}]`, "nested"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := sendBatch(newBatchRouter(), tt.body, batchTestToken)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+			var resp errorResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, ErrCodeInvalidRequest, resp.Error.Code)
+			assert.Contains(t, resp.Error.Message, tt.want)
+		})
+	}
+}
+
+func TestBatchHandler_MethodNotAllowed(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/batch", nil)
+	req.Header.Set("Authorization", "Bearer "+batchTestToken)
+	rec := httptest.NewRecorder()
+	newBatchRouter().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
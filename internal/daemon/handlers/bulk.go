@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/mjshashank/dabbi/internal/agent"
+	"github.com/mjshashank/dabbi/internal/audit"
+	"github.com/mjshashank/dabbi/internal/bulk"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/tunnel"
+)
+
+// BulkHandler starts or stops many VMs at once
+type BulkHandler struct {
+	mp      multipass.Client
+	labels  *labels.Store
+	tunnels *tunnel.Manager
+	agents  *agent.Manager
+}
+
+// NewBulkHandler creates a new bulk handler
+func NewBulkHandler(mp multipass.Client, ls *labels.Store, tm *tunnel.Manager, am *agent.Manager) *BulkHandler {
+	return &BulkHandler{mp: mp, labels: ls, tunnels: tm, agents: am}
+}
+
+// BulkRequest selects VMs to start or stop. Either names or all is required.
+type BulkRequest struct {
+	Action        string   `json:"action"` // "start" or "stop"
+	Names         []string `json:"names,omitempty"`
+	All           bool     `json:"all,omitempty"`
+	SkipUserStops bool     `json:"skip_user_stops,omitempty"` // start: skip VMs stopped on purpose
+	Parallel      int      `json:"parallel,omitempty"`        // VMs acted on at once (default 4)
+}
+
+// BulkResponse reports what happened to each selected VM
+type BulkResponse struct {
+	Results []bulk.Result `json:"results"`
+}
+
+// Run starts or stops the selected VMs. Failures for individual VMs are
+// reported in the results rather than failing the request.
+// POST /api/vms/bulk
+func (h *BulkHandler) Run(w http.ResponseWriter, r *http.Request) {
+	var req BulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	action, err := bulk.ParseAction(req.Action)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if req.All == (len(req.Names) > 0) {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "specify either names or all")
+		return
+	}
+	if req.Parallel < 0 {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "parallel cannot be negative")
+		return
+	}
+	audit.SetDetail(r.Context(), req.Action)
+
+	results, err := bulk.Run(h.mp, h.labels, action, bulk.Options{
+		Names:         req.Names,
+		SkipUserStops: req.SkipUserStops,
+		Parallel:      req.Parallel,
+	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	if action == bulk.ActionStop {
+		for _, res := range results {
+			if res.Status == bulk.StatusOK {
+				CloseListeners(h.tunnels, h.agents, res.Name)
+			}
+		}
+	}
+
+	respondJSON(w, http.StatusOK, BulkResponse{Results: results})
+}
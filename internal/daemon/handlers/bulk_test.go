@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/bulk"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkHandler_Run(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	ls := newTestLabelStore(t)
+	require.NoError(t, ls.Mark("kept", labels.StoppedByUserKey))
+	handler := NewBulkHandler(mockMP, ls, nil, nil)
+
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "web", State: multipass.StateRunning},
+		{Name: "db", State: multipass.StateStopped},
+		{Name: "kept", State: multipass.StateStopped},
+	}, nil)
+	mockMP.On("Start", "db").Return(nil)
+
+	body := `{"action": "start", "all": true, "skip_user_stops": true}`
+	rec := httptest.NewRecorder()
+	handler.Run(rec, httptest.NewRequest(http.MethodPost, "/api/vms/bulk", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp BulkResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, []bulk.Result{
+		{Name: "db", Status: bulk.StatusOK},
+		{Name: "kept", Status: bulk.StatusSkipped, Detail: "stopped by user"},
+		{Name: "web", Status: bulk.StatusSkipped, Detail: "running"},
+	}, resp.Results)
+	mockMP.AssertExpectations(t)
+}
+
+func TestBulkHandler_Run_Invalid(t *testing.T) {
+	handler := NewBulkHandler(new(testutil.MockMultipassClient), newTestLabelStore(t), nil, nil)
+
+	for _, body := range []string{
+		`not json`,
+		`{"action": "restart", "all": true}`,
+		`{"action": "stop"}`,
+		`{"action": "stop", "all": true, "names": ["web"]}`,
+		`{"action": "stop", "all": true, "parallel": -1}`,
+	} {
+		rec := httptest.NewRecorder()
+		handler.Run(rec, httptest.NewRequest(http.MethodPost, "/api/vms/bulk", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+}
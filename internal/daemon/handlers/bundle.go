@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// BundleVersion is the VMBundle format written by Export. Import rejects
+// bundles with any other version.
+const BundleVersion = 1
+
+// releasePattern matches Ubuntu releases multipass can launch by number
+var releasePattern = regexp.MustCompile(`^\d+\.\d+$`)
+
+// VMBundle is a reproducible description of a VM's dabbi setup: resources,
+// network restrictions, mounts, and labels. It does not include disk contents.
+type VMBundle struct {
+	Version int                      `json:"version"`
+	Name    string                   `json:"name"`
+	CPUs    int                      `json:"cpu,omitempty"`
+	Memory  string                   `json:"mem,omitempty"`   // rounded up to whole GiB, e.g. "4G"
+	Disk    string                   `json:"disk,omitempty"`  // rounded up to whole GiB
+	Image   string                   `json:"image,omitempty"` // Ubuntu release, e.g. "24.04"; custom images aren't exported
+	Network *multipass.NetworkConfig `json:"network,omitempty"`
+	Mounts  []MountEntry             `json:"mounts,omitempty"`
+	Labels  map[string]string        `json:"labels,omitempty"` // without reserved dabbi/ labels
+}
+
+// ImportResponse reports an imported VM. Mounts that couldn't be recreated
+// (e.g. the host path doesn't exist here) are listed by VM path in Failed.
+type ImportResponse struct {
+	Status string            `json:"status"`
+	Name   string            `json:"name"`
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Export returns a VM's setup as a VMBundle
+// GET /api/vms/{name}/export
+func (h *VMHandler) Export(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	info, err := h.mp.InfoContext(r.Context(), name)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
+		return
+	}
+	// Stopped VMs report no resources, and network config lives inside the VM
+	if !requireExecState(w, name, info, "VM must be running to export it") {
+		return
+	}
+
+	netConfig, err := h.applier.GetCurrentConfig(name)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	if netConfig != nil && netConfig.Mode == multipass.NetworkModeNone {
+		netConfig = nil
+	}
+
+	vmLabels, err := h.labels.Get(name)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	// Reserved labels are dabbi's state for this VM (and Import rejects them)
+	for k := range vmLabels {
+		if labels.IsReserved(k) {
+			delete(vmLabels, k)
+		}
+	}
+
+	var diskBytes int64
+	for _, d := range info.Disks {
+		diskBytes += d.TotalBytes()
+	}
+
+	recorded, err := h.mounts.List(name)
+	if err != nil {
+		log.Printf("Warning: failed to read recorded mounts for VM %s: %v", name, err)
+	}
+
+	respondJSON(w, http.StatusOK, VMBundle{
+		Version: BundleVersion,
+		Name:    name,
+		CPUs:    info.CPUs(),
+		Memory:  wholeGiB(info.Memory.Total),
+		Disk:    wholeGiB(diskBytes),
+		Image:   releaseImage(info.ImageRelease),
+		Network: netConfig,
+		Mounts:  mountEntries(info, recorded),
+		Labels:  vmLabels,
+	})
+}
+
+// Import creates a VM from a VMBundle, then recreates its mounts and labels.
+// ?name= overrides the bundle's VM name.
+// POST /api/vms/import
+func (h *VMHandler) Import(w http.ResponseWriter, r *http.Request) {
+	var bundle VMBundle
+	if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if bundle.Version != BundleVersion {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest,
+			fmt.Sprintf("unsupported bundle version %d (expected %d)", bundle.Version, BundleVersion))
+		return
+	}
+	if name := r.URL.Query().Get("name"); name != "" {
+		bundle.Name = name
+	}
+	if err := multipass.ValidateVMName(bundle.Name); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if err := labels.Validate(bundle.Labels); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	for _, m := range bundle.Mounts {
+		if m.HostPath == "" || m.VMPath == "" {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "mounts need host_path and vm_path")
+			return
+		}
+		if err := multipass.ValidateMount(m.options()); err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+
+	req := CreateVMRequest{
+		Name:    bundle.Name,
+		CPUs:    bundle.CPUs,
+		Memory:  bundle.Memory,
+		Disk:    bundle.Disk,
+		Image:   bundle.Image,
+		Network: bundle.Network,
+	}
+	modifiedContent, netConfig, ok := h.prepareCreate(w, &req)
+	if !ok || !h.checkLimits(w, req) {
+		return
+	}
+
+	launchFile, err := h.cfg.WriteLaunchFile(req.Name, modifiedContent)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	err = h.mp.Launch(multipass.LaunchOptions{
+		Name:          req.Name,
+		CPUs:          req.CPUs,
+		Memory:        req.Memory,
+		Disk:          req.Disk,
+		CloudInit:     launchFile.Path,
+		Image:         req.Image,
+		NetworkConfig: netConfig,
+	})
+	releaseLaunchFile(launchFile)
+	if err != nil {
+		launchError(w, err)
+		return
+	}
+	h.recordLaunch(req, modifiedContent)
+
+	if len(bundle.Labels) > 0 {
+		if err := h.labels.Replace(req.Name, bundle.Labels); err != nil {
+			apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+	}
+
+	resp := ImportResponse{Status: "created", Name: req.Name}
+	for _, m := range bundle.Mounts {
+		opts := m.options()
+		if err := h.mp.Mount(req.Name, opts); err != nil {
+			if resp.Failed == nil {
+				resp.Failed = make(map[string]string)
+			}
+			resp.Failed[m.VMPath] = err.Error()
+			continue
+		}
+		recordMount(h.mounts, req.Name, opts)
+	}
+
+	respondJSON(w, http.StatusCreated, resp)
+}
+
+// wholeGiB renders a byte count as a multipass size rounded up to whole GiB.
+// VMs report slightly less memory and disk than they were launched with.
+func wholeGiB(b int64) string {
+	if b <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%dG", (b+(1<<30)-1)>>30)
+}
+
+// releaseImage turns an image release such as "24.04 LTS" into the image
+// name multipass launches it by, or "" if it isn't a numbered release
+func releaseImage(release string) string {
+	fields := strings.Fields(release)
+	if len(fields) == 0 || !releasePattern.MatchString(fields[0]) {
+		return ""
+	}
+	return fields[0]
+}
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/mounts"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVMHandler_Export(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+
+	info := testutil.RunningVM("test-vm", "192.168.64.5")
+	info.Memory.Total = 4*(1<<30) - 200<<20 // guests see a bit less than they were given
+	info.Mounts = map[string]multipass.Mount{
+		"/home/ubuntu/src":  {SourcePath: "/Users/me/src"},
+		"/home/ubuntu/data": {SourcePath: "/Users/me/data"},
+	}
+	mockMP.On("Info", "test-vm").Return(info, nil)
+	mockMP.MockNetworkConfig("test-vm", `{"mode":"allowlist","rules":[{"type":"domain","value":"github.com"}]}`)
+	require.NoError(t, handler.labels.Set("test-vm", map[string]string{"project": "demo"}))
+	require.NoError(t, handler.labels.Mark("test-vm", labels.PinnedKey))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/test-vm/export", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "test-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+
+	handler.Export(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var bundle VMBundle
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&bundle))
+	assert.Equal(t, BundleVersion, bundle.Version)
+	assert.Equal(t, "test-vm", bundle.Name)
+	assert.Equal(t, 2, bundle.CPUs)
+	assert.Equal(t, "4G", bundle.Memory)
+	assert.Equal(t, "20G", bundle.Disk)
+	assert.Equal(t, "24.04", bundle.Image)
+	require.NotNil(t, bundle.Network)
+	assert.Equal(t, multipass.NetworkModeAllowlist, bundle.Network.Mode)
+	assert.Equal(t, []MountEntry{
+		{HostPath: "/Users/me/data", VMPath: "/home/ubuntu/data"},
+		{HostPath: "/Users/me/src", VMPath: "/home/ubuntu/src"},
+	}, bundle.Mounts)
+	assert.Equal(t, map[string]string{"project": "demo"}, bundle.Labels)
+}
+
+func TestVMHandler_Export_Stopped(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Info", "test-vm").Return(testutil.StoppedVM("test-vm"), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/test-vm/export", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "test-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+
+	handler.Export(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var resp errorResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, ErrCodeVMNotRunning, resp.Error.Code)
+	mockMP.AssertNotCalled(t, "Exec", mock.Anything, mock.Anything)
+}
+
+func TestVMHandler_Import(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+
+	bundle := VMBundle{
+		Version: BundleVersion,
+		Name:    "original",
+		CPUs:    4,
+		Memory:  "8G",
+		Disk:    "40G",
+		Image:   "24.04",
+		Network: &multipass.NetworkConfig{
+			Mode:  multipass.NetworkModeAllowlist,
+			Rules: []multipass.NetworkRule{{Type: "domain", Value: "github.com"}},
+		},
+		Mounts: []MountEntry{
+			{HostPath: "/Users/me/src", VMPath: "/home/ubuntu/src"},
+			{HostPath: "/missing", VMPath: "/home/ubuntu/missing"},
+		},
+		Labels: map[string]string{"project": "demo"},
+	}
+
+	mockMP.On("Launch", mock.MatchedBy(func(opts multipass.LaunchOptions) bool {
+		return opts.Name == "copy" && opts.CPUs == 4 && opts.Memory == "8G" &&
+			opts.Disk == "40G" && opts.Image == "24.04" && opts.NetworkConfig != nil
+	})).Return(nil)
+	mockMP.On("Mount", "copy", multipass.MountOptions{HostPath: "/Users/me/src", VMPath: "/home/ubuntu/src"}).Return(nil)
+	mockMP.On("Mount", "copy", multipass.MountOptions{HostPath: "/missing", VMPath: "/home/ubuntu/missing"}).Return(errors.New("source path does not exist"))
+
+	body, err := json.Marshal(bundle)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/import?name=copy", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	handler.Import(rec, req)
+
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var resp ImportResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "copy", resp.Name)
+	assert.Contains(t, resp.Failed["/home/ubuntu/missing"], "does not exist")
+	assert.NotContains(t, resp.Failed, "/home/ubuntu/src")
+
+	vmLabels, err := handler.labels.Get("copy")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"project": "demo"}, vmLabels)
+
+	// Only the mount that succeeded is recorded
+	recorded, err := handler.mounts.List("copy")
+	require.NoError(t, err)
+	assert.Equal(t, []mounts.Entry{{HostPath: "/Users/me/src", VMPath: "/home/ubuntu/src"}}, recorded)
+	mockMP.AssertExpectations(t)
+}
+
+func TestVMHandler_Import_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		bundle  VMBundle
+		wantMsg string
+	}{
+		{"unknown_version", VMBundle{Version: 99, Name: "vm"}, "unsupported bundle version 99"},
+		{"missing_name", VMBundle{Version: BundleVersion}, "name is required"},
+		{"bad_label", VMBundle{Version: BundleVersion, Name: "vm", Labels: map[string]string{"bad key": "x"}}, "invalid label key"},
+		{"reserved_label", VMBundle{Version: BundleVersion, Name: "vm", Labels: map[string]string{"dabbi/pinned": "true"}}, "reserved"},
+		{"bad_mount", VMBundle{Version: BundleVersion, Name: "vm", Mounts: []MountEntry{{VMPath: "/mnt"}}}, "host_path and vm_path"},
+		{"bad_mount_uid_map", VMBundle{Version: BundleVersion, Name: "vm", Mounts: []MountEntry{{HostPath: "/src", VMPath: "/mnt", UIDMaps: []string{"me:ubuntu"}}}}, "invalid id mapping"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockMP := setupVMHandler(t)
+
+			body, err := json.Marshal(tt.bundle)
+			require.NoError(t, err)
+			req := httptest.NewRequest(http.MethodPost, "/api/vms/import", bytes.NewReader(body))
+			rec := httptest.NewRecorder()
+
+			handler.Import(rec, req)
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			var resp errorResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Contains(t, resp.Error.Message, tt.wantMsg)
+			mockMP.AssertNotCalled(t, "Launch", mock.Anything)
+		})
+	}
+}
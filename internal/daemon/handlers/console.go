@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/console"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// consolePollInterval is how often a followed console log is re-read
+const consolePollInterval = 2 * time.Second
+
+// ConsoleHandler serves VM boot/console logs
+type ConsoleHandler struct {
+	mp     multipass.Client
+	reader *console.Reader
+	poll   time.Duration
+}
+
+// NewConsoleHandler creates a console handler. hostPath is the host-side
+// log used when a VM can't run dmesg (see console.NewReader).
+func NewConsoleHandler(mp multipass.Client, hostPath string) *ConsoleHandler {
+	return &ConsoleHandler{mp: mp, reader: console.NewReader(mp, hostPath), poll: consolePollInterval}
+}
+
+// Get returns the end of a VM's console log: its kernel log while it can
+// run commands, else the host-side multipass log. The second is what shows
+// why a VM that is running has no IPv4 address. ?lines= sets how many
+// lines (default 200). With ?follow=true, the log is streamed as plain
+// text until the client disconnects.
+// GET /api/vms/{name}/console
+func (h *ConsoleHandler) Get(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	lines := 0
+	if s := r.URL.Query().Get("lines"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "lines must be a non-negative number")
+			return
+		}
+		lines = n
+	}
+
+	info, err := h.mp.InfoContext(r.Context(), name)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
+		return
+	}
+	log, err := h.reader.Read(name, info, lines)
+	if err != nil {
+		consoleError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("follow") != "true" {
+		respondJSON(w, http.StatusOK, log)
+		return
+	}
+	h.follow(w, r, name, lines, log)
+}
+
+// follow writes log, then new lines as they appear. Errors while
+// following (the VM was deleted, say) end the stream.
+func (h *ConsoleHandler) follow(w http.ResponseWriter, r *http.Request, name string, lines int, log *console.Log) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	prev := log
+	write := func(lines []string) error {
+		for _, l := range lines {
+			if _, err := fmt.Fprintln(w, l); err != nil {
+				return err
+			}
+		}
+		return rc.Flush()
+	}
+	if write(log.Lines) != nil {
+		return
+	}
+
+	ticker := time.NewTicker(h.poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := h.mp.InfoContext(r.Context(), name)
+		if err != nil {
+			return
+		}
+		cur, err := h.reader.Read(name, info, lines)
+		if err != nil {
+			continue // e.g. rebooting between dmesg and the host log
+		}
+		fresh := console.NewLines(prev.Lines, cur.Lines)
+		if cur.Source != prev.Source {
+			fresh = append([]string{fmt.Sprintf("--- reading %s ---", cur.Source)}, cur.Lines...)
+		}
+		if write(fresh) != nil {
+			return
+		}
+		prev = cur
+	}
+}
+
+// consoleError maps a console read failure to a response
+func consoleError(w http.ResponseWriter, err error) {
+	if errors.Is(err, console.ErrUnavailable) {
+		apiError(w, http.StatusServiceUnavailable, ErrCodeUnavailable, err.Error())
+		return
+	}
+	apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+}
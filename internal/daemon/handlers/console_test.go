@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/console"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newConsoleRequest(vmName, query string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/"+vmName+"/console"+query, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", vmName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestConsoleHandler_Get(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "dev").Return(testutil.RunningVM("dev", "192.168.64.2"), nil)
+	mockMP.On("Exec", "dev", []string{"sudo", "dmesg"}).Return("one\ntwo\nthree\n", nil)
+
+	rec := httptest.NewRecorder()
+	NewConsoleHandler(mockMP, "").Get(rec, newConsoleRequest("dev", "?lines=2"))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var log console.Log
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&log))
+	assert.Equal(t, "dev", log.VM)
+	assert.Equal(t, console.SourceDmesg, log.Source)
+	assert.Equal(t, []string{"two", "three"}, log.Lines)
+}
+
+func TestConsoleHandler_Errors(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "missing").Return(nil, errors.New("instance \"missing\" does not exist"))
+	mockMP.On("Info", "stuck").Return(&multipass.InstanceInfo{State: multipass.StateRunning}, nil)
+	handler := NewConsoleHandler(mockMP, "/nonexistent/{vm}.log")
+
+	tests := []struct {
+		name     string
+		vm       string
+		query    string
+		wantCode int
+		wantErr  string
+	}{
+		{"bad_lines", "dev", "?lines=many", http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"not_found", "missing", "", http.StatusNotFound, ErrCodeVMNotFound},
+		{"no_log", "stuck", "", http.StatusServiceUnavailable, ErrCodeUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.Get(rec, newConsoleRequest(tt.vm, tt.query))
+			assert.Equal(t, tt.wantCode, rec.Code)
+
+			var resp errorResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, tt.wantErr, resp.Error.Code)
+		})
+	}
+}
+
+func TestConsoleHandler_Follow(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "dev").Return(testutil.RunningVM("dev", "192.168.64.2"), nil)
+	mockMP.On("Exec", "dev", []string{"sudo", "dmesg"}).Return("one\ntwo\n", nil).Once()
+	mockMP.On("Exec", "dev", []string{"sudo", "dmesg"}).Return("one\ntwo\nthree\n", nil)
+
+	handler := NewConsoleHandler(mockMP, "")
+	handler.poll = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := newConsoleRequest("dev", "?follow=true")
+	req = req.WithContext(context.WithValue(ctx, chi.RouteCtxKey, chi.RouteContext(req.Context())))
+	rec := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		handler.Get(rec, req)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+	// Lines already sent aren't repeated
+	assert.Equal(t, "one\ntwo\nthree\n", rec.Body.String())
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/httpkit"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// Error codes returned in API error responses so clients can branch on
+// the kind of failure instead of matching message text
+const (
+	ErrCodeInvalidRequest = "INVALID_REQUEST"  // malformed body or missing/invalid parameters
+	ErrCodeInvalidConfig  = "INVALID_CONFIG"   // rejected network or watchdog configuration
+	ErrCodeVMNotFound     = "VM_NOT_FOUND"     // VM does not exist or could not be queried
+	ErrCodeVMNotRunning   = "VM_NOT_RUNNING"   // operation requires a running VM
+	ErrCodeVMNotStopped   = "VM_NOT_STOPPED"   // operation requires a stopped VM
+	ErrCodeNotFound       = "NOT_FOUND"        // other resource (tunnel, config) not found
+	ErrCodeUploadTooLarge = "UPLOAD_TOO_LARGE" // upload exceeded the configured body limit
+	ErrCodeUnavailable    = "UNAVAILABLE"      // dependent service inside the VM is not reachable
+	ErrCodeVMExists       = "VM_EXISTS"        // a VM with the requested name already exists
+	ErrCodeNoResources    = "NO_RESOURCES"     // host is out of disk space or memory
+	ErrCodeImageFailed    = "IMAGE_FAILED"     // image couldn't be found or downloaded
+	ErrCodeLimitExceeded  = "LIMIT_EXCEEDED"   // a new VM would exceed the host's configured limits
+	ErrCodeInternal       = "INTERNAL_ERROR"   // multipass or host-side failure
+)
+
+// APIError is the body of every API error response:
+// {"error": {"code": "VM_NOT_FOUND", "message": "..."}}
+type APIError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Hint      string `json:"hint,omitempty"`       // what the user can do about it, when known
+	RequestID string `json:"request_id,omitempty"` // matches the daemon's log line for the request
+}
+
+type errorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// apiError writes a structured JSON error response
+func apiError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, status, APIError{Code: code, Message: message})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, e APIError) {
+	// httpkit.RequestID has already set the response header
+	e.RequestID = w.Header().Get(httpkit.RequestIDHeader)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: e})
+}
+
+// launchError writes the response for a failed launch. Failures multipass
+// reports in a recognizable way get a specific status and a hint.
+func launchError(w http.ResponseWriter, err error) {
+	e := APIError{Code: ErrCodeInternal, Message: err.Error()}
+	status := http.StatusInternalServerError
+
+	var mpErr *multipass.MultipassError
+	if errors.As(err, &mpErr) {
+		f := mpErr.Classify()
+		e.Hint = f.Suggestion
+		switch f.Reason {
+		case multipass.FailureAlreadyExists:
+			status, e.Code = http.StatusConflict, ErrCodeVMExists
+		case multipass.FailureDiskFull, multipass.FailureInsufficientMemory:
+			status, e.Code = http.StatusInsufficientStorage, ErrCodeNoResources
+		case multipass.FailureImageNotFound:
+			status, e.Code = http.StatusBadRequest, ErrCodeImageFailed
+		case multipass.FailureImageDownload:
+			status, e.Code = http.StatusBadGateway, ErrCodeImageFailed
+		}
+	}
+	writeAPIError(w, status, e)
+}
+
+// requireExecState writes an error and returns false unless the VM can run
+// commands. notRunning is the message for a plain stopped or suspended VM;
+// deleted and transitioning VMs get messages saying what to do instead.
+func requireExecState(w http.ResponseWriter, vmName string, info *multipass.InstanceInfo, notRunning string) bool {
+	switch {
+	case multipass.CanExec(info.State):
+		return true
+	case info.State == multipass.StateDeleted:
+		apiError(w, http.StatusConflict, ErrCodeVMNotRunning,
+			fmt.Sprintf("VM is deleted; run 'multipass recover %s' to restore it", vmName))
+	case multipass.IsTransient(info.State):
+		state := strings.ToLower(info.State)
+		if info.State == multipass.StateDelayedShutdown {
+			state = "shutting down"
+		}
+		w.Header().Set("Retry-After", "5")
+		apiError(w, http.StatusServiceUnavailable, ErrCodeVMNotRunning,
+			fmt.Sprintf("VM is %s, try again shortly", state))
+	case info.State == multipass.StateUnknown:
+		apiError(w, http.StatusServiceUnavailable, ErrCodeVMNotRunning,
+			fmt.Sprintf("VM state is unknown; check 'multipass info %s'", vmName))
+	default:
+		apiError(w, http.StatusBadRequest, ErrCodeVMNotRunning, notRunning)
+	}
+	return false
+}
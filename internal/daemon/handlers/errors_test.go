@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/httpkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIError_RequestID(t *testing.T) {
+	h := httpkit.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, "VM not found")
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/vms/missing", nil))
+
+	var resp errorResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, ErrCodeVMNotFound, resp.Error.Code)
+	assert.NotEmpty(t, resp.Error.RequestID)
+	assert.Equal(t, rec.Header().Get(httpkit.RequestIDHeader), resp.Error.RequestID)
+}
+
+func TestAPIError_NoRequestID(t *testing.T) {
+	// Without the middleware the field is left out
+	rec := httptest.NewRecorder()
+	apiError(rec, http.StatusBadRequest, ErrCodeInvalidRequest, "bad")
+	assert.NotContains(t, rec.Body.String(), "request_id")
+}
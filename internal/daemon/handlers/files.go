@@ -1,25 +1,32 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/config"
 	"github.com/mjshashank/dabbi/internal/multipass"
 )
 
+// multipartOverhead is extra body allowance for multipart boundaries and headers
+const multipartOverhead = 1 << 20
+
 // FileHandler handles file-related API requests
 type FileHandler struct {
-	mp multipass.Client
+	mp  multipass.Client
+	cfg *config.Config
 }
 
 // NewFileHandler creates a new file handler
-func NewFileHandler(mp multipass.Client) *FileHandler {
-	return &FileHandler{mp: mp}
+func NewFileHandler(mp multipass.Client, cfg *config.Config) *FileHandler {
+	return &FileHandler{mp: mp, cfg: cfg}
 }
 
 // FileEntry represents a file or directory in the browser
@@ -40,20 +47,19 @@ func (h *FileHandler) Browse(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check VM is running
-	info, err := h.mp.Info(vmName)
+	info, err := h.mp.InfoContext(r.Context(), vmName)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
-	if info.State != multipass.StateRunning {
-		http.Error(w, `{"error": "VM is not running"}`, http.StatusBadRequest)
+	if !requireExecState(w, vmName, info, "VM is not running") {
 		return
 	}
 
 	// List directory contents using exec
 	output, err := h.mp.Exec(vmName, "ls", "-la", path)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
@@ -109,30 +115,34 @@ func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	targetPath := r.URL.Query().Get("path")
 
 	if targetPath == "" {
-		http.Error(w, `{"error": "path query parameter is required"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "path query parameter is required")
 		return
 	}
 
 	// Check VM is running
-	info, err := h.mp.Info(vmName)
+	info, err := h.mp.InfoContext(r.Context(), vmName)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
-	if info.State != multipass.StateRunning {
-		http.Error(w, `{"error": "VM is not running"}`, http.StatusBadRequest)
+	if !requireExecState(w, vmName, info, "VM is not running") {
 		return
 	}
 
-	// Parse multipart form (max 100MB)
-	if err := r.ParseMultipartForm(100 << 20); err != nil {
-		respondError(w, http.StatusBadRequest, err)
+	// Cap the request body so clients can't stream unbounded data into host temp space
+	maxBytes := h.cfg.MaxUploadBytes()
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+multipartOverhead)
+
+	// Stream the multipart body instead of buffering the whole form
+	reader, err := r.MultipartReader()
+	if err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	file, err := nextFilePart(reader)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		respondUploadError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err, maxBytes)
 		return
 	}
 	defer file.Close()
@@ -140,15 +150,20 @@ func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	// Create temp file on host
 	tmpFile, err := os.CreateTemp("", "dabbi-upload-*")
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 	defer os.Remove(tmpFile.Name())
 	defer tmpFile.Close()
 
-	// Copy uploaded file to temp
-	if _, err := io.Copy(tmpFile, file); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+	// Copy uploaded file to temp with a running byte cap (one extra byte detects overflow)
+	size, err := io.Copy(tmpFile, io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		respondUploadError(w, http.StatusInternalServerError, ErrCodeInternal, err, maxBytes)
+		return
+	}
+	if size > maxBytes {
+		respondUploadError(w, http.StatusRequestEntityTooLarge, ErrCodeUploadTooLarge, &http.MaxBytesError{Limit: maxBytes}, maxBytes)
 		return
 	}
 	tmpFile.Close()
@@ -156,47 +171,75 @@ func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	// Determine full target path
 	fullPath := targetPath
 	if strings.HasSuffix(targetPath, "/") {
-		fullPath = filepath.Join(targetPath, header.Filename)
+		fullPath = filepath.Join(targetPath, file.FileName())
 	}
 
 	// Transfer to VM
 	vmPath := fmt.Sprintf("%s:%s", vmName, fullPath)
 	if err := h.mp.Transfer(tmpFile.Name(), vmPath); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]string{
+	respondJSON(w, http.StatusOK, map[string]interface{}{
 		"status": "uploaded",
 		"path":   fullPath,
+		"size":   size,
 	})
 }
 
+// nextFilePart advances the multipart reader to the "file" form field
+func nextFilePart(reader *multipart.Reader) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("file field is required")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// respondUploadError reports 413 when the body limit was hit, otherwise the given status and code
+func respondUploadError(w http.ResponseWriter, status int, code string, err error, maxBytes int64) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		apiError(w, http.StatusRequestEntityTooLarge, ErrCodeUploadTooLarge,
+			fmt.Sprintf("upload exceeds limit of %d MB", maxBytes>>20))
+		return
+	}
+	apiError(w, status, code, err.Error())
+}
+
 // Download handles file downloads from a VM
 func (h *FileHandler) Download(w http.ResponseWriter, r *http.Request) {
 	vmName := chi.URLParam(r, "name")
 	filePath := r.URL.Query().Get("path")
 
 	if filePath == "" {
-		http.Error(w, `{"error": "path query parameter is required"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "path query parameter is required")
 		return
 	}
 
 	// Check VM is running
-	info, err := h.mp.Info(vmName)
+	info, err := h.mp.InfoContext(r.Context(), vmName)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
-	if info.State != multipass.StateRunning {
-		http.Error(w, `{"error": "VM is not running"}`, http.StatusBadRequest)
+	if !requireExecState(w, vmName, info, "VM is not running") {
 		return
 	}
 
 	// Create temp file on host
 	tmpFile, err := os.CreateTemp("", "dabbi-download-*")
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 	defer os.Remove(tmpFile.Name())
@@ -205,14 +248,14 @@ func (h *FileHandler) Download(w http.ResponseWriter, r *http.Request) {
 	// Transfer from VM to host
 	vmPath := fmt.Sprintf("%s:%s", vmName, filePath)
 	if err := h.mp.Transfer(vmPath, tmpFile.Name()); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
 	// Read the downloaded file
 	content, err := os.ReadFile(tmpFile.Name())
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
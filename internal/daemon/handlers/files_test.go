@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupFileHandler(t *testing.T) (*FileHandler, *testutil.MockMultipassClient, *config.Config) {
+	mockMP := new(testutil.MockMultipassClient)
+	cfg := config.DefaultConfig()
+	handler := NewFileHandler(mockMP, cfg)
+	return handler, mockMP, cfg
+}
+
+// newUploadRequest builds a multipart upload request for the given VM and content
+func newUploadRequest(t *testing.T, vmName, path string, content []byte) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", "data.bin")
+	require.NoError(t, err)
+	_, err = fw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/"+vmName+"/files?path="+path, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", vmName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestFileHandler_Upload_Success(t *testing.T) {
+	handler, mockMP, _ := setupFileHandler(t)
+
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.On("Transfer", mock.Anything, "test-vm:/home/ubuntu/data.bin").Return(nil)
+
+	content := bytes.Repeat([]byte("x"), 4096)
+	req := newUploadRequest(t, "test-vm", "/home/ubuntu/", content)
+	rec := httptest.NewRecorder()
+
+	handler.Upload(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var resp map[string]interface{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "uploaded", resp["status"])
+	assert.Equal(t, "/home/ubuntu/data.bin", resp["path"])
+	assert.Equal(t, float64(len(content)), resp["size"])
+
+	mockMP.AssertExpectations(t)
+}
+
+func TestFileHandler_Upload_TooLarge(t *testing.T) {
+	handler, mockMP, cfg := setupFileHandler(t)
+	cfg.MaxUploadMB = 1
+
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+
+	content := bytes.Repeat([]byte("x"), (1<<20)+1)
+	req := newUploadRequest(t, "test-vm", "/home/ubuntu/", content)
+	rec := httptest.NewRecorder()
+
+	handler.Upload(rec, req)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrCodeUploadTooLarge)
+	mockMP.AssertNotCalled(t, "Transfer", mock.Anything, mock.Anything)
+}
+
+func TestFileHandler_Upload_MissingFile(t *testing.T) {
+	handler, mockMP, _ := setupFileHandler(t)
+
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	require.NoError(t, mw.WriteField("other", "value"))
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/test-vm/files?path=/tmp/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "test-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+
+	handler.Upload(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "file field is required")
+}
+
+func TestFileHandler_Browse_VMState(t *testing.T) {
+	tests := []struct {
+		state      string
+		wantStatus int
+		wantMsg    string
+	}{
+		{multipass.StateStopped, http.StatusBadRequest, "VM is not running"},
+		{multipass.StateSuspended, http.StatusBadRequest, "VM is not running"},
+		{multipass.StateDeleted, http.StatusConflict, "multipass recover test-vm"},
+		{multipass.StateStarting, http.StatusServiceUnavailable, "VM is starting, try again"},
+		{multipass.StateDelayedShutdown, http.StatusServiceUnavailable, "VM is shutting down, try again"},
+		{multipass.StateUnknown, http.StatusServiceUnavailable, "VM state is unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.state, func(t *testing.T) {
+			handler, mockMP, _ := setupFileHandler(t)
+			mockMP.On("Info", "test-vm").Return(&multipass.InstanceInfo{State: tt.state}, nil)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/vms/test-vm/files", nil)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("name", "test-vm")
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+			rec := httptest.NewRecorder()
+
+			handler.Browse(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			var resp errorResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, ErrCodeVMNotRunning, resp.Error.Code)
+			assert.Contains(t, resp.Error.Message, tt.wantMsg)
+			mockMP.AssertNotCalled(t, "Exec", mock.Anything, mock.Anything)
+		})
+	}
+}
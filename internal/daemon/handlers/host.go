@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// HostHandler handles host-level API requests
+type HostHandler struct {
+	mp multipass.Client
+}
+
+// NewHostHandler creates a new host handler
+func NewHostHandler(mp multipass.Client) *HostHandler {
+	return &HostHandler{mp: mp}
+}
+
+// ListNetworks returns host interfaces that VMs can be bridged onto
+// GET /api/host/networks
+func (h *HostHandler) ListNetworks(w http.ResponseWriter, r *http.Request) {
+	networks, err := h.mp.ListNetworks()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	if networks == nil {
+		networks = []multipass.NetworkInterface{}
+	}
+	respondJSON(w, http.StatusOK, networks)
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+const (
+	// Bounds for ?interval=, so a stream can't exec in the VM more than
+	// every couple of seconds
+	metricsDefaultInterval = 5 * time.Second
+	metricsMinInterval     = 2 * time.Second
+	metricsMaxInterval     = time.Minute
+
+	// metricsWriteWait bounds how long a sample may take to send
+	metricsWriteWait = 10 * time.Second
+)
+
+// MetricsHandler streams live resource samples from VMs
+type MetricsHandler struct {
+	mp  multipass.Client
+	cfg *config.Config
+
+	// collect queries a VM's stats (overridden in tests)
+	collect func(mp multipass.Client, vmName string) (*multipass.ActivityStats, error)
+}
+
+// NewMetricsHandler creates a metrics handler
+func NewMetricsHandler(mp multipass.Client, cfg *config.Config) *MetricsHandler {
+	return &MetricsHandler{mp: mp, cfg: cfg, collect: multipass.CollectActivity}
+}
+
+// MetricsSample is one reading sent on the metrics stream. Rates and CPU
+// use are averaged since the previous sample, so they're 0 in the first.
+type MetricsSample struct {
+	Time          time.Time `json:"time"`
+	CPUPercent    float64   `json:"cpu_percent"` // across all cores, 0-100
+	MemUsedBytes  uint64    `json:"mem_used_bytes"`
+	MemTotalBytes uint64    `json:"mem_total_bytes"`
+	Load1         float64   `json:"load_1m"`
+	RxBytes       uint64    `json:"rx_bytes"` // totals since boot
+	TxBytes       uint64    `json:"tx_bytes"`
+	RxBytesPerSec float64   `json:"rx_bytes_per_sec"`
+	TxBytesPerSec float64   `json:"tx_bytes_per_sec"`
+	Error         string    `json:"error,omitempty"` // set instead of the readings when the VM couldn't be queried
+}
+
+// Stream upgrades to a WebSocket and sends a MetricsSample (JSON) every
+// ?interval= seconds (default 5, 2 to 60) until the client disconnects.
+// Each sample is one exec in the VM, the same one the watchdog runs.
+// GET /api/vms/{name}/metrics/stream
+func (h *MetricsHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	vmName := chi.URLParam(r, "name")
+
+	interval := metricsDefaultInterval
+	if s := r.URL.Query().Get("interval"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "interval must be a number of seconds")
+			return
+		}
+		interval = min(max(time.Duration(secs)*time.Second, metricsMinInterval), metricsMaxInterval)
+	}
+
+	info, err := h.mp.InfoContext(r.Context(), vmName)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, "VM not found")
+		return
+	}
+	if !requireExecState(w, vmName, info, "VM is not running") {
+		return
+	}
+
+	var allowed []string
+	if h.cfg != nil {
+		allowed = h.cfg.AllowedOrigins
+	}
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return checkOrigin(r, allowed) }}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// The client only ever closes; reading is what notices it
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var prev *multipass.ActivityStats
+	var prevAt time.Time
+	for {
+		now := time.Now()
+		stats, err := h.collect(h.mp, vmName)
+		sample := MetricsSample{Time: now.UTC()}
+		if err != nil {
+			sample.Error = err.Error()
+		} else {
+			fillSample(&sample, stats, prev, now.Sub(prevAt))
+			prev, prevAt = stats, now
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(metricsWriteWait))
+		if err := conn.WriteJSON(sample); err != nil {
+			return
+		}
+
+		select {
+		case <-closed:
+			return
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fillSample sets a sample's readings from stats, with rates against the
+// previous stats taken elapsed earlier (nil for the first)
+func fillSample(sample *MetricsSample, stats, prev *multipass.ActivityStats, elapsed time.Duration) {
+	sample.CPUPercent = stats.CPUPercent(prev)
+	sample.MemTotalBytes = stats.MemTotalKB << 10
+	if stats.MemTotalKB >= stats.MemAvailableKB {
+		sample.MemUsedBytes = (stats.MemTotalKB - stats.MemAvailableKB) << 10
+	}
+	sample.Load1 = stats.LoadAverage1Min
+	sample.RxBytes = stats.RxBytes
+	sample.TxBytes = stats.TxBytes
+
+	// Counters reset when the VM reboots; report no rate rather than a negative one
+	if prev == nil || elapsed <= 0 {
+		return
+	}
+	secs := elapsed.Seconds()
+	if stats.RxBytes >= prev.RxBytes {
+		sample.RxBytesPerSec = float64(stats.RxBytes-prev.RxBytes) / secs
+	}
+	if stats.TxBytes >= prev.TxBytes {
+		sample.TxBytesPerSec = float64(stats.TxBytes-prev.TxBytes) / secs
+	}
+}
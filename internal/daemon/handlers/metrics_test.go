@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMetricsTestServer serves a metrics handler whose stats come from collect
+func newMetricsTestServer(t *testing.T, collect func(multipass.Client, string) (*multipass.ActivityStats, error)) (*httptest.Server, chan struct{}) {
+	t.Helper()
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.On("Info", "stopped-vm").Return(&multipass.InstanceInfo{State: multipass.StateStopped}, nil)
+
+	handler := NewMetricsHandler(mockMP, nil)
+	handler.collect = collect
+
+	// Signaled when a stream's handler returns
+	ended := make(chan struct{}, 1)
+	r := chi.NewRouter()
+	r.Get("/api/vms/{name}/metrics/stream", func(w http.ResponseWriter, r *http.Request) {
+		handler.Stream(w, r)
+		select {
+		case ended <- struct{}{}:
+		default:
+		}
+	})
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server, ended
+}
+
+func TestMetricsHandler_Stream(t *testing.T) {
+	server, ended := newMetricsTestServer(t, func(multipass.Client, string) (*multipass.ActivityStats, error) {
+		return &multipass.ActivityStats{
+			RxBytes: 1000, TxBytes: 500, LoadAverage1Min: 0.5,
+			CPUBusy: 10, CPUTotal: 100, MemTotalKB: 4096, MemAvailableKB: 1024,
+		}, nil
+	})
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/vms/test-vm/metrics/stream"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+
+	// The first sample comes right away, without rates
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var sample MetricsSample
+	require.NoError(t, conn.ReadJSON(&sample))
+	assert.Empty(t, sample.Error)
+	assert.Equal(t, uint64(4096<<10), sample.MemTotalBytes)
+	assert.Equal(t, uint64(3072<<10), sample.MemUsedBytes)
+	assert.Equal(t, uint64(1000), sample.RxBytes)
+	assert.InDelta(t, 0.5, sample.Load1, 0.001)
+	assert.Zero(t, sample.CPUPercent)
+	assert.Zero(t, sample.RxBytesPerSec)
+
+	// Disconnecting ends the stream without waiting for the next sample
+	conn.Close()
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatal("stream didn't stop after the client disconnected")
+	}
+}
+
+func TestMetricsHandler_StreamReportsErrors(t *testing.T) {
+	server, _ := newMetricsTestServer(t, func(multipass.Client, string) (*multipass.ActivityStats, error) {
+		return nil, assert.AnError
+	})
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/vms/test-vm/metrics/stream"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var sample MetricsSample
+	require.NoError(t, conn.ReadJSON(&sample))
+	assert.Equal(t, assert.AnError.Error(), sample.Error)
+}
+
+func TestMetricsHandler_StreamRejects(t *testing.T) {
+	server, _ := newMetricsTestServer(t, nil)
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+	}{
+		{"bad_interval", "/api/vms/test-vm/metrics/stream?interval=soon", http.StatusBadRequest},
+		{"not_running", "/api/vms/stopped-vm/metrics/stream", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := "ws" + strings.TrimPrefix(server.URL, "http") + tt.path
+			_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+			require.Error(t, err)
+			require.NotNil(t, resp)
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestFillSample_Rates(t *testing.T) {
+	prev := &multipass.ActivityStats{RxBytes: 1000, TxBytes: 2000, CPUBusy: 100, CPUTotal: 1000}
+	cur := &multipass.ActivityStats{RxBytes: 6000, TxBytes: 2500, CPUBusy: 150, CPUTotal: 1200}
+
+	var sample MetricsSample
+	fillSample(&sample, cur, prev, 5*time.Second)
+	assert.InDelta(t, 1000, sample.RxBytesPerSec, 0.001)
+	assert.InDelta(t, 100, sample.TxBytesPerSec, 0.001)
+	assert.InDelta(t, 25, sample.CPUPercent, 0.001)
+
+	// After a reboot the counters start over
+	var rebooted MetricsSample
+	fillSample(&rebooted, &multipass.ActivityStats{RxBytes: 10, CPUBusy: 1, CPUTotal: 10}, cur, 5*time.Second)
+	assert.Zero(t, rebooted.RxBytesPerSec)
+	assert.Zero(t, rebooted.CPUPercent)
+}
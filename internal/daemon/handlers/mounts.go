@@ -2,85 +2,166 @@ package handlers
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/mounts"
 	"github.com/mjshashank/dabbi/internal/multipass"
 )
 
 // MountHandler handles mount-related API requests
 type MountHandler struct {
-	mp multipass.Client
+	mp     multipass.Client
+	mounts *mounts.Store
 }
 
 // NewMountHandler creates a new mount handler
-func NewMountHandler(mp multipass.Client) *MountHandler {
-	return &MountHandler{mp: mp}
+func NewMountHandler(mp multipass.Client, ms *mounts.Store) *MountHandler {
+	return &MountHandler{mp: mp, mounts: ms}
 }
 
 // MountEntry represents a mount point
 type MountEntry struct {
-	HostPath string `json:"host_path"`
-	VMPath   string `json:"vm_path"`
+	HostPath string   `json:"host_path"`
+	VMPath   string   `json:"vm_path"`
+	UIDMaps  []string `json:"uid_maps,omitempty"` // host:vm uid pairs
+	GIDMaps  []string `json:"gid_maps,omitempty"` // host:vm gid pairs
+	Type     string   `json:"type,omitempty"`     // classic or native, when dabbi added the mount
+}
+
+// options converts the entry to multipass mount options
+func (e MountEntry) options() multipass.MountOptions {
+	return multipass.MountOptions{HostPath: e.HostPath, VMPath: e.VMPath, UIDMaps: e.UIDMaps, GIDMaps: e.GIDMaps, Type: e.Type}
+}
+
+// mountEntries lists a VM's current mounts, sorted by VM path. The type and
+// id mappings come from dabbi's record of how each mount was added; mounts
+// it didn't add get multipass's explicit id mappings and no type.
+func mountEntries(info *multipass.InstanceInfo, recorded []mounts.Entry) []MountEntry {
+	byPath := make(map[string]mounts.Entry, len(recorded))
+	for _, e := range recorded {
+		byPath[e.VMPath] = e
+	}
+
+	entries := make([]MountEntry, 0, len(info.Mounts))
+	for vmPath, m := range info.Mounts {
+		entry := MountEntry{HostPath: m.SourcePath, VMPath: vmPath}
+		if rec, ok := byPath[vmPath]; ok && rec.HostPath == m.SourcePath {
+			entry.UIDMaps, entry.GIDMaps, entry.Type = rec.UIDMaps, rec.GIDMaps, rec.Type
+		} else {
+			entry.UIDMaps, entry.GIDMaps = explicitIDMaps(m.UIDMappings), explicitIDMaps(m.GIDMappings)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].VMPath < entries[j].VMPath })
+	return entries
+}
+
+// explicitIDMaps drops multipass's "<id>:default" mappings, which only say
+// the default user is used and can't be passed back to multipass mount
+func explicitIDMaps(maps []string) []string {
+	var explicit []string
+	for _, m := range maps {
+		if !strings.HasSuffix(m, ":default") {
+			explicit = append(explicit, m)
+		}
+	}
+	return explicit
+}
+
+// recordMount remembers how a mount was added. The mount exists by now, so
+// a failure is only logged.
+func recordMount(ms *mounts.Store, vmName string, opts multipass.MountOptions) {
+	if err := ms.Add(vmName, mounts.EntryFromOptions(opts)); err != nil {
+		log.Printf("Warning: failed to record mount %s for VM %s: %v", opts.VMPath, vmName, err)
+	}
 }
 
 // List returns all mounts for a VM
 func (h *MountHandler) List(w http.ResponseWriter, r *http.Request) {
 	vmName := chi.URLParam(r, "name")
 
-	info, err := h.mp.Info(vmName)
+	info, err := h.mp.InfoContext(r.Context(), vmName)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
 
-	var mounts []MountEntry
-	for vmPath, mount := range info.Mounts {
-		mounts = append(mounts, MountEntry{
-			HostPath: mount.SourcePath,
-			VMPath:   vmPath,
-		})
+	recorded, err := h.mounts.List(vmName)
+	if err != nil {
+		log.Printf("Warning: failed to read recorded mounts for VM %s: %v", vmName, err)
 	}
 
-	respondJSON(w, http.StatusOK, mounts)
+	respondJSON(w, http.StatusOK, mountEntries(info, recorded))
 }
 
-// AddMountRequest represents a mount add request
-type AddMountRequest struct {
-	HostPath string `json:"host_path"`
-	VMPath   string `json:"vm_path"`
+// AllMountsResponse is every VM's mounts, and the VMs that couldn't be read
+type AllMountsResponse struct {
+	Mounts []mounts.HostMount `json:"mounts"`
+	Errors []mounts.VMError   `json:"errors,omitempty"`
 }
 
+// ListAll returns the mounts of every VM with whether each host path still
+// exists, to find mounts left stale by a moved or deleted host directory.
+// A VM that can't be queried is listed in errors instead of failing the
+// request.
+// GET /api/mounts
+func (h *MountHandler) ListAll(w http.ResponseWriter, r *http.Request) {
+	found, failed, err := mounts.All(h.mp, 0)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, AllMountsResponse{Mounts: found, Errors: failed})
+}
+
+// AddMountRequest represents a mount add request. It has the same fields as
+// MountEntry; type and id mappings are optional.
+type AddMountRequest = MountEntry
+
 // Add creates a new mount
 func (h *MountHandler) Add(w http.ResponseWriter, r *http.Request) {
 	vmName := chi.URLParam(r, "name")
 
 	var req AddMountRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
 	if req.HostPath == "" || req.VMPath == "" {
-		http.Error(w, `{"error": "host_path and vm_path are required"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "host_path and vm_path are required")
+		return
+	}
+	opts := req.options()
+	if err := multipass.ValidateMount(opts); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
-	// Check VM is running
-	info, err := h.mp.Info(vmName)
+	info, err := h.mp.InfoContext(r.Context(), vmName)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
-	if info.State != multipass.StateRunning {
-		http.Error(w, `{"error": "VM is not running"}`, http.StatusBadRequest)
+	// Classic (SSHFS) mounts need a running VM; native ones a stopped VM
+	if opts.Type == multipass.MountTypeNative {
+		if info.State == multipass.StateRunning {
+			apiError(w, http.StatusConflict, ErrCodeVMNotStopped, "native mounts can only be added to a stopped VM")
+			return
+		}
+	} else if !requireExecState(w, vmName, info, "VM is not running") {
 		return
 	}
 
-	if err := h.mp.Mount(vmName, req.HostPath, req.VMPath); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+	if err := h.mp.Mount(vmName, opts); err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
+	recordMount(h.mounts, vmName, opts)
 
 	respondJSON(w, http.StatusCreated, map[string]string{"status": "mounted"})
 }
@@ -91,25 +172,46 @@ func (h *MountHandler) Remove(w http.ResponseWriter, r *http.Request) {
 	vmPath := r.URL.Query().Get("path")
 
 	if vmPath == "" {
-		http.Error(w, `{"error": "path query parameter is required"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "path query parameter is required")
 		return
 	}
 
 	// Check VM is running
-	info, err := h.mp.Info(vmName)
+	info, err := h.mp.InfoContext(r.Context(), vmName)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
-	if info.State != multipass.StateRunning {
-		http.Error(w, `{"error": "VM is not running"}`, http.StatusBadRequest)
+	if !requireExecState(w, vmName, info, "VM is not running") {
 		return
 	}
 
 	if err := h.mp.Unmount(vmName, vmPath); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
+	if err := h.mounts.Remove(vmName, vmPath); err != nil {
+		log.Printf("Warning: failed to forget mount %s for VM %s: %v", vmPath, vmName, err)
+	}
 
 	respondJSON(w, http.StatusOK, map[string]string{"status": "unmounted"})
 }
+
+// MountRestoreResponse reports what happened to each recorded mount
+type MountRestoreResponse struct {
+	Results []mounts.Result `json:"results"`
+}
+
+// Restore re-applies the mounts dabbi recorded for a VM that it no longer
+// has, e.g. after the VM was recreated
+// POST /api/vms/{name}/mounts/restore
+func (h *MountHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	vmName := chi.URLParam(r, "name")
+
+	results, err := mounts.Restore(h.mp, h.mounts, vmName)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, MountRestoreResponse{Results: results})
+}
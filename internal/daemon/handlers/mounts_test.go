@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/mounts"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupMountHandler(t *testing.T) (*MountHandler, *testutil.MockMultipassClient) {
+	mockMP := new(testutil.MockMultipassClient)
+	return NewMountHandler(mockMP, newTestMountStore(t)), mockMP
+}
+
+func TestMountHandler_Add_Records(t *testing.T) {
+	handler, mockMP := setupMountHandler(t)
+	opts := multipass.MountOptions{
+		HostPath: "/Users/me/src",
+		VMPath:   "/home/ubuntu/src",
+		UIDMaps:  []string{"501:1000"},
+		GIDMaps:  []string{"20:1000"},
+	}
+	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "10.0.0.5"), nil)
+	mockMP.On("Mount", "vm1", opts).Return(nil)
+
+	body := `{"host_path":"/Users/me/src","vm_path":"/home/ubuntu/src","uid_maps":["501:1000"],"gid_maps":["20:1000"]}`
+	rec := httptest.NewRecorder()
+	handler.Add(rec, newLabelsRequest(http.MethodPost, "vm1", body))
+
+	require.Equal(t, http.StatusCreated, rec.Code)
+	recorded, err := handler.mounts.List("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, []mounts.Entry{mounts.EntryFromOptions(opts)}, recorded)
+	mockMP.AssertExpectations(t)
+}
+
+func TestMountHandler_Add_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"missing_vm_path", `{"host_path":"/src"}`},
+		{"bad_uid_map", `{"host_path":"/src","vm_path":"/mnt","uid_maps":["me:1000"]}`},
+		{"bad_type", `{"host_path":"/src","vm_path":"/mnt","type":"nfs"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockMP := setupMountHandler(t)
+
+			rec := httptest.NewRecorder()
+			handler.Add(rec, newLabelsRequest(http.MethodPost, "vm1", tt.body))
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			mockMP.AssertNotCalled(t, "Mount")
+		})
+	}
+}
+
+func TestMountHandler_Add_NativeNeedsStoppedVM(t *testing.T) {
+	handler, mockMP := setupMountHandler(t)
+	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "10.0.0.5"), nil)
+
+	rec := httptest.NewRecorder()
+	handler.Add(rec, newLabelsRequest(http.MethodPost, "vm1", `{"host_path":"/src","vm_path":"/mnt","type":"native"}`))
+
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrCodeVMNotStopped)
+	mockMP.AssertNotCalled(t, "Mount")
+}
+
+func TestMountHandler_List_MergesRecord(t *testing.T) {
+	handler, mockMP := setupMountHandler(t)
+	info := testutil.RunningVM("vm1", "10.0.0.5")
+	info.Mounts = map[string]multipass.Mount{
+		"/home/ubuntu/src": {SourcePath: "/Users/me/src", UIDMappings: []string{"501:default"}},
+		"/data":            {SourcePath: "/Users/me/data", UIDMappings: []string{"501:1000"}},
+	}
+	mockMP.On("Info", "vm1").Return(info, nil)
+	require.NoError(t, handler.mounts.Add("vm1", mounts.Entry{HostPath: "/Users/me/src", VMPath: "/home/ubuntu/src", Type: multipass.MountTypeNative}))
+
+	rec := httptest.NewRecorder()
+	handler.List(rec, newLabelsRequest(http.MethodGet, "vm1", ""))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var entries []MountEntry
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&entries))
+	assert.Equal(t, []MountEntry{
+		{HostPath: "/Users/me/data", VMPath: "/data", UIDMaps: []string{"501:1000"}},
+		{HostPath: "/Users/me/src", VMPath: "/home/ubuntu/src", Type: multipass.MountTypeNative},
+	}, entries)
+}
+
+func TestMountHandler_Remove_Forgets(t *testing.T) {
+	handler, mockMP := setupMountHandler(t)
+	require.NoError(t, handler.mounts.Add("vm1", mounts.Entry{HostPath: "/src", VMPath: "/mnt"}))
+	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "10.0.0.5"), nil)
+	mockMP.On("Unmount", "vm1", "/mnt").Return(nil)
+
+	req := newLabelsRequest(http.MethodDelete, "vm1", "")
+	req.URL.RawQuery = "path=/mnt"
+	rec := httptest.NewRecorder()
+	handler.Remove(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	recorded, err := handler.mounts.List("vm1")
+	require.NoError(t, err)
+	assert.Empty(t, recorded)
+}
+
+func TestMountHandler_Restore(t *testing.T) {
+	handler, mockMP := setupMountHandler(t)
+	require.NoError(t, handler.mounts.Add("vm1", mounts.Entry{HostPath: "/src", VMPath: "/home/ubuntu/src", UIDMaps: []string{"501:1000"}}))
+	require.NoError(t, handler.mounts.Add("vm1", mounts.Entry{HostPath: "/data", VMPath: "/data"}))
+	require.NoError(t, handler.mounts.Add("vm1", mounts.Entry{HostPath: "/missing", VMPath: "/missing"}))
+
+	info := testutil.RunningVM("vm1", "10.0.0.5")
+	info.Mounts = map[string]multipass.Mount{"/data": {SourcePath: "/data"}}
+	mockMP.On("Info", "vm1").Return(info, nil)
+	mockMP.On("Mount", "vm1", multipass.MountOptions{HostPath: "/src", VMPath: "/home/ubuntu/src", UIDMaps: []string{"501:1000"}}).Return(nil)
+	mockMP.On("Mount", "vm1", multipass.MountOptions{HostPath: "/missing", VMPath: "/missing"}).Return(errors.New("source path does not exist"))
+
+	rec := httptest.NewRecorder()
+	handler.Restore(rec, newLabelsRequest(http.MethodPost, "vm1", ""))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp MountRestoreResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	statuses := make(map[string]string)
+	for _, r := range resp.Results {
+		statuses[r.VMPath] = r.Status
+	}
+	assert.Equal(t, map[string]string{
+		"/data":            mounts.StatusSkipped,
+		"/home/ubuntu/src": mounts.StatusMounted,
+		"/missing":         mounts.StatusFailed,
+	}, statuses)
+	mockMP.AssertExpectations(t)
+}
+
+func TestMountHandler_ListAll(t *testing.T) {
+	handler, mockMP := setupMountHandler(t)
+	info := testutil.RunningVM("vm1", "10.0.0.5")
+	info.Mounts = map[string]multipass.Mount{"/gone": {SourcePath: "/nonexistent/dabbi-test-dir"}}
+	mockMP.On("List").Return(testutil.RunningVMList("vm1", "vm2"), nil)
+	mockMP.On("Info", "vm1").Return(info, nil)
+	mockMP.On("Info", "vm2").Return(nil, errors.New("timed out"))
+
+	rec := httptest.NewRecorder()
+	handler.ListAll(rec, httptest.NewRequest(http.MethodGet, "/api/mounts", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp AllMountsResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, []mounts.HostMount{{VM: "vm1", HostPath: "/nonexistent/dabbi-test-dir", VMPath: "/gone"}}, resp.Mounts)
+	assert.Equal(t, []mounts.VMError{{VM: "vm2", Error: "timed out"}}, resp.Errors)
+}
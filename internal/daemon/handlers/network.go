@@ -2,9 +2,13 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/audit"
 	"github.com/mjshashank/dabbi/internal/config"
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/network"
@@ -22,20 +26,35 @@ func NewNetworkHandler(mp multipass.Client, cfg *config.Config) *NetworkHandler
 	return &NetworkHandler{
 		mp:      mp,
 		cfg:     cfg,
-		applier: network.NewApplier(mp),
+		applier: newApplier(mp, cfg),
 	}
 }
 
+// newApplier returns a network applier set up from the config
+func newApplier(mp multipass.Client, cfg *config.Config) *network.Applier {
+	applier := network.NewApplier(mp)
+	applier.SetAutoInstall(cfg.NetworkAutoInstallTools)
+	if dir, err := config.HostNetworkPath(); err == nil {
+		applier.SetHostDir(dir)
+	}
+	return applier
+}
+
 // NetworkConfigRequest represents a network configuration update request
 type NetworkConfigRequest struct {
-	Mode  string                  `json:"mode"`  // "none", "allowlist", "blocklist", "isolated"
-	Rules []multipass.NetworkRule `json:"rules"` // Rules (ignored for "isolated" and "none")
+	Mode       string                  `json:"mode"`                  // "none", "allowlist", "blocklist", "isolated"
+	Rules      []multipass.NetworkRule `json:"rules"`                 // Rules (ignored for "isolated" and "none")
+	DNSServers []string                `json:"dns_servers,omitempty"` // Resolvers allowed in allowlist mode
+	Scope      string                  `json:"scope,omitempty"`       // "vm" (default) or "host" (Linux hosts only)
 }
 
 // NetworkConfigResponse represents the current network configuration
 type NetworkConfigResponse struct {
-	Mode  string                  `json:"mode"`
-	Rules []multipass.NetworkRule `json:"rules,omitempty"`
+	Mode       string                  `json:"mode"`
+	Rules      []multipass.NetworkRule `json:"rules,omitempty"`
+	DNSServers []string                `json:"dns_servers,omitempty"`
+	Scope      string                  `json:"scope,omitempty"`  // where the rules are enforced, if not in the VM
+	Paused     bool                    `json:"paused,omitempty"` // restrictions lifted until resumed
 }
 
 // Get returns the current network configuration for a VM
@@ -44,21 +63,24 @@ func (h *NetworkHandler) Get(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
 	// Verify VM exists and is running
-	info, err := h.mp.Info(name)
+	info, err := h.mp.InfoContext(r.Context(), name)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
 
-	if info.State != multipass.StateRunning {
-		http.Error(w, `{"error": "VM must be running to query network config"}`, http.StatusBadRequest)
+	if !requireExecState(w, name, info, "VM must be running to query network config") {
 		return
 	}
 
 	// Query the VM for current config
 	cfg, err := h.applier.GetCurrentConfig(name)
+	if errors.Is(err, multipass.ErrExecTimeout) {
+		apiError(w, http.StatusServiceUnavailable, ErrCodeUnavailable, err.Error())
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
@@ -71,9 +93,13 @@ func (h *NetworkHandler) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	paused, _ := h.applier.IsPaused(name)
 	respondJSON(w, http.StatusOK, NetworkConfigResponse{
-		Mode:  string(cfg.Mode),
-		Rules: cfg.Rules,
+		Mode:       string(cfg.Mode),
+		Rules:      cfg.Rules,
+		DNSServers: cfg.DNSServers,
+		Scope:      string(cfg.Scope),
+		Paused:     paused,
 	})
 }
 
@@ -84,37 +110,42 @@ func (h *NetworkHandler) Update(w http.ResponseWriter, r *http.Request) {
 
 	var req NetworkConfigRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
 	// Verify VM exists and is running
-	info, err := h.mp.Info(name)
+	info, err := h.mp.InfoContext(r.Context(), name)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
 
-	if info.State != multipass.StateRunning {
-		http.Error(w, `{"error": "VM must be running to update network config"}`, http.StatusBadRequest)
+	if !requireExecState(w, name, info, "VM must be running to update network config") {
 		return
 	}
 
 	// Build config
 	cfg := &multipass.NetworkConfig{
-		Mode:  multipass.NetworkMode(req.Mode),
-		Rules: req.Rules,
+		Mode:       multipass.NetworkMode(req.Mode),
+		Rules:      req.Rules,
+		DNSServers: req.DNSServers,
+		Scope:      multipass.NetworkScope(req.Scope),
 	}
 
 	// Validate
 	if err := network.ValidateConfig(cfg); err != nil {
-		http.Error(w, `{"error": "`+err.Error()+`"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, err.Error())
 		return
 	}
 
 	// Apply to VM
 	if err := h.applier.ApplyToVM(name, cfg); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		if errors.Is(err, network.ErrHostScopeUnsupported) {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, err.Error())
+			return
+		}
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
@@ -130,20 +161,19 @@ func (h *NetworkHandler) Remove(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
 	// Verify VM exists and is running
-	info, err := h.mp.Info(name)
+	info, err := h.mp.InfoContext(r.Context(), name)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
 
-	if info.State != multipass.StateRunning {
-		http.Error(w, `{"error": "VM must be running to remove network config"}`, http.StatusBadRequest)
+	if !requireExecState(w, name, info, "VM must be running to remove network config") {
 		return
 	}
 
 	// Apply "none" mode
 	if err := h.applier.RemoveFromVM(name); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
@@ -158,32 +188,31 @@ func (h *NetworkHandler) Apply(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
 	// Verify VM exists and is running
-	info, err := h.mp.Info(name)
+	info, err := h.mp.InfoContext(r.Context(), name)
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
 
-	if info.State != multipass.StateRunning {
-		http.Error(w, `{"error": "VM must be running to apply network config"}`, http.StatusBadRequest)
+	if !requireExecState(w, name, info, "VM must be running to apply network config") {
 		return
 	}
 
 	// Get current config from VM
 	cfg, err := h.applier.GetCurrentConfig(name)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
 	if cfg == nil {
-		http.Error(w, `{"error": "no network config to apply"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeNotFound, "no network config to apply")
 		return
 	}
 
 	// Re-apply
 	if err := h.applier.ApplyToVM(name, cfg); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
@@ -193,10 +222,220 @@ func (h *NetworkHandler) Apply(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// NetworkBulkApplyRequest applies one network config to many VMs. Either
+// names or all is required.
+type NetworkBulkApplyRequest struct {
+	Names    []string             `json:"names,omitempty"`
+	All      bool                 `json:"all,omitempty"`
+	Config   NetworkConfigRequest `json:"config"`
+	Parallel int                  `json:"parallel,omitempty"` // VMs applied to at once (default 4)
+}
+
+// NetworkBulkApplyResponse reports what happened to each selected VM
+type NetworkBulkApplyResponse struct {
+	Results []network.BulkResult `json:"results"`
+}
+
+// ApplyBulk applies a network config to the selected VMs, a few at a time.
+// Only running VMs get it; failures for individual VMs are reported in the
+// results rather than failing the request.
+// POST /api/network/apply-bulk
+func (h *NetworkHandler) ApplyBulk(w http.ResponseWriter, r *http.Request) {
+	var req NetworkBulkApplyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	if req.All == (len(req.Names) > 0) {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "specify either names or all")
+		return
+	}
+	if req.Parallel < 0 {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "parallel cannot be negative")
+		return
+	}
+
+	cfg := &multipass.NetworkConfig{
+		Mode:       multipass.NetworkMode(req.Config.Mode),
+		Rules:      req.Config.Rules,
+		DNSServers: req.Config.DNSServers,
+		Scope:      multipass.NetworkScope(req.Config.Scope),
+	}
+	if err := network.ValidateConfig(cfg); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, err.Error())
+		return
+	}
+	audit.SetDetail(r.Context(), req.Config.Mode)
+
+	results, err := h.applier.ApplyBulk(req.Names, cfg, req.Parallel)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, NetworkBulkApplyResponse{Results: results})
+}
+
+// Pause lifts a VM's network restrictions, keeping its config, until it's
+// resumed or rebooted
+// POST /api/vms/{name}/network/pause
+func (h *NetworkHandler) Pause(w http.ResponseWriter, r *http.Request) {
+	h.pauseOrResume(w, r, "paused", h.applier.Pause)
+}
+
+// Resume reapplies a paused VM's network restrictions
+// POST /api/vms/{name}/network/resume
+func (h *NetworkHandler) Resume(w http.ResponseWriter, r *http.Request) {
+	h.pauseOrResume(w, r, "resumed", h.applier.Resume)
+}
+
+func (h *NetworkHandler) pauseOrResume(w http.ResponseWriter, r *http.Request, status string, fn func(vmName string) error) {
+	name := chi.URLParam(r, "name")
+
+	info, err := h.mp.InfoContext(r.Context(), name)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
+		return
+	}
+	if !requireExecState(w, name, info, "VM must be running to change its network rules") {
+		return
+	}
+
+	if err := fn(name); err != nil {
+		if errors.Is(err, network.ErrNotConfigured) {
+			apiError(w, http.StatusBadRequest, ErrCodeNotFound, err.Error())
+			return
+		}
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": status})
+}
+
+// NetworkTestRequest lists hosts to check from inside a VM
+type NetworkTestRequest struct {
+	Hosts       []string `json:"hosts"`                  // domains or IPv4 addresses, host:port for a TCP check
+	TimeoutSecs int      `json:"timeout_secs,omitempty"` // per host (default 5, max 30)
+}
+
+// NetworkTestResponse is what a VM could reach
+type NetworkTestResponse struct {
+	VM        string                `json:"vm"`
+	Results   []network.ProbeResult `json:"results"`
+	Reachable int                   `json:"reachable"`
+	Blocked   int                   `json:"blocked"`
+}
+
+// Test checks from inside a VM whether each host can be reached, to verify
+// the applied rules end to end: plain hosts are fetched over HTTPS, and
+// host:port gets a TCP connect
+// POST /api/vms/{name}/network/test
+func (h *NetworkHandler) Test(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	var req NetworkTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid request body")
+		return
+	}
+	if len(req.Hosts) == 0 {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "at least one host is required")
+		return
+	}
+	if len(req.Hosts) > network.MaxProbeHosts {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("at most %d hosts can be tested at once", network.MaxProbeHosts))
+		return
+	}
+	for _, host := range req.Hosts {
+		if err := network.ValidateProbeHost(host); err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+	}
+	timeout := time.Duration(req.TimeoutSecs) * time.Second
+	if req.TimeoutSecs < 0 || timeout > network.MaxProbeTimeout {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("timeout_secs must be between 0 and %d", int(network.MaxProbeTimeout.Seconds())))
+		return
+	}
+
+	info, err := h.mp.InfoContext(r.Context(), name)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
+		return
+	}
+	if !requireExecState(w, name, info, "VM must be running to test its network") {
+		return
+	}
+
+	resp := NetworkTestResponse{VM: name, Results: network.ProbeHosts(h.mp, name, req.Hosts, timeout)}
+	for _, result := range resp.Results {
+		if result.Reachable {
+			resp.Reachable++
+		} else {
+			resp.Blocked++
+		}
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// NetworkVerifyResponse is how a VM's live rules differ from its config
+type NetworkVerifyResponse struct {
+	VM     string          `json:"vm"`
+	InSync bool            `json:"in_sync"`
+	Drift  []network.Drift `json:"drift"`
+}
+
+// Verify compares the iptables rules live in a VM against its stored
+// config, reporting rules that are missing or were added by hand
+// GET /api/vms/{name}/network/verify
+func (h *NetworkHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	info, err := h.mp.InfoContext(r.Context(), name)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
+		return
+	}
+	if !requireExecState(w, name, info, "VM must be running to verify its network rules") {
+		return
+	}
+
+	cfg, err := h.applier.GetCurrentConfig(name)
+	if errors.Is(err, multipass.ErrExecTimeout) {
+		apiError(w, http.StatusServiceUnavailable, ErrCodeUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	if paused, _ := h.applier.IsPaused(name); paused {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "network restrictions are paused; resume them to verify")
+		return
+	}
+
+	drift, err := h.applier.Verify(name, cfg)
+	switch {
+	case errors.Is(err, network.ErrVerifyHostScope):
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	case errors.Is(err, multipass.ErrExecTimeout):
+		apiError(w, http.StatusServiceUnavailable, ErrCodeUnavailable, err.Error())
+		return
+	case err != nil:
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	if drift == nil {
+		drift = []network.Drift{}
+	}
+	respondJSON(w, http.StatusOK, NetworkVerifyResponse{VM: name, InSync: len(drift) == 0, Drift: drift})
+}
+
 // GetDefaults returns the global default network configuration
 // GET /api/network/defaults
 func (h *NetworkHandler) GetDefaults(w http.ResponseWriter, r *http.Request) {
-	cfg := h.cfg.Defaults.NetworkConfig
+	cfg := h.cfg.Snapshot().Defaults.NetworkConfig
 	if cfg == nil {
 		respondJSON(w, http.StatusOK, NetworkConfigResponse{
 			Mode:  string(multipass.NetworkModeNone),
@@ -206,8 +445,9 @@ func (h *NetworkHandler) GetDefaults(w http.ResponseWriter, r *http.Request) {
 	}
 
 	respondJSON(w, http.StatusOK, NetworkConfigResponse{
-		Mode:  string(cfg.Mode),
-		Rules: cfg.Rules,
+		Mode:       string(cfg.Mode),
+		Rules:      cfg.Rules,
+		DNSServers: cfg.DNSServers,
 	})
 }
 
@@ -216,28 +456,29 @@ func (h *NetworkHandler) GetDefaults(w http.ResponseWriter, r *http.Request) {
 func (h *NetworkHandler) SetDefaults(w http.ResponseWriter, r *http.Request) {
 	var req NetworkConfigRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
 	// Build config
 	cfg := &multipass.NetworkConfig{
-		Mode:  multipass.NetworkMode(req.Mode),
-		Rules: req.Rules,
+		Mode:       multipass.NetworkMode(req.Mode),
+		Rules:      req.Rules,
+		DNSServers: req.DNSServers,
 	}
 
 	// Validate
 	if err := network.ValidateConfig(cfg); err != nil {
-		http.Error(w, `{"error": "`+err.Error()+`"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, err.Error())
 		return
 	}
 
-	// Update config
-	h.cfg.Defaults.NetworkConfig = cfg
-
-	// Save to disk
-	if err := h.cfg.Save(); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+	// Update config and save to disk
+	err := h.cfg.Update(func(c *config.Config) {
+		c.Defaults.NetworkConfig = cfg
+	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/network"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newNetworkTestRequest(vmName, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/"+vmName+"/network/test", strings.NewReader(body))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", vmName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestNetworkHandler_Test(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.On("Exec", "test-vm", mock.MatchedBy(func(cmd []string) bool {
+		return cmd[0] == "curl" && cmd[len(cmd)-1] == "https://github.com"
+	})).Return("200", nil)
+	mockMP.On("Exec", "test-vm", mock.MatchedBy(func(cmd []string) bool {
+		return cmd[0] == "curl" && cmd[len(cmd)-1] == "https://example.com"
+	})).Return("", &multipass.MultipassError{Stderr: "curl: (28) Connection timed out after 5001 milliseconds", Err: errors.New("exit status 28")})
+
+	rec := httptest.NewRecorder()
+	handler.Test(rec, newNetworkTestRequest("test-vm", `{"hosts": ["github.com", "example.com"]}`))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp NetworkTestResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, NetworkTestResponse{
+		VM: "test-vm",
+		Results: []network.ProbeResult{
+			{Host: "github.com", Reachable: true, HTTPStatus: 200},
+			{Host: "example.com", Error: "curl: (28) Connection timed out after 5001 milliseconds"},
+		},
+		Reachable: 1,
+		Blocked:   1,
+	}, resp)
+}
+
+func TestNetworkHandler_Test_InvalidRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no hosts", `{"hosts": []}`},
+		{"bad host", `{"hosts": ["github.com; reboot"]}`},
+		{"too many hosts", `{"hosts": [` + strings.Repeat(`"a.com",`, network.MaxProbeHosts) + `"b.com"]}`},
+		{"timeout too long", `{"hosts": ["github.com"], "timeout_secs": 600}`},
+		{"malformed", `{`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockMP := new(testutil.MockMultipassClient)
+			handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+
+			rec := httptest.NewRecorder()
+			handler.Test(rec, newNetworkTestRequest("test-vm", tt.body))
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			mockMP.AssertNotCalled(t, "Exec", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestNetworkHandler_Test_Stopped(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+	mockMP.On("Info", "test-vm").Return(testutil.StoppedVM("test-vm"), nil)
+
+	rec := httptest.NewRecorder()
+	handler.Test(rec, newNetworkTestRequest("test-vm", `{"hosts": ["github.com"]}`))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	mockMP.AssertNotCalled(t, "Exec", mock.Anything, mock.Anything)
+}
+
+func newNetworkPauseRequest(vmName, action string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/"+vmName+"/network/"+action, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", vmName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestNetworkHandler_PauseResume(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.MockNetworkConfig("test-vm", `{"mode":"allowlist","rules":[{"type":"domain","value":"github.com"}]}`)
+	mockMP.On("Exec", "test-vm", mock.Anything).Return("", nil)
+
+	rec := httptest.NewRecorder()
+	handler.Pause(rec, newNetworkPauseRequest("test-vm", "pause"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status": "paused"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.Resume(rec, newNetworkPauseRequest("test-vm", "resume"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status": "resumed"}`, rec.Body.String())
+
+	mockMP.AssertCalled(t, "Exec", "test-vm", []string{"sudo", "/opt/dabbi/network/apply-rules.sh"})
+}
+
+func TestNetworkHandler_Pause_NotConfigured(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.MockNetworkConfig("test-vm", "")
+
+	rec := httptest.NewRecorder()
+	handler.Pause(rec, newNetworkPauseRequest("test-vm", "pause"))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrCodeNotFound)
+}
+
+func TestNetworkHandler_Update_InvalidScope(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+
+	req := httptest.NewRequest(http.MethodPut, "/api/vms/test-vm/network", strings.NewReader(`{"mode": "isolated", "scope": "router"}`))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "test-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	handler.Update(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "invalid network scope")
+	mockMP.AssertNotCalled(t, "Exec", mock.Anything, mock.Anything)
+}
+
+func TestNetworkHandler_Get_Unresponsive(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.On("ExecWithTimeout", "test-vm", mock.Anything, mock.Anything).
+		Return("", fmt.Errorf("test -f in test-vm: %w", multipass.ErrExecTimeout))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/test-vm/network", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "test-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	handler.Get(rec, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrCodeUnavailable)
+}
+
+func TestNetworkHandler_Verify(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.MockNetworkConfig("test-vm", `{"mode":"blocklist","rules":[{"type":"ip","value":"8.8.8.8"}]}`)
+	mockMP.On("Exec", "test-vm", []string{"test", "-e", "/run/dabbi-network-paused"}).Return("", testutil.ExitError(1))
+	mockMP.On("ExecWithTimeout", "test-vm", mock.Anything, []string{"sudo", "iptables", "-S"}).
+		Return("-P INPUT ACCEPT\n-P FORWARD ACCEPT\n-P OUTPUT ACCEPT\n-N DABBI_OUT\n-A OUTPUT -j DABBI_OUT\n", nil)
+	mockMP.On("ExecWithTimeout", "test-vm", mock.Anything, []string{"sudo", "sh", "-c", "[ ! -e /proc/net/if_inet6 ] || ip6tables -S"}).
+		Return("", nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/test-vm/network/verify", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "test-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	handler.Verify(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{
+		"vm": "test-vm",
+		"in_sync": false,
+		"drift": [{"kind": "missing", "rule": {"chain": "DABBI_OUT", "dest": "8.8.8.8/32", "target": "DROP"}}]
+	}`, rec.Body.String())
+}
+
+func TestNetworkHandler_ApplyBulk(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "web", State: multipass.StateRunning},
+		{Name: "old", State: multipass.StateStopped},
+	}, nil)
+	mockMP.On("Exec", "web", mock.Anything).Return("", nil)
+	mockMP.On("Transfer", mock.Anything, mock.Anything).Return(nil)
+
+	body := `{"all": true, "config": {"mode": "allowlist", "rules": [{"type": "cidr", "value": "10.0.0.0/8"}]}}`
+	rec := httptest.NewRecorder()
+	handler.ApplyBulk(rec, httptest.NewRequest(http.MethodPost, "/api/network/apply-bulk", strings.NewReader(body)))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"results": [
+		{"name": "old", "status": "skipped", "detail": "not running (stopped)"},
+		{"name": "web", "status": "ok"}
+	]}`, rec.Body.String())
+}
+
+func TestNetworkHandler_ApplyBulk_InvalidRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no selection", `{"config": {"mode": "isolated"}}`},
+		{"names and all", `{"names": ["web"], "all": true, "config": {"mode": "isolated"}}`},
+		{"negative parallel", `{"all": true, "parallel": -1, "config": {"mode": "isolated"}}`},
+		{"invalid config", `{"all": true, "config": {"mode": "open"}}`},
+		{"malformed", `{`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockMP := new(testutil.MockMultipassClient)
+			handler := NewNetworkHandler(mockMP, config.DefaultConfig())
+
+			rec := httptest.NewRecorder()
+			handler.ApplyBulk(rec, httptest.NewRequest(http.MethodPost, "/api/network/apply-bulk", strings.NewReader(tt.body)))
+
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			mockMP.AssertNotCalled(t, "List")
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/agent"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/mounts"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/prune"
+	"github.com/mjshashank/dabbi/internal/tunnel"
+	"github.com/mjshashank/dabbi/internal/vmspec"
+	"github.com/mjshashank/dabbi/internal/watchdog"
+)
+
+// PruneHandler deletes stopped or idle VMs in bulk
+type PruneHandler struct {
+	mp      multipass.Client
+	stops   *watchdog.StopLog
+	labels  *labels.Store
+	specs   *vmspec.Store
+	mounts  *mounts.Store
+	tunnels *tunnel.Manager
+	agents  *agent.Manager
+}
+
+// NewPruneHandler creates a new prune handler
+func NewPruneHandler(mp multipass.Client, stops *watchdog.StopLog, ls *labels.Store, specs *vmspec.Store, ms *mounts.Store, tm *tunnel.Manager, am *agent.Manager) *PruneHandler {
+	return &PruneHandler{mp: mp, stops: stops, labels: ls, specs: specs, mounts: ms, tunnels: tm, agents: am}
+}
+
+// PruneRequest selects which VMs to prune
+type PruneRequest struct {
+	Stopped   bool   `json:"stopped"`              // only stopped VMs
+	OlderThan string `json:"older_than,omitempty"` // only VMs inactive this long, e.g. "7d"
+	DryRun    bool   `json:"dry_run"`              // report matches without deleting
+}
+
+// PruneResponse lists the VMs that were (or would be) deleted
+type PruneResponse struct {
+	DryRun bool              `json:"dry_run"`
+	Pruned []prune.Candidate `json:"pruned"`
+	Failed map[string]string `json:"failed,omitempty"` // vm -> error
+}
+
+// Prune deletes VMs matching the request's filters
+// POST /api/vms/prune
+func (h *PruneHandler) Prune(w http.ResponseWriter, r *http.Request) {
+	var req PruneRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid JSON")
+		return
+	}
+
+	pinned, err := h.labels.Pinned()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	criteria := prune.Criteria{Stopped: req.Stopped, CallerIP: remoteIP(r), Pinned: pinned}
+	if req.OlderThan != "" {
+		age, err := prune.ParseAge(req.OlderThan)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+			return
+		}
+		criteria.OlderThan = age
+	}
+	if err := criteria.Validate(); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	candidates, err := prune.Select(h.mp, h.stops, criteria, time.Now())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	resp := PruneResponse{DryRun: req.DryRun, Pruned: []prune.Candidate{}}
+	if req.DryRun {
+		resp.Pruned = append(resp.Pruned, candidates...)
+		respondJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	for _, c := range candidates {
+		if err := h.mp.Delete(c.Name, true); err != nil {
+			if resp.Failed == nil {
+				resp.Failed = make(map[string]string)
+			}
+			resp.Failed[c.Name] = err.Error()
+			continue
+		}
+		CloseListeners(h.tunnels, h.agents, c.Name)
+		if err := h.labels.Delete(c.Name); err != nil {
+			log.Printf("Warning: failed to remove labels for pruned VM %s: %v", c.Name, err)
+		}
+		if err := h.specs.Delete(c.Name); err != nil {
+			log.Printf("Warning: failed to remove spec for pruned VM %s: %v", c.Name, err)
+		}
+		if err := h.mounts.Delete(c.Name); err != nil {
+			log.Printf("Warning: failed to remove mount records for pruned VM %s: %v", c.Name, err)
+		}
+		resp.Pruned = append(resp.Pruned, c)
+	}
+
+	respondJSON(w, http.StatusOK, resp)
+}
+
+// remoteIP returns the request's client address without the port
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
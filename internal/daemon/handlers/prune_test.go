@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/mjshashank/dabbi/internal/watchdog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupPruneHandler(t *testing.T) (*PruneHandler, *testutil.MockMultipassClient) {
+	mockMP := new(testutil.MockMultipassClient)
+	stops := watchdog.NewStopLog(filepath.Join(t.TempDir(), "activity.json"))
+	return NewPruneHandler(mockMP, stops, newTestLabelStore(t), newTestSpecStore(t), newTestMountStore(t), nil, nil), mockMP
+}
+
+func newPruneRequest(body, remoteAddr string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/prune", bytes.NewBufferString(body))
+	if remoteAddr != "" {
+		req.RemoteAddr = remoteAddr
+	}
+	return req
+}
+
+func stoppedVMList() []multipass.ListInstance {
+	return []multipass.ListInstance{
+		{Name: "vm1", State: multipass.StateStopped, IPv4: []string{"192.168.64.2"}},
+		{Name: "vm2", State: multipass.StateStopped, IPv4: []string{"192.168.64.3"}},
+		{Name: "vm3", State: multipass.StateRunning, IPv4: []string{"192.168.64.4"}},
+	}
+}
+
+func TestPruneHandler_DryRun(t *testing.T) {
+	handler, mockMP := setupPruneHandler(t)
+	mockMP.On("List").Return(stoppedVMList(), nil)
+
+	rec := httptest.NewRecorder()
+	handler.Prune(rec, newPruneRequest(`{"stopped":true,"dry_run":true}`, ""))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp PruneResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.True(t, resp.DryRun)
+	require.Len(t, resp.Pruned, 2)
+	assert.Equal(t, "vm1", resp.Pruned[0].Name)
+	assert.Equal(t, "vm2", resp.Pruned[1].Name)
+	mockMP.AssertNotCalled(t, "Delete", "vm1", true)
+}
+
+func TestPruneHandler_Deletes(t *testing.T) {
+	handler, mockMP := setupPruneHandler(t)
+	require.NoError(t, handler.labels.Set("vm1", map[string]string{"env": "ci"}))
+	mockMP.On("List").Return(stoppedVMList(), nil)
+	mockMP.On("Delete", "vm1", true).Return(nil)
+	mockMP.On("Delete", "vm2", true).Return(assert.AnError)
+
+	rec := httptest.NewRecorder()
+	handler.Prune(rec, newPruneRequest(`{"stopped":true}`, ""))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp PruneResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.False(t, resp.DryRun)
+	require.Len(t, resp.Pruned, 1)
+	assert.Equal(t, "vm1", resp.Pruned[0].Name)
+	assert.Contains(t, resp.Failed, "vm2")
+
+	vmLabels, err := handler.labels.Get("vm1")
+	require.NoError(t, err)
+	assert.Empty(t, vmLabels)
+	mockMP.AssertExpectations(t)
+}
+
+func TestPruneHandler_SkipsCallersVM(t *testing.T) {
+	handler, mockMP := setupPruneHandler(t)
+	mockMP.On("List").Return(stoppedVMList(), nil)
+
+	rec := httptest.NewRecorder()
+	handler.Prune(rec, newPruneRequest(`{"stopped":true,"dry_run":true}`, "192.168.64.2:51234"))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp PruneResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Pruned, 1)
+	assert.Equal(t, "vm2", resp.Pruned[0].Name)
+}
+
+func TestPruneHandler_InvalidRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid_json", `{`},
+		{"no_filters", `{}`},
+		{"invalid_age", `{"older_than":"soon"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockMP := setupPruneHandler(t)
+
+			rec := httptest.NewRecorder()
+			handler.Prune(rec, newPruneRequest(tt.body, ""))
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+			var resp errorResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, ErrCodeInvalidRequest, resp.Error.Code)
+			mockMP.AssertNotCalled(t, "List")
+		})
+	}
+}
+
+func TestPruneHandler_SkipsPinned(t *testing.T) {
+	handler, mockMP := setupPruneHandler(t)
+	require.NoError(t, handler.labels.Mark("vm1", labels.PinnedKey))
+	mockMP.On("List").Return(stoppedVMList(), nil)
+	mockMP.On("Delete", "vm2", true).Return(nil)
+
+	rec := httptest.NewRecorder()
+	handler.Prune(rec, newPruneRequest(`{"stopped":true}`, ""))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var resp PruneResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Pruned, 1)
+	assert.Equal(t, "vm2", resp.Pruned[0].Name)
+	mockMP.AssertNotCalled(t, "Delete", "vm1", true)
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// ReadyResponse is the progress of a VM's first-boot tool install, read
+// from the status file the default cloud-init writes
+type ReadyResponse struct {
+	VM    string `json:"vm"`
+	Ready bool   `json:"ready"` // the install completed
+	*multipass.InstallStatus
+}
+
+// Ready reports whether a VM's first-boot install (the tools and agent set
+// up by the default cloud-init) is still running, completed, or failed, and
+// which command failed. A VM without a status file is "unknown".
+// GET /api/vms/{name}/ready
+func (h *VMHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	info, err := h.mp.InfoContext(r.Context(), name)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, "VM not found")
+		return
+	}
+	if !requireExecState(w, name, info, "VM is not running") {
+		return
+	}
+
+	status, err := multipass.ReadInstallStatus(h.mp, name)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, "failed to read install status: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, ReadyResponse{
+		VM:            name,
+		Ready:         status.Status == multipass.InstallComplete,
+		InstallStatus: status,
+	})
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newReadyRequest(vmName string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/"+vmName+"/ready", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", vmName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestVMHandler_Ready(t *testing.T) {
+	tests := []struct {
+		name      string
+		output    string
+		wantReady bool
+		want      string
+		wantError string
+	}{
+		{"installing", "status=running\nupdated=2026-10-16T12:00:00Z\nerror=\n", false, multipass.InstallRunning, ""},
+		{"complete", "status=complete\nupdated=2026-10-16T12:05:00Z\nerror=\n", true, multipass.InstallComplete, ""},
+		{"failed", "status=failed\nupdated=2026-10-16T12:01:00Z\nerror=line 27: apt-get install -y gh (exit 100)\n", false, multipass.InstallFailed, "line 27: apt-get install -y gh (exit 100)"},
+		{"no status file", "", false, multipass.InstallUnknown, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockMP := setupVMHandler(t)
+			mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+			mockMP.On("Exec", "test-vm", mock.MatchedBy(func(cmd []string) bool {
+				return len(cmd) == 3 && cmd[0] == "sh" && cmd[1] == "-c"
+			})).Return(tt.output, nil)
+
+			rec := httptest.NewRecorder()
+			handler.Ready(rec, newReadyRequest("test-vm"))
+
+			require.Equal(t, http.StatusOK, rec.Code)
+			var resp ReadyResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, "test-vm", resp.VM)
+			assert.Equal(t, tt.wantReady, resp.Ready)
+			assert.Equal(t, tt.want, resp.Status)
+			assert.Equal(t, tt.wantError, resp.Error)
+		})
+	}
+}
+
+func TestVMHandler_Ready_Stopped(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Info", "test-vm").Return(testutil.StoppedVM("test-vm"), nil)
+
+	rec := httptest.NewRecorder()
+	handler.Ready(rec, newReadyRequest("test-vm"))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	mockMP.AssertNotCalled(t, "Exec", mock.Anything, mock.Anything)
+}
+
+func TestVMHandler_Ready_ExecError(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.On("Exec", "test-vm", mock.Anything).Return("", errors.New("ssh failed"))
+
+	rec := httptest.NewRecorder()
+	handler.Ready(rec, newReadyRequest("test-vm"))
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
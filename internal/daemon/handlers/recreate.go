@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/agent"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/tunnel"
+)
+
+// RecreateHandler rebuilds VMs from their recorded specs. It closes the
+// daemon's tunnels and agent listener for the VM first, since they point at
+// the old instance's IP.
+type RecreateHandler struct {
+	vms     *VMHandler
+	tunnels *tunnel.Manager
+	agents  *agent.Manager
+}
+
+// NewRecreateHandler creates a new recreate handler
+func NewRecreateHandler(vms *VMHandler, tm *tunnel.Manager, am *agent.Manager) *RecreateHandler {
+	return &RecreateHandler{vms: vms, tunnels: tm, agents: am}
+}
+
+// Recreate deletes and purges a VM, then launches it again from the spec it
+// was created with. Disk contents and snapshots are not kept; labels are.
+// POST /api/vms/{name}/recreate
+func (h *RecreateHandler) Recreate(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	data, err := h.vms.specs.Spec(name)
+	if errors.Is(err, os.ErrNotExist) {
+		apiError(w, http.StatusNotFound, ErrCodeNotFound,
+			fmt.Sprintf("no spec recorded for VM '%s', so it can't be recreated", name))
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	var req CreateVMRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, "corrupt spec: "+err.Error())
+		return
+	}
+	req.Name = name
+
+	// Render before deleting anything, so a spec that no longer validates
+	// leaves the VM alone
+	modifiedContent, netConfig, ok := h.vms.prepareCreate(w, &req)
+	if !ok {
+		return
+	}
+
+	CloseListeners(h.tunnels, h.agents, name)
+
+	// A VM that is already gone (e.g. an earlier recreate failed to launch)
+	// only needs relaunching
+	if _, err := h.vms.mp.InfoContext(r.Context(), name); err == nil {
+		if err := h.vms.mp.Delete(name, true); err != nil {
+			apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+	}
+
+	launchFile, err := h.vms.cfg.WriteLaunchFile(req.Name, modifiedContent)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	err = h.vms.mp.Launch(multipass.LaunchOptions{
+		Name:          req.Name,
+		CPUs:          req.CPUs,
+		Memory:        req.Memory,
+		Disk:          req.Disk,
+		CloudInit:     launchFile.Path,
+		Image:         req.Image,
+		ImageChecksum: req.ImageChecksum,
+		Networks:      req.Networks,
+		NetworkConfig: netConfig,
+	})
+	releaseLaunchFile(launchFile)
+	if err != nil {
+		launchError(w, fmt.Errorf("VM was deleted but relaunching failed (retry to launch it again): %w", err))
+		return
+	}
+	h.vms.recordLaunch(req, modifiedContent)
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"status": "recreated",
+		"name":   name,
+	})
+}
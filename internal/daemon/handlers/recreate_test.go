@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/agent"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/mjshashank/dabbi/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupRecreateHandler(t *testing.T) (*RecreateHandler, *testutil.MockMultipassClient) {
+	vms, mockMP := setupVMHandler(t)
+	return NewRecreateHandler(vms, tunnel.NewManager(mockMP), agent.NewManager(mockMP)), mockMP
+}
+
+func TestRecreateHandler_NoSpec(t *testing.T) {
+	handler, mockMP := setupRecreateHandler(t)
+
+	rec := httptest.NewRecorder()
+	handler.Recreate(rec, newLabelsRequest(http.MethodPost, "dev", ""))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), "no spec recorded")
+	mockMP.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+}
+
+func TestRecreateHandler_Recreate(t *testing.T) {
+	handler, mockMP := setupRecreateHandler(t)
+	netConfig := &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated}
+	spec := CreateVMRequest{
+		Name:     "dev",
+		CPUs:     4,
+		Memory:   "8G",
+		Disk:     "40G",
+		Image:    "24.04",
+		Network:  netConfig,
+		Packages: []string{"htop"},
+	}
+	require.NoError(t, handler.vms.specs.Save("dev", "#cloud-config\n", spec))
+
+	mockMP.On("Info", "dev").Return(testutil.RunningVM("dev", "192.168.64.5"), nil)
+	tun, err := handler.tunnels.Create("dev", 8080)
+	require.NoError(t, err)
+	require.NotNil(t, tun)
+
+	mockMP.On("Delete", "dev", true).Return(nil).Once()
+	mockMP.On("Launch", mock.MatchedBy(func(opts multipass.LaunchOptions) bool {
+		return opts.Name == "dev" && opts.CPUs == 4 && opts.Memory == "8G" && opts.Disk == "40G" &&
+			opts.Image == "24.04" && opts.NetworkConfig != nil && opts.NetworkConfig.Mode == multipass.NetworkModeIsolated
+	})).Return(nil).Once()
+
+	rec := httptest.NewRecorder()
+	handler.Recreate(rec, newLabelsRequest(http.MethodPost, "dev", ""))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp map[string]string
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "recreated", resp["status"])
+
+	// Tunnels to the old instance are closed
+	assert.Empty(t, handler.tunnels.List())
+
+	// The spec is kept for the next rebuild
+	_, err = handler.vms.specs.Spec("dev")
+	assert.NoError(t, err)
+	mockMP.AssertExpectations(t)
+}
+
+func TestRecreateHandler_AlreadyDeleted(t *testing.T) {
+	handler, mockMP := setupRecreateHandler(t)
+	require.NoError(t, handler.vms.specs.Save("dev", "#cloud-config\n", CreateVMRequest{Name: "dev"}))
+
+	// An earlier recreate deleted the VM but failed to launch it
+	mockMP.On("Info", "dev").Return(nil, errors.New("instance \"dev\" does not exist"))
+	mockMP.On("Launch", mock.Anything).Return(nil).Once()
+
+	rec := httptest.NewRecorder()
+	handler.Recreate(rec, newLabelsRequest(http.MethodPost, "dev", ""))
+
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	mockMP.AssertNotCalled(t, "Delete", mock.Anything, mock.Anything)
+}
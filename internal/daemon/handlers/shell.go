@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"compress/flate"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
@@ -13,6 +16,8 @@ import (
 	"github.com/creack/pty"
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/daemon/mw"
 	"github.com/mjshashank/dabbi/internal/multipass"
 )
 
@@ -25,17 +30,15 @@ const (
 
 	// Time allowed to write a message to the peer
 	writeWait = 10 * time.Second
-)
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin:     checkOrigin,
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
+	// WebSocket buffer size; large enough for a coalesced burst of PTY output
+	shellBufferSize = 32 << 10
+)
 
 // checkOrigin validates WebSocket connection origins to prevent CSRF attacks.
-// Allows: no origin (non-browser clients), localhost, and same-origin requests.
-func checkOrigin(r *http.Request) bool {
+// Allows: no origin (non-browser clients), localhost, same-origin requests,
+// and origins listed in allowedOrigins (exact scheme+host match).
+func checkOrigin(r *http.Request, allowedOrigins []string) bool {
 	origin := r.Header.Get("Origin")
 
 	// No origin header = non-browser client (curl, CLI tools) - allow
@@ -65,17 +68,57 @@ func checkOrigin(r *http.Request) bool {
 		return true
 	}
 
-	return false
+	// Allow explicitly configured origins (e.g., a reverse proxy hostname),
+	// the same allowlist the API's CORS middleware uses
+	return mw.OriginAllowed(origin, allowedOrigins)
 }
 
 // ShellHandler handles WebSocket shell sessions
 type ShellHandler struct {
-	mp multipass.Client
+	mp  multipass.Client
+	cfg *config.Config
+
+	// shellCommand builds the command run inside the PTY (overridden in tests)
+	shellCommand func(vmName string) *exec.Cmd
+
+	// recordingsDir is where ?record=true sessions are saved ("" if unavailable)
+	recordingsDir string
+
+	// Live shells keyed by session ID, kept across websocket reconnects
+	sessionsMu sync.Mutex
+	sessions   map[string]*shellSession
 }
 
 // NewShellHandler creates a new shell handler
-func NewShellHandler(mp multipass.Client) *ShellHandler {
-	return &ShellHandler{mp: mp}
+func NewShellHandler(mp multipass.Client, cfg *config.Config) *ShellHandler {
+	recordingsDir, _ := config.RecordingsPath()
+	return &ShellHandler{
+		mp:            mp,
+		cfg:           cfg,
+		shellCommand:  multipassShellCommand,
+		recordingsDir: recordingsDir,
+		sessions:      make(map[string]*shellSession),
+	}
+}
+
+func multipassShellCommand(vmName string) *exec.Cmd {
+	return exec.Command("multipass", "shell", vmName)
+}
+
+// upgrader returns a WebSocket upgrader that applies the configured origin allowlist
+func (h *ShellHandler) upgrader() *websocket.Upgrader {
+	var allowed []string
+	if h.cfg != nil {
+		allowed = h.cfg.AllowedOrigins
+	}
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return checkOrigin(r, allowed)
+		},
+		ReadBufferSize:    shellBufferSize,
+		WriteBufferSize:   shellBufferSize,
+		EnableCompression: true, // per-message deflate, if the client offers it
+	}
 }
 
 // ResizeMessage represents a terminal resize message
@@ -85,19 +128,27 @@ type ResizeMessage struct {
 	Cols uint16 `json:"cols"`
 }
 
-// Handle upgrades to WebSocket and provides shell access
+// SessionMessage is sent on connect with the ID a client passes back as
+// ?session=<id> to reattach to the same shell after a disconnect
+type SessionMessage struct {
+	Type      string `json:"type"` // always "session"
+	ID        string `json:"id"`
+	Recording string `json:"recording,omitempty"` // recording file name, if the session is recorded
+}
+
+// Handle upgrades to WebSocket and provides shell access. With ?record=true
+// a new session's output is saved as an asciinema recording.
 func (h *ShellHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	vmName := chi.URLParam(r, "name")
 
 	// Ensure VM exists and is running
-	info, err := h.mp.Info(vmName)
+	info, err := h.mp.InfoContext(r.Context(), vmName)
 	if err != nil {
-		http.Error(w, "VM not found", http.StatusNotFound)
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, "VM not found")
 		return
 	}
 
-	if info.State != multipass.StateRunning {
-		http.Error(w, "VM is not running", http.StatusBadRequest)
+	if !requireExecState(w, vmName, info, "VM is not running") {
 		return
 	}
 
@@ -117,53 +168,37 @@ func (h *ShellHandler) Handle(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Upgrade to WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader().Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
 	defer conn.Close()
-
-	// Start multipass shell with PTY at the correct initial size
-	// CRITICAL: Using StartWithSize ensures the shell starts with correct dimensions
-	// This fixes TUI applications like Claude Code that read terminal size at startup
-	cmd := exec.Command("multipass", "shell", vmName)
-
-	// Set environment variables for proper terminal behavior
-	cmd.Env = append(cmd.Environ(),
-		"TERM=xterm-256color",
-		"LANG=en_US.UTF-8",
-		"LC_ALL=en_US.UTF-8",
-	)
-
-	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{
-		Rows: uint16(initialRows),
-		Cols: uint16(initialCols),
-	})
-	if err != nil {
-		conn.WriteMessage(websocket.TextMessage, []byte("Failed to start shell: "+err.Error()))
-		return
-	}
-
-	// Ensure PTY and process are cleaned up on any exit
-	defer func() {
-		ptmx.Close()
-		if cmd.Process != nil {
-			cmd.Process.Kill()
-			cmd.Wait() // Reap the zombie process
+	// Terminal output is latency-sensitive and compresses well even at the fastest level
+	conn.SetCompressionLevel(flate.BestSpeed)
+
+	// Reattach to a live session if the client has one, otherwise start a new shell
+	// (attach sends the session ID and replays recent output to the client)
+	session := h.lookupSession(r.URL.Query().Get("session"), vmName)
+	resumed := session != nil
+	if resumed {
+		session.resize(uint16(initialRows), uint16(initialCols))
+	} else {
+		record := r.URL.Query().Get("record") == "true"
+		session, err = h.startSession(vmName, initialRows, initialCols, record)
+		if err != nil {
+			conn.WriteMessage(websocket.TextMessage, []byte("Failed to start shell: "+err.Error()))
+			return
 		}
-	}()
+	}
+	session.attach(conn)
 
-	// Channel to signal all goroutines to stop
-	done := make(chan struct{})
-	var closeOnce sync.Once
-	closeDone := func() {
-		closeOnce.Do(func() {
-			close(done)
-		})
+	if !resumed {
+		go session.pump(func() { h.endSession(session) })
 	}
 
-	// Mutex to synchronize WebSocket writes (ping + PTY output)
-	var writeMu sync.Mutex
+	// Channel to signal the ping goroutine to stop
+	done := make(chan struct{})
+	defer close(done)
 
 	// Set up WebSocket ping/pong for dead connection detection
 	// This is critical for detecting when browser tabs are closed abruptly
@@ -173,7 +208,7 @@ func (h *ShellHandler) Handle(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
-	// Goroutine 1: Send pings periodically to detect dead connections
+	// Send pings periodically to detect dead connections
 	go func() {
 		ticker := time.NewTicker(pingPeriod)
 		defer ticker.Stop()
@@ -182,76 +217,140 @@ func (h *ShellHandler) Handle(w http.ResponseWriter, r *http.Request) {
 			case <-done:
 				return
 			case <-ticker.C:
-				writeMu.Lock()
-				conn.SetWriteDeadline(time.Now().Add(writeWait))
-				err := conn.WriteMessage(websocket.PingMessage, nil)
-				writeMu.Unlock()
-				if err != nil {
-					closeDone()
+				if err := session.write(conn, websocket.PingMessage, nil); err != nil {
+					conn.Close()
 					return
 				}
 			}
 		}
 	}()
 
-	// Goroutine 2: Read from PTY and send to WebSocket
-	go func() {
-		defer closeDone()
-		buf := make([]byte, 4096)
-		for {
-			select {
-			case <-done:
-				return
-			default:
-			}
-
-			n, err := ptmx.Read(buf)
-			if err != nil {
-				return
-			}
-
-			writeMu.Lock()
-			conn.SetWriteDeadline(time.Now().Add(writeWait))
-			err = conn.WriteMessage(websocket.BinaryMessage, buf[:n])
-			writeMu.Unlock()
-			if err != nil {
-				return
-			}
-		}
-	}()
-
-	// Main goroutine: Read from WebSocket and write to PTY
+	// Main loop: Read from WebSocket and write to PTY
+	// (PTY output is sent to the attached client by session.pump)
+	var readErr error
 	for {
-		select {
-		case <-done:
-			return
-		default:
-		}
-
 		// ReadMessage will return error when read deadline expires (no pong received)
 		// or when the connection is closed
 		msgType, data, err := conn.ReadMessage()
 		if err != nil {
-			closeDone()
-			return
+			readErr = err
+			break
 		}
 
 		// Check for resize message (JSON with type: "resize")
 		if msgType == websocket.TextMessage && len(data) > 0 && data[0] == '{' {
 			var resize ResizeMessage
 			if err := json.Unmarshal(data, &resize); err == nil && resize.Type == "resize" {
-				pty.Setsize(ptmx, &pty.Winsize{
-					Rows: resize.Rows,
-					Cols: resize.Cols,
-				})
+				session.resize(resize.Rows, resize.Cols)
 				continue
 			}
 		}
 
 		// Write to PTY
-		if _, err := ptmx.Write(data); err != nil {
-			closeDone()
-			return
+		if _, err := session.ptmx.Write(data); err != nil {
+			break
+		}
+	}
+
+	// Shell exited, or another client took over this session
+	if session.closed() || !session.isAttached(conn) {
+		return
+	}
+
+	// A clean close means the user is done; anything else (timeout, dropped
+	// connection) keeps the shell alive for the grace period so it can be resumed
+	grace := h.resumeGrace()
+	if grace <= 0 || websocket.IsCloseError(readErr, websocket.CloseNormalClosure) {
+		h.endSession(session)
+		return
+	}
+	session.detach(conn, grace, func() { h.endSession(session) })
+}
+
+// startSession starts a shell PTY for the VM and registers it for reattach
+func (h *ShellHandler) startSession(vmName string, rows, cols int, record bool) (*shellSession, error) {
+	var recorder *castRecorder
+	if record {
+		if h.recordingsDir == "" {
+			return nil, errors.New("recordings directory is unavailable")
+		}
+		var err error
+		recorder, err = createCastRecorder(h.recordingsDir, vmName, cols, rows, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("failed to start recording: %w", err)
+		}
+	}
+
+	// Start multipass shell with PTY at the correct initial size
+	// CRITICAL: Using StartWithSize ensures the shell starts with correct dimensions
+	// This fixes TUI applications like Claude Code that read terminal size at startup
+	cmd := h.shellCommand(vmName)
+
+	// Set environment variables for proper terminal behavior
+	cmd.Env = append(cmd.Environ(),
+		"TERM=xterm-256color",
+		"LANG=en_US.UTF-8",
+		"LC_ALL=en_US.UTF-8",
+	)
+
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{
+		Rows: uint16(rows),
+		Cols: uint16(cols),
+	})
+	if err != nil {
+		if recorder != nil {
+			recorder.close(time.Now())
 		}
+		return nil, err
+	}
+
+	session := newShellSession(vmName, cmd, ptmx, h.scrollbackSize())
+	session.recorder = recorder
+
+	h.sessionsMu.Lock()
+	h.sessions[session.id] = session
+	h.sessionsMu.Unlock()
+
+	return session, nil
+}
+
+// lookupSession returns the live session with the given ID for the VM, if any
+func (h *ShellHandler) lookupSession(id, vmName string) *shellSession {
+	if id == "" {
+		return nil
+	}
+
+	h.sessionsMu.Lock()
+	session := h.sessions[id]
+	h.sessionsMu.Unlock()
+
+	if session == nil || session.vmName != vmName || session.closed() {
+		return nil
+	}
+	return session
+}
+
+// endSession unregisters a session and kills its shell
+func (h *ShellHandler) endSession(session *shellSession) {
+	h.sessionsMu.Lock()
+	delete(h.sessions, session.id)
+	h.sessionsMu.Unlock()
+
+	session.close()
+}
+
+// scrollbackSize returns how many bytes of output each session keeps for replay
+func (h *ShellHandler) scrollbackSize() int {
+	if h.cfg == nil {
+		return config.DefaultShellScrollbackKB << 10
+	}
+	return h.cfg.ShellScrollbackBytes()
+}
+
+// resumeGrace returns how long a dropped shell stays resumable
+func (h *ShellHandler) resumeGrace() time.Duration {
+	if h.cfg == nil {
+		return 0
 	}
+	return h.cfg.ShellResumeGrace()
 }
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// recordingTimeFormat is the timestamp in recording file names, <vm>-<ts>.cast
+const recordingTimeFormat = "20060102-150405"
+
+// recordingSuffix matches what follows "<vm>-" in a recording file name
+var recordingSuffix = regexp.MustCompile(`^\d{8}-\d{6}(-\d+)?\.cast$`)
+
+// castHeader is the first line of an asciinema v2 recording
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// castRecorder writes a shell session's output to an asciinema v2 .cast
+// file: a JSON header line, then one [seconds, code, data] line per event
+type castRecorder struct {
+	name    string
+	f       *os.File
+	start   time.Time
+	partial []byte // trailing bytes of a UTF-8 sequence split across reads
+	err     error  // first write error; recording stops after it
+}
+
+// createCastRecorder creates <dir>/<vm>-<ts>.cast and writes its header
+func createCastRecorder(dir, vmName string, cols, rows int, now time.Time) (*castRecorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	base := vmName + "-" + now.UTC().Format(recordingTimeFormat)
+	var f *os.File
+	var name string
+	for i := 0; f == nil; i++ {
+		name = base + ".cast"
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d.cast", base, i)
+		}
+		// Mode 0600: terminal output can contain secrets
+		var err error
+		f, err = os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+	}
+
+	header, _ := json.Marshal(castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: now.Unix(),
+		Title:     vmName,
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	})
+	if _, err := f.Write(append(header, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return &castRecorder{name: name, f: f, start: now}, nil
+}
+
+// output records PTY output. A UTF-8 sequence cut off at the end of data is
+// held back until the rest arrives, since events are JSON strings.
+func (r *castRecorder) output(data []byte, now time.Time) {
+	buf := append(r.partial, data...)
+	cut := completeUTF8(buf)
+	r.partial = append([]byte(nil), buf[cut:]...)
+	if cut > 0 {
+		r.event(now, "o", string(buf[:cut]))
+	}
+}
+
+// resize records a terminal size change
+func (r *castRecorder) resize(cols, rows int, now time.Time) {
+	r.event(now, "r", fmt.Sprintf("%dx%d", cols, rows))
+}
+
+func (r *castRecorder) event(now time.Time, code, data string) {
+	if r.err != nil {
+		return
+	}
+	elapsed := math.Round(now.Sub(r.start).Seconds()*1e6) / 1e6
+	line, _ := json.Marshal([]interface{}{elapsed, code, data})
+	_, r.err = r.f.Write(append(line, '\n'))
+}
+
+// close writes any held-back output and closes the file
+func (r *castRecorder) close(now time.Time) error {
+	if len(r.partial) > 0 {
+		r.event(now, "o", string(r.partial))
+		r.partial = nil
+	}
+	return r.f.Close()
+}
+
+// completeUTF8 returns the length of b without a trailing incomplete rune
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return len(b)
+			}
+			return i
+		}
+	}
+	return len(b)
+}
+
+// RecordingInfo describes a saved shell recording
+type RecordingInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// isRecordingOf reports whether file is a recording of the VM
+func isRecordingOf(file, vmName string) bool {
+	rest, ok := strings.CutPrefix(file, vmName+"-")
+	return ok && recordingSuffix.MatchString(rest)
+}
+
+// ListRecordings returns a VM's shell recordings, newest first
+// GET /api/vms/{name}/recordings
+func (h *ShellHandler) ListRecordings(w http.ResponseWriter, r *http.Request) {
+	vmName := chi.URLParam(r, "name")
+
+	if h.recordingsDir == "" {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, "recordings directory is unavailable")
+		return
+	}
+
+	recordings := []RecordingInfo{}
+	entries, err := os.ReadDir(h.recordingsDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() || !isRecordingOf(e.Name(), vmName) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		recordings = append(recordings, RecordingInfo{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(recordings, func(i, j int) bool { return recordings[i].Name > recordings[j].Name })
+
+	respondJSON(w, http.StatusOK, recordings)
+}
+
+// GetRecording downloads a shell recording
+// GET /api/vms/{name}/recordings/{file}
+func (h *ShellHandler) GetRecording(w http.ResponseWriter, r *http.Request) {
+	vmName := chi.URLParam(r, "name")
+	file := chi.URLParam(r, "file")
+
+	// The name check also rules out path traversal
+	if h.recordingsDir == "" || !isRecordingOf(file, vmName) {
+		apiError(w, http.StatusNotFound, ErrCodeNotFound, "recording not found")
+		return
+	}
+
+	f, err := os.Open(filepath.Join(h.recordingsDir, file))
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeNotFound, "recording not found")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file))
+	http.ServeContent(w, r, file, info.ModTime(), f)
+}
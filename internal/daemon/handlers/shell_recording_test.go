@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readCast parses a .cast file into its header and events
+func readCast(t *testing.T, path string) (castHeader, [][]interface{}) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	require.True(t, scanner.Scan(), "missing header")
+	var header castHeader
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &header))
+
+	var events [][]interface{}
+	for scanner.Scan() {
+		var event []interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event), "line %q", scanner.Text())
+		require.Len(t, event, 3)
+		events = append(events, event)
+	}
+	return header, events
+}
+
+func TestCastRecorder(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	rec, err := createCastRecorder(dir, "test-vm", 120, 40, start)
+	require.NoError(t, err)
+	assert.Equal(t, "test-vm-20260301-120000.cast", rec.name)
+
+	euro := []byte("€") // 3 bytes, split across two reads
+	rec.output([]byte("price: "), start.Add(100*time.Millisecond))
+	rec.output(euro[:1], start.Add(200*time.Millisecond))
+	rec.output(euro[1:], start.Add(300*time.Millisecond))
+	rec.resize(80, 24, start.Add(1500*time.Millisecond))
+	require.NoError(t, rec.close(start.Add(2*time.Second)))
+
+	header, events := readCast(t, filepath.Join(dir, rec.name))
+	assert.Equal(t, castHeader{
+		Version:   2,
+		Width:     120,
+		Height:    40,
+		Timestamp: start.Unix(),
+		Title:     "test-vm",
+		Env:       map[string]string{"TERM": "xterm-256color"},
+	}, header)
+	assert.Equal(t, [][]interface{}{
+		{0.1, "o", "price: "},
+		{0.3, "o", "€"},
+		{1.5, "r", "80x24"},
+	}, events)
+
+	// A second recording in the same second gets its own file
+	rec2, err := createCastRecorder(dir, "test-vm", 80, 24, start)
+	require.NoError(t, err)
+	defer rec2.close(start)
+	assert.Equal(t, "test-vm-20260301-120000-1.cast", rec2.name)
+}
+
+func TestIsRecordingOf(t *testing.T) {
+	tests := []struct {
+		file string
+		vm   string
+		want bool
+	}{
+		{"dev-20260301-120000.cast", "dev", true},
+		{"dev-20260301-120000-2.cast", "dev", true},
+		{"dev-box-20260301-120000.cast", "dev", false},
+		{"dev-box-20260301-120000.cast", "dev-box", true},
+		{"dev-20260301-120000.txt", "dev", false},
+		{"../dev-20260301-120000.cast", "dev", false},
+		{"dev-../../etc/passwd", "dev", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRecordingOf(tt.file, tt.vm))
+		})
+	}
+}
+
+func TestShellHandler_Record(t *testing.T) {
+	handler, server := newShellTestServer(t, 0)
+	handler.recordingsDir = t.TempDir()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/vms/test-vm/shell?record=true&cols=100&rows=30"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	var msg SessionMessage
+	require.NoError(t, json.Unmarshal(data, &msg))
+	require.NotEmpty(t, msg.Recording)
+
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("recorded\n")))
+	expectOutput(t, conn, "recorded")
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+	require.Eventually(t, func() bool { return sessionCount(handler) == 0 },
+		5*time.Second, 10*time.Millisecond)
+
+	// The recording is listed for the VM and downloads as a valid cast
+	r := chi.NewRouter()
+	r.Get("/api/vms/{name}/recordings", handler.ListRecordings)
+	r.Get("/api/vms/{name}/recordings/{file}", handler.GetRecording)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/vms/test-vm/recordings", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var list []RecordingInfo
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&list))
+	require.Len(t, list, 1)
+	assert.Equal(t, msg.Recording, list[0].Name)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/vms/test-vm/recordings/"+msg.Recording, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-asciicast", rec.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(rec.Body.String(), `{"version":2,"width":100,"height":30`), rec.Body.String())
+	assert.Contains(t, rec.Body.String(), "recorded")
+}
+
+func TestShellHandler_RecordingsForOtherVMs(t *testing.T) {
+	handler := NewShellHandler(nil, nil)
+	handler.recordingsDir = t.TempDir()
+	for _, name := range []string{"other-20260301-120000.cast", "test-vm-20260301-120000.cast"} {
+		require.NoError(t, os.WriteFile(filepath.Join(handler.recordingsDir, name), []byte("{}\n"), 0600))
+	}
+
+	get := func(path, file string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("name", "test-vm")
+		if file != "" {
+			rctx.URLParams.Add("file", file)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+		rec := httptest.NewRecorder()
+		if file != "" {
+			handler.GetRecording(rec, req)
+		} else {
+			handler.ListRecordings(rec, req)
+		}
+		return rec
+	}
+
+	rec := get("/api/vms/test-vm/recordings", "")
+	var list []RecordingInfo
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&list))
+	require.Len(t, list, 1)
+	assert.Equal(t, "test-vm-20260301-120000.cast", list[0].Name)
+
+	rec = get("/api/vms/test-vm/recordings/other-20260301-120000.cast", "other-20260301-120000.cast")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// PTY output is held for up to outputFlushDelay so bursts go out as one
+	// frame, or sent as soon as outputFlushSize bytes have built up
+	outputFlushDelay = 5 * time.Millisecond
+	outputFlushSize  = 32 << 10
+)
+
+// shellSession is a running `multipass shell` PTY that can outlive the
+// websocket it was started from, so a client can reattach after a brief
+// network drop instead of losing the shell and its foreground program
+type shellSession struct {
+	id     string
+	vmName string
+	ptmx   *os.File
+	cmd    *exec.Cmd
+
+	// mu guards conn, scrollback, and pending, and serializes all writes to conn
+	mu         sync.Mutex
+	conn       *websocket.Conn // attached client, nil while detached
+	expiry     *time.Timer     // pending cleanup while detached
+	scrollback *ringBuffer     // recent PTY output, replayed on attach
+	pending    []byte          // PTY output not yet sent to conn
+	flushArmed bool            // a flush of pending is scheduled
+	recorder   *castRecorder   // asciinema recording of the output, if requested
+
+	closeOnce sync.Once
+	done      chan struct{} // closed once the session has ended
+}
+
+func newShellSession(vmName string, cmd *exec.Cmd, ptmx *os.File, scrollbackSize int) *shellSession {
+	return &shellSession{
+		id:         uuid.New().String(),
+		vmName:     vmName,
+		ptmx:       ptmx,
+		cmd:        cmd,
+		scrollback: newRingBuffer(scrollbackSize),
+		done:       make(chan struct{}),
+	}
+}
+
+// attach makes conn the session's client, replacing (and closing) any
+// previously attached connection and cancelling a pending expiry. The
+// client is sent the session ID followed by the scrollback, under the same
+// lock as live output so nothing is lost or duplicated in between.
+func (s *shellSession) attach(conn *websocket.Conn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	if s.conn != nil && s.conn != conn {
+		s.conn.Close()
+	}
+	s.conn = conn
+	// Pending output is already in the scrollback sent below
+	s.pending = s.pending[:0]
+
+	msg := SessionMessage{Type: "session", ID: s.id}
+	if s.recorder != nil {
+		msg.Recording = s.recorder.name
+	}
+	data, _ := json.Marshal(msg)
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+
+	if history := s.scrollback.Bytes(); len(history) > 0 {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return conn.WriteMessage(websocket.BinaryMessage, history)
+	}
+	return nil
+}
+
+// detach drops conn if it is still the attached client and schedules
+// onExpire to run after grace unless a client reattaches first
+func (s *shellSession) detach(conn *websocket.Conn, grace time.Duration, onExpire func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != conn {
+		return // another client has already taken over
+	}
+	s.conn = nil
+	s.expiry = time.AfterFunc(grace, func() {
+		s.mu.Lock()
+		attached := s.conn != nil
+		s.mu.Unlock()
+		if !attached {
+			onExpire()
+		}
+	})
+}
+
+// write sends a message to conn if it is still the attached client
+func (s *shellSession) write(conn *websocket.Conn, msgType int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != conn {
+		return websocket.ErrCloseSent
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(msgType, data)
+}
+
+// pump copies PTY output to whichever client is attached and records it in
+// the scrollback. Small reads are coalesced into fewer, larger frames.
+// Calls onExit when the shell process ends.
+func (s *shellSession) pump(onExit func()) {
+	defer onExit()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.ptmx.Read(buf)
+		if err != nil {
+			s.mu.Lock()
+			s.flushLocked()
+			s.mu.Unlock()
+			return
+		}
+
+		s.mu.Lock()
+		s.scrollback.Write(buf[:n])
+		if s.recorder != nil {
+			s.recorder.output(buf[:n], time.Now())
+		}
+		s.pending = append(s.pending, buf[:n]...)
+		if len(s.pending) >= outputFlushSize {
+			s.flushLocked()
+		} else if !s.flushArmed {
+			s.flushArmed = true
+			time.AfterFunc(outputFlushDelay, s.flush)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// flush sends pending output to the attached client
+func (s *shellSession) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+}
+
+// flushLocked sends pending output; the caller holds mu. Output produced
+// while detached is dropped here since attach replays it from the scrollback.
+func (s *shellSession) flushLocked() {
+	s.flushArmed = false
+	if len(s.pending) == 0 {
+		return
+	}
+	if s.conn != nil {
+		s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := s.conn.WriteMessage(websocket.BinaryMessage, s.pending); err != nil {
+			// The client's read loop will notice and detach
+			s.conn.Close()
+		}
+	}
+	s.pending = s.pending[:0]
+}
+
+// resize changes the PTY size and records it if the session is recorded
+func (s *shellSession) resize(rows, cols uint16) {
+	pty.Setsize(s.ptmx, &pty.Winsize{Rows: rows, Cols: cols})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recorder != nil {
+		s.recorder.resize(int(cols), int(rows), time.Now())
+	}
+}
+
+// close kills the shell and disconnects any attached client
+func (s *shellSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.mu.Lock()
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		if s.recorder != nil {
+			s.recorder.close(time.Now())
+			s.recorder = nil
+		}
+		s.mu.Unlock()
+
+		s.ptmx.Close()
+		if s.cmd.Process != nil {
+			s.cmd.Process.Kill()
+			s.cmd.Wait() // Reap the zombie process
+		}
+	})
+}
+
+// closed reports whether the session has ended
+func (s *shellSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// isAttached reports whether conn is the session's current client
+func (s *shellSession) isAttached(conn *websocket.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn == conn
+}
+
+// ringBuffer keeps the most recent bytes written to it, up to a fixed size
+type ringBuffer struct {
+	buf   []byte
+	start int // index of the oldest byte
+	size  int // number of valid bytes
+}
+
+func newRingBuffer(capacity int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, capacity)}
+}
+
+// Write appends p, discarding the oldest bytes once the buffer is full
+func (b *ringBuffer) Write(p []byte) {
+	capacity := len(b.buf)
+	if capacity == 0 {
+		return
+	}
+	if len(p) >= capacity {
+		copy(b.buf, p[len(p)-capacity:])
+		b.start, b.size = 0, capacity
+		return
+	}
+
+	end := (b.start + b.size) % capacity
+	n := copy(b.buf[end:], p)
+	copy(b.buf, p[n:])
+
+	b.size += len(p)
+	if b.size > capacity {
+		b.start = (b.start + b.size - capacity) % capacity
+		b.size = capacity
+	}
+}
+
+// Bytes returns a copy of the buffered bytes, oldest first
+func (b *ringBuffer) Bytes() []byte {
+	out := make([]byte, b.size)
+	n := copy(out, b.buf[b.start:min(b.start+b.size, len(b.buf))])
+	copy(out[n:], b.buf[:b.size-n])
+	return out
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		writes   []string
+		expected string
+	}{
+		{"empty", 8, nil, ""},
+		{"under_capacity", 8, []string{"abc", "de"}, "abcde"},
+		{"exact_capacity", 4, []string{"ab", "cd"}, "abcd"},
+		{"overflow_drops_oldest", 4, []string{"abc", "def"}, "cdef"},
+		{"wraps_repeatedly", 5, []string{"abc", "def", "gh", "i"}, "efghi"},
+		{"single_write_larger_than_capacity", 3, []string{"abcdef"}, "def"},
+		{"large_write_after_wrap", 4, []string{"ab", "cde", "fghijk"}, "hijk"},
+		{"zero_capacity_keeps_nothing", 0, []string{"abc"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newRingBuffer(tt.capacity)
+			for _, w := range tt.writes {
+				b.Write([]byte(w))
+			}
+			assert.Equal(t, tt.expected, string(b.Bytes()))
+		})
+	}
+}
@@ -2,12 +2,19 @@ package handlers
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os/exec"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/mjshashank/dabbi/internal/config"
 	"github.com/mjshashank/dabbi/internal/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -18,6 +25,7 @@ func TestCheckOrigin(t *testing.T) {
 		name       string
 		origin     string
 		host       string
+		allowed    []string
 		shouldPass bool
 	}{
 		// Cases that should ALLOW
@@ -81,6 +89,20 @@ func TestCheckOrigin(t *testing.T) {
 			host:       "example.com",
 			shouldPass: true,
 		},
+		{
+			name:       "configured_origin_allowed",
+			origin:     "https://dabbi.internal.example.com",
+			host:       "10.0.0.5:8080",
+			allowed:    []string{"https://dabbi.internal.example.com"},
+			shouldPass: true,
+		},
+		{
+			name:       "configured_origin_with_port_allowed",
+			origin:     "http://dashboard.corp:9000",
+			host:       "10.0.0.5:8080",
+			allowed:    []string{"https://other.corp", "http://dashboard.corp:9000/"},
+			shouldPass: true,
+		},
 
 		// Cases that should BLOCK
 		{
@@ -143,6 +165,27 @@ func TestCheckOrigin(t *testing.T) {
 			host:       "localhost:8080",
 			shouldPass: false,
 		},
+		{
+			name:       "configured_origin_scheme_mismatch_blocked",
+			origin:     "http://dabbi.internal.example.com",
+			host:       "10.0.0.5:8080",
+			allowed:    []string{"https://dabbi.internal.example.com"},
+			shouldPass: false,
+		},
+		{
+			name:       "configured_origin_port_mismatch_blocked",
+			origin:     "http://dashboard.corp:9001",
+			host:       "10.0.0.5:8080",
+			allowed:    []string{"http://dashboard.corp:9000"},
+			shouldPass: false,
+		},
+		{
+			name:       "configured_origin_subdomain_blocked",
+			origin:     "https://evil.dabbi.internal.example.com",
+			host:       "10.0.0.5:8080",
+			allowed:    []string{"https://dabbi.internal.example.com"},
+			shouldPass: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -153,7 +196,7 @@ func TestCheckOrigin(t *testing.T) {
 			}
 			req.Host = tt.host
 
-			result := checkOrigin(req)
+			result := checkOrigin(req, tt.allowed)
 			assert.Equal(t, tt.shouldPass, result, "checkOrigin should return %v for origin=%q, host=%q", tt.shouldPass, tt.origin, tt.host)
 		})
 	}
@@ -163,7 +206,7 @@ func TestShellHandler_VMNotFound(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
 	mockMP.On("Info", "nonexistent-vm").Return(nil, errors.New("VM not found"))
 
-	handler := NewShellHandler(mockMP)
+	handler := NewShellHandler(mockMP, config.DefaultConfig())
 
 	req := httptest.NewRequest(http.MethodGet, "/api/vms/nonexistent-vm/shell", nil)
 	rctx := chi.NewRouteContext()
@@ -182,7 +225,7 @@ func TestShellHandler_VMNotRunning(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
 	mockMP.On("Info", "stopped-vm").Return(testutil.StoppedVM("stopped-vm"), nil)
 
-	handler := NewShellHandler(mockMP)
+	handler := NewShellHandler(mockMP, config.DefaultConfig())
 
 	req := httptest.NewRequest(http.MethodGet, "/api/vms/stopped-vm/shell", nil)
 	rctx := chi.NewRouteContext()
@@ -221,7 +264,7 @@ func TestShellHandler_ParsesInitialSize(t *testing.T) {
 			mockMP := new(testutil.MockMultipassClient)
 			mockMP.On("Info", tt.vmName).Return(testutil.StoppedVM(tt.vmName), nil)
 
-			handler := NewShellHandler(mockMP)
+			handler := NewShellHandler(mockMP, config.DefaultConfig())
 
 			url := "/api/vms/" + tt.vmName + "/shell"
 			if tt.cols != "" || tt.rows != "" {
@@ -252,8 +295,225 @@ func TestShellHandler_ParsesInitialSize(t *testing.T) {
 
 func TestNewShellHandler(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
-	handler := NewShellHandler(mockMP)
+	handler := NewShellHandler(mockMP, config.DefaultConfig())
 
 	require.NotNil(t, handler)
 	assert.Equal(t, mockMP, handler.mp)
 }
+
+// newShellTestServer serves the shell handler with `cat` standing in for
+// `multipass shell`, so input is echoed back through a real PTY
+func newShellTestServer(t testing.TB, graceSecs int) (*ShellHandler, *httptest.Server) {
+	t.Helper()
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+
+	cfg := config.DefaultConfig()
+	cfg.ShellResumeGraceSecs = graceSecs
+	handler := NewShellHandler(mockMP, cfg)
+	handler.shellCommand = func(string) *exec.Cmd { return exec.Command("cat") }
+
+	r := chi.NewRouter()
+	r.Get("/api/vms/{name}/shell", handler.Handle)
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	t.Cleanup(func() {
+		handler.sessionsMu.Lock()
+		sessions := make([]*shellSession, 0, len(handler.sessions))
+		for _, s := range handler.sessions {
+			sessions = append(sessions, s)
+		}
+		handler.sessionsMu.Unlock()
+		for _, s := range sessions {
+			handler.endSession(s)
+		}
+	})
+
+	return handler, server
+}
+
+// dialShell connects to the shell and returns the connection and session ID
+func dialShell(t *testing.T, server *httptest.Server, sessionID string) (*websocket.Conn, string) {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/vms/test-vm/shell"
+	if sessionID != "" {
+		url += "?session=" + sessionID
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msgType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		if msgType != websocket.TextMessage {
+			continue
+		}
+		var msg SessionMessage
+		require.NoError(t, json.Unmarshal(data, &msg))
+		require.Equal(t, "session", msg.Type)
+		return conn, msg.ID
+	}
+}
+
+// expectOutput reads PTY output until it contains want
+func expectOutput(t *testing.T, conn *websocket.Conn, want string) {
+	t.Helper()
+
+	var out strings.Builder
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !strings.Contains(out.String(), want) {
+		_, data, err := conn.ReadMessage()
+		require.NoError(t, err, "output so far: %q", out.String())
+		out.Write(data)
+	}
+}
+
+func sessionCount(h *ShellHandler) int {
+	h.sessionsMu.Lock()
+	defer h.sessionsMu.Unlock()
+	return len(h.sessions)
+}
+
+func TestShellHandler_ResumeAfterDrop(t *testing.T) {
+	handler, server := newShellTestServer(t, 60)
+
+	conn, id := dialShell(t, server, "")
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("first\n")))
+	expectOutput(t, conn, "first")
+
+	// Drop the connection without a close frame, like a network blip
+	conn.UnderlyingConn().Close()
+
+	conn2, id2 := dialShell(t, server, id)
+	defer conn2.Close()
+	assert.Equal(t, id, id2, "reconnect should reattach to the same session")
+
+	require.NoError(t, conn2.WriteMessage(websocket.BinaryMessage, []byte("second\n")))
+	expectOutput(t, conn2, "second")
+	assert.Equal(t, 1, sessionCount(handler))
+}
+
+func TestShellHandler_CleanCloseEndsSession(t *testing.T) {
+	handler, server := newShellTestServer(t, 60)
+
+	conn, _ := dialShell(t, server, "")
+	conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+
+	assert.Eventually(t, func() bool { return sessionCount(handler) == 0 },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestShellHandler_DroppedSessionExpires(t *testing.T) {
+	handler, server := newShellTestServer(t, 1)
+
+	conn, id := dialShell(t, server, "")
+	conn.UnderlyingConn().Close()
+
+	assert.Eventually(t, func() bool { return sessionCount(handler) == 0 },
+		5*time.Second, 10*time.Millisecond)
+
+	// An expired session ID starts a fresh shell
+	conn2, id2 := dialShell(t, server, id)
+	defer conn2.Close()
+	assert.NotEqual(t, id, id2)
+}
+
+func TestShellHandler_UnknownSessionStartsNew(t *testing.T) {
+	handler, server := newShellTestServer(t, 60)
+
+	conn, id := dialShell(t, server, "does-not-exist")
+	defer conn.Close()
+
+	assert.NotEqual(t, "does-not-exist", id)
+	assert.Equal(t, 1, sessionCount(handler))
+}
+
+func TestShellHandler_ReplaysScrollbackOnResume(t *testing.T) {
+	_, server := newShellTestServer(t, 60)
+
+	conn, id := dialShell(t, server, "")
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("history\n")))
+	expectOutput(t, conn, "history")
+	conn.UnderlyingConn().Close()
+
+	// The new connection sees earlier output without sending anything
+	conn2, _ := dialShell(t, server, id)
+	defer conn2.Close()
+	expectOutput(t, conn2, "history")
+}
+
+func TestShellHandler_CompressionWithResize(t *testing.T) {
+	handler, server := newShellTestServer(t, 0)
+	handler.shellCommand = func(string) *exec.Cmd { return exec.Command("sh") }
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/vms/test-vm/shell"
+	conn, resp, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Contains(t, resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+
+	// Resize control messages are still plain JSON text frames
+	resize, _ := json.Marshal(ResizeMessage{Type: "resize", Rows: 40, Cols: 100})
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, resize))
+	require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("stty size\n")))
+	expectOutput(t, conn, "40 100")
+}
+
+// countingConn counts bytes read off the wire, after any compression
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// BenchmarkShellOutput streams 1MiB of `yes` output through the shell and
+// reports websocket frames and wire bytes per run
+func BenchmarkShellOutput(b *testing.B) {
+	handler, server := newShellTestServer(b, 0)
+	handler.shellCommand = func(string) *exec.Cmd {
+		return exec.Command("sh", "-c", "yes | head -c 1048576")
+	}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/vms/test-vm/shell"
+
+	var frames, wire int64
+	for i := 0; i < b.N; i++ {
+		var counter *countingConn
+		dialer := websocket.Dialer{
+			EnableCompression: true,
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				counter = &countingConn{Conn: conn}
+				return counter, err
+			},
+		}
+		conn, _, err := dialer.Dial(url, nil)
+		require.NoError(b, err)
+
+		// Read until the shell exits and the server closes the connection
+		for {
+			msgType, _, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			if msgType == websocket.BinaryMessage {
+				frames++
+			}
+		}
+		wire += counter.n
+		conn.Close()
+	}
+
+	b.ReportMetric(float64(frames)/float64(b.N), "frames/op")
+	b.ReportMetric(float64(wire)/float64(b.N), "wire-bytes/op")
+}
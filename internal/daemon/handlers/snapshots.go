@@ -3,8 +3,11 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/audit"
 	"github.com/mjshashank/dabbi/internal/multipass"
 )
 
@@ -24,13 +27,105 @@ func (h *SnapshotHandler) List(w http.ResponseWriter, r *http.Request) {
 
 	snapshots, err := h.mp.ListSnapshots(vmName)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
 	respondJSON(w, http.StatusOK, snapshots)
 }
 
+// ListAll returns every VM's snapshots, keyed by VM name then snapshot
+// name, from one multipass call. VMs without snapshots are left out.
+// GET /api/snapshots
+func (h *SnapshotHandler) ListAll(w http.ResponseWriter, r *http.Request) {
+	snapshots, err := h.mp.ListAllSnapshots()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, snapshots)
+}
+
+// SnapshotNode is a snapshot and the snapshots taken on top of it
+type SnapshotNode struct {
+	Name     string          `json:"name"`
+	Comment  string          `json:"comment,omitempty"`
+	Children []*SnapshotNode `json:"children"`
+}
+
+// SnapshotTree is a VM's snapshots arranged by parent. Snapshots whose parent
+// no longer exists are listed in Orphans and also appear as roots. Snapshots
+// whose parent chain loops are listed in Cycles and left out of the tree.
+type SnapshotTree struct {
+	Roots   []*SnapshotNode `json:"roots"`
+	Orphans []string        `json:"orphans,omitempty"`
+	Cycles  []string        `json:"cycles,omitempty"`
+}
+
+// Tree returns a VM's snapshots as a parent->children tree
+// GET /api/vms/{name}/snapshots/tree
+func (h *SnapshotHandler) Tree(w http.ResponseWriter, r *http.Request) {
+	vmName := chi.URLParam(r, "name")
+
+	snapshots, err := h.mp.ListSnapshots(vmName)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, buildSnapshotTree(snapshots))
+}
+
+// buildSnapshotTree links snapshots to their parents. Siblings are sorted by
+// name so the output is stable.
+func buildSnapshotTree(snapshots map[string]multipass.Snapshot) SnapshotTree {
+	names := make([]string, 0, len(snapshots))
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nodes := make(map[string]*SnapshotNode, len(snapshots))
+	for _, name := range names {
+		nodes[name] = &SnapshotNode{Name: name, Comment: snapshots[name].Comment, Children: []*SnapshotNode{}}
+	}
+
+	tree := SnapshotTree{Roots: []*SnapshotNode{}}
+	for _, name := range names {
+		parent := snapshots[name].Parent
+		switch {
+		case parent == "":
+			tree.Roots = append(tree.Roots, nodes[name])
+		case nodes[parent] == nil:
+			tree.Orphans = append(tree.Orphans, name)
+			tree.Roots = append(tree.Roots, nodes[name])
+		default:
+			nodes[parent].Children = append(nodes[parent].Children, nodes[name])
+		}
+	}
+
+	// Anything not reachable from a root sits on (or under) a parent cycle
+	reached := make(map[string]bool, len(nodes))
+	var walk func(n *SnapshotNode)
+	walk = func(n *SnapshotNode) {
+		reached[n.Name] = true
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	for _, root := range tree.Roots {
+		walk(root)
+	}
+	for _, name := range names {
+		if !reached[name] {
+			tree.Cycles = append(tree.Cycles, name)
+		}
+	}
+
+	return tree
+}
+
 // CreateSnapshotRequest represents a snapshot creation request
 type CreateSnapshotRequest struct {
 	Name string `json:"name,omitempty"`
@@ -42,12 +137,12 @@ func (h *SnapshotHandler) Create(w http.ResponseWriter, r *http.Request) {
 
 	var req CreateSnapshotRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err.Error() != "EOF" {
-		respondError(w, http.StatusBadRequest, err)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
 	if err := h.mp.CreateSnapshot(vmName, req.Name); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
@@ -58,29 +153,48 @@ func (h *SnapshotHandler) Create(w http.ResponseWriter, r *http.Request) {
 type RestoreSnapshotRequest struct {
 	SnapshotName string `json:"snapshot_name"`
 	Destructive  bool   `json:"destructive,omitempty"`
+	AutoSnapshot bool   `json:"auto_snapshot,omitempty"` // with destructive, save the current state first
 }
 
-// Restore restores a snapshot
+// RestoreSnapshotResponse reports a restore and any safety snapshot taken
+type RestoreSnapshotResponse struct {
+	Status         string `json:"status"`
+	SafetySnapshot string `json:"safety_snapshot,omitempty"`
+}
+
+// Restore restores a snapshot. A destructive restore with auto_snapshot
+// stops the VM and snapshots it as pre-restore-<timestamp> first.
 func (h *SnapshotHandler) Restore(w http.ResponseWriter, r *http.Request) {
 	vmName := chi.URLParam(r, "name")
 
 	var req RestoreSnapshotRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
 	if req.SnapshotName == "" {
-		http.Error(w, `{"error": "snapshot_name is required"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "snapshot_name is required")
+		return
+	}
+	audit.SetDetail(r.Context(), req.SnapshotName)
+
+	if req.Destructive && req.AutoSnapshot {
+		safety, err := multipass.RestoreWithSafetySnapshot(h.mp, vmName, req.SnapshotName, time.Now())
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+		respondJSON(w, http.StatusOK, RestoreSnapshotResponse{Status: "restored", SafetySnapshot: safety})
 		return
 	}
 
 	if err := h.mp.RestoreSnapshot(vmName, req.SnapshotName, req.Destructive); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]string{"status": "restored"})
+	respondJSON(w, http.StatusOK, RestoreSnapshotResponse{Status: "restored"})
 }
 
 // Delete removes a snapshot
@@ -89,7 +203,7 @@ func (h *SnapshotHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	snapName := chi.URLParam(r, "snap")
 
 	if err := h.mp.DeleteSnapshot(vmName, snapName); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// newRestoreRequest builds a snapshot restore request for the given VM
+func newRestoreRequest(t *testing.T, vmName string, body RestoreSnapshotRequest) *http.Request {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/"+vmName+"/snapshots/restore", bytes.NewReader(data))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", vmName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestSnapshotHandler_Restore_AutoSnapshotOrdering(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewSnapshotHandler(mockMP)
+
+	var calls []string
+	record := func(name string) func(mock.Arguments) {
+		return func(mock.Arguments) { calls = append(calls, name) }
+	}
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.On("Stop", "test-vm").Run(record("stop")).Return(nil)
+	mockMP.On("CreateSnapshot", "test-vm", mock.MatchedBy(func(name string) bool {
+		return strings.HasPrefix(name, multipass.SafetySnapshotPrefix)
+	})).Run(record("snapshot")).Return(nil)
+	mockMP.On("RestoreSnapshot", "test-vm", "snap1", true).Run(record("restore")).Return(nil)
+
+	rec := httptest.NewRecorder()
+	handler.Restore(rec, newRestoreRequest(t, "test-vm", RestoreSnapshotRequest{
+		SnapshotName: "snap1",
+		Destructive:  true,
+		AutoSnapshot: true,
+	}))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, []string{"stop", "snapshot", "restore"}, calls)
+
+	var resp RestoreSnapshotResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "restored", resp.Status)
+	assert.Regexp(t, `^pre-restore-\d{8}-\d{6}$`, resp.SafetySnapshot)
+	mockMP.AssertExpectations(t)
+}
+
+func TestSnapshotHandler_Restore_AutoSnapshotStoppedVM(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewSnapshotHandler(mockMP)
+
+	mockMP.On("Info", "test-vm").Return(testutil.StoppedVM("test-vm"), nil)
+	mockMP.On("CreateSnapshot", "test-vm", mock.Anything).Return(nil)
+	mockMP.On("RestoreSnapshot", "test-vm", "snap1", true).Return(errors.New("restore failed"))
+
+	rec := httptest.NewRecorder()
+	handler.Restore(rec, newRestoreRequest(t, "test-vm", RestoreSnapshotRequest{
+		SnapshotName: "snap1",
+		Destructive:  true,
+		AutoSnapshot: true,
+	}))
+
+	// Already stopped, so no Stop; the error names the safety snapshot
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	var resp errorResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Contains(t, resp.Error.Message, multipass.SafetySnapshotPrefix)
+	mockMP.AssertNotCalled(t, "Stop", mock.Anything)
+}
+
+func TestSnapshotHandler_Restore_SnapshotFailureSkipsRestore(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewSnapshotHandler(mockMP)
+
+	mockMP.On("Info", "test-vm").Return(testutil.StoppedVM("test-vm"), nil)
+	mockMP.On("CreateSnapshot", "test-vm", mock.Anything).Return(errors.New("disk full"))
+
+	rec := httptest.NewRecorder()
+	handler.Restore(rec, newRestoreRequest(t, "test-vm", RestoreSnapshotRequest{
+		SnapshotName: "snap1",
+		Destructive:  true,
+		AutoSnapshot: true,
+	}))
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	mockMP.AssertNotCalled(t, "RestoreSnapshot", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSnapshotHandler_Restore_WithoutAutoSnapshot(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewSnapshotHandler(mockMP)
+
+	mockMP.On("RestoreSnapshot", "test-vm", "snap1", true).Return(nil)
+
+	rec := httptest.NewRecorder()
+	handler.Restore(rec, newRestoreRequest(t, "test-vm", RestoreSnapshotRequest{
+		SnapshotName: "snap1",
+		Destructive:  true,
+	}))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.NotContains(t, body, "safety_snapshot")
+	mockMP.AssertNotCalled(t, "CreateSnapshot", mock.Anything, mock.Anything)
+}
+
+func TestSnapshotHandler_Tree(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewSnapshotHandler(mockMP)
+	mockMP.On("ListSnapshots", "test-vm").Return(testutil.TestSnapshots(), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/test-vm/snapshots/tree", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "test-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+
+	handler.Tree(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var tree SnapshotTree
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&tree))
+	require.Len(t, tree.Roots, 1)
+	assert.Equal(t, "snap1", tree.Roots[0].Name)
+	assert.Equal(t, "Before update", tree.Roots[0].Comment)
+	require.Len(t, tree.Roots[0].Children, 1)
+	assert.Equal(t, "snap2", tree.Roots[0].Children[0].Name)
+	assert.Empty(t, tree.Roots[0].Children[0].Children)
+	assert.Empty(t, tree.Orphans)
+	assert.Empty(t, tree.Cycles)
+}
+
+func TestSnapshotHandler_ListAll(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewSnapshotHandler(mockMP)
+	mockMP.On("ListAllSnapshots").Return(map[string]map[string]multipass.Snapshot{
+		"test-vm": testutil.TestSnapshots(),
+		"db":      {"nightly": {Comment: "cron"}},
+	}, nil)
+
+	rec := httptest.NewRecorder()
+	handler.ListAll(rec, httptest.NewRequest(http.MethodGet, "/api/snapshots", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var got map[string]map[string]multipass.Snapshot
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Len(t, got, 2)
+	assert.Equal(t, testutil.TestSnapshots(), got["test-vm"])
+	assert.Equal(t, "cron", got["db"]["nightly"].Comment)
+	mockMP.AssertNotCalled(t, "ListSnapshots", mock.Anything)
+}
+
+func TestSnapshotHandler_ListAll_Error(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	handler := NewSnapshotHandler(mockMP)
+	mockMP.On("ListAllSnapshots").Return(nil, errors.New("multipass unavailable"))
+
+	rec := httptest.NewRecorder()
+	handler.ListAll(rec, httptest.NewRequest(http.MethodGet, "/api/snapshots", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestBuildSnapshotTree(t *testing.T) {
+	tree := buildSnapshotTree(map[string]multipass.Snapshot{
+		"base":    {},
+		"step1":   {Parent: "base"},
+		"step2":   {Parent: "step1"},
+		"step3":   {Parent: "step2"},
+		"branch":  {Parent: "step1"},
+		"stray":   {Parent: "deleted"},
+		"loop-a":  {Parent: "loop-b"},
+		"loop-b":  {Parent: "loop-a"},
+		"on-loop": {Parent: "loop-a"},
+		"other":   {},
+	})
+
+	names := func(nodes []*SnapshotNode) []string {
+		out := make([]string, len(nodes))
+		for i, n := range nodes {
+			out[i] = n.Name
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{"base", "other", "stray"}, names(tree.Roots))
+	base := tree.Roots[0]
+	require.Len(t, base.Children, 1)
+	step1 := base.Children[0]
+	assert.Equal(t, []string{"branch", "step2"}, names(step1.Children))
+	assert.Equal(t, []string{"step3"}, names(step1.Children[1].Children))
+
+	assert.Equal(t, []string{"stray"}, tree.Orphans)
+	assert.Equal(t, []string{"loop-a", "loop-b", "on-loop"}, tree.Cycles)
+}
+
+func TestBuildSnapshotTree_Empty(t *testing.T) {
+	tree := buildSnapshotTree(nil)
+
+	data, err := json.Marshal(tree)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"roots":[]}`, string(data))
+}
@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/audit"
 	"github.com/mjshashank/dabbi/internal/tunnel"
 )
 
@@ -22,21 +25,31 @@ func NewTunnelHandler(tm *tunnel.Manager) *TunnelHandler {
 
 // TunnelInfo represents tunnel information in API responses
 type TunnelInfo struct {
-	HostPort int    `json:"host_port"`
-	VMName   string `json:"vm_name"`
-	VMPort   int    `json:"vm_port"`
+	HostPort      int    `json:"host_port"`
+	VMName        string `json:"vm_name"`
+	VMPort        int    `json:"vm_port"`
+	RateLimitKBps int    `json:"rate_limit_kbps,omitempty"`
+	Stable        bool   `json:"stable,omitempty"`
 }
 
-// List returns all active tunnels
+// List returns all active tunnels, or with ?vm=<name> only that VM's
+// GET /api/tunnels
 func (h *TunnelHandler) List(w http.ResponseWriter, r *http.Request) {
-	tunnels := h.tm.List()
+	var tunnels []*tunnel.Tunnel
+	if vm := r.URL.Query().Get("vm"); vm != "" {
+		tunnels = h.tm.ListByVM(vm)
+	} else {
+		tunnels = h.tm.List()
+	}
 
 	var info []TunnelInfo
 	for _, t := range tunnels {
 		info = append(info, TunnelInfo{
-			HostPort: t.HostPort,
-			VMName:   t.VMName,
-			VMPort:   t.VMPort,
+			HostPort:      t.HostPort,
+			VMName:        t.VMName,
+			VMPort:        t.VMPort,
+			RateLimitKBps: t.RateLimitKBps,
+			Stable:        t.Stable,
 		})
 	}
 
@@ -45,38 +58,57 @@ func (h *TunnelHandler) List(w http.ResponseWriter, r *http.Request) {
 
 // CreateTunnelRequest represents a tunnel creation request
 type CreateTunnelRequest struct {
-	VMName string `json:"vm_name"`
-	VMPort int    `json:"vm_port"`
+	VMName        string `json:"vm_name"`
+	VMPort        int    `json:"vm_port"`
+	RateLimitKBps int    `json:"rate_limit_kbps,omitempty"` // 0 = unlimited
+	Stable        bool   `json:"stable,omitempty"`          // derive the host port from vm_name and vm_port
 }
 
 // Create creates a new tunnel
 func (h *TunnelHandler) Create(w http.ResponseWriter, r *http.Request) {
 	var req CreateTunnelRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
 	if req.VMName == "" || req.VMPort == 0 {
-		http.Error(w, `{"error": "vm_name and vm_port are required"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "vm_name and vm_port are required")
+		return
+	}
+	audit.SetVM(r.Context(), req.VMName)
+	audit.SetDetail(r.Context(), fmt.Sprintf("port %d", req.VMPort))
+
+	if req.RateLimitKBps < 0 {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "rate_limit_kbps cannot be negative")
 		return
 	}
 
-	t, err := h.tm.Create(req.VMName, req.VMPort)
+	create := h.tm.CreateWithRateLimit
+	if req.Stable {
+		create = h.tm.CreateStable
+	}
+	t, err := create(req.VMName, req.VMPort, req.RateLimitKBps)
 	if err != nil {
 		// Return 400 for user errors like VM not running
 		if strings.Contains(err.Error(), "not running") {
-			respondError(w, http.StatusBadRequest, err)
+			apiError(w, http.StatusBadRequest, ErrCodeVMNotRunning, err.Error())
+			return
+		}
+		if errors.Is(err, tunnel.ErrRateLimitChanged) {
+			apiError(w, http.StatusConflict, ErrCodeInvalidRequest, err.Error())
 			return
 		}
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
 	respondJSON(w, http.StatusCreated, TunnelInfo{
-		HostPort: t.HostPort,
-		VMName:   t.VMName,
-		VMPort:   t.VMPort,
+		HostPort:      t.HostPort,
+		VMName:        t.VMName,
+		VMPort:        t.VMPort,
+		RateLimitKBps: t.RateLimitKBps,
+		Stable:        t.Stable,
 	})
 }
 
@@ -85,12 +117,12 @@ func (h *TunnelHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	portStr := chi.URLParam(r, "port")
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		http.Error(w, `{"error": "invalid port"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid port")
 		return
 	}
 
 	if err := h.tm.Delete(port); err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusNotFound, ErrCodeNotFound, err.Error())
 		return
 	}
 
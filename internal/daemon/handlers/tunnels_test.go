@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/mjshashank/dabbi/internal/tunnel"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelHandler_List_FilterByVM(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "192.0.2.1"), nil)
+	mockMP.On("Info", "vm2").Return(testutil.RunningVM("vm2", "192.0.2.2"), nil)
+
+	tm := tunnel.NewManager(mockMP)
+	defer tm.DeleteVM("vm1")
+	defer tm.DeleteVM("vm2")
+	for _, vm := range []string{"vm1", "vm1", "vm2"} {
+		_, err := tm.Create(vm, 8080)
+		require.NoError(t, err)
+	}
+	handler := NewTunnelHandler(tm)
+
+	list := func(url string) []TunnelInfo {
+		rec := httptest.NewRecorder()
+		handler.List(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var info []TunnelInfo
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+		return info
+	}
+
+	assert.Len(t, list("/api/tunnels"), 3)
+
+	vm1 := list("/api/tunnels?vm=vm1")
+	require.Len(t, vm1, 2)
+	for _, info := range vm1 {
+		assert.Equal(t, "vm1", info.VMName)
+	}
+
+	vm2 := list("/api/tunnels?vm=vm2")
+	require.Len(t, vm2, 1)
+	assert.Equal(t, "vm2", vm2[0].VMName)
+
+	assert.Empty(t, list("/api/tunnels?vm=missing"))
+}
+
+func TestTunnelHandler_Create_Stable(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "db").Return(testutil.RunningVM("db", "192.0.2.1"), nil)
+
+	tm := tunnel.NewManager(mockMP)
+	defer tm.DeleteVM("db")
+	handler := NewTunnelHandler(tm)
+
+	create := func() TunnelInfo {
+		body := `{"vm_name": "db", "vm_port": 5432, "stable": true}`
+		rec := httptest.NewRecorder()
+		handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/tunnels", strings.NewReader(body)))
+		require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+		var info TunnelInfo
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&info))
+		return info
+	}
+
+	first := create()
+	assert.True(t, first.Stable)
+	base, count := tunnel.DefaultStableBasePort, tunnel.DefaultStablePortRange
+	assert.GreaterOrEqual(t, first.HostPort, base)
+	assert.Less(t, first.HostPort, base+count)
+
+	// The open tunnel is reused rather than duplicated
+	assert.Equal(t, first, create())
+	assert.Len(t, tm.List(), 1)
+}
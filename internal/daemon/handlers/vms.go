@@ -2,218 +2,811 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/agent"
+	"github.com/mjshashank/dabbi/internal/audit"
 	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/jobs"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/mounts"
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/network"
+	"github.com/mjshashank/dabbi/internal/quota"
+	"github.com/mjshashank/dabbi/internal/sshagent"
+	"github.com/mjshashank/dabbi/internal/tunnel"
+	"github.com/mjshashank/dabbi/internal/vmspec"
+	"github.com/mjshashank/dabbi/internal/watchdog"
 )
 
 // VMHandler handles VM-related API requests
 type VMHandler struct {
-	mp  multipass.Client
-	cfg *config.Config
+	mp      multipass.Client
+	cfg     *config.Config
+	labels  *labels.Store
+	specs   *vmspec.Store     // what each VM was launched with
+	mounts  *mounts.Store     // how each VM's mounts were added
+	stops   *watchdog.StopLog // stop times, for the last activity of stopped VMs
+	jobs    *jobs.Registry    // async creates
+	applier *network.Applier  // reads network config for export
+	tunnels *tunnel.Manager   // closed for VMs that are stopped or deleted
+	agents  *agent.Manager    // same for agent listeners
 }
 
 // NewVMHandler creates a new VM handler
-func NewVMHandler(mp multipass.Client, cfg *config.Config) *VMHandler {
-	return &VMHandler{mp: mp, cfg: cfg}
+func NewVMHandler(mp multipass.Client, cfg *config.Config, ls *labels.Store, specs *vmspec.Store, ms *mounts.Store, stops *watchdog.StopLog, tm *tunnel.Manager, am *agent.Manager) *VMHandler {
+	return &VMHandler{mp: mp, cfg: cfg, labels: ls, specs: specs, mounts: ms, stops: stops, jobs: jobs.NewRegistry(), applier: newApplier(mp, cfg), tunnels: tm, agents: am}
 }
 
-// Defaults returns the default VM configuration values
-func (h *VMHandler) Defaults(w http.ResponseWriter, r *http.Request) {
-	cpu := h.cfg.Defaults.CPU
+// CloseListeners stops the daemon's tunnels and agent listener for a VM
+// that was stopped or deleted; they would otherwise keep their host ports
+// and proxy to an address nothing answers on. Either manager may be nil.
+func CloseListeners(tm *tunnel.Manager, am *agent.Manager, vmName string) {
+	if tm != nil {
+		tm.DeleteVM(vmName)
+	}
+	if am != nil {
+		am.Stop(vmName)
+	}
+}
+
+// jobPollInterval is how often an async create checks on the booting VM
+var jobPollInterval = 3 * time.Second
+
+// cloudInitLog is where cloud-init writes the output of its scripts
+const cloudInitLog = "/var/log/cloud-init-output.log"
+
+// VMDefaults are the settings used for new VMs when a create request
+// leaves them out
+type VMDefaults struct {
+	CPU       int    `json:"cpu"`
+	Mem       string `json:"mem"`
+	Disk      string `json:"disk"`
+	Image     string `json:"image,omitempty"`      // empty means multipass's default image
+	CloudInit string `json:"cloud_init,omitempty"` // empty means ~/.dabbi/cloud-init.yaml if it exists
+}
+
+// UpdateDefaultsRequest changes the defaults for new VMs. Omitted fields are
+// left as they are; an empty image or cloud_init clears it.
+type UpdateDefaultsRequest struct {
+	CPU       *int    `json:"cpu,omitempty"`
+	Mem       *string `json:"mem,omitempty"`
+	Disk      *string `json:"disk,omitempty"`
+	Image     *string `json:"image,omitempty"`
+	CloudInit *string `json:"cloud_init,omitempty"` // path to a cloud-init file on the host
+}
+
+// defaults returns the configured defaults with built-in fallbacks applied
+func (h *VMHandler) defaults() VMDefaults {
+	d := h.cfg.Snapshot().Defaults
+	cpu := d.CPU
 	if cpu == 0 {
 		cpu = 2
 	}
-	mem := h.cfg.Defaults.Mem
+	mem := d.Mem
 	if mem == "" {
 		mem = "4G"
 	}
-	disk := h.cfg.Defaults.Disk
+	disk := d.Disk
 	if disk == "" {
 		disk = "20G"
 	}
 
-	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"cpu":  cpu,
-		"mem":  mem,
-		"disk": disk,
+	return VMDefaults{
+		CPU:       cpu,
+		Mem:       mem,
+		Disk:      disk,
+		Image:     d.Image,
+		CloudInit: d.CloudInit,
+	}
+}
+
+// Defaults returns the default VM configuration values
+// GET /api/defaults
+func (h *VMHandler) Defaults(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, h.defaults())
+}
+
+// SetDefaults updates the default VM configuration and persists it to config
+// PUT /api/defaults
+func (h *VMHandler) SetDefaults(w http.ResponseWriter, r *http.Request) {
+	var req UpdateDefaultsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if req.CPU != nil && *req.CPU < 1 {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, "cpu must be at least 1")
+		return
+	}
+	if req.Mem != nil {
+		if _, err := multipass.ParseSize(*req.Mem); err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, "mem: "+err.Error())
+			return
+		}
+	}
+	if req.Disk != nil {
+		if _, err := multipass.ParseSize(*req.Disk); err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, "disk: "+err.Error())
+			return
+		}
+	}
+	if req.Image != nil {
+		if err := multipass.ValidateImage(*req.Image, ""); err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, err.Error())
+			return
+		}
+	}
+	if req.CloudInit != nil && *req.CloudInit != "" {
+		// GetCloudInitPath silently skips a missing file, so catch typos here
+		if info, err := os.Stat(*req.CloudInit); err != nil || info.IsDir() {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig,
+				fmt.Sprintf("cloud_init: %s is not a readable file", *req.CloudInit))
+			return
+		}
+	}
+
+	err := h.cfg.Update(func(cfg *config.Config) {
+		if req.CPU != nil {
+			cfg.Defaults.CPU = *req.CPU
+		}
+		if req.Mem != nil {
+			cfg.Defaults.Mem = *req.Mem
+		}
+		if req.Disk != nil {
+			cfg.Defaults.Disk = *req.Disk
+		}
+		if req.Image != nil {
+			cfg.Defaults.Image = *req.Image
+		}
+		if req.CloudInit != nil {
+			cfg.Defaults.CloudInit = *req.CloudInit
+		}
 	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, h.defaults())
+}
+
+// Activity is when a VM was last seen active, from the watchdog checkpoint of
+// a running VM or the recorded stop time of a stopped one. Both fields are
+// absent when neither is known.
+type Activity struct {
+	LastActivity *time.Time `json:"last_activity,omitempty"`
+	IdleSeconds  *int64     `json:"idle_seconds,omitempty"`
+}
+
+// VMListItem is a VM in the list response, with its host-side labels
+type VMListItem struct {
+	multipass.ListInstance
+	Activity
+	Labels map[string]string `json:"labels,omitempty"`
+	Pinned bool              `json:"pinned"` // excluded from prune and auto-shutdown
+}
+
+// VMDetail is a VM's info plus its last activity
+type VMDetail struct {
+	*multipass.InstanceInfo
+	Activity
+	Pinned bool `json:"pinned"`
+}
+
+// activity looks up a VM's last activity. Running VMs need an exec call.
+func (h *VMHandler) activity(vm multipass.ListInstance) Activity {
+	last, ok := watchdog.LastActivity(h.mp, h.stops, vm)
+	if !ok {
+		return Activity{}
+	}
+	idle := int64(time.Since(last).Seconds())
+	if idle < 0 {
+		idle = 0
+	}
+	return Activity{LastActivity: &last, IdleSeconds: &idle}
 }
 
-// List returns all VMs
+// List returns all VMs, optionally filtered by ?label=key=value (repeatable).
+// With ?activity=true each VM also gets its last activity.
+// GET /api/vms
 func (h *VMHandler) List(w http.ResponseWriter, r *http.Request) {
-	vms, err := h.mp.List()
+	vms, err := h.mp.ListContext(r.Context())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	allLabels, err := h.labels.All()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	selectors := r.URL.Query()["label"]
+	items := make([]VMListItem, 0, len(vms))
+	for _, vm := range vms {
+		vmLabels := allLabels[vm.Name]
+		if !matchesAll(vmLabels, selectors) {
+			continue
+		}
+		items = append(items, VMListItem{ListInstance: vm, Labels: vmLabels, Pinned: labels.IsPinned(vmLabels)})
+	}
+
+	if r.URL.Query().Get("activity") == "true" {
+		// One exec per running VM, so look them up concurrently
+		var wg sync.WaitGroup
+		for i := range items {
+			wg.Add(1)
+			go func(item *VMListItem) {
+				defer wg.Done()
+				item.Activity = h.activity(item.ListInstance)
+			}(&items[i])
+		}
+		wg.Wait()
+	}
+
+	respondJSON(w, http.StatusOK, items)
+}
+
+// matchesAll reports whether labels satisfy every selector
+func matchesAll(vmLabels map[string]string, selectors []string) bool {
+	for _, sel := range selectors {
+		if !labels.Matches(vmLabels, sel) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetLabels returns a VM's labels
+// GET /api/vms/{name}/labels
+func (h *VMHandler) GetLabels(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	vmLabels, err := h.labels.Get(name)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, vmLabels)
+}
+
+// SetLabels replaces a VM's labels with the key/value object in the body.
+// Reserved dabbi/ labels can't be set and are kept.
+// PUT /api/vms/{name}/labels
+func (h *VMHandler) SetLabels(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid JSON: expected an object of string labels")
+		return
+	}
+	if err := labels.Validate(req); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if _, err := h.mp.InfoContext(r.Context(), name); err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
+		return
+	}
+
+	if err := h.labels.Replace(name, req); err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
-	respondJSON(w, http.StatusOK, vms)
+	// Respond with the stored labels, which include any reserved ones kept
+	vmLabels, err := h.labels.Get(name)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, vmLabels)
 }
 
-// Get returns details for a single VM
+// Get returns details for a single VM, including its last activity
+// GET /api/vms/{name}
 func (h *VMHandler) Get(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
-	info, err := h.mp.Info(name)
+	info, err := h.mp.InfoContext(r.Context(), name)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
+		return
+	}
+
+	vmLabels, err := h.labels.Get(name)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, VMDetail{
+		InstanceInfo: info,
+		Activity:     h.activity(multipass.ListInstance{Name: name, State: info.State}),
+		Pinned:       labels.IsPinned(vmLabels),
+	})
+}
+
+// Pin excludes a VM from prune and the watchdog's auto-shutdown
+// POST /api/vms/{name}/pin
+func (h *VMHandler) Pin(w http.ResponseWriter, r *http.Request) {
+	h.setPinned(w, r, true)
+}
+
+// Unpin lets prune and the watchdog act on a VM again
+// DELETE /api/vms/{name}/pin
+func (h *VMHandler) Unpin(w http.ResponseWriter, r *http.Request) {
+	h.setPinned(w, r, false)
+}
+
+func (h *VMHandler) setPinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	name := chi.URLParam(r, "name")
+	if _, err := h.mp.InfoContext(r.Context(), name); err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
+		return
+	}
+
+	var err error
+	if pinned {
+		err = h.labels.Mark(name, labels.PinnedKey)
+	} else {
+		err = h.labels.Remove(name, labels.PinnedKey)
+	}
 	if err != nil {
-		respondError(w, http.StatusNotFound, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
-	respondJSON(w, http.StatusOK, info)
+	respondJSON(w, http.StatusOK, map[string]bool{"pinned": pinned})
+}
+
+// RevokeSSHAgent stops relaying the daemon's SSH agent to a VM created with
+// forward_ssh_agent. Recreating the VM grants it again.
+// DELETE /api/vms/{name}/ssh-agent
+func (h *VMHandler) RevokeSSHAgent(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := multipass.ValidateInstanceName(name); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	if err := h.specs.RevokeSSHAgent(name); err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
 }
 
 // CreateVMRequest represents a VM creation request
 type CreateVMRequest struct {
-	Name      string                   `json:"name"`
-	CPUs      int                      `json:"cpu,omitempty"`
-	Memory    string                   `json:"mem,omitempty"`
-	Disk      string                   `json:"disk,omitempty"`
-	CloudInit string                   `json:"cloud_init,omitempty"`
-	Image     string                   `json:"image,omitempty"`
-	Network   *multipass.NetworkConfig `json:"network,omitempty"`
+	Name            string                   `json:"name"`
+	CPUs            int                      `json:"cpu,omitempty"`
+	Memory          string                   `json:"mem,omitempty"`
+	Disk            string                   `json:"disk,omitempty"`
+	CloudInit       string                   `json:"cloud_init,omitempty"`
+	Image           string                   `json:"image,omitempty"`
+	ImageChecksum   string                   `json:"image_checksum,omitempty"` // sha256 of a file:// image
+	Networks        []string                 `json:"networks,omitempty"`       // host interfaces to bridge onto
+	Network         *multipass.NetworkConfig `json:"network,omitempty"`
+	Packages        []string                 `json:"packages,omitempty"`          // apt packages on top of defaults.extra_packages
+	ForwardSSHAgent bool                     `json:"forward_ssh_agent,omitempty"` // relay the daemon's SSH agent into the VM
+	Netplan         string                   `json:"netplan,omitempty"`           // path to a netplan config on the host, written into the VM
+
+	sshAgentSecret string // given to the VM's SSH agent relay; set by prepareCreate, never recorded in the spec
 }
 
-// Create creates a new VM
+// Create creates a new VM. With ?async=true it returns 202 and a job to
+// poll at /api/jobs/{id} instead of waiting for launch and cloud-init.
 func (h *VMHandler) Create(w http.ResponseWriter, r *http.Request) {
 	var req CreateVMRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+	audit.SetVM(r.Context(), req.Name)
+	if err := multipass.ValidateVMName(req.Name); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
-	if req.Name == "" {
-		http.Error(w, `{"error": "name is required"}`, http.StatusBadRequest)
+	modifiedContent, netConfig, ok := h.prepareCreate(w, &req)
+	if !ok || !h.checkLimits(w, req) {
+		return
+	}
+
+	// The file must survive until multipass has read it, i.e. until Launch returns
+	launchFile, err := h.cfg.WriteLaunchFile(req.Name, modifiedContent)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
+	opts := multipass.LaunchOptions{
+		Name:          req.Name,
+		CPUs:          req.CPUs,
+		Memory:        req.Memory,
+		Disk:          req.Disk,
+		CloudInit:     launchFile.Path,
+		Image:         req.Image,
+		ImageChecksum: req.ImageChecksum,
+		Networks:      req.Networks,
+		NetworkConfig: netConfig,
+	}
+
+	// Async: launching plus cloud-init can take minutes, so hand back a job
+	// to poll instead of holding the request open
+	if r.URL.Query().Get("async") == "true" {
+		job := h.jobs.Create(req.Name)
+		go func() {
+			defer releaseLaunchFile(launchFile)
+			if h.runLaunchJob(job.ID, opts) {
+				h.recordLaunch(req, modifiedContent)
+			}
+		}()
+		respondJSON(w, http.StatusAccepted, job)
+		return
+	}
+
+	// Launch VM synchronously so we can return errors to the user
+	err = h.mp.Launch(opts)
+	releaseLaunchFile(launchFile)
+	if err != nil {
+		launchError(w, err)
+		return
+	}
+	h.recordLaunch(req, modifiedContent)
+
+	respondJSON(w, http.StatusCreated, map[string]string{
+		"status": "created",
+		"name":   req.Name,
+	})
+}
+
+// checkLimits rejects a create that would take the host past the
+// limits in the config. req must have its defaults filled in. On failure it
+// writes the error response.
+func (h *VMHandler) checkLimits(w http.ResponseWriter, req CreateVMRequest) bool {
+	limits, err := quota.FromConfig(h.cfg)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return false
+	}
+	err = quota.CheckLaunch(h.mp, limits, req.CPUs, req.Memory)
+	if errors.Is(err, quota.ErrExceeded) {
+		apiError(w, http.StatusConflict, ErrCodeLimitExceeded, err.Error())
+		return false
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return false
+	}
+	return true
+}
+
+// checkCloneLimits rejects a clone that would take the host past the VM
+// limit in the config. On failure it writes the error response.
+func (h *VMHandler) checkCloneLimits(w http.ResponseWriter) bool {
+	limits, err := quota.FromConfig(h.cfg)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return false
+	}
+	err = quota.CheckClone(h.mp, limits)
+	if errors.Is(err, quota.ErrExceeded) {
+		apiError(w, http.StatusConflict, ErrCodeLimitExceeded, err.Error())
+		return false
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return false
+	}
+	return true
+}
+
+// releaseLaunchFile cleans up a launch's cloud-init file, logging failures
+// to keep a debug copy since the launch itself already finished
+func releaseLaunchFile(f *config.LaunchFile) {
+	if err := f.Release(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// recordLaunch records what a VM was launched with, and grants it the SSH
+// agent if it asked for that. The VM exists by now, so failures are only
+// logged.
+func (h *VMHandler) recordLaunch(req CreateVMRequest, cloudInit string) {
+	if err := h.specs.Save(req.Name, cloudInit, req); err != nil {
+		log.Printf("Warning: failed to save spec for VM %s: %v", req.Name, err)
+	}
+	if req.sshAgentSecret != "" {
+		if err := h.specs.GrantSSHAgent(req.Name, req.sshAgentSecret); err != nil {
+			log.Printf("Warning: failed to enable SSH agent forwarding for VM %s: %v", req.Name, err)
+		}
+	}
+}
+
+// recordClone records a clone's spec from its source's, so it can be
+// recreated like any other VM. Sources without a spec are skipped, and
+// other failures only logged since the clone exists by now.
+func (h *VMHandler) recordClone(source string, req CloneRequest) {
+	overrides := map[string]interface{}{}
+	if req.CPUs > 0 {
+		overrides["cpu"] = req.CPUs
+	}
+	if req.Memory != "" {
+		overrides["mem"] = req.Memory
+	}
+	if req.Disk != "" {
+		overrides["disk"] = req.Disk
+	}
+	if err := h.specs.Copy(source, req.NewName, overrides); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: failed to save spec for VM %s: %v", req.NewName, err)
+	}
+}
+
+// VMSpecResponse is what a VM was launched with
+type VMSpecResponse struct {
+	Spec      json.RawMessage `json:"spec"`       // the create request, with defaults filled in
+	CloudInit string          `json:"cloud_init"` // the rendered cloud-init
+}
+
+// GetSpec returns the create request and rendered cloud-init a VM was
+// launched with. VMs created before specs were recorded, or outside dabbi,
+// have none.
+// GET /api/vms/{name}/spec
+func (h *VMHandler) GetSpec(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	spec, err := h.specs.Spec(name)
+	if errors.Is(err, os.ErrNotExist) {
+		apiError(w, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("no spec recorded for VM '%s'", name))
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	cloudInit, err := h.specs.CloudInit(name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, VMSpecResponse{Spec: spec, CloudInit: cloudInit})
+}
+
+// prepareCreate validates a create request, fills in defaults, and renders
+// its cloud-init. Create and PreviewCloudInit share it so the preview is
+// exactly what a launch would use. On failure it writes the error response.
+func (h *VMHandler) prepareCreate(w http.ResponseWriter, req *CreateVMRequest) (string, *multipass.NetworkConfig, bool) {
+	if req.Name == "" {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "name is required")
+		return "", nil, false
+	}
+
+	// One snapshot, so a concurrent PUT /api/defaults can't mix two sets
+	cfg := h.cfg.Snapshot()
+	if req.Image == "" {
+		req.Image = cfg.Defaults.Image
+	}
+
+	// Custom images (file://, http(s)://) are passed through to multipass as-is
+	if err := multipass.ValidateImage(req.Image, req.ImageChecksum); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return "", nil, false
+	}
+
+	if err := multipass.ValidateNetworks(req.Networks); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return "", nil, false
+	}
+
+	if err := config.ValidatePackages(req.Packages); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return "", nil, false
+	}
+
 	// Set defaults if not provided
 	if req.CPUs == 0 {
-		req.CPUs = h.cfg.Defaults.CPU
+		req.CPUs = cfg.Defaults.CPU
 		if req.CPUs == 0 {
 			req.CPUs = 2
 		}
 	}
 	if req.Memory == "" {
-		req.Memory = h.cfg.Defaults.Mem
+		req.Memory = cfg.Defaults.Mem
 		if req.Memory == "" {
 			req.Memory = "4G"
 		}
 	}
 	if req.Disk == "" {
-		req.Disk = h.cfg.Defaults.Disk
+		req.Disk = cfg.Defaults.Disk
 		if req.Disk == "" {
 			req.Disk = "20G"
 		}
 	}
+	if _, err := multipass.ParseSize(req.Memory); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "mem: "+err.Error())
+		return "", nil, false
+	}
+	if _, err := multipass.ParseSize(req.Disk); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "disk: "+err.Error())
+		return "", nil, false
+	}
 
 	// Resolve cloud-init path (explicit > config default > ~/.dabbi/cloud-init.yaml)
-	resolvedCloudInit := h.cfg.GetCloudInitPath(req.CloudInit)
+	resolvedCloudInit := cfg.GetCloudInitPath(req.CloudInit)
+	req.CloudInit = resolvedCloudInit
 
 	// Handle network config
 	netConfig := req.Network
-	if netConfig == nil && h.cfg.Defaults.NetworkConfig != nil && h.cfg.Defaults.NetworkConfig.Mode != multipass.NetworkModeNone {
-		netConfig = h.cfg.Defaults.NetworkConfig
+	if netConfig == nil && cfg.Defaults.NetworkConfig != nil && cfg.Defaults.NetworkConfig.Mode != multipass.NetworkModeNone {
+		netConfig = cfg.Defaults.NetworkConfig
 	}
+	req.Network = netConfig // so a recorded spec relaunches the same way
 
-	// Validate network config if provided
-	if netConfig != nil && netConfig.Mode != multipass.NetworkModeNone {
-		if err := network.ValidateConfig(netConfig); err != nil {
-			http.Error(w, `{"error": "invalid network config: `+err.Error()+`"}`, http.StatusBadRequest)
-			return
+	if req.Netplan == "" {
+		req.Netplan = cfg.Defaults.Netplan
+	}
+	if req.Netplan != "" {
+		if _, err := config.LoadNetplan(req.Netplan); err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, err.Error())
+			return "", nil, false
 		}
 	}
 
-	// Read base cloud-init content
-	var baseContent string
-	if resolvedCloudInit != "" {
-		data, err := os.ReadFile(resolvedCloudInit)
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, err)
-			return
+	// Validate network config if provided
+	if netConfig != nil && netConfig.Mode != multipass.NetworkModeNone {
+		if err := network.ValidateConfig(netConfig); err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, "invalid network config: "+err.Error())
+			return "", nil, false
 		}
-		baseContent = string(data)
-	} else {
-		baseContent = config.DefaultCloudInit
 	}
 
-	// Inject auth token into cloud-init (replaces __DABBI_AUTH_TOKEN__ placeholder)
-	modifiedContent := config.GenerateCloudInitWithAuthToken(baseContent, h.cfg.AuthToken)
-
-	// Generate cloud-init with network config if needed
-	if netConfig != nil && netConfig.Mode != multipass.NetworkModeNone {
-		var err error
-		modifiedContent, err = config.GenerateCloudInitWithNetwork(modifiedContent, netConfig)
+	// Each launch gets a fresh secret, so a recreated VM's old one stops working
+	if req.ForwardSSHAgent {
+		secret, err := sshagent.NewSecret()
 		if err != nil {
-			respondError(w, http.StatusInternalServerError, err)
-			return
+			apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return "", nil, false
 		}
+		req.sshAgentSecret = secret
 	}
 
-	// Write to temp file in home directory (snap multipass can't access /tmp)
-	homeDir, err := os.UserHomeDir()
+	content, err := cfg.RenderCloudInit(resolvedCloudInit, req.Packages, netConfig, req.sshAgentSecret, req.Netplan)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
-		return
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return "", nil, false
 	}
-	tmpDir, err := os.MkdirTemp(homeDir, "dabbi-cloudinit-*")
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+	return content, netConfig, true
+}
+
+// CloudInitPreviewResponse is the rendered cloud-init for a create request
+type CloudInitPreviewResponse struct {
+	CloudInit string `json:"cloud_init"`
+}
+
+// PreviewCloudInit renders the cloud-init a create request would launch
+// with, without launching anything
+// POST /api/vms/cloud-init/preview
+func (h *VMHandler) PreviewCloudInit(w http.ResponseWriter, r *http.Request) {
+	var req CreateVMRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
-	defer os.RemoveAll(tmpDir)
 
-	tempCloudInitFile := filepath.Join(tmpDir, "cloud-init.yaml")
-	if err := os.WriteFile(tempCloudInitFile, []byte(modifiedContent), 0644); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+	content, _, ok := h.prepareCreate(w, &req)
+	if !ok {
 		return
 	}
+	respondJSON(w, http.StatusOK, CloudInitPreviewResponse{CloudInit: content})
+}
 
-	finalCloudInit := tempCloudInitFile
-
-	opts := multipass.LaunchOptions{
-		Name:          req.Name,
-		CPUs:          req.CPUs,
-		Memory:        req.Memory,
-		Disk:          req.Disk,
-		CloudInit:     finalCloudInit,
-		Image:         req.Image,
-		NetworkConfig: netConfig,
+// runLaunchJob launches a VM for an async create, moving the job to
+// installing once the VM is up and tracking cloud-init's latest output line.
+// It reports whether the launch succeeded.
+func (h *VMHandler) runLaunchJob(id string, opts multipass.LaunchOptions) bool {
+	done := make(chan error, 1)
+	go func() { done <- h.mp.Launch(opts) }()
+
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-done:
+			h.jobs.Update(id, func(j *jobs.Job) {
+				if err != nil {
+					j.Status = jobs.StatusFailed
+					j.Error = err.Error()
+					var mpErr *multipass.MultipassError
+					if errors.As(err, &mpErr) {
+						j.Hint = mpErr.Classify().Suggestion
+					}
+					return
+				}
+				j.Status = jobs.StatusReady
+			})
+			return err == nil
+		case <-ticker.C:
+			h.pollLaunchJob(id, opts.Name)
+		}
 	}
+}
 
-	// Launch VM synchronously so we can return errors to the user
-	if err := h.mp.Launch(opts); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
-		return
+// pollLaunchJob records progress of a VM that is still launching
+func (h *VMHandler) pollLaunchJob(id, vmName string) {
+	info, err := h.mp.Info(vmName)
+	if err != nil || info.State != multipass.StateRunning {
+		return // not booted yet
 	}
 
-	respondJSON(w, http.StatusCreated, map[string]string{
-		"status": "created",
-		"name":   req.Name,
+	out, _ := h.mp.Exec(vmName, "sudo", "tail", "-n", "1", cloudInitLog)
+	h.jobs.Update(id, func(j *jobs.Job) {
+		if j.Status == jobs.StatusLaunching {
+			j.Status = jobs.StatusInstalling
+		}
+		if line := strings.TrimSpace(out); line != "" {
+			j.LastLog = line
+		}
 	})
 }
 
+// GetJob returns the progress of an async create
+// GET /api/jobs/{id}
+func (h *VMHandler) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobs.Get(chi.URLParam(r, "id"))
+	if !ok {
+		apiError(w, http.StatusNotFound, ErrCodeNotFound, "job not found")
+		return
+	}
+	respondJSON(w, http.StatusOK, job)
+}
+
 // Delete removes a VM
 func (h *VMHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
 	if err := h.mp.Delete(name, true); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
+	CloseListeners(h.tunnels, h.agents, name)
+
+	// Labels are host-side only, so they must be cleaned up here
+	if err := h.labels.Delete(name); err != nil {
+		log.Printf("Warning: failed to remove labels for deleted VM %s: %v", name, err)
+	}
+	if err := h.specs.Delete(name); err != nil {
+		log.Printf("Warning: failed to remove spec for deleted VM %s: %v", name, err)
+	}
+	if err := h.mounts.Delete(name); err != nil {
+		log.Printf("Warning: failed to remove mount records for deleted VM %s: %v", name, err)
+	}
 
 	respondJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
 }
 
 // StateChangeRequest represents a state change request
 type StateChangeRequest struct {
-	Action string `json:"action"` // "start" or "stop"
+	Action string `json:"action"`          // "start" or "stop"
+	Force  bool   `json:"force,omitempty"` // stop: power off without a clean shutdown
 }
 
 // ChangeState changes the state of a VM
@@ -222,55 +815,133 @@ func (h *VMHandler) ChangeState(w http.ResponseWriter, r *http.Request) {
 
 	var req StateChangeRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
+	audit.SetDetail(r.Context(), req.Action)
 
 	var err error
 	switch req.Action {
 	case "start":
 		err = h.mp.Start(name)
 	case "stop":
-		err = h.mp.Stop(name)
+		if req.Force {
+			err = h.mp.StopWithOptions(name, true, 0)
+		} else {
+			err = h.mp.Stop(name)
+		}
 	case "restart":
 		err = h.mp.Restart(name)
 	default:
-		http.Error(w, `{"error": "invalid action, must be 'start', 'stop', or 'restart'"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "invalid action, must be 'start', 'stop', or 'restart'")
 		return
 	}
 
+	if errors.Is(err, quota.ErrExceeded) {
+		apiError(w, http.StatusConflict, ErrCodeLimitExceeded, err.Error())
+		return
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
 		return
 	}
 
+	if req.Action == "stop" {
+		CloseListeners(h.tunnels, h.agents, name)
+	}
+
+	// Remember VMs stopped on purpose so a bulk start can leave them alone
+	switch req.Action {
+	case "start":
+		err = h.labels.Remove(name, labels.StoppedByUserKey)
+	case "stop":
+		err = h.labels.Mark(name, labels.StoppedByUserKey)
+	}
+	if err != nil {
+		log.Printf("Warning: failed to update labels for VM %s: %v", name, err)
+	}
+
 	respondJSON(w, http.StatusOK, map[string]string{"status": req.Action + "ed"})
 }
 
-// CloneRequest represents a clone request
+// CloneRequest represents a clone request. CPUs, Memory, and Disk override
+// the clone's resources; unset fields keep the source's values.
 type CloneRequest struct {
-	NewName string `json:"new_name"`
+	NewName        string `json:"new_name"`
+	SourceSnapshot string `json:"source_snapshot,omitempty"` // clone the VM as of this snapshot (see multipass.Client.CloneFromSnapshot)
+	CPUs           int    `json:"cpu,omitempty"`
+	Memory         string `json:"mem,omitempty"`
+	Disk           string `json:"disk,omitempty"`
 }
 
-// Clone creates a copy of a VM
+// Clone creates a copy of a VM. Multipass only clones stopped VMs.
 func (h *VMHandler) Clone(w http.ResponseWriter, r *http.Request) {
 	name := chi.URLParam(r, "name")
 
 	var req CloneRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, err)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
 
 	if req.NewName == "" {
-		http.Error(w, `{"error": "new_name is required"}`, http.StatusBadRequest)
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "new_name is required")
+		return
+	}
+	if err := multipass.ValidateVMName(req.NewName); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
 		return
 	}
+	if req.CPUs < 0 {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "cpu must be positive")
+		return
+	}
+	if req.Memory != "" {
+		if _, err := multipass.ParseSize(req.Memory); err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "mem: "+err.Error())
+			return
+		}
+	}
+	if req.Disk != "" {
+		if _, err := multipass.ParseSize(req.Disk); err != nil {
+			apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, "disk: "+err.Error())
+			return
+		}
+	}
 
-	if err := h.mp.Clone(name, req.NewName); err != nil {
-		respondError(w, http.StatusInternalServerError, err)
+	info, err := h.mp.InfoContext(r.Context(), name)
+	if err != nil {
+		apiError(w, http.StatusNotFound, ErrCodeVMNotFound, err.Error())
 		return
 	}
+	if info.State != multipass.StateStopped {
+		apiError(w, http.StatusConflict, ErrCodeVMNotStopped,
+			fmt.Sprintf("VM is %s; stop it before cloning", strings.ToLower(info.State)))
+		return
+	}
+	if !h.checkCloneLimits(w) {
+		return
+	}
+
+	if req.SourceSnapshot != "" {
+		err = h.mp.CloneFromSnapshot(name, req.SourceSnapshot, req.NewName)
+	} else {
+		err = h.mp.Clone(name, req.NewName)
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	// Clones start out stopped, so resources can be changed right away
+	if req.CPUs > 0 || req.Memory != "" || req.Disk != "" {
+		if err := h.mp.SetResources(req.NewName, req.CPUs, req.Memory, req.Disk); err != nil {
+			apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+				fmt.Sprintf("VM cloned to %s, but resizing it failed: %v", req.NewName, err))
+			return
+		}
+	}
+	h.recordClone(name, req)
 
 	respondJSON(w, http.StatusCreated, map[string]string{
 		"status": "cloned",
@@ -285,9 +956,3 @@ func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(data)
 }
-
-func respondError(w http.ResponseWriter, status int, err error) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
-}
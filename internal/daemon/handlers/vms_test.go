@@ -5,23 +5,50 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/agent"
 	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/jobs"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/mounts"
 	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/quota"
 	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/mjshashank/dabbi/internal/tunnel"
+	"github.com/mjshashank/dabbi/internal/vmspec"
+	"github.com/mjshashank/dabbi/internal/watchdog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
+func newTestLabelStore(t *testing.T) *labels.Store {
+	return labels.NewStore(filepath.Join(t.TempDir(), "labels.json"))
+}
+
+func newTestSpecStore(t *testing.T) *vmspec.Store {
+	return vmspec.NewStore(filepath.Join(t.TempDir(), "vms"))
+}
+
+func newTestMountStore(t *testing.T) *mounts.Store {
+	return mounts.NewStore(filepath.Join(t.TempDir(), "mounts"))
+}
+
 func setupVMHandler(t *testing.T) (*VMHandler, *testutil.MockMultipassClient) {
 	mockMP := new(testutil.MockMultipassClient)
 	cfg := config.DefaultConfig()
-	handler := NewVMHandler(mockMP, cfg)
+	handler := NewVMHandler(mockMP, cfg, newTestLabelStore(t), newTestSpecStore(t), newTestMountStore(t), nil, nil, nil)
 	return handler, mockMP
 }
 
@@ -93,6 +120,7 @@ func TestVMHandler_Get(t *testing.T) {
 		mockInfo       *multipass.InstanceInfo
 		mockErr        error
 		expectedStatus int
+		expectedCode   string
 	}{
 		{
 			name:           "returns_vm_info",
@@ -107,6 +135,7 @@ func TestVMHandler_Get(t *testing.T) {
 			mockInfo:       nil,
 			mockErr:        errors.New("VM not found"),
 			expectedStatus: http.StatusNotFound,
+			expectedCode:   ErrCodeVMNotFound,
 		},
 	}
 
@@ -114,6 +143,7 @@ func TestVMHandler_Get(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockMP.ExpectedCalls = nil
 			mockMP.On("Info", tt.vmName).Return(tt.mockInfo, tt.mockErr)
+			mockMP.On("Exec", tt.vmName, []string{"cat", watchdog.CheckpointPath}).Return("", errors.New("no checkpoint")).Maybe()
 
 			req := httptest.NewRequest(http.MethodGet, "/api/vms/"+tt.vmName, nil)
 			rctx := chi.NewRouteContext()
@@ -124,11 +154,94 @@ func TestVMHandler_Get(t *testing.T) {
 			handler.Get(rec, req)
 
 			assert.Equal(t, tt.expectedStatus, rec.Code)
+			if tt.expectedCode != "" {
+				var result errorResponse
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&result))
+				assert.Equal(t, tt.expectedCode, result.Error.Code)
+			}
 			mockMP.AssertExpectations(t)
 		})
 	}
 }
 
+func TestVMHandler_Get_Activity(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+
+	last := time.Now().UTC().Add(-12 * time.Minute).Truncate(time.Second)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.On("Exec", "test-vm", []string{"cat", watchdog.CheckpointPath}).
+		Return(`{"timestamp":"`+last.Format(time.RFC3339)+`","rx_bytes":1,"tx_bytes":2}`, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/test-vm", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "test-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+
+	handler.Get(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var detail VMDetail
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&detail))
+	assert.Equal(t, multipass.StateRunning, detail.State)
+	require.NotNil(t, detail.LastActivity)
+	assert.True(t, last.Equal(*detail.LastActivity))
+	require.NotNil(t, detail.IdleSeconds)
+	assert.InDelta(t, 12*60, *detail.IdleSeconds, 5)
+}
+
+func TestVMHandler_Get_NoActivity(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.On("Exec", "test-vm", []string{"cat", watchdog.CheckpointPath}).Return("", errors.New("no such file"))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/test-vm", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "test-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+
+	handler.Get(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var body map[string]interface{}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.NotContains(t, body, "last_activity")
+	assert.NotContains(t, body, "idle_seconds")
+}
+
+func TestVMHandler_List_Activity(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	stops := watchdog.NewStopLog(filepath.Join(t.TempDir(), "stops.json"))
+	stoppedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, stops.Record("vm2", stoppedAt))
+	handler := NewVMHandler(mockMP, config.DefaultConfig(), newTestLabelStore(t), newTestSpecStore(t), newTestMountStore(t), stops, nil, nil)
+
+	running := time.Now().UTC().Add(-5 * time.Minute).Truncate(time.Second)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "vm1", State: multipass.StateRunning},
+		{Name: "vm2", State: multipass.StateStopped},
+	}, nil)
+	mockMP.On("Exec", "vm1", []string{"cat", watchdog.CheckpointPath}).
+		Return(`{"timestamp":"`+running.Format(time.RFC3339)+`"}`, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms?activity=true", nil)
+	rec := httptest.NewRecorder()
+
+	handler.List(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var items []VMListItem
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&items))
+	require.Len(t, items, 2)
+	require.NotNil(t, items[0].LastActivity)
+	assert.True(t, running.Equal(*items[0].LastActivity))
+	require.NotNil(t, items[1].LastActivity)
+	assert.True(t, stoppedAt.Equal(*items[1].LastActivity))
+	assert.InDelta(t, 3600, *items[1].IdleSeconds, 5)
+	mockMP.AssertExpectations(t)
+}
+
 func TestVMHandler_Create(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -167,6 +280,38 @@ func TestVMHandler_Create(t *testing.T) {
 			mockSetup:      func(m *testutil.MockMultipassClient) {},
 			expectedStatus: http.StatusBadRequest,
 		},
+		{
+			name: "with_packages",
+			request: CreateVMRequest{
+				Name:     "pkg-vm",
+				Packages: []string{"htop"},
+			},
+			mockSetup: func(m *testutil.MockMultipassClient) {
+				m.On("Launch", mock.MatchedBy(func(opts multipass.LaunchOptions) bool {
+					data, err := os.ReadFile(opts.CloudInit)
+					return err == nil && strings.Contains(string(data), `  - "htop"`)
+				})).Return(nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:           "invalid_package",
+			request:        CreateVMRequest{Name: "pkg-vm", Packages: []string{"htop; reboot"}},
+			mockSetup:      func(m *testutil.MockMultipassClient) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "name_with_port_suffix",
+			request:        CreateVMRequest{Name: "api-8080"},
+			mockSetup:      func(m *testutil.MockMultipassClient) {},
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "invalid_memory_size",
+			request:        CreateVMRequest{Name: "typo-vm", Memory: "4GB"},
+			mockSetup:      func(m *testutil.MockMultipassClient) {},
+			expectedStatus: http.StatusBadRequest,
+		},
 		{
 			name:    "launch_error",
 			request: CreateVMRequest{Name: "error-vm"},
@@ -193,7 +338,7 @@ func TestVMHandler_Create(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockMP := new(testutil.MockMultipassClient)
 			cfg := config.DefaultConfig()
-			handler := NewVMHandler(mockMP, cfg)
+			handler := NewVMHandler(mockMP, cfg, newTestLabelStore(t), newTestSpecStore(t), newTestMountStore(t), nil, nil, nil)
 			tt.mockSetup(mockMP)
 
 			body, _ := json.Marshal(tt.request)
@@ -221,6 +366,198 @@ func TestVMHandler_Create_InvalidJSON(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, rec.Code)
 }
 
+func TestVMHandler_PreviewCloudInit(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+
+	body, _ := json.Marshal(CreateVMRequest{Name: "preview-vm", Packages: []string{"htop"}})
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/cloud-init/preview", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	handler.PreviewCloudInit(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp CloudInitPreviewResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.True(t, strings.HasPrefix(resp.CloudInit, "#cloud-config"))
+	assert.Contains(t, resp.CloudInit, `  - "htop"`)
+
+	// Nothing is launched
+	mockMP.AssertNotCalled(t, "Launch", mock.Anything)
+}
+
+func TestVMHandler_PreviewCloudInit_Invalid(t *testing.T) {
+	handler, _ := setupVMHandler(t)
+
+	body, _ := json.Marshal(CreateVMRequest{Name: "preview-vm", Memory: "4GB"})
+	rec := httptest.NewRecorder()
+	handler.PreviewCloudInit(rec, httptest.NewRequest(http.MethodPost, "/api/vms/cloud-init/preview", bytes.NewReader(body)))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestVMHandler_PreviewCloudInit_Netplan(t *testing.T) {
+	handler, _ := setupVMHandler(t)
+	dir := t.TempDir()
+	good := filepath.Join(dir, "static.yaml")
+	require.NoError(t, os.WriteFile(good, []byte("network:\n  version: 2\n"), 0644))
+	bad := filepath.Join(dir, "bad.yaml")
+	require.NoError(t, os.WriteFile(bad, []byte("network: [\n"), 0644))
+
+	body, _ := json.Marshal(CreateVMRequest{Name: "preview-vm", Netplan: good})
+	rec := httptest.NewRecorder()
+	handler.PreviewCloudInit(rec, httptest.NewRequest(http.MethodPost, "/api/vms/cloud-init/preview", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), config.NetplanPath)
+
+	body, _ = json.Marshal(CreateVMRequest{Name: "preview-vm", Netplan: bad})
+	rec = httptest.NewRecorder()
+	handler.PreviewCloudInit(rec, httptest.NewRequest(http.MethodPost, "/api/vms/cloud-init/preview", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "not valid YAML")
+}
+
+// getJob fetches an async create job through the handler
+func getJob(t *testing.T, handler *VMHandler, id string) (int, jobs.Job) {
+	req := httptest.NewRequest(http.MethodGet, "/api/jobs/"+id, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("id", id)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+
+	handler.GetJob(rec, req)
+
+	var job jobs.Job
+	if rec.Code == http.StatusOK {
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&job))
+	}
+	return rec.Code, job
+}
+
+func TestVMHandler_Create_Async(t *testing.T) {
+	orig := jobPollInterval
+	jobPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { jobPollInterval = orig })
+
+	handler, mockMP := setupVMHandler(t)
+
+	release := make(chan struct{})
+	mockMP.On("Launch", mock.MatchedBy(func(opts multipass.LaunchOptions) bool {
+		return opts.Name == "slow-vm"
+	})).Run(func(mock.Arguments) { <-release }).Return(nil)
+	mockMP.On("Info", "slow-vm").Return(testutil.RunningVM("slow-vm", "10.0.0.5"), nil)
+	mockMP.On("Exec", "slow-vm", []string{"sudo", "tail", "-n", "1", cloudInitLog}).
+		Return("Installing opencode...\n", nil)
+
+	body, _ := json.Marshal(CreateVMRequest{Name: "slow-vm"})
+	req := httptest.NewRequest(http.MethodPost, "/api/vms?async=true", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	handler.Create(rec, req)
+
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var job jobs.Job
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&job))
+	assert.Equal(t, "slow-vm", job.VM)
+	assert.Equal(t, jobs.StatusLaunching, job.Status)
+
+	// The VM is up but Launch hasn't returned: cloud-init is still running
+	assert.Eventually(t, func() bool {
+		_, got := getJob(t, handler, job.ID)
+		return got.Status == jobs.StatusInstalling && got.LastLog == "Installing opencode..."
+	}, time.Second, 10*time.Millisecond)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		_, got := getJob(t, handler, job.ID)
+		return got.Status == jobs.StatusReady
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestVMHandler_Create_AsyncFailure(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Launch", mock.Anything).Return(errors.New("launch failed"))
+
+	body, _ := json.Marshal(CreateVMRequest{Name: "bad-vm"})
+	rec := httptest.NewRecorder()
+	handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/vms?async=true", bytes.NewReader(body)))
+
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var job jobs.Job
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&job))
+
+	assert.Eventually(t, func() bool {
+		_, got := getJob(t, handler, job.ID)
+		return got.Status == jobs.StatusFailed && got.Error == "launch failed"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestVMHandler_Create_LaunchFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		stderr     string
+		wantStatus int
+		wantCode   string
+		wantHint   bool
+	}{
+		{"name taken", `launch failed: instance "dev" already exists`, http.StatusConflict, ErrCodeVMExists, true},
+		{"disk full", "launch failed: No space left on device", http.StatusInsufficientStorage, ErrCodeNoResources, true},
+		{"no memory", "launch failed: Cannot allocate memory", http.StatusInsufficientStorage, ErrCodeNoResources, true},
+		{"bad image", `launch failed: Unable to find an image matching "nope"`, http.StatusBadRequest, ErrCodeImageFailed, true},
+		{"download", `launch failed: Remote "" is unknown or unreachable.`, http.StatusBadGateway, ErrCodeImageFailed, true},
+		{"unknown", "launch failed: something else", http.StatusInternalServerError, ErrCodeInternal, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockMP := setupVMHandler(t)
+			mockMP.On("Launch", mock.Anything).Return(&multipass.MultipassError{
+				Command: "multipass launch",
+				Stderr:  tt.stderr,
+				Err:     errors.New("exit status 2"),
+			})
+
+			rec := httptest.NewRecorder()
+			handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/vms", strings.NewReader(`{"name": "dev"}`)))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			var resp errorResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, tt.wantCode, resp.Error.Code)
+			assert.Contains(t, resp.Error.Message, tt.stderr)
+			assert.Equal(t, tt.wantHint, resp.Error.Hint != "")
+		})
+	}
+}
+
+func TestVMHandler_Create_AsyncFailureHint(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Launch", mock.Anything).Return(&multipass.MultipassError{
+		Command: "multipass launch",
+		Stderr:  "launch failed: No space left on device",
+		Err:     errors.New("exit status 2"),
+	})
+
+	body, _ := json.Marshal(CreateVMRequest{Name: "full-vm"})
+	rec := httptest.NewRecorder()
+	handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/vms?async=true", bytes.NewReader(body)))
+
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var job jobs.Job
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&job))
+
+	assert.Eventually(t, func() bool {
+		_, got := getJob(t, handler, job.ID)
+		return got.Status == jobs.StatusFailed && strings.Contains(got.Hint, "disk space")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestVMHandler_GetJob_NotFound(t *testing.T) {
+	handler, _ := setupVMHandler(t)
+
+	code, _ := getJob(t, handler, "missing")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
 func TestVMHandler_Delete(t *testing.T) {
 	handler, mockMP := setupVMHandler(t)
 
@@ -318,7 +655,7 @@ func TestVMHandler_ChangeState(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockMP := new(testutil.MockMultipassClient)
 			cfg := config.DefaultConfig()
-			handler := NewVMHandler(mockMP, cfg)
+			handler := NewVMHandler(mockMP, cfg, newTestLabelStore(t), newTestSpecStore(t), newTestMountStore(t), nil, nil, nil)
 
 			if tt.mockMethod != "" {
 				switch tt.mockMethod {
@@ -347,6 +684,116 @@ func TestVMHandler_ChangeState(t *testing.T) {
 	}
 }
 
+func TestVMHandler_ChangeState_TracksUserStops(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Stop", "vm1").Return(nil)
+	mockMP.On("Start", "vm1").Return(nil)
+
+	changeState := func(action string) {
+		rec := httptest.NewRecorder()
+		handler.ChangeState(rec, newLabelsRequest(http.MethodPost, "vm1", `{"action": "`+action+`"}`))
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	changeState("stop")
+	got, err := handler.labels.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, "true", got[labels.StoppedByUserKey])
+
+	changeState("start")
+	got, err = handler.labels.Get("vm1")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestVMHandler_ChangeState_ForceStop(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("StopWithOptions", "vm1", true, time.Duration(0)).Return(nil)
+
+	rec := httptest.NewRecorder()
+	handler.ChangeState(rec, newLabelsRequest(http.MethodPost, "vm1", `{"action": "stop", "force": true}`))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	mockMP.AssertExpectations(t)
+	mockMP.AssertNotCalled(t, "Stop", mock.Anything)
+}
+
+// openListeners gives a VM a tunnel and an agent listener, like using the
+// VM through the daemon would
+func openListeners(t *testing.T, mockMP *testutil.MockMultipassClient, vmName string) (*tunnel.Manager, *agent.Manager) {
+	t.Helper()
+	mockMP.On("Info", vmName).Return(testutil.RunningVM(vmName, "192.0.2.1"), nil)
+
+	tm := tunnel.NewManager(mockMP)
+	_, err := tm.Create(vmName, 8080)
+	require.NoError(t, err)
+	t.Cleanup(func() { tm.DeleteVM(vmName) })
+
+	// A one-port agent range on a port known to be free
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	am := agent.NewManager(mockMP)
+	require.NoError(t, am.SetPortRange(port, 1))
+	require.NoError(t, am.Start(vmName))
+	t.Cleanup(am.StopAll)
+
+	return tm, am
+}
+
+func TestVMHandler_ClosesListeners(t *testing.T) {
+	tests := []struct {
+		name   string
+		call   func(h *VMHandler, w http.ResponseWriter)
+		mockFn func(m *testutil.MockMultipassClient)
+	}{
+		{
+			name: "delete",
+			call: func(h *VMHandler, w http.ResponseWriter) {
+				h.Delete(w, newLabelsRequest(http.MethodDelete, "vm1", ""))
+			},
+			mockFn: func(m *testutil.MockMultipassClient) { m.On("Delete", "vm1", true).Return(nil) },
+		},
+		{
+			name: "stop",
+			call: func(h *VMHandler, w http.ResponseWriter) {
+				h.ChangeState(w, newLabelsRequest(http.MethodPost, "vm1", `{"action": "stop"}`))
+			},
+			mockFn: func(m *testutil.MockMultipassClient) { m.On("Stop", "vm1").Return(nil) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockMP := setupVMHandler(t)
+			handler.tunnels, handler.agents = openListeners(t, mockMP, "vm1")
+			tt.mockFn(mockMP)
+
+			rec := httptest.NewRecorder()
+			tt.call(handler, rec)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			assert.Empty(t, handler.tunnels.List())
+			assert.False(t, handler.agents.IsRunning("vm1"))
+			assert.Empty(t, handler.agents.List())
+		})
+	}
+}
+
+func TestVMHandler_KeepsListenersOnFailure(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	handler.tunnels, handler.agents = openListeners(t, mockMP, "vm1")
+	mockMP.On("Stop", "vm1").Return(errors.New("stop failed"))
+
+	rec := httptest.NewRecorder()
+	handler.ChangeState(rec, newLabelsRequest(http.MethodPost, "vm1", `{"action": "stop"}`))
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	assert.Len(t, handler.tunnels.List(), 1)
+	assert.True(t, handler.agents.IsRunning("vm1"))
+}
+
 func TestVMHandler_Clone(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -382,9 +829,10 @@ func TestVMHandler_Clone(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockMP := new(testutil.MockMultipassClient)
 			cfg := config.DefaultConfig()
-			handler := NewVMHandler(mockMP, cfg)
+			handler := NewVMHandler(mockMP, cfg, newTestLabelStore(t), newTestSpecStore(t), newTestMountStore(t), nil, nil, nil)
 
 			if tt.newName != "" {
+				mockMP.On("Info", tt.sourceName).Return(testutil.StoppedVM(tt.sourceName), nil)
 				mockMP.On("Clone", tt.sourceName, tt.newName).Return(tt.mockErr)
 			}
 
@@ -404,6 +852,123 @@ func TestVMHandler_Clone(t *testing.T) {
 	}
 }
 
+func TestVMHandler_Clone_Options(t *testing.T) {
+	tests := []struct {
+		name           string
+		req            CloneRequest
+		source         *multipass.InstanceInfo
+		setup          func(m *testutil.MockMultipassClient)
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			name:   "from_snapshot_with_overrides",
+			req:    CloneRequest{NewName: "clone-vm", SourceSnapshot: "snap1", CPUs: 4, Memory: "8G", Disk: "40G"},
+			source: testutil.StoppedVM("source-vm"),
+			setup: func(m *testutil.MockMultipassClient) {
+				m.On("CloneFromSnapshot", "source-vm", "snap1", "clone-vm").Return(nil)
+				m.On("SetResources", "clone-vm", 4, "8G", "40G").Return(nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "memory_only",
+			req:    CloneRequest{NewName: "clone-vm", Memory: "2G"},
+			source: testutil.StoppedVM("source-vm"),
+			setup: func(m *testutil.MockMultipassClient) {
+				m.On("Clone", "source-vm", "clone-vm").Return(nil)
+				m.On("SetResources", "clone-vm", 0, "2G", "").Return(nil)
+			},
+			expectedStatus: http.StatusCreated,
+		},
+		{
+			name:   "resize_error",
+			req:    CloneRequest{NewName: "clone-vm", Disk: "10G"},
+			source: testutil.StoppedVM("source-vm"),
+			setup: func(m *testutil.MockMultipassClient) {
+				m.On("Clone", "source-vm", "clone-vm").Return(nil)
+				m.On("SetResources", "clone-vm", 0, "", "10G").Return(errors.New("disk can only grow"))
+			},
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   ErrCodeInternal,
+		},
+		{
+			name:           "source_running",
+			req:            CloneRequest{NewName: "clone-vm"},
+			source:         testutil.RunningVM("source-vm", "192.168.64.5"),
+			expectedStatus: http.StatusConflict,
+			expectedCode:   ErrCodeVMNotStopped,
+		},
+		{
+			name:           "invalid_memory",
+			req:            CloneRequest{NewName: "clone-vm", Memory: "lots"},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   ErrCodeInvalidRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockMP := new(testutil.MockMultipassClient)
+			handler := NewVMHandler(mockMP, config.DefaultConfig(), newTestLabelStore(t), newTestSpecStore(t), newTestMountStore(t), nil, nil, nil)
+			if tt.source != nil {
+				mockMP.On("Info", "source-vm").Return(tt.source, nil)
+			}
+			if tt.setup != nil {
+				tt.setup(mockMP)
+			}
+
+			body, _ := json.Marshal(tt.req)
+			req := httptest.NewRequest(http.MethodPost, "/api/vms/source-vm/clone", bytes.NewReader(body))
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("name", "source-vm")
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+
+			rec := httptest.NewRecorder()
+			handler.Clone(rec, req)
+
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+			if tt.expectedCode != "" {
+				var resp errorResponse
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+				assert.Equal(t, tt.expectedCode, resp.Error.Code)
+			}
+			mockMP.AssertExpectations(t)
+			if tt.source == nil || tt.source.State != multipass.StateStopped {
+				mockMP.AssertNotCalled(t, "Clone", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestVMHandler_Clone_RecordsSpec(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	specs := newTestSpecStore(t)
+	handler := NewVMHandler(mockMP, config.DefaultConfig(), newTestLabelStore(t), specs, newTestMountStore(t), nil, nil, nil)
+	require.NoError(t, specs.Save("source-vm", "#cloud-config\n", CreateVMRequest{Name: "source-vm", CPUs: 2, Memory: "4G", Image: "jammy"}))
+
+	mockMP.On("Info", "source-vm").Return(testutil.StoppedVM("source-vm"), nil)
+	mockMP.On("Clone", "source-vm", "clone-vm").Return(nil)
+	mockMP.On("SetResources", "clone-vm", 0, "8G", "").Return(nil)
+
+	body, _ := json.Marshal(CloneRequest{NewName: "clone-vm", Memory: "8G"})
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/source-vm/clone", bytes.NewReader(body))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "source-vm")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	handler.Clone(rec, req)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	// The clone is recorded like its source, with its own name and memory
+	spec, err := specs.Spec("clone-vm")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "clone-vm", "cpu": 2, "mem": "8G", "image": "jammy"}`, string(spec))
+	cloudInit, err := specs.CloudInit("clone-vm")
+	require.NoError(t, err)
+	assert.Equal(t, "#cloud-config\n", cloudInit)
+}
+
 func TestVMHandler_Defaults(t *testing.T) {
 	handler, _ := setupVMHandler(t)
 
@@ -421,12 +986,132 @@ func TestVMHandler_Defaults(t *testing.T) {
 	assert.Equal(t, float64(2), defaults["cpu"])
 	assert.Equal(t, "4G", defaults["mem"])
 	assert.Equal(t, "20G", defaults["disk"])
+	assert.NotContains(t, defaults, "image")
+
+	handler.cfg.Defaults.Image = "24.04"
+	rec = httptest.NewRecorder()
+	handler.Defaults(rec, req)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&defaults))
+	assert.Equal(t, "24.04", defaults["image"])
+}
+
+func TestVMHandler_SetDefaults(t *testing.T) {
+	// Isolate config writes from the real home directory
+	t.Setenv("HOME", t.TempDir())
+	handler, _ := setupVMHandler(t)
+
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/defaults", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handler.SetDefaults(rec, req)
+		return rec
+	}
+
+	// Omitted fields are kept
+	rec := put(`{"image": "24.04", "mem": "8G"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var defaults VMDefaults
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&defaults))
+	assert.Equal(t, VMDefaults{CPU: 2, Mem: "8G", Disk: "20G", Image: "24.04"}, defaults)
+
+	saved, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, "24.04", saved.Defaults.Image)
+	assert.Equal(t, "8G", saved.Defaults.Mem)
+
+	// An empty image clears it
+	rec = put(`{"image": ""}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, handler.cfg.Defaults.Image)
+
+	tests := []struct {
+		name    string
+		body    string
+		wantMsg string
+	}{
+		{"zero_cpu", `{"cpu": 0}`, "cpu must be at least 1"},
+		{"bad_mem", `{"mem": "lots"}`, "mem:"},
+		{"bad_disk", `{"disk": "-5G"}`, "disk:"},
+		{"flag_like_image", `{"image": "--help"}`, "invalid image alias"},
+		{"bad_scheme", `{"image": "ftp://example.com/img"}`, "unsupported image scheme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := put(tt.body)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			var resp errorResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Contains(t, resp.Error.Message, tt.wantMsg)
+			assert.Equal(t, VMDefaults{CPU: 2, Mem: "8G", Disk: "20G"}, handler.defaults())
+		})
+	}
+}
+
+func TestVMHandler_SetDefaults_CloudInit(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	handler, _ := setupVMHandler(t)
+
+	cloudInit := filepath.Join(home, "team.yaml")
+	require.NoError(t, os.WriteFile(cloudInit, []byte("#cloud-config\n"), 0644))
+
+	put := func(body interface{}) *httptest.ResponseRecorder {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		handler.SetDefaults(rec, httptest.NewRequest(http.MethodPut, "/api/defaults", bytes.NewReader(data)))
+		return rec
+	}
+
+	rec := put(map[string]interface{}{"cpu": 4, "mem": "8G", "disk": "40G", "image": "24.04", "cloud_init": cloudInit})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var defaults VMDefaults
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&defaults))
+	assert.Equal(t, VMDefaults{CPU: 4, Mem: "8G", Disk: "40G", Image: "24.04", CloudInit: cloudInit}, defaults)
+
+	saved, err := config.Load()
+	require.NoError(t, err)
+	assert.Equal(t, cloudInit, saved.Defaults.CloudInit)
+	assert.Equal(t, 4, saved.Defaults.CPU)
+
+	// Missing files and directories are rejected, leaving the default alone
+	for _, path := range []string{filepath.Join(home, "missing.yaml"), home} {
+		rec = put(map[string]string{"cloud_init": path})
+		assert.Equal(t, http.StatusBadRequest, rec.Code, path)
+		assert.Equal(t, cloudInit, handler.cfg.Defaults.CloudInit)
+	}
+
+	// An empty path clears it
+	rec = put(map[string]string{"cloud_init": ""})
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, handler.cfg.Defaults.CloudInit)
+}
+
+func TestVMHandler_Create_DefaultImage(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	handler.cfg.Defaults.Image = "24.04"
+
+	mockMP.On("Launch", mock.MatchedBy(func(opts multipass.LaunchOptions) bool {
+		return opts.Name == "default-img" && opts.Image == "24.04"
+	})).Return(nil)
+	mockMP.On("Launch", mock.MatchedBy(func(opts multipass.LaunchOptions) bool {
+		return opts.Name == "own-img" && opts.Image == "22.04"
+	})).Return(nil)
+
+	for _, req := range []CreateVMRequest{{Name: "default-img"}, {Name: "own-img", Image: "22.04"}} {
+		body, err := json.Marshal(req)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/vms", bytes.NewReader(body)))
+		assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	mockMP.AssertExpectations(t)
 }
 
 func TestNewVMHandler(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
 	cfg := config.DefaultConfig()
-	handler := NewVMHandler(mockMP, cfg)
+	handler := NewVMHandler(mockMP, cfg, newTestLabelStore(t), newTestSpecStore(t), newTestMountStore(t), nil, nil, nil)
 
 	require.NotNil(t, handler)
 	assert.Equal(t, mockMP, handler.mp)
@@ -448,17 +1133,361 @@ func TestRespondJSON(t *testing.T) {
 	assert.Equal(t, "value", result["key"])
 }
 
-func TestRespondError(t *testing.T) {
+func TestAPIError(t *testing.T) {
 	rec := httptest.NewRecorder()
-	err := errors.New("test error")
 
-	respondError(rec, http.StatusBadRequest, err)
+	apiError(rec, http.StatusNotFound, ErrCodeVMNotFound, "test error")
 
-	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
 	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
 
-	var result map[string]string
+	var result errorResponse
 	decodeErr := json.NewDecoder(rec.Body).Decode(&result)
 	require.NoError(t, decodeErr)
-	assert.Equal(t, "test error", result["error"])
+	assert.Equal(t, ErrCodeVMNotFound, result.Error.Code)
+	assert.Equal(t, "test error", result.Error.Message)
+}
+
+func newLabelsRequest(method, vmName, body string) *http.Request {
+	req := httptest.NewRequest(method, "/api/vms/"+vmName+"/labels", bytes.NewBufferString(body))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", vmName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestVMHandler_List_Labels(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	require.NoError(t, handler.labels.Set("vm1", map[string]string{"project": "foo", "env": "ci"}))
+	require.NoError(t, handler.labels.Set("vm2", map[string]string{"project": "bar"}))
+
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "vm1", State: "Running"},
+		{Name: "vm2", State: "Stopped"},
+		{Name: "vm3", State: "Stopped"},
+	}, nil)
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{"no_filter", "", []string{"vm1", "vm2", "vm3"}},
+		{"key_value", "?label=project=foo", []string{"vm1"}},
+		{"key_only", "?label=project", []string{"vm1", "vm2"}},
+		{"multiple_selectors", "?label=project=foo&label=env=dev", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.List(rec, httptest.NewRequest(http.MethodGet, "/api/vms"+tt.query, nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			var vms []VMListItem
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&vms))
+
+			var names []string
+			for _, vm := range vms {
+				names = append(names, vm.Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handler.List(rec, httptest.NewRequest(http.MethodGet, "/api/vms?label=project=foo", nil))
+	var vms []VMListItem
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&vms))
+	require.Len(t, vms, 1)
+	assert.Equal(t, map[string]string{"project": "foo", "env": "ci"}, vms[0].Labels)
+}
+
+func TestVMHandler_SetAndGetLabels(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "192.168.64.2"), nil)
+
+	rec := httptest.NewRecorder()
+	handler.SetLabels(rec, newLabelsRequest(http.MethodPut, "vm1", `{"project":"foo"}`))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.GetLabels(rec, newLabelsRequest(http.MethodGet, "vm1", ""))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var got map[string]string
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, map[string]string{"project": "foo"}, got)
+}
+
+func TestVMHandler_SetLabels_KeepsReserved(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "192.168.64.2"), nil)
+	require.NoError(t, handler.labels.Mark("vm1", labels.PinnedKey))
+	require.NoError(t, handler.labels.Set("vm1", map[string]string{"env": "ci"}))
+
+	rec := httptest.NewRecorder()
+	handler.SetLabels(rec, newLabelsRequest(http.MethodPut, "vm1", `{"project":"foo"}`))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var got map[string]string
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, map[string]string{labels.PinnedKey: "true", "project": "foo"}, got)
+}
+
+func TestVMHandler_SetLabels_Errors(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		infoErr        error
+		expectedStatus int
+		expectedCode   string
+	}{
+		{"invalid_json", `["a"]`, nil, http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"invalid_key", `{"bad key":"x"}`, nil, http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"reserved_key", `{"dabbi/ssh-agent":"true"}`, nil, http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"vm_not_found", `{"a":"b"}`, errors.New("instance does not exist"), http.StatusNotFound, ErrCodeVMNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockMP := setupVMHandler(t)
+			mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "192.168.64.2"), tt.infoErr).Maybe()
+
+			rec := httptest.NewRecorder()
+			handler.SetLabels(rec, newLabelsRequest(http.MethodPut, "vm1", tt.body))
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+
+			var resp errorResponse
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+			assert.Equal(t, tt.expectedCode, resp.Error.Code)
+
+			all, err := handler.labels.All()
+			require.NoError(t, err)
+			assert.Empty(t, all)
+		})
+	}
+}
+
+func TestVMHandler_Delete_RemovesLabels(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	require.NoError(t, handler.labels.Set("vm1", map[string]string{"project": "foo"}))
+	require.NoError(t, handler.labels.Set("vm2", map[string]string{"project": "foo"}))
+	mockMP.On("Delete", "vm1", true).Return(nil)
+
+	rec := httptest.NewRecorder()
+	handler.Delete(rec, newLabelsRequest(http.MethodDelete, "vm1", ""))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	all, err := handler.labels.All()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"vm2": {"project": "foo"}}, all)
+}
+
+func TestVMHandler_Create_SavesSpec(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	handler.cfg.Defaults.Image = "24.04"
+	mockMP.On("Launch", mock.Anything).Return(nil)
+
+	// Nothing recorded before the VM exists
+	rec := httptest.NewRecorder()
+	handler.GetSpec(rec, newLabelsRequest(http.MethodGet, "spec-vm", ""))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	body := `{"name": "spec-vm", "packages": ["htop"]}`
+	rec = httptest.NewRecorder()
+	handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/vms", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	handler.GetSpec(rec, newLabelsRequest(http.MethodGet, "spec-vm", ""))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp struct {
+		Spec      CreateVMRequest `json:"spec"`
+		CloudInit string          `json:"cloud_init"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	// The spec has the defaults the launch actually used
+	assert.Equal(t, "spec-vm", resp.Spec.Name)
+	assert.Equal(t, "24.04", resp.Spec.Image)
+	assert.Equal(t, handler.cfg.Defaults.CPU, resp.Spec.CPUs)
+	assert.Equal(t, []string{"htop"}, resp.Spec.Packages)
+	assert.Contains(t, resp.CloudInit, "htop")
+
+	// Deleting the VM drops the record
+	mockMP.On("Delete", "spec-vm", true).Return(nil)
+	rec = httptest.NewRecorder()
+	handler.Delete(rec, newLabelsRequest(http.MethodDelete, "spec-vm", ""))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.GetSpec(rec, newLabelsRequest(http.MethodGet, "spec-vm", ""))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestVMHandler_Create_ForwardSSHAgent(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Launch", mock.Anything).Return(nil)
+
+	// Off unless asked for
+	rec := httptest.NewRecorder()
+	handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/vms", strings.NewReader(`{"name": "plain"}`)))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	cloudInit, err := handler.specs.CloudInit("plain")
+	require.NoError(t, err)
+	assert.NotContains(t, cloudInit, config.SSHAgentSocket)
+
+	rec = httptest.NewRecorder()
+	handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/vms", strings.NewReader(`{"name": "dev", "forward_ssh_agent": true}`)))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	cloudInit, err = handler.specs.CloudInit("dev")
+	require.NoError(t, err)
+	assert.Contains(t, cloudInit, "export SSH_AUTH_SOCK="+config.SSHAgentSocket)
+
+	// The secret in the cloud-init is the one granted, and stays out of the spec
+	secret := regexp.MustCompile(`echo ([0-9a-f]{64}) > /opt/dabbi/ssh-agent-secret`).FindStringSubmatch(cloudInit)
+	require.Len(t, secret, 2)
+	vm, ok, err := handler.specs.SSHAgentVM(secret[1])
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "dev", vm)
+	spec, err := handler.specs.Spec("dev")
+	require.NoError(t, err)
+	assert.NotContains(t, string(spec), secret[1])
+
+	rec = httptest.NewRecorder()
+	handler.RevokeSSHAgent(rec, newLabelsRequest(http.MethodDelete, "dev", ""))
+	require.Equal(t, http.StatusOK, rec.Code)
+	_, ok, err = handler.specs.SSHAgentVM(secret[1])
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestVMHandler_Create_FailedLaunchSavesNoSpec(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Launch", mock.Anything).Return(errors.New("launch failed"))
+
+	rec := httptest.NewRecorder()
+	handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/vms", strings.NewReader(`{"name": "broken"}`)))
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	_, err := handler.specs.Spec("broken")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestVMHandler_Create_Limits(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxVMs         int
+		maxMemory      string
+		expectedStatus int
+	}{
+		{"below_vm_limit", 3, "", http.StatusCreated},
+		{"at_vm_limit", 2, "", http.StatusConflict},
+		{"memory_reaches_limit", 0, "12G", http.StatusCreated},
+		{"memory_over_limit", 0, "10G", http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, mockMP := setupVMHandler(t)
+			handler.cfg.MaxVMs = tt.maxVMs
+			handler.cfg.MaxTotalMemory = tt.maxMemory
+
+			// Two running VMs with 4G each
+			mockMP.On("List").Return(testutil.RunningVMList("vm1", "vm2"), nil)
+			mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "192.168.64.1"), nil)
+			mockMP.On("Info", "vm2").Return(testutil.RunningVM("vm2", "192.168.64.2"), nil)
+			mockMP.On("Launch", mock.Anything).Return(nil)
+
+			rec := httptest.NewRecorder()
+			handler.Create(rec, httptest.NewRequest(http.MethodPost, "/api/vms", strings.NewReader(`{"name": "new-vm", "mem": "4G"}`)))
+
+			require.Equal(t, tt.expectedStatus, rec.Code, rec.Body.String())
+			if tt.expectedStatus == http.StatusConflict {
+				assert.Contains(t, rec.Body.String(), ErrCodeLimitExceeded)
+				mockMP.AssertNotCalled(t, "Launch", mock.Anything)
+			}
+		})
+	}
+}
+
+func TestVMHandler_Clone_Limits(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	handler.cfg.MaxVMs = 2
+	mockMP.On("Info", "vm1").Return(testutil.StoppedVM("vm1"), nil)
+	mockMP.On("List").Return(testutil.RunningVMList("vm1", "vm2"), nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/vm1/clone", strings.NewReader(`{"new_name": "vm3"}`))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "vm1")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	handler.Clone(rec, req)
+
+	require.Equal(t, http.StatusConflict, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), ErrCodeLimitExceeded)
+	mockMP.AssertNotCalled(t, "Clone", mock.Anything, mock.Anything)
+}
+
+func TestVMHandler_ChangeState_Limits(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Start", "vm1").Return(fmt.Errorf("%w: running VMs use 4 of 4 CPUs (max_total_cpu)", quota.ErrExceeded))
+
+	req := httptest.NewRequest(http.MethodPut, "/api/vms/vm1/state", strings.NewReader(`{"action": "start"}`))
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", "vm1")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+	rec := httptest.NewRecorder()
+	handler.ChangeState(rec, req)
+
+	require.Equal(t, http.StatusConflict, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), ErrCodeLimitExceeded)
+}
+
+func TestVMHandler_PinUnpin(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "192.168.64.2"), nil)
+	mockMP.On("List").Return(testutil.RunningVMList("vm1"), nil)
+	mockMP.On("Exec", "vm1", mock.Anything).Return("", errors.New("no checkpoint"))
+	require.NoError(t, handler.labels.Set("vm1", map[string]string{"project": "foo"}))
+
+	rec := httptest.NewRecorder()
+	handler.Pin(rec, newLabelsRequest(http.MethodPost, "vm1", ""))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"pinned": true}`, rec.Body.String())
+
+	// Both the list and the detail report it
+	rec = httptest.NewRecorder()
+	handler.List(rec, httptest.NewRequest(http.MethodGet, "/api/vms", nil))
+	var items []VMListItem
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&items))
+	require.Len(t, items, 1)
+	assert.True(t, items[0].Pinned)
+
+	rec = httptest.NewRecorder()
+	handler.Get(rec, newLabelsRequest(http.MethodGet, "vm1", ""))
+	assert.Contains(t, rec.Body.String(), `"pinned":true`)
+
+	rec = httptest.NewRecorder()
+	handler.Unpin(rec, newLabelsRequest(http.MethodDelete, "vm1", ""))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// Other labels are untouched
+	vmLabels, err := handler.labels.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"project": "foo"}, vmLabels)
+}
+
+func TestVMHandler_Pin_VMNotFound(t *testing.T) {
+	handler, mockMP := setupVMHandler(t)
+	mockMP.On("Info", "ghost").Return(nil, errors.New("instance \"ghost\" does not exist"))
+
+	rec := httptest.NewRecorder()
+	handler.Pin(rec, newLabelsRequest(http.MethodPost, "ghost", ""))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	pinned, err := handler.labels.Pinned()
+	require.NoError(t, err)
+	assert.Empty(t, pinned)
 }
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/proxy"
+)
+
+// WakeHandler manages VMs the proxy is waking for a request
+type WakeHandler struct {
+	proxy *proxy.Router
+}
+
+// NewWakeHandler creates a wake handler
+func NewWakeHandler(pr *proxy.Router) *WakeHandler {
+	return &WakeHandler{proxy: pr}
+}
+
+// Cancel stops waiting for a VM the proxy is waking, so its loading page
+// stops and the next request to it starts a fresh wake. A start multipass
+// is already running isn't aborted.
+// POST /api/vms/{name}/wake/cancel
+func (h *WakeHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !h.proxy.CancelWake(name) {
+		apiError(w, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("VM '%s' is not being woken", name))
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{
+		"status": "cancelled",
+		"name":   name,
+	})
+}
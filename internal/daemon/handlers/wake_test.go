@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/proxy"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func newWakeCancelRequest(vmName string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/"+vmName+"/wake/cancel", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("name", vmName)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestWakeHandler_Cancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "dev").Return(testutil.StoppedVM("dev"), nil)
+	mockMP.On("Start", "dev").Run(func(mock.Arguments) { <-release }).Return(nil)
+
+	pr := proxy.NewRouter(mockMP)
+	handler := NewWakeHandler(pr)
+
+	// A proxied request to the stopped VM starts waking it
+	wakeReq := httptest.NewRequest(http.MethodGet, "/", nil)
+	wakeReq.Host = "dev-3000.localhost"
+	rec := httptest.NewRecorder()
+	pr.Middleware(http.NotFoundHandler()).ServeHTTP(rec, wakeReq)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.Cancel(rec, newWakeCancelRequest("dev"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status": "cancelled", "name": "dev"}`, rec.Body.String())
+
+	// Nothing left to cancel
+	rec = httptest.NewRecorder()
+	handler.Cancel(rec, newWakeCancelRequest("dev"))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrCodeNotFound)
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/watchdog"
+)
+
+// WatchdogHandler handles watchdog configuration API requests
+type WatchdogHandler struct {
+	wd  *watchdog.Watchdog
+	cfg *config.Config
+}
+
+// NewWatchdogHandler creates a new watchdog handler
+func NewWatchdogHandler(wd *watchdog.Watchdog, cfg *config.Config) *WatchdogHandler {
+	return &WatchdogHandler{wd: wd, cfg: cfg}
+}
+
+// WatchdogTimeoutRequest represents a timeout update request
+type WatchdogTimeoutRequest struct {
+	TimeoutMins int `json:"timeout_mins"`
+}
+
+// WatchdogTimeoutResponse represents the current inactivity timeout
+type WatchdogTimeoutResponse struct {
+	TimeoutMins int    `json:"timeout_mins"`
+	Timeout     string `json:"timeout"` // human-readable, e.g. "45m0s"
+}
+
+// GetTimeout returns the current inactivity timeout
+// GET /api/watchdog/timeout
+func (h *WatchdogHandler) GetTimeout(w http.ResponseWriter, r *http.Request) {
+	d := h.wd.GetTimeout()
+	respondJSON(w, http.StatusOK, WatchdogTimeoutResponse{
+		TimeoutMins: int(d / time.Minute),
+		Timeout:     d.String(),
+	})
+}
+
+// SetTimeout updates the inactivity timeout live and persists it to config
+// PUT /api/watchdog/timeout
+func (h *WatchdogHandler) SetTimeout(w http.ResponseWriter, r *http.Request) {
+	var req WatchdogTimeoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return
+	}
+
+	d := time.Duration(req.TimeoutMins) * time.Minute
+	if err := watchdog.ValidateTimeout(d); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, err.Error())
+		return
+	}
+
+	// Save to disk first so a failed write doesn't leave config and runtime out of sync
+	err := h.cfg.Update(func(cfg *config.Config) {
+		cfg.ShutdownTimeoutMins = req.TimeoutMins
+	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	if err := h.wd.SetTimeout(d); err != nil {
+		apiError(w, http.StatusBadRequest, ErrCodeInvalidConfig, err.Error())
+		return
+	}
+
+	respondJSON(w, http.StatusOK, WatchdogTimeoutResponse{
+		TimeoutMins: req.TimeoutMins,
+		Timeout:     d.String(),
+	})
+}
+
+// WatchdogCheckResponse lists what an on-demand check decided per running VM
+type WatchdogCheckResponse struct {
+	Decisions []watchdog.Decision `json:"decisions"`
+}
+
+// Check runs the idle check now instead of waiting for the next tick. Idle
+// VMs past the timeout are stopped or suspended, as on a normal tick.
+// POST /api/watchdog/check
+func (h *WatchdogHandler) Check(w http.ResponseWriter, r *http.Request) {
+	decisions, err := h.wd.CheckNow()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, WatchdogCheckResponse{Decisions: decisions})
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/mjshashank/dabbi/internal/watchdog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func setupWatchdogHandler(t *testing.T) (*WatchdogHandler, *watchdog.Watchdog, *config.Config) {
+	// Isolate config writes from the real home directory
+	tmpHome := t.TempDir()
+	origHome := os.Getenv("HOME")
+	os.Setenv("HOME", tmpHome)
+	t.Cleanup(func() { os.Setenv("HOME", origHome) })
+
+	cfg := config.DefaultConfig()
+	wd := watchdog.New(new(testutil.MockMultipassClient), time.Duration(cfg.ShutdownTimeoutMins)*time.Minute)
+	t.Cleanup(wd.Stop)
+
+	return NewWatchdogHandler(wd, cfg), wd, cfg
+}
+
+func TestWatchdogHandler_GetTimeout(t *testing.T) {
+	handler, _, _ := setupWatchdogHandler(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/watchdog/timeout", nil)
+	rec := httptest.NewRecorder()
+
+	handler.GetTimeout(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var resp WatchdogTimeoutResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, 5, resp.TimeoutMins)
+	assert.Equal(t, "5m0s", resp.Timeout)
+}
+
+func TestWatchdogHandler_SetTimeout(t *testing.T) {
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedMins   int
+	}{
+		{
+			name:           "updates_timeout",
+			body:           `{"timeout_mins": 45}`,
+			expectedStatus: http.StatusOK,
+			expectedMins:   45,
+		},
+		{
+			name:           "rejects_zero",
+			body:           `{"timeout_mins": 0}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedMins:   5,
+		},
+		{
+			name:           "rejects_negative",
+			body:           `{"timeout_mins": -10}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedMins:   5,
+		},
+		{
+			name:           "rejects_invalid_json",
+			body:           `not json`,
+			expectedStatus: http.StatusBadRequest,
+			expectedMins:   5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, wd, cfg := setupWatchdogHandler(t)
+
+			req := httptest.NewRequest(http.MethodPut, "/api/watchdog/timeout", bytes.NewBufferString(tt.body))
+			rec := httptest.NewRecorder()
+
+			handler.SetTimeout(rec, req)
+
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+			assert.Equal(t, time.Duration(tt.expectedMins)*time.Minute, wd.GetTimeout())
+			assert.Equal(t, tt.expectedMins, cfg.ShutdownTimeoutMins)
+		})
+	}
+}
+
+func TestWatchdogHandler_Check(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "busy-vm", State: multipass.StateRunning},
+		{Name: "stopped-vm", State: multipass.StateStopped},
+	}, nil)
+	mockMP.On("Exec", "busy-vm", mock.MatchedBy(func(cmd []string) bool {
+		return len(cmd) >= 2 && cmd[0] == "sh"
+	})).Return("1000 2000\n-1\n0.9", nil)
+
+	wd := watchdog.New(mockMP, 30*time.Minute)
+	t.Cleanup(wd.Stop)
+	handler := NewWatchdogHandler(wd, config.DefaultConfig())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/watchdog/check", nil)
+	rec := httptest.NewRecorder()
+
+	handler.Check(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var resp WatchdogCheckResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Len(t, resp.Decisions, 1)
+	assert.Equal(t, "busy-vm", resp.Decisions[0].VM)
+	assert.Equal(t, watchdog.DecisionKeep, resp.Decisions[0].Action)
+}
+
+func TestWatchdogHandler_Check_ListError(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(nil, errors.New("multipass unavailable"))
+
+	wd := watchdog.New(mockMP, 30*time.Minute)
+	t.Cleanup(wd.Stop)
+	handler := NewWatchdogHandler(wd, config.DefaultConfig())
+
+	rec := httptest.NewRecorder()
+	handler.Check(rec, httptest.NewRequest(http.MethodPost, "/api/watchdog/check", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	var resp errorResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, ErrCodeInternal, resp.Error.Code)
+}
@@ -0,0 +1,74 @@
+package mw
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/mjshashank/dabbi/internal/audit"
+)
+
+// Audit returns middleware that records mutating requests (anything but
+// GET, HEAD, and OPTIONS) in the audit log once they complete. It logs the
+// route, VM, status, caller address, and how the caller authenticated;
+// request bodies, query strings, and credentials are never written.
+func Audit(al *audit.Log) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if al == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, note := audit.WithNote(r.Context())
+			r = r.WithContext(ctx)
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			entry := audit.Entry{
+				Source:   audit.SourceAPI,
+				Action:   r.Method + " " + r.URL.Path,
+				VM:       note.VM,
+				Detail:   note.Detail,
+				Auth:     Credential(r),
+				ClientIP: clientIP(r),
+				Status:   status,
+				Result:   audit.ResultOK,
+			}
+			if status >= http.StatusBadRequest {
+				entry.Result = audit.ResultError
+			}
+			// The route pattern and VM name are known once chi has routed the request
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				if pattern := rctx.RoutePattern(); pattern != "" {
+					entry.Action = r.Method + " " + pattern
+				}
+				if vm := rctx.URLParam("name"); vm != "" {
+					entry.VM = vm
+				}
+			}
+
+			if err := al.Append(entry); err != nil {
+				log.Printf("audit: %v", err)
+			}
+		})
+	}
+}
+
+// clientIP returns the caller's address without the port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
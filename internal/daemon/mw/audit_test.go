@@ -0,0 +1,128 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/audit"
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/httpkit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAuditedRouter(t *testing.T) (http.Handler, *audit.Log, string) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	al := audit.NewLog(path)
+
+	r := chi.NewRouter()
+	r.Route("/api", func(r chi.Router) {
+		r.Use(BearerAuth(testToken, []config.APIKey{{Name: "ci", Token: "ci-token"}}))
+		r.Use(Audit(al))
+		r.Get("/vms/{name}", func(w http.ResponseWriter, r *http.Request) {})
+		r.Post("/vms/{name}/state", func(w http.ResponseWriter, r *http.Request) {
+			audit.SetDetail(r.Context(), "stop")
+		})
+		r.Delete("/vms/{name}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+		r.Post("/tunnels", func(w http.ResponseWriter, r *http.Request) {
+			audit.SetVM(r.Context(), "dev")
+			w.WriteHeader(http.StatusCreated)
+		})
+	})
+	return r, al, path
+}
+
+func TestAudit(t *testing.T) {
+	router, al, path := newAuditedRouter(t)
+
+	send := func(method, target string, cookie bool) {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "203.0.113.7:51234"
+		if cookie {
+			req.AddCookie(&http.Cookie{Name: httpkit.AuthCookieName, Value: testToken})
+		} else {
+			req.Header.Set("Authorization", "Bearer "+testToken)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send(http.MethodGet, "/api/vms/dev", false)
+	send(http.MethodPost, "/api/vms/dev/state?token="+testToken, false)
+	send(http.MethodDelete, "/api/vms/dev", true)
+	send(http.MethodPost, "/api/tunnels", false)
+
+	entries, err := al.Recent(10)
+	require.NoError(t, err)
+	require.Len(t, entries, 3, "GET requests are not audited")
+
+	assert.Equal(t, "POST /api/tunnels", entries[0].Action)
+	assert.Equal(t, "dev", entries[0].VM)
+	assert.Equal(t, http.StatusCreated, entries[0].Status)
+
+	assert.Equal(t, "DELETE /api/vms/{name}", entries[1].Action)
+	assert.Equal(t, "cookie", entries[1].Auth)
+	assert.Equal(t, audit.ResultError, entries[1].Result)
+	assert.Equal(t, http.StatusInternalServerError, entries[1].Status)
+
+	state := entries[2]
+	assert.Equal(t, audit.SourceAPI, state.Source)
+	assert.Equal(t, "POST /api/vms/{name}/state", state.Action)
+	assert.Equal(t, "dev", state.VM)
+	assert.Equal(t, "stop", state.Detail)
+	assert.Equal(t, "bearer", state.Auth)
+	assert.Equal(t, "203.0.113.7", state.ClientIP)
+	assert.Equal(t, http.StatusOK, state.Status)
+	assert.Equal(t, audit.ResultOK, state.Result)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), testToken)
+}
+
+func TestAudit_RecordsAPIKeyName(t *testing.T) {
+	router, al, path := newAuditedRouter(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/vms/dev/state", nil)
+	req.Header.Set("Authorization", "Bearer ci-token")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	entries, err := al.Recent(1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "key:ci", entries[0].Auth)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "ci-token")
+}
+
+func TestAudit_NilLog(t *testing.T) {
+	called := false
+	h := Audit(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/vms/dev", nil))
+	assert.True(t, called)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAudit_UnauthorizedNotLogged(t *testing.T) {
+	router, al, _ := newAuditedRouter(t)
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/vms/dev", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	entries, err := al.Recent(10)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
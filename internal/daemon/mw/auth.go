@@ -1,24 +1,56 @@
 package mw
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"strings"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/httpkit"
 )
 
-// AuthCookieName is the name of the authentication cookie
-const AuthCookieName = "dabbi_auth"
+type credentialKey struct{}
+
+// credential is what BearerAuth stores in the request context
+type credential struct {
+	kind     string
+	keyName  string // API key used, if any
+	readOnly bool
+}
+
+// Credential reports how an authenticated request presented the token:
+// "cookie" or "bearer" for the auth token, "key:<name>" for an API key, or
+// "" if it didn't pass through BearerAuth
+func Credential(r *http.Request) string {
+	c, _ := r.Context().Value(credentialKey{}).(credential)
+	if c.keyName != "" {
+		return "key:" + c.keyName
+	}
+	return c.kind
+}
+
+// ReadOnly reports whether the request authenticated with a read-only API key
+func ReadOnly(r *http.Request) bool {
+	c, _ := r.Context().Value(credentialKey{}).(credential)
+	return c.readOnly
+}
+
+func withCredential(r *http.Request, c credential) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), credentialKey{}, c))
+}
 
 // BearerAuth returns middleware that validates authentication via:
 // 1. Cookie (preferred for browser/WebSocket)
-// 2. Authorization: Bearer header (for API clients)
-func BearerAuth(token string) func(http.Handler) http.Handler {
+// 2. Authorization: Bearer header (for API clients), with the auth token
+// or one of the configured API keys
+func BearerAuth(token string, keys []config.APIKey) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			// Check cookie first (works for both regular requests and WebSocket)
-			if cookie, err := r.Cookie(AuthCookieName); err == nil {
+			if cookie, err := r.Cookie(httpkit.AuthCookieName); err == nil {
 				if cookie.Value == token {
-					next.ServeHTTP(w, r)
+					next.ServeHTTP(w, withCredential(r, credential{kind: "cookie"}))
 					return
 				}
 			}
@@ -26,32 +58,52 @@ func BearerAuth(token string) func(http.Handler) http.Handler {
 			// Fall back to Authorization header for API clients
 			auth := r.Header.Get("Authorization")
 			if auth == "" {
-				http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+				writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized")
 				return
 			}
 
 			parts := strings.SplitN(auth, " ", 2)
 			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-				http.Error(w, `{"error": "Invalid Authorization header format"}`, http.StatusUnauthorized)
+				writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid Authorization header format")
 				return
 			}
 
-			if parts[1] != token {
-				http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+			if parts[1] == token {
+				next.ServeHTTP(w, withCredential(r, credential{kind: "bearer"}))
 				return
 			}
+			for _, key := range keys {
+				if key.Token != "" && parts[1] == key.Token {
+					next.ServeHTTP(w, withCredential(r, credential{kind: "bearer", keyName: key.Name, readOnly: key.ReadOnly}))
+					return
+				}
+			}
 
-			next.ServeHTTP(w, r)
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Unauthorized")
 		})
 	}
 }
 
+// RequireWrite rejects requests made with a read-only API key. Apply it to
+// every route that changes state or runs commands in a VM.
+func RequireWrite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ReadOnly(r) {
+			writeError(w, http.StatusForbidden, "FORBIDDEN", "API key is read-only")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // LoginHandler returns a handler that validates token and sets auth cookie.
+// A non-empty cookieDomain (e.g. ".example.com") shares the cookie with
+// subdomains; otherwise it is host-only.
 // This endpoint is NOT protected by auth middleware.
-func LoginHandler(token string, secureCookie bool) http.HandlerFunc {
+func LoginHandler(token string, secureCookie bool, cookieDomain string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+			writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
 			return
 		}
 
@@ -59,23 +111,24 @@ func LoginHandler(token string, secureCookie bool) http.HandlerFunc {
 			Token string `json:"token"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
 			return
 		}
 
 		if req.Token != token {
-			http.Error(w, `{"error": "Invalid token"}`, http.StatusUnauthorized)
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid token")
 			return
 		}
 
 		// Set HttpOnly cookie - not accessible via JavaScript
 		http.SetCookie(w, &http.Cookie{
-			Name:     AuthCookieName,
+			Name:     httpkit.AuthCookieName,
 			Value:    token,
 			Path:     "/",
+			Domain:   cookieDomain,
 			HttpOnly: true,
 			Secure:   secureCookie, // true when using HTTPS
-			SameSite: http.SameSiteStrictMode,
+			SameSite: httpkit.CookieSameSite(cookieDomain),
 			MaxAge:   86400 * 30, // 30 days
 		})
 
@@ -85,19 +138,21 @@ func LoginHandler(token string, secureCookie bool) http.HandlerFunc {
 	}
 }
 
-// LogoutHandler returns a handler that clears the auth cookie.
-func LogoutHandler() http.HandlerFunc {
+// LogoutHandler returns a handler that clears the auth cookie. cookieDomain
+// must match the one used at login or the browser keeps the cookie.
+func LogoutHandler(cookieDomain string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, `{"error": "Method not allowed"}`, http.StatusMethodNotAllowed)
+			writeError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
 			return
 		}
 
 		// Clear cookie by setting MaxAge to -1
 		http.SetCookie(w, &http.Cookie{
-			Name:     AuthCookieName,
+			Name:     httpkit.AuthCookieName,
 			Value:    "",
 			Path:     "/",
+			Domain:   cookieDomain,
 			HttpOnly: true,
 			MaxAge:   -1,
 		})
@@ -107,3 +162,14 @@ func LogoutHandler() http.HandlerFunc {
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}
 }
+
+// writeError writes an error in the same {"error": {"code", "message"}} shape as the API handlers
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	body := map[string]string{"code": code, "message": message}
+	if id := w.Header().Get(httpkit.RequestIDHeader); id != "" {
+		body["request_id"] = id
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]map[string]string{"error": body})
+}
@@ -7,6 +7,9 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/httpkit"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -39,7 +42,7 @@ func TestBearerAuth(t *testing.T) {
 		{
 			name: "valid_cookie",
 			setupRequest: func(r *http.Request) {
-				r.AddCookie(&http.Cookie{Name: AuthCookieName, Value: testToken})
+				r.AddCookie(&http.Cookie{Name: httpkit.AuthCookieName, Value: testToken})
 			},
 			expectedStatus: http.StatusOK,
 			shouldPassNext: true,
@@ -47,7 +50,7 @@ func TestBearerAuth(t *testing.T) {
 		{
 			name: "cookie_takes_precedence_over_invalid_bearer",
 			setupRequest: func(r *http.Request) {
-				r.AddCookie(&http.Cookie{Name: AuthCookieName, Value: testToken})
+				r.AddCookie(&http.Cookie{Name: httpkit.AuthCookieName, Value: testToken})
 				r.Header.Set("Authorization", "Bearer wrong-token")
 			},
 			expectedStatus: http.StatusOK,
@@ -64,7 +67,7 @@ func TestBearerAuth(t *testing.T) {
 		{
 			name: "invalid_cookie_falls_back_to_bearer",
 			setupRequest: func(r *http.Request) {
-				r.AddCookie(&http.Cookie{Name: AuthCookieName, Value: "wrong"})
+				r.AddCookie(&http.Cookie{Name: httpkit.AuthCookieName, Value: "wrong"})
 				r.Header.Set("Authorization", "Bearer "+testToken)
 			},
 			expectedStatus: http.StatusOK,
@@ -73,7 +76,7 @@ func TestBearerAuth(t *testing.T) {
 		{
 			name: "invalid_cookie_no_bearer",
 			setupRequest: func(r *http.Request) {
-				r.AddCookie(&http.Cookie{Name: AuthCookieName, Value: "wrong"})
+				r.AddCookie(&http.Cookie{Name: httpkit.AuthCookieName, Value: "wrong"})
 			},
 			expectedStatus: http.StatusUnauthorized,
 			shouldPassNext: false,
@@ -134,7 +137,7 @@ func TestBearerAuth(t *testing.T) {
 				w.WriteHeader(http.StatusOK)
 			})
 
-			middleware := BearerAuth(testToken)
+			middleware := BearerAuth(testToken, nil)
 			handler := middleware(next)
 
 			req := httptest.NewRequest(http.MethodGet, "/api/test", nil)
@@ -149,12 +152,54 @@ func TestBearerAuth(t *testing.T) {
 	}
 }
 
+func TestRequireWrite(t *testing.T) {
+	keys := []config.APIKey{
+		{Name: "dashboard", Token: "read-only-key", ReadOnly: true},
+		{Name: "ci", Token: "ci-key"},
+		{Name: "unset"},
+	}
+
+	r := chi.NewRouter()
+	r.Use(BearerAuth(testToken, keys))
+	r.Get("/api/vms", func(w http.ResponseWriter, r *http.Request) {})
+	r.With(RequireWrite).Delete("/api/vms/{name}", func(w http.ResponseWriter, r *http.Request) {})
+
+	send := func(method, target, token string) int {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// A read-only key can list but not delete
+	assert.Equal(t, http.StatusOK, send(http.MethodGet, "/api/vms", "read-only-key"))
+	assert.Equal(t, http.StatusForbidden, send(http.MethodDelete, "/api/vms/dev", "read-only-key"))
+
+	// Full keys and the auth token can do both
+	for _, token := range []string{"ci-key", testToken} {
+		assert.Equal(t, http.StatusOK, send(http.MethodGet, "/api/vms", token))
+		assert.Equal(t, http.StatusOK, send(http.MethodDelete, "/api/vms/dev", token))
+	}
+
+	// A key without a token never matches
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodGet, "/api/vms", ""))
+
+	// API keys are bearer-only; they aren't accepted as the auth cookie
+	req := httptest.NewRequest(http.MethodGet, "/api/vms", nil)
+	req.AddCookie(&http.Cookie{Name: httpkit.AuthCookieName, Value: "ci-key"})
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
 func TestLoginHandler(t *testing.T) {
 	tests := []struct {
 		name           string
 		method         string
 		body           interface{}
 		secureCookie   bool
+		cookieDomain   string
 		expectedStatus int
 		checkCookie    bool
 	}{
@@ -174,6 +219,15 @@ func TestLoginHandler(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			checkCookie:    true,
 		},
+		{
+			name:           "successful_login_cookie_domain",
+			method:         http.MethodPost,
+			body:           map[string]string{"token": testToken},
+			secureCookie:   true,
+			cookieDomain:   ".example.com",
+			expectedStatus: http.StatusOK,
+			checkCookie:    true,
+		},
 		{
 			name:           "invalid_token",
 			method:         http.MethodPost,
@@ -226,7 +280,7 @@ func TestLoginHandler(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			handler := LoginHandler(testToken, tt.secureCookie)
+			handler := LoginHandler(testToken, tt.secureCookie, tt.cookieDomain)
 
 			var body *bytes.Buffer
 			if tt.body != nil {
@@ -254,12 +308,19 @@ func TestLoginHandler(t *testing.T) {
 				require.Len(t, cookies, 1)
 				cookie := cookies[0]
 
-				assert.Equal(t, AuthCookieName, cookie.Name)
+				assert.Equal(t, httpkit.AuthCookieName, cookie.Name)
 				assert.Equal(t, testToken, cookie.Value)
 				assert.Equal(t, "/", cookie.Path)
 				assert.True(t, cookie.HttpOnly)
 				assert.Equal(t, tt.secureCookie, cookie.Secure)
-				assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+				if tt.cookieDomain != "" {
+					// Go drops the leading dot when parsing Set-Cookie
+					assert.Equal(t, "example.com", cookie.Domain)
+					assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+				} else {
+					assert.Empty(t, cookie.Domain)
+					assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+				}
 				assert.Equal(t, 86400*30, cookie.MaxAge)
 			}
 
@@ -302,7 +363,7 @@ func TestLogoutHandler(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			handler := LogoutHandler()
+			handler := LogoutHandler("")
 
 			req := httptest.NewRequest(tt.method, "/api/auth/logout", nil)
 			rec := httptest.NewRecorder()
@@ -316,7 +377,7 @@ func TestLogoutHandler(t *testing.T) {
 				require.Len(t, cookies, 1)
 				cookie := cookies[0]
 
-				assert.Equal(t, AuthCookieName, cookie.Name)
+				assert.Equal(t, httpkit.AuthCookieName, cookie.Name)
 				assert.Equal(t, "", cookie.Value)
 				assert.Equal(t, "/", cookie.Path)
 				assert.True(t, cookie.HttpOnly)
@@ -334,7 +395,7 @@ func TestLogoutHandler(t *testing.T) {
 }
 
 func TestLogoutHandler_MultipleLogouts(t *testing.T) {
-	handler := LogoutHandler()
+	handler := LogoutHandler("")
 
 	// First logout
 	req1 := httptest.NewRequest(http.MethodPost, "/api/auth/logout", nil)
@@ -348,3 +409,15 @@ func TestLogoutHandler_MultipleLogouts(t *testing.T) {
 	handler.ServeHTTP(rec2, req2)
 	assert.Equal(t, http.StatusOK, rec2.Code)
 }
+
+func TestRequestID_InAuthErrors(t *testing.T) {
+	h := httpkit.RequestID(BearerAuth("secret", nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms", nil)
+	req.Header.Set(httpkit.RequestIDHeader, "trace-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"request_id":"trace-1"`)
+}
@@ -0,0 +1,85 @@
+package mw
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/httpkit"
+)
+
+// corsMethods are the methods the API uses
+const corsMethods = "GET, POST, PUT, DELETE, OPTIONS"
+
+// corsHeaders are the request headers API clients always need
+var corsHeaders = []string{"Authorization", "Content-Type"}
+
+// corsMaxAge is how long (seconds) browsers may cache a preflight response
+const corsMaxAge = "600"
+
+// OriginAllowed reports whether origin (scheme://host[:port]) is in the
+// allowlist. Matching is exact on scheme and host, ignoring case and a
+// trailing slash. The shell websocket and CORS share this check so both
+// honor the same allowed_origins.
+func OriginAllowed(origin string, allowed []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, a := range allowed {
+		au, err := url.Parse(strings.TrimSuffix(a, "/"))
+		if err != nil || au.Host == "" {
+			continue
+		}
+		if strings.EqualFold(au.Scheme, u.Scheme) && strings.EqualFold(au.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS returns middleware that lets frontends on the allowed origins call the
+// API from a browser, with credentials so cookie auth works. Other origins get
+// no CORS headers, so browsers block their requests. Preflight requests are
+// answered here, before auth, since browsers send them without credentials.
+// extraHeaders are request headers allowed in addition to Authorization and
+// Content-Type.
+func CORS(allowedOrigins, extraHeaders []string) func(http.Handler) http.Handler {
+	allowHeaders := strings.Join(append(append([]string{}, corsHeaders...), extraHeaders...), ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Responses differ by origin, so caches must key on it
+			w.Header().Add("Vary", "Origin")
+			allowed := OriginAllowed(origin, allowedOrigins)
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			if !allowed {
+				if preflight {
+					writeError(w, http.StatusForbidden, "FORBIDDEN", "Origin not allowed")
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", httpkit.RequestIDHeader)
+			if preflight {
+				w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+				w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mjshashank/dabbi/internal/httpkit"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCORSRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Route("/api", func(r chi.Router) {
+		r.Use(CORS([]string{"https://dash.example.com"}, []string{"X-Request-ID"}))
+		r.Use(BearerAuth(testToken, nil))
+		r.Get("/vms", func(w http.ResponseWriter, r *http.Request) {})
+		r.Delete("/vms/{name}", func(w http.ResponseWriter, r *http.Request) {})
+	})
+	return r
+}
+
+func TestCORS_Preflight(t *testing.T) {
+	router := newCORSRouter()
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/api/vms/dev", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+		req.Header.Set("Access-Control-Request-Headers", "authorization")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Answered without credentials, before auth
+	rec := preflight("https://dash.example.com")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://dash.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, rec.Header().Get("Access-Control-Allow-Methods"), http.MethodDelete)
+	assert.Equal(t, "Authorization, Content-Type, X-Request-ID", rec.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "Origin", rec.Header().Get("Vary"))
+
+	rec = preflight("https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, rec.Header().Get("Access-Control-Allow-Methods"))
+}
+
+func TestCORS_Request(t *testing.T) {
+	router := newCORSRouter()
+
+	tests := []struct {
+		name        string
+		origin      string
+		bearer      bool
+		wantStatus  int
+		allowOrigin string
+	}{
+		{"allowed_origin", "https://dash.example.com", true, http.StatusOK, "https://dash.example.com"},
+		{"allowed_origin_case_insensitive", "HTTPS://Dash.Example.com", true, http.StatusOK, "HTTPS://Dash.Example.com"},
+		{"allowed_origin_still_needs_auth", "https://dash.example.com", false, http.StatusUnauthorized, "https://dash.example.com"},
+		{"disallowed_origin", "https://evil.example.com", true, http.StatusOK, ""},
+		{"wrong_scheme", "http://dash.example.com", true, http.StatusOK, ""},
+		{"wrong_port", "https://dash.example.com:8443", true, http.StatusOK, ""},
+		{"no_origin", "", true, http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/vms", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.bearer {
+				req.Header.Set("Authorization", "Bearer "+testToken)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.allowOrigin, rec.Header().Get("Access-Control-Allow-Origin"))
+			if tt.allowOrigin != "" {
+				assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+				assert.Equal(t, httpkit.RequestIDHeader, rec.Header().Get("Access-Control-Expose-Headers"))
+			} else {
+				assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+			}
+		})
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://dash.example.com/", "http://localhost:5173", "not a url"}
+
+	assert.True(t, OriginAllowed("https://dash.example.com", allowed))
+	assert.True(t, OriginAllowed("http://localhost:5173", allowed))
+	assert.False(t, OriginAllowed("http://localhost:3000", allowed))
+	assert.False(t, OriginAllowed("https://dash.example.com.evil.com", allowed))
+	assert.False(t, OriginAllowed("null", allowed))
+	assert.False(t, OriginAllowed("https://dash.example.com", nil))
+}
@@ -0,0 +1,40 @@
+package mw
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/mjshashank/dabbi/internal/httpkit"
+)
+
+// NoDeadline lifts the server's read and write timeouts for a request, for
+// routes that legitimately outlast them: launches that wait for cloud-init,
+// large file transfers, and streams. The shell websocket also sets its own
+// read and write deadlines once upgraded. The API request timeout (see
+// Timeout) is lifted too.
+func NoDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A batch buffers every response and waits for all of them, which a
+		// stream or a large transfer would hold up indefinitely
+		if InBatch(r) {
+			writeError(w, http.StatusBadRequest, "INVALID_REQUEST", "long-running routes (streams, transfers, recordings) can't be batched")
+			return
+		}
+		httpkit.LiftDeadlines(w)
+		liftTimeout(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// batchKey marks the sub-requests of a batch (see handlers.BatchHandler)
+type batchKey struct{}
+
+// WithBatch marks requests made with ctx as sub-requests of a batch
+func WithBatch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, batchKey{}, true)
+}
+
+// InBatch reports whether r is a sub-request of a batch
+func InBatch(r *http.Request) bool {
+	return r.Context().Value(batchKey{}) != nil
+}
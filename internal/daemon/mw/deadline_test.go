@@ -0,0 +1,44 @@
+package mw
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoDeadline(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/slow", slow)
+	// Wrapped the way the router wraps writers, to check deadlines reach the connection
+	mux.Handle("/lifted", middleware.Logger(NoDeadline(slow)))
+
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// The server's write timeout cuts the slow response off
+	if resp, err := http.Get(srv.URL + "/slow"); err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Error(t, err)
+	}
+
+	resp, err := http.Get(srv.URL + "/lifted")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "done", string(body))
+}
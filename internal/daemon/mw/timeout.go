@@ -0,0 +1,109 @@
+package mw
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ErrRequestTimeout is the cause of a request context Timeout canceled
+var ErrRequestTimeout = errors.New("request timed out")
+
+// timeoutKey holds the timer that cancels a request, so NoDeadline can stop it
+type timeoutKey struct{}
+
+// Timeout cancels a request's context after d, so handlers and the
+// multipass commands they pass the context on to (see
+// multipass.Client.InfoContext) give up instead of holding the request
+// open. Whatever a handler answers once that has happened, typically the
+// error of the killed command, is replaced with a 504, as is no answer at
+// all. Like chi's middleware.Timeout, it doesn't interrupt a handler that
+// ignores the context. Routes behind NoDeadline opt out. A zero or negative
+// d disables the timeout.
+func Timeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if d <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
+			timer := time.AfterFunc(d, func() { cancel(ErrRequestTimeout) })
+			defer timer.Stop()
+
+			tw := &timeoutWriter{ResponseWriter: w, ctx: ctx, d: d}
+			next.ServeHTTP(tw, r.WithContext(context.WithValue(ctx, timeoutKey{}, timer)))
+			tw.answer()
+		})
+	}
+}
+
+// timeoutWriter answers with a 504 in place of a response begun after the
+// request timed out. A response begun in time goes through untouched.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	d        time.Duration
+	answered bool // the response has begun, one way or the other
+	timedOut bool // it's a 504, and the handler's writes are dropped
+}
+
+// answer begins the response, with a 504 if the request has timed out
+func (tw *timeoutWriter) answer() {
+	if tw.answered {
+		return
+	}
+	tw.answered = true
+	if context.Cause(tw.ctx) == ErrRequestTimeout {
+		tw.timedOut = true
+		writeError(tw.ResponseWriter, http.StatusGatewayTimeout, "TIMEOUT", fmt.Sprintf("request timed out after %s", tw.d))
+	}
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.answer()
+	if !tw.timedOut {
+		tw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.answer()
+	if tw.timedOut {
+		return len(b), nil
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.answer()
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok && !tw.timedOut {
+		f.Flush()
+	}
+}
+
+// Hijack hands over the connection, for websockets behind NoDeadline
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := tw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer doesn't support hijacking")
+	}
+	tw.answered = true
+	return hj.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the connection's deadlines
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// liftTimeout stops the Timeout for r's request, if it hasn't fired yet
+func liftTimeout(r *http.Request) {
+	if timer, ok := r.Context().Value(timeoutKey{}).(*time.Timer); ok {
+		timer.Stop()
+	}
+}
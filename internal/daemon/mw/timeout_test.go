@@ -0,0 +1,100 @@
+package mw
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForCancel blocks until the request is canceled or a second passes,
+// like a handler running a command with the request's context
+func waitForCancel(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-r.Context().Done():
+	case <-time.After(time.Second):
+		w.Write([]byte("finished"))
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var cause error
+	h := Timeout(50 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		waitForCancel(w, r)
+		cause = context.Cause(r.Context())
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/vms", nil))
+
+	assert.ErrorIs(t, cause, ErrRequestTimeout)
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	var resp map[string]map[string]string
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "TIMEOUT", resp["error"]["code"])
+}
+
+func TestTimeout_ReplacesLateResponse(t *testing.T) {
+	h := Timeout(50 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		http.Error(w, "multipass killed", http.StatusInternalServerError)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/vms", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "multipass killed")
+}
+
+func TestTimeout_KeepsResponseBegunInTime(t *testing.T) {
+	h := Timeout(50 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		<-r.Context().Done()
+		w.Write([]byte("partial"))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/vms", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "partial", rec.Body.String())
+}
+
+func TestTimeout_FastRequest(t *testing.T) {
+	h := Timeout(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/vms", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok", rec.Body.String())
+}
+
+func TestTimeout_NoDeadlineOptsOut(t *testing.T) {
+	h := Timeout(50 * time.Millisecond)(NoDeadline(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(200 * time.Millisecond):
+			w.Write([]byte("streamed"))
+		}
+	})))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/vms/dev/shell", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "streamed", rec.Body.String())
+}
+
+func TestTimeout_Disabled(t *testing.T) {
+	next := http.HandlerFunc(waitForCancel)
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	Timeout(0)(next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/vms", nil))
+	assert.Equal(t, "finished", rec.Body.String())
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/config"
+)
+
+const pidFileName = "dabbi.pid"
+
+// AlreadyRunningError is returned when the PID file names a live process
+type AlreadyRunningError struct {
+	PID  int
+	Path string
+}
+
+func (e *AlreadyRunningError) Error() string {
+	return fmt.Sprintf("dabbi is already running (pid %d, see %s)", e.PID, e.Path)
+}
+
+// PIDFile marks the running daemon so a second `dabbi serve` refuses to start
+type PIDFile struct {
+	path string
+}
+
+// DefaultPIDPath returns the path to the PID file (~/.dabbi/dabbi.pid)
+func DefaultPIDPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, config.ConfigDir, pidFileName), nil
+}
+
+// AcquirePIDFile writes the current PID to path, creating it exclusively so
+// two daemons starting at once can't both succeed. It fails with an
+// *AlreadyRunningError if the file names another live process; a stale file
+// left by a crashed daemon is replaced.
+func AcquirePIDFile(path string) (*PIDFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	// Replacing a stale file takes a second attempt
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return &PIDFile{path: path}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if pid, ok := readPID(path); ok && pid != os.Getpid() && processAlive(pid) {
+			return nil, &AlreadyRunningError{PID: pid, Path: path}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("failed to create %s: another dabbi is starting", path)
+}
+
+// Release removes the PID file if it still belongs to this process
+func (p *PIDFile) Release() error {
+	if pid, ok := readPID(p.path); !ok || pid != os.Getpid() {
+		return nil
+	}
+	if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// readPID returns the PID recorded in path, if it holds one
+func readPID(path string) (int, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
@@ -0,0 +1,70 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquirePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dabbi.pid")
+
+	p, err := AcquirePIDFile(path)
+	require.NoError(t, err)
+
+	pid, ok := readPID(path)
+	require.True(t, ok)
+	assert.Equal(t, os.Getpid(), pid)
+
+	require.NoError(t, p.Release())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAcquirePIDFile_LiveProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dabbi.pid")
+
+	// The parent process (the test runner) is alive and isn't us
+	require.NoError(t, os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())), 0600))
+
+	_, err := AcquirePIDFile(path)
+	var running *AlreadyRunningError
+	require.ErrorAs(t, err, &running)
+	assert.Equal(t, os.Getppid(), running.PID)
+}
+
+func TestAcquirePIDFile_StaleOrGarbage(t *testing.T) {
+	for name, content := range map[string]string{
+		"stale":   "2147483646", // no such process
+		"garbage": "not-a-pid",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dabbi.pid")
+			require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+			_, err := AcquirePIDFile(path)
+			require.NoError(t, err)
+
+			pid, ok := readPID(path)
+			require.True(t, ok)
+			assert.Equal(t, os.Getpid(), pid)
+		})
+	}
+}
+
+func TestPIDFile_ReleaseKeepsOtherOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dabbi.pid")
+	p, err := AcquirePIDFile(path)
+	require.NoError(t, err)
+
+	// Another daemon took over the file; releasing must not delete it
+	require.NoError(t, os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())), 0600))
+	require.NoError(t, p.Release())
+
+	_, err = os.Stat(path)
+	assert.NoError(t, err)
+}
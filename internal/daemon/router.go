@@ -6,116 +6,304 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/mjshashank/dabbi/internal/agent"
+	"github.com/mjshashank/dabbi/internal/audit"
 	"github.com/mjshashank/dabbi/internal/config"
 	"github.com/mjshashank/dabbi/internal/daemon/handlers"
 	authMw "github.com/mjshashank/dabbi/internal/daemon/mw"
+	"github.com/mjshashank/dabbi/internal/httpkit"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/mounts"
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/proxy"
 	"github.com/mjshashank/dabbi/internal/tunnel"
 	"github.com/mjshashank/dabbi/internal/ui"
+	"github.com/mjshashank/dabbi/internal/vmspec"
+	"github.com/mjshashank/dabbi/internal/watchdog"
 )
 
 // SetupRouter configures and returns the HTTP router
 func SetupRouter(
 	cfg *config.Config,
 	mp multipass.Client,
+	ls *labels.Store,
+	specs *vmspec.Store,
+	ms *mounts.Store,
+	stops *watchdog.StopLog,
+	al *audit.Log,
 	tm *tunnel.Manager,
 	pr *proxy.Router,
 	am *agent.Manager,
+	wd *watchdog.Watchdog,
 ) http.Handler {
-	return SetupRouterWithTLS(cfg, mp, tm, pr, am, false, "")
+	return SetupRouterWithTLS(cfg, mp, ls, specs, ms, stops, al, tm, pr, am, wd, false, "")
 }
 
-// SetupRouterWithTLS configures and returns the HTTP router with TLS awareness
+// SetupRouterWithTLS configures and returns the HTTP router with TLS
+// awareness: VM traffic, the API, and the UI on one listener
 func SetupRouterWithTLS(
 	cfg *config.Config,
 	mp multipass.Client,
+	ls *labels.Store,
+	specs *vmspec.Store,
+	ms *mounts.Store,
+	stops *watchdog.StopLog,
+	al *audit.Log,
 	tm *tunnel.Manager,
 	pr *proxy.Router,
 	am *agent.Manager,
+	wd *watchdog.Watchdog,
 	useTLS bool,
 	domain string,
 ) http.Handler {
+	return setupRouter(cfg, mp, ls, specs, ms, stops, al, tm, pr, am, wd, useTLS, domain, true)
+}
+
+// SetupAPIRouter returns the API and UI without the VM proxy, for serving
+// them on their own port (see SetupProxyRouter)
+func SetupAPIRouter(
+	cfg *config.Config,
+	mp multipass.Client,
+	ls *labels.Store,
+	specs *vmspec.Store,
+	ms *mounts.Store,
+	stops *watchdog.StopLog,
+	al *audit.Log,
+	tm *tunnel.Manager,
+	pr *proxy.Router,
+	am *agent.Manager,
+	wd *watchdog.Watchdog,
+	useTLS bool,
+	domain string,
+) http.Handler {
+	return setupRouter(cfg, mp, ls, specs, ms, stops, al, tm, pr, am, wd, useTLS, domain, false)
+}
+
+// SetupProxyRouter returns just the VM proxy, for a listener separate from
+// the API's. Requests for anything but <vm>-<port> hosts get a 404, so the
+// API and UI can't be reached through it.
+func SetupProxyRouter(cfg *config.Config, ls *labels.Store, pr *proxy.Router, useTLS bool) http.Handler {
 	r := chi.NewRouter()
+	configureProxy(cfg, ls, pr, useTLS)
+
+	r.Use(httpkit.RequestID)
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+	r.Use(middleware.RealIP)
+	r.Use(pr.Middleware)
 
-	// Configure proxy router with auth token for protected ports
+	r.Get("/health", health)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not a VM address, expected <vm>-<port>.<domain>", http.StatusNotFound)
+	})
+
+	return r
+}
+
+// configureProxy applies the config to the proxy router
+func configureProxy(cfg *config.Config, ls *labels.Store, pr *proxy.Router, useTLS bool) {
+	// Auth token for protected ports
 	pr.SetAuthToken(cfg.AuthToken)
+	pr.SetSecureCookie(useTLS)
+	pr.SetCookieDomain(cfg.CookieDomain)
+	pr.SetLabels(ls)
+	pr.SetHeaderPolicy(cfg.ProxyStripHeaders, cfg.ProxySetHeaders)
+	pr.SetLoadingPage(cfg.LoadingPage)
+}
 
-	// Global middleware
+// health answers load balancer and uptime checks (no auth required)
+func health(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// setupRouter builds the API and UI routes, behind the VM proxy when
+// proxied is set
+func setupRouter(
+	cfg *config.Config,
+	mp multipass.Client,
+	ls *labels.Store,
+	specs *vmspec.Store,
+	ms *mounts.Store,
+	stops *watchdog.StopLog,
+	al *audit.Log,
+	tm *tunnel.Manager,
+	pr *proxy.Router,
+	am *agent.Manager,
+	wd *watchdog.Watchdog,
+	useTLS bool,
+	domain string,
+	proxied bool,
+) http.Handler {
+	r := chi.NewRouter()
+
+	// The wake handler uses the proxy router even when it isn't serving here
+	configureProxy(cfg, ls, pr, useTLS)
+
+	// Global middleware. RequestID comes first so the access log line
+	// carries the ID.
+	r.Use(httpkit.RequestID)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.RealIP)
 
 	// Proxy router handles VM traffic based on Host header
 	// This MUST be first to intercept VM requests before API routes
-	r.Use(pr.Middleware)
+	if proxied {
+		r.Use(pr.Middleware)
+	}
+
+	// CORS for frontends on allowed_origins; preflights are answered before auth
+	cors := authMw.CORS(cfg.AllowedOrigins, cfg.CORSAllowedHeaders)
+
+	// Auth endpoints (not protected). Handle (rather than Post) lets CORS see
+	// preflights; the handlers reject other methods themselves.
+	r.With(cors).Handle("/api/auth/login", authMw.LoginHandler(cfg.AuthToken, useTLS, cfg.CookieDomain))
+	r.With(cors).Handle("/api/auth/logout", authMw.LogoutHandler(cfg.CookieDomain))
 
-	// Auth endpoints (not protected)
-	r.Post("/api/auth/login", authMw.LoginHandler(cfg.AuthToken, useTLS))
-	r.Post("/api/auth/logout", authMw.LogoutHandler())
+	// Several API reads in one round trip. Each sub-request goes back through
+	// this router, so auth, read-only key checks, and handlers apply as if it
+	// had been sent on its own. It's registered outside the API group because
+	// it only runs reads, so it isn't audited; Handle lets CORS see preflights.
+	batchHandler := handlers.NewBatchHandler(r)
+	r.With(cors, authMw.BearerAuth(cfg.AuthToken, cfg.APIKeys)).HandleFunc("/api/batch", batchHandler.Run)
 
 	// API routes (protected by auth)
 	r.Route("/api", func(r chi.Router) {
-		r.Use(authMw.BearerAuth(cfg.AuthToken))
+		r.Use(cors)
+		r.Use(authMw.BearerAuth(cfg.AuthToken, cfg.APIKeys))
+		r.Use(authMw.Audit(al))
+		r.Use(authMw.Timeout(cfg.RequestTimeout()))
+
+		// Routes that change state or run commands in a VM; read-only API
+		// keys get 403
+		write := r.With(authMw.RequireWrite)
+
+		// Routes that can outlast the server's read/write timeouts and the
+		// request timeout: launches and boots that wait on multipass, file
+		// transfers, streams
+		slow := r.With(authMw.NoDeadline)
+		slowWrite := write.With(authMw.NoDeadline)
+
+		// Audit log of mutating requests and CLI commands
+		auditHandler := handlers.NewAuditHandler(al)
+		r.Get("/audit", auditHandler.List)
 
 		// VMs
-		vmHandler := handlers.NewVMHandler(mp, cfg)
+		vmHandler := handlers.NewVMHandler(mp, cfg, ls, specs, ms, stops, tm, am)
 		r.Get("/defaults", vmHandler.Defaults)
+		write.Put("/defaults", vmHandler.SetDefaults)
 		r.Get("/vms", vmHandler.List)
-		r.Post("/vms", vmHandler.Create)
+		slowWrite.Post("/vms", vmHandler.Create)
+		write.Post("/vms/cloud-init/preview", vmHandler.PreviewCloudInit)
+		slowWrite.Post("/vms/import", vmHandler.Import)
+		r.Get("/jobs/{id}", vmHandler.GetJob)
 		r.Get("/vms/{name}", vmHandler.Get)
-		r.Delete("/vms/{name}", vmHandler.Delete)
-		r.Post("/vms/{name}/state", vmHandler.ChangeState)
-		r.Post("/vms/{name}/clone", vmHandler.Clone)
+		write.Delete("/vms/{name}", vmHandler.Delete)
+		slowWrite.Post("/vms/{name}/state", vmHandler.ChangeState)
+		slowWrite.Post("/vms/{name}/clone", vmHandler.Clone)
+		r.Get("/vms/{name}/ready", vmHandler.Ready)
+		r.Get("/vms/{name}/labels", vmHandler.GetLabels)
+		write.Put("/vms/{name}/labels", vmHandler.SetLabels)
+		write.Post("/vms/{name}/pin", vmHandler.Pin)
+		write.Delete("/vms/{name}/pin", vmHandler.Unpin)
+		write.Delete("/vms/{name}/ssh-agent", vmHandler.RevokeSSHAgent)
+		r.Get("/vms/{name}/export", vmHandler.Export)
+		write.Get("/vms/{name}/spec", vmHandler.GetSpec) // the cloud-init holds the auth token
+
+		// Waking VMs on proxied requests
+		wakeHandler := handlers.NewWakeHandler(pr)
+		write.Post("/vms/{name}/wake/cancel", wakeHandler.Cancel)
+
+		// Rebuild a VM from its recorded spec
+		recreateHandler := handlers.NewRecreateHandler(vmHandler, tm, am)
+		slowWrite.Post("/vms/{name}/recreate", recreateHandler.Recreate)
+
+		// Start or stop many VMs at once
+		bulkHandler := handlers.NewBulkHandler(mp, ls, tm, am)
+		slowWrite.Post("/vms/bulk", bulkHandler.Run)
+
+		// Bulk cleanup of stopped/idle VMs
+		pruneHandler := handlers.NewPruneHandler(mp, stops, ls, specs, ms, tm, am)
+		slowWrite.Post("/vms/prune", pruneHandler.Prune)
+
+		// Host networks (for bridged VM NICs)
+		hostHandler := handlers.NewHostHandler(mp)
+		r.Get("/host/networks", hostHandler.ListNetworks)
 
 		// Snapshots
 		snapHandler := handlers.NewSnapshotHandler(mp)
+		r.Get("/snapshots", snapHandler.ListAll)
 		r.Get("/vms/{name}/snapshots", snapHandler.List)
-		r.Post("/vms/{name}/snapshots", snapHandler.Create)
-		r.Post("/vms/{name}/snapshots/restore", snapHandler.Restore)
-		r.Delete("/vms/{name}/snapshots/{snap}", snapHandler.Delete)
+		r.Get("/vms/{name}/snapshots/tree", snapHandler.Tree)
+		slowWrite.Post("/vms/{name}/snapshots", snapHandler.Create)
+		slowWrite.Post("/vms/{name}/snapshots/restore", snapHandler.Restore)
+		write.Delete("/vms/{name}/snapshots/{snap}", snapHandler.Delete)
 
 		// Files
-		fileHandler := handlers.NewFileHandler(mp)
-		r.Get("/vms/{name}/files", fileHandler.Browse)
-		r.Post("/vms/{name}/files", fileHandler.Upload)
-		r.Get("/vms/{name}/files/download", fileHandler.Download)
+		fileHandler := handlers.NewFileHandler(mp, cfg)
+		// Reads too need a write key: files in the VM hold the auth token
+		// (the agent's unit and shell defaults)
+		write.Get("/vms/{name}/files", fileHandler.Browse)
+		slowWrite.Post("/vms/{name}/files", fileHandler.Upload)
+		slowWrite.Get("/vms/{name}/files/download", fileHandler.Download)
+
+		// Live resource samples (WebSocket)
+		metricsHandler := handlers.NewMetricsHandler(mp, cfg)
+		slow.Get("/vms/{name}/metrics/stream", metricsHandler.Stream)
+
+		// Console (boot) log; streams with ?follow=true
+		consoleHandler := handlers.NewConsoleHandler(mp, cfg.ConsoleLogPath)
+		slow.Get("/vms/{name}/console", consoleHandler.Get)
 
 		// Mounts
-		mountHandler := handlers.NewMountHandler(mp)
+		mountHandler := handlers.NewMountHandler(mp, ms)
+		r.Get("/mounts", mountHandler.ListAll)
 		r.Get("/vms/{name}/mounts", mountHandler.List)
-		r.Post("/vms/{name}/mounts", mountHandler.Add)
-		r.Delete("/vms/{name}/mounts", mountHandler.Remove)
+		write.Post("/vms/{name}/mounts", mountHandler.Add)
+		write.Delete("/vms/{name}/mounts", mountHandler.Remove)
+		write.Post("/vms/{name}/mounts/restore", mountHandler.Restore)
 
 		// Tunnels
 		tunnelHandler := handlers.NewTunnelHandler(tm)
 		r.Get("/tunnels", tunnelHandler.List)
-		r.Post("/tunnels", tunnelHandler.Create)
-		r.Delete("/tunnels/{port}", tunnelHandler.Delete)
+		write.Post("/tunnels", tunnelHandler.Create)
+		write.Delete("/tunnels/{port}", tunnelHandler.Delete)
 
 		// Network configuration
 		networkHandler := handlers.NewNetworkHandler(mp, cfg)
 		r.Get("/vms/{name}/network", networkHandler.Get)
-		r.Put("/vms/{name}/network", networkHandler.Update)
-		r.Delete("/vms/{name}/network", networkHandler.Remove)
-		r.Post("/vms/{name}/network/apply", networkHandler.Apply)
+		write.Put("/vms/{name}/network", networkHandler.Update)
+		write.Delete("/vms/{name}/network", networkHandler.Remove)
+		write.Post("/vms/{name}/network/apply", networkHandler.Apply)
+		write.Post("/vms/{name}/network/pause", networkHandler.Pause)
+		write.Post("/vms/{name}/network/resume", networkHandler.Resume)
+		slowWrite.Post("/vms/{name}/network/test", networkHandler.Test)
+		r.Get("/vms/{name}/network/verify", networkHandler.Verify)
+		slowWrite.Post("/network/apply-bulk", networkHandler.ApplyBulk)
 		r.Get("/network/defaults", networkHandler.GetDefaults)
-		r.Put("/network/defaults", networkHandler.SetDefaults)
+		write.Put("/network/defaults", networkHandler.SetDefaults)
+
+		// Watchdog (idle shutdown)
+		watchdogHandler := handlers.NewWatchdogHandler(wd, cfg)
+		r.Get("/watchdog/timeout", watchdogHandler.GetTimeout)
+		write.Put("/watchdog/timeout", watchdogHandler.SetTimeout)
+		write.Post("/watchdog/check", watchdogHandler.Check)
 
 		// Shell (WebSocket)
-		shellHandler := handlers.NewShellHandler(mp)
-		r.Get("/vms/{name}/shell", shellHandler.Handle)
+		shellHandler := handlers.NewShellHandler(mp, cfg)
+		slowWrite.Get("/vms/{name}/shell", shellHandler.Handle)          // sets its own deadlines once upgraded
+		write.Get("/vms/{name}/recordings", shellHandler.ListRecordings) // recordings are shell output
+		slowWrite.Get("/vms/{name}/recordings/{file}", shellHandler.GetRecording)
 
 		// Agent (opencode) - returns URL to access agent via subdomain proxy
 		agentHandler := handlers.NewAgentHandler(am, domain, cfg.AuthToken, useTLS)
-		r.Get("/vms/{name}/agent-url", agentHandler.GetURL)
+		write.Get("/vms/{name}/agent-url", agentHandler.GetURL)
+		r.Get("/vms/{name}/agent-status", agentHandler.Status)
+		r.Get("/agents", agentHandler.List)
 	})
 
 	// Health check (no auth required)
-	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	r.Get("/health", health)
 
 	// Embedded UI (fallback for all other routes)
 	r.Handle("/*", ui.Handler())
@@ -0,0 +1,112 @@
+package daemon
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/agent"
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/proxy"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/mjshashank/dabbi/internal/tunnel"
+	"github.com/mjshashank/dabbi/internal/watchdog"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveHost(h http.Handler, host, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Host = host
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSetupProxyRouter(t *testing.T) {
+	cfg := config.DefaultConfig()
+	h := SetupProxyRouter(cfg, nil, proxy.NewRouter(new(testutil.MockMultipassClient)), false)
+
+	assert.Equal(t, http.StatusOK, serveHost(h, "example.com", "/health").Code)
+
+	// Neither the API nor the UI is served on the proxy's port
+	for _, path := range []string{"/api/vms", "/api/auth/login", "/"} {
+		rec := serveHost(h, "example.com", path)
+		assert.Equal(t, http.StatusNotFound, rec.Code, path)
+		assert.Contains(t, rec.Body.String(), "not a VM address", path)
+	}
+}
+
+func TestSetupAPIRouter_DoesNotProxy(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	cfg := config.DefaultConfig()
+	h := SetupAPIRouter(cfg, mockMP, nil, nil, nil, nil, nil, tunnel.NewManager(mockMP), proxy.NewRouter(mockMP),
+		agent.NewManager(mockMP), watchdog.New(mockMP, 0), false, "")
+
+	// A VM host on the API's port gets the API, not the VM
+	assert.Equal(t, http.StatusOK, serveHost(h, "myvm-8080.localhost", "/health").Code)
+	assert.Equal(t, http.StatusUnauthorized, serveHost(h, "myvm-8080.localhost", "/api/vms").Code)
+	mockMP.AssertNotCalled(t, "Info", "myvm")
+}
+
+func TestSetupRouter_ReadOnlyKeyCantReadVMFiles(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	cfg := config.DefaultConfig()
+	cfg.APIKeys = []config.APIKey{{Name: "dashboard", Token: "ro-token", ReadOnly: true}}
+	h := SetupAPIRouter(cfg, mockMP, nil, nil, nil, nil, nil, tunnel.NewManager(mockMP), proxy.NewRouter(mockMP),
+		agent.NewManager(mockMP), watchdog.New(mockMP, 0), false, "")
+
+	// These can reveal the auth token, which would turn the key into an admin one
+	for _, path := range []string{
+		"/api/vms/myvm/files?path=/etc/systemd/system",
+		"/api/vms/myvm/files/download?path=/etc/systemd/system/dabbi-opencode.service",
+		"/api/vms/myvm/recordings",
+		"/api/vms/myvm/recordings/session.cast",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer ro-token")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code, path)
+	}
+	mockMP.AssertNotCalled(t, "Info", "myvm")
+}
+
+// hungExecutor is a multipass that never answers, until the command is killed
+type hungExecutor struct{}
+
+func (hungExecutor) Execute(name string, args ...string) ([]byte, error) {
+	select {}
+}
+
+func (hungExecutor) ExecuteContext(ctx context.Context, name string, args ...string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSetupRouter_RequestTimeoutKillsMultipass(t *testing.T) {
+	mp := multipass.NewClient(hungExecutor{})
+	cfg := config.DefaultConfig()
+	cfg.RequestTimeoutSecs = 1
+	h := SetupAPIRouter(cfg, mp, nil, nil, nil, nil, nil, tunnel.NewManager(mp), proxy.NewRouter(mp),
+		agent.NewManager(mp), watchdog.New(mp, 0), false, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/vms/myvm", nil)
+	req.Header.Set("Authorization", "Bearer "+cfg.AuthToken)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still waiting on multipass after its timeout")
+	}
+	assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	assert.Contains(t, rec.Body.String(), "TIMEOUT")
+}
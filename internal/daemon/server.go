@@ -3,16 +3,29 @@ package daemon
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mjshashank/dabbi/internal/agent"
+	"github.com/mjshashank/dabbi/internal/audit"
 	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/daemon/handlers"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/mounts"
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/proxy"
+	"github.com/mjshashank/dabbi/internal/sshagent"
 	"github.com/mjshashank/dabbi/internal/tunnel"
+	"github.com/mjshashank/dabbi/internal/vmspec"
 	"github.com/mjshashank/dabbi/internal/watchdog"
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -20,109 +33,274 @@ import (
 // ServerConfig holds server configuration
 type ServerConfig struct {
 	Port            int
+	APIPort         int // serve the API and UI on this port, and only VM traffic on Port (0 = all on Port)
 	Domain          string
+	BindAddress     string // empty listens on all interfaces
+	TLSCertFile     string // user-provided certificate; when set, autocert is skipped
+	TLSKeyFile      string
 	Config          *config.Config
 	MultipassClient multipass.Client
+	Labels          *labels.Store
+	Specs           *vmspec.Store
+	Mounts          *mounts.Store
+	StopLog         *watchdog.StopLog
+	AuditLog        *audit.Log
 }
 
 // Server represents the dabbi daemon
 type Server struct {
-	cfg      ServerConfig
-	router   http.Handler
-	watchdog *watchdog.Watchdog
-	tunnels  *tunnel.Manager
-	proxy    *proxy.Router
-	agents   *agent.Manager
+	cfg       ServerConfig
+	router    http.Handler
+	apiRouter http.Handler // the API and UI on APIPort; nil when router serves them too
+	watchdog  *watchdog.Watchdog
+	tunnels   *tunnel.Manager
+	proxy     *proxy.Router
+	agents    *agent.Manager
+	sshAgent  *sshagent.Forwarder // nil when the daemon has no SSH agent
 }
 
 // NewServer creates a new daemon server
 func NewServer(cfg ServerConfig) *Server {
 	timeout := time.Duration(cfg.Config.ShutdownTimeoutMins) * time.Minute
 	wd := watchdog.New(cfg.MultipassClient, timeout)
+	if err := wd.SetAction(cfg.Config.WatchdogAction); err != nil {
+		log.Printf("Warning: %v, falling back to %q", err, watchdog.ActionStop)
+	}
+	if err := wd.SetThresholds(cfg.Config.WatchdogLoadThreshold, cfg.Config.WatchdogNoiseBytesPerMin); err != nil {
+		log.Printf("Warning: %v, using the defaults (load %v, %d bytes)",
+			err, watchdog.DefaultLoadThreshold, watchdog.DefaultNoiseBytesPerMin)
+	}
+	wd.SetLabels(cfg.Labels)
 	tm := tunnel.NewManager(cfg.MultipassClient)
+	if err := tm.SetStablePortRange(cfg.Config.TunnelPortBase, cfg.Config.TunnelPortRange); err != nil {
+		log.Printf("Warning: %v, using the default ports %d-%d",
+			err, tunnel.DefaultStableBasePort, tunnel.DefaultStableBasePort+tunnel.DefaultStablePortRange-1)
+	}
 	pr := proxy.NewRouter(cfg.MultipassClient)
 	am := agent.NewManager(cfg.MultipassClient)
+	am.SetAuthToken(cfg.Config.AuthToken)
+	am.SetAutoHeal(cfg.Config.AgentAutoHeal)
+	if err := am.SetPortRange(cfg.Config.AgentPortBase, cfg.Config.AgentPortRange); err != nil {
+		log.Printf("Warning: %v, using the default ports %d-%d",
+			err, agent.DefaultBasePort, agent.DefaultBasePort+agent.DefaultPortRange-1)
+	}
+	// VMs the watchdog shuts down lose their listeners, as with a stop
+	// through the API
+	wd.SetOnShutdown(func(vmName string) {
+		handlers.CloseListeners(tm, am, vmName)
+	})
+	if subnet, err := cfg.Config.PreferredSubnet(); err != nil {
+		log.Printf("Warning: %v, ignoring", err)
+	} else {
+		tm.SetPreferredSubnet(subnet)
+		pr.SetPreferredSubnet(subnet)
+		am.SetPreferredSubnet(subnet)
+	}
 
-	// Use TLS-aware router when domain is configured
-	useTLS := cfg.Domain != ""
-	router := SetupRouterWithTLS(cfg.Config, cfg.MultipassClient, tm, pr, am, useTLS, cfg.Domain)
+	// Use TLS-aware router when serving HTTPS (Let's Encrypt or user certs)
+	useTLS := cfg.Domain != "" || cfg.TLSCertFile != ""
+	var router, apiRouter http.Handler
+	if cfg.APIPort != 0 {
+		router = SetupProxyRouter(cfg.Config, cfg.Labels, pr, useTLS)
+		apiRouter = SetupAPIRouter(cfg.Config, cfg.MultipassClient, cfg.Labels, cfg.Specs, cfg.Mounts, cfg.StopLog, cfg.AuditLog, tm, pr, am, wd, useTLS, cfg.Domain)
+	} else {
+		router = SetupRouterWithTLS(cfg.Config, cfg.MultipassClient, cfg.Labels, cfg.Specs, cfg.Mounts, cfg.StopLog, cfg.AuditLog, tm, pr, am, wd, useTLS, cfg.Domain)
+	}
 
 	return &Server{
-		cfg:      cfg,
-		router:   router,
-		watchdog: wd,
-		tunnels:  tm,
-		proxy:    pr,
-		agents:   am,
+		cfg:       cfg,
+		router:    router,
+		apiRouter: apiRouter,
+		watchdog:  wd,
+		tunnels:   tm,
+		proxy:     pr,
+		agents:    am,
 	}
 }
 
-// ListenAndServe starts the HTTP server
+// ListenAndServe starts the HTTP server, and the API's own when APIPort is
+// set. It returns when either stops.
 func (s *Server) ListenAndServe() error {
-	addr := fmt.Sprintf(":%d", s.cfg.Port)
+	port := s.cfg.Port
+	var tlsConfig *tls.Config
+	switch {
+	case s.cfg.TLSCertFile != "":
+		cert, err := tls.LoadX509KeyPair(s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	case s.cfg.Domain != "":
+		tlsConfig = s.autocertConfig()
+		port = 443
+	}
 
-	if s.cfg.Domain != "" {
-		return s.listenTLS()
+	s.startSSHAgent()
+	go s.warnPortSuffixedNames()
+
+	if s.apiRouter == nil {
+		return s.serve(s.router, port, tlsConfig)
 	}
+	errCh := make(chan error, 2)
+	go func() { errCh <- s.serve(s.apiRouter, s.cfg.APIPort, tlsConfig) }()
+	go func() { errCh <- s.serve(s.router, port, tlsConfig) }()
+	return <-errCh
+}
 
-	srv := &http.Server{
+// serve runs handler on port, over TLS when tlsConfig is set
+func (s *Server) serve(handler http.Handler, port int, tlsConfig *tls.Config) error {
+	srv := s.newHTTPServer(s.listenAddr(port), handler, tlsConfig)
+	if tlsConfig == nil {
+		return listenError(port, srv.ListenAndServe())
+	}
+	return listenError(port, srv.ListenAndServeTLS("", ""))
+}
+
+// listenAddr joins the configured bind address with port
+func (s *Server) listenAddr(port int) string {
+	return net.JoinHostPort(s.cfg.BindAddress, strconv.Itoa(port))
+}
+
+// newHTTPServer returns a server for handler with the configured timeouts,
+// so plain HTTP and both TLS modes behave the same. Routes that run long
+// lift the read and write timeouts themselves (see mw.NoDeadline).
+func (s *Server) newHTTPServer(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
 		Addr:         addr,
-		Handler:      s.router,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		Handler:      handler,
+		ReadTimeout:  s.cfg.Config.ServerReadTimeout(),
+		WriteTimeout: s.cfg.Config.ServerWriteTimeout(),
+		IdleTimeout:  s.cfg.Config.ServerIdleTimeout(),
+		TLSConfig:    tlsConfig,
 	}
+}
 
-	return srv.ListenAndServe()
+// startSSHAgent relays the daemon's SSH agent to VMs created with
+// --forward-ssh-agent. It listens on the host's multipass bridge address,
+// where the VMs' relays connect, or on the bind address if there's none.
+// Without an agent, or if the port is taken, those VMs just don't get one;
+// the rest of the daemon works as usual.
+func (s *Server) startSSHAgent() {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		log.Printf("SSH_AUTH_SOCK is not set, VMs created with --forward-ssh-agent won't get an SSH agent")
+		return
+	}
+
+	vms, err := s.cfg.MultipassClient.List()
+	if err != nil {
+		log.Printf("Warning: failed to list VMs to find the multipass bridge: %v", err)
+	}
+	host := sshagent.BridgeAddress(vms)
+	if host == "" {
+		host = s.cfg.BindAddress
+	}
+
+	fwd := sshagent.NewForwarder(s.cfg.Specs, socket)
+	if err := fwd.Listen(net.JoinHostPort(host, strconv.Itoa(s.cfg.Config.SSHAgentListenPort()))); err != nil {
+		log.Printf("Warning: %v, SSH agent forwarding is disabled", err)
+		return
+	}
+	s.sshAgent = fwd
 }
 
-// listenTLS starts an HTTPS server with Let's Encrypt
-func (s *Server) listenTLS() error {
-	domain := s.cfg.Domain
-	certManager := autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		HostPolicy: func(ctx context.Context, host string) error {
-			// Allow the main domain
-			if host == domain {
-				return nil
-			}
-			// Allow subdomains: <vm>-<port>.<domain>
-			if strings.HasSuffix(host, "."+domain) {
-				prefix := strings.TrimSuffix(host, "."+domain)
-				// Validate subdomain format: must contain a hyphen (vm-port pattern)
-				if idx := strings.LastIndex(prefix, "-"); idx > 0 {
-					return nil
-				}
-			}
-			return fmt.Errorf("host %q not allowed", host)
-		},
-		Cache: autocert.DirCache(".dabbi-certs"),
+// warnPortSuffixedNames logs existing VMs whose names end in -<digits>,
+// which new VMs can't use because the proxy reads the suffix as a port
+func (s *Server) warnPortSuffixedNames() {
+	vms, err := s.cfg.MultipassClient.List()
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, vm := range vms {
+		if multipass.HasPortSuffix(vm.Name) {
+			names = append(names, vm.Name)
+		}
 	}
+	if len(names) > 0 {
+		log.Printf("Warning: VM name(s) %s end in -<number>, which the proxy reads as a port: "+
+			"reach them as <vm>-<port>.<domain> (e.g. %s-80.localhost) or clone them to a new name",
+			strings.Join(names, ", "), names[0])
+	}
+}
 
-	srv := &http.Server{
-		Addr:    ":443",
-		Handler: s.router,
-		TLSConfig: &tls.Config{
-			GetCertificate: certManager.GetCertificate,
-			MinVersion:     tls.VersionTLS12,
-		},
+// listenError turns a bind failure into a hint about what holds the port
+func listenError(port int, err error) error {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return fmt.Errorf("port %d is already in use - is dabbi (or another web server) already running? "+
+			"Stop it or choose another --port: %w", port, err)
+	}
+	return err
+}
+
+// autocertConfig returns a TLS config with Let's Encrypt certificates and
+// starts the HTTP server on port 80 that answers ACME challenges
+func (s *Server) autocertConfig() *tls.Config {
+	certManager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: hostPolicy(s.cfg.Domain, s.cfg.MultipassClient),
+		Cache:      autocert.DirCache(".dabbi-certs"),
 	}
 
 	// HTTP redirect server (also handles ACME challenges)
 	go func() {
 		httpSrv := &http.Server{
-			Addr:    ":80",
+			Addr:    s.listenAddr(80),
 			Handler: certManager.HTTPHandler(nil),
 		}
 		httpSrv.ListenAndServe()
 	}()
 
-	return srv.ListenAndServeTLS("", "")
+	return &tls.Config{
+		GetCertificate: certManager.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// subdomainPattern matches the <vm>-<port> label of a VM subdomain
+var subdomainPattern = regexp.MustCompile(`^([a-z0-9][a-z0-9-]*)-(\d{1,5})$`)
+
+// hostPolicy allows certificates for the base domain and for
+// <vm>-<port>.<domain> where the VM exists. Let's Encrypt can't issue
+// wildcards over HTTP-01, so each VM subdomain gets its own certificate;
+// checking the VM keeps random SNI names from burning the rate limit.
+func hostPolicy(domain string, mp multipass.Client) autocert.HostPolicy {
+	domain = strings.ToLower(domain)
+	return func(ctx context.Context, host string) error {
+		host = strings.ToLower(host)
+		if host == domain {
+			return nil
+		}
+
+		prefix, ok := strings.CutSuffix(host, "."+domain)
+		if !ok {
+			return fmt.Errorf("host %q not allowed", host)
+		}
+		m := subdomainPattern.FindStringSubmatch(prefix)
+		if m == nil {
+			return fmt.Errorf("host %q not allowed: expected <vm>-<port>.%s", host, domain)
+		}
+		if port, _ := strconv.Atoi(m[2]); port < 1 || port > 65535 {
+			return fmt.Errorf("host %q not allowed: invalid port", host)
+		}
+
+		info, err := mp.Info(m[1])
+		if err != nil || info.State == multipass.StateDeleted {
+			return fmt.Errorf("host %q not allowed: no VM named %q", host, m[1])
+		}
+		return nil
+	}
 }
 
 // Shutdown gracefully shuts down the server
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.watchdog.Stop()
 	s.agents.StopAll()
+	if s.sshAgent != nil {
+		s.sshAgent.Close()
+	}
 	return nil
 }
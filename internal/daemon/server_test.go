@@ -0,0 +1,73 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenAndServe_BadCertificate(t *testing.T) {
+	dir := t.TempDir()
+	s := &Server{cfg: ServerConfig{
+		Port:        0,
+		Domain:      "dabbi.local",
+		TLSCertFile: filepath.Join(dir, "missing.crt"),
+		TLSKeyFile:  filepath.Join(dir, "missing.key"),
+	}}
+
+	// User certs take precedence over autocert, and are loaded before binding
+	err := s.ListenAndServe()
+	assert.ErrorContains(t, err, "failed to load TLS certificate")
+}
+
+func TestListenError(t *testing.T) {
+	inUse := fmt.Errorf("listen tcp :80: bind: %w", syscall.EADDRINUSE)
+	assert.ErrorContains(t, listenError(80, inUse), "is dabbi (or another web server) already running")
+	assert.ErrorIs(t, listenError(80, inUse), syscall.EADDRINUSE)
+
+	other := fmt.Errorf("listen tcp :80: bind: %w", syscall.EACCES)
+	assert.Equal(t, other, listenError(80, other))
+}
+
+func TestHostPolicy(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "myvm").Return(testutil.RunningVM("myvm", "10.0.0.2"), nil)
+	mockMP.On("Info", "my-vm").Return(testutil.RunningVM("my-vm", "10.0.0.3"), nil)
+	mockMP.On("Info", "ghost").Return(nil, errors.New("instance \"ghost\" does not exist"))
+
+	policy := hostPolicy("Example.com", mockMP)
+
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"example.com", true},
+		{"myvm-8080.example.com", true},
+		{"MYVM-8080.EXAMPLE.COM", true},
+		{"my-vm-1234.example.com", true},
+		{"ghost-8080.example.com", false}, // no such VM
+		{"myvm.example.com", false},       // no port
+		{"myvm-abc.example.com", false},   // non-numeric port
+		{"myvm-70000.example.com", false}, // port out of range
+		{"a.myvm-8080.example.com", false},
+		{"myvm-8080.example.org", false},
+		{"evilexample.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			err := policy(context.Background(), tt.host)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package hosts
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// BeginMarker and EndMarker delimit the block of the hosts file dabbi
+	// manages. Everything outside it is left alone.
+	BeginMarker = "# BEGIN dabbi (managed by 'dabbi hosts sync', edits are overwritten)"
+	EndMarker   = "# END dabbi"
+
+	// LoopbackIP is what proxy hostnames resolve to
+	LoopbackIP = "127.0.0.1"
+
+	// probeHost is looked up to check whether arbitrary .localhost names resolve
+	probeHost = "dabbi-resolve-check-1.localhost"
+)
+
+// DefaultPorts are the VM ports synced when hosts_ports isn't set: the
+// opencode agent and common dev servers
+var DefaultPorts = []int{1234, 3000, 5173, 8000, 8080}
+
+// DefaultPath returns the platform's hosts file
+func DefaultPath() string {
+	if runtime.GOOS == "windows" {
+		return `C:\Windows\System32\drivers\etc\hosts`
+	}
+	return "/etc/hosts"
+}
+
+// Hostnames returns the proxy hostname, <vm>-<port>.localhost, for each VM
+// and port, sorted
+func Hostnames(vms []string, ports []int) []string {
+	names := make([]string, 0, len(vms)*len(ports))
+	for _, vm := range vms {
+		for _, port := range ports {
+			names = append(names, fmt.Sprintf("%s-%d.localhost", vm, port))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Block returns the managed block mapping hostnames to the loopback
+// address, one per line (some platforms cap names per line), or "" for no
+// hostnames
+func Block(hostnames []string) string {
+	if len(hostnames) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(BeginMarker + "\n")
+	for _, name := range hostnames {
+		fmt.Fprintf(&b, "%s\t%s\n", LoopbackIP, name)
+	}
+	b.WriteString(EndMarker + "\n")
+	return b.String()
+}
+
+// Update returns content with its managed block replaced by block (an
+// empty block removes it), and whether anything changed. A file without a
+// block gets it appended. A begin marker without an end marker is an error,
+// rather than a guess at where the block stops.
+func Update(content, block string) (string, bool, error) {
+	before, rest, found := cutLine(content, BeginMarker)
+	after := ""
+	if found {
+		var ok bool
+		_, after, ok = cutLine(rest, EndMarker)
+		if !ok {
+			return "", false, fmt.Errorf("hosts file has %q without %q; fix it by hand", BeginMarker, EndMarker)
+		}
+	}
+
+	var out string
+	switch {
+	case !found && block == "":
+		return content, false, nil
+	case !found:
+		out = content
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		out += block
+	default:
+		out = before + block + after
+	}
+	return out, out != content, nil
+}
+
+// cutLine splits content around the first line equal to marker, ignoring
+// surrounding whitespace. before ends with a newline (or is empty) and
+// after starts at the following line.
+func cutLine(content, marker string) (before, after string, found bool) {
+	start := 0
+	for start < len(content) {
+		end := strings.IndexByte(content[start:], '\n')
+		next := len(content)
+		if end >= 0 {
+			next = start + end + 1
+		}
+		if strings.TrimSpace(content[start:next]) == marker {
+			return content[:start], content[next:], true
+		}
+		start = next
+	}
+	return content, "", false
+}
+
+// Managed returns the hostnames in content's managed block
+func Managed(content string) []string {
+	_, rest, found := cutLine(content, BeginMarker)
+	if !found {
+		return nil
+	}
+	block, _, _ := cutLine(rest, EndMarker)
+	var names []string
+	for _, line := range strings.Split(block, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && !strings.HasPrefix(fields[0], "#") {
+			names = append(names, fields[1:]...)
+		}
+	}
+	return names
+}
+
+// ResolvesLocalhost reports whether the system resolves arbitrary
+// .localhost subdomains to loopback, in which case no hosts entries are
+// needed
+func ResolvesLocalhost() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, probeHost)
+	if err != nil || len(addrs) == 0 {
+		return false
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip == nil || !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+// DnsmasqConfig returns a dnsmasq snippet resolving every .localhost name
+// to loopback, an alternative to per-VM hosts entries that also covers
+// ports and VMs added later
+func DnsmasqConfig() string {
+	return "# Resolve *.localhost (dabbi's VM proxy hostnames) to this machine\n" +
+		"address=/localhost/" + LoopbackIP + "\n" +
+		"address=/localhost/::1\n"
+}
@@ -0,0 +1,74 @@
+package hosts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const systemHosts = "127.0.0.1\tlocalhost\n::1\tlocalhost\n"
+
+func TestHostnames(t *testing.T) {
+	assert.Equal(t, []string{
+		"api-3000.localhost", "api-8080.localhost",
+		"dev-3000.localhost", "dev-8080.localhost",
+	}, Hostnames([]string{"dev", "api"}, []int{8080, 3000}))
+	assert.Empty(t, Hostnames(nil, DefaultPorts))
+}
+
+func TestBlock(t *testing.T) {
+	assert.Empty(t, Block(nil))
+	assert.Equal(t,
+		BeginMarker+"\n127.0.0.1\tdev-3000.localhost\n127.0.0.1\tdev-8080.localhost\n"+EndMarker+"\n",
+		Block([]string{"dev-3000.localhost", "dev-8080.localhost"}))
+}
+
+func TestUpdate(t *testing.T) {
+	block := Block([]string{"dev-3000.localhost"})
+
+	// Appended to a file without a block
+	out, changed, err := Update(systemHosts, block)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, systemHosts+block, out)
+
+	// Idempotent
+	again, changed, err := Update(out, block)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, out, again)
+
+	// Replaced in place, keeping lines after the block
+	withTail := out + "10.0.0.5\tnas\n"
+	newBlock := Block([]string{"api-3000.localhost", "dev-3000.localhost"})
+	out, changed, err = Update(withTail, newBlock)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, systemHosts+newBlock+"10.0.0.5\tnas\n", out)
+	assert.Equal(t, []string{"api-3000.localhost", "dev-3000.localhost"}, Managed(out))
+
+	// Removed
+	out, changed, err = Update(out, "")
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, systemHosts+"10.0.0.5\tnas\n", out)
+	assert.Empty(t, Managed(out))
+
+	// Nothing to remove
+	_, changed, err = Update(systemHosts, "")
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
+
+func TestUpdate_NoTrailingNewline(t *testing.T) {
+	block := Block([]string{"dev-3000.localhost"})
+	out, _, err := Update("127.0.0.1 localhost", block)
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n"+block, out)
+}
+
+func TestUpdate_UnterminatedBlock(t *testing.T) {
+	_, _, err := Update(systemHosts+BeginMarker+"\n127.0.0.1\tdev-3000.localhost\n", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,17 @@
+package httpkit
+
+import "net/http"
+
+// AuthCookieName is the name of the authentication cookie
+const AuthCookieName = "dabbi_auth"
+
+// CookieSameSite returns the SameSite mode for auth cookies, the daemon's
+// and the agent proxy's alike. Cookies scoped to a parent domain are sent to
+// <vm>-<port> subdomains, which Strict would block on cross-site
+// navigations, so they use Lax instead.
+func CookieSameSite(cookieDomain string) http.SameSite {
+	if cookieDomain != "" {
+		return http.SameSiteLaxMode
+	}
+	return http.SameSiteStrictMode
+}
@@ -0,0 +1,13 @@
+package httpkit
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookieSameSite(t *testing.T) {
+	assert.Equal(t, http.SameSiteStrictMode, CookieSameSite(""))
+	assert.Equal(t, http.SameSiteLaxMode, CookieSameSite(".example.com"))
+}
@@ -0,0 +1,58 @@
+// Package httpkit holds the HTTP helpers shared by the daemon's API, the
+// proxy, and the agent listeners, so none of them imports another's
+// middleware
+package httpkit
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// RequestIDHeader carries a request's correlation ID: in from clients that
+// already have one, back out on every response, and on to VMs by the proxy
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen caps client-supplied IDs, which end up in logs
+const maxRequestIDLen = 128
+
+// RequestID gives each request an ID, reusing the client's X-Request-ID when
+// it sent a usable one, so a failure can be matched to the daemon's log
+// line and to the VM's own logs. chi's middleware.Logger prints it, and it
+// is echoed in the response header and in API error bodies.
+func RequestID(next http.Handler) http.Handler {
+	withID := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			w.Header().Set(RequestIDHeader, id)
+		}
+		next.ServeHTTP(w, r)
+	})
+	assign := middleware.RequestID(withID)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validRequestID(r.Header.Get(RequestIDHeader)) {
+			r.Header.Del(RequestIDHeader)
+		}
+		assign.ServeHTTP(w, r)
+	})
+}
+
+// GetRequestID returns the ID RequestID assigned to a request, or "" if it
+// didn't pass through RequestID
+func GetRequestID(r *http.Request) string {
+	return middleware.GetReqID(r.Context())
+}
+
+// validRequestID accepts short IDs of printable ASCII without spaces, so a
+// client can't forge log fields with them
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
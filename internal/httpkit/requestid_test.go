@@ -0,0 +1,48 @@
+package httpkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		keep     bool
+	}{
+		{"generated", "", false},
+		{"client_id", "build-42/step-3", true},
+		{"with_space", "a b", false},
+		{"with_newline", "a\nlevel=error", false},
+		{"too_long", strings.Repeat("x", maxRequestIDLen+1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = GetRequestID(r)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.clientID != "" {
+				req.Header.Set(RequestIDHeader, tt.clientID)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.NotEmpty(t, seen)
+			assert.Equal(t, seen, rec.Header().Get(RequestIDHeader))
+			if tt.keep {
+				assert.Equal(t, tt.clientID, seen)
+			} else {
+				assert.NotEqual(t, tt.clientID, seen)
+			}
+		})
+	}
+}
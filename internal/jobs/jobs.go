@@ -0,0 +1,99 @@
+package jobs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job statuses, in the order a launch moves through them
+const (
+	StatusLaunching  = "launching"  // multipass is creating and booting the VM
+	StatusInstalling = "installing" // VM is up, cloud-init is still running
+	StatusReady      = "ready"
+	StatusFailed     = "failed"
+)
+
+// retention is how long finished jobs stay queryable
+const retention = time.Hour
+
+// Job tracks one long-running VM operation started by the daemon
+type Job struct {
+	ID        string    `json:"id"`
+	VM        string    `json:"vm"`
+	Status    string    `json:"status"`
+	LastLog   string    `json:"last_log,omitempty"` // latest cloud-init output line
+	Error     string    `json:"error,omitempty"`
+	Hint      string    `json:"hint,omitempty"` // what to do about Error, when known
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Done reports whether the job has finished, successfully or not
+func (j Job) Done() bool {
+	return j.Status == StatusReady || j.Status == StatusFailed
+}
+
+// Registry is an in-memory store of jobs. Jobs don't survive a daemon
+// restart, and finished ones are dropped after an hour.
+type Registry struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// NewRegistry creates an empty job registry
+func NewRegistry() *Registry {
+	return &Registry{jobs: make(map[string]*Job)}
+}
+
+// Create registers a new job for a VM in the launching state
+func (r *Registry) Create(vmName string) Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	r.expire(now)
+
+	job := &Job{
+		ID:        uuid.New().String(),
+		VM:        vmName,
+		Status:    StatusLaunching,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	r.jobs[job.ID] = job
+	return *job
+}
+
+// Get returns a copy of a job
+func (r *Registry) Get(id string) (Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Update applies fn to a job under the registry lock
+func (r *Registry) Update(id string, fn func(j *Job)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if job, ok := r.jobs[id]; ok {
+		fn(job)
+		job.UpdatedAt = time.Now().UTC()
+	}
+}
+
+// expire drops jobs that finished more than retention ago
+func (r *Registry) expire(now time.Time) {
+	for id, job := range r.jobs {
+		if job.Done() && now.Sub(job.UpdatedAt) > retention {
+			delete(r.jobs, id)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Lifecycle(t *testing.T) {
+	r := NewRegistry()
+
+	job := r.Create("vm1")
+	assert.NotEmpty(t, job.ID)
+	assert.Equal(t, "vm1", job.VM)
+	assert.Equal(t, StatusLaunching, job.Status)
+	assert.False(t, job.Done())
+
+	r.Update(job.ID, func(j *Job) {
+		j.Status = StatusInstalling
+		j.LastLog = "Setting up opencode..."
+	})
+
+	got, ok := r.Get(job.ID)
+	require.True(t, ok)
+	assert.Equal(t, StatusInstalling, got.Status)
+	assert.Equal(t, "Setting up opencode...", got.LastLog)
+
+	r.Update(job.ID, func(j *Job) { j.Status = StatusReady })
+	got, _ = r.Get(job.ID)
+	assert.True(t, got.Done())
+
+	_, ok = r.Get("missing")
+	assert.False(t, ok)
+}
+
+func TestRegistry_GetReturnsCopy(t *testing.T) {
+	r := NewRegistry()
+	job := r.Create("vm1")
+
+	got, _ := r.Get(job.ID)
+	got.Status = StatusFailed
+
+	again, _ := r.Get(job.ID)
+	assert.Equal(t, StatusLaunching, again.Status)
+}
+
+func TestRegistry_ExpiresFinishedJobs(t *testing.T) {
+	r := NewRegistry()
+	old := r.Create("old")
+	running := r.Create("running")
+
+	// Backdate both; only the finished one may be dropped
+	for _, id := range []string{old.ID, running.ID} {
+		r.jobs[id].UpdatedAt = time.Now().Add(-2 * retention)
+	}
+	r.jobs[old.ID].Status = StatusReady
+
+	r.Create("new")
+
+	_, ok := r.Get(old.ID)
+	assert.False(t, ok)
+	_, ok = r.Get(running.ID)
+	assert.True(t, ok)
+}
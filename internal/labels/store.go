@@ -0,0 +1,263 @@
+package labels
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/mjshashank/dabbi/internal/config"
+)
+
+const (
+	labelsFile = "labels.json"
+
+	maxKeyLen   = 63
+	maxValueLen = 256
+)
+
+// ReservedPrefix starts the keys dabbi sets itself. Users can't set them
+// through Set or Replace (see Validate); dabbi uses Mark instead.
+const ReservedPrefix = "dabbi/"
+
+// StoppedByUserKey marks a VM the user stopped on purpose with
+// `dabbi stop <vm>`, so `dabbi start --all --skip-stopped` leaves it alone.
+// Bulk and watchdog stops don't set it; starting the VM clears it.
+const StoppedByUserKey = "dabbi/stopped-by-user"
+
+// PinnedKey marks a VM pinned with `dabbi pin <vm>`: prune never selects it
+// and the watchdog never stops or suspends it
+const PinnedKey = "dabbi/pinned"
+
+// IsPinned reports whether a VM's labels pin it
+func IsPinned(labels map[string]string) bool {
+	return labels[PinnedKey] == "true"
+}
+
+// keyPattern allows keys like "project", "env", "team.io/owner"
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// Store persists VM labels (vm -> key -> value) in a JSON file on the host.
+// Multipass has no label concept, so labels live entirely on the host side.
+// The file is re-read on every call so the CLI and daemon see each other's changes.
+type Store struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewStore creates a label store backed by the given file
+func NewStore(path string) *Store {
+	return &Store{path: path}
+}
+
+// DefaultPath returns the path to the labels file (~/.dabbi/labels.json)
+func DefaultPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, config.ConfigDir, labelsFile), nil
+}
+
+// All returns the labels of every VM
+func (s *Store) All() (map[string]map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+// Get returns the labels of a VM (empty if it has none)
+func (s *Store) Get(vmName string) (map[string]string, error) {
+	all, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	if all[vmName] == nil {
+		return map[string]string{}, nil
+	}
+	return all[vmName], nil
+}
+
+// Pinned returns the set of pinned VMs
+func (s *Store) Pinned() (map[string]bool, error) {
+	all, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+	pinned := make(map[string]bool)
+	for vm, labels := range all {
+		if IsPinned(labels) {
+			pinned[vm] = true
+		}
+	}
+	return pinned, nil
+}
+
+// IsReserved reports whether key is one dabbi sets itself
+func IsReserved(key string) bool {
+	return strings.HasPrefix(key, ReservedPrefix)
+}
+
+// Set adds or updates labels on a VM, keeping any other existing labels
+func (s *Store) Set(vmName string, labels map[string]string) error {
+	if err := Validate(labels); err != nil {
+		return err
+	}
+	return s.update(func(all map[string]map[string]string) {
+		if all[vmName] == nil {
+			all[vmName] = make(map[string]string, len(labels))
+		}
+		for k, v := range labels {
+			all[vmName][k] = v
+		}
+	})
+}
+
+// Replace sets a VM's labels to exactly the given set. Reserved labels the
+// VM already has are kept, since users can't set them back.
+func (s *Store) Replace(vmName string, labels map[string]string) error {
+	if err := Validate(labels); err != nil {
+		return err
+	}
+	return s.update(func(all map[string]map[string]string) {
+		merged := make(map[string]string, len(labels))
+		for k, v := range all[vmName] {
+			if IsReserved(k) {
+				merged[k] = v
+			}
+		}
+		for k, v := range labels {
+			merged[k] = v
+		}
+		if len(merged) == 0 {
+			delete(all, vmName)
+			return
+		}
+		all[vmName] = merged
+	})
+}
+
+// Mark sets one of dabbi's own reserved keys (e.g. PinnedKey) to "true" on
+// a VM. Remove clears it.
+func (s *Store) Mark(vmName, key string) error {
+	if !IsReserved(key) {
+		return fmt.Errorf("label key %q is not reserved, use Set", key)
+	}
+	return s.update(func(all map[string]map[string]string) {
+		if all[vmName] == nil {
+			all[vmName] = make(map[string]string, 1)
+		}
+		all[vmName][key] = "true"
+	})
+}
+
+// Remove deletes the given label keys from a VM
+func (s *Store) Remove(vmName string, keys ...string) error {
+	return s.update(func(all map[string]map[string]string) {
+		for _, k := range keys {
+			delete(all[vmName], k)
+		}
+		if len(all[vmName]) == 0 {
+			delete(all, vmName)
+		}
+	})
+}
+
+// Delete drops all labels of a VM (called when the VM is deleted)
+func (s *Store) Delete(vmName string) error {
+	return s.update(func(all map[string]map[string]string) {
+		delete(all, vmName)
+	})
+}
+
+// update applies fn to the stored labels and writes them back
+func (s *Store) update(fn func(all map[string]map[string]string)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.load()
+	if err != nil {
+		return err
+	}
+	fn(all)
+	return s.save(all)
+}
+
+func (s *Store) load() (map[string]map[string]string, error) {
+	all := make(map[string]map[string]string)
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return all, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	return all, nil
+}
+
+func (s *Store) save(all map[string]map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temp file and rename so readers never see a partial file
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Validate checks user-supplied label keys and values. Keys starting with
+// ReservedPrefix are rejected: they pin VMs and record dabbi's own state.
+func Validate(labels map[string]string) error {
+	for k, v := range labels {
+		if len(k) > maxKeyLen || !keyPattern.MatchString(k) {
+			return fmt.Errorf("invalid label key %q: use letters, digits, '.', '_', '/', '-' (max %d chars)", k, maxKeyLen)
+		}
+		if IsReserved(k) {
+			return fmt.Errorf("label key %q is reserved: keys starting with %q are set by dabbi", k, ReservedPrefix)
+		}
+		if len(v) > maxValueLen {
+			return fmt.Errorf("label %q value is too long (max %d chars)", k, maxValueLen)
+		}
+		if strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return fmt.Errorf("label %q value cannot contain control characters", k)
+		}
+	}
+	return nil
+}
+
+// Parse splits a "key=value" string into its key and value
+func Parse(s string) (string, string, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("invalid label %q: expected key=value", s)
+	}
+	return key, value, nil
+}
+
+// Matches reports whether labels satisfy a selector: "key=value" requires
+// that exact value, a bare "key" only requires the key to be present
+func Matches(labels map[string]string, selector string) bool {
+	key, value, hasValue := strings.Cut(selector, "=")
+	got, ok := labels[key]
+	if !ok {
+		return false
+	}
+	return !hasValue || got == value
+}
@@ -0,0 +1,169 @@
+package labels
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStore(t *testing.T) *Store {
+	return NewStore(filepath.Join(t.TempDir(), "labels.json"))
+}
+
+func TestStore_SetGetRemove(t *testing.T) {
+	s := newTestStore(t)
+
+	// Missing file reads as empty
+	got, err := s.Get("vm1")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	require.NoError(t, s.Set("vm1", map[string]string{"project": "foo", "env": "ci"}))
+	require.NoError(t, s.Set("vm1", map[string]string{"env": "dev"}))
+
+	got, err = s.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"project": "foo", "env": "dev"}, got)
+
+	require.NoError(t, s.Remove("vm1", "env", "missing"))
+	got, err = s.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"project": "foo"}, got)
+
+	// Removing the last label drops the VM entry entirely
+	require.NoError(t, s.Remove("vm1", "project"))
+	all, err := s.All()
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
+
+func TestStore_ReplaceAndDelete(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.Set("vm1", map[string]string{"a": "1", "b": "2"}))
+	require.NoError(t, s.Set("vm2", map[string]string{"a": "1"}))
+	require.NoError(t, s.Replace("vm1", map[string]string{"c": "3"}))
+
+	got, err := s.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"c": "3"}, got)
+
+	require.NoError(t, s.Delete("vm1"))
+	all, err := s.All()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{"vm2": {"a": "1"}}, all)
+}
+
+func TestStore_ReplaceKeepsReserved(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.Mark("vm1", PinnedKey))
+	require.NoError(t, s.Set("vm1", map[string]string{"a": "1"}))
+	require.NoError(t, s.Replace("vm1", nil))
+
+	got, err := s.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{PinnedKey: "true"}, got)
+}
+
+func TestStore_Mark(t *testing.T) {
+	s := newTestStore(t)
+
+	require.NoError(t, s.Mark("vm1", StoppedByUserKey))
+	got, err := s.Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{StoppedByUserKey: "true"}, got)
+
+	assert.Error(t, s.Mark("vm1", "project"))
+
+	// Users can't set reserved keys themselves
+	assert.ErrorContains(t, s.Set("vm1", map[string]string{PinnedKey: "true"}), "reserved")
+	assert.ErrorContains(t, s.Replace("vm1", map[string]string{"dabbi/ssh-agent": "true"}), "reserved")
+}
+
+func TestStore_SharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.json")
+	require.NoError(t, NewStore(path).Set("vm1", map[string]string{"env": "ci"}))
+
+	// A second store (e.g. the CLI while the daemon runs) sees the change
+	got, err := NewStore(path).Get("vm1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"env": "ci"}, got)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestStore_SetRejectsInvalid(t *testing.T) {
+	s := newTestStore(t)
+
+	err := s.Set("vm1", map[string]string{"bad key": "x"})
+	assert.ErrorContains(t, err, "invalid label key")
+
+	all, err := s.All()
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		expectErr bool
+	}{
+		{"simple", map[string]string{"project": "foo"}, false},
+		{"prefixed_key", map[string]string{"team.io/owner": "me"}, false},
+		{"empty_value", map[string]string{"flag": ""}, false},
+		{"value_with_equals", map[string]string{"expr": "a=b"}, false},
+		{"empty_key", map[string]string{"": "x"}, true},
+		{"key_with_space", map[string]string{"my key": "x"}, true},
+		{"key_with_equals", map[string]string{"a=b": "x"}, true},
+		{"leading_dash", map[string]string{"-a": "x"}, true},
+		{"reserved_prefix", map[string]string{"dabbi/pinned": "true"}, true},
+		{"value_with_newline", map[string]string{"a": "x\ny"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.labels)
+			if tt.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	key, value, err := Parse("project=foo")
+	require.NoError(t, err)
+	assert.Equal(t, "project", key)
+	assert.Equal(t, "foo", value)
+
+	key, value, err = Parse("expr=a=b")
+	require.NoError(t, err)
+	assert.Equal(t, "expr", key)
+	assert.Equal(t, "a=b", value)
+
+	_, _, err = Parse("project")
+	assert.Error(t, err)
+
+	_, _, err = Parse("=foo")
+	assert.Error(t, err)
+}
+
+func TestMatches(t *testing.T) {
+	labels := map[string]string{"project": "foo", "env": ""}
+
+	assert.True(t, Matches(labels, "project=foo"))
+	assert.False(t, Matches(labels, "project=bar"))
+	assert.True(t, Matches(labels, "project"))
+	assert.True(t, Matches(labels, "env="))
+	assert.False(t, Matches(labels, "owner"))
+	assert.False(t, Matches(nil, "project"))
+}
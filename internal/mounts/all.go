@@ -0,0 +1,80 @@
+package mounts
+
+import (
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// DefaultParallel is how many VMs All queries at once when parallel is unset
+const DefaultParallel = 4
+
+// HostMount is one mount of one VM, as seen host-wide
+type HostMount struct {
+	VM             string `json:"vm"`
+	HostPath       string `json:"host_path"`
+	VMPath         string `json:"vm_path"`
+	HostPathExists bool   `json:"host_path_exists"` // false when the host directory was moved or deleted
+}
+
+// VMError is a VM whose mounts couldn't be read
+type VMError struct {
+	VM    string `json:"vm"`
+	Error string `json:"error"`
+}
+
+// All returns the mounts of every VM, sorted by VM and VM path, with
+// whether each host path still exists. VMs are queried parallel at a time
+// (0 = DefaultParallel); one that can't be queried is reported in the
+// errors rather than failing the rest. Only listing the VMs can fail All.
+func All(mp multipass.Client, parallel int) ([]HostMount, []VMError, error) {
+	vms, err := mp.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	if parallel <= 0 {
+		parallel = DefaultParallel
+	}
+
+	infos := make([]*multipass.InstanceInfo, len(vms))
+	errs := make([]error, len(vms))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, vm := range vms {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, name string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			infos[i], errs[i] = mp.Info(name)
+		}(i, vm.Name)
+	}
+	wg.Wait()
+
+	found := []HostMount{}
+	var failed []VMError
+	for i, vm := range vms {
+		if errs[i] != nil {
+			failed = append(failed, VMError{VM: vm.Name, Error: errs[i].Error()})
+			continue
+		}
+		for vmPath, m := range infos[i].Mounts {
+			_, statErr := os.Stat(m.SourcePath)
+			found = append(found, HostMount{
+				VM:             vm.Name,
+				HostPath:       m.SourcePath,
+				VMPath:         vmPath,
+				HostPathExists: statErr == nil,
+			})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].VM != found[j].VM {
+			return found[i].VM < found[j].VM
+		}
+		return found[i].VMPath < found[j].VMPath
+	})
+	return found, failed, nil
+}
@@ -0,0 +1,62 @@
+package mounts
+
+import (
+	"fmt"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// Restore result statuses
+const (
+	StatusMounted = "mounted"
+	StatusSkipped = "skipped"
+	StatusFailed  = "failed"
+)
+
+// Result is what happened to one recorded mount
+type Result struct {
+	HostPath string `json:"host_path"`
+	VMPath   string `json:"vm_path"`
+	Status   string `json:"status"`           // mounted, skipped, or failed
+	Detail   string `json:"detail,omitempty"` // why it was skipped, or the error
+}
+
+// Restore applies a VM's recorded mounts that it doesn't currently have,
+// e.g. after the VM was recreated. Mounts already in place are skipped and a
+// failed mount doesn't stop the rest; only reading the record or the VM's
+// info can fail Restore itself.
+func Restore(mp multipass.Client, s *Store, vmName string) ([]Result, error) {
+	entries, err := s.List(vmName)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return []Result{}, nil
+	}
+	info, err := mp.Info(vmName)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, 0, len(entries))
+	for _, e := range entries {
+		r := Result{HostPath: e.HostPath, VMPath: e.VMPath}
+		if current, ok := info.Mounts[e.VMPath]; ok {
+			if current.SourcePath == e.HostPath {
+				r.Status, r.Detail = StatusSkipped, "already mounted"
+			} else {
+				r.Status, r.Detail = StatusFailed, fmt.Sprintf("%s is already mounted from %s", e.VMPath, current.SourcePath)
+			}
+			results = append(results, r)
+			continue
+		}
+
+		if err := mp.Mount(vmName, e.Options()); err != nil {
+			r.Status, r.Detail = StatusFailed, err.Error()
+		} else {
+			r.Status = StatusMounted
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
@@ -0,0 +1,179 @@
+package mounts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+const mountsDir = "mounts"
+
+// Entry is a mount as it was added: multipass info only reports the source
+// path and id mappings, not the type or how they were asked for
+type Entry struct {
+	HostPath string   `json:"host_path"`
+	VMPath   string   `json:"vm_path"`
+	UIDMaps  []string `json:"uid_maps,omitempty"`
+	GIDMaps  []string `json:"gid_maps,omitempty"`
+	Type     string   `json:"type,omitempty"`
+}
+
+// Options converts the entry to multipass mount options
+func (e Entry) Options() multipass.MountOptions {
+	return multipass.MountOptions{
+		HostPath: e.HostPath,
+		VMPath:   e.VMPath,
+		UIDMaps:  e.UIDMaps,
+		GIDMaps:  e.GIDMaps,
+		Type:     e.Type,
+	}
+}
+
+// EntryFromOptions records multipass mount options
+func EntryFromOptions(opts multipass.MountOptions) Entry {
+	return Entry{
+		HostPath: opts.HostPath,
+		VMPath:   opts.VMPath,
+		UIDMaps:  opts.UIDMaps,
+		GIDMaps:  opts.GIDMaps,
+		Type:     opts.Type,
+	}
+}
+
+// Store keeps each VM's mounts in <dir>/<vm>.json, so they can be applied
+// again after multipass loses them (e.g. when a VM is recreated)
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewStore creates a mount store rooted at dir
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// DefaultDir returns the directory mount records are stored in (~/.dabbi/mounts)
+func DefaultDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, config.ConfigDir, mountsDir), nil
+}
+
+func (s *Store) path(vmName string) (string, error) {
+	if err := multipass.ValidateInstanceName(vmName); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, vmName+".json"), nil
+}
+
+// List returns a VM's recorded mounts, sorted by VM path (empty if none)
+func (s *Store) List(vmName string) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(vmName)
+}
+
+// Add records a mount, replacing any earlier one at the same VM path
+func (s *Store) Add(vmName string, entry Entry) error {
+	return s.update(vmName, func(entries []Entry) []Entry {
+		entries = without(entries, entry.VMPath)
+		return append(entries, entry)
+	})
+}
+
+// Remove forgets the mount at vmPath. Removing one that isn't recorded is
+// not an error.
+func (s *Store) Remove(vmName, vmPath string) error {
+	return s.update(vmName, func(entries []Entry) []Entry {
+		return without(entries, vmPath)
+	})
+}
+
+// Delete forgets all of a VM's mounts
+func (s *Store) Delete(vmName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.path(vmName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) update(vmName string, fn func([]Entry) []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.load(vmName)
+	if err != nil {
+		return err
+	}
+	entries = fn(entries)
+	if len(entries) == 0 {
+		path, _ := s.path(vmName)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return s.save(vmName, entries)
+}
+
+func (s *Store) load(vmName string) ([]Entry, error) {
+	path, err := s.path(vmName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+func (s *Store) save(vmName string, entries []Entry) error {
+	path, err := s.path(vmName)
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].VMPath < entries[j].VMPath })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// without returns entries minus the one mounted at vmPath
+func without(entries []Entry, vmPath string) []Entry {
+	kept := entries[:0]
+	for _, e := range entries {
+		if e.VMPath != vmPath {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
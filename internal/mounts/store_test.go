@@ -0,0 +1,141 @@
+package mounts
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_AddRemoveDelete(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore(dir)
+
+	entries, err := s.List("dev")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	src := Entry{HostPath: "/Users/me/src", VMPath: "/home/ubuntu/src", UIDMaps: []string{"501:1000"}, Type: multipass.MountTypeNative}
+	data := Entry{HostPath: "/data", VMPath: "/data"}
+	require.NoError(t, s.Add("dev", src))
+	require.NoError(t, s.Add("dev", data))
+
+	entries, err = s.List("dev")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{data, src}, entries)
+
+	info, err := os.Stat(filepath.Join(dir, "dev.json"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Adding at the same VM path replaces the record
+	moved := Entry{HostPath: "/Users/me/other", VMPath: "/home/ubuntu/src"}
+	require.NoError(t, s.Add("dev", moved))
+	entries, err = s.List("dev")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{data, moved}, entries)
+
+	require.NoError(t, s.Remove("dev", "/data"))
+	require.NoError(t, s.Remove("dev", "/not-recorded"))
+	entries, err = s.List("dev")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{moved}, entries)
+
+	// Removing the last mount removes the file
+	require.NoError(t, s.Remove("dev", "/home/ubuntu/src"))
+	_, err = os.Stat(filepath.Join(dir, "dev.json"))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	require.NoError(t, s.Add("dev", data))
+	require.NoError(t, s.Delete("dev"))
+	require.NoError(t, s.Delete("dev"))
+	entries, err = s.List("dev")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStore_RejectsUnsafeNames(t *testing.T) {
+	s := NewStore(t.TempDir())
+	for _, name := range []string{"", "..", "../escape", "a/b", ".hidden", "-flag"} {
+		assert.Error(t, s.Add(name, Entry{HostPath: "/a", VMPath: "/a"}), name)
+		_, err := s.List(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	s := NewStore(t.TempDir())
+	src := Entry{HostPath: "/Users/me/src", VMPath: "/home/ubuntu/src", UIDMaps: []string{"501:1000"}}
+	require.NoError(t, s.Add("dev", src))
+	require.NoError(t, s.Add("dev", Entry{HostPath: "/data", VMPath: "/data"}))
+	require.NoError(t, s.Add("dev", Entry{HostPath: "/cache", VMPath: "/cache"}))
+	require.NoError(t, s.Add("dev", Entry{HostPath: "/logs", VMPath: "/logs"}))
+
+	info := testutil.RunningVM("dev", "192.168.64.5")
+	info.Mounts = map[string]multipass.Mount{
+		"/data": {SourcePath: "/data"},
+		"/logs": {SourcePath: "/elsewhere"},
+	}
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "dev").Return(info, nil)
+	mockMP.On("Mount", "dev", src.Options()).Return(nil)
+	mockMP.On("Mount", "dev", multipass.MountOptions{HostPath: "/cache", VMPath: "/cache"}).Return(errors.New("source path does not exist"))
+
+	results, err := Restore(mockMP, s, "dev")
+	require.NoError(t, err)
+	assert.Equal(t, []Result{
+		{HostPath: "/cache", VMPath: "/cache", Status: StatusFailed, Detail: "source path does not exist"},
+		{HostPath: "/data", VMPath: "/data", Status: StatusSkipped, Detail: "already mounted"},
+		{HostPath: "/Users/me/src", VMPath: "/home/ubuntu/src", Status: StatusMounted},
+		{HostPath: "/logs", VMPath: "/logs", Status: StatusFailed, Detail: "/logs is already mounted from /elsewhere"},
+	}, results)
+	mockMP.AssertExpectations(t)
+}
+
+func TestRestore_NothingRecorded(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	results, err := Restore(mockMP, NewStore(t.TempDir()), "dev")
+	require.NoError(t, err)
+	assert.Empty(t, results)
+	mockMP.AssertNotCalled(t, "Info", "dev")
+}
+
+func TestAll(t *testing.T) {
+	existing := t.TempDir()
+
+	dev := testutil.RunningVM("dev", "192.168.64.5")
+	dev.Mounts = map[string]multipass.Mount{
+		"/src":  {SourcePath: existing},
+		"/data": {SourcePath: filepath.Join(existing, "moved-away")},
+	}
+	db := testutil.StoppedVM("db")
+	db.Mounts = map[string]multipass.Mount{"/backups": {SourcePath: existing}}
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(testutil.RunningVMList("dev", "broken", "db"), nil)
+	mockMP.On("Info", "dev").Return(dev, nil)
+	mockMP.On("Info", "db").Return(db, nil)
+	mockMP.On("Info", "broken").Return(nil, errors.New("instance is unknown"))
+
+	found, failed, err := All(mockMP, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []HostMount{
+		{VM: "db", HostPath: existing, VMPath: "/backups", HostPathExists: true},
+		{VM: "dev", HostPath: filepath.Join(existing, "moved-away"), VMPath: "/data", HostPathExists: false},
+		{VM: "dev", HostPath: existing, VMPath: "/src", HostPathExists: true},
+	}, found)
+	assert.Equal(t, []VMError{{VM: "broken", Error: "instance is unknown"}}, failed)
+}
+
+func TestAll_ListFails(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(nil, errors.New("multipass not running"))
+
+	_, _, err := All(mockMP, 0)
+	assert.ErrorContains(t, err, "multipass not running")
+}
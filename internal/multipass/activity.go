@@ -0,0 +1,80 @@
+package multipass
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// activityCommand prints, one per line:
+//  1. network bytes received and sent, from /proc/net/dev
+//  2. PTY idle time in seconds (min across all PTYs, -1 if none)
+//  3. 1-minute load average
+//  4. busy and total CPU jiffies, from /proc/stat
+//  5. total and available memory in KiB, from /proc/meminfo
+const activityCommand = `awk 'NR>2 {rx+=$2; tx+=$10} END {print rx, tx}' /proc/net/dev; ` +
+	`now=$(date +%s); idle=-1; for p in /dev/pts/[0-9]*; do [ -e "$p" ] && { t=$(stat -c %Y "$p"); i=$((now-t)); [ $idle -lt 0 ] || [ $i -lt $idle ] && idle=$i; }; done; echo $idle; ` +
+	`cut -d' ' -f1 /proc/loadavg; ` +
+	`awk '/^cpu / {t=0; for (i=2; i<=NF; i++) t+=$i; print t-$5-$6, t}' /proc/stat; ` +
+	`awk '/^MemTotal:/ {t=$2} /^MemAvailable:/ {a=$2} END {print t, a}' /proc/meminfo`
+
+// ActivityStats holds activity and resource indicators queried from a VM.
+// Counters are totals since boot; rates come from comparing two samples.
+type ActivityStats struct {
+	RxBytes         uint64
+	TxBytes         uint64
+	PTYIdleSeconds  int // Seconds since last PTY activity (-1 if no PTY)
+	LoadAverage1Min float64
+	CPUBusy         uint64 // jiffies spent neither idle nor waiting on I/O
+	CPUTotal        uint64
+	MemTotalKB      uint64
+	MemAvailableKB  uint64
+}
+
+// CollectActivity queries a VM's activity stats in one exec call. The
+// watchdog uses the activity indicators; live metrics use the rest too.
+func CollectActivity(mp Client, vmName string) (*ActivityStats, error) {
+	output, err := mp.Exec(vmName, "sh", "-c", activityCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("unexpected output: %s", output)
+	}
+
+	stats := &ActivityStats{}
+
+	if parts := strings.Fields(lines[0]); len(parts) == 2 {
+		stats.RxBytes, _ = strconv.ParseUint(parts[0], 10, 64)
+		stats.TxBytes, _ = strconv.ParseUint(parts[1], 10, 64)
+	}
+	stats.PTYIdleSeconds, _ = strconv.Atoi(strings.TrimSpace(lines[1]))
+	stats.LoadAverage1Min, _ = strconv.ParseFloat(strings.TrimSpace(lines[2]), 64)
+	// CPU and memory lines are missing if /proc/stat or /proc/meminfo
+	// can't be read; the activity indicators above are still usable
+	if len(lines) > 3 {
+		if parts := strings.Fields(lines[3]); len(parts) == 2 {
+			stats.CPUBusy, _ = strconv.ParseUint(parts[0], 10, 64)
+			stats.CPUTotal, _ = strconv.ParseUint(parts[1], 10, 64)
+		}
+	}
+	if len(lines) > 4 {
+		if parts := strings.Fields(lines[4]); len(parts) == 2 {
+			stats.MemTotalKB, _ = strconv.ParseUint(parts[0], 10, 64)
+			stats.MemAvailableKB, _ = strconv.ParseUint(parts[1], 10, 64)
+		}
+	}
+
+	return stats, nil
+}
+
+// CPUPercent returns the share of CPU time spent busy between an earlier
+// sample and s, across all cores (0-100)
+func (s *ActivityStats) CPUPercent(prev *ActivityStats) float64 {
+	if prev == nil || s.CPUTotal <= prev.CPUTotal || s.CPUBusy < prev.CPUBusy {
+		return 0
+	}
+	return 100 * float64(s.CPUBusy-prev.CPUBusy) / float64(s.CPUTotal-prev.CPUTotal)
+}
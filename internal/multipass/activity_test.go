@@ -0,0 +1,63 @@
+package multipass
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectActivity(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass exec test-vm -- sh -c "+activityCommand,
+		[]byte("123456 789012\n-1\n0.25\n4000 20000\n4046848 3000000\n"))
+
+	stats, err := CollectActivity(NewClient(mock), "test-vm")
+	require.NoError(t, err)
+
+	assert.Equal(t, &ActivityStats{
+		RxBytes:         123456,
+		TxBytes:         789012,
+		PTYIdleSeconds:  -1,
+		LoadAverage1Min: 0.25,
+		CPUBusy:         4000,
+		CPUTotal:        20000,
+		MemTotalKB:      4046848,
+		MemAvailableKB:  3000000,
+	}, stats)
+}
+
+func TestCollectActivity_PartialOutput(t *testing.T) {
+	// Without /proc/stat and /proc/meminfo the activity indicators still count
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass exec test-vm -- sh -c "+activityCommand, []byte("10 20\n42\n1.50\n"))
+
+	stats, err := CollectActivity(NewClient(mock), "test-vm")
+	require.NoError(t, err)
+
+	assert.Equal(t, &ActivityStats{RxBytes: 10, TxBytes: 20, PTYIdleSeconds: 42, LoadAverage1Min: 1.5}, stats)
+}
+
+func TestCollectActivity_Errors(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass exec short -- sh -c "+activityCommand, []byte("10 20\n"))
+	mock.SetError("multipass exec down -- sh -c "+activityCommand, errors.New("instance is not running"))
+	client := NewClient(mock)
+
+	_, err := CollectActivity(client, "short")
+	assert.ErrorContains(t, err, "unexpected output")
+
+	_, err = CollectActivity(client, "down")
+	assert.ErrorContains(t, err, "instance is not running")
+}
+
+func TestActivityStats_CPUPercent(t *testing.T) {
+	prev := &ActivityStats{CPUBusy: 4000, CPUTotal: 20000}
+	cur := &ActivityStats{CPUBusy: 4300, CPUTotal: 21000}
+
+	assert.InDelta(t, 30, cur.CPUPercent(prev), 0.001)
+	assert.Zero(t, cur.CPUPercent(nil))
+	// Counters went backwards: the VM rebooted
+	assert.Zero(t, prev.CPUPercent(cur))
+}
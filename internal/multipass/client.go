@@ -2,10 +2,18 @@ package multipass
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // CommandExecutor interface for testability
@@ -13,17 +21,55 @@ type CommandExecutor interface {
 	Execute(name string, args ...string) ([]byte, error)
 }
 
+// EnvExecutor is a CommandExecutor that can also add environment variables
+// to a command, for launches configured with launch_env
+type EnvExecutor interface {
+	ExecuteEnv(env []string, name string, args ...string) ([]byte, error)
+}
+
+// ContextExecutor is a CommandExecutor that can kill a command when ctx
+// ends, for commands that may hang, like stopping a guest that won't shut
+// down
+type ContextExecutor interface {
+	ExecuteContext(ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
 // RealExecutor uses actual exec.Command
 type RealExecutor struct{}
 
 // Execute runs a command and returns stdout
 func (e RealExecutor) Execute(name string, args ...string) ([]byte, error) {
-	cmd := exec.Command(name, args...)
+	return e.ExecuteEnv(nil, name, args...)
+}
+
+// ExecuteEnv runs a command with env ("NAME=value") added to the daemon's
+// environment and returns stdout
+func (e RealExecutor) ExecuteEnv(env []string, name string, args ...string) ([]byte, error) {
+	return e.run(context.Background(), env, name, args)
+}
+
+// ExecuteContext runs a command, killing it if ctx ends first, and returns
+// stdout
+func (e RealExecutor) ExecuteContext(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return e.run(ctx, nil, name, args)
+}
+
+func (e RealExecutor) run(ctx context.Context, env []string, name string, args []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
 	err := cmd.Run()
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrMultipassNotInstalled
+	}
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		err = ctxErr
+	}
 	if err != nil {
 		return nil, &MultipassError{
 			Command: strings.Join(append([]string{name}, args...), " "),
@@ -34,6 +80,10 @@ func (e RealExecutor) Execute(name string, args ...string) ([]byte, error) {
 	return stdout.Bytes(), nil
 }
 
+// ErrMultipassNotInstalled is returned by RealExecutor when the multipass
+// binary can't be found, instead of the bare exec error
+var ErrMultipassNotInstalled = errors.New("multipass is not installed or not on PATH; install it from https://multipass.run/install")
+
 // MultipassError wraps exec errors with context
 type MultipassError struct {
 	Command string
@@ -52,6 +102,16 @@ func (e *MultipassError) Unwrap() error {
 	return e.Err
 }
 
+// ExitCode returns the exit status of a failed command (for Exec, that of
+// the command run in the VM), or -1 if it didn't run to an exit
+func ExitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
 // Client interface for multipass operations
 type Client interface {
 	// VM Lifecycle
@@ -60,30 +120,61 @@ type Client interface {
 	Launch(opts LaunchOptions) error
 	Start(name string) error
 	Stop(name string) error
+	StopWithOptions(name string, force bool, timeout time.Duration) error
+	Suspend(name string) error
 	Restart(name string) error
 	Delete(name string, purge bool) error
 
+	// Variants that kill the command when ctx ends, e.g. when an API request
+	// times out or its client goes away
+	ListContext(ctx context.Context) ([]ListInstance, error)
+	InfoContext(ctx context.Context, name string) (*InstanceInfo, error)
+
+	// Host networks (for bridged NICs)
+	ListNetworks() ([]NetworkInterface, error)
+
 	// Clone
 	Clone(source, dest string) error
+	CloneFromSnapshot(source, snapshot, dest string) error
+
+	// Resources (VM must be stopped to change them)
+	Resources(vmName string) (cpus int, memory int64, err error)
+	SetResources(vmName string, cpus int, memory, disk string) error
 
 	// Snapshots
 	ListSnapshots(vmName string) (map[string]Snapshot, error)
+	ListAllSnapshots() (map[string]map[string]Snapshot, error)
 	CreateSnapshot(vmName, snapshotName string) error
 	RestoreSnapshot(vmName, snapshotName string, destructive bool) error
 	DeleteSnapshot(vmName, snapshotName string) error
 
 	// Files
 	Transfer(src, dst string) error
+	TransferRecursive(src, dst string) error
 	Exec(vmName string, cmd ...string) (string, error)
+	ExecWithTimeout(vmName string, timeout time.Duration, cmd ...string) (string, error)
 
 	// Mounts
-	Mount(vmName, hostPath, vmPath string) error
+	Mount(vmName string, opts MountOptions) error
 	Unmount(vmName, path string) error
+
+	// Escape hatch for subcommands without a typed wrapper (unsupported)
+	Raw(args ...string) ([]byte, error)
+
+	// Installed release, for features only newer releases have
+	Version() (Version, error)
+	Supports(f Feature) bool
 }
 
 // client implements Client using multipass CLI
 type client struct {
 	exec CommandExecutor
+
+	versionMu sync.Mutex
+	version   *Version // cached by Version
+
+	launchEnv  []string // added to every launch, see ClientOptions
+	launchArgs []string
 }
 
 // NewClient creates a new multipass client with the given executor
@@ -96,9 +187,90 @@ func NewRealClient() Client {
 	return &client{exec: RealExecutor{}}
 }
 
+// ClientOptions configures a client created with NewClientWithOptions
+type ClientOptions struct {
+	// MaxConcurrent caps how many multipass commands run at once; further
+	// calls wait for a slot. 0 means unlimited.
+	MaxConcurrent int
+
+	// LaunchEnv ("NAME=value", MULTIPASS_* only) and LaunchArgs are added to
+	// every `multipass launch`, e.g. for images behind a proxy or a mirror
+	// that needs credentials. Check them with ValidateLaunchPassthrough.
+	LaunchEnv  []string
+	LaunchArgs []string
+}
+
+// NewClientWithOptions creates a multipass client with the given executor
+// and options
+func NewClientWithOptions(exec CommandExecutor, opts ClientOptions) Client {
+	if opts.MaxConcurrent > 0 {
+		exec = &limitedExecutor{exec: exec, slots: make(chan struct{}, opts.MaxConcurrent)}
+	}
+	return &client{exec: exec, launchEnv: opts.LaunchEnv, launchArgs: opts.LaunchArgs}
+}
+
+// limitedExecutor runs at most cap(slots) commands at a time, so bulk
+// operations don't start dozens of multipass processes at once
+type limitedExecutor struct {
+	exec  CommandExecutor
+	slots chan struct{}
+}
+
+// Execute waits for a free slot, then runs the command
+func (e *limitedExecutor) Execute(name string, args ...string) ([]byte, error) {
+	e.slots <- struct{}{}
+	defer func() { <-e.slots }()
+	return e.exec.Execute(name, args...)
+}
+
+// ExecuteEnv waits for a free slot, then runs the command with env
+func (e *limitedExecutor) ExecuteEnv(env []string, name string, args ...string) ([]byte, error) {
+	ee, ok := e.exec.(EnvExecutor)
+	if !ok {
+		return nil, errNoEnv
+	}
+	e.slots <- struct{}{}
+	defer func() { <-e.slots }()
+	return ee.ExecuteEnv(env, name, args...)
+}
+
+// ExecuteContext waits for a free slot (or ctx to end), then runs the
+// command with ctx
+func (e *limitedExecutor) ExecuteContext(ctx context.Context, name string, args ...string) ([]byte, error) {
+	ce, ok := e.exec.(ContextExecutor)
+	if !ok {
+		return nil, errNoContext
+	}
+	select {
+	case e.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-e.slots }()
+	return ce.ExecuteContext(ctx, name, args...)
+}
+
+// executeContext runs a multipass command, killing it if ctx ends first.
+// Without a ctx that can end, or an executor that can cancel commands, it
+// runs to completion.
+func (c *client) executeContext(ctx context.Context, args ...string) ([]byte, error) {
+	if ce, ok := c.exec.(ContextExecutor); ok && ctx.Done() != nil {
+		out, err := ce.ExecuteContext(ctx, "multipass", args...)
+		if !errors.Is(err, errNoContext) {
+			return out, err
+		}
+	}
+	return c.exec.Execute("multipass", args...)
+}
+
 // List returns all VMs
 func (c *client) List() ([]ListInstance, error) {
-	out, err := c.exec.Execute("multipass", "list", "--format", "json")
+	return c.ListContext(context.Background())
+}
+
+// ListContext returns all VMs, giving up when ctx ends
+func (c *client) ListContext(ctx context.Context) ([]ListInstance, error) {
+	out, err := c.executeContext(ctx, "list", "--format", "json")
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +284,12 @@ func (c *client) List() ([]ListInstance, error) {
 
 // Info returns detailed information about a VM
 func (c *client) Info(name string) (*InstanceInfo, error) {
-	out, err := c.exec.Execute("multipass", "info", name, "--format", "json")
+	return c.InfoContext(context.Background(), name)
+}
+
+// InfoContext returns detailed information about a VM, giving up when ctx ends
+func (c *client) InfoContext(ctx context.Context, name string) (*InstanceInfo, error) {
+	out, err := c.executeContext(ctx, "info", name, "--format", "json")
 	if err != nil {
 		return nil, err
 	}
@@ -131,6 +308,14 @@ func (c *client) Info(name string) (*InstanceInfo, error) {
 
 // Launch creates and starts a new VM
 func (c *client) Launch(opts LaunchOptions) error {
+	// Checked here rather than only by callers, so the image is verified
+	// right before multipass reads it
+	if opts.ImageChecksum != "" {
+		if err := ValidateImage(opts.Image, opts.ImageChecksum); err != nil {
+			return err
+		}
+	}
+
 	args := []string{"launch", "--name", opts.Name}
 
 	if opts.CPUs > 0 {
@@ -145,34 +330,138 @@ func (c *client) Launch(opts LaunchOptions) error {
 	if opts.CloudInit != "" {
 		args = append(args, "--cloud-init", opts.CloudInit)
 	}
+	for _, n := range opts.Networks {
+		args = append(args, "--network", n)
+	}
+	args = append(args, c.launchArgs...)
 	if opts.Image != "" {
 		args = append(args, opts.Image)
 	}
 
-	_, err := c.exec.Execute("multipass", args...)
+	var err error
+	if len(c.launchEnv) > 0 {
+		ee, ok := c.exec.(EnvExecutor)
+		if !ok {
+			return errNoEnv
+		}
+		_, err = ee.ExecuteEnv(c.launchEnv, "multipass", args...)
+	} else {
+		_, err = c.exec.Execute("multipass", args...)
+	}
+	if err != nil && len(c.launchArgs) > 0 {
+		// Extra flags are the usual suspect when an older release rejects a launch
+		if v, verr := c.Version(); verr == nil {
+			err = fmt.Errorf("%w (launch_args are passed as-is to multipass %s; see `multipass launch --help` for the flags it has)", err, v)
+		}
+	}
 	return err
 }
 
+// ListNetworks returns the host interfaces available for bridged VM networking
+func (c *client) ListNetworks() ([]NetworkInterface, error) {
+	out, err := c.exec.Execute("multipass", "networks", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var resp NetworksResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse networks output: %w", err)
+	}
+	return resp.List, nil
+}
+
+// ValidateNetworks checks bridged network specs before they are passed to multipass launch
+func ValidateNetworks(networks []string) error {
+	for _, n := range networks {
+		if n == "" || strings.HasPrefix(n, "-") || strings.ContainsAny(n, " \t\n") {
+			return fmt.Errorf("invalid network: %q", n)
+		}
+	}
+	return nil
+}
+
 // Start starts a stopped VM
 func (c *client) Start(name string) error {
+	ForgetReachableIP(name)
 	_, err := c.exec.Execute("multipass", "start", name)
 	return err
 }
 
 // Stop stops a running VM
 func (c *client) Stop(name string) error {
+	ForgetReachableIP(name)
 	_, err := c.exec.Execute("multipass", "stop", name)
 	return err
 }
 
+// ErrStopTimeout is returned by StopWithOptions when a clean shutdown
+// didn't finish within the timeout and force wasn't set
+var ErrStopTimeout = errors.New("timed out waiting for the VM to shut down")
+
+// errNoContext is returned when the executor can't cancel commands
+var errNoContext = errors.New("multipass executor does not support timeouts")
+
+// StopWithOptions stops a VM whose guest may not shut down cleanly. With a
+// timeout, a clean stop is given that long; then it's killed and, if force
+// is set, the VM is powered off with 'multipass stop --force' (which may
+// lose unsaved data in the VM), else ErrStopTimeout is returned. force
+// without a timeout powers off straight away. An executor that can't
+// cancel commands gets a plain stop with no timeout.
+func (c *client) StopWithOptions(name string, force bool, timeout time.Duration) error {
+	ForgetReachableIP(name)
+	if timeout <= 0 {
+		if force {
+			return c.forceStop(name)
+		}
+		return c.Stop(name)
+	}
+
+	ce, ok := c.exec.(ContextExecutor)
+	if !ok {
+		return c.Stop(name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := ce.ExecuteContext(ctx, "multipass", "stop", name)
+	if errors.Is(err, errNoContext) {
+		return c.Stop(name)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	if !force {
+		return fmt.Errorf("stopping %s: %w after %v", name, ErrStopTimeout, timeout)
+	}
+	return c.forceStop(name)
+}
+
+// forceStop powers a VM off without waiting for its guest to shut down
+func (c *client) forceStop(name string) error {
+	if err := c.requireFeature(FeatureForceStop); err != nil {
+		return err
+	}
+	_, err := c.exec.Execute("multipass", "stop", "--force", name)
+	return c.checkUnsupported(err)
+}
+
+// Suspend suspends a running VM (resumes faster than a full stop)
+func (c *client) Suspend(name string) error {
+	ForgetReachableIP(name)
+	_, err := c.exec.Execute("multipass", "suspend", name)
+	return err
+}
+
 // Restart restarts a VM
 func (c *client) Restart(name string) error {
+	ForgetReachableIP(name)
 	_, err := c.exec.Execute("multipass", "restart", name)
 	return err
 }
 
 // Delete removes a VM
 func (c *client) Delete(name string, purge bool) error {
+	ForgetReachableIP(name)
 	args := []string{"delete", name}
 	if purge {
 		args = append(args, "--purge")
@@ -183,12 +472,111 @@ func (c *client) Delete(name string, purge bool) error {
 
 // Clone creates a copy of a VM
 func (c *client) Clone(source, dest string) error {
+	if err := c.requireFeature(FeatureClone); err != nil {
+		return err
+	}
 	_, err := c.exec.Execute("multipass", "clone", source, "-n", dest)
-	return err
+	return c.checkUnsupported(err)
+}
+
+// preCloneSnapshot holds a VM's current state while CloneFromSnapshot
+// clones it as of an older snapshot
+const preCloneSnapshot = "dabbi-pre-clone"
+
+// CloneFromSnapshot creates a copy of a stopped VM as it was at the given
+// snapshot. Multipass can only clone a VM's current state, so the VM's state
+// is snapshotted, the snapshot restored and cloned, and the saved state
+// restored and dropped again. If restoring the saved state fails, the VM is
+// left at the snapshot and its state kept in the dabbi-pre-clone snapshot.
+func (c *client) CloneFromSnapshot(source, snapshot, dest string) error {
+	if err := c.requireFeature(FeatureClone); err != nil {
+		return err
+	}
+	if err := c.CreateSnapshot(source, preCloneSnapshot); err != nil {
+		return fmt.Errorf("failed to save the current state of %s: %w", source, err)
+	}
+	if err := c.RestoreSnapshot(source, snapshot, true); err != nil {
+		_ = c.DeleteSnapshot(source, preCloneSnapshot)
+		return err
+	}
+
+	cloneErr := c.Clone(source, dest)
+	if err := c.RestoreSnapshot(source, preCloneSnapshot, true); err != nil {
+		return fmt.Errorf("%s was left at snapshot %s; its previous state is in snapshot %s: %w",
+			source, snapshot, preCloneSnapshot, err)
+	}
+	// A leftover snapshot would make the next clone from a snapshot fail
+	if err := c.DeleteSnapshot(source, preCloneSnapshot); err != nil {
+		return errors.Join(cloneErr, fmt.Errorf("failed to delete snapshot %s.%s: %w", source, preCloneSnapshot, err))
+	}
+	return cloneErr
+}
+
+// Resources returns a VM's CPUs and memory (bytes) as configured. Unlike
+// Info, it reports them for stopped VMs too.
+func (c *client) Resources(vmName string) (int, int64, error) {
+	out, err := c.exec.Execute("multipass", "get", fmt.Sprintf("local.%s.cpus", vmName))
+	if err != nil {
+		return 0, 0, err
+	}
+	value := strings.TrimSpace(string(out))
+	cpus, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected CPU count %q for VM %s", value, vmName)
+	}
+
+	out, err = c.exec.Execute("multipass", "get", fmt.Sprintf("local.%s.memory", vmName))
+	if err != nil {
+		return 0, 0, err
+	}
+	// Multipass prints binary units, e.g. "4.0GiB"
+	value = strings.TrimSpace(string(out))
+	memory, err := ParseSize(strings.TrimSuffix(strings.TrimSuffix(value, "B"), "i"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("unexpected memory size %q for VM %s", value, vmName)
+	}
+	return cpus, memory, nil
+}
+
+// SetResources changes a stopped VM's CPUs, memory, and disk. Zero or empty
+// values are left unchanged. Multipass can only grow disks, never shrink them.
+func (c *client) SetResources(vmName string, cpus int, memory, disk string) error {
+	var settings []string
+	if cpus > 0 {
+		settings = append(settings, fmt.Sprintf("local.%s.cpus=%d", vmName, cpus))
+	}
+	if memory != "" {
+		settings = append(settings, fmt.Sprintf("local.%s.memory=%s", vmName, memory))
+	}
+	if disk != "" {
+		settings = append(settings, fmt.Sprintf("local.%s.disk=%s", vmName, disk))
+	}
+
+	for _, setting := range settings {
+		if _, err := c.exec.Execute("multipass", "set", setting); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ListSnapshots returns all snapshots for a VM
 func (c *client) ListSnapshots(vmName string) (map[string]Snapshot, error) {
+	all, err := c.ListAllSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, ok := all[vmName]
+	if !ok {
+		return make(map[string]Snapshot), nil
+	}
+	return snapshots, nil
+}
+
+// ListAllSnapshots returns every VM's snapshots (vm_name -> snapshot_name ->
+// snapshot) from a single multipass call. VMs without snapshots are left out.
+func (c *client) ListAllSnapshots() (map[string]map[string]Snapshot, error) {
 	out, err := c.exec.Execute("multipass", "list", "--snapshots", "--format", "json")
 	if err != nil {
 		return nil, err
@@ -199,21 +587,23 @@ func (c *client) ListSnapshots(vmName string) (map[string]Snapshot, error) {
 		return nil, fmt.Errorf("failed to parse snapshots output: %w", err)
 	}
 
-	snapshots, ok := resp.Info[vmName]
-	if !ok {
-		return make(map[string]Snapshot), nil
+	if resp.Info == nil {
+		return make(map[string]map[string]Snapshot), nil
 	}
-	return snapshots, nil
+	return resp.Info, nil
 }
 
 // CreateSnapshot creates a new snapshot (VM must be stopped)
 func (c *client) CreateSnapshot(vmName, snapshotName string) error {
+	if err := c.requireFeature(FeatureSnapshots); err != nil {
+		return err
+	}
 	args := []string{"snapshot", vmName}
 	if snapshotName != "" {
 		args = append(args, "--name", snapshotName)
 	}
 	_, err := c.exec.Execute("multipass", args...)
-	return err
+	return c.checkUnsupported(err)
 }
 
 // RestoreSnapshot restores a VM to a previous snapshot
@@ -239,6 +629,16 @@ func (c *client) Transfer(src, dst string) error {
 	return err
 }
 
+// TransferRecursive copies a directory between host and VM, using the same
+// vm_name:path syntax as Transfer
+func (c *client) TransferRecursive(src, dst string) error {
+	if err := c.requireFeature(FeatureRecursiveTransfer); err != nil {
+		return err
+	}
+	_, err := c.exec.Execute("multipass", "transfer", "--recursive", src, dst)
+	return c.checkUnsupported(err)
+}
+
 // Exec runs a command in a VM and returns the output
 func (c *client) Exec(vmName string, cmd ...string) (string, error) {
 	args := append([]string{"exec", vmName, "--"}, cmd...)
@@ -249,16 +649,91 @@ func (c *client) Exec(vmName string, cmd ...string) (string, error) {
 	return string(out), nil
 }
 
+// ErrExecTimeout is returned by ExecWithTimeout when the command didn't
+// finish in time
+var ErrExecTimeout = errors.New("command in VM timed out")
+
+// ExecWithTimeout runs a command in a VM like Exec, but kills it and
+// returns ErrExecTimeout if it hasn't finished within timeout, e.g. because
+// the VM is wedged. An executor that can't cancel commands runs it without
+// a timeout.
+func (c *client) ExecWithTimeout(vmName string, timeout time.Duration, cmd ...string) (string, error) {
+	ce, ok := c.exec.(ContextExecutor)
+	if !ok || timeout <= 0 {
+		return c.Exec(vmName, cmd...)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	args := append([]string{"exec", vmName, "--"}, cmd...)
+	out, err := ce.ExecuteContext(ctx, "multipass", args...)
+	if errors.Is(err, errNoContext) {
+		return c.Exec(vmName, cmd...)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "", fmt.Errorf("%s in %s: %w after %v", strings.Join(cmd, " "), vmName, ErrExecTimeout, timeout)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
 // Mount mounts a host directory to a VM
-func (c *client) Mount(vmName, hostPath, vmPath string) error {
-	target := fmt.Sprintf("%s:%s", vmName, vmPath)
-	_, err := c.exec.Execute("multipass", "mount", hostPath, target)
+func (c *client) Mount(vmName string, opts MountOptions) error {
+	if err := ValidateMount(opts); err != nil {
+		return err
+	}
+
+	args := []string{"mount"}
+	if opts.Type != "" {
+		args = append(args, "--type", opts.Type)
+	}
+	for _, m := range opts.UIDMaps {
+		args = append(args, "--uid-map", m)
+	}
+	for _, m := range opts.GIDMaps {
+		args = append(args, "--gid-map", m)
+	}
+	args = append(args, opts.HostPath, fmt.Sprintf("%s:%s", vmName, opts.VMPath))
+
+	_, err := c.exec.Execute("multipass", args...)
 	return err
 }
 
+// idMapPattern matches a host:instance uid or gid pair
+var idMapPattern = regexp.MustCompile(`^\d+:\d+$`)
+
+// ValidateMount checks mount options before they are passed to multipass
+func ValidateMount(opts MountOptions) error {
+	if opts.HostPath == "" || opts.VMPath == "" {
+		return fmt.Errorf("mount needs a host path and a VM path")
+	}
+	if strings.HasPrefix(opts.HostPath, "-") || strings.HasPrefix(opts.VMPath, "-") {
+		return fmt.Errorf("invalid mount path")
+	}
+	for _, m := range append(append([]string{}, opts.UIDMaps...), opts.GIDMaps...) {
+		if !idMapPattern.MatchString(m) {
+			return fmt.Errorf("invalid id mapping %q: use <host-id>:<vm-id>, e.g. 501:1000", m)
+		}
+	}
+	switch opts.Type {
+	case "", MountTypeClassic, MountTypeNative:
+	default:
+		return fmt.Errorf("invalid mount type %q, must be %q or %q", opts.Type, MountTypeClassic, MountTypeNative)
+	}
+	return nil
+}
+
 // Unmount removes a mount from a VM
 func (c *client) Unmount(vmName, path string) error {
 	target := fmt.Sprintf("%s:%s", vmName, path)
 	_, err := c.exec.Execute("multipass", "umount", target)
 	return err
 }
+
+// Raw runs multipass with arbitrary arguments and returns its stdout.
+// It exists for subcommands the typed API doesn't cover; callers get no
+// parsing or validation, so prefer a typed method where one exists.
+func (c *client) Raw(args ...string) ([]byte, error) {
+	return c.exec.Execute("multipass", args...)
+}
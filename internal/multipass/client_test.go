@@ -1,8 +1,18 @@
 package multipass
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // MockExecutor for testing
@@ -179,10 +189,102 @@ func TestClient_LaunchWithCloudInit(t *testing.T) {
 	}
 }
 
+func TestClient_LaunchWithFileImage(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass launch --name test-vm --cpus 2 file:///images/custom.img", []byte(""))
+
+	client := NewClient(mock)
+	err := client.Launch(LaunchOptions{
+		Name:  "test-vm",
+		CPUs:  2,
+		Image: "file:///images/custom.img",
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClient_LaunchVerifiesImageChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "custom.img")
+	if err := os.WriteFile(path, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("image"))
+	image := "file://" + path
+
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass launch --name test-vm "+image, []byte(""))
+	client := NewClient(mock)
+
+	err := client.Launch(LaunchOptions{Name: "test-vm", Image: image, ImageChecksum: strings.Repeat("0", 64)})
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if len(mock.GetCalls()) != 0 {
+		t.Fatalf("multipass should not run for a mismatched image, got %v", mock.GetCalls())
+	}
+
+	err = client.Launch(LaunchOptions{Name: "test-vm", Image: image, ImageChecksum: hex.EncodeToString(sum[:])})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClient_LaunchWithNetworks(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass launch --name test-vm --network eth0 --network name=en0,mode=manual", []byte(""))
+
+	client := NewClient(mock)
+	err := client.Launch(LaunchOptions{
+		Name:     "test-vm",
+		Networks: []string{"eth0", "name=en0,mode=manual"},
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClient_ListNetworks(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass networks --format json", []byte(`{
+		"list": [
+			{"description": "Ethernet", "name": "eth0", "type": "ethernet"},
+			{"description": "Wi-Fi (en0)", "name": "en0", "type": "wifi"}
+		]
+	}`))
+
+	client := NewClient(mock)
+	networks, err := client.ListNetworks()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(networks) != 2 {
+		t.Fatalf("expected 2 networks, got %d", len(networks))
+	}
+	if networks[1].Name != "en0" || networks[1].Type != "wifi" {
+		t.Errorf("unexpected network: %+v", networks[1])
+	}
+}
+
+func TestValidateNetworks(t *testing.T) {
+	if err := ValidateNetworks([]string{"eth0", "name=en0,mode=manual"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, bad := range []string{"", "--cpus", "eth0 extra"} {
+		if err := ValidateNetworks([]string{bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
 func TestClient_StartStopRestart(t *testing.T) {
 	mock := NewMockExecutor()
 	mock.SetResponse("multipass start test-vm", []byte(""))
 	mock.SetResponse("multipass stop test-vm", []byte(""))
+	mock.SetResponse("multipass suspend test-vm", []byte(""))
 	mock.SetResponse("multipass restart test-vm", []byte(""))
 
 	client := NewClient(mock)
@@ -193,6 +295,9 @@ func TestClient_StartStopRestart(t *testing.T) {
 	if err := client.Stop("test-vm"); err != nil {
 		t.Errorf("Stop failed: %v", err)
 	}
+	if err := client.Suspend("test-vm"); err != nil {
+		t.Errorf("Suspend failed: %v", err)
+	}
 	if err := client.Restart("test-vm"); err != nil {
 		t.Errorf("Restart failed: %v", err)
 	}
@@ -225,6 +330,92 @@ func TestClient_Clone(t *testing.T) {
 	}
 }
 
+func TestClient_CloneFromSnapshot(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass snapshot source-vm --name dabbi-pre-clone", []byte(""))
+	mock.SetResponse("multipass restore source-vm.snap1 --destructive", []byte(""))
+	mock.SetResponse("multipass clone source-vm -n dest-vm", []byte(""))
+	mock.SetResponse("multipass restore source-vm.dabbi-pre-clone --destructive", []byte(""))
+	mock.SetResponse("multipass delete --purge source-vm.dabbi-pre-clone", []byte(""))
+
+	client := NewClient(mock)
+	if err := client.CloneFromSnapshot("source-vm", "snap1", "dest-vm"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The source's state is saved before and restored after the clone
+	want := []string{
+		"multipass snapshot source-vm --name dabbi-pre-clone",
+		"multipass restore source-vm.snap1 --destructive",
+		"multipass clone source-vm -n dest-vm",
+		"multipass restore source-vm.dabbi-pre-clone --destructive",
+		"multipass delete --purge source-vm.dabbi-pre-clone",
+	}
+	var got []string
+	for _, call := range mock.calls {
+		if call != "multipass version" {
+			got = append(got, call)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %v, want %v", got, want)
+	}
+}
+
+func TestClient_CloneFromSnapshot_CloneFails(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass snapshot source-vm --name dabbi-pre-clone", []byte(""))
+	mock.SetResponse("multipass restore source-vm.snap1 --destructive", []byte(""))
+	mock.SetError("multipass clone source-vm -n dest-vm", errors.New("clone failed"))
+	mock.SetResponse("multipass restore source-vm.dabbi-pre-clone --destructive", []byte(""))
+	mock.SetResponse("multipass delete --purge source-vm.dabbi-pre-clone", []byte(""))
+
+	client := NewClient(mock)
+	err := client.CloneFromSnapshot("source-vm", "snap1", "dest-vm")
+	if err == nil || !strings.Contains(err.Error(), "clone failed") {
+		t.Fatalf("expected the clone error, got %v", err)
+	}
+	// The source still gets its state back
+	if got := mock.calls[len(mock.calls)-2]; got != "multipass restore source-vm.dabbi-pre-clone --destructive" {
+		t.Errorf("expected the saved state to be restored, got %v", mock.calls)
+	}
+}
+
+func TestClient_SetResources(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass set local.test-vm.cpus=4", []byte(""))
+	mock.SetResponse("multipass set local.test-vm.disk=40G", []byte(""))
+
+	client := NewClient(mock)
+	if err := client.SetResources("test-vm", 4, "", "40G"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(mock.calls) != 2 {
+		t.Errorf("expected 2 set calls, got %d: %v", len(mock.calls), mock.calls)
+	}
+}
+
+func TestClient_Resources(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass get local.test-vm.cpus", []byte("4\n"))
+	mock.SetResponse("multipass get local.test-vm.memory", []byte("8.0GiB\n"))
+
+	client := NewClient(mock)
+	cpus, memory, err := client.Resources("test-vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cpus != 4 || memory != 8<<30 {
+		t.Errorf("expected 4 CPUs and 8GiB, got %d and %d", cpus, memory)
+	}
+
+	mock.SetResponse("multipass get local.test-vm.memory", []byte("lots\n"))
+	if _, _, err := client.Resources("test-vm"); err == nil {
+		t.Error("expected an error for an unparseable memory size")
+	}
+}
+
 func TestClient_ListSnapshots(t *testing.T) {
 	mock := NewMockExecutor()
 	mock.SetResponse("multipass list --snapshots --format json", []byte(`{
@@ -278,6 +469,54 @@ func TestClient_ListSnapshots_NoSnapshots(t *testing.T) {
 	}
 }
 
+func TestClient_ListAllSnapshots(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass list --snapshots --format json", []byte(`{
+		"errors": [],
+		"info": {
+			"web": {
+				"snap1": {"comment": "before upgrade", "parent": ""},
+				"snap2": {"comment": "", "parent": "snap1"}
+			},
+			"db": {
+				"nightly": {"comment": "cron", "parent": ""}
+			}
+		}
+	}`))
+
+	client := NewClient(mock)
+	all, err := client.ListAllSnapshots()
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("expected snapshots for 2 VMs, got %d", len(all))
+	}
+	if len(all["web"]) != 2 || all["web"]["snap2"].Parent != "snap1" {
+		t.Errorf("unexpected snapshots for web: %+v", all["web"])
+	}
+	if all["db"]["nightly"].Comment != "cron" {
+		t.Errorf("expected comment 'cron', got '%s'", all["db"]["nightly"].Comment)
+	}
+	if calls := mock.GetCalls(); len(calls) != 1 {
+		t.Errorf("expected one multipass call, got %v", calls)
+	}
+}
+
+func TestClient_ListAllSnapshots_NoInfo(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass list --snapshots --format json", []byte(`{"errors": []}`))
+
+	all, err := NewClient(mock).ListAllSnapshots()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if all == nil || len(all) != 0 {
+		t.Errorf("expected an empty map, got %v", all)
+	}
+}
+
 func TestClient_SnapshotOperations(t *testing.T) {
 	mock := NewMockExecutor()
 	mock.SetResponse("multipass snapshot test-vm --name snap1", []byte(""))
@@ -333,13 +572,50 @@ func TestClient_Mount(t *testing.T) {
 	mock.SetResponse("multipass mount /tmp/shared test-vm:/home/ubuntu/shared", []byte(""))
 
 	client := NewClient(mock)
-	err := client.Mount("test-vm", "/tmp/shared", "/home/ubuntu/shared")
+	err := client.Mount("test-vm", MountOptions{HostPath: "/tmp/shared", VMPath: "/home/ubuntu/shared"})
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClient_Mount_Options(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass mount --type native --uid-map 501:1000 --gid-map 20:1000 /tmp/shared test-vm:/home/ubuntu/shared", []byte(""))
+
+	client := NewClient(mock)
+	err := client.Mount("test-vm", MountOptions{
+		HostPath: "/tmp/shared",
+		VMPath:   "/home/ubuntu/shared",
+		UIDMaps:  []string{"501:1000"},
+		GIDMaps:  []string{"20:1000"},
+		Type:     MountTypeNative,
+	})
 
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
 
+func TestValidateMount(t *testing.T) {
+	valid := MountOptions{HostPath: "/src", VMPath: "/home/ubuntu/src", UIDMaps: []string{"501:1000"}, Type: MountTypeClassic}
+	if err := ValidateMount(valid); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for name, opts := range map[string]MountOptions{
+		"missing vm path": {HostPath: "/src"},
+		"flag as path":    {HostPath: "--help", VMPath: "/src"},
+		"default mapping": {HostPath: "/src", VMPath: "/src", UIDMaps: []string{"501:default"}},
+		"bad gid mapping": {HostPath: "/src", VMPath: "/src", GIDMaps: []string{"staff"}},
+		"unknown type":    {HostPath: "/src", VMPath: "/src", Type: "nfs"},
+	} {
+		if err := ValidateMount(opts); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
 func TestClient_Unmount(t *testing.T) {
 	mock := NewMockExecutor()
 	mock.SetResponse("multipass umount test-vm:/home/ubuntu/shared", []byte(""))
@@ -352,6 +628,21 @@ func TestClient_Unmount(t *testing.T) {
 	}
 }
 
+func TestClient_Raw(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass get local.driver", []byte("qemu\n"))
+
+	client := NewClient(mock)
+	out, err := client.Raw("get", "local.driver")
+
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != "qemu\n" {
+		t.Errorf("expected raw stdout, got %q", out)
+	}
+}
+
 func TestClient_Error(t *testing.T) {
 	mock := NewMockExecutor()
 	mock.SetError("multipass list --format json", &MultipassError{
@@ -372,3 +663,230 @@ func TestClient_Error(t *testing.T) {
 		t.Errorf("expected MultipassError, got %T", err)
 	}
 }
+
+// slowExecutor records how many commands run at once
+type slowExecutor struct {
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (e *slowExecutor) Execute(name string, args ...string) ([]byte, error) {
+	e.mu.Lock()
+	e.running++
+	if e.running > e.peak {
+		e.peak = e.running
+	}
+	e.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	e.mu.Lock()
+	e.running--
+	e.mu.Unlock()
+	return nil, nil
+}
+
+func TestClient_MaxConcurrent(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+	}{
+		{"limited", 3},
+		{"serialized", 1},
+		{"unlimited", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exec := &slowExecutor{}
+			client := NewClientWithOptions(exec, ClientOptions{MaxConcurrent: tt.limit})
+
+			var wg sync.WaitGroup
+			for i := 0; i < 12; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					client.Start("vm")
+				}()
+			}
+			wg.Wait()
+
+			if tt.limit > 0 && exec.peak > tt.limit {
+				t.Errorf("expected at most %d concurrent commands, got %d", tt.limit, exec.peak)
+			}
+			if tt.limit == 0 && exec.peak < 2 {
+				t.Errorf("expected unlimited client to run commands concurrently, got peak %d", exec.peak)
+			}
+			if exec.running != 0 {
+				t.Errorf("expected all commands to finish, %d still running", exec.running)
+			}
+		})
+	}
+}
+
+func TestRealExecutor_NotInstalled(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	var exec CommandExecutor = RealExecutor{}
+	_, err := exec.Execute("multipass", "version")
+	if !errors.Is(err, ErrMultipassNotInstalled) {
+		t.Fatalf("Execute() error = %v, want ErrMultipassNotInstalled", err)
+	}
+
+	// Client methods pass it through, so callers can still detect it
+	if _, err := NewClient(exec).List(); !errors.Is(err, ErrMultipassNotInstalled) {
+		t.Errorf("List() error = %v, want ErrMultipassNotInstalled", err)
+	}
+}
+
+func TestRealExecutor_CommandFailure(t *testing.T) {
+	_, err := RealExecutor{}.Execute("sh", "-c", "echo oops >&2; exit 1")
+
+	var mpErr *MultipassError
+	if !errors.As(err, &mpErr) {
+		t.Fatalf("Execute() error = %v, want *MultipassError", err)
+	}
+	if errors.Is(err, ErrMultipassNotInstalled) {
+		t.Error("a failing command should not be reported as multipass missing")
+	}
+	if mpErr.Stderr != "oops\n" {
+		t.Errorf("Stderr = %q, want %q", mpErr.Stderr, "oops\n")
+	}
+}
+
+// hangingExecutor is a ContextExecutor whose plain 'multipass stop' hangs
+// until its context ends, like a guest that won't shut down
+type hangingExecutor struct {
+	*MockExecutor
+}
+
+func (e hangingExecutor) ExecuteContext(ctx context.Context, name string, args ...string) ([]byte, error) {
+	e.calls = append(e.calls, "ctx: "+name+" "+strings.Join(args, " "))
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestClient_StopWithOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		force   bool
+		timeout time.Duration
+		wantErr error
+		want    []string
+	}{
+		{"force without timeout", true, 0, nil, []string{"multipass version", "multipass stop --force vm"}},
+		{"plain", false, 0, nil, []string{"multipass stop vm"}},
+		{"timeout then force", true, 20 * time.Millisecond, nil, []string{"ctx: multipass stop vm", "multipass version", "multipass stop --force vm"}},
+		{"timeout without force", false, 20 * time.Millisecond, ErrStopTimeout, []string{"ctx: multipass stop vm"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := NewMockExecutor()
+			mock.SetResponse("multipass stop vm", nil)
+			mock.SetResponse("multipass stop --force vm", nil)
+			mock.SetResponse("multipass version", []byte("multipass   1.13.1\nmultipassd  1.13.1\n"))
+			exec := hangingExecutor{mock}
+			client := NewClient(exec)
+
+			err := client.StopWithOptions("vm", tt.force, tt.timeout)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("StopWithOptions() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := strings.Join(mock.GetCalls(), "; "); got != strings.Join(tt.want, "; ") {
+				t.Errorf("calls = %q, want %q", got, strings.Join(tt.want, "; "))
+			}
+		})
+	}
+}
+
+func TestClient_StopWithOptions_NoContextExecutor(t *testing.T) {
+	// Without ExecuteContext there's no way to time out, so it's a plain stop
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass stop vm", nil)
+
+	if err := NewClient(mock).StopWithOptions("vm", true, time.Second); err != nil {
+		t.Fatalf("StopWithOptions() error = %v", err)
+	}
+	if calls := mock.GetCalls(); len(calls) != 1 || calls[0] != "multipass stop vm" {
+		t.Errorf("calls = %v, want a plain stop", calls)
+	}
+}
+
+func TestRealExecutor_ExecuteContextTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := RealExecutor{}.ExecuteContext(ctx, "sleep", "5")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("ExecuteContext() error = %v, want context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("command should have been killed at the deadline")
+	}
+}
+
+func TestClient_ExecWithTimeout(t *testing.T) {
+	mock := NewMockExecutor()
+	client := NewClient(hangingExecutor{mock})
+
+	_, err := client.ExecWithTimeout("vm", 20*time.Millisecond, "cat", "/etc/hostname")
+
+	if !errors.Is(err, ErrExecTimeout) {
+		t.Fatalf("ExecWithTimeout() error = %v, want ErrExecTimeout", err)
+	}
+	if calls := mock.GetCalls(); len(calls) != 1 || calls[0] != "ctx: multipass exec vm -- cat /etc/hostname" {
+		t.Errorf("calls = %v", calls)
+	}
+}
+
+func TestClient_ExecWithTimeout_NoContextExecutor(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass exec vm -- cat /etc/hostname", []byte("vm\n"))
+
+	out, err := NewClient(mock).ExecWithTimeout("vm", time.Second, "cat", "/etc/hostname")
+	if err != nil {
+		t.Fatalf("ExecWithTimeout() error = %v", err)
+	}
+	if out != "vm\n" {
+		t.Errorf("output = %q", out)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	err := exec.Command("sh", "-c", "exit 3").Run()
+	if got := ExitCode(&MultipassError{Command: "exec", Err: err}); got != 3 {
+		t.Errorf("ExitCode() = %d, want 3", got)
+	}
+	if got := ExitCode(ErrExecTimeout); got != -1 {
+		t.Errorf("ExitCode() = %d, want -1", got)
+	}
+}
+
+func TestClient_InfoContext(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass info vm --format json", []byte(`{"info": {"vm": {"state": "Running"}}}`))
+	client := NewClient(hangingExecutor{mock})
+
+	// A hung multipass is killed when the context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.InfoContext(ctx, "vm"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("InfoContext() error = %v, want context.DeadlineExceeded", err)
+	}
+
+	// A context that can't end runs the command to completion
+	info, err := client.Info("vm")
+	if err != nil {
+		t.Fatalf("Info() error = %v", err)
+	}
+	if info.State != StateRunning {
+		t.Errorf("State = %q, want %q", info.State, StateRunning)
+	}
+	want := "ctx: multipass info vm --format json; multipass info vm --format json"
+	if got := strings.Join(mock.GetCalls(), "; "); got != want {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+package multipass
+
+import "strings"
+
+// FailureReason is a recognized cause of a failed multipass command
+type FailureReason string
+
+const (
+	FailureUnknown            FailureReason = ""
+	FailureAlreadyExists      FailureReason = "already_exists"
+	FailureDiskFull           FailureReason = "disk_full"
+	FailureInsufficientMemory FailureReason = "insufficient_memory"
+	FailureImageNotFound      FailureReason = "image_not_found"
+	FailureImageDownload      FailureReason = "image_download"
+)
+
+// Failure is a classified multipass error with advice for the user
+type Failure struct {
+	Reason     FailureReason
+	Suggestion string
+}
+
+// failurePatterns maps lowercased stderr substrings to what they mean. The
+// first match wins, so more specific patterns come first.
+var failurePatterns = []struct {
+	substrings []string
+	failure    Failure
+}{
+	{
+		[]string{"already exists"},
+		Failure{FailureAlreadyExists, "Pick another name, or delete the existing VM first."},
+	},
+	{
+		[]string{"no space left on device", "not enough disk space", "insufficient disk space"},
+		Failure{FailureDiskFull, "The host is out of disk space. Free some up (delete unused VMs or snapshots) or ask for a smaller --disk."},
+	},
+	{
+		[]string{"cannot allocate memory", "not enough memory", "insufficient memory", "out of memory"},
+		Failure{FailureInsufficientMemory, "The host doesn't have enough free memory. Stop other VMs or ask for less --mem."},
+	},
+	{
+		[]string{"unable to find an image matching", "unknown image", "no image found"},
+		Failure{FailureImageNotFound, "Check the image name; 'multipass find' lists the available images."},
+	},
+	{
+		[]string{"failed to download", "download failed", "error downloading", "is unknown or unreachable", "network timeout", "could not resolve host"},
+		Failure{FailureImageDownload, "The image couldn't be downloaded. Check the host's internet connection and try again."},
+	},
+}
+
+// Classify matches the command's stderr against known failures. The reason
+// is FailureUnknown if nothing matched.
+func (e *MultipassError) Classify() Failure {
+	stderr := strings.ToLower(e.Stderr)
+	for _, p := range failurePatterns {
+		for _, s := range p.substrings {
+			if strings.Contains(stderr, s) {
+				return p.failure
+			}
+		}
+	}
+	return Failure{Reason: FailureUnknown}
+}
@@ -0,0 +1,35 @@
+package multipass
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMultipassError_Classify(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   FailureReason
+	}{
+		{`launch failed: instance "dev" already exists`, FailureAlreadyExists},
+		{"launch failed: qemu-img: error while writing at byte 0: No space left on device", FailureDiskFull},
+		{"launch failed: Insufficient disk space to create the instance", FailureDiskFull},
+		{"launch failed: qemu-system-x86_64: cannot set up guest memory 'pc.ram': Cannot allocate memory", FailureInsufficientMemory},
+		{"launch failed: Not enough memory available on the host", FailureInsufficientMemory},
+		{`launch failed: Unable to find an image matching "focal-xyz"`, FailureImageNotFound},
+		{"launch failed: failed to download from 'https://cloud-images.ubuntu.com/releases/24.04/': Network timeout", FailureImageDownload},
+		{`launch failed: Remote "" is unknown or unreachable.`, FailureImageDownload},
+		{"launch failed: The following errors occurred:\ntimed out waiting for response", FailureUnknown},
+		{"", FailureUnknown},
+	}
+
+	for _, tt := range tests {
+		err := &MultipassError{Command: "multipass launch", Stderr: tt.stderr, Err: errors.New("exit status 2")}
+		got := err.Classify()
+		if got.Reason != tt.want {
+			t.Errorf("Classify(%q) = %q, want %q", tt.stderr, got.Reason, tt.want)
+		}
+		if tt.want != FailureUnknown && got.Suggestion == "" {
+			t.Errorf("Classify(%q) has no suggestion", tt.stderr)
+		}
+	}
+}
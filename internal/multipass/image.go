@@ -0,0 +1,105 @@
+package multipass
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IsCustomImage reports whether image is a file:// or http(s):// image
+// rather than a multipass alias like "jammy" or "22.04"
+func IsCustomImage(image string) bool {
+	return strings.HasPrefix(image, "file://") ||
+		strings.HasPrefix(image, "http://") ||
+		strings.HasPrefix(image, "https://")
+}
+
+// ValidateImage checks an image reference before it is passed to multipass launch.
+// Custom images are passed through as-is; checksum (sha256 hex) is only supported
+// for file:// images since multipass downloads remote images itself.
+func ValidateImage(image, checksum string) error {
+	if image == "" {
+		if checksum != "" {
+			return fmt.Errorf("image checksum requires an image")
+		}
+		return nil
+	}
+
+	if !IsCustomImage(image) {
+		if strings.Contains(image, "://") {
+			return fmt.Errorf("unsupported image scheme: %q (use file://, http:// or https://)", image)
+		}
+		// Aliases are passed as a positional arg, so reject anything flag-like
+		if strings.HasPrefix(image, "-") || strings.ContainsAny(image, " \t\n") {
+			return fmt.Errorf("invalid image alias: %q", image)
+		}
+		if checksum != "" {
+			return fmt.Errorf("image checksum is only supported for file:// images")
+		}
+		return nil
+	}
+
+	u, err := url.Parse(image)
+	if err != nil {
+		return fmt.Errorf("invalid image URL: %w", err)
+	}
+
+	if u.Scheme != "file" {
+		if u.Host == "" {
+			return fmt.Errorf("invalid image URL: %q has no host", image)
+		}
+		if checksum != "" {
+			return fmt.Errorf("image checksum is only supported for file:// images")
+		}
+		return nil
+	}
+
+	if !filepath.IsAbs(u.Path) {
+		return fmt.Errorf("file image path must be absolute: %q", image)
+	}
+	fi, err := os.Stat(u.Path)
+	if err != nil {
+		return fmt.Errorf("image file not accessible: %w", err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("image is not a regular file: %s", u.Path)
+	}
+
+	if checksum != "" {
+		return verifyImageChecksum(u.Path, checksum)
+	}
+	return nil
+}
+
+// verifyImageChecksum compares a file's sha256 against the expected hex digest
+// (optionally prefixed with "sha256:")
+func verifyImageChecksum(path, checksum string) error {
+	expected := strings.ToLower(strings.TrimPrefix(checksum, "sha256:"))
+	if len(expected) != sha256.Size*2 {
+		return fmt.Errorf("invalid sha256 checksum: %q", checksum)
+	}
+	if _, err := hex.DecodeString(expected); err != nil {
+		return fmt.Errorf("invalid sha256 checksum: %q", checksum)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash image: %w", err)
+	}
+
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("image checksum mismatch: expected %s, got %s", expected, actual)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package multipass
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsCustomImage(t *testing.T) {
+	tests := []struct {
+		image  string
+		expect bool
+	}{
+		{"", false},
+		{"jammy", false},
+		{"22.04", false},
+		{"file:///images/custom.img", true},
+		{"http://example.com/custom.img", true},
+		{"https://example.com/custom.img", true},
+	}
+
+	for _, tt := range tests {
+		if got := IsCustomImage(tt.image); got != tt.expect {
+			t.Errorf("IsCustomImage(%q) = %v, want %v", tt.image, got, tt.expect)
+		}
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	dir := t.TempDir()
+	imgPath := filepath.Join(dir, "custom.img")
+	content := []byte("fake image contents")
+	if err := os.WriteFile(imgPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(content)
+	goodChecksum := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name     string
+		image    string
+		checksum string
+		wantErr  bool
+	}{
+		{"empty", "", "", false},
+		{"alias", "jammy", "", false},
+		{"version alias", "24.04", "", false},
+		{"flag-like alias", "--cpus", "", true},
+		{"alias with space", "jammy extra", "", true},
+		{"alias with checksum", "jammy", goodChecksum, true},
+		{"unsupported scheme", "ftp://example.com/x.img", "", true},
+		{"https url", "https://example.com/custom.img", "", false},
+		{"http url without host", "http:///custom.img", "", true},
+		{"https url with checksum", "https://example.com/custom.img", goodChecksum, true},
+		{"file url", "file://" + imgPath, "", false},
+		{"file url missing", "file://" + filepath.Join(dir, "missing.img"), "", true},
+		{"file url directory", "file://" + dir, "", true},
+		{"file url good checksum", "file://" + imgPath, goodChecksum, false},
+		{"file url prefixed checksum", "file://" + imgPath, "sha256:" + goodChecksum, false},
+		{"file url wrong checksum", "file://" + imgPath, hex.EncodeToString(make([]byte, 32)), true},
+		{"file url malformed checksum", "file://" + imgPath, "abc123", true},
+		{"checksum without image", "", goodChecksum, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateImage(tt.image, tt.checksum)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateImage(%q, %q) error = %v, wantErr %v", tt.image, tt.checksum, err, tt.wantErr)
+			}
+		})
+	}
+}
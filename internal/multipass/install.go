@@ -0,0 +1,70 @@
+package multipass
+
+import (
+	"strings"
+	"time"
+)
+
+// Files the default cloud-init's install script writes in the VM
+const (
+	InstallStatusPath   = "/home/ubuntu/.dabbi-install-status"
+	InstallCompletePath = "/home/ubuntu/.dabbi-install-complete"
+	InstallFailedPath   = "/home/ubuntu/.dabbi-install-failed"
+)
+
+// Install states. InstallUnknown means there's no status file: the script
+// hasn't started yet, or the VM was created with a cloud-init that doesn't
+// write one.
+const (
+	InstallRunning  = "running"
+	InstallComplete = "complete"
+	InstallFailed   = "failed"
+	InstallUnknown  = "unknown"
+)
+
+// installStatusCommand prints the status file. VMs created before it
+// existed only have the completion marker, which stands in for it.
+const installStatusCommand = `cat ` + InstallStatusPath + ` 2>/dev/null || { [ -e ` + InstallCompletePath + ` ] && echo status=` + InstallComplete + `; } || true`
+
+// InstallStatus is the progress of a VM's first-boot tool install
+type InstallStatus struct {
+	Status    string     `json:"status"`               // running, complete, failed, or unknown
+	UpdatedAt *time.Time `json:"updated_at,omitempty"` // when the script last wrote the status
+	Error     string     `json:"error,omitempty"`      // the command that failed, for failed
+}
+
+// ReadInstallStatus reads a VM's install status file in one exec call. The
+// VM must be able to run commands.
+func ReadInstallStatus(c Client, vmName string) (*InstallStatus, error) {
+	out, err := c.Exec(vmName, "sh", "-c", installStatusCommand)
+	if err != nil {
+		return nil, err
+	}
+	return ParseInstallStatus(out), nil
+}
+
+// ParseInstallStatus parses the key=value lines of an install status file
+// (status, updated, error). Empty or unrecognized content is unknown.
+func ParseInstallStatus(content string) *InstallStatus {
+	s := &InstallStatus{Status: InstallUnknown}
+	for _, line := range strings.Split(content, "\n") {
+		key, value, ok := strings.Cut(strings.TrimRight(line, "\r"), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "status":
+			switch value {
+			case InstallRunning, InstallComplete, InstallFailed:
+				s.Status = value
+			}
+		case "updated":
+			if t, err := time.Parse(time.RFC3339, value); err == nil {
+				s.UpdatedAt = &t
+			}
+		case "error":
+			s.Error = value
+		}
+	}
+	return s
+}
@@ -0,0 +1,43 @@
+package multipass
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInstallStatus(t *testing.T) {
+	updated := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		content   string
+		want      string
+		wantError string
+		wantTime  bool
+	}{
+		{"running", "status=running\nupdated=2026-10-16T12:00:00Z\nerror=\n", InstallRunning, "", true},
+		{"complete", "status=complete\nupdated=2026-10-16T12:00:00Z\nerror=\n", InstallComplete, "", true},
+		{"failed", "status=failed\nupdated=2026-10-16T12:00:00Z\nerror=line 27: apt-get install -y gh (exit 100)\n", InstallFailed, "line 27: apt-get install -y gh (exit 100)", true},
+		{"error with equals", "status=failed\nerror=line 3: FOO=bar cmd (exit 1)\n", InstallFailed, "line 3: FOO=bar cmd (exit 1)", false},
+		{"completion marker only", "status=complete\n", InstallComplete, "", false},
+		{"empty", "", InstallUnknown, "", false},
+		{"unrecognized status", "status=exploded\n", InstallUnknown, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseInstallStatus(tt.content)
+			if got.Status != tt.want {
+				t.Errorf("Status = %q, want %q", got.Status, tt.want)
+			}
+			if got.Error != tt.wantError {
+				t.Errorf("Error = %q, want %q", got.Error, tt.wantError)
+			}
+			if tt.wantTime && (got.UpdatedAt == nil || !got.UpdatedAt.Equal(updated)) {
+				t.Errorf("UpdatedAt = %v, want %v", got.UpdatedAt, updated)
+			}
+			if !tt.wantTime && got.UpdatedAt != nil {
+				t.Errorf("UpdatedAt = %v, want nil", got.UpdatedAt)
+			}
+		})
+	}
+}
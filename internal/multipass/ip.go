@@ -0,0 +1,67 @@
+package multipass
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeTimeout bounds each dial made while picking a VM address
+const probeTimeout = 500 * time.Millisecond
+
+// reachable remembers, per VM, the address PickReachableIP found answering
+// and the addresses it chose from, so multi-homed VMs aren't probed on
+// every request
+var reachable sync.Map // VM name -> reachableIP
+
+type reachableIP struct {
+	from string // the VM's addresses, joined
+	ip   string
+}
+
+// PickReachableIP chooses which of a VM's addresses to connect to on port.
+// VMs with extra interfaces (e.g. a bridged --network) report several IPs and
+// the first may not be reachable from the host. An address inside subnet wins;
+// otherwise each is dialed briefly and the first to answer is used, and
+// remembered for the VM until its addresses or state change or
+// ForgetReachableIP is called. If none answer (the service may not be up
+// yet) the first address is returned, and "" if the VM has none.
+func PickReachableIP(vmName string, info *InstanceInfo, port int, subnet *net.IPNet) string {
+	if len(info.IPv4) == 0 {
+		return ""
+	}
+	if len(info.IPv4) == 1 {
+		return info.IPv4[0]
+	}
+
+	if subnet != nil {
+		for _, ip := range info.IPv4 {
+			if parsed := net.ParseIP(ip); parsed != nil && subnet.Contains(parsed) {
+				return ip
+			}
+		}
+	}
+
+	from := strings.Join(info.IPv4, ",")
+	if cached, ok := reachable.Load(vmName); ok && cached.(reachableIP).from == from {
+		return cached.(reachableIP).ip
+	}
+	for _, ip := range info.IPv4 {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), probeTimeout)
+		if err == nil {
+			conn.Close()
+			reachable.Store(vmName, reachableIP{from: from, ip: ip})
+			return ip
+		}
+	}
+	return info.IPv4[0]
+}
+
+// ForgetReachableIP drops the address remembered for a VM, so the next
+// PickReachableIP probes again. Callers use it when connecting to the
+// address fails; the client does on lifecycle changes.
+func ForgetReachableIP(vmName string) {
+	reachable.Delete(vmName)
+}
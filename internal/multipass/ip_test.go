@@ -0,0 +1,85 @@
+package multipass
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPickReachableIP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	_, internal, _ := net.ParseCIDR("10.20.0.0/16")
+
+	tests := []struct {
+		name   string
+		ips    []string
+		subnet *net.IPNet
+		want   string
+	}{
+		{"no ips", nil, nil, ""},
+		{"single ip is not probed", []string{"192.0.2.1"}, nil, "192.0.2.1"},
+		{"second ip reachable", []string{"192.0.2.1", "127.0.0.1"}, nil, "127.0.0.1"},
+		{"preferred subnet wins", []string{"127.0.0.1", "10.20.3.4"}, internal, "10.20.3.4"},
+		{"subnet miss falls back to dialing", []string{"192.0.2.1", "127.0.0.1"}, internal, "127.0.0.1"},
+		{"none reachable uses first", []string{"192.0.2.1", "192.0.2.2"}, nil, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &InstanceInfo{State: StateRunning, IPv4: tt.ips}
+			if got := PickReachableIP(tt.name, info, port, tt.subnet); got != tt.want {
+				t.Errorf("PickReachableIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickReachableIP_Remembered(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	info := &InstanceInfo{State: StateRunning, IPv4: []string{"192.0.2.1", "127.0.0.1"}}
+	defer ForgetReachableIP("cached-vm")
+
+	if got := PickReachableIP("cached-vm", info, port, nil); got != "127.0.0.1" {
+		t.Fatalf("PickReachableIP() = %q, want 127.0.0.1", got)
+	}
+
+	// Once found, the address is used without probing again
+	ln.Close()
+	if got := PickReachableIP("cached-vm", info, port, nil); got != "127.0.0.1" {
+		t.Errorf("remembered address = %q, want 127.0.0.1", got)
+	}
+
+	// New addresses are probed afresh
+	moved := &InstanceInfo{State: StateRunning, IPv4: []string{"192.0.2.1", "127.0.0.2"}}
+	if got := PickReachableIP("cached-vm", moved, port, nil); got != "192.0.2.1" {
+		t.Errorf("after the addresses changed = %q, want 192.0.2.1", got)
+	}
+
+	// As are the addresses of a VM whose remembered one was forgotten
+	ForgetReachableIP("cached-vm")
+	if got := PickReachableIP("cached-vm", info, port, nil); got != "192.0.2.1" {
+		t.Errorf("after ForgetReachableIP = %q, want 192.0.2.1", got)
+	}
+}
+
+func TestClient_LifecycleForgetsReachableIP(t *testing.T) {
+	reachable.Store("test-vm", reachableIP{from: "192.0.2.1,127.0.0.1", ip: "127.0.0.1"})
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass stop test-vm", []byte(""))
+
+	if err := NewClient(mock).Stop("test-vm"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := reachable.Load("test-vm"); ok {
+		t.Error("stopping the VM should forget its address")
+	}
+}
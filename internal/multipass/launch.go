@@ -0,0 +1,92 @@
+package multipass
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// errNoEnv is returned when launch_env is set but the executor can't pass
+// environment variables to multipass
+var errNoEnv = errors.New("launch_env is set but the command executor can't set environment variables")
+
+// launchEnvName matches the variables launch_env may set
+var launchEnvName = regexp.MustCompile(`^MULTIPASS_[A-Z0-9_]+$`)
+
+// reservedLaunchFlags are set by dabbi from the VM's own options, so
+// launch_args can't repeat them
+var reservedLaunchFlags = map[string]bool{
+	"-n": true, "--name": true,
+	"-c": true, "--cpus": true,
+	"-m": true, "--memory": true,
+	"-d": true, "--disk": true,
+	"--cloud-init": true,
+	"--network":    true,
+}
+
+// launchValueFlags are multipass launch flags dabbi lets through that take
+// their value as the next argument. Values of other flags have to be given
+// as --flag=value, so a value can't be mistaken for the image.
+var launchValueFlags = map[string]bool{
+	"--timeout": true,
+	"--mount":   true,
+}
+
+// launchBoolFlags are short flags that take no value, so they can be grouped
+// with others (-vv)
+var launchBoolFlags = map[string]bool{
+	"-v": true,
+}
+
+// ValidateLaunchPassthrough checks the extra environment ("NAME=value") and
+// flags added to every launch. Only MULTIPASS_* variables are accepted, so
+// the setting can't be used to change PATH or similar for the subprocess,
+// and flags can't override the ones dabbi sets from the VM's options.
+func ValidateLaunchPassthrough(env, args []string) error {
+	for _, kv := range env {
+		name, _, ok := strings.Cut(kv, "=")
+		if !ok {
+			return fmt.Errorf("invalid launch_env entry %q: want NAME=value", kv)
+		}
+		if !launchEnvName.MatchString(name) {
+			return fmt.Errorf("invalid launch_env variable %q: only MULTIPASS_* variables can be set", name)
+		}
+	}
+
+	return validateLaunchArgs(args)
+}
+
+// validateLaunchArgs parses args the way multipass does, so a reserved flag
+// is found however it's written (--cpus=8, -c8, -vc 8) and nothing is left
+// over to be taken as the image
+func validateLaunchArgs(args []string) error {
+	valueNext := false
+	for _, arg := range args {
+		switch {
+		case valueNext:
+			valueNext = false
+		case strings.HasPrefix(arg, "--") && arg != "--":
+			flag, _, hasValue := strings.Cut(arg, "=")
+			if reservedLaunchFlags[flag] {
+				return fmt.Errorf("invalid launch_args: %s is set from the VM's options", flag)
+			}
+			valueNext = !hasValue && launchValueFlags[flag]
+		case strings.HasPrefix(arg, "-") && arg != "-" && arg != "--":
+			// Short flags can be grouped, and the first one that isn't a
+			// switch takes the rest of the argument as its value
+			for i := 1; i < len(arg); i++ {
+				flag := "-" + arg[i:i+1]
+				if reservedLaunchFlags[flag] {
+					return fmt.Errorf("invalid launch_args: %s is set from the VM's options", flag)
+				}
+				if !launchBoolFlags[flag] {
+					break
+				}
+			}
+		default:
+			return fmt.Errorf("invalid launch_args: %q isn't a flag (the image comes from the VM's options; give flag values as --flag=value)", arg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package multipass
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateLaunchPassthrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     []string
+		args    []string
+		wantErr string
+	}{
+		{"empty", nil, nil, ""},
+		{"valid", []string{"MULTIPASS_PROXY=http://u:p@proxy:3128", "MULTIPASS_X="}, []string{"--timeout", "600"}, ""},
+		{"flag_with_value", nil, []string{"--timeout=600"}, ""},
+		{"not_multipass", []string{"PATH=/tmp"}, nil, "only MULTIPASS_*"},
+		{"lowercase", []string{"multipass_proxy=x"}, nil, "only MULTIPASS_*"},
+		{"no_value", []string{"MULTIPASS_PROXY"}, nil, "NAME=value"},
+		{"positional_first", nil, []string{"jammy"}, "isn't a flag"},
+		{"reserved", nil, []string{"--timeout", "600", "--cpus", "8"}, "--cpus"},
+		{"reserved_with_value", nil, []string{"--cloud-init=/tmp/x.yaml"}, "--cloud-init"},
+		{"reserved_short", nil, []string{"-n", "other"}, "-n"},
+		{"reserved_fused", nil, []string{"-c8"}, "-c"},
+		{"reserved_grouped", nil, []string{"-vvm", "8G"}, "-m"},
+		{"grouped_switches", nil, []string{"-vv", "--timeout", "900"}, ""},
+		{"mount_value", nil, []string{"--mount", "/src:/dst"}, ""},
+		{"unknown_flag_with_value", nil, []string{"--future=1"}, ""},
+		{"positional_after_switch", nil, []string{"--bridged", "jammy"}, "isn't a flag"},
+		{"positional_after_value", nil, []string{"--timeout", "900", "jammy"}, "isn't a flag"},
+		{"end_of_flags", nil, []string{"--", "jammy"}, "isn't a flag"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateLaunchPassthrough(tt.env, tt.args)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// envMockExecutor records the environment of each command
+type envMockExecutor struct {
+	*MockExecutor
+	env [][]string
+}
+
+func (m *envMockExecutor) ExecuteEnv(env []string, name string, args ...string) ([]byte, error) {
+	m.env = append(m.env, env)
+	return m.Execute(name, args...)
+}
+
+func TestClient_LaunchPassthrough(t *testing.T) {
+	mock := &envMockExecutor{MockExecutor: NewMockExecutor()}
+	mock.SetResponse("multipass launch --name test-vm --cpus 2 --timeout 900 https://mirror.example.com/dev.img", []byte(""))
+
+	client := NewClientWithOptions(mock, ClientOptions{
+		MaxConcurrent: 1,
+		LaunchEnv:     []string{"MULTIPASS_PROXY=secret"},
+		LaunchArgs:    []string{"--timeout", "900"},
+	})
+	err := client.Launch(LaunchOptions{
+		Name:  "test-vm",
+		CPUs:  2,
+		Image: "https://mirror.example.com/dev.img",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mock.env) != 1 || len(mock.env[0]) != 1 || mock.env[0][0] != "MULTIPASS_PROXY=secret" {
+		t.Errorf("launch env = %v, want [[MULTIPASS_PROXY=secret]]", mock.env)
+	}
+
+	// Other commands run without it
+	mock.SetResponse("multipass start test-vm", []byte(""))
+	if err := client.Start("test-vm"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(mock.env) != 1 {
+		t.Errorf("expected only the launch to get launch_env, got %d", len(mock.env))
+	}
+}
+
+func TestClient_LaunchEnvNeedsEnvExecutor(t *testing.T) {
+	client := NewClientWithOptions(NewMockExecutor(), ClientOptions{LaunchEnv: []string{"MULTIPASS_PROXY=x"}})
+	if err := client.Launch(LaunchOptions{Name: "test-vm"}); err != errNoEnv {
+		t.Fatalf("Launch() error = %v, want errNoEnv", err)
+	}
+}
+
+func TestClient_LaunchArgsFailureNamesVersion(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass version", []byte("multipass   1.12.2\nmultipassd  1.12.2\n"))
+
+	client := NewClientWithOptions(mock, ClientOptions{LaunchArgs: []string{"--bridged"}})
+	err := client.Launch(LaunchOptions{Name: "test-vm"})
+	if err == nil || !strings.Contains(err.Error(), "multipass 1.12.2") {
+		t.Fatalf("Launch() error = %v, want it to name the installed version", err)
+	}
+}
+
+func TestRealExecutor_ExecuteEnv(t *testing.T) {
+	out, err := RealExecutor{}.ExecuteEnv([]string{"MULTIPASS_TEST=set"}, "sh", "-c", "echo $MULTIPASS_TEST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(out) != "set\n" {
+		t.Errorf("output = %q, want %q", out, "set\n")
+	}
+}
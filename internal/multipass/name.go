@@ -0,0 +1,49 @@
+package multipass
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// vmNamePattern matches instance names multipass accepts: a letter, then
+// letters, digits and hyphens, not ending in a hyphen
+var vmNamePattern = regexp.MustCompile(`^[a-zA-Z]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// portSuffixPattern matches a trailing "-<digits>"
+var portSuffixPattern = regexp.MustCompile(`-[0-9]+$`)
+
+// ValidateVMName checks the name for a new VM. Besides multipass' own rules,
+// names can't end in "-<digits>": the proxy routes <vm>-<port>.<domain> and
+// takes the last "-<digits>" as the port, so while a VM named "api-8080" is
+// still reached at api-8080-3000.localhost, api-8080.localhost goes to VM
+// "api", port 8080.
+func ValidateVMName(name string) error {
+	if err := ValidateInstanceName(name); err != nil {
+		return err
+	}
+	if HasPortSuffix(name) {
+		return fmt.Errorf("invalid VM name %q: names ending in -<number> clash with proxy addresses (%s.localhost would reach VM %q)",
+			name, name, portSuffixPattern.ReplaceAllString(name, ""))
+	}
+	return nil
+}
+
+// ValidateInstanceName checks a name against multipass' own rules only, for
+// existing VMs, which may predate ValidateVMName's. It keeps names safe to
+// use in file paths and shell commands.
+func ValidateInstanceName(name string) error {
+	if name == "" {
+		return fmt.Errorf("VM name is required")
+	}
+	if !vmNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid VM name %q: use letters, digits and hyphens, starting with a letter and not ending with a hyphen", name)
+	}
+	return nil
+}
+
+// HasPortSuffix reports whether a VM name ends in "-<digits>", which the
+// proxy would read as a port (see ValidateVMName). Existing VMs named so
+// still work but are confusing to address.
+func HasPortSuffix(name string) bool {
+	return portSuffixPattern.MatchString(name)
+}
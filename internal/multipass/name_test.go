@@ -0,0 +1,35 @@
+package multipass
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateVMName(t *testing.T) {
+	valid := []string{"a", "dev", "my-vm", "VM1", "web2", "api-v2", "db-8080x"}
+	for _, name := range valid {
+		assert.NoError(t, ValidateVMName(name), name)
+	}
+
+	invalid := []string{"", "1vm", "-vm", "vm-", "my_vm", "my vm", "vm.local", "--flag"}
+	for _, name := range invalid {
+		assert.Error(t, ValidateVMName(name), name)
+	}
+}
+
+func TestValidateVMName_PortSuffix(t *testing.T) {
+	for _, name := range []string{"api-8080", "web-1", "my-vm-2"} {
+		assert.True(t, HasPortSuffix(name), name)
+		assert.ErrorContains(t, ValidateVMName(name), "clash with proxy addresses", name)
+	}
+
+	assert.EqualError(t, ValidateVMName("api-8080"),
+		`invalid VM name "api-8080": names ending in -<number> clash with proxy addresses (api-8080.localhost would reach VM "api")`)
+	assert.False(t, HasPortSuffix("web2"))
+	assert.False(t, HasPortSuffix("api-v8080"))
+
+	// Existing VMs named so are still valid instance names
+	assert.NoError(t, ValidateInstanceName("api-8080"))
+	assert.Error(t, ValidateInstanceName("../api"))
+}
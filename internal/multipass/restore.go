@@ -0,0 +1,37 @@
+package multipass
+
+import (
+	"fmt"
+	"time"
+)
+
+// SafetySnapshotPrefix names the snapshots taken by RestoreWithSafetySnapshot
+const SafetySnapshotPrefix = "pre-restore-"
+
+// RestoreWithSafetySnapshot destructively restores a snapshot after first
+// saving the VM's current state as pre-restore-<timestamp>, so the restore
+// can be undone. Snapshots need a stopped VM, so a running or suspended VM
+// is stopped first and left stopped. The safety snapshot's name is returned
+// whenever it was created, even if the restore itself then fails.
+func RestoreWithSafetySnapshot(c Client, vmName, snapshotName string, now time.Time) (string, error) {
+	info, err := c.Info(vmName)
+	if err != nil {
+		return "", err
+	}
+
+	if info.State == StateRunning || info.State == StateSuspended {
+		if err := c.Stop(vmName); err != nil {
+			return "", fmt.Errorf("failed to stop VM before snapshot: %w", err)
+		}
+	}
+
+	safety := SafetySnapshotPrefix + now.UTC().Format("20060102-150405")
+	if err := c.CreateSnapshot(vmName, safety); err != nil {
+		return "", fmt.Errorf("failed to create safety snapshot: %w", err)
+	}
+
+	if err := c.RestoreSnapshot(vmName, snapshotName, true); err != nil {
+		return safety, fmt.Errorf("restore failed (current state saved as snapshot %q): %w", safety, err)
+	}
+	return safety, nil
+}
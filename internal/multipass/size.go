@@ -0,0 +1,57 @@
+package multipass
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sizePattern matches the size syntax multipass accepts for --memory/--disk:
+// a number with an optional K, M, or G suffix (binary units)
+var sizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)([KMGkmg])?$`)
+
+// ParseSize converts a multipass size string such as "4G" or "512M" to bytes.
+// A bare number is taken as bytes. Suffixes like "GB" or "GiB" are rejected
+// so typos are caught before multipass sees them.
+func ParseSize(s string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid size %q: use a number with an optional K, M, or G suffix (e.g., 4G)", s)
+	}
+
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+
+	multiplier := float64(1)
+	switch strings.ToUpper(m[2]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+
+	bytes := int64(value * multiplier)
+	if bytes <= 0 {
+		return 0, fmt.Errorf("invalid size %q: must be greater than zero", s)
+	}
+	return bytes, nil
+}
+
+// FormatBytes renders a byte count using binary units, e.g. "4.0 GiB"
+func FormatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit && exp < 5; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,69 @@
+package multipass
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"4G", 4 << 30, false},
+		{"20G", 20 << 30, false},
+		{"512M", 512 << 20, false},
+		{"1024K", 1 << 20, false},
+		{"1.5G", 3 << 29, false},
+		{"4g", 4 << 30, false},
+		{"1048576", 1 << 20, false},
+		{" 2G ", 2 << 30, false},
+		{"", 0, true},
+		{"4GB", 0, true},
+		{"4GiB", 0, true},
+		{"4T", 0, true},
+		{"G", 0, true},
+		{"-4G", 0, true},
+		{"0", 0, true},
+		{"0G", 0, true},
+		{"four", 0, true},
+		{"4 G", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSize(tt.input)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSize(%q) = %d, expected error", tt.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSize(%q) unexpected error: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		input int64
+		want  string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{512 << 20, "512.0 MiB"},
+		{4 << 30, "4.0 GiB"},
+		{20775645184, "19.3 GiB"},
+		{3 << 40, "3.0 TiB"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatBytes(tt.input); got != tt.want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package multipass
+
+// CanExec reports whether commands can run in a VM in the given state
+// (shell, file, mount, and network operations all go through exec)
+func CanExec(state string) bool {
+	return state == StateRunning
+}
+
+// CanProxy reports whether HTTP requests can be served for a VM in the given
+// state, either directly or by waking it first
+func CanProxy(state string) bool {
+	switch state {
+	case StateRunning, StateStopped, StateSuspended:
+		return true
+	}
+	return false
+}
+
+// IsTransient reports whether the state will settle on its own, so the
+// caller should retry shortly rather than act
+func IsTransient(state string) bool {
+	switch state {
+	case StateStarting, StateRestarting, StateSuspending, StateDelayedShutdown:
+		return true
+	}
+	return false
+}
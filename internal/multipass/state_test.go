@@ -0,0 +1,35 @@
+package multipass
+
+import "testing"
+
+func TestStateClassification(t *testing.T) {
+	tests := []struct {
+		state     string
+		canExec   bool
+		canProxy  bool
+		transient bool
+	}{
+		{StateRunning, true, true, false},
+		{StateStopped, false, true, false},
+		{StateSuspended, false, true, false},
+		{StateDeleted, false, false, false},
+		{StateStarting, false, false, true},
+		{StateRestarting, false, false, true},
+		{StateSuspending, false, false, true},
+		{StateDelayedShutdown, false, false, true},
+		{StateUnknown, false, false, false},
+		{"", false, false, false},
+	}
+
+	for _, tt := range tests {
+		if got := CanExec(tt.state); got != tt.canExec {
+			t.Errorf("CanExec(%q) = %v, want %v", tt.state, got, tt.canExec)
+		}
+		if got := CanProxy(tt.state); got != tt.canProxy {
+			t.Errorf("CanProxy(%q) = %v, want %v", tt.state, got, tt.canProxy)
+		}
+		if got := IsTransient(tt.state); got != tt.transient {
+			t.Errorf("IsTransient(%q) = %v, want %v", tt.state, got, tt.transient)
+		}
+	}
+}
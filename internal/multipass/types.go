@@ -1,5 +1,10 @@
 package multipass
 
+import (
+	"strconv"
+	"strings"
+)
+
 // ListResponse represents the JSON output of `multipass list --format json`
 type ListResponse struct {
 	List []ListInstance `json:"list"`
@@ -40,6 +45,42 @@ type Disk struct {
 	Used  string `json:"used"`
 }
 
+// CPUs returns CPUCount as a number, or 0 if unknown (e.g., VM stopped)
+func (i *InstanceInfo) CPUs() int {
+	return atoiOrZero(i.CPUCount)
+}
+
+// Snapshots returns SnapshotCount as a number, or 0 if unknown
+func (i *InstanceInfo) Snapshots() int {
+	return atoiOrZero(i.SnapshotCount)
+}
+
+// UsedBytes returns the used disk space in bytes, or 0 if unknown
+func (d Disk) UsedBytes() int64 {
+	return parseInt64OrZero(d.Used)
+}
+
+// TotalBytes returns the disk size in bytes, or 0 if unknown
+func (d Disk) TotalBytes() int64 {
+	return parseInt64OrZero(d.Total)
+}
+
+func atoiOrZero(s string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func parseInt64OrZero(s string) int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
 // Memory represents memory usage information
 type Memory struct {
 	Total int64 `json:"total"` // bytes
@@ -48,7 +89,24 @@ type Memory struct {
 
 // Mount represents a mount point
 type Mount struct {
-	SourcePath string `json:"source_path"`
+	SourcePath  string   `json:"source_path"`
+	UIDMappings []string `json:"uid_mappings,omitempty"` // host:instance, instance "default" for the default user
+	GIDMappings []string `json:"gid_mappings,omitempty"`
+}
+
+// Mount types (multipass mount --type)
+const (
+	MountTypeClassic = "classic" // SSHFS, works everywhere (multipass default)
+	MountTypeNative  = "native"  // hypervisor file sharing, faster but the VM must be stopped to add it
+)
+
+// MountOptions configures a mount
+type MountOptions struct {
+	HostPath string
+	VMPath   string
+	UIDMaps  []string // host:instance uid pairs, e.g. "501:1000" (empty = multipass default)
+	GIDMaps  []string // host:instance gid pairs
+	Type     string   // MountTypeClassic or MountTypeNative (empty = multipass default)
 }
 
 // SnapshotsResponse represents the JSON output of `multipass list --snapshots --format json`
@@ -63,6 +121,19 @@ type Snapshot struct {
 	Parent  string `json:"parent"` // parent snapshot name, empty if base
 }
 
+// NetworksResponse represents the JSON output of `multipass networks --format json`
+type NetworksResponse struct {
+	List []NetworkInterface `json:"list"`
+}
+
+// NetworkInterface is a host network interface a VM NIC can be bridged onto.
+// Not to be confused with NetworkConfig, which holds in-VM iptables restrictions.
+type NetworkInterface struct {
+	Name        string `json:"name"`        // e.g., "eth0", "en0"
+	Type        string `json:"type"`        // e.g., "ethernet", "wifi", "bridge"
+	Description string `json:"description"` // e.g., "Wi-Fi (en0)"
+}
+
 // LaunchOptions holds options for creating a new VM
 type LaunchOptions struct {
 	Name          string
@@ -70,7 +141,9 @@ type LaunchOptions struct {
 	Memory        string         // e.g., "4G"
 	Disk          string         // e.g., "20G"
 	CloudInit     string         // path to cloud-init file
-	Image         string         // e.g., "22.04" or "jammy"
+	Image         string         // e.g., "22.04", "jammy", "file:///path.img" or "https://..."
+	ImageChecksum string         // optional sha256 of a file:// image, verified before launch
+	Networks      []string       // host interfaces to bridge extra NICs onto (multipass --network)
 	NetworkConfig *NetworkConfig // network restrictions (nil = no restrictions)
 }
 
@@ -84,6 +157,14 @@ const (
 	NetworkModeIsolated  NetworkMode = "isolated"  // No network access at all
 )
 
+// NetworkScope defines where a VM's network rules are enforced
+type NetworkScope string
+
+const (
+	NetworkScopeVM   NetworkScope = "vm"   // iptables inside the VM (default)
+	NetworkScopeHost NetworkScope = "host" // host iptables on the VM's bridged traffic; Linux hosts only
+)
+
 // NetworkRule represents a single network rule (host to allow/block)
 type NetworkRule struct {
 	Type    string `json:"type"`              // "ip", "cidr", "domain"
@@ -93,8 +174,15 @@ type NetworkRule struct {
 
 // NetworkConfig holds network restriction configuration for a VM
 type NetworkConfig struct {
-	Mode  NetworkMode   `json:"mode"`
-	Rules []NetworkRule `json:"rules,omitempty"`
+	Mode       NetworkMode   `json:"mode"`
+	Rules      []NetworkRule `json:"rules,omitempty"`
+	DNSServers []string      `json:"dns_servers,omitempty"` // resolvers allowed in allowlist mode (default: the VM's own)
+	Scope      NetworkScope  `json:"scope,omitempty"`       // where the rules are enforced (default: vm)
+}
+
+// HostScoped reports whether the rules are enforced on the host
+func (c *NetworkConfig) HostScoped() bool {
+	return c != nil && c.Scope == NetworkScopeHost
 }
 
 // VM States
@@ -104,3 +192,12 @@ const (
 	StateSuspended = "Suspended"
 	StateDeleted   = "Deleted"
 )
+
+// Transitional and error states multipass reports while a VM changes state
+const (
+	StateStarting        = "Starting"
+	StateRestarting      = "Restarting"
+	StateSuspending      = "Suspending"
+	StateDelayedShutdown = "Delayed Shutdown"
+	StateUnknown         = "Unknown"
+)
@@ -0,0 +1,41 @@
+package multipass
+
+import "testing"
+
+func TestInstanceInfo_NumericFields(t *testing.T) {
+	info := &InstanceInfo{
+		CPUCount:      "4",
+		SnapshotCount: "2",
+		Disks: map[string]Disk{
+			"sda1": {Total: "20775645184", Used: "2354360320"},
+		},
+	}
+
+	if got := info.CPUs(); got != 4 {
+		t.Errorf("CPUs() = %d, want 4", got)
+	}
+	if got := info.Snapshots(); got != 2 {
+		t.Errorf("Snapshots() = %d, want 2", got)
+	}
+	if got := info.Disks["sda1"].TotalBytes(); got != 20775645184 {
+		t.Errorf("TotalBytes() = %d, want 20775645184", got)
+	}
+	if got := info.Disks["sda1"].UsedBytes(); got != 2354360320 {
+		t.Errorf("UsedBytes() = %d, want 2354360320", got)
+	}
+}
+
+func TestInstanceInfo_NumericFieldsUnknown(t *testing.T) {
+	// Stopped VMs report empty strings for most fields
+	info := &InstanceInfo{CPUCount: "", SnapshotCount: "n/a"}
+
+	if got := info.CPUs(); got != 0 {
+		t.Errorf("CPUs() = %d, want 0", got)
+	}
+	if got := info.Snapshots(); got != 0 {
+		t.Errorf("Snapshots() = %d, want 0", got)
+	}
+	if got := (Disk{}).TotalBytes(); got != 0 {
+		t.Errorf("TotalBytes() = %d, want 0", got)
+	}
+}
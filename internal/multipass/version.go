@@ -0,0 +1,183 @@
+package multipass
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a multipass release version
+type Version struct {
+	Major int
+	Minor int
+	Patch int
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// AtLeast reports whether v is the same release as min or newer
+func (v Version) AtLeast(min Version) bool {
+	if v.Major != min.Major {
+		return v.Major > min.Major
+	}
+	if v.Minor != min.Minor {
+		return v.Minor > min.Minor
+	}
+	return v.Patch >= min.Patch
+}
+
+// ParseVersion parses a version such as "1.14.1", ignoring pre-release and
+// build suffixes ("1.15.0-dev.2929+gc67ef66.mac", "1.13.1+mac")
+func ParseVersion(s string) (Version, error) {
+	core := s
+	if i := strings.IndexAny(core, "-+"); i >= 0 {
+		core = core[:i]
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+
+	var nums [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return Version{}, fmt.Errorf("invalid version %q", s)
+		}
+		nums[i] = n
+	}
+	return Version{Major: nums[0], Minor: nums[1], Patch: nums[2]}, nil
+}
+
+// parseVersionOutput reads the output of `multipass version`, which has a
+// line for the client and, when it is reachable, one for the daemon:
+//
+//	multipass   1.14.1+mac
+//	multipassd  1.14.1+mac
+//
+// The daemon does the work, so its version wins; the client's is used when
+// the daemon didn't answer. Update notices after the version lines are ignored.
+func parseVersionOutput(out string) (Version, error) {
+	var client, daemon string
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		switch fields[0] {
+		case "multipass":
+			client = fields[1]
+		case "multipassd":
+			daemon = fields[1]
+		}
+	}
+
+	switch {
+	case daemon != "":
+		return ParseVersion(daemon)
+	case client != "":
+		return ParseVersion(client)
+	default:
+		return Version{}, fmt.Errorf("no version found in multipass output: %q", strings.TrimSpace(out))
+	}
+}
+
+// Feature is a multipass capability that only some releases have
+type Feature string
+
+const (
+	FeatureRecursiveTransfer Feature = "transfer --recursive"
+	FeatureSnapshots         Feature = "snapshots"
+	FeatureClone             Feature = "clone"
+	FeatureForceStop         Feature = "stop --force"
+)
+
+// featureVersions is the first multipass release with each feature
+var featureVersions = map[Feature]Version{
+	FeatureRecursiveTransfer: {Major: 1, Minor: 11},
+	FeatureSnapshots:         {Major: 1, Minor: 13},
+	FeatureClone:             {Major: 1, Minor: 15},
+	FeatureForceStop:         {Major: 1, Minor: 11},
+}
+
+// Version returns the installed multipass version. It is cached after the
+// first successful call.
+func (c *client) Version() (Version, error) {
+	c.versionMu.Lock()
+	defer c.versionMu.Unlock()
+	if c.version != nil {
+		return *c.version, nil
+	}
+
+	out, err := c.exec.Execute("multipass", "version")
+	if err != nil {
+		return Version{}, err
+	}
+	v, err := parseVersionOutput(string(out))
+	if err != nil {
+		return Version{}, err
+	}
+	c.version = &v
+	return v, nil
+}
+
+// Supports reports whether the installed multipass has a feature. If the
+// version can't be determined it answers yes and leaves multipass to fail.
+func (c *client) Supports(f Feature) bool {
+	return c.requireFeature(f) == nil
+}
+
+// requireFeature returns an error naming the release needed if the installed
+// multipass is too old for f. A cached version that's too old is checked
+// again first, in case multipass was upgraded since it was detected.
+func (c *client) requireFeature(f Feature) error {
+	min, ok := featureVersions[f]
+	if !ok {
+		return fmt.Errorf("unknown multipass feature %q", f)
+	}
+	v, err := c.Version()
+	if err != nil || v.AtLeast(min) {
+		return nil
+	}
+	c.forgetVersion()
+	v, err = c.Version()
+	if err != nil || v.AtLeast(min) {
+		return nil
+	}
+	return fmt.Errorf("%s requires multipass %s or newer (installed: %s)", f, min, v)
+}
+
+// forgetVersion drops the cached version so the next Version call detects it
+// again
+func (c *client) forgetVersion() {
+	c.versionMu.Lock()
+	c.version = nil
+	c.versionMu.Unlock()
+}
+
+// unsupportedPatterns are lowercased stderr substrings multipass prints for
+// a command or flag it doesn't have
+var unsupportedPatterns = []string{"unknown option", "unknown command", "unrecognized option"}
+
+// checkUnsupported drops the cached version if multipass rejected a command
+// or flag of a gated feature, which means the installed release changed
+// since the version was detected. It returns err unchanged.
+func (c *client) checkUnsupported(err error) error {
+	var mpErr *MultipassError
+	if !errors.As(err, &mpErr) {
+		return err
+	}
+	stderr := strings.ToLower(mpErr.Stderr)
+	for _, s := range unsupportedPatterns {
+		if strings.Contains(stderr, s) {
+			c.forgetVersion()
+			break
+		}
+	}
+	return err
+}
@@ -0,0 +1,246 @@
+package multipass
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseVersionOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want Version
+	}{
+		{
+			name: "linux snap",
+			out:  "multipass   1.14.1\nmultipassd  1.14.1\n",
+			want: Version{1, 14, 1},
+		},
+		{
+			name: "macos",
+			out:  "multipass   1.13.1+mac\nmultipassd  1.13.1+mac\n",
+			want: Version{1, 13, 1},
+		},
+		{
+			name: "windows",
+			out:  "multipass   1.14.0+win\r\nmultipassd  1.14.0+win\r\n",
+			want: Version{1, 14, 0},
+		},
+		{
+			name: "daemon wins over client",
+			out:  "multipass   1.15.0-dev.2929.pr661+gc67ef6641.mac\nmultipassd  1.14.1+mac\n",
+			want: Version{1, 14, 1},
+		},
+		{
+			name: "daemon not reachable",
+			out:  "multipass   1.12.2\n",
+			want: Version{1, 12, 2},
+		},
+		{
+			name: "update notice",
+			out: `multipass   1.12.2+mac
+multipassd  1.12.2+mac
+
+##################################################
+Multipass 1.13.0 release
+Multipass 1.13.0 brings snapshots and instance cloning
+
+Go here for more information: https://github.com/canonical/multipass/releases/tag/v1.13.0
+##################################################
+`,
+			want: Version{1, 12, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVersionOutput(tt.out)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseVersionOutput_Invalid(t *testing.T) {
+	for _, out := range []string{"", "command not found\n", "multipass   unknown\n", "multipass   1\n"} {
+		if _, err := parseVersionOutput(out); err == nil {
+			t.Errorf("expected error for %q", out)
+		}
+	}
+}
+
+func TestVersion_AtLeast(t *testing.T) {
+	v := Version{1, 13, 1}
+	cases := map[Version]bool{
+		{1, 13, 1}: true,
+		{1, 13, 0}: true,
+		{1, 11, 5}: true,
+		{0, 99, 0}: true,
+		{1, 13, 2}: false,
+		{1, 15, 0}: false,
+		{2, 0, 0}:  false,
+	}
+	for min, want := range cases {
+		if got := v.AtLeast(min); got != want {
+			t.Errorf("%s.AtLeast(%s) = %v, want %v", v, min, got, want)
+		}
+	}
+}
+
+func TestClient_Version_Cached(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass version", []byte("multipass   1.14.1\nmultipassd  1.14.1\n"))
+
+	client := NewClient(mock)
+	for i := 0; i < 3; i++ {
+		v, err := client.Version()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v != (Version{1, 14, 1}) {
+			t.Errorf("expected 1.14.1, got %s", v)
+		}
+	}
+	if len(mock.calls) != 1 {
+		t.Errorf("expected 1 version call, got %d: %v", len(mock.calls), mock.calls)
+	}
+}
+
+func TestClient_Version_ErrorNotCached(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetError("multipass version", errors.New("multipass not found"))
+
+	client := NewClient(mock)
+	if _, err := client.Version(); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Once multipass is available, the version is picked up
+	delete(mock.errors, "multipass version")
+	mock.SetResponse("multipass version", []byte("multipass   1.14.1\n"))
+	if v, err := client.Version(); err != nil || v != (Version{1, 14, 1}) {
+		t.Errorf("expected 1.14.1, got %s (err %v)", v, err)
+	}
+}
+
+func TestClient_Supports(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass version", []byte("multipass   1.13.1\nmultipassd  1.13.1\n"))
+
+	client := NewClient(mock)
+	if !client.Supports(FeatureSnapshots) {
+		t.Error("expected 1.13.1 to support snapshots")
+	}
+	if !client.Supports(FeatureRecursiveTransfer) {
+		t.Error("expected 1.13.1 to support recursive transfer")
+	}
+	if client.Supports(FeatureClone) {
+		t.Error("expected 1.13.1 not to support clone")
+	}
+	if client.Supports(Feature("teleport")) {
+		t.Error("expected unknown features to be unsupported")
+	}
+}
+
+func TestClient_Supports_UnknownVersion(t *testing.T) {
+	// When the version can't be read, let multipass decide
+	client := NewClient(NewMockExecutor())
+	if !client.Supports(FeatureClone) {
+		t.Error("expected features to be assumed supported when the version is unknown")
+	}
+}
+
+func TestClient_Clone_TooOld(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass version", []byte("multipass   1.14.1\nmultipassd  1.14.1\n"))
+
+	client := NewClient(mock)
+	err := client.Clone("source-vm", "dest-vm")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "requires multipass 1.15.0 or newer (installed: 1.14.1)") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, call := range mock.calls {
+		if strings.HasPrefix(call, "multipass clone") {
+			t.Errorf("clone should not have run: %v", mock.calls)
+		}
+	}
+}
+
+func TestClient_Supports_RedetectsAfterUpgrade(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass version", []byte("multipass   1.14.1\nmultipassd  1.14.1\n"))
+
+	client := NewClient(mock)
+	if client.Supports(FeatureClone) {
+		t.Fatal("expected 1.14.1 not to support clone")
+	}
+
+	// A cached version that's too old is checked again
+	mock.SetResponse("multipass version", []byte("multipass   1.15.0\nmultipassd  1.15.0\n"))
+	if !client.Supports(FeatureClone) {
+		t.Error("expected the upgrade to 1.15.0 to be detected")
+	}
+}
+
+func TestClient_TransferRecursive(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass version", []byte("multipass   1.13.1\nmultipassd  1.13.1\n"))
+	mock.SetResponse("multipass transfer --recursive ./dir vm:/home/ubuntu/", []byte(""))
+
+	client := NewClient(mock)
+	if err := client.TransferRecursive("./dir", "vm:/home/ubuntu/"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mock.SetResponse("multipass version", []byte("multipass   1.10.0\nmultipassd  1.10.0\n"))
+	client = NewClient(mock)
+	err := client.TransferRecursive("./dir", "vm:/home/ubuntu/")
+	if err == nil || !strings.Contains(err.Error(), "requires multipass 1.11.0 or newer") {
+		t.Errorf("expected a version error, got %v", err)
+	}
+}
+
+func TestClient_UnknownOptionRedetectsVersion(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass version", []byte("multipass   1.13.1\nmultipassd  1.13.1\n"))
+	mock.SetError("multipass transfer --recursive ./dir vm:/tmp", &MultipassError{
+		Command: "transfer",
+		Stderr:  "Unknown option 'recursive'.\n",
+		Err:     errors.New("exit status 1"),
+	})
+
+	client := NewClient(mock)
+	if err := client.TransferRecursive("./dir", "vm:/tmp"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	// Multipass was replaced by an older release: the next check asks again
+	mock.SetResponse("multipass version", []byte("multipass   1.10.0\nmultipassd  1.10.0\n"))
+	if client.Supports(FeatureRecursiveTransfer) {
+		t.Error("expected the version to be detected again after an unknown option")
+	}
+}
+
+func TestClient_ForceStop_TooOld(t *testing.T) {
+	mock := NewMockExecutor()
+	mock.SetResponse("multipass version", []byte("multipass   1.10.1\nmultipassd  1.10.1\n"))
+
+	client := NewClient(mock)
+	err := client.StopWithOptions("vm", true, 0)
+	if err == nil || !strings.Contains(err.Error(), "stop --force requires multipass 1.11.0 or newer") {
+		t.Fatalf("expected a version error, got %v", err)
+	}
+	for _, call := range mock.calls {
+		if strings.HasPrefix(call, "multipass stop") {
+			t.Errorf("stop should not have run: %v", mock.calls)
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package network
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/mjshashank/dabbi/internal/multipass"
 )
@@ -18,17 +24,79 @@ const (
 	vmServiceFile   = "/etc/systemd/system/dabbi-network.service"
 )
 
+// vmPausedFile marks a VM whose rules are paused. It's in /run, so a
+// reboot, which reapplies the rules, also clears it.
+const vmPausedFile = "/run/dabbi-network-paused"
+
+// pauseScript lifts all restrictions without touching the saved config:
+// what the rules script sets up is flushed and the policies reset to accept
+const pauseScript = `iptables -P OUTPUT ACCEPT
+iptables -P INPUT ACCEPT
+iptables -F OUTPUT
+iptables -F INPUT
+iptables -F DABBI_OUT 2>/dev/null || true
+ip6tables -P OUTPUT ACCEPT 2>/dev/null || true
+ip6tables -P INPUT ACCEPT 2>/dev/null || true
+ip6tables -F OUTPUT 2>/dev/null || true
+ip6tables -F INPUT 2>/dev/null || true
+ip6tables -F DABBI_OUT 2>/dev/null || true
+touch ` + vmPausedFile
+
+// configReadTimeout bounds each command reading a VM's config, so a wedged
+// VM can't hang callers like 'network get'
+const configReadTimeout = 10 * time.Second
+
+// errConfigAbsent is returned by vmConfig when the VM has no config file
+var errConfigAbsent = errors.New("no network config in VM")
+
+// ErrNotConfigured is returned when pausing or resuming a VM that has no
+// network restrictions
+var ErrNotConfigured = errors.New("no network config to pause or resume")
+
+// toolCheckScript prints each of its arguments that isn't an installed command
+const toolCheckScript = `for t in "$@"; do command -v "$t" >/dev/null 2>&1 || echo "$t"; done`
+
+// toolPackages maps tools the rules script needs to the apt package providing them
+var toolPackages = map[string]string{
+	"iptables":  "iptables",
+	"ip6tables": "iptables",
+	"dig":       "dnsutils",
+}
+
 // Applier handles applying network rules to VMs
 type Applier struct {
 	mp multipass.Client
+
+	// autoInstall installs missing tools with apt instead of failing the apply
+	autoInstall bool
+
+	// hostDir keeps host-scoped configs; host scope is unavailable without it
+	hostDir string
+	hostOS  string
+	runHost func(script string) error
+	lookup  func(host string) ([]string, error)
 }
 
 // NewApplier creates a new network applier
 func NewApplier(mp multipass.Client) *Applier {
-	return &Applier{mp: mp}
+	return &Applier{mp: mp, hostOS: runtime.GOOS, runHost: runHostScript, lookup: lookupIPv4}
+}
+
+// SetHostDir sets the directory host-scoped configs are kept in, enabling
+// host-scoped rules
+func (a *Applier) SetHostDir(dir string) {
+	a.hostDir = dir
+}
+
+// SetAutoInstall controls whether missing tools (iptables, dig) are installed
+// in the VM with apt-get, rather than failing the apply
+func (a *Applier) SetAutoInstall(enabled bool) {
+	a.autoInstall = enabled
 }
 
-// ApplyToVM applies network configuration to a running VM
+// ApplyToVM applies network configuration to a running VM, inside it or,
+// for host-scoped configs, on the host. Rules in the other place are
+// removed, after the new ones are in force.
 func (a *Applier) ApplyToVM(vmName string, config *multipass.NetworkConfig) error {
 	if config == nil {
 		config = &multipass.NetworkConfig{Mode: multipass.NetworkModeNone}
@@ -38,6 +106,43 @@ func (a *Applier) ApplyToVM(vmName string, config *multipass.NetworkConfig) erro
 	if err := ValidateConfig(config); err != nil {
 		return fmt.Errorf("invalid network config: %w", err)
 	}
+	return a.apply(vmName, config)
+}
+
+// apply applies an already validated config under the VM's lock
+func (a *Applier) apply(vmName string, config *multipass.NetworkConfig) error {
+	lock := a.lockFor(vmName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if config.HostScoped() {
+		if err := a.applyOnHost(vmName, config); err != nil {
+			return err
+		}
+		current, err := a.vmConfig(vmName)
+		if errors.Is(err, errConfigAbsent) {
+			return nil
+		}
+		if err != nil || current.Mode == multipass.NetworkModeNone {
+			return err
+		}
+		return a.applyInVM(vmName, &multipass.NetworkConfig{Mode: multipass.NetworkModeNone})
+	}
+
+	if err := a.applyInVM(vmName, config); err != nil {
+		return err
+	}
+	return a.removeFromHost(vmName)
+}
+
+// applyInVM installs and runs the rules script inside the VM. Callers hold
+// the VM's lock.
+func (a *Applier) applyInVM(vmName string, config *multipass.NetworkConfig) error {
+	// Make sure the script's tools exist; otherwise rules (especially the
+	// `|| true` domain loops) would silently not be applied
+	if err := a.preflight(vmName, config); err != nil {
+		return err
+	}
 
 	// Generate the iptables script
 	script, err := GenerateIptablesScript(config)
@@ -79,25 +184,34 @@ func (a *Applier) ApplyToVM(vmName string, config *multipass.NetworkConfig) erro
 		return fmt.Errorf("failed to create network dir in VM: %w", err)
 	}
 
-	// Transfer files to /tmp first (multipass transfer runs as ubuntu user)
-	if err := a.mp.Transfer(configPath, fmt.Sprintf("%s:/tmp/dabbi-config.json", vmName)); err != nil {
+	// Transfer files to /tmp first (multipass transfer runs as ubuntu user).
+	// Staging names get a random suffix so leftovers from another apply can't collide.
+	suffix, err := randomSuffix()
+	if err != nil {
+		return fmt.Errorf("failed to generate temp name: %w", err)
+	}
+	vmTmpConfig := "/tmp/dabbi-config-" + suffix + ".json"
+	vmTmpScript := "/tmp/dabbi-apply-rules-" + suffix + ".sh"
+	vmTmpService := "/tmp/dabbi-network-" + suffix + ".service"
+
+	if err := a.mp.Transfer(configPath, fmt.Sprintf("%s:%s", vmName, vmTmpConfig)); err != nil {
 		return fmt.Errorf("failed to transfer config: %w", err)
 	}
-	if err := a.mp.Transfer(scriptPath, fmt.Sprintf("%s:/tmp/dabbi-apply-rules.sh", vmName)); err != nil {
+	if err := a.mp.Transfer(scriptPath, fmt.Sprintf("%s:%s", vmName, vmTmpScript)); err != nil {
 		return fmt.Errorf("failed to transfer script: %w", err)
 	}
-	if err := a.mp.Transfer(servicePath, fmt.Sprintf("%s:/tmp/dabbi-network.service", vmName)); err != nil {
+	if err := a.mp.Transfer(servicePath, fmt.Sprintf("%s:%s", vmName, vmTmpService)); err != nil {
 		return fmt.Errorf("failed to transfer service: %w", err)
 	}
 
 	// Move files to final locations (requires sudo)
-	if _, err := a.mp.Exec(vmName, "sudo", "mv", "/tmp/dabbi-config.json", vmConfigFile); err != nil {
+	if _, err := a.mp.Exec(vmName, "sudo", "mv", vmTmpConfig, vmConfigFile); err != nil {
 		return fmt.Errorf("failed to install config: %w", err)
 	}
-	if _, err := a.mp.Exec(vmName, "sudo", "mv", "/tmp/dabbi-apply-rules.sh", vmScriptFile); err != nil {
+	if _, err := a.mp.Exec(vmName, "sudo", "mv", vmTmpScript, vmScriptFile); err != nil {
 		return fmt.Errorf("failed to install script: %w", err)
 	}
-	if _, err := a.mp.Exec(vmName, "sudo", "mv", "/tmp/dabbi-network.service", vmServiceFile); err != nil {
+	if _, err := a.mp.Exec(vmName, "sudo", "mv", vmTmpService, vmServiceFile); err != nil {
 		return fmt.Errorf("failed to install service: %w", err)
 	}
 
@@ -122,21 +236,67 @@ func (a *Applier) ApplyToVM(vmName string, config *multipass.NetworkConfig) erro
 	return nil
 }
 
-// GetCurrentConfig retrieves the current network configuration from a VM
+// vmLocks serializes applies per VM (map[string]*sync.Mutex) so concurrent
+// callers don't race on the staged files and systemctl operations. It's
+// shared by every Applier, as handlers and CLI commands each build their own.
+var vmLocks sync.Map
+
+// lockFor returns the mutex guarding applies to the given VM
+func (a *Applier) lockFor(vmName string) *sync.Mutex {
+	lock, _ := vmLocks.LoadOrStore(vmName, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// randomSuffix returns a short random hex string for unique temp file names
+func randomSuffix() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GetCurrentConfig retrieves the current network configuration of a VM:
+// its host-scoped config if it has one, else the one inside the VM. A VM
+// without either has no restrictions, and gets a nil config.
 func (a *Applier) GetCurrentConfig(vmName string) (*multipass.NetworkConfig, error) {
-	// Try to read the config file from the VM
-	output, err := a.mp.Exec(vmName, "cat", vmConfigFile)
+	config, err := a.hostConfig(vmName)
+	if err != nil || config != nil {
+		return config, err
+	}
+	config, err = a.vmConfig(vmName)
+	if errors.Is(err, errConfigAbsent) {
+		return nil, nil
+	}
+	return config, err
+}
+
+// vmConfig reads the configuration stored inside a VM, returning
+// errConfigAbsent if there is none
+func (a *Applier) vmConfig(vmName string) (*multipass.NetworkConfig, error) {
+	// The answer is in the output rather than the exit status, which
+	// multipass also sets for its own failures (1 when it can't reach the
+	// VM, the same as test for a missing file)
+	output, err := a.mp.ExecWithTimeout(vmName, configReadTimeout, "sh", "-c", "test -f "+vmConfigFile+" && echo present || echo absent")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for config in VM: %w", err)
+	}
+	switch strings.TrimSpace(output) {
+	case "present":
+	case "absent":
+		return nil, errConfigAbsent
+	default:
+		return nil, fmt.Errorf("failed to check for config in VM: unexpected output %q", output)
+	}
+
+	output, err = a.mp.ExecWithTimeout(vmName, configReadTimeout, "cat", vmConfigFile)
 	if err != nil {
-		// Check if it's just a "file not found" error
-		if strings.Contains(err.Error(), "No such file") {
-			return nil, nil // No config = no restrictions
-		}
 		return nil, fmt.Errorf("failed to read config from VM: %w", err)
 	}
 
 	output = strings.TrimSpace(output)
 	if output == "" {
-		return nil, nil
+		return nil, errConfigAbsent
 	}
 
 	var config multipass.NetworkConfig
@@ -147,6 +307,87 @@ func (a *Applier) GetCurrentConfig(vmName string) (*multipass.NetworkConfig, err
 	return &config, nil
 }
 
+// Pause lifts a VM's network restrictions until Resume (or a reboot),
+// keeping its config so it doesn't need rebuilding, e.g. to briefly install
+// something an allowlist blocks. Unlike RemoveFromVM, the config stays in
+// place.
+func (a *Applier) Pause(vmName string) error {
+	config, err := a.requireRestricted(vmName)
+	if err != nil {
+		return err
+	}
+
+	lock := a.lockFor(vmName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if config.HostScoped() {
+		if err := a.clearOnHost(vmName); err != nil {
+			return err
+		}
+		return a.setHostPaused(vmName, true)
+	}
+
+	if _, err := a.mp.Exec(vmName, "sudo", "sh", "-c", pauseScript); err != nil {
+		return fmt.Errorf("failed to pause network rules: %w", err)
+	}
+	return nil
+}
+
+// Resume reapplies a paused VM's saved rules
+func (a *Applier) Resume(vmName string) error {
+	config, err := a.requireRestricted(vmName)
+	if err != nil {
+		return err
+	}
+
+	lock := a.lockFor(vmName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if config.HostScoped() {
+		if err := a.enforceOnHost(vmName, config); err != nil {
+			return err
+		}
+		return a.setHostPaused(vmName, false)
+	}
+
+	if _, err := a.mp.Exec(vmName, "sudo", vmScriptFile); err != nil {
+		return fmt.Errorf("failed to apply rules: %w", err)
+	}
+	// Scripts written before pausing existed don't clear the marker themselves
+	if _, err := a.mp.Exec(vmName, "sudo", "rm", "-f", vmPausedFile); err != nil {
+		return fmt.Errorf("failed to clear paused marker: %w", err)
+	}
+	return nil
+}
+
+// IsPaused checks if a VM's network restrictions are paused
+func (a *Applier) IsPaused(vmName string) (bool, error) {
+	if a.hostPaused(vmName) {
+		return true, nil
+	}
+	_, err := a.mp.Exec(vmName, "test", "-e", vmPausedFile)
+	if err != nil {
+		// File doesn't exist or error
+		return false, nil
+	}
+	return true, nil
+}
+
+// requireRestricted returns the VM's config, or ErrNotConfigured unless it
+// restricts something
+func (a *Applier) requireRestricted(vmName string) (*multipass.NetworkConfig, error) {
+	config, err := a.GetCurrentConfig(vmName)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || config.Mode == multipass.NetworkModeNone {
+		return nil, ErrNotConfigured
+	}
+	return config, nil
+}
+
 // RemoveFromVM removes all network restrictions from a VM
 func (a *Applier) RemoveFromVM(vmName string) error {
 	// Apply "none" mode to remove all restrictions
@@ -162,3 +403,77 @@ func (a *Applier) IsConfigured(vmName string) (bool, error) {
 	}
 	return true, nil
 }
+
+// requiredTools returns the commands the rules script needs for config.
+// Default-deny modes need ip6tables to lock down IPv6 too, and domain rules
+// need dig to resolve them and ip6tables for their AAAA records.
+func requiredTools(config *multipass.NetworkConfig) []string {
+	needIP6 := config.Mode == multipass.NetworkModeIsolated || config.Mode == multipass.NetworkModeAllowlist
+	needDig := false
+	if config.Mode == multipass.NetworkModeAllowlist || config.Mode == multipass.NetworkModeBlocklist {
+		for _, rule := range config.Rules {
+			if rule.Type == "domain" {
+				needIP6, needDig = true, true
+				break
+			}
+		}
+	}
+
+	tools := []string{"iptables"}
+	if needIP6 {
+		tools = append(tools, "ip6tables")
+	}
+	if needDig {
+		tools = append(tools, "dig")
+	}
+	return tools
+}
+
+// missingTools returns the tools that are not installed in the VM
+func (a *Applier) missingTools(vmName string, tools []string) ([]string, error) {
+	// Tool names are passed as arguments ("$@"), not spliced into the script
+	args := append([]string{"sh", "-c", toolCheckScript, "sh"}, tools...)
+	out, err := a.mp.Exec(vmName, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for required tools: %w", err)
+	}
+	return strings.Fields(out), nil
+}
+
+// preflight checks that the tools the rules script needs exist in the VM,
+// installing them if auto-install is enabled
+func (a *Applier) preflight(vmName string, config *multipass.NetworkConfig) error {
+	missing, err := a.missingTools(vmName, requiredTools(config))
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+
+	if !a.autoInstall {
+		return fmt.Errorf("VM is missing required tools: %s (install them, e.g. `sudo apt-get install -y %s`, or enable network_auto_install_tools)",
+			strings.Join(missing, ", "), strings.Join(packagesFor(missing), " "))
+	}
+
+	if _, err := a.mp.Exec(vmName, "sudo", "apt-get", "update", "-qq"); err != nil {
+		return fmt.Errorf("failed to update package lists: %w", err)
+	}
+	args := append([]string{"sudo", "DEBIAN_FRONTEND=noninteractive", "apt-get", "install", "-y", "-qq"}, packagesFor(missing)...)
+	if _, err := a.mp.Exec(vmName, args...); err != nil {
+		return fmt.Errorf("failed to install %s: %w", strings.Join(missing, ", "), err)
+	}
+	return nil
+}
+
+// packagesFor returns the unique apt packages providing tools
+func packagesFor(tools []string) []string {
+	var pkgs []string
+	seen := make(map[string]bool)
+	for _, t := range tools {
+		pkg := toolPackages[t]
+		if pkg == "" || seen[pkg] {
+			continue
+		}
+		seen[pkg] = true
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs
+}
@@ -0,0 +1,233 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplier_ApplyToVM_SerializesPerVM(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+
+	var active, maxActive int32
+	var mu sync.Mutex
+	var destinations []string
+
+	// An apply starts with mkdir and ends with running the script; track how
+	// many applies are between those two points at once
+	mockMP.On("Exec", "test-vm", []string{"sudo", "mkdir", "-p", vmNetworkDir}).Run(func(args mock.Arguments) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}).Return("", nil)
+	mockMP.On("Exec", "test-vm", []string{"sudo", vmScriptFile}).Run(func(args mock.Arguments) {
+		atomic.AddInt32(&active, -1)
+	}).Return("", nil)
+	mockMP.On("Exec", "test-vm", mock.Anything).Return("", nil)
+	mockMP.On("Transfer", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		mu.Lock()
+		destinations = append(destinations, args.String(1))
+		mu.Unlock()
+	}).Return(nil)
+
+	// Each caller has its own applier, as handlers and CLI commands do
+	const applies = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, applies)
+	for i := 0; i < applies; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- NewApplier(mockMP).ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(1), maxActive, "applies to the same VM should not overlap")
+
+	// Every staged file should have a unique name inside the VM
+	require.Len(t, destinations, applies*3)
+	seen := make(map[string]bool)
+	for _, dst := range destinations {
+		assert.True(t, strings.HasPrefix(dst, "test-vm:/tmp/dabbi-"), dst)
+		assert.False(t, seen[dst], "duplicate staging path %s", dst)
+		seen[dst] = true
+	}
+}
+
+func TestApplier_LockFor_PerVM(t *testing.T) {
+	a := NewApplier(new(testutil.MockMultipassClient))
+
+	assert.Same(t, a.lockFor("vm1"), a.lockFor("vm1"))
+	assert.NotSame(t, a.lockFor("vm1"), a.lockFor("vm2"))
+	assert.Same(t, a.lockFor("vm1"), NewApplier(new(testutil.MockMultipassClient)).lockFor("vm1"))
+}
+
+func TestApplier_ApplyToVM_MissingTools(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Exec", "test-vm", []string{"sh", "-c", toolCheckScript, "sh", "iptables", "ip6tables", "dig"}).
+		Return("dig\n", nil)
+
+	a := NewApplier(mockMP)
+	err := a.ApplyToVM("test-vm", &multipass.NetworkConfig{
+		Mode:  multipass.NetworkModeAllowlist,
+		Rules: []multipass.NetworkRule{{Type: "domain", Value: "github.com"}},
+	})
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing required tools: dig")
+	assert.Contains(t, err.Error(), "apt-get install -y dnsutils")
+	mockMP.AssertNotCalled(t, "Transfer", mock.Anything, mock.Anything)
+	mockMP.AssertExpectations(t)
+}
+
+func TestApplier_ApplyToVM_AutoInstallsTools(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Exec", "test-vm", []string{"sh", "-c", toolCheckScript, "sh", "iptables", "ip6tables"}).
+		Return("iptables\nip6tables\n", nil).Once()
+	mockMP.On("Exec", "test-vm", []string{"sudo", "apt-get", "update", "-qq"}).Return("", nil).Once()
+	mockMP.On("Exec", "test-vm", []string{"sudo", "DEBIAN_FRONTEND=noninteractive", "apt-get", "install", "-y", "-qq", "iptables"}).
+		Return("", nil).Once()
+	mockMP.On("Exec", "test-vm", mock.Anything).Return("", nil)
+	mockMP.On("Transfer", mock.Anything, mock.Anything).Return(nil)
+
+	a := NewApplier(mockMP)
+	a.SetAutoInstall(true)
+
+	require.NoError(t, a.ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated}))
+	mockMP.AssertExpectations(t)
+}
+
+func TestRequiredTools(t *testing.T) {
+	domainRule := []multipass.NetworkRule{{Type: "domain", Value: "github.com"}}
+	ipRule := []multipass.NetworkRule{{Type: "ip", Value: "1.1.1.1"}}
+
+	assert.Equal(t, []string{"iptables", "ip6tables"}, requiredTools(&multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated}))
+	assert.Equal(t, []string{"iptables", "ip6tables"}, requiredTools(&multipass.NetworkConfig{Mode: multipass.NetworkModeAllowlist, Rules: ipRule}))
+	assert.Equal(t, []string{"iptables"}, requiredTools(&multipass.NetworkConfig{Mode: multipass.NetworkModeBlocklist, Rules: ipRule}))
+	assert.Equal(t, []string{"iptables", "ip6tables", "dig"}, requiredTools(&multipass.NetworkConfig{Mode: multipass.NetworkModeBlocklist, Rules: domainRule}))
+	assert.Equal(t, []string{"iptables"}, requiredTools(&multipass.NetworkConfig{Mode: multipass.NetworkModeNone, Rules: domainRule}))
+}
+
+func TestPackagesFor(t *testing.T) {
+	assert.Equal(t, []string{"iptables", "dnsutils"}, packagesFor([]string{"iptables", "ip6tables", "dig"}))
+}
+
+func TestApplier_PauseResume(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.MockNetworkConfig("test-vm", `{"mode":"allowlist","rules":[{"type":"domain","value":"github.com"}]}`)
+	mockMP.On("Exec", "test-vm", []string{"sudo", "sh", "-c", pauseScript}).Return("", nil)
+	mockMP.On("Exec", "test-vm", []string{"sudo", vmScriptFile}).Return("", nil)
+	mockMP.On("Exec", "test-vm", []string{"sudo", "rm", "-f", vmPausedFile}).Return("", nil)
+
+	a := NewApplier(mockMP)
+	require.NoError(t, a.Pause("test-vm"))
+	require.NoError(t, a.Resume("test-vm"))
+
+	mockMP.AssertExpectations(t)
+	// The saved config is never rewritten or removed
+	mockMP.AssertNotCalled(t, "Transfer", mock.Anything, mock.Anything)
+	assert.NotContains(t, pauseScript, vmConfigFile)
+}
+
+func TestApplier_Pause_NotConfigured(t *testing.T) {
+	for _, config := range []string{"", `{"mode":"none","rules":[]}`} {
+		mockMP := new(testutil.MockMultipassClient)
+		mockMP.MockNetworkConfig("test-vm", config)
+
+		a := NewApplier(mockMP)
+		assert.ErrorIs(t, a.Pause("test-vm"), ErrNotConfigured)
+		assert.ErrorIs(t, a.Resume("test-vm"), ErrNotConfigured)
+		mockMP.AssertNotCalled(t, "Exec", "test-vm", []string{"sudo", "sh", "-c", pauseScript})
+	}
+}
+
+func TestApplier_IsPaused(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Exec", "paused-vm", []string{"test", "-e", vmPausedFile}).Return("", nil)
+	mockMP.On("Exec", "active-vm", []string{"test", "-e", vmPausedFile}).Return("", errors.New("exit status 1"))
+
+	a := NewApplier(mockMP)
+	paused, err := a.IsPaused("paused-vm")
+	require.NoError(t, err)
+	assert.True(t, paused)
+	paused, err = a.IsPaused("active-vm")
+	require.NoError(t, err)
+	assert.False(t, paused)
+}
+
+func TestGenerateIptablesScript_EndsPause(t *testing.T) {
+	script, err := GenerateIptablesScript(&multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated})
+	require.NoError(t, err)
+	assert.Contains(t, script, "rm -f "+vmPausedFile)
+}
+
+func TestApplier_GetCurrentConfig(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.MockNetworkConfig("test-vm", `{"mode":"isolated"}`)
+
+	config, err := NewApplier(mockMP).GetCurrentConfig("test-vm")
+
+	require.NoError(t, err)
+	assert.Equal(t, &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated}, config)
+	mockMP.AssertCalled(t, "ExecWithTimeout", "test-vm", configReadTimeout, []string{"cat", vmConfigFile})
+}
+
+func TestApplier_GetCurrentConfig_Absent(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.MockNetworkConfig("test-vm", "")
+
+	config, err := NewApplier(mockMP).GetCurrentConfig("test-vm")
+
+	require.NoError(t, err)
+	assert.Nil(t, config)
+	mockMP.AssertNotCalled(t, "ExecWithTimeout", "test-vm", mock.Anything, []string{"cat", vmConfigFile})
+}
+
+func TestApplier_GetCurrentConfig_Unreachable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		// multipass exits 1 when it can't reach the VM, as test does for a
+		// missing file
+		{"multipass error", &multipass.MultipassError{
+			Command: "exec",
+			Stderr:  "exec failed: ssh connection failed: 'Failed to connect: No route to host'",
+			Err:     testutil.ExitError(1),
+		}},
+		{"timeout", fmt.Errorf("test -f in test-vm: %w", multipass.ErrExecTimeout)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockMP := new(testutil.MockMultipassClient)
+			mockMP.On("ExecWithTimeout", "test-vm", configReadTimeout, mock.Anything).Return("", tt.err)
+
+			config, err := NewApplier(mockMP).GetCurrentConfig("test-vm")
+
+			// Not mistaken for a VM without restrictions
+			assert.Nil(t, config)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// Bulk apply result statuses, the same as the bulk package's for starting
+// and stopping VMs
+const (
+	BulkStatusOK      = "ok"
+	BulkStatusSkipped = "skipped"
+	BulkStatusFailed  = "failed"
+)
+
+// DefaultBulkParallel is how many VMs ApplyBulk applies to at once when
+// parallel is unset
+const DefaultBulkParallel = 4
+
+// BulkResult is what happened to one VM in ApplyBulk
+type BulkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`           // ok, skipped, or failed
+	Detail string `json:"detail,omitempty"` // why it was skipped, or the error
+}
+
+// ApplyBulk applies one config to the named VMs (every VM when names is
+// empty), parallel at a time, and returns a result for each, sorted by name.
+// The config is validated once up front; only running VMs get it, the rest
+// are reported as skipped. Applies to a single VM stay serialized with any
+// others made through this applier.
+func (a *Applier) ApplyBulk(names []string, config *multipass.NetworkConfig, parallel int) ([]BulkResult, error) {
+	if config == nil {
+		config = &multipass.NetworkConfig{Mode: multipass.NetworkModeNone}
+	}
+	if err := ValidateConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid network config: %w", err)
+	}
+
+	vms, err := a.mp.List()
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]string, len(vms))
+	for _, vm := range vms {
+		states[vm.Name] = vm.State
+	}
+
+	if len(names) == 0 {
+		for _, vm := range vms {
+			names = append(names, vm.Name)
+		}
+	} else {
+		names = append([]string(nil), names...)
+	}
+	sort.Strings(names)
+
+	results := make([]BulkResult, len(names))
+	var targets []int
+	for i, name := range names {
+		results[i] = BulkResult{Name: name}
+		state, ok := states[name]
+		switch {
+		case !ok:
+			results[i].Status, results[i].Detail = BulkStatusFailed, "not found"
+		case state != multipass.StateRunning:
+			results[i].Status, results[i].Detail = BulkStatusSkipped, "not running ("+strings.ToLower(state)+")"
+		default:
+			targets = append(targets, i)
+		}
+	}
+
+	if parallel <= 0 {
+		parallel = DefaultBulkParallel
+	}
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for _, i := range targets {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(r *BulkResult) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if err := a.apply(r.Name, config); err != nil {
+				r.Status, r.Detail = BulkStatusFailed, err.Error()
+				return
+			}
+			r.Status = BulkStatusOK
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results, nil
+}
@@ -0,0 +1,64 @@
+package network
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApplier_ApplyBulk(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "web", State: multipass.StateRunning},
+		{Name: "db", State: multipass.StateRunning},
+		{Name: "old", State: multipass.StateStopped},
+	}, nil)
+	mockMP.On("Exec", "web", mock.Anything).Return("", nil)
+	mockMP.On("Exec", "db", mock.Anything).Return("", errors.New("exec failed"))
+	mockMP.On("Transfer", mock.Anything, mock.Anything).Return(nil)
+
+	results, err := NewApplier(mockMP).ApplyBulk(nil, &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated}, 2)
+	require.NoError(t, err)
+
+	require.Len(t, results, 3)
+	assert.Equal(t, "db", results[0].Name)
+	assert.Equal(t, BulkStatusFailed, results[0].Status)
+	assert.Contains(t, results[0].Detail, "exec failed")
+	assert.Equal(t, BulkResult{Name: "old", Status: BulkStatusSkipped, Detail: "not running (stopped)"}, results[1])
+	assert.Equal(t, BulkResult{Name: "web", Status: BulkStatusOK}, results[2])
+	mockMP.AssertCalled(t, "Exec", "web", []string{"sudo", vmScriptFile})
+	mockMP.AssertNotCalled(t, "Exec", "old", mock.Anything)
+}
+
+func TestApplier_ApplyBulk_Names(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "web", State: multipass.StateRunning},
+		{Name: "db", State: multipass.StateRunning},
+	}, nil)
+	mockMP.On("Exec", "web", mock.Anything).Return("", nil)
+	mockMP.On("Transfer", mock.Anything, mock.Anything).Return(nil)
+
+	results, err := NewApplier(mockMP).ApplyBulk([]string{"web", "gone"}, &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated}, 0)
+	require.NoError(t, err)
+
+	assert.Equal(t, []BulkResult{
+		{Name: "gone", Status: BulkStatusFailed, Detail: "not found"},
+		{Name: "web", Status: BulkStatusOK},
+	}, results)
+	mockMP.AssertNotCalled(t, "Exec", "db", mock.Anything)
+}
+
+func TestApplier_ApplyBulk_InvalidConfig(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+
+	_, err := NewApplier(mockMP).ApplyBulk(nil, &multipass.NetworkConfig{Mode: "open"}, 0)
+
+	assert.ErrorContains(t, err, "invalid network config")
+	mockMP.AssertNotCalled(t, "List")
+}
@@ -0,0 +1,429 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// Host-scoped rules are enforced by the host's iptables on the traffic a VM
+// routes through the multipass bridge, matched by the bridge port (the VM's
+// tap device) it comes in on. Unlike rules inside the VM, a guest with sudo
+// can't flush them, and changing its addresses doesn't get it past them.
+// Only IPv4 is filtered by destination; forwarded IPv6 is dropped. Traffic
+// between the VM and the host itself (including the bridge's DNS) isn't
+// forwarded, so it's never affected.
+
+// ErrHostScopeUnsupported is returned when host-scoped rules are applied
+// where they can't be enforced
+var ErrHostScopeUnsupported = errors.New("host-scoped network rules need a Linux host")
+
+// hostScriptTemplate sets up one VM's chains on the host. Rerunning it
+// replaces whatever an earlier run set up, including the jumps for a
+// previous tap device of the VM. The VM's address is only used to find its
+// tap device, through the host's neighbor table and the bridge's FDB.
+const hostScriptTemplate = `#!/bin/sh
+# Dabbi host network rules for VM {{.VM}} ({{.IP}})
+# Mode: {{.Config.Mode}}
+# Generated automatically - do not edit manually
+
+set -e
+
+# Remove this VM's jumps and chains
+for ipt in iptables ip6tables; do
+    $ipt -S FORWARD | grep -e '-j {{.Chain}}$' | sed 's/^-A /-D /' | while read -r rule; do
+        $ipt $rule
+    done
+    $ipt -F {{.Chain}} 2>/dev/null || true
+    $ipt -X {{.Chain}} 2>/dev/null || true
+done
+{{if .Enforce}}
+# Find the bridge port the VM is on: the guest can change its addresses, but
+# not the port its traffic comes in on
+modprobe br_netfilter
+ping -c 1 -W 1 {{.IP}} >/dev/null 2>&1 || true
+mac=$(ip neigh show {{.IP}} | awk '{for (i = 1; i < NF; i++) if ($i == "lladdr") print $(i+1)}')
+port=$(bridge fdb show | awk -v mac="$mac" '$1 == mac && $2 == "dev" {print $3; exit}')
+if [ -z "$mac" ] || [ -z "$port" ]; then
+    echo "Can't find the bridge port of {{.IP}}" >&2
+    exit 1
+fi
+
+# IPv6 isn't filtered by destination, so none is forwarded
+ip6tables -N {{.Chain}}
+ip6tables -A {{.Chain}} -j DROP
+ip6tables -I FORWARD -m physdev --physdev-in "$port" -j {{.Chain}}
+
+iptables -N {{.Chain}}
+iptables -I FORWARD -m physdev --physdev-in "$port" -j {{.Chain}}
+
+# Allow replies on connections that are already up
+iptables -A {{.Chain}} -m state --state ESTABLISHED,RELATED -j ACCEPT
+{{if eq .Config.Mode "isolated"}}
+# ISOLATED MODE - Nothing beyond the host
+iptables -A {{.Chain}} -j DROP
+{{else if eq .Config.Mode "allowlist"}}
+# ALLOWLIST MODE - Default deny, allow specific hosts
+{{range .Config.DNSServers}}iptables -A {{$.Chain}} -p udp -d {{.}} --dport 53 -j ACCEPT
+iptables -A {{$.Chain}} -p tcp -d {{.}} --dport 53 -j ACCEPT
+{{end}}{{range .Rules}}
+# Allow {{.Label}}
+{{range .Addrs}}iptables -A {{$.Chain}} -d {{.}} -j ACCEPT
+{{end}}{{end}}
+iptables -A {{.Chain}} -j DROP
+{{else if eq .Config.Mode "blocklist"}}
+# BLOCKLIST MODE - Default allow, block specific hosts
+{{range .Rules}}
+# Block {{.Label}}
+{{range .Addrs}}iptables -A {{$.Chain}} -d {{.}} -j DROP
+{{end}}{{end}}{{end}}{{end}}
+echo "Host network rules applied (mode: {{.Config.Mode}})"
+`
+
+// hostScriptRule is a rule with its domain resolved to addresses
+type hostScriptRule struct {
+	Label string
+	Addrs []string
+}
+
+// hostScriptData is what hostScriptTemplate renders
+type hostScriptData struct {
+	VM      string
+	IP      string
+	Chain   string
+	Config  *multipass.NetworkConfig
+	Enforce bool // false removes the VM's rules
+	Rules   []hostScriptRule
+}
+
+var hostScriptTmpl = template.Must(template.New("host").Parse(hostScriptTemplate))
+
+// hostChain is the name of a VM's chain on the host. iptables caps chain
+// names at 28 characters, shorter than a VM name can be, so it's hashed.
+func hostChain(vmName string) string {
+	sum := sha256.Sum256([]byte(vmName))
+	return "DABBI-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// GenerateHostScript generates the host-side script enforcing config for
+// the VM at vmIP. Domains are resolved with lookup when the script is
+// generated, as the host's iptables only match addresses. A nil config or
+// none mode removes the VM's rules.
+func GenerateHostScript(vmName, vmIP string, config *multipass.NetworkConfig, lookup func(host string) ([]string, error)) (string, error) {
+	if config == nil {
+		config = &multipass.NetworkConfig{Mode: multipass.NetworkModeNone}
+	}
+	if err := ValidateConfig(config); err != nil {
+		return "", err
+	}
+	if err := multipass.ValidateInstanceName(vmName); err != nil {
+		return "", err
+	}
+	if !isValidIP(vmIP) {
+		return "", fmt.Errorf("invalid VM address: %q", vmIP)
+	}
+
+	data := hostScriptData{
+		VM:      vmName,
+		IP:      vmIP,
+		Chain:   hostChain(vmName),
+		Config:  config,
+		Enforce: config.Mode != multipass.NetworkModeNone,
+	}
+	for _, rule := range config.Rules {
+		label := rule.Type + ": " + rule.Value
+		if rule.Comment != "" {
+			label += " - " + rule.Comment
+		}
+		addrs := []string{rule.Value}
+		if rule.Type == "domain" {
+			resolved, err := lookup(rule.Value)
+			if err != nil {
+				return "", fmt.Errorf("failed to resolve %s: %w", rule.Value, err)
+			}
+			addrs = nil
+			for _, addr := range resolved {
+				// Only IPv4 is filtered by destination; IPv6 is dropped
+				if isValidIP(addr) {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+		data.Rules = append(data.Rules, hostScriptRule{Label: label, Addrs: addrs})
+	}
+
+	var buf bytes.Buffer
+	if err := hostScriptTmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// lookupIPv4 resolves a domain on the host
+func lookupIPv4(host string) ([]string, error) {
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			addrs = append(addrs, ip4.String())
+		}
+	}
+	return addrs, nil
+}
+
+// runHostScript runs a script as root on the host, through passwordless
+// sudo unless the daemon is root already
+func runHostScript(script string) error {
+	name, args := "sh", []string{"-c", script}
+	if os.Geteuid() != 0 {
+		name, args = "sudo", append([]string{"-n", "sh"}, args...)
+	}
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// hostConfigPath is where a host-scoped VM's config is kept
+func (a *Applier) hostConfigPath(vmName string) (string, error) {
+	if a.hostDir == "" {
+		return "", fmt.Errorf("no directory for host-scoped network rules is set")
+	}
+	if err := multipass.ValidateInstanceName(vmName); err != nil {
+		return "", err
+	}
+	return filepath.Join(a.hostDir, vmName+".json"), nil
+}
+
+// hostPausedPath marks a host-scoped VM whose rules are paused
+func (a *Applier) hostPausedPath(vmName string) (string, error) {
+	path, err := a.hostConfigPath(vmName)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(path, ".json") + ".paused", nil
+}
+
+// hostConfig returns a VM's host-scoped config, or nil when it has none
+func (a *Applier) hostConfig(vmName string) (*multipass.NetworkConfig, error) {
+	if a.hostDir == "" {
+		return nil, nil
+	}
+	path, err := a.hostConfigPath(vmName)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host network config: %w", err)
+	}
+	var config multipass.NetworkConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse host network config: %w", err)
+	}
+	return &config, nil
+}
+
+// enforceOnHost (re)applies config's rules on the host at the VM's current
+// bridge port. Callers hold the VM's lock.
+func (a *Applier) enforceOnHost(vmName string, config *multipass.NetworkConfig) error {
+	if a.hostOS != "linux" {
+		return ErrHostScopeUnsupported
+	}
+	info, err := a.mp.Info(vmName)
+	if err != nil {
+		return fmt.Errorf("failed to get VM info: %w", err)
+	}
+	if len(info.IPv4) == 0 {
+		return fmt.Errorf("VM '%s' has no IPv4 address to find its bridge port by", vmName)
+	}
+
+	script, err := GenerateHostScript(vmName, info.IPv4[0], config, a.lookup)
+	if err != nil {
+		return fmt.Errorf("failed to generate host rules: %w", err)
+	}
+	if err := a.runHost(script); err != nil {
+		return fmt.Errorf("failed to apply host rules: %w", err)
+	}
+	return nil
+}
+
+// clearOnHost removes a VM's rules from the host. Callers hold the VM's lock.
+func (a *Applier) clearOnHost(vmName string) error {
+	// The teardown doesn't depend on the VM's address or port, which may be gone
+	script, err := GenerateHostScript(vmName, "0.0.0.0", nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := a.runHost(script); err != nil {
+		return fmt.Errorf("failed to remove host rules: %w", err)
+	}
+	return nil
+}
+
+// applyOnHost enforces config on the host and records it there. Callers
+// hold the VM's lock.
+func (a *Applier) applyOnHost(vmName string, config *multipass.NetworkConfig) error {
+	path, err := a.hostConfigPath(vmName)
+	if err != nil {
+		return err
+	}
+	if err := a.enforceOnHost(vmName, config); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+	if err := os.MkdirAll(a.hostDir, 0700); err != nil {
+		return fmt.Errorf("failed to create host network dir: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save host network config: %w", err)
+	}
+	return a.setHostPaused(vmName, false)
+}
+
+// removeFromHost removes a VM's host-scoped rules and config, if it has
+// any. Callers hold the VM's lock.
+func (a *Applier) removeFromHost(vmName string) error {
+	config, err := a.hostConfig(vmName)
+	if err != nil || config == nil {
+		return err
+	}
+	if err := a.clearOnHost(vmName); err != nil {
+		return err
+	}
+	path, err := a.hostConfigPath(vmName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove host network config: %w", err)
+	}
+	return a.setHostPaused(vmName, false)
+}
+
+// setHostPaused records whether a host-scoped VM's rules are paused
+func (a *Applier) setHostPaused(vmName string, paused bool) error {
+	path, err := a.hostPausedPath(vmName)
+	if err != nil {
+		return err
+	}
+	if !paused {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to clear paused marker: %w", err)
+		}
+		return nil
+	}
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		return fmt.Errorf("failed to write paused marker: %w", err)
+	}
+	return nil
+}
+
+// hostPaused reports whether a host-scoped VM's rules are paused
+func (a *Applier) hostPaused(vmName string) bool {
+	path, err := a.hostPausedPath(vmName)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// RefreshHost reapplies a host-scoped VM's rules at its current bridge
+// port, which can change when it restarts. It does nothing for VMs without
+// host-scoped rules, or whose rules are paused.
+func (a *Applier) RefreshHost(vmName string) error {
+	lock := a.lockFor(vmName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	config, err := a.hostConfig(vmName)
+	if err != nil || config == nil || a.hostPaused(vmName) {
+		return err
+	}
+	return a.enforceOnHost(vmName, config)
+}
+
+// ForgetHost removes a deleted VM's host-scoped rules and config
+func (a *Applier) ForgetHost(vmName string) error {
+	lock := a.lockFor(vmName)
+	lock.Lock()
+	defer lock.Unlock()
+
+	return a.removeFromHost(vmName)
+}
+
+// hostRulesClient keeps host-scoped rules in step with VMs' lifecycles
+type hostRulesClient struct {
+	multipass.Client
+	applier *Applier
+}
+
+// TrackHostRules wraps a multipass client so that starting or restarting a
+// VM reapplies its host-scoped rules at its new bridge port, and purging it
+// removes them, whichever path (API, CLI, bulk, wake on request) does it.
+// Failures are logged; the lifecycle change itself has already happened.
+func TrackHostRules(mp multipass.Client, a *Applier) multipass.Client {
+	return &hostRulesClient{Client: mp, applier: a}
+}
+
+func (c *hostRulesClient) Start(name string) error {
+	if err := c.Client.Start(name); err != nil {
+		return err
+	}
+	c.refresh(name)
+	return nil
+}
+
+func (c *hostRulesClient) Restart(name string) error {
+	if err := c.Client.Restart(name); err != nil {
+		return err
+	}
+	c.refresh(name)
+	return nil
+}
+
+func (c *hostRulesClient) Delete(name string, purge bool) error {
+	if err := c.Client.Delete(name, purge); err != nil {
+		return err
+	}
+	// A recoverable VM keeps its rules for when it's recovered and started
+	if purge {
+		if err := c.applier.ForgetHost(name); err != nil {
+			log.Printf("Warning: failed to remove host network rules for deleted VM %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (c *hostRulesClient) refresh(name string) {
+	if err := c.applier.RefreshHost(name); err != nil {
+		log.Printf("Warning: failed to refresh host network rules for VM %s: %v", name, err)
+	}
+}
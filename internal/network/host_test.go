@@ -0,0 +1,286 @@
+package network
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeLookup(host string) ([]string, error) {
+	switch host {
+	case "github.com":
+		return []string{"140.82.121.4", "2606:50c0::1"}, nil
+	default:
+		return nil, errors.New("no such host")
+	}
+}
+
+// newHostApplier returns an applier enforcing host scope into a temp dir,
+// recording the host scripts it runs
+func newHostApplier(t *testing.T, mp multipass.Client) (*Applier, *[]string) {
+	var scripts []string
+	a := NewApplier(mp)
+	a.SetHostDir(t.TempDir())
+	a.hostOS = "linux"
+	a.lookup = fakeLookup
+	a.runHost = func(script string) error {
+		scripts = append(scripts, script)
+		return nil
+	}
+	return a, &scripts
+}
+
+func TestGenerateHostScript(t *testing.T) {
+	chain := hostChain("test-vm")
+
+	tests := []struct {
+		name     string
+		config   *multipass.NetworkConfig
+		contains []string
+		excludes []string
+	}{
+		{
+			name: "allowlist",
+			config: &multipass.NetworkConfig{
+				Mode: multipass.NetworkModeAllowlist,
+				Rules: []multipass.NetworkRule{
+					{Type: "domain", Value: "github.com", Comment: "GitHub"},
+					{Type: "cidr", Value: "10.0.0.0/8"},
+				},
+				DNSServers: []string{"1.1.1.1"},
+			},
+			contains: []string{
+				"iptables -N " + chain,
+				"ip neigh show 192.168.64.5",
+				`iptables -I FORWARD -m physdev --physdev-in "$port" -j ` + chain,
+				`ip6tables -I FORWARD -m physdev --physdev-in "$port" -j ` + chain,
+				"ip6tables -A " + chain + " -j DROP",
+				"iptables -A " + chain + " -m state --state ESTABLISHED,RELATED -j ACCEPT",
+				"iptables -A " + chain + " -p udp -d 1.1.1.1 --dport 53 -j ACCEPT",
+				"# Allow domain: github.com - GitHub",
+				"iptables -A " + chain + " -d 140.82.121.4 -j ACCEPT",
+				"iptables -A " + chain + " -d 10.0.0.0/8 -j ACCEPT",
+				"iptables -A " + chain + " -j DROP",
+			},
+			excludes: []string{"2606:50c0::1"},
+		},
+		{
+			name: "blocklist",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeBlocklist,
+				Rules: []multipass.NetworkRule{{Type: "ip", Value: "8.8.8.8"}},
+			},
+			contains: []string{
+				"iptables -A " + chain + " -d 8.8.8.8 -j DROP",
+			},
+			excludes: []string{"iptables -A " + chain + " -j DROP"},
+		},
+		{
+			name:   "isolated",
+			config: &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated},
+			contains: []string{
+				`iptables -I FORWARD -m physdev --physdev-in "$port" -j ` + chain,
+				"iptables -A " + chain + " -j DROP",
+			},
+			excludes: []string{"-s 192.168.64.5"},
+		},
+		{
+			name:   "none_removes_rules",
+			config: nil,
+			contains: []string{
+				"grep -e '-j " + chain + "$'",
+				"for ipt in iptables ip6tables",
+				"$ipt -X " + chain,
+			},
+			excludes: []string{"iptables -N", "iptables -I FORWARD", "ip neigh"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := GenerateHostScript("test-vm", "192.168.64.5", tt.config, fakeLookup)
+			require.NoError(t, err)
+
+			for _, want := range tt.contains {
+				assert.Contains(t, script, want)
+			}
+			for _, unwanted := range tt.excludes {
+				assert.NotContains(t, script, unwanted)
+			}
+		})
+	}
+}
+
+func TestGenerateHostScript_Invalid(t *testing.T) {
+	allow := &multipass.NetworkConfig{Mode: multipass.NetworkModeAllowlist, Rules: []multipass.NetworkRule{{Type: "domain", Value: "nowhere.invalid"}}}
+
+	_, err := GenerateHostScript("test-vm", "192.168.64.5", allow, fakeLookup)
+	assert.ErrorContains(t, err, "failed to resolve nowhere.invalid")
+
+	_, err = GenerateHostScript("test-vm", "192.168.64.5; reboot", nil, fakeLookup)
+	assert.Error(t, err)
+
+	_, err = GenerateHostScript("../vm", "192.168.64.5", nil, fakeLookup)
+	assert.Error(t, err)
+}
+
+func TestHostChain(t *testing.T) {
+	assert.Equal(t, hostChain("a"), hostChain("a"))
+	assert.NotEqual(t, hostChain("a"), hostChain("b"))
+	// iptables' limit on chain names
+	assert.LessOrEqual(t, len(hostChain(strings.Repeat("x", 63))), 28)
+}
+
+func TestApplier_ApplyToVM_HostScope(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	// No rules inside the VM to clear
+	mockMP.MockNetworkConfig("test-vm", "")
+	a, scripts := newHostApplier(t, mockMP)
+
+	config := &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated, Scope: multipass.NetworkScopeHost}
+	require.NoError(t, a.ApplyToVM("test-vm", config))
+
+	require.Len(t, *scripts, 1)
+	assert.Contains(t, (*scripts)[0], "ip neigh show 192.168.64.5")
+	assert.Contains(t, (*scripts)[0], `iptables -I FORWARD -m physdev --physdev-in "$port" -j `+hostChain("test-vm"))
+	mockMP.AssertNotCalled(t, "Transfer", mock.Anything, mock.Anything)
+
+	got, err := a.GetCurrentConfig("test-vm")
+	require.NoError(t, err)
+	assert.Equal(t, config, got)
+}
+
+func TestApplier_ApplyToVM_HostScopeClearsVMRules(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.MockNetworkConfig("test-vm", `{"mode":"isolated"}`)
+	mockMP.On("Exec", "test-vm", mock.Anything).Return("", nil)
+	mockMP.On("Transfer", mock.Anything, mock.Anything).Return(nil)
+	a, scripts := newHostApplier(t, mockMP)
+
+	require.NoError(t, a.ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated, Scope: multipass.NetworkScopeHost}))
+
+	// The host rules go in first, then the VM's own are reset to none
+	assert.Len(t, *scripts, 1)
+	mockMP.AssertCalled(t, "Exec", "test-vm", []string{"sudo", vmScriptFile})
+}
+
+func TestApplier_ApplyToVM_BackToVMScope(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.MockNetworkConfig("test-vm", "")
+	mockMP.On("Exec", "test-vm", mock.Anything).Return("", nil)
+	mockMP.On("Transfer", mock.Anything, mock.Anything).Return(nil)
+	a, scripts := newHostApplier(t, mockMP)
+
+	require.NoError(t, a.ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated, Scope: multipass.NetworkScopeHost}))
+	require.NoError(t, a.ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated}))
+
+	require.Len(t, *scripts, 2)
+	assert.NotContains(t, (*scripts)[1], "iptables -N")
+	_, err := os.Stat(filepath.Join(a.hostDir, "test-vm.json"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestApplier_ApplyToVM_HostScopeUnsupported(t *testing.T) {
+	a, scripts := newHostApplier(t, new(testutil.MockMultipassClient))
+	a.hostOS = "darwin"
+
+	err := a.ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated, Scope: multipass.NetworkScopeHost})
+
+	assert.ErrorIs(t, err, ErrHostScopeUnsupported)
+	assert.Empty(t, *scripts)
+}
+
+func TestApplier_PauseResume_HostScope(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.MockNetworkConfig("test-vm", "")
+	a, scripts := newHostApplier(t, mockMP)
+	require.NoError(t, a.ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated, Scope: multipass.NetworkScopeHost}))
+
+	require.NoError(t, a.Pause("test-vm"))
+	paused, _ := a.IsPaused("test-vm")
+	assert.True(t, paused)
+	assert.NotContains(t, (*scripts)[1], "iptables -N")
+
+	// A paused VM's rules stay lifted when it restarts
+	require.NoError(t, a.RefreshHost("test-vm"))
+	assert.Len(t, *scripts, 2)
+
+	require.NoError(t, a.Resume("test-vm"))
+	assert.Contains(t, (*scripts)[2], "iptables -N")
+	assert.False(t, a.hostPaused("test-vm"))
+}
+
+func TestApplier_RefreshHost(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil).Once()
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.9"), nil)
+	mockMP.MockNetworkConfig("test-vm", "")
+	a, scripts := newHostApplier(t, mockMP)
+
+	// Nothing to do without host-scoped rules
+	require.NoError(t, a.RefreshHost("test-vm"))
+	assert.Empty(t, *scripts)
+
+	require.NoError(t, a.ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated, Scope: multipass.NetworkScopeHost}))
+	require.NoError(t, a.RefreshHost("test-vm"))
+
+	require.Len(t, *scripts, 2)
+	assert.Contains(t, (*scripts)[1], "ip neigh show 192.168.64.9")
+}
+
+func TestApplier_ForgetHost(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.MockNetworkConfig("test-vm", "")
+	a, scripts := newHostApplier(t, mockMP)
+	require.NoError(t, a.ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated, Scope: multipass.NetworkScopeHost}))
+
+	require.NoError(t, a.ForgetHost("test-vm"))
+
+	require.Len(t, *scripts, 2)
+	config, err := a.hostConfig("test-vm")
+	require.NoError(t, err)
+	assert.Nil(t, config)
+}
+
+func TestTrackHostRules(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
+	mockMP.MockNetworkConfig("test-vm", "")
+	mockMP.On("Start", "test-vm").Return(nil)
+	mockMP.On("Restart", "test-vm").Return(nil)
+	mockMP.On("Delete", "test-vm", mock.Anything).Return(nil)
+	a, scripts := newHostApplier(t, mockMP)
+	require.NoError(t, a.ApplyToVM("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated, Scope: multipass.NetworkScopeHost}))
+	mp := TrackHostRules(mockMP, a)
+
+	require.NoError(t, mp.Start("test-vm"))
+	require.NoError(t, mp.Restart("test-vm"))
+	require.Len(t, *scripts, 3)
+	assert.Contains(t, (*scripts)[2], "iptables -N")
+
+	// A recoverable VM keeps its rules
+	require.NoError(t, mp.Delete("test-vm", false))
+	config, err := a.hostConfig("test-vm")
+	require.NoError(t, err)
+	assert.NotNil(t, config)
+
+	require.NoError(t, mp.Delete("test-vm", true))
+	require.Len(t, *scripts, 4)
+	assert.NotContains(t, (*scripts)[3], "iptables -N")
+	config, err = a.hostConfig("test-vm")
+	require.NoError(t, err)
+	assert.Nil(t, config)
+}
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// Preset is a named bundle of allowlist rules for a common service, so a
+// VM can reach e.g. GitHub without listing every host it uses
+type Preset struct {
+	Name  string
+	Rules []multipass.NetworkRule
+}
+
+// Built-in presets. Domains are resolved when the rules are applied, so
+// services behind CDNs may need the rules reapplied when their addresses
+// change; GitHub's published git and web ranges are included as CIDRs.
+var (
+	PresetGitHub = newPreset("github",
+		"github.com",
+		"api.github.com",
+		"codeload.github.com",
+		"uploads.github.com",
+		"objects.githubusercontent.com",
+		"raw.githubusercontent.com",
+		"ghcr.io",
+		"pkg-containers.githubusercontent.com",
+		"140.82.112.0/20",
+		"143.55.64.0/20",
+		"185.199.108.0/22",
+		"192.30.252.0/22",
+	)
+
+	PresetNpm = newPreset("npm",
+		"registry.npmjs.org",
+		"registry.yarnpkg.com",
+		"nodejs.org",
+	)
+
+	PresetPypi = newPreset("pypi",
+		"pypi.org",
+		"files.pythonhosted.org",
+	)
+
+	PresetUbuntuApt = newPreset("ubuntu-apt",
+		"archive.ubuntu.com",
+		"security.ubuntu.com",
+		"ports.ubuntu.com",
+		"ppa.launchpadcontent.net",
+		"keyserver.ubuntu.com",
+	)
+)
+
+// presets indexes the built-in presets by name
+var presets = map[string]Preset{
+	PresetGitHub.Name:    PresetGitHub,
+	PresetNpm.Name:       PresetNpm,
+	PresetPypi.Name:      PresetPypi,
+	PresetUbuntuApt.Name: PresetUbuntuApt,
+}
+
+// newPreset builds a preset from domains and CIDRs (values with a '/').
+// Each rule's comment names the preset, so 'network get' shows where it
+// came from.
+func newPreset(name string, values ...string) Preset {
+	rules := make([]multipass.NetworkRule, len(values))
+	for i, v := range values {
+		ruleType := "domain"
+		if strings.Contains(v, "/") {
+			ruleType = "cidr"
+		}
+		rules[i] = multipass.NetworkRule{Type: ruleType, Value: v, Comment: name + " preset"}
+	}
+	return Preset{Name: name, Rules: rules}
+}
+
+// PresetNames returns the names of the built-in presets, sorted
+func PresetNames() []string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExpandPresets returns the rules of the named presets, in order, with
+// rules already added by an earlier preset left out
+func ExpandPresets(names []string) ([]multipass.NetworkRule, error) {
+	var rules []multipass.NetworkRule
+	seen := make(map[string]bool)
+	for _, name := range names {
+		preset, ok := presets[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(PresetNames(), ", "))
+		}
+		for _, rule := range preset.Rules {
+			key := rule.Type + " " + rule.Value
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ruleValues returns the values of rules of one type
+func ruleValues(rules []multipass.NetworkRule, ruleType string) []string {
+	var values []string
+	for _, r := range rules {
+		if r.Type == ruleType {
+			values = append(values, r.Value)
+		}
+	}
+	return values
+}
+
+func TestExpandPresets(t *testing.T) {
+	tests := []struct {
+		preset  string
+		domains []string
+		cidrs   []string
+	}{
+		{
+			preset: "github",
+			domains: []string{
+				"github.com", "api.github.com", "codeload.github.com", "uploads.github.com",
+				"objects.githubusercontent.com", "raw.githubusercontent.com",
+				"ghcr.io", "pkg-containers.githubusercontent.com",
+			},
+			cidrs: []string{"140.82.112.0/20", "143.55.64.0/20", "185.199.108.0/22", "192.30.252.0/22"},
+		},
+		{
+			preset:  "npm",
+			domains: []string{"registry.npmjs.org", "registry.yarnpkg.com", "nodejs.org"},
+		},
+		{
+			preset:  "pypi",
+			domains: []string{"pypi.org", "files.pythonhosted.org"},
+		},
+		{
+			preset: "ubuntu-apt",
+			domains: []string{
+				"archive.ubuntu.com", "security.ubuntu.com", "ports.ubuntu.com",
+				"ppa.launchpadcontent.net", "keyserver.ubuntu.com",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.preset, func(t *testing.T) {
+			rules, err := ExpandPresets([]string{tt.preset})
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.domains, ruleValues(rules, "domain"))
+			assert.Equal(t, tt.cidrs, ruleValues(rules, "cidr"))
+			for _, r := range rules {
+				assert.Equal(t, tt.preset+" preset", r.Comment)
+			}
+
+			// Every preset must pass validation on its own
+			config := &multipass.NetworkConfig{Mode: multipass.NetworkModeAllowlist, Rules: rules}
+			assert.NoError(t, ValidateConfig(config))
+		})
+	}
+}
+
+func TestExpandPresets_Several(t *testing.T) {
+	rules, err := ExpandPresets([]string{"npm", "PyPI", "npm"})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"registry.npmjs.org", "registry.yarnpkg.com", "nodejs.org",
+		"pypi.org", "files.pythonhosted.org",
+	}, ruleValues(rules, "domain"))
+}
+
+func TestExpandPresets_Unknown(t *testing.T) {
+	_, err := ExpandPresets([]string{"github", "cargo"})
+	assert.ErrorContains(t, err, `unknown preset "cargo"`)
+	assert.ErrorContains(t, err, "github, npm, pypi, ubuntu-apt")
+}
+
+func TestPresetNames(t *testing.T) {
+	assert.Equal(t, []string{"github", "npm", "pypi", "ubuntu-apt"}, PresetNames())
+}
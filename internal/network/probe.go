@@ -0,0 +1,144 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+const (
+	// DefaultProbeTimeout is how long each host gets to answer
+	DefaultProbeTimeout = 5 * time.Second
+
+	// MaxProbeTimeout caps the per-host timeout
+	MaxProbeTimeout = 30 * time.Second
+
+	// MaxProbeHosts caps how many hosts one probe checks
+	MaxProbeHosts = 20
+
+	// probeParallel is how many hosts are checked at once
+	probeParallel = 4
+)
+
+// ProbeResult is whether a VM could reach one host
+type ProbeResult struct {
+	Host       string `json:"host"`
+	Reachable  bool   `json:"reachable"`
+	HTTPStatus int    `json:"http_status,omitempty"` // for HTTPS checks; any status means the host answered
+	Error      string `json:"error,omitempty"`       // why it wasn't reachable, e.g. curl's timeout message
+}
+
+// ValidateProbeHost checks a host to probe: a domain or IPv4 address,
+// optionally with a :port
+func ValidateProbeHost(host string) error {
+	name, port, err := splitProbeHost(host)
+	if err != nil {
+		return err
+	}
+	if !isValidIP(name) && (len(name) > maxDomainLen || !domainPattern.MatchString(name)) {
+		return fmt.Errorf("invalid host %q (must be a domain or IPv4 address)", host)
+	}
+	if port < 0 {
+		return fmt.Errorf("invalid port in %q", host)
+	}
+	return nil
+}
+
+// splitProbeHost splits host[:port]; port is 0 when none is given and -1
+// when it isn't a valid port
+func splitProbeHost(host string) (string, int, error) {
+	if host == "" {
+		return "", 0, fmt.Errorf("host cannot be empty")
+	}
+	if !strings.Contains(host, ":") {
+		return host, 0, nil
+	}
+	name, portStr, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid host %q: %w", host, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return name, -1, nil
+	}
+	return name, port, nil
+}
+
+// ProbeHosts checks from inside a VM whether each host can be reached, to
+// confirm applied network rules behave as intended. A plain host is
+// fetched over HTTPS with curl; host:port gets a TCP connect. Hosts must
+// pass ValidateProbeHost, and the VM must be running. Results are in the
+// order of hosts.
+func ProbeHosts(mp multipass.Client, vmName string, hosts []string, timeout time.Duration) []ProbeResult {
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+	results := make([]ProbeResult, len(hosts))
+	slots := make(chan struct{}, probeParallel)
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i] = probeHost(mp, vmName, host, timeout)
+		}(i, host)
+	}
+	wg.Wait()
+	return results
+}
+
+// probeHost checks one host
+func probeHost(mp multipass.Client, vmName, host string, timeout time.Duration) ProbeResult {
+	result := ProbeResult{Host: host}
+	name, port, err := splitProbeHost(host)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	secs := strconv.Itoa(max(int(timeout.Round(time.Second)/time.Second), 1))
+
+	if port == 0 {
+		out, err := mp.Exec(vmName, "curl", "-sS", "-o", "/dev/null", "-w", "%{http_code}",
+			"--max-time", secs, "https://"+name)
+		if err != nil {
+			result.Error = probeError(err, "")
+			return result
+		}
+		result.Reachable = true
+		result.HTTPStatus, _ = strconv.Atoi(strings.TrimSpace(out))
+		return result
+	}
+
+	// The host and port are passed as arguments, not spliced into the script
+	_, err = mp.Exec(vmName, "timeout", secs, "bash", "-c", `exec 3<>"/dev/tcp/$0/$1"`, name, strconv.Itoa(port))
+	if err != nil {
+		result.Error = probeError(err, fmt.Sprintf("no connection to port %d within %ss", port, secs))
+		return result
+	}
+	result.Reachable = true
+	return result
+}
+
+// probeError is the reason a check failed: what the command printed, if
+// anything, else silent (a command that failed without saying why), else
+// the error itself
+func probeError(err error, silent string) string {
+	var mpErr *multipass.MultipassError
+	if errors.As(err, &mpErr) {
+		if stderr := strings.TrimSpace(mpErr.Stderr); stderr != "" {
+			return stderr
+		}
+		if silent != "" {
+			return silent
+		}
+	}
+	return err.Error()
+}
@@ -0,0 +1,62 @@
+package network
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// curlCmd is the command ProbeHosts runs for an HTTPS check
+func curlCmd(host, secs string) []string {
+	return []string{"curl", "-sS", "-o", "/dev/null", "-w", "%{http_code}", "--max-time", secs, "https://" + host}
+}
+
+func TestProbeHosts(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Exec", "vm", curlCmd("github.com", "5")).Return("200", nil)
+	mockMP.On("Exec", "vm", curlCmd("example.com", "5")).Return("", &multipass.MultipassError{
+		Command: "exec",
+		Stderr:  "curl: (28) Connection timed out after 5001 milliseconds\n",
+		Err:     errors.New("exit status 28"),
+	})
+	mockMP.On("Exec", "vm", curlCmd("auth.example.org", "5")).Return("403", nil)
+	mockMP.On("Exec", "vm", []string{"timeout", "5", "bash", "-c", `exec 3<>"/dev/tcp/$0/$1"`, "10.0.0.5", "5432"}).Return("", nil)
+	mockMP.On("Exec", "vm", []string{"timeout", "5", "bash", "-c", `exec 3<>"/dev/tcp/$0/$1"`, "10.0.0.6", "22"}).Return("", &multipass.MultipassError{
+		Command: "exec",
+		Err:     errors.New("exit status 124"),
+	})
+
+	results := ProbeHosts(mockMP, "vm", []string{"github.com", "example.com", "auth.example.org", "10.0.0.5:5432", "10.0.0.6:22"}, 0)
+
+	assert.Equal(t, []ProbeResult{
+		{Host: "github.com", Reachable: true, HTTPStatus: 200},
+		{Host: "example.com", Error: "curl: (28) Connection timed out after 5001 milliseconds"},
+		// Any HTTP answer means the rules let the connection through
+		{Host: "auth.example.org", Reachable: true, HTTPStatus: 403},
+		{Host: "10.0.0.5:5432", Reachable: true},
+		{Host: "10.0.0.6:22", Error: "no connection to port 22 within 5s"},
+	}, results)
+}
+
+func TestProbeHosts_Timeout(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Exec", "vm", curlCmd("github.com", "12")).Return("200", nil)
+	mockMP.On("Exec", "vm", curlCmd("pypi.org", "1")).Return("200", nil)
+
+	assert.True(t, ProbeHosts(mockMP, "vm", []string{"github.com"}, 12*time.Second)[0].Reachable)
+	// Sub-second timeouts round up, since curl treats 0 as none
+	assert.True(t, ProbeHosts(mockMP, "vm", []string{"pypi.org"}, 100*time.Millisecond)[0].Reachable)
+}
+
+func TestValidateProbeHost(t *testing.T) {
+	for _, host := range []string{"github.com", "10.0.0.1", "db.internal:5432", "1.2.3.4:443"} {
+		assert.NoError(t, ValidateProbeHost(host), host)
+	}
+	for _, host := range []string{"", "github.com; rm -rf /", "$(id)", "host:0", "host:99999", "host:ssh", "-o.com", "[::1]:22"} {
+		assert.Error(t, ValidateProbeHost(host), host)
+	}
+}
@@ -3,12 +3,27 @@ package network
 import (
 	"bytes"
 	"fmt"
+	"net"
+	"regexp"
 	"strings"
 	"text/template"
+	"unicode"
 
 	"github.com/mjshashank/dabbi/internal/multipass"
 )
 
+// domainPattern matches RFC 1123 host names: dot-separated labels of letters,
+// digits, and inner hyphens, with an optional trailing dot
+var domainPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*\.?$`)
+
+// shellMetachars can't appear in any rule value. Values are written unquoted
+// into the rules script, so these would end or extend the iptables command.
+// Whitespace is reported by the per-type checks.
+const shellMetachars = "`$;&|<>()'\"\\*?[]{}!#~"
+
+// maxDomainLen is the longest valid DNS name
+const maxDomainLen = 253
+
 // scriptTemplate is the template for the iptables setup script
 const scriptTemplate = `#!/bin/bash
 # Dabbi Network Rules
@@ -17,14 +32,22 @@ const scriptTemplate = `#!/bin/bash
 
 set -e
 
+# Applying the rules ends a pause (see Applier.Pause)
+rm -f /run/dabbi-network-paused
+
 # Flush existing rules
 iptables -F OUTPUT 2>/dev/null || true
 iptables -F INPUT 2>/dev/null || true
 iptables -F DABBI_OUT 2>/dev/null || true
+ip6tables -F OUTPUT 2>/dev/null || true
+ip6tables -F INPUT 2>/dev/null || true
+ip6tables -F DABBI_OUT 2>/dev/null || true
 
 # Delete and recreate custom chain
 iptables -X DABBI_OUT 2>/dev/null || true
 iptables -N DABBI_OUT 2>/dev/null || true
+ip6tables -X DABBI_OUT 2>/dev/null || true
+ip6tables -N DABBI_OUT 2>/dev/null || true
 
 {{if eq .Mode "isolated"}}
 # ISOLATED MODE - No network access
@@ -48,6 +71,17 @@ if [ -n "$GATEWAY_IP" ]; then
     iptables -A INPUT -s "$GATEWAY_NET" -j ACCEPT
 fi
 
+# IPv6 gets the same base policy, or it would bypass the rules above.
+# Skipped when the kernel has no IPv6 stack, as there is nothing to bypass.
+if [ -e /proc/net/if_inet6 ]; then
+    ip6tables -P OUTPUT DROP
+    ip6tables -P INPUT DROP
+    ip6tables -A OUTPUT -o lo -j ACCEPT
+    ip6tables -A INPUT -i lo -j ACCEPT
+    ip6tables -A INPUT -m state --state ESTABLISHED,RELATED -j ACCEPT
+    ip6tables -A OUTPUT -m state --state ESTABLISHED,RELATED -j ACCEPT
+fi
+
 {{else if eq .Mode "allowlist"}}
 # ALLOWLIST MODE - Default deny, allow specific hosts
 iptables -P OUTPUT DROP
@@ -70,12 +104,51 @@ if [ -n "$GATEWAY_IP" ]; then
     iptables -A INPUT -s "$GATEWAY_NET" -j ACCEPT
 fi
 
-# Allow DNS for domain resolution (to local resolver and common DNS servers)
-iptables -A OUTPUT -p udp --dport 53 -j ACCEPT
-iptables -A OUTPUT -p tcp --dport 53 -j ACCEPT
+# IPv6 gets the same base policy, or it would bypass the rules above.
+# Skipped when the kernel has no IPv6 stack, as there is nothing to bypass.
+if [ -e /proc/net/if_inet6 ]; then
+    ip6tables -P OUTPUT DROP
+    ip6tables -P INPUT DROP
+    ip6tables -A OUTPUT -o lo -j ACCEPT
+    ip6tables -A INPUT -i lo -j ACCEPT
+    ip6tables -A INPUT -m state --state ESTABLISHED,RELATED -j ACCEPT
+    ip6tables -A OUTPUT -m state --state ESTABLISHED,RELATED -j ACCEPT
+
+    # Neighbor and router discovery, without which no IPv6 host is reachable
+    for type in router-solicitation router-advertisement neighbour-solicitation neighbour-advertisement; do
+        ip6tables -A OUTPUT -p ipv6-icmp --icmpv6-type "$type" -j ACCEPT
+        ip6tables -A INPUT -p ipv6-icmp --icmpv6-type "$type" -j ACCEPT
+    done
+fi
+
+# Allow DNS for domain resolution, only to approved resolvers so queries
+# can't leak to arbitrary DNS servers
+{{if .DNSServers}}
+DNS_SERVERS="{{range $i, $dns := .DNSServers}}{{if $i}} {{end}}{{$dns}}{{end}}"
+DNS6_SERVERS=""
+{{else}}
+# Use the VM's configured upstream resolvers (the systemd-resolved stub on
+# 127.0.0.53 is already covered by the loopback rule)
+DNS_SERVERS=$(awk '/^nameserver/ {print $2}' /run/systemd/resolve/resolv.conf /etc/resolv.conf 2>/dev/null | grep -E '^[0-9]+\.[0-9]+\.[0-9]+\.[0-9]+$' | grep -v '^127\.' | sort -u)
+# IPv6 resolvers; link-local ones (with a %zone) cannot be matched by address
+DNS6_SERVERS=$(awk '/^nameserver/ {print $2}' /run/systemd/resolve/resolv.conf /etc/resolv.conf 2>/dev/null | grep ':' | grep -v '%' | grep -v '^::1$' | sort -u)
+{{end}}
+for dns in $DNS_SERVERS; do
+    iptables -A OUTPUT -p udp -d "$dns" --dport 53 -j ACCEPT
+    iptables -A OUTPUT -p tcp -d "$dns" --dport 53 -j ACCEPT
+done
+if [ -e /proc/net/if_inet6 ]; then
+    for dns in $DNS6_SERVERS; do
+        ip6tables -A OUTPUT -p udp -d "$dns" --dport 53 -j ACCEPT
+        ip6tables -A OUTPUT -p tcp -d "$dns" --dport 53 -j ACCEPT
+    done
+fi
 
 # Jump to custom chain for user rules
 iptables -A OUTPUT -j DABBI_OUT
+if [ -e /proc/net/if_inet6 ]; then
+    ip6tables -A OUTPUT -j DABBI_OUT
+fi
 
 # User-defined allow rules
 {{range .Rules}}
@@ -101,9 +174,12 @@ done
 # BLOCKLIST MODE - Default allow, block specific hosts
 iptables -P OUTPUT ACCEPT
 iptables -P INPUT ACCEPT
+ip6tables -P OUTPUT ACCEPT 2>/dev/null || true
+ip6tables -P INPUT ACCEPT 2>/dev/null || true
 
 # Jump to custom chain for user rules
 iptables -A OUTPUT -j DABBI_OUT
+ip6tables -A OUTPUT -j DABBI_OUT 2>/dev/null || true
 
 # User-defined block rules
 {{range .Rules}}
@@ -129,6 +205,8 @@ done
 # NONE MODE - No restrictions (permissive)
 iptables -P OUTPUT ACCEPT
 iptables -P INPUT ACCEPT
+ip6tables -P OUTPUT ACCEPT 2>/dev/null || true
+ip6tables -P INPUT ACCEPT 2>/dev/null || true
 {{end}}
 
 echo "Network rules applied successfully (mode: {{.Mode}})"
@@ -154,6 +232,18 @@ func GenerateIptablesScript(config *multipass.NetworkConfig) (string, error) {
 		config = &multipass.NetworkConfig{Mode: multipass.NetworkModeNone}
 	}
 
+	// Values are interpolated into shell commands; never render unchecked ones
+	for _, dns := range config.DNSServers {
+		if !isValidIP(dns) {
+			return "", fmt.Errorf("invalid DNS server: %q (must be an IPv4 address)", dns)
+		}
+	}
+	for i, rule := range config.Rules {
+		if err := validateRule(&rule); err != nil {
+			return "", fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+
 	tmpl, err := template.New("iptables").Parse(scriptTemplate)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse template: %w", err)
@@ -178,6 +268,12 @@ func ValidateConfig(config *multipass.NetworkConfig) error {
 		return nil
 	}
 
+	switch config.Scope {
+	case "", multipass.NetworkScopeVM, multipass.NetworkScopeHost:
+	default:
+		return fmt.Errorf("invalid network scope: %q (must be vm or host)", config.Scope)
+	}
+
 	switch config.Mode {
 	case multipass.NetworkModeNone, multipass.NetworkModeIsolated:
 		// These modes don't need rules
@@ -191,6 +287,13 @@ func ValidateConfig(config *multipass.NetworkConfig) error {
 		return fmt.Errorf("invalid network mode: %q", config.Mode)
 	}
 
+	// DNS servers are written into the generated script
+	for _, dns := range config.DNSServers {
+		if !isValidIP(dns) {
+			return fmt.Errorf("invalid DNS server: %q (must be an IPv4 address)", dns)
+		}
+	}
+
 	// Validate each rule
 	for i, rule := range config.Rules {
 		if err := validateRule(&rule); err != nil {
@@ -205,6 +308,9 @@ func validateRule(rule *multipass.NetworkRule) error {
 	if rule.Value == "" {
 		return fmt.Errorf("rule value cannot be empty")
 	}
+	if strings.ContainsAny(rule.Value, shellMetachars) {
+		return fmt.Errorf("rule value contains shell metacharacters: %q", rule.Value)
+	}
 
 	switch rule.Type {
 	case "ip":
@@ -213,19 +319,30 @@ func validateRule(rule *multipass.NetworkRule) error {
 			return fmt.Errorf("invalid IP address: %q", rule.Value)
 		}
 	case "cidr":
-		// Basic CIDR validation
 		if !strings.Contains(rule.Value, "/") {
 			return fmt.Errorf("CIDR must contain /: %q", rule.Value)
 		}
+		// iptables rules are IPv4-only
+		ip, _, err := net.ParseCIDR(rule.Value)
+		if err != nil || ip.To4() == nil || !isValidIP(strings.SplitN(rule.Value, "/", 2)[0]) {
+			return fmt.Errorf("invalid IPv4 CIDR: %q", rule.Value)
+		}
 	case "domain":
-		// Basic domain validation
 		if strings.Contains(rule.Value, " ") {
 			return fmt.Errorf("domain cannot contain spaces: %q", rule.Value)
 		}
+		if len(rule.Value) > maxDomainLen || !domainPattern.MatchString(rule.Value) {
+			return fmt.Errorf("invalid domain: %q", rule.Value)
+		}
 	default:
 		return fmt.Errorf("invalid rule type: %q (must be ip, cidr, or domain)", rule.Type)
 	}
 
+	// Comments are written into the generated script, so they must stay on one line
+	if strings.IndexFunc(rule.Comment, unicode.IsControl) >= 0 {
+		return fmt.Errorf("comment cannot contain control characters: %q", rule.Comment)
+	}
+
 	return nil
 }
 
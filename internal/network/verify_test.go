@@ -0,0 +1,214 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// allowlistLive is 'iptables -S' in a VM with an allowlist of 1.1.1.1 and
+// 10.0.0.0/8 applied
+const allowlistLive = `-P INPUT DROP
+-P FORWARD ACCEPT
+-P OUTPUT DROP
+-N DABBI_OUT
+-A INPUT -i lo -j ACCEPT
+-A INPUT -m state --state RELATED,ESTABLISHED -j ACCEPT
+-A OUTPUT -o lo -j ACCEPT
+-A OUTPUT -p udp -d 192.168.64.1/32 --dport 53 -j ACCEPT
+-A OUTPUT -j DABBI_OUT
+-A DABBI_OUT -d 1.1.1.1/32 -j ACCEPT
+-A DABBI_OUT -d 10.0.0.0/8 -j ACCEPT
+`
+
+// allowlistLive6 is 'ip6tables -S' in the same VM
+const allowlistLive6 = `-P INPUT DROP
+-P FORWARD ACCEPT
+-P OUTPUT DROP
+-N DABBI_OUT
+-A INPUT -i lo -j ACCEPT
+-A INPUT -m state --state RELATED,ESTABLISHED -j ACCEPT
+-A INPUT -p ipv6-icmp -m icmp6 --icmpv6-type 134 -j ACCEPT
+-A OUTPUT -o lo -j ACCEPT
+-A OUTPUT -p ipv6-icmp -m icmp6 --icmpv6-type 133 -j ACCEPT
+-A OUTPUT -d fd00::1/128 -p udp -m udp --dport 53 -j ACCEPT
+-A OUTPUT -j DABBI_OUT
+`
+
+// parseLive parses 'iptables -S' and 'ip6tables -S' output as Verify does
+func parseLive(live, live6 string) []IptablesRule {
+	rules := ParseIptablesRules(live)
+	for _, rule := range ParseIptablesRules(live6) {
+		rule.IPv6 = true
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+var allowlistConfig = &multipass.NetworkConfig{
+	Mode: multipass.NetworkModeAllowlist,
+	Rules: []multipass.NetworkRule{
+		{Type: "ip", Value: "1.1.1.1"},
+		{Type: "cidr", Value: "10.0.0.0/8"},
+	},
+}
+
+func TestParseIptablesRules(t *testing.T) {
+	rules := ParseIptablesRules(allowlistLive)
+
+	require.Len(t, rules, 10)
+	assert.Equal(t, IptablesRule{Chain: "INPUT", Policy: true, Target: "DROP"}, rules[0])
+	assert.Equal(t, IptablesRule{Chain: "OUTPUT", Target: "ACCEPT", Dest: "192.168.64.1/32", Extra: "-p udp --dport 53"}, rules[6])
+	assert.Equal(t, IptablesRule{Chain: "DABBI_OUT", Dest: "1.1.1.1/32", Target: "ACCEPT"}, rules[8])
+
+	for _, rule := range []string{"-P OUTPUT DROP", "-A OUTPUT -j DABBI_OUT", "-A DABBI_OUT -d 10.0.0.0/8 -j ACCEPT"} {
+		assert.Equal(t, rule, ParseIptablesRules(rule)[0].String())
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *multipass.NetworkConfig
+		live   string
+		live6  string
+		want   []string
+	}{
+		{
+			name:   "in sync",
+			config: allowlistConfig,
+			live:   allowlistLive,
+		},
+		{
+			name:   "in sync with IPv6",
+			config: allowlistConfig,
+			live:   allowlistLive,
+			live6:  allowlistLive6,
+		},
+		{
+			name:   "flushed",
+			config: allowlistConfig,
+			live:   "-P INPUT ACCEPT\n-P FORWARD ACCEPT\n-P OUTPUT ACCEPT\n-N DABBI_OUT\n",
+			want: []string{
+				"missing: -P INPUT DROP",
+				"missing: -P OUTPUT DROP",
+				"missing: -A OUTPUT -j DABBI_OUT",
+				"missing: -A DABBI_OUT -d 1.1.1.1/32 -j ACCEPT",
+				"missing: -A DABBI_OUT -d 10.0.0.0/8 -j ACCEPT",
+			},
+		},
+		{
+			name:   "rule added by hand",
+			config: allowlistConfig,
+			live:   allowlistLive + "-A DABBI_OUT -d 203.0.113.7/32 -j ACCEPT\n",
+			want:   []string{"unexpected: -A DABBI_OUT -d 203.0.113.7/32 -j ACCEPT"},
+		},
+		{
+			name:   "base chains changed by hand",
+			config: allowlistConfig,
+			live: allowlistLive +
+				"-A OUTPUT -p tcp -m tcp --dport 443 -j ACCEPT\n" +
+				"-A OUTPUT -d 203.0.113.0/24 -j ACCEPT\n" +
+				"-A INPUT -s 192.168.64.0/24 -j ACCEPT\n" +
+				"-A FORWARD -j ACCEPT\n",
+			want: []string{
+				"unexpected: -A OUTPUT -p tcp -m tcp --dport 443 -j ACCEPT",
+				"unexpected: -A OUTPUT -d 203.0.113.0/24 -j ACCEPT",
+			},
+		},
+		{
+			name:   "IPv6 flushed",
+			config: allowlistConfig,
+			live:   allowlistLive,
+			live6:  "-P INPUT ACCEPT\n-P FORWARD ACCEPT\n-P OUTPUT ACCEPT\n-A OUTPUT -j ACCEPT\n",
+			want: []string{
+				"missing: -P INPUT DROP (IPv6)",
+				"missing: -P OUTPUT DROP (IPv6)",
+				"missing: -A OUTPUT -j DABBI_OUT (IPv6)",
+				"unexpected: -A OUTPUT -j ACCEPT (IPv6)",
+			},
+		},
+		{
+			name: "resolver other than the configured one",
+			config: &multipass.NetworkConfig{
+				Mode:       multipass.NetworkModeAllowlist,
+				DNSServers: []string{"1.1.1.1"},
+				Rules:      allowlistConfig.Rules,
+			},
+			live: allowlistLive,
+			want: []string{"unexpected: -A OUTPUT -d 192.168.64.1/32 -p udp --dport 53 -j ACCEPT"},
+		},
+		{
+			name: "domain rules allow extra addresses",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeAllowlist,
+				Rules: append([]multipass.NetworkRule{{Type: "domain", Value: "github.com"}}, allowlistConfig.Rules...),
+			},
+			live:  allowlistLive + "-A DABBI_OUT -d 140.82.121.4/32 -j ACCEPT\n",
+			live6: allowlistLive6 + "-A DABBI_OUT -d 2606:50c0::154/128 -j ACCEPT\n",
+		},
+		{
+			name: "domain rules don't cover the base chains",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeAllowlist,
+				Rules: []multipass.NetworkRule{{Type: "domain", Value: "github.com"}},
+			},
+			live: allowlistLive + "-A OUTPUT -d 140.82.121.4/32 -j ACCEPT\n",
+			want: []string{"unexpected: -A OUTPUT -d 140.82.121.4/32 -j ACCEPT"},
+		},
+		{
+			name: "blocklist rule removed",
+			config: &multipass.NetworkConfig{
+				Mode:  multipass.NetworkModeBlocklist,
+				Rules: []multipass.NetworkRule{{Type: "cidr", Value: "10.1.2.3/8"}},
+			},
+			live: "-P OUTPUT ACCEPT\n-A OUTPUT -j DABBI_OUT\n",
+			want: []string{"missing: -A DABBI_OUT -d 10.0.0.0/8 -j DROP"},
+		},
+		{
+			name:   "none left locked down",
+			config: nil,
+			live:   "-P OUTPUT DROP\n-A OUTPUT -o lo -j ACCEPT\n",
+			want:   []string{"missing: -P OUTPUT ACCEPT", "unexpected: -A OUTPUT -o lo -j ACCEPT"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range DiffRules(tt.config, parseLive(tt.live, tt.live6)) {
+				got = append(got, d.String())
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestApplier_Verify(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("ExecWithTimeout", "test-vm", configReadTimeout, []string{"sudo", "iptables", "-S"}).
+		Return(allowlistLive+"-A DABBI_OUT -d 203.0.113.7/32 -j ACCEPT\n", nil)
+	mockMP.On("ExecWithTimeout", "test-vm", configReadTimeout, []string{"sudo", "sh", "-c", "[ ! -e /proc/net/if_inet6 ] || ip6tables -S"}).
+		Return(allowlistLive6+"-A OUTPUT -j ACCEPT\n", nil)
+
+	drift, err := NewApplier(mockMP).Verify("test-vm", allowlistConfig)
+
+	require.NoError(t, err)
+	assert.Equal(t, []Drift{
+		{Kind: "unexpected", Rule: IptablesRule{Chain: "DABBI_OUT", Dest: "203.0.113.7/32", Target: "ACCEPT"}},
+		{Kind: "unexpected", Rule: IptablesRule{Chain: "OUTPUT", Target: "ACCEPT", IPv6: true}},
+	}, drift)
+}
+
+func TestApplier_Verify_HostScope(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+
+	_, err := NewApplier(mockMP).Verify("test-vm", &multipass.NetworkConfig{Mode: multipass.NetworkModeIsolated, Scope: multipass.NetworkScopeHost})
+
+	assert.ErrorIs(t, err, ErrVerifyHostScope)
+	mockMP.AssertNotCalled(t, "ExecWithTimeout", mock.Anything, mock.Anything, mock.Anything)
+}
@@ -0,0 +1,29 @@
+package portmap
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// Port returns the port key hashes to among the count ports starting at
+// base. The same key always gets the same port, across restarts too.
+func Port(key string, base, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return base + int(h.Sum32()%uint32(count))
+}
+
+// Probe tries key's port and, while try fails, the ports after it (wrapping
+// around within the range) until one succeeds. It returns the port try
+// succeeded on, or the last error once every port in the range failed.
+func Probe(key string, base, count int, try func(port int) error) (int, error) {
+	start := Port(key, base, count) - base
+	var err error
+	for i := 0; i < count; i++ {
+		port := base + (start+i)%count
+		if err = try(port); err == nil {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free port in %d-%d: %w", base, base+count-1, err)
+}
@@ -0,0 +1,48 @@
+package portmap
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPort_Deterministic(t *testing.T) {
+	for _, key := range []string{"dev", "db:5432", "some-longer-vm-name:8080"} {
+		port := Port(key, 20000, 100)
+		assert.Equal(t, port, Port(key, 20000, 100), key)
+		assert.GreaterOrEqual(t, port, 20000, key)
+		assert.Less(t, port, 20100, key)
+	}
+	assert.NotEqual(t, Port("db:5432", 20000, 1000), Port("db:5433", 20000, 1000))
+}
+
+func TestProbe_Collision(t *testing.T) {
+	taken := map[int]bool{}
+	try := func(port int) error {
+		if taken[port] {
+			return errors.New("in use")
+		}
+		return nil
+	}
+
+	first, err := Probe("db:5432", 30000, 3, try)
+	require.NoError(t, err)
+	assert.Equal(t, Port("db:5432", 30000, 3), first)
+
+	// Taken ports are skipped in order, wrapping within the range
+	taken[first] = true
+	second, err := Probe("db:5432", 30000, 3, try)
+	require.NoError(t, err)
+	assert.Equal(t, 30000+(first-30000+1)%3, second)
+
+	taken[second] = true
+	third, err := Probe("db:5432", 30000, 3, try)
+	require.NoError(t, err)
+	assert.NotContains(t, []int{first, second}, third)
+
+	taken[third] = true
+	_, err = Probe("db:5432", 30000, 3, try)
+	assert.ErrorContains(t, err, "no free port in 30000-30002: in use")
+}
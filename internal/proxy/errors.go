@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/httpkit"
+)
+
+const errorHTML = `<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.Title}}</title>
+    <style>
+        * { box-sizing: border-box; }
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            display: flex;
+            justify-content: center;
+            align-items: center;
+            height: 100vh;
+            margin: 0;
+            background: linear-gradient(135deg, #1a1a2e 0%, #16213e 100%);
+            color: #eee;
+        }
+        .container {
+            text-align: center;
+            padding: 40px;
+            max-width: 640px;
+        }
+        .status {
+            font-size: 64px;
+            font-weight: 300;
+            color: #ff6b6b;
+            margin-bottom: 10px;
+        }
+        h1 {
+            font-size: 28px;
+            margin-bottom: 10px;
+            font-weight: 500;
+        }
+        p {
+            color: #888;
+            margin: 5px 0;
+        }
+        .message {
+            color: #00d4ff;
+            font-family: monospace;
+            font-size: 16px;
+            word-break: break-word;
+        }
+        .info {
+            margin-top: 30px;
+            padding: 20px;
+            background: rgba(255,255,255,0.05);
+            border-radius: 8px;
+            font-size: 14px;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        {{if .Status}}<div class="status">{{.Status}}</div>{{end}}
+        <h1>{{.Title}}</h1>
+        <p class="message">{{.Message}}</p>
+        {{if .Hint}}<div class="info">
+            <p>{{.Hint}}</p>
+        </div>{{end}}
+        {{if .RequestID}}<p>Request ID: {{.RequestID}}</p>{{end}}
+    </div>
+</body>
+</html>`
+
+var errorTmpl = template.Must(template.New("error").Parse(errorHTML))
+
+// errorPage describes a proxy error. Browsers get Title, Message, and Hint
+// as an HTML page; other clients get Code and Message as JSON or plain text.
+// serveError fills in RequestID.
+type errorPage struct {
+	Status    int
+	Code      string
+	Title     string
+	Message   string
+	Hint      string
+	RequestID string
+}
+
+// serveError writes e in the format the client asked for: HTML for browsers,
+// the API's {"error": {"code", "message"}} shape for JSON clients, and plain
+// text for everything else (curl, scripts)
+func serveError(w http.ResponseWriter, req *http.Request, e errorPage) {
+	accept := req.Header.Get("Accept")
+	e.RequestID = httpkit.GetRequestID(req)
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+
+	switch {
+	case strings.Contains(accept, "text/html"):
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(e.Status)
+		errorTmpl.Execute(w, e)
+
+	case strings.Contains(accept, "application/json"):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(e.Status)
+		body := map[string]string{"code": e.Code, "message": e.Message}
+		if e.RequestID != "" {
+			body["request_id"] = e.RequestID
+		}
+		json.NewEncoder(w).Encode(map[string]map[string]string{"error": body})
+
+	default:
+		http.Error(w, e.Message, e.Status)
+	}
+}
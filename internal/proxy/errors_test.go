@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/httpkit"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeError_ContentNegotiation(t *testing.T) {
+	page := errorPage{
+		Status:  http.StatusNotFound,
+		Code:    "VM_NOT_FOUND",
+		Title:   "VM not found",
+		Message: "VM '<dev>' not found",
+		Hint:    "Check the VM name.",
+	}
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+	}{
+		{"browser", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"json_client", "application/json", "application/json"},
+		{"curl", "*/*", "text/plain; charset=utf-8"},
+		{"no_accept", "", "text/plain; charset=utf-8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+
+			serveError(rec, req, page)
+
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+			assert.Equal(t, tt.contentType, rec.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestServeError_Bodies(t *testing.T) {
+	page := errorPage{
+		Status:  http.StatusServiceUnavailable,
+		Code:    "VM_UNAVAILABLE",
+		Title:   "VM unavailable",
+		Message: "VM '<script>' has no IP address",
+		Hint:    "Try again in a moment.",
+	}
+
+	send := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		serveError(rec, req, page)
+		return rec
+	}
+
+	// HTML is escaped and includes the hint
+	body := send("text/html").Body.String()
+	assert.Contains(t, body, "<h1>VM unavailable</h1>")
+	assert.Contains(t, body, "&lt;script&gt;")
+	assert.NotContains(t, body, "<script>")
+	assert.Contains(t, body, "Try again in a moment.")
+
+	// JSON matches the API error shape
+	var resp struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(send("application/json").Body).Decode(&resp))
+	assert.Equal(t, "VM_UNAVAILABLE", resp.Error.Code)
+	assert.Equal(t, page.Message, resp.Error.Message)
+
+	// Plain text is just the message
+	assert.Equal(t, page.Message+"\n", send("*/*").Body.String())
+}
+
+func TestServeError_RequestID(t *testing.T) {
+	h := httpkit.RequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		serveError(w, req, errorPage{Status: http.StatusBadGateway, Code: "BAD_GATEWAY", Message: "Proxy error"})
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set(httpkit.RequestIDHeader, "trace-1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var resp struct {
+		Error struct {
+			RequestID string `json:"request_id"`
+		} `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, "trace-1", resp.Error.RequestID)
+	assert.Equal(t, "trace-1", rec.Header().Get(httpkit.RequestIDHeader))
+}
+
+func TestRouter_VMNotFound_HTML(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "ghost").Return(nil, errors.New("instance \"ghost\" does not exist"))
+	r := NewRouter(mockMP)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "ghost-8080.localhost"
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+
+	r.Middleware(http.NotFoundHandler()).ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rec.Body.String(), "VM &#39;ghost&#39; not found")
+}
+
+func TestRouter_ProxyError_HTML(t *testing.T) {
+	// Grab a free port, then close it so nothing is listening
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	r := NewRouter(nil)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+
+	r.proxyRequest(rec, req, "test-vm", "127.0.0.1", port)
+
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, rec.Body.String(), "Nothing is answering on port "+strconv.Itoa(port))
+}
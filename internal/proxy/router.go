@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -9,6 +10,9 @@ import (
 	"strconv"
 	"sync"
 
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/httpkit"
+	"github.com/mjshashank/dabbi/internal/labels"
 	"github.com/mjshashank/dabbi/internal/multipass"
 )
 
@@ -17,11 +21,23 @@ var hostPattern = regexp.MustCompile(`^([a-zA-Z0-9][a-zA-Z0-9-]*)-(\d+)\.(localh
 
 const agentPort = 1234 // OpenCode port inside VM
 
+// HealthPathLabel is the VM label naming an HTTP path that must return 2xx
+// before a woken VM is proxied to, e.g. "/healthz"
+const HealthPathLabel = "dabbi.health-path"
+
 // Router handles HTTP routing to VMs based on Host header
 type Router struct {
-	mp        multipass.Client
-	authToken string
-	waking    sync.Map // map[vmName]bool - tracks VMs currently waking
+	mp           multipass.Client
+	authToken    string
+	secureCookie bool               // mark the agent auth cookie Secure (only when serving TLS)
+	cookieDomain string             // share the agent auth cookie with subdomains (empty = host-only)
+	subnet       *net.IPNet         // preferred VM network when a VM has several IPs
+	labels       *labels.Store      // per-VM health paths (see HealthPathLabel)
+	stripHeaders []string           // request headers removed before forwarding
+	setHeaders   map[string]string  // request headers added before forwarding
+	loadingPage  config.LoadingPage // customizations for the wake loading page
+	waking       sync.Map           // map[vmName]*wake - tracks VMs currently waking
+	woken        sync.Map           // map[vmName]string - IP a woken VM's port answered on
 }
 
 // NewRouter creates a new proxy router
@@ -36,6 +52,41 @@ func (r *Router) SetAuthToken(token string) {
 	r.authToken = token
 }
 
+// SetSecureCookie controls whether the agent auth cookie is marked Secure.
+// Browsers drop Secure cookies over plain HTTP, so only enable it with TLS.
+func (r *Router) SetSecureCookie(secure bool) {
+	r.secureCookie = secure
+}
+
+// SetPreferredSubnet sets the network whose VM addresses are proxied to first
+func (r *Router) SetPreferredSubnet(subnet *net.IPNet) {
+	r.subnet = subnet
+}
+
+// SetLabels sets the store read for per-VM health paths
+func (r *Router) SetLabels(ls *labels.Store) {
+	r.labels = ls
+}
+
+// SetHeaderPolicy configures request headers removed from and added to every
+// proxied request. Headers are stripped first, so a set header always wins.
+func (r *Router) SetHeaderPolicy(strip []string, set map[string]string) {
+	r.stripHeaders = strip
+	r.setHeaders = set
+}
+
+// SetCookieDomain scopes the agent auth cookie to a parent domain such as
+// ".example.com" and relaxes SameSite to Lax so it follows cross-subdomain
+// navigations from the UI. Empty keeps the cookie host-only and Strict.
+func (r *Router) SetCookieDomain(domain string) {
+	r.cookieDomain = domain
+}
+
+// SetLoadingPage customizes the page shown while a VM wakes
+func (r *Router) SetLoadingPage(page config.LoadingPage) {
+	r.loadingPage = page
+}
+
 // Middleware returns middleware that routes requests to VMs based on Host header
 func (r *Router) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -46,6 +97,10 @@ func (r *Router) Middleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// VM apps stream, serve large files, and hold websockets open, so
+		// the daemon's read/write timeouts (meant for its API) don't apply
+		httpkit.LiftDeadlines(w)
+
 		r.handleVMRequest(w, req, vmName, port)
 	})
 }
@@ -95,9 +150,10 @@ func (r *Router) checkAgentAuth(w http.ResponseWriter, req *http.Request) bool {
 			Name:     agentAuthCookie,
 			Value:    token,
 			Path:     "/",
+			Domain:   r.cookieDomain,
 			HttpOnly: true,
-			Secure:   true,
-			SameSite: http.SameSiteStrictMode,
+			Secure:   r.secureCookie,
+			SameSite: httpkit.CookieSameSite(r.cookieDomain),
 			MaxAge:   86400, // 24 hours
 		})
 	}
@@ -114,10 +170,49 @@ func (r *Router) handleVMRequest(w http.ResponseWriter, req *http.Request, vmNam
 		}
 	}
 
+	// Handled before the state checks, since it must not wake the VM
+	if req.URL.Path == cancelWakePath {
+		r.serveWakeCancelled(w, req, vmName)
+		return
+	}
+
 	// Get VM info
 	info, err := r.mp.Info(vmName)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("VM '%s' not found", vmName), http.StatusNotFound)
+		serveError(w, req, errorPage{
+			Status:  http.StatusNotFound,
+			Code:    "VM_NOT_FOUND",
+			Title:   "VM not found",
+			Message: fmt.Sprintf("VM '%s' not found", vmName),
+			Hint:    "Check the VM name in the address, or create it with dabbi create.",
+		})
+		return
+	}
+
+	if !multipass.CanProxy(info.State) {
+		if info.State == multipass.StateDeleted {
+			serveError(w, req, errorPage{
+				Status:  http.StatusNotFound,
+				Code:    "VM_NOT_FOUND",
+				Title:   "VM deleted",
+				Message: fmt.Sprintf("VM '%s' is deleted", vmName),
+				Hint:    "Recover it with multipass recover, or purge it and create a new one.",
+			})
+			return
+		}
+		serveError(w, req, errorPage{
+			Status:  http.StatusServiceUnavailable,
+			Code:    "VM_UNAVAILABLE",
+			Title:   "VM unavailable",
+			Message: fmt.Sprintf("VM in unexpected state: %s", info.State),
+			Hint:    "The VM may be starting or stopping. Try again in a moment.",
+		})
+		return
+	}
+
+	// The loading page polls this until the VM is ready
+	if req.URL.Path == readyPath {
+		r.serveReady(w, vmName, info.State)
 		return
 	}
 
@@ -128,21 +223,46 @@ func (r *Router) handleVMRequest(w http.ResponseWriter, req *http.Request, vmNam
 		return
 
 	case multipass.StateRunning:
-		// Get IP
-		if len(info.IPv4) == 0 {
-			http.Error(w, "VM has no IP address", http.StatusServiceUnavailable)
+		// Keep serving the loading page until a woken VM's port is ready
+		if _, waking := r.waking.Load(vmName); waking {
+			r.serveLoadingPage(w, vmName, port)
 			return
 		}
-		r.proxyRequest(w, req, info.IPv4[0], port)
 
-	default:
-		http.Error(w, fmt.Sprintf("VM in unexpected state: %s", info.State), http.StatusServiceUnavailable)
+		vmIP := r.vmIP(vmName, info, port)
+		if vmIP == "" {
+			serveError(w, req, errorPage{
+				Status:  http.StatusServiceUnavailable,
+				Code:    "VM_UNAVAILABLE",
+				Title:   "VM unavailable",
+				Message: "VM has no IP address",
+				Hint:    "The VM's network may still be coming up. Try again in a moment.",
+			})
+			return
+		}
+		r.proxyRequest(w, req, vmName, vmIP, port)
+	}
+}
+
+// vmIP returns the IP to proxy a running VM's port to: the one its port
+// answered on when it was woken, while the VM still has it, else the
+// address picked from its current IPs
+func (r *Router) vmIP(vmName string, info *multipass.InstanceInfo, port int) string {
+	if v, ok := r.woken.Load(vmName); ok {
+		ip := v.(string)
+		for _, cur := range info.IPv4 {
+			if cur == ip {
+				return ip
+			}
+		}
+		r.woken.Delete(vmName)
 	}
+	return multipass.PickReachableIP(vmName, info, port, r.subnet)
 }
 
 // proxyRequest forwards the request to the VM using httputil.ReverseProxy
-func (r *Router) proxyRequest(w http.ResponseWriter, req *http.Request, vmIP string, port int) {
-	targetHost := fmt.Sprintf("%s:%d", vmIP, port)
+func (r *Router) proxyRequest(w http.ResponseWriter, req *http.Request, vmName, vmIP string, port int) {
+	targetHost := net.JoinHostPort(vmIP, strconv.Itoa(port))
 	target, err := url.Parse(fmt.Sprintf("http://%s", targetHost))
 	if err != nil {
 		http.Error(w, "Invalid target URL", http.StatusInternalServerError)
@@ -163,12 +283,50 @@ func (r *Router) proxyRequest(w http.ResponseWriter, req *http.Request, vmIP str
 		// Set forwarded headers
 		req.Header.Set("X-Forwarded-Host", req.Host)
 		req.Header.Set("X-Forwarded-Proto", "https")
+		// Pass the correlation ID on so the app's logs can be matched to ours
+		if id := httpkit.GetRequestID(req); id != "" {
+			req.Header.Set(httpkit.RequestIDHeader, id)
+		}
+		r.rewriteHeaders(req)
 	}
 
 	// Custom error handler
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		http.Error(w, fmt.Sprintf("Proxy error: %v", err), http.StatusBadGateway)
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		// The VM may have moved to another of its addresses
+		r.woken.Delete(vmName)
+		multipass.ForgetReachableIP(vmName)
+		serveError(w, req, errorPage{
+			Status:  http.StatusBadGateway,
+			Code:    "BAD_GATEWAY",
+			Title:   fmt.Sprintf("Nothing is answering on port %d", port),
+			Message: fmt.Sprintf("Proxy error: %v", err),
+			Hint:    "Check that the app in the VM is running and listening on 0.0.0.0, not just localhost.",
+		})
 	}
 
 	proxy.ServeHTTP(w, req)
 }
+
+// rewriteHeaders removes the daemon's own credentials from a request bound
+// for a VM, then applies the configured header policy
+func (r *Router) rewriteHeaders(req *http.Request) {
+	req.Header.Del("X-Dabbi-Token")
+	if auth := req.Header.Get("Authorization"); r.authToken != "" && auth == "Bearer "+r.authToken {
+		req.Header.Del("Authorization")
+	}
+	if cookies := req.Cookies(); len(cookies) > 0 {
+		req.Header.Del("Cookie")
+		for _, c := range cookies {
+			if c.Name != httpkit.AuthCookieName && c.Name != agentAuthCookie {
+				req.AddCookie(c)
+			}
+		}
+	}
+
+	for _, name := range r.stripHeaders {
+		req.Header.Del(name)
+	}
+	for name, value := range r.setHeaders {
+		req.Header.Set(name, value)
+	}
+}
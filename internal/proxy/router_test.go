@@ -2,10 +2,12 @@ package proxy
 
 import (
 	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/mjshashank/dabbi/internal/httpkit"
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/testutil"
 	"github.com/stretchr/testify/assert"
@@ -60,6 +62,23 @@ func TestParseHost(t *testing.T) {
 	}
 }
 
+func TestParseHost_PortSuffixedVMName(t *testing.T) {
+	// The last -<digits> is always the port, so a VM named "api-8080" is
+	// reachable, but a host naming it alone reaches VM "api" instead. That's
+	// why new VM names can't end in -<digits> (see multipass.ValidateVMName).
+	r := NewRouter(nil)
+
+	vm, port, ok := r.parseHost("api-8080-3000.localhost")
+	require.True(t, ok)
+	assert.Equal(t, "api-8080", vm)
+	assert.Equal(t, 3000, port)
+
+	vm, port, ok = r.parseHost("api-8080.localhost")
+	require.True(t, ok)
+	assert.Equal(t, "api", vm)
+	assert.Equal(t, 8080, port)
+}
+
 func TestRouter_Middleware_PassesThrough(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
 	r := NewRouter(mockMP)
@@ -195,6 +214,22 @@ func TestRouter_HandleVMRequest_UnexpectedState(t *testing.T) {
 	mockMP.AssertExpectations(t)
 }
 
+func TestRouter_HandleVMRequest_Deleted(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "gone-vm").Return(&multipass.InstanceInfo{State: multipass.StateDeleted}, nil)
+
+	r := NewRouter(mockMP)
+
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	rec := httptest.NewRecorder()
+
+	r.handleVMRequest(rec, req, "gone-vm", 8080)
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), "is deleted")
+	mockMP.AssertNotCalled(t, "Start", "gone-vm")
+}
+
 func TestNewRouter(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
 	r := NewRouter(mockMP)
@@ -203,6 +238,132 @@ func TestNewRouter(t *testing.T) {
 	assert.Equal(t, mockMP, r.mp)
 }
 
+func TestRouter_CheckAgentAuth_CookieSecureFollowsTLS(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		r := NewRouter(new(testutil.MockMultipassClient))
+		r.SetAuthToken("secret")
+		r.SetSecureCookie(secure)
+
+		req := httptest.NewRequest("GET", "/?token=secret", nil)
+		rec := httptest.NewRecorder()
+		require.True(t, r.checkAgentAuth(rec, req))
+
+		cookies := rec.Result().Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, agentAuthCookie, cookies[0].Name)
+		assert.Equal(t, secure, cookies[0].Secure)
+	}
+}
+
+func TestRouter_CheckAgentAuth_CookieDomain(t *testing.T) {
+	r := NewRouter(new(testutil.MockMultipassClient))
+	r.SetAuthToken("secret")
+
+	// Host-only and Strict by default
+	rec := httptest.NewRecorder()
+	require.True(t, r.checkAgentAuth(rec, httptest.NewRequest("GET", "/?token=secret", nil)))
+	cookie := rec.Result().Cookies()[0]
+	assert.Empty(t, cookie.Domain)
+	assert.Equal(t, http.SameSiteStrictMode, cookie.SameSite)
+
+	// Shared with subdomains and Lax once a domain is configured
+	r.SetCookieDomain(".example.com")
+	rec = httptest.NewRecorder()
+	require.True(t, r.checkAgentAuth(rec, httptest.NewRequest("GET", "/?token=secret", nil)))
+	cookie = rec.Result().Cookies()[0]
+	assert.Equal(t, "example.com", cookie.Domain)
+	assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+}
+
+func TestRouter_ProxyRequest_HeaderPolicy(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	r := NewRouter(nil)
+	r.SetAuthToken("secret")
+	r.SetHeaderPolicy([]string{"X-Internal", "x-app-role"}, map[string]string{
+		"X-App-Role":  "sandbox",
+		"X-Served-By": "dabbi",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Dabbi-Token", "secret")
+	req.Header.Set("X-Internal", "1")
+	req.Header.Set("X-App-Role", "admin")
+	req.Header.Set("Accept", "text/html")
+	req.AddCookie(&http.Cookie{Name: "dabbi_auth", Value: "secret"})
+	req.AddCookie(&http.Cookie{Name: agentAuthCookie, Value: "secret"})
+	req.AddCookie(&http.Cookie{Name: "session", Value: "app"})
+	rec := httptest.NewRecorder()
+
+	r.proxyRequest(rec, req, "test-vm", "127.0.0.1", port)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// The daemon's credentials never reach the VM
+	assert.Empty(t, got.Get("Authorization"))
+	assert.Empty(t, got.Get("X-Dabbi-Token"))
+	assert.Equal(t, "session=app", got.Get("Cookie"))
+
+	// Configured strips and sets; set wins over strip
+	assert.Empty(t, got.Get("X-Internal"))
+	assert.Equal(t, "sandbox", got.Get("X-App-Role"))
+	assert.Equal(t, "dabbi", got.Get("X-Served-By"))
+
+	// Everything else is forwarded untouched
+	assert.Equal(t, "text/html", got.Get("Accept"))
+	assert.Equal(t, "https", got.Get("X-Forwarded-Proto"))
+}
+
+func TestRouter_ProxyRequest_KeepsAppAuthorization(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Clone()
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	r := NewRouter(nil)
+	r.SetAuthToken("secret")
+
+	// Credentials meant for the VM's own app pass through
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	rec := httptest.NewRecorder()
+
+	r.proxyRequest(rec, req, "test-vm", "127.0.0.1", port)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "Basic dXNlcjpwYXNz", got.Get("Authorization"))
+	assert.Empty(t, got.Get("Cookie"))
+}
+
+func TestRouter_ProxyRequest_ForwardsRequestID(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req.Header.Get(httpkit.RequestIDHeader)
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	r := NewRouter(nil)
+	var assigned string
+	h := httpkit.RequestID(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assigned = httpkit.GetRequestID(req)
+		r.proxyRequest(w, req, "test-vm", "127.0.0.1", port)
+	}))
+
+	// The VM sees the ID the daemon assigned, not just one a client sent
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, got)
+	assert.Equal(t, assigned, got)
+}
+
 func TestRouter_HostPatternExamples(t *testing.T) {
 	// Real-world examples of host patterns
 	r := NewRouter(nil)
@@ -1,18 +1,26 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
 )
 
 const loadingHTML = `<!DOCTYPE html>
 <html>
 <head>
-    <title>Starting {{.VMName}}...</title>
-    <meta http-equiv="refresh" content="2">
+    <title>{{.Title}}: {{.VMName}}</title>
+    {{if .RefreshURL}}<meta http-equiv="refresh" content="{{.RefreshSecs}}; url={{.RefreshURL}}">{{else}}<meta http-equiv="refresh" content="{{.RefreshSecs}}">{{end}}
     <style>
         * { box-sizing: border-box; }
         body {
@@ -62,28 +70,97 @@ const loadingHTML = `<!DOCTYPE html>
             border-radius: 8px;
             font-size: 14px;
         }
+        .logo {
+            max-width: 160px;
+            max-height: 80px;
+            margin-bottom: 30px;
+        }
+        a {
+            color: #00d4ff;
+        }
+        button {
+            margin-top: 15px;
+            padding: 6px 14px;
+            background: none;
+            border: 1px solid #00d4ff;
+            border-radius: 4px;
+            color: #00d4ff;
+            cursor: pointer;
+        }
     </style>
 </head>
 <body>
     <div class="container">
+        {{if .LogoURL}}<img class="logo" src="{{.LogoURL}}" alt="">{{end}}
         <div class="spinner"></div>
-        <h1>Starting VM</h1>
+        <h1>{{.Title}}</h1>
         <p class="vm-name">{{.VMName}}</p>
         <p>Waiting for port {{.Port}} to become available...</p>
         <div class="info">
             <p>This page will refresh automatically.</p>
             <p>The VM is being started and may take a moment.</p>
+            {{if .Message}}<p>{{.Message}}</p>{{end}}
+            {{if .CancelURL}}<p><a href="{{.CancelURL}}">Cancel</a></p>{{end}}
+            <form method="post" action="{{.CancelPath}}"><button type="submit">Stop waiting</button></form>
         </div>
     </div>
+    <script>
+        (function () {
+            var target = {{.RefreshURL}} || location.href;
+            function check() {
+                fetch({{.ReadyPath}}, { cache: 'no-store', credentials: 'same-origin' })
+                    .then(function (res) { return res.ok ? res.json() : { ready: false }; })
+                    .then(function (body) {
+                        if (body.ready) {
+                            location.replace(target);
+                        } else {
+                            setTimeout(check, {{.PollMillis}});
+                        }
+                    })
+                    .catch(function () { setTimeout(check, {{.PollMillis}}); });
+            }
+            setTimeout(check, {{.PollMillis}});
+        })();
+    </script>
 </body>
 </html>`
 
 var loadingTmpl = template.Must(template.New("loading").Parse(loadingHTML))
 
+// readyPath is polled by the loading page's script, which loads the page as
+// soon as the VM is ready instead of waiting for the next meta refresh. The
+// proxy answers it on every VM host instead of forwarding it to the VM.
+const readyPath = "/.dabbi/ready"
+
+// cancelWakePath is where the loading page's form posts to stop waking the
+// VM, answered like readyPath
+const cancelWakePath = "/.dabbi/wake/cancel"
+
+// wakeTimeout is how long a woken VM's port is waited for
+const wakeTimeout = 90 * time.Second
+
+// wake is an in-progress wake in Router.waking. It's a pointer so a
+// finished wake only removes its own entry, not one started after it was
+// cancelled.
+type wake struct {
+	cancel context.CancelFunc
+}
+
+// readyPollInterval is how often the loading page's script polls readyPath
+const readyPollInterval = 500 * time.Millisecond
+
+// defaultRefreshSecs is the loading page's meta-refresh interval for browsers
+// without JavaScript
+const defaultRefreshSecs = 2
+
 // handleWakeOnRequest starts a stopped VM and serves a loading page
 func (r *Router) handleWakeOnRequest(w http.ResponseWriter, req *http.Request, vmName string, port int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wk := &wake{cancel: cancel}
+
 	// Check if already waking this VM
-	if _, waking := r.waking.LoadOrStore(vmName, true); waking {
+	if _, waking := r.waking.LoadOrStore(vmName, wk); waking {
+		cancel()
 		// Already waking, just serve loading page
 		r.serveLoadingPage(w, vmName, port)
 		return
@@ -91,16 +168,21 @@ func (r *Router) handleWakeOnRequest(w http.ResponseWriter, req *http.Request, v
 
 	// Start waking in background
 	go func() {
-		defer r.waking.Delete(vmName)
+		defer cancel()
+		defer r.waking.CompareAndDelete(vmName, wk)
 
-		// Start the VM
-		if err := r.mp.Start(vmName); err != nil {
+		// Start the VM. Multipass can't abort a start, so a cancel that
+		// comes in now takes effect once it returns.
+		r.woken.Delete(vmName)
+		if err := r.mp.Start(vmName); err != nil || ctx.Err() != nil {
 			// Log error but don't block
 			return
 		}
 
-		// Wait for port to be ready
-		r.waitForPort(vmName, port, 90*time.Second)
+		// Wait for port to be ready, then proxy to the IP that answered
+		if ip, ok := r.waitForPort(ctx, vmName, port, wakeTimeout); ok {
+			r.woken.Store(vmName, ip)
+		}
 	}()
 
 	// Serve loading page immediately
@@ -109,36 +191,166 @@ func (r *Router) handleWakeOnRequest(w http.ResponseWriter, req *http.Request, v
 
 // serveLoadingPage renders the loading page
 func (r *Router) serveLoadingPage(w http.ResponseWriter, vmName string, port int) {
+	page := r.loadingPage
+	if page.Title == "" {
+		page.Title = "Starting VM"
+	}
+	if page.RefreshSecs <= 0 {
+		page.RefreshSecs = defaultRefreshSecs
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	loadingTmpl.Execute(w, map[string]interface{}{
-		"VMName": vmName,
-		"Port":   port,
+		"VMName":      vmName,
+		"Port":        port,
+		"Title":       page.Title,
+		"LogoURL":     page.LogoURL,
+		"Message":     page.Message,
+		"CancelURL":   page.CancelURL,
+		"CancelPath":  cancelWakePath,
+		"RefreshSecs": page.RefreshSecs,
+		"RefreshURL":  page.RefreshURL,
+		"ReadyPath":   readyPath,
+		"PollMillis":  readyPollInterval.Milliseconds(),
 	})
 }
 
-// waitForPort polls until the VM port is accepting connections
-func (r *Router) waitForPort(vmName string, port int, timeout time.Duration) bool {
+// serveReady tells the loading page whether the VM can be proxied to yet:
+// it's running and no longer waking
+func (r *Router) serveReady(w http.ResponseWriter, vmName, state string) {
+	_, waking := r.waking.Load(vmName)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"ready": state == multipass.StateRunning && !waking,
+	})
+}
+
+// CancelWake stops waiting for a VM woken by a proxied request, so requests
+// are proxied (or wake it again) as if it had never been woken. It reports
+// whether a wake was in progress. A start already sent to multipass still
+// completes.
+func (r *Router) CancelWake(vmName string) bool {
+	v, ok := r.waking.LoadAndDelete(vmName)
+	if !ok {
+		return false
+	}
+	if wk, ok := v.(*wake); ok {
+		wk.cancel()
+	}
+	return true
+}
+
+// serveWakeCancelled answers the loading page's cancel form: it cancels the
+// wake, then goes to the configured cancel URL or shows that it stopped.
+// It doesn't wake the VM, so the page has no refresh.
+func (r *Router) serveWakeCancelled(w http.ResponseWriter, req *http.Request, vmName string) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.CancelWake(vmName)
+	if r.loadingPage.CancelURL != "" {
+		http.Redirect(w, req, r.loadingPage.CancelURL, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	errorTmpl.Execute(w, errorPage{
+		Title:   "Stopped waiting",
+		Message: fmt.Sprintf("No longer waiting for VM '%s'", vmName),
+		Hint:    "If it was starting, it may still come up. Reload the app's address to wake it again.",
+	})
+}
+
+// Backoff bounds for waitForPort polling
+const (
+	waitBackoffMin = 250 * time.Millisecond
+	waitBackoffMax = 2 * time.Second
+)
+
+// waitForPort polls with exponential backoff until the VM port accepts
+// connections and returns the IP that answered. The IP is looked up once and
+// only re-fetched if it stops answering entirely; a refused connection means
+// the VM is up and the service just isn't listening yet. If the VM has a
+// health path, the port also has to answer it with a 2xx. It gives up early
+// when ctx is cancelled.
+func (r *Router) waitForPort(ctx context.Context, vmName string, port int, timeout time.Duration) (string, bool) {
 	deadline := time.Now().Add(timeout)
+	delay := waitBackoffMin
+	healthPath := r.healthPath(vmName)
+	var vmIP string
 
 	for time.Now().Before(deadline) {
-		// Get current VM info (IP might change after start)
-		info, err := r.mp.Info(vmName)
-		if err != nil || len(info.IPv4) == 0 {
-			time.Sleep(1 * time.Second)
-			continue
+		if vmIP == "" {
+			// The IP is only known once the VM has booted far enough to get one
+			if info, err := r.mp.Info(vmName); err == nil && len(info.IPv4) > 0 {
+				vmIP = multipass.PickReachableIP(vmName, info, port, r.subnet)
+			}
 		}
 
-		// Try to connect to the port
-		addr := fmt.Sprintf("%s:%d", info.IPv4[0], port)
-		conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
-		if err == nil {
-			conn.Close()
-			return true
+		if vmIP != "" {
+			err := dialPort(vmIP, port, 2*time.Second)
+			if err == nil {
+				if healthPath == "" || healthy(vmIP, port, healthPath) {
+					return vmIP, true
+				}
+			} else if !errors.Is(err, syscall.ECONNREFUSED) {
+				vmIP = ""
+				multipass.ForgetReachableIP(vmName)
+			}
 		}
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-ctx.Done():
+			return "", false
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, waitBackoffMax)
 	}
 
-	return false
+	return "", false
+}
+
+// healthPath returns the VM's health path label, or "" to only check TCP
+func (r *Router) healthPath(vmName string) string {
+	if r.labels == nil {
+		return ""
+	}
+	vmLabels, err := r.labels.Get(vmName)
+	if err != nil {
+		return ""
+	}
+	path := strings.TrimSpace(vmLabels[HealthPathLabel])
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// healthy reports whether GET path on ip:port answers with a 2xx status
+func healthy(ip string, port int, path string) bool {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(ip, strconv.Itoa(port)) + path)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// PortOpen reports whether a TCP connection to ip:port succeeds within timeout
+func PortOpen(ip string, port int, timeout time.Duration) bool {
+	return dialPort(ip, port, timeout) == nil
+}
+
+// dialPort opens and immediately closes a TCP connection to ip:port
+func dialPort(ip string, port int, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
 }
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/labels"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortOpen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	assert.True(t, PortOpen("127.0.0.1", port, time.Second))
+
+	ln.Close()
+	assert.False(t, PortOpen("127.0.0.1", port, time.Second))
+}
+
+func TestWaitForPort_OpensAfterRetries(t *testing.T) {
+	// Reserve a port, then free it so the first dials are refused
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	mockMP := new(testutil.MockMultipassClient)
+	// Still booting on the first lookup: no IP yet
+	mockMP.On("Info", "waking-vm").Return(&multipass.InstanceInfo{State: multipass.StateRunning}, nil).Once()
+	mockMP.On("Info", "waking-vm").Return(testutil.RunningVM("waking-vm", "127.0.0.1"), nil)
+
+	opened := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		ln, _ := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		opened <- ln
+	}()
+
+	r := NewRouter(mockMP)
+	ip, ok := r.waitForPort(context.Background(), "waking-vm", port, 5*time.Second)
+	if ln := <-opened; ln != nil {
+		ln.Close()
+	}
+
+	require.True(t, ok)
+	assert.Equal(t, "127.0.0.1", ip)
+	// The IP is cached once known; refused dials don't trigger new lookups
+	mockMP.AssertNumberOfCalls(t, "Info", 2)
+}
+
+func TestWaitForPort_Timeout(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "stuck-vm").Return(testutil.StoppedVM("stuck-vm"), nil)
+
+	r := NewRouter(mockMP)
+	ip, ok := r.waitForPort(context.Background(), "stuck-vm", 8080, 100*time.Millisecond)
+
+	assert.False(t, ok)
+	assert.Empty(t, ip)
+}
+
+func TestWaitForPort_Cancelled(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "stuck-vm").Return(testutil.StoppedVM("stuck-vm"), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	r := NewRouter(mockMP)
+	start := time.Now()
+	_, ok := r.waitForPort(ctx, "stuck-vm", 8080, 10*time.Second)
+
+	assert.False(t, ok)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestWaitForPort_HealthPath(t *testing.T) {
+	// Accepts connections immediately but is only healthy on the third check
+	var checks atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/healthz", req.URL.Path)
+		if checks.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	ls := labels.NewStore(filepath.Join(t.TempDir(), "labels.json"))
+	require.NoError(t, ls.Set("app-vm", map[string]string{HealthPathLabel: "healthz"}))
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "app-vm").Return(testutil.RunningVM("app-vm", "127.0.0.1"), nil)
+
+	r := NewRouter(mockMP)
+	r.SetLabels(ls)
+
+	ip, ok := r.waitForPort(context.Background(), "app-vm", port, 5*time.Second)
+	require.True(t, ok)
+	assert.Equal(t, "127.0.0.1", ip)
+	assert.Equal(t, int32(3), checks.Load())
+}
+
+func TestVMIP_PrefersWokenIP(t *testing.T) {
+	r := NewRouter(nil)
+	info := &multipass.InstanceInfo{State: multipass.StateRunning, IPv4: []string{"127.0.0.2", "127.0.0.3"}}
+
+	// The IP the woken VM's port answered on is used as-is
+	r.woken.Store("dual-vm", "127.0.0.3")
+	assert.Equal(t, "127.0.0.3", r.vmIP("dual-vm", info, 8080))
+
+	// Once the VM no longer has it, the IP is picked again
+	info.IPv4 = []string{"127.0.0.2"}
+	assert.Equal(t, "127.0.0.2", r.vmIP("dual-vm", info, 8080))
+	_, ok := r.woken.Load("dual-vm")
+	assert.False(t, ok)
+}
+
+func TestHandleVMRequest_LoadingPageWhileWaking(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "waking-vm").Return(testutil.RunningVM("waking-vm", "127.0.0.1"), nil)
+
+	r := NewRouter(mockMP)
+	r.waking.Store("waking-vm", &wake{cancel: func() {}})
+
+	rec := httptest.NewRecorder()
+	r.handleVMRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil), "waking-vm", 8080)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Starting VM")
+}
+
+func TestServeLoadingPage_Defaults(t *testing.T) {
+	r := NewRouter(nil)
+
+	rec := httptest.NewRecorder()
+	r.serveLoadingPage(rec, "dev", 8080)
+
+	body := rec.Body.String()
+	assert.Contains(t, body, "<h1>Starting VM</h1>")
+	assert.Contains(t, body, `<meta http-equiv="refresh" content="2">`)
+	assert.Contains(t, body, `fetch("/.dabbi/ready"`)
+	assert.Contains(t, body, `<form method="post" action="/.dabbi/wake/cancel">`)
+	assert.NotContains(t, body, `class="logo"`)
+	assert.NotContains(t, body, "Cancel")
+}
+
+func TestServeLoadingPage_Custom(t *testing.T) {
+	r := NewRouter(nil)
+	r.SetLoadingPage(config.LoadingPage{
+		Title:       "Waking your sandbox",
+		LogoURL:     "https://example.com/logo.png",
+		Message:     "Ping #infra if this takes more than 2 minutes",
+		CancelURL:   "https://example.com/",
+		RefreshSecs: 5,
+		RefreshURL:  "https://example.com/status",
+	})
+
+	rec := httptest.NewRecorder()
+	r.serveLoadingPage(rec, "dev", 8080)
+
+	body := rec.Body.String()
+	assert.Contains(t, body, "<h1>Waking your sandbox</h1>")
+	assert.Contains(t, body, `<img class="logo" src="https://example.com/logo.png"`)
+	assert.Contains(t, body, "Ping #infra if this takes more than 2 minutes")
+	assert.Contains(t, body, `<a href="https://example.com/">Cancel</a>`)
+	assert.Contains(t, body, `content="5; url=https://example.com/status"`)
+	assert.Contains(t, body, `var target = "https://example.com/status" || location.href;`)
+}
+
+func TestHandleVMRequest_ReadyCheck(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "waking-vm").Return(testutil.RunningVM("waking-vm", "127.0.0.1"), nil)
+	mockMP.On("Info", "up-vm").Return(testutil.RunningVM("up-vm", "127.0.0.1"), nil)
+	mockMP.On("Info", "stopped-vm").Return(testutil.StoppedVM("stopped-vm"), nil)
+
+	r := NewRouter(mockMP)
+	r.waking.Store("waking-vm", &wake{cancel: func() {}})
+
+	ready := func(vmName string) string {
+		rec := httptest.NewRecorder()
+		r.handleVMRequest(rec, httptest.NewRequest(http.MethodGet, readyPath, nil), vmName, 8080)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		return rec.Body.String()
+	}
+
+	assert.JSONEq(t, `{"ready": false}`, ready("waking-vm"))
+	assert.JSONEq(t, `{"ready": true}`, ready("up-vm"))
+
+	// Polling doesn't wake a stopped VM; only page loads do
+	assert.JSONEq(t, `{"ready": false}`, ready("stopped-vm"))
+	mockMP.AssertNotCalled(t, "Start", "stopped-vm")
+}
+
+func TestCancelWake(t *testing.T) {
+	release := make(chan struct{})
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "sleepy-vm").Return(testutil.StoppedVM("sleepy-vm"), nil)
+	mockMP.On("Start", "sleepy-vm").Run(func(mock.Arguments) { <-release }).Return(nil)
+
+	r := NewRouter(mockMP)
+	get := func() {
+		rec := httptest.NewRecorder()
+		r.handleVMRequest(rec, httptest.NewRequest(http.MethodGet, "/", nil), "sleepy-vm", 8080)
+		assert.Contains(t, rec.Body.String(), "Starting VM")
+	}
+
+	get()
+	_, waking := r.waking.Load("sleepy-vm")
+	require.True(t, waking)
+
+	assert.True(t, r.CancelWake("sleepy-vm"))
+	_, waking = r.waking.Load("sleepy-vm")
+	assert.False(t, waking, "cancelling clears the waking flag")
+	assert.False(t, r.CancelWake("sleepy-vm"))
+
+	// A new request wakes it again, and the cancelled wake finishing
+	// doesn't remove the new one
+	get()
+	close(release)
+	assert.Never(t, func() bool {
+		_, waking := r.waking.Load("sleepy-vm")
+		return !waking
+	}, 200*time.Millisecond, 10*time.Millisecond)
+	assert.True(t, r.CancelWake("sleepy-vm"))
+	mockMP.AssertNumberOfCalls(t, "Start", 2)
+}
+
+func TestHandleVMRequest_CancelWakePath(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+
+	r := NewRouter(mockMP)
+	cancelled := false
+	r.waking.Store("waking-vm", &wake{cancel: func() { cancelled = true }})
+
+	rec := httptest.NewRecorder()
+	r.handleVMRequest(rec, httptest.NewRequest(http.MethodGet, cancelWakePath, nil), "waking-vm", 8080)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.False(t, cancelled)
+
+	rec = httptest.NewRecorder()
+	r.handleVMRequest(rec, httptest.NewRequest(http.MethodPost, cancelWakePath, nil), "waking-vm", 8080)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "Stopped waiting")
+	assert.NotContains(t, rec.Body.String(), "refresh")
+	assert.True(t, cancelled)
+
+	// With a cancel URL configured, the form goes there afterwards
+	r.SetLoadingPage(config.LoadingPage{CancelURL: "https://example.com/"})
+	rec = httptest.NewRecorder()
+	r.handleVMRequest(rec, httptest.NewRequest(http.MethodPost, cancelWakePath, nil), "stopped-vm", 8080)
+	assert.Equal(t, http.StatusSeeOther, rec.Code)
+	assert.Equal(t, "https://example.com/", rec.Header().Get("Location"))
+
+	// Neither looks the VM up or wakes it
+	mockMP.AssertNotCalled(t, "Info", mock.Anything)
+	mockMP.AssertNotCalled(t, "Start", mock.Anything)
+}
@@ -0,0 +1,103 @@
+package prune
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/watchdog"
+)
+
+// Criteria selects VMs to prune. Every filter that is set must match.
+type Criteria struct {
+	Stopped   bool            // only VMs in the Stopped state
+	OlderThan time.Duration   // only VMs inactive for longer than this (0 = any)
+	CallerIP  string          // never prune the VM with this address (the requester's own VM)
+	Pinned    map[string]bool // never prune these VMs (see labels.PinnedKey)
+}
+
+// Candidate is a VM selected for pruning
+type Candidate struct {
+	Name       string     `json:"name"`
+	State      string     `json:"state"`
+	LastActive *time.Time `json:"last_active,omitempty"`
+}
+
+// Validate rejects criteria that would select every VM
+func (c Criteria) Validate() error {
+	if !c.Stopped && c.OlderThan <= 0 {
+		return errors.New("specify --stopped and/or --older-than (refusing to prune every VM)")
+	}
+	return nil
+}
+
+// Select lists VMs and returns those matching the criteria. A VM whose last
+// activity is unknown never matches OlderThan, so missing data keeps it.
+func Select(mp multipass.Client, log *watchdog.StopLog, c Criteria, now time.Time) ([]Candidate, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	vms, err := mp.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []Candidate
+	for _, vm := range vms {
+		if vm.State == multipass.StateDeleted || hasIP(vm, c.CallerIP) || c.Pinned[vm.Name] {
+			continue
+		}
+		if c.Stopped && vm.State != multipass.StateStopped {
+			continue
+		}
+
+		candidate := Candidate{Name: vm.Name, State: vm.State}
+		if last, ok := watchdog.LastActivity(mp, log, vm); ok {
+			candidate.LastActive = &last
+		}
+
+		if c.OlderThan > 0 {
+			if candidate.LastActive == nil || now.Sub(*candidate.LastActive) < c.OlderThan {
+				continue
+			}
+		}
+
+		selected = append(selected, candidate)
+	}
+
+	return selected, nil
+}
+
+// hasIP reports whether ip is one of the VM's addresses
+func hasIP(vm multipass.ListInstance, ip string) bool {
+	if ip == "" {
+		return false
+	}
+	for _, addr := range vm.IPv4 {
+		if addr == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAge parses an age like "7d", "12h", or "90m"
+func ParseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid age %q: use a duration like 7d or 12h", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid age %q: use a duration like 7d or 12h", s)
+	}
+	return d, nil
+}
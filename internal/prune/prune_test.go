@@ -0,0 +1,123 @@
+package prune
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/mjshashank/dabbi/internal/watchdog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelect(t *testing.T) {
+	now := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	log := watchdog.NewStopLog(filepath.Join(t.TempDir(), "activity.json"))
+	require.NoError(t, log.Record("old-stopped", now.Add(-10*24*time.Hour)))
+	require.NoError(t, log.Record("new-stopped", now.Add(-time.Hour)))
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "old-stopped", State: multipass.StateStopped},
+		{Name: "new-stopped", State: multipass.StateStopped},
+		{Name: "unknown-stopped", State: multipass.StateStopped},
+		{Name: "idle-running", State: multipass.StateRunning, IPv4: []string{"192.168.64.5"}},
+		{Name: "caller", State: multipass.StateStopped, IPv4: []string{"192.168.64.9"}},
+	}, nil)
+	mockMP.On("Exec", "idle-running", []string{"cat", watchdog.CheckpointPath}).
+		Return(`{"timestamp":"2024-02-01T00:00:00Z"}`, nil)
+
+	tests := []struct {
+		name     string
+		criteria Criteria
+		expected []string
+	}{
+		{
+			name:     "stopped",
+			criteria: Criteria{Stopped: true},
+			expected: []string{"old-stopped", "new-stopped", "unknown-stopped", "caller"},
+		},
+		{
+			name:     "older_than_skips_unknown_activity",
+			criteria: Criteria{OlderThan: 7 * 24 * time.Hour},
+			expected: []string{"old-stopped", "idle-running"},
+		},
+		{
+			name:     "stopped_and_older_than",
+			criteria: Criteria{Stopped: true, OlderThan: 7 * 24 * time.Hour},
+			expected: []string{"old-stopped"},
+		},
+		{
+			name:     "never_prunes_callers_vm",
+			criteria: Criteria{Stopped: true, CallerIP: "192.168.64.9"},
+			expected: []string{"old-stopped", "new-stopped", "unknown-stopped"},
+		},
+		{
+			name:     "never_prunes_pinned_vms",
+			criteria: Criteria{Stopped: true, Pinned: map[string]bool{"old-stopped": true}},
+			expected: []string{"new-stopped", "unknown-stopped", "caller"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Select(mockMP, log, tt.criteria, now)
+			require.NoError(t, err)
+
+			var names []string
+			for _, c := range got {
+				names = append(names, c.Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestSelect_RequiresFilter(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+
+	_, err := Select(mockMP, nil, Criteria{}, time.Now())
+	assert.ErrorContains(t, err, "refusing to prune every VM")
+	mockMP.AssertNotCalled(t, "List")
+}
+
+func TestSelect_ListError(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(nil, errors.New("multipass error"))
+
+	_, err := Select(mockMP, nil, Criteria{Stopped: true}, time.Now())
+	assert.Error(t, err)
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  time.Duration
+		expectErr bool
+	}{
+		{"7d", 7 * 24 * time.Hour, false},
+		{"12h", 12 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"0d", 0, true},
+		{"-1h", 0, true},
+		{"xd", 0, true},
+		{"week", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseAge(tt.input)
+			if tt.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
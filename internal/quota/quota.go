@@ -0,0 +1,179 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+// ErrExceeded is wrapped by the error Check returns when a new VM doesn't fit
+var ErrExceeded = errors.New("resource limit reached")
+
+// Limits caps how many VMs a shared host runs and what they may use. Zero
+// fields are unlimited.
+type Limits struct {
+	MaxVMs         int   // VMs that exist, running or not
+	MaxTotalCPU    int   // CPUs of running VMs
+	MaxTotalMemory int64 // memory of running VMs, in bytes
+}
+
+// FromConfig reads the limits set in the config
+func FromConfig(cfg *config.Config) (Limits, error) {
+	l := Limits{MaxVMs: cfg.MaxVMs, MaxTotalCPU: cfg.MaxTotalCPU}
+	if cfg.MaxTotalMemory != "" {
+		mem, err := multipass.ParseSize(cfg.MaxTotalMemory)
+		if err != nil {
+			return Limits{}, fmt.Errorf("max_total_memory: %w", err)
+		}
+		l.MaxTotalMemory = mem
+	}
+	return l, nil
+}
+
+// Unlimited reports whether no limit is set
+func (l Limits) Unlimited() bool {
+	return l.MaxVMs <= 0 && l.MaxTotalCPU <= 0 && l.MaxTotalMemory <= 0
+}
+
+// Usage is what existing VMs add up to
+type Usage struct {
+	VMs    int
+	CPUs   int
+	Memory int64 // bytes
+}
+
+// Measure adds up the VMs multipass knows about. Every VM but deleted ones
+// counts toward the VM limit. CPUs and memory are only counted for VMs that
+// aren't stopped or suspended, since only those hold them; multipass doesn't
+// report either for a stopped VM anyway.
+func Measure(mp multipass.Client, l Limits) (Usage, error) {
+	vms, err := mp.List()
+	if err != nil {
+		return Usage{}, err
+	}
+
+	var u Usage
+	for _, vm := range vms {
+		if vm.State == multipass.StateDeleted {
+			continue
+		}
+		u.VMs++
+
+		// Info is a multipass call per VM, so skip it when nothing needs it
+		if l.MaxTotalCPU <= 0 && l.MaxTotalMemory <= 0 {
+			continue
+		}
+		if vm.State == multipass.StateStopped || vm.State == multipass.StateSuspended {
+			continue
+		}
+		info, err := mp.Info(vm.Name)
+		if err != nil {
+			return Usage{}, fmt.Errorf("failed to get info for VM %s: %w", vm.Name, err)
+		}
+		u.CPUs += info.CPUs()
+		u.Memory += info.Memory.Total
+	}
+	return u, nil
+}
+
+// Check returns an error wrapping ErrExceeded that names the first limit a
+// new VM with the given CPUs and memory (bytes) would exceed, or nil if it
+// fits
+func (l Limits) Check(u Usage, cpus int, memory int64) error {
+	if l.MaxVMs > 0 && u.VMs+1 > l.MaxVMs {
+		return fmt.Errorf("%w: %d of %d VMs exist (max_vms); delete one first", ErrExceeded, u.VMs, l.MaxVMs)
+	}
+	if l.MaxTotalCPU > 0 && u.CPUs+cpus > l.MaxTotalCPU {
+		return fmt.Errorf("%w: running VMs use %d of %d CPUs (max_total_cpu) and this VM asks for %d",
+			ErrExceeded, u.CPUs, l.MaxTotalCPU, cpus)
+	}
+	if l.MaxTotalMemory > 0 && u.Memory+memory > l.MaxTotalMemory {
+		return fmt.Errorf("%w: running VMs use %s of %s memory (max_total_memory) and this VM asks for %s",
+			ErrExceeded, multipass.FormatBytes(u.Memory), multipass.FormatBytes(l.MaxTotalMemory), multipass.FormatBytes(memory))
+	}
+	return nil
+}
+
+// CheckLaunch measures current usage and checks a new VM against the
+// limits. It does nothing when no limit is set. Concurrent launches can
+// each pass before either VM exists, so the limits are a guardrail, not a
+// guarantee.
+func CheckLaunch(mp multipass.Client, l Limits, cpus int, memory string) error {
+	if l.Unlimited() {
+		return nil
+	}
+	mem, err := multipass.ParseSize(memory)
+	if err != nil {
+		return err
+	}
+	u, err := Measure(mp, l)
+	if err != nil {
+		return fmt.Errorf("failed to measure VM usage: %w", err)
+	}
+	return l.Check(u, cpus, mem)
+}
+
+// CheckClone measures current usage and checks that one more VM fits the VM
+// limit. Clones start out stopped, so the CPU and memory limits are checked
+// when they're started instead (see LimitStarts).
+func CheckClone(mp multipass.Client, l Limits) error {
+	l = Limits{MaxVMs: l.MaxVMs}
+	if l.Unlimited() {
+		return nil
+	}
+	u, err := Measure(mp, l)
+	if err != nil {
+		return fmt.Errorf("failed to measure VM usage: %w", err)
+	}
+	return l.Check(u, 0, 0)
+}
+
+// CheckStart measures current usage and checks that starting the VM fits
+// the CPU and memory limits. A VM that's already running holds its share,
+// so only stopped and suspended VMs are checked.
+func CheckStart(mp multipass.Client, l Limits, name string) error {
+	// The VM already exists, so the VM limit doesn't apply
+	l = Limits{MaxTotalCPU: l.MaxTotalCPU, MaxTotalMemory: l.MaxTotalMemory}
+	if l.Unlimited() {
+		return nil
+	}
+	info, err := mp.Info(name)
+	if err != nil {
+		return err
+	}
+	if info.State != multipass.StateStopped && info.State != multipass.StateSuspended {
+		return nil
+	}
+
+	cpus, memory, err := mp.Resources(name)
+	if err != nil {
+		return fmt.Errorf("failed to get resources of VM %s: %w", name, err)
+	}
+	u, err := Measure(mp, l)
+	if err != nil {
+		return fmt.Errorf("failed to measure VM usage: %w", err)
+	}
+	return l.Check(u, cpus, memory)
+}
+
+// limitedClient checks starts against the resource limits
+type limitedClient struct {
+	multipass.Client
+	limits Limits
+}
+
+// LimitStarts wraps a multipass client so that starting a VM that would take
+// running VMs past the CPU or memory limits fails with an error wrapping
+// ErrExceeded, whichever path (API, CLI, bulk, wake on request) starts it.
+func LimitStarts(mp multipass.Client, l Limits) multipass.Client {
+	return &limitedClient{Client: mp, limits: l}
+}
+
+func (c *limitedClient) Start(name string) error {
+	if err := CheckStart(c.Client, c.limits, name); err != nil {
+		return err
+	}
+	return c.Client.Start(name)
+}
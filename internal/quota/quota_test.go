@@ -0,0 +1,135 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromConfig(t *testing.T) {
+	cfg := config.DefaultConfig()
+	l, err := FromConfig(cfg)
+	require.NoError(t, err)
+	assert.True(t, l.Unlimited())
+
+	cfg.MaxVMs, cfg.MaxTotalCPU, cfg.MaxTotalMemory = 3, 8, "16G"
+	l, err = FromConfig(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, Limits{MaxVMs: 3, MaxTotalCPU: 8, MaxTotalMemory: 16 << 30}, l)
+
+	cfg.MaxTotalMemory = "16GB"
+	_, err = FromConfig(cfg)
+	assert.ErrorContains(t, err, "max_total_memory")
+}
+
+func TestMeasure(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "a", State: multipass.StateRunning},
+		{Name: "b", State: multipass.StateRunning},
+		{Name: "off", State: multipass.StateStopped},
+		{Name: "gone", State: multipass.StateDeleted},
+	}, nil)
+	mockMP.On("Info", "a").Return(testutil.RunningVM("a", "10.0.0.1"), nil)
+	mockMP.On("Info", "b").Return(testutil.RunningVM("b", "10.0.0.2"), nil)
+
+	u, err := Measure(mockMP, Limits{MaxTotalCPU: 8})
+	require.NoError(t, err)
+	assert.Equal(t, Usage{VMs: 3, CPUs: 4, Memory: 8 << 30}, u)
+	mockMP.AssertNotCalled(t, "Info", "off")
+}
+
+func TestMeasure_CountOnly(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(testutil.RunningVMList("a", "b"), nil)
+
+	u, err := Measure(mockMP, Limits{MaxVMs: 5})
+	require.NoError(t, err)
+	assert.Equal(t, Usage{VMs: 2}, u)
+	mockMP.AssertNotCalled(t, "Info", "a")
+}
+
+func TestCheck(t *testing.T) {
+	usage := Usage{VMs: 2, CPUs: 4, Memory: 8 << 30}
+
+	tests := []struct {
+		name    string
+		limits  Limits
+		cpus    int
+		memory  int64
+		wantErr string
+	}{
+		{"unlimited", Limits{}, 64, 1 << 40, ""},
+		{"vms_below_limit", Limits{MaxVMs: 3}, 2, 4 << 30, ""},
+		{"vms_at_limit", Limits{MaxVMs: 2}, 2, 4 << 30, "2 of 2 VMs"},
+		{"cpu_reaches_limit", Limits{MaxTotalCPU: 6}, 2, 4 << 30, ""},
+		{"cpu_over_limit", Limits{MaxTotalCPU: 6}, 4, 4 << 30, "max_total_cpu"},
+		{"memory_reaches_limit", Limits{MaxTotalMemory: 12 << 30}, 2, 4 << 30, ""},
+		{"memory_over_limit", Limits{MaxTotalMemory: 12 << 30}, 2, 5 << 30, "max_total_memory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.limits.Check(usage, tt.cpus, tt.memory)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, ErrExceeded))
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestCheckLaunch_Unlimited(t *testing.T) {
+	// No limits means no multipass calls at all
+	mockMP := new(testutil.MockMultipassClient)
+	assert.NoError(t, CheckLaunch(mockMP, Limits{}, 2, "4G"))
+	mockMP.AssertNotCalled(t, "List")
+}
+
+func TestCheckClone(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(testutil.RunningVMList("a", "b"), nil)
+
+	// Clones start out stopped, so only the VM limit applies
+	assert.NoError(t, CheckClone(mockMP, Limits{MaxVMs: 3, MaxTotalCPU: 1}))
+	assert.ErrorIs(t, CheckClone(mockMP, Limits{MaxVMs: 2}), ErrExceeded)
+	mockMP.AssertNotCalled(t, "Info", "a")
+}
+
+func TestLimitStarts(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "a", State: multipass.StateRunning},
+		{Name: "off", State: multipass.StateStopped},
+		{Name: "small", State: multipass.StateStopped},
+	}, nil)
+	mockMP.On("Info", "a").Return(testutil.RunningVM("a", "10.0.0.1"), nil)
+	mockMP.On("Info", "off").Return(testutil.StoppedVM("off"), nil)
+	mockMP.On("Info", "small").Return(testutil.StoppedVM("small"), nil)
+	mockMP.On("Resources", "off").Return(4, int64(8<<30), nil)
+	mockMP.On("Resources", "small").Return(1, int64(1<<30), nil)
+	mockMP.On("Start", "small").Return(nil)
+	mockMP.On("Start", "a").Return(nil)
+
+	// "a" uses 2 CPUs and 4GiB
+	mp := LimitStarts(mockMP, Limits{MaxVMs: 3, MaxTotalCPU: 4, MaxTotalMemory: 8 << 30})
+
+	err := mp.Start("off")
+	assert.ErrorIs(t, err, ErrExceeded)
+	assert.ErrorContains(t, err, "max_total_cpu")
+	mockMP.AssertNotCalled(t, "Start", "off")
+
+	// At the VM limit, existing VMs can still start
+	assert.NoError(t, mp.Start("small"))
+
+	// Running VMs already hold their share
+	assert.NoError(t, mp.Start("a"))
+	mockMP.AssertNotCalled(t, "Resources", "a")
+}
@@ -0,0 +1,193 @@
+package sshagent
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/vmspec"
+)
+
+// secretTimeout is how long a connection has to send its secret
+const secretTimeout = 10 * time.Second
+
+// maxSecretLine bounds the line a connection opens with
+const maxSecretLine = 128
+
+// bridgeInterfaces are the host bridges multipass puts VMs on: qemu's and
+// LXD's on Linux
+var bridgeInterfaces = []string{"mpqemubr0", "mpbr0"}
+
+// NewSecret returns a random secret for a VM's cloud-init. The VM's relay
+// sends it at the start of every connection, so the daemon knows the VM
+// without trusting its address.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate SSH agent secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Forwarder relays TCP connections from VMs to the host's SSH agent socket.
+// Each connection opens with a line holding the secret the VM's cloud-init
+// was given; only secrets recorded in the spec store (see
+// vmspec.Store.GrantSSHAgent) are let through, so other VMs and other hosts
+// on the network can't use the agent.
+type Forwarder struct {
+	specs    *vmspec.Store
+	socket   string // host SSH agent socket, usually $SSH_AUTH_SOCK
+	listener net.Listener
+}
+
+// NewForwarder creates a forwarder to the agent listening on socket
+func NewForwarder(specs *vmspec.Store, socket string) *Forwarder {
+	return &Forwarder{specs: specs, socket: socket}
+}
+
+// Listen starts accepting connections on addr (e.g. "10.0.0.1:7322")
+func (f *Forwarder) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for SSH agent connections on %s: %w", addr, err)
+	}
+	f.listener = l
+	go f.serve()
+	return nil
+}
+
+// Addr returns the address the forwarder is listening on
+func (f *Forwarder) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+// Close stops accepting connections. Relayed connections run until either
+// side closes them.
+func (f *Forwarder) Close() error {
+	if f.listener == nil {
+		return nil
+	}
+	return f.listener.Close()
+}
+
+// serve accepts connections until the listener is closed
+func (f *Forwarder) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handleConnection(conn)
+	}
+}
+
+// handleConnection relays one connection to the agent if it opens with the
+// secret of a VM that may use it
+func (f *Forwarder) handleConnection(client net.Conn) {
+	defer client.Close()
+
+	// The agent's data may follow the secret in the same read, so the relay
+	// copies from the buffered reader rather than the connection
+	reader := bufio.NewReaderSize(client, maxSecretLine)
+	client.SetReadDeadline(time.Now().Add(secretTimeout))
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		log.Printf("SSH agent: refused connection from %s, no secret sent", client.RemoteAddr())
+		return
+	}
+	client.SetReadDeadline(time.Time{})
+
+	vm, ok, err := f.specs.SSHAgentVM(strings.TrimSpace(string(line)))
+	if err != nil {
+		log.Printf("SSH agent: failed to look up secret: %v", err)
+		return
+	}
+	if !ok {
+		log.Printf("SSH agent: refused connection from %s, not a VM created with --forward-ssh-agent", client.RemoteAddr())
+		return
+	}
+
+	agent, err := net.Dial("unix", f.socket)
+	if err != nil {
+		log.Printf("SSH agent: VM %s: %v", vm, err)
+		return
+	}
+	defer agent.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(agent, reader)
+		agent.(*net.UnixConn).CloseWrite()
+	}()
+
+	go func() {
+		defer wg.Done()
+		io.Copy(client, agent)
+		client.(*net.TCPConn).CloseWrite()
+	}()
+
+	wg.Wait()
+}
+
+// BridgeAddress returns the host's address on the network multipass puts
+// VMs on, which is where their relays connect: a known multipass bridge, or
+// else the host address on the same network as a VM's first address. It
+// returns "" when neither is found, e.g. on macOS with no VM running.
+func BridgeAddress(vms []multipass.ListInstance) string {
+	for _, name := range bridgeInterfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		if ip := firstIPv4(addrs, nil); ip != "" {
+			return ip
+		}
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, vm := range vms {
+		if len(vm.IPv4) == 0 {
+			continue
+		}
+		// Only the first: later ones may be on a bridged host network
+		if vmIP := net.ParseIP(vm.IPv4[0]); vmIP != nil {
+			if ip := firstIPv4(addrs, vmIP); ip != "" {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+// firstIPv4 returns the first IPv4 address in addrs, or with vmIP set, the
+// first whose network holds vmIP (other than vmIP itself)
+func firstIPv4(addrs []net.Addr, vmIP net.IP) string {
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+		if vmIP == nil || (ipnet.Contains(vmIP) && !ipnet.IP.Equal(vmIP)) {
+			return ipnet.IP.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,119 @@
+package sshagent
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/vmspec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoAgent stands in for the host's SSH agent
+func startEchoAgent(t *testing.T) string {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return socket
+}
+
+func startForwarder(t *testing.T) (*Forwarder, *vmspec.Store) {
+	specs := vmspec.NewStore(t.TempDir())
+	require.NoError(t, specs.GrantSSHAgent("dev", "dev-secret"))
+
+	f := NewForwarder(specs, startEchoAgent(t))
+	require.NoError(t, f.Listen("127.0.0.1:0"))
+	t.Cleanup(func() { f.Close() })
+	return f, specs
+}
+
+// roundTrip connects the way a VM's relay does: the secret line, then the
+// agent traffic, sent together
+func roundTrip(t *testing.T, f *Forwarder, secret string) (string, error) {
+	conn, err := net.Dial("tcp", f.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte(secret + "\nping")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	return string(buf), err
+}
+
+func TestForwarder_RelaysGrantedVM(t *testing.T) {
+	f, _ := startForwarder(t)
+
+	got, err := roundTrip(t, f, "dev-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "ping", got)
+}
+
+func TestForwarder_RefusesUnknownSecret(t *testing.T) {
+	for _, secret := range []string{"", "other-secret", "dev-secre"} {
+		t.Run(secret, func(t *testing.T) {
+			f, _ := startForwarder(t)
+
+			_, err := roundTrip(t, f, secret)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestForwarder_RefusesRevokedVM(t *testing.T) {
+	f, specs := startForwarder(t)
+	require.NoError(t, specs.RevokeSSHAgent("dev"))
+
+	_, err := roundTrip(t, f, "dev-secret")
+	assert.Error(t, err)
+}
+
+func TestForwarder_RefusesLongLine(t *testing.T) {
+	f, _ := startForwarder(t)
+
+	_, err := roundTrip(t, f, string(make([]byte, 2*maxSecretLine)))
+	assert.Error(t, err)
+}
+
+func TestNewSecret(t *testing.T) {
+	a, err := NewSecret()
+	require.NoError(t, err)
+	b, err := NewSecret()
+	require.NoError(t, err)
+
+	assert.Len(t, a, 64)
+	assert.NotEqual(t, a, b)
+}
+
+func TestFirstIPv4(t *testing.T) {
+	addrs := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("192.168.1.2"), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)},
+	}
+
+	assert.Equal(t, "192.168.1.2", firstIPv4(addrs, nil))
+	assert.Equal(t, "10.0.0.1", firstIPv4(addrs, net.ParseIP("10.0.0.5")))
+	assert.Equal(t, "", firstIPv4(addrs, net.ParseIP("172.16.0.5")))
+	// A host address is never its own bridge
+	assert.Equal(t, "", firstIPv4(addrs[2:], net.ParseIP("10.0.0.1")))
+}
@@ -2,6 +2,11 @@
 package testutil
 
 import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/stretchr/testify/mock"
 )
@@ -32,6 +37,16 @@ func (m *MockMultipassClient) Info(name string) (*multipass.InstanceInfo, error)
 	return args.Get(0).(*multipass.InstanceInfo), args.Error(1)
 }
 
+// ListContext mocks ListContext as List, so expectations set on List apply
+func (m *MockMultipassClient) ListContext(ctx context.Context) ([]multipass.ListInstance, error) {
+	return m.List()
+}
+
+// InfoContext mocks InfoContext as Info, so expectations set on Info apply
+func (m *MockMultipassClient) InfoContext(ctx context.Context, name string) (*multipass.InstanceInfo, error) {
+	return m.Info(name)
+}
+
 // Launch mocks the Launch method
 func (m *MockMultipassClient) Launch(opts multipass.LaunchOptions) error {
 	args := m.Called(opts)
@@ -50,6 +65,18 @@ func (m *MockMultipassClient) Stop(name string) error {
 	return args.Error(0)
 }
 
+// StopWithOptions mocks the StopWithOptions method
+func (m *MockMultipassClient) StopWithOptions(name string, force bool, timeout time.Duration) error {
+	args := m.Called(name, force, timeout)
+	return args.Error(0)
+}
+
+// Suspend mocks the Suspend method
+func (m *MockMultipassClient) Suspend(name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
 // Restart mocks the Restart method
 func (m *MockMultipassClient) Restart(name string) error {
 	args := m.Called(name)
@@ -62,12 +89,39 @@ func (m *MockMultipassClient) Delete(name string, purge bool) error {
 	return args.Error(0)
 }
 
+// ListNetworks mocks the ListNetworks method
+func (m *MockMultipassClient) ListNetworks() ([]multipass.NetworkInterface, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]multipass.NetworkInterface), args.Error(1)
+}
+
 // Clone mocks the Clone method
 func (m *MockMultipassClient) Clone(source, dest string) error {
 	args := m.Called(source, dest)
 	return args.Error(0)
 }
 
+// CloneFromSnapshot mocks the CloneFromSnapshot method
+func (m *MockMultipassClient) CloneFromSnapshot(source, snapshot, dest string) error {
+	args := m.Called(source, snapshot, dest)
+	return args.Error(0)
+}
+
+// Resources mocks the Resources method
+func (m *MockMultipassClient) Resources(vmName string) (int, int64, error) {
+	args := m.Called(vmName)
+	return args.Int(0), args.Get(1).(int64), args.Error(2)
+}
+
+// SetResources mocks the SetResources method
+func (m *MockMultipassClient) SetResources(vmName string, cpus int, memory, disk string) error {
+	args := m.Called(vmName, cpus, memory, disk)
+	return args.Error(0)
+}
+
 // ListSnapshots mocks the ListSnapshots method
 func (m *MockMultipassClient) ListSnapshots(vmName string) (map[string]multipass.Snapshot, error) {
 	args := m.Called(vmName)
@@ -77,6 +131,15 @@ func (m *MockMultipassClient) ListSnapshots(vmName string) (map[string]multipass
 	return args.Get(0).(map[string]multipass.Snapshot), args.Error(1)
 }
 
+// ListAllSnapshots mocks the ListAllSnapshots method
+func (m *MockMultipassClient) ListAllSnapshots() (map[string]map[string]multipass.Snapshot, error) {
+	args := m.Called()
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).(map[string]map[string]multipass.Snapshot), args.Error(1)
+}
+
 // CreateSnapshot mocks the CreateSnapshot method
 func (m *MockMultipassClient) CreateSnapshot(vmName, snapshotName string) error {
 	args := m.Called(vmName, snapshotName)
@@ -101,15 +164,27 @@ func (m *MockMultipassClient) Transfer(src, dst string) error {
 	return args.Error(0)
 }
 
+// TransferRecursive mocks the TransferRecursive method
+func (m *MockMultipassClient) TransferRecursive(src, dst string) error {
+	args := m.Called(src, dst)
+	return args.Error(0)
+}
+
 // Exec mocks the Exec method
 func (m *MockMultipassClient) Exec(vmName string, cmd ...string) (string, error) {
 	args := m.Called(vmName, cmd)
 	return args.String(0), args.Error(1)
 }
 
+// ExecWithTimeout mocks the ExecWithTimeout method
+func (m *MockMultipassClient) ExecWithTimeout(vmName string, timeout time.Duration, cmd ...string) (string, error) {
+	args := m.Called(vmName, timeout, cmd)
+	return args.String(0), args.Error(1)
+}
+
 // Mount mocks the Mount method
-func (m *MockMultipassClient) Mount(vmName, hostPath, vmPath string) error {
-	args := m.Called(vmName, hostPath, vmPath)
+func (m *MockMultipassClient) Mount(vmName string, opts multipass.MountOptions) error {
+	args := m.Called(vmName, opts)
 	return args.Error(0)
 }
 
@@ -119,6 +194,27 @@ func (m *MockMultipassClient) Unmount(vmName, path string) error {
 	return args.Error(0)
 }
 
+// Raw mocks the Raw method
+func (m *MockMultipassClient) Raw(rawArgs ...string) ([]byte, error) {
+	args := m.Called(rawArgs)
+	if args.Get(0) == nil {
+		return nil, args.Error(1)
+	}
+	return args.Get(0).([]byte), args.Error(1)
+}
+
+// Version mocks the Version method
+func (m *MockMultipassClient) Version() (multipass.Version, error) {
+	args := m.Called()
+	return args.Get(0).(multipass.Version), args.Error(1)
+}
+
+// Supports mocks the Supports method
+func (m *MockMultipassClient) Supports(f multipass.Feature) bool {
+	args := m.Called(f)
+	return args.Bool(0)
+}
+
 // Helper functions for creating test fixtures
 
 // RunningVM creates a mock InstanceInfo for a running VM
@@ -216,3 +312,22 @@ func TestSnapshots() map[string]multipass.Snapshot {
 		"snap2": {Comment: "After update", Parent: "snap1"},
 	}
 }
+
+// ExitError returns the error of a command in a VM that exited with code
+func ExitError(code int) error {
+	err := exec.Command("sh", "-c", fmt.Sprintf("exit %d", code)).Run()
+	return &multipass.MultipassError{Command: "exec", Err: err}
+}
+
+// MockNetworkConfig sets up the network config stored in a VM; an empty
+// config means the VM has none
+func (m *MockMultipassClient) MockNetworkConfig(vmName, config string) {
+	const path = "/opt/dabbi/network/config.json"
+	probe := []string{"sh", "-c", "test -f " + path + " && echo present || echo absent"}
+	if config == "" {
+		m.On("ExecWithTimeout", vmName, mock.Anything, probe).Return("absent\n", nil)
+		return
+	}
+	m.On("ExecWithTimeout", vmName, mock.Anything, probe).Return("present\n", nil)
+	m.On("ExecWithTimeout", vmName, mock.Anything, []string{"cat", path}).Return(config, nil)
+}
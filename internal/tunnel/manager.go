@@ -1,13 +1,26 @@
 package tunnel
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/portmap"
+	"golang.org/x/time/rate"
+)
+
+// Default host ports stable tunnels are assigned from, after the agent
+// listeners' default range
+const (
+	DefaultStableBasePort  = 12000 // first port
+	DefaultStablePortRange = 1000  // number of ports
 )
 
 // Manager manages TCP tunnels to VMs
@@ -15,28 +28,98 @@ type Manager struct {
 	mu      sync.RWMutex
 	tunnels map[int]*Tunnel
 	mp      multipass.Client
+	subnet  *net.IPNet // preferred VM network when a VM has several IPs
+
+	stableBase  int // first host port of the stable tunnel range
+	stableRange int // number of ports in the range
 }
 
 // Tunnel represents an active TCP tunnel
 type Tunnel struct {
-	HostPort int
-	VMName   string
-	VMPort   int
-	vmIP     string
-	listener net.Listener
-	done     chan struct{}
+	HostPort      int
+	VMName        string
+	VMPort        int
+	RateLimitKBps int  // per-direction bandwidth cap in KB/s (0 = unlimited)
+	Stable        bool // HostPort was derived from VMName and VMPort
+	vmIP          string
+	listener      net.Listener
+	done          chan struct{}
+	upLimiter     *rate.Limiter // client -> VM
+	downLimiter   *rate.Limiter // VM -> client
 }
 
 // NewManager creates a new tunnel manager
 func NewManager(mp multipass.Client) *Manager {
 	return &Manager{
-		tunnels: make(map[int]*Tunnel),
-		mp:      mp,
+		tunnels:     make(map[int]*Tunnel),
+		mp:          mp,
+		stableBase:  DefaultStableBasePort,
+		stableRange: DefaultStablePortRange,
+	}
+}
+
+// SetStablePortRange sets the host ports stable tunnels are assigned from:
+// count ports starting at base. Zero keeps the default for either.
+// Changing the range moves every stable tunnel's port.
+func (m *Manager) SetStablePortRange(base, count int) error {
+	if base == 0 {
+		base = DefaultStableBasePort
+	}
+	if count == 0 {
+		count = DefaultStablePortRange
+	}
+	if base < 1 || count < 1 || base+count-1 > 65535 {
+		return fmt.Errorf("invalid stable tunnel port range: %d ports from %d must fit in 1-65535", count, base)
 	}
+	m.mu.Lock()
+	m.stableBase, m.stableRange = base, count
+	m.mu.Unlock()
+	return nil
+}
+
+// StablePort returns the host port a stable tunnel to vmName:vmPort is
+// tried on first. CreateStable moves to the next free port if it's taken.
+func (m *Manager) StablePort(vmName string, vmPort int) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return portmap.Port(stableKey(vmName, vmPort), m.stableBase, m.stableRange)
+}
+
+func stableKey(vmName string, vmPort int) string {
+	return vmName + ":" + strconv.Itoa(vmPort)
+}
+
+// SetPreferredSubnet sets the network whose VM addresses are tunneled to first
+func (m *Manager) SetPreferredSubnet(subnet *net.IPNet) {
+	m.subnet = subnet
 }
 
 // Create creates a new tunnel to a VM port
 func (m *Manager) Create(vmName string, vmPort int) (*Tunnel, error) {
+	return m.CreateWithRateLimit(vmName, vmPort, 0)
+}
+
+// CreateWithRateLimit creates a new tunnel to a VM port with an optional
+// bandwidth cap applied in each direction (0 = unlimited)
+func (m *Manager) CreateWithRateLimit(vmName string, vmPort int, rateLimitKBps int) (*Tunnel, error) {
+	return m.create(vmName, vmPort, rateLimitKBps, false)
+}
+
+// CreateStable creates a tunnel whose host port is derived from the VM name
+// and port, like agent listener ports, so it's the same every time (across
+// daemon restarts too) unless another program holds it. A taken port moves
+// the tunnel to the next free one in the range. If a stable tunnel to the
+// same VM port is open, it's returned instead, provided it has the same rate
+// limit (otherwise the error wraps ErrRateLimitChanged).
+func (m *Manager) CreateStable(vmName string, vmPort int, rateLimitKBps int) (*Tunnel, error) {
+	return m.create(vmName, vmPort, rateLimitKBps, true)
+}
+
+func (m *Manager) create(vmName string, vmPort int, rateLimitKBps int, stable bool) (*Tunnel, error) {
+	if rateLimitKBps < 0 {
+		return nil, fmt.Errorf("rate limit cannot be negative: %d", rateLimitKBps)
+	}
+
 	// Ensure VM is running
 	info, err := m.mp.Info(vmName)
 	if err != nil {
@@ -47,37 +130,88 @@ func (m *Manager) Create(vmName string, vmPort int) (*Tunnel, error) {
 		return nil, fmt.Errorf("VM %q is not running (state: %s)", vmName, info.State)
 	}
 
-	if len(info.IPv4) == 0 {
+	vmIP := multipass.PickReachableIP(vmName, info, vmPort, m.subnet)
+	if vmIP == "" {
 		return nil, fmt.Errorf("VM has no IP address")
 	}
-	vmIP := info.IPv4[0]
 
-	// Find free port on host
-	listener, err := net.Listen("tcp", ":0")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create listener: %w", err)
+	var listener net.Listener
+	if stable {
+		m.mu.RLock()
+		t, err := m.openStable(vmName, vmPort, rateLimitKBps)
+		m.mu.RUnlock()
+		if t != nil || err != nil {
+			return t, err
+		}
+
+		// Probed without the lock, since trying ports can take a while
+		_, err = portmap.Probe(stableKey(vmName, vmPort), m.stableBase, m.stableRange, func(port int) error {
+			var err error
+			listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create listener: %w", err)
+		}
+	} else {
+		// Find free port on host
+		listener, err = net.Listen("tcp", ":0")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create listener: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Another request may have opened the same stable tunnel meanwhile
+	if stable {
+		if t, err := m.openStable(vmName, vmPort, rateLimitKBps); t != nil || err != nil {
+			listener.Close()
+			return t, err
+		}
 	}
 
 	hostPort := listener.Addr().(*net.TCPAddr).Port
 
 	tunnel := &Tunnel{
-		HostPort: hostPort,
-		VMName:   vmName,
-		VMPort:   vmPort,
-		vmIP:     vmIP,
-		listener: listener,
-		done:     make(chan struct{}),
+		HostPort:      hostPort,
+		VMName:        vmName,
+		VMPort:        vmPort,
+		RateLimitKBps: rateLimitKBps,
+		Stable:        stable,
+		vmIP:          vmIP,
+		listener:      listener,
+		done:          make(chan struct{}),
+		upLimiter:     newLimiter(rateLimitKBps),
+		downLimiter:   newLimiter(rateLimitKBps),
 	}
 
 	go tunnel.serve()
-
-	m.mu.Lock()
 	m.tunnels[hostPort] = tunnel
-	m.mu.Unlock()
 
 	return tunnel, nil
 }
 
+// ErrRateLimitChanged is returned when a stable tunnel is requested with a
+// different rate limit than the open one it would reuse
+var ErrRateLimitChanged = errors.New("a stable tunnel to this VM port is open with a different rate limit; delete it first")
+
+// openStable returns the open stable tunnel to a VM port, if any. It fails
+// if the tunnel's rate limit isn't the requested one, since connections
+// already through it can't change theirs. The caller holds m.mu.
+func (m *Manager) openStable(vmName string, vmPort int, rateLimitKBps int) (*Tunnel, error) {
+	for _, t := range m.tunnels {
+		if t.Stable && t.VMName == vmName && t.VMPort == vmPort {
+			if t.RateLimitKBps != rateLimitKBps {
+				return nil, fmt.Errorf("%w (open at %d KB/s, requested %d KB/s)", ErrRateLimitChanged, t.RateLimitKBps, rateLimitKBps)
+			}
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
 // Delete closes a tunnel
 func (m *Manager) Delete(hostPort int) error {
 	m.mu.Lock()
@@ -96,6 +230,26 @@ func (m *Manager) Delete(hostPort int) error {
 	return nil
 }
 
+// DeleteVM closes every tunnel to a VM, e.g. before it is deleted or
+// relaunched with a new IP, and returns how many were closed
+func (m *Manager) DeleteVM(vmName string) int {
+	m.mu.Lock()
+	var closing []*Tunnel
+	for port, t := range m.tunnels {
+		if t.VMName == vmName {
+			closing = append(closing, t)
+			delete(m.tunnels, port)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, t := range closing {
+		close(t.done)
+		t.listener.Close()
+	}
+	return len(closing)
+}
+
 // List returns all active tunnels
 func (m *Manager) List() []*Tunnel {
 	m.mu.RLock()
@@ -108,6 +262,26 @@ func (m *Manager) List() []*Tunnel {
 	return tunnels
 }
 
+// ListByVM returns the active tunnels to a VM, ordered by VM port
+func (m *Manager) ListByVM(vmName string) []*Tunnel {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var tunnels []*Tunnel
+	for _, t := range m.tunnels {
+		if t.VMName == vmName {
+			tunnels = append(tunnels, t)
+		}
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		if tunnels[i].VMPort != tunnels[j].VMPort {
+			return tunnels[i].VMPort < tunnels[j].VMPort
+		}
+		return tunnels[i].HostPort < tunnels[j].HostPort
+	})
+	return tunnels
+}
+
 // serve accepts connections and proxies them to the VM
 func (t *Tunnel) serve() {
 	for {
@@ -140,27 +314,67 @@ func (t *Tunnel) handleConnection(client net.Conn) {
 	defer client.Close()
 
 	// Connect to VM
-	target, err := net.Dial("tcp", fmt.Sprintf("%s:%d", t.vmIP, t.VMPort))
+	target, err := net.Dial("tcp", net.JoinHostPort(t.vmIP, strconv.Itoa(t.VMPort)))
 	if err != nil {
+		multipass.ForgetReachableIP(t.VMName)
 		return
 	}
 	defer target.Close()
 
-	// Bidirectional copy
+	// Bidirectional copy (throttled when a rate limit is configured)
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		io.Copy(target, client)
+		io.Copy(target, limitReader(client, t.upLimiter))
 		target.(*net.TCPConn).CloseWrite()
 	}()
 
 	go func() {
 		defer wg.Done()
-		io.Copy(client, target)
+		io.Copy(client, limitReader(target, t.downLimiter))
 		client.(*net.TCPConn).CloseWrite()
 	}()
 
 	wg.Wait()
 }
+
+// newLimiter returns a token bucket allowing kbps KB/s with a one second burst,
+// or nil when kbps is zero (unlimited)
+func newLimiter(kbps int) *rate.Limiter {
+	if kbps <= 0 {
+		return nil
+	}
+	bytesPerSec := kbps * 1024
+	return rate.NewLimiter(rate.Limit(bytesPerSec), bytesPerSec)
+}
+
+// limitReader wraps r so reads are throttled by limiter (nil = unlimited)
+func limitReader(r io.Reader, limiter *rate.Limiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &rateLimitedReader{r: r, limiter: limiter}
+}
+
+// rateLimitedReader blocks after each read until the limiter grants the bytes read
+type rateLimitedReader struct {
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	// WaitN fails for requests larger than the burst, so cap the read size
+	if burst := l.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if werr := l.limiter.WaitN(context.Background(), n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -2,7 +2,11 @@ package tunnel
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/testutil"
@@ -40,6 +44,49 @@ func TestManager_Create_Success(t *testing.T) {
 	mockMP.AssertExpectations(t)
 }
 
+func TestManager_Create_PicksReachableIP(t *testing.T) {
+	// Only the second address answers, like a VM whose first IP is an unreachable bridge
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	vmPort := ln.Addr().(*net.TCPAddr).Port
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "multi-ip").Return(&multipass.InstanceInfo{
+		State: multipass.StateRunning,
+		IPv4:  []string{"192.0.2.10", "127.0.0.1"},
+	}, nil)
+
+	m := NewManager(mockMP)
+
+	tunnel, err := m.Create("multi-ip", vmPort)
+	require.NoError(t, err)
+	defer m.Delete(tunnel.HostPort)
+
+	assert.Equal(t, "127.0.0.1", tunnel.vmIP)
+	mockMP.AssertExpectations(t)
+}
+
+func TestManager_Create_PrefersSubnet(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "multi-ip").Return(&multipass.InstanceInfo{
+		State: multipass.StateRunning,
+		IPv4:  []string{"10.0.0.5", "192.168.64.5"},
+	}, nil)
+
+	_, subnet, err := net.ParseCIDR("192.168.64.0/24")
+	require.NoError(t, err)
+
+	m := NewManager(mockMP)
+	m.SetPreferredSubnet(subnet)
+
+	tunnel, err := m.Create("multi-ip", 8080)
+	require.NoError(t, err)
+	defer m.Delete(tunnel.HostPort)
+
+	assert.Equal(t, "192.168.64.5", tunnel.vmIP)
+}
+
 func TestManager_Create_VMNotRunning(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
 	mockMP.On("Info", "stopped-vm").Return(testutil.StoppedVM("stopped-vm"), nil)
@@ -114,6 +161,29 @@ func TestManager_Delete_NotFound(t *testing.T) {
 	assert.Contains(t, err.Error(), "tunnel not found")
 }
 
+func TestManager_DeleteVM(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "192.168.64.5"), nil)
+	mockMP.On("Info", "vm2").Return(testutil.RunningVM("vm2", "192.168.64.6"), nil)
+
+	m := NewManager(mockMP)
+
+	_, err := m.Create("vm1", 8080)
+	require.NoError(t, err)
+	_, err = m.Create("vm1", 3000)
+	require.NoError(t, err)
+	other, err := m.Create("vm2", 8080)
+	require.NoError(t, err)
+	defer m.Delete(other.HostPort)
+
+	assert.Equal(t, 2, m.DeleteVM("vm1"))
+	assert.Equal(t, 0, m.DeleteVM("vm1"))
+
+	tunnels := m.List()
+	require.Len(t, tunnels, 1)
+	assert.Equal(t, "vm2", tunnels[0].VMName)
+}
+
 func TestManager_List(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
 	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "192.168.64.5"), nil)
@@ -145,6 +215,38 @@ func TestManager_List(t *testing.T) {
 	mockMP.AssertExpectations(t)
 }
 
+func TestManager_ListByVM(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "vm1").Return(testutil.RunningVM("vm1", "192.168.64.5"), nil)
+	mockMP.On("Info", "vm2").Return(testutil.RunningVM("vm2", "192.168.64.6"), nil)
+
+	m := NewManager(mockMP)
+	defer m.DeleteVM("vm1")
+	defer m.DeleteVM("vm2")
+
+	for _, port := range []int{8080, 3000} {
+		_, err := m.Create("vm1", port)
+		require.NoError(t, err)
+	}
+	_, err := m.Create("vm2", 8080)
+	require.NoError(t, err)
+
+	vm1 := m.ListByVM("vm1")
+	require.Len(t, vm1, 2)
+	assert.Equal(t, 3000, vm1[0].VMPort)
+	assert.Equal(t, 8080, vm1[1].VMPort)
+	for _, tun := range vm1 {
+		assert.Equal(t, "vm1", tun.VMName)
+	}
+
+	vm2 := m.ListByVM("vm2")
+	require.Len(t, vm2, 1)
+	assert.Equal(t, "vm2", vm2[0].VMName)
+
+	assert.Empty(t, m.ListByVM("vm3"))
+	assert.Len(t, m.List(), 3)
+}
+
 func TestManager_ConcurrentAccess(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
 	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "192.168.64.5"), nil)
@@ -177,3 +279,183 @@ func TestManager_ConcurrentAccess(t *testing.T) {
 		m.Delete(t.HostPort)
 	}
 }
+
+func TestManager_CreateWithRateLimit_NegativeRejected(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	m := NewManager(mockMP)
+
+	tunnel, err := m.CreateWithRateLimit("test-vm", 8080, -1)
+	assert.Error(t, err)
+	assert.Nil(t, tunnel)
+	assert.Contains(t, err.Error(), "cannot be negative")
+}
+
+func TestManager_CreateWithRateLimit_ThrottlesTransfer(t *testing.T) {
+	// Local sink standing in for a service inside the VM
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer sink.Close()
+
+	received := make(chan int64, 1)
+	go func() {
+		conn, err := sink.Accept()
+		if err != nil {
+			received <- 0
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- n
+	}()
+
+	sinkPort := sink.Addr().(*net.TCPAddr).Port
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "test-vm").Return(testutil.RunningVM("test-vm", "127.0.0.1"), nil)
+
+	m := NewManager(mockMP)
+
+	const rateLimitKBps = 128
+	tunnel, err := m.CreateWithRateLimit("test-vm", sinkPort, rateLimitKBps)
+	require.NoError(t, err)
+	defer m.Delete(tunnel.HostPort)
+	assert.Equal(t, rateLimitKBps, tunnel.RateLimitKBps)
+
+	conn, err := net.Dial("tcp", tunnel.listener.Addr().String())
+	require.NoError(t, err)
+
+	// 256KB at 128KB/s with a one second burst needs at least ~1s
+	payload := make([]byte, 256*1024)
+	start := time.Now()
+	_, err = conn.Write(payload)
+	require.NoError(t, err)
+	conn.(*net.TCPConn).CloseWrite()
+
+	select {
+	case n := <-received:
+		assert.Equal(t, int64(len(payload)), n)
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer did not complete")
+	}
+	conn.Close()
+
+	assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+}
+
+// freeRange returns the first of n ports likely to be free, for stable port tests
+func freeRange(t *testing.T, n int) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	base := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	if base+n-1 > 65535 {
+		base = 65535 - n + 1
+	}
+	return base
+}
+
+func TestManager_CreateStable(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "db").Return(testutil.RunningVM("db", "192.168.64.5"), nil)
+
+	m := NewManager(mockMP)
+	base := freeRange(t, 20)
+	require.NoError(t, m.SetStablePortRange(base, 20))
+
+	first, err := m.CreateStable("db", 5432, 0)
+	require.NoError(t, err)
+	assert.True(t, first.Stable)
+	assert.Equal(t, m.StablePort("db", 5432), first.HostPort)
+
+	// Asking again returns the open tunnel
+	again, err := m.CreateStable("db", 5432, 0)
+	require.NoError(t, err)
+	assert.Same(t, first, again)
+	assert.Len(t, m.List(), 1)
+
+	// But not with a different rate limit, which it can't take on
+	_, err = m.CreateStable("db", 5432, 100)
+	assert.ErrorIs(t, err, ErrRateLimitChanged)
+	assert.Len(t, m.List(), 1)
+
+	// The same VM port gets the same host port after the tunnel is closed,
+	// as it would from a restarted daemon
+	require.NoError(t, m.Delete(first.HostPort))
+	restarted := NewManager(mockMP)
+	require.NoError(t, restarted.SetStablePortRange(base, 20))
+	reopened, err := restarted.CreateStable("db", 5432, 0)
+	require.NoError(t, err)
+	defer restarted.Delete(reopened.HostPort)
+	assert.Equal(t, first.HostPort, reopened.HostPort)
+}
+
+func TestManager_CreateStable_Collision(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "db").Return(testutil.RunningVM("db", "192.168.64.5"), nil)
+
+	m := NewManager(mockMP)
+	base := freeRange(t, 2)
+	require.NoError(t, m.SetStablePortRange(base, 2))
+
+	// Another program holds the hashed port, so the next one is used
+	want := m.StablePort("db", 5432)
+	held, err := net.Listen("tcp", fmt.Sprintf(":%d", want))
+	if err != nil {
+		t.Skipf("port %d not free: %v", want, err)
+	}
+	defer held.Close()
+
+	tun, err := m.CreateStable("db", 5432, 0)
+	if err != nil {
+		t.Skipf("neither port in %d-%d is free: %v", base, base+1, err)
+	}
+	defer m.Delete(tun.HostPort)
+	assert.NotEqual(t, want, tun.HostPort)
+	assert.Equal(t, base+(want-base+1)%2, tun.HostPort)
+
+	// With the whole range taken, creating fails
+	_, err = m.CreateStable("db", 5433, 0)
+	assert.ErrorContains(t, err, "no free port")
+}
+
+func TestManager_CreateStable_Concurrent(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Info", "db").Return(testutil.RunningVM("db", "192.168.64.5"), nil)
+
+	m := NewManager(mockMP)
+	require.NoError(t, m.SetStablePortRange(freeRange(t, 20), 20))
+
+	// Requests racing for the same stable tunnel all get the one tunnel
+	const n = 8
+	results := make(chan *Tunnel, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			tun, err := m.CreateStable("db", 5432, 0)
+			assert.NoError(t, err)
+			results <- tun
+		}()
+	}
+	first := <-results
+	for i := 1; i < n; i++ {
+		assert.Same(t, first, <-results)
+	}
+	assert.Len(t, m.List(), 1)
+	require.NoError(t, m.Delete(first.HostPort))
+}
+
+func TestManager_SetStablePortRange(t *testing.T) {
+	m := NewManager(new(testutil.MockMultipassClient))
+
+	require.NoError(t, m.SetStablePortRange(20000, 10))
+	for _, port := range []int{22, 5432, 8080} {
+		p := m.StablePort("vm", port)
+		assert.GreaterOrEqual(t, p, 20000)
+		assert.Less(t, p, 20010)
+	}
+
+	assert.Error(t, m.SetStablePortRange(65000, 1000))
+	assert.Error(t, m.SetStablePortRange(-1, 10))
+	require.NoError(t, m.SetStablePortRange(0, 0))
+	assert.Equal(t, DefaultStableBasePort, m.stableBase)
+	assert.Equal(t, DefaultStablePortRange, m.stableRange)
+}
@@ -0,0 +1,194 @@
+package vmspec
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+const (
+	vmsDir        = "vms"
+	cloudInitFile = "cloud-init.yaml"
+	specFile      = "spec.json"
+	sshAgentFile  = "ssh-agent-secret"
+)
+
+// Store keeps what each VM was launched with: the rendered cloud-init and
+// the create request, in <dir>/<vm>/cloud-init.yaml and <dir>/<vm>/spec.json.
+// Multipass discards the cloud-init after launch, so this is the only record.
+// VMs created with --forward-ssh-agent also get <dir>/<vm>/ssh-agent-secret,
+// the secret their cloud-init was given; deleting the record revokes it.
+type Store struct {
+	dir string
+}
+
+// NewStore creates a spec store rooted at dir
+func NewStore(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// DefaultDir returns the directory VM specs are stored in (~/.dabbi/vms)
+func DefaultDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, config.ConfigDir, vmsDir), nil
+}
+
+func (s *Store) vmDir(vmName string) (string, error) {
+	if err := multipass.ValidateInstanceName(vmName); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, vmName), nil
+}
+
+// Save records a VM's rendered cloud-init and create request, replacing any
+// earlier record for the same name
+func (s *Store) Save(vmName, cloudInit string, spec interface{}) error {
+	dir, err := s.vmDir(vmName)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	// Mode 0600: the rendered cloud-init contains the auth token
+	if err := os.WriteFile(filepath.Join(dir, cloudInitFile), []byte(cloudInit), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, specFile), append(data, '\n'), 0600)
+}
+
+// Spec returns the create request a VM was launched with. The error wraps
+// os.ErrNotExist if none was recorded.
+func (s *Store) Spec(vmName string) (json.RawMessage, error) {
+	dir, err := s.vmDir(vmName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", os.ErrNotExist, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, specFile))
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("corrupt spec for VM %s", vmName)
+	}
+	return json.RawMessage(data), nil
+}
+
+// CloudInit returns the rendered cloud-init a VM was launched with. The error
+// wraps os.ErrNotExist if none was recorded.
+func (s *Store) CloudInit(vmName string) (string, error) {
+	dir, err := s.vmDir(vmName)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", os.ErrNotExist, err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, cloudInitFile))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Copy records a clone as launched like its source: the same cloud-init, and
+// the source's create request with the new name and any overrides (keyed by
+// their JSON field, e.g. "cpu") applied. The error wraps os.ErrNotExist if
+// the source has no record.
+func (s *Store) Copy(from, to string, overrides map[string]interface{}) error {
+	data, err := s.Spec(from)
+	if err != nil {
+		return err
+	}
+	cloudInit, err := s.CloudInit(from)
+	if err != nil {
+		return err
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("corrupt spec for VM %s: %w", from, err)
+	}
+	for k, v := range overrides {
+		spec[k] = v
+	}
+	spec["name"] = to
+	return s.Save(to, cloudInit, spec)
+}
+
+// GrantSSHAgent records the secret a VM's cloud-init was given to use the
+// host's SSH agent, replacing any earlier one
+func (s *Store) GrantSSHAgent(vmName, secret string) error {
+	dir, err := s.vmDir(vmName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, sshAgentFile), []byte(secret+"\n"), 0600)
+}
+
+// RevokeSSHAgent drops a VM's SSH agent secret. Revoking a VM without one is
+// not an error.
+func (s *Store) RevokeSSHAgent(vmName string) error {
+	dir, err := s.vmDir(vmName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, sshAgentFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SSHAgentVM returns the VM granted the SSH agent with secret, and whether
+// there is one
+func (s *Store) SSHAgentVM(secret string) (string, bool, error) {
+	if secret == "" {
+		return "", false, nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(s.dir, e.Name(), sshAgentFile))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(string(data))), []byte(secret)) == 1 {
+			return e.Name(), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// Delete removes a VM's record. Deleting a VM without one is not an error.
+func (s *Store) Delete(vmName string) error {
+	dir, err := s.vmDir(vmName)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package vmspec
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_SaveLoadDelete(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore(dir)
+
+	// Nothing recorded yet
+	_, err := s.Spec("dev")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	_, err = s.CloudInit("dev")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	spec := map[string]interface{}{"name": "dev", "cpu": 2}
+	require.NoError(t, s.Save("dev", "#cloud-config\n", spec))
+
+	got, err := s.Spec("dev")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "dev", "cpu": 2}`, string(got))
+	cloudInit, err := s.CloudInit("dev")
+	require.NoError(t, err)
+	assert.Equal(t, "#cloud-config\n", cloudInit)
+
+	// Both files are private; the cloud-init holds the auth token
+	for _, name := range []string{cloudInitFile, specFile} {
+		info, err := os.Stat(filepath.Join(dir, "dev", name))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), name)
+	}
+
+	// Saving again replaces the record
+	require.NoError(t, s.Save("dev", "#cloud-config\npackages: [htop]\n", map[string]string{"name": "dev"}))
+	got, err = s.Spec("dev")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "dev"}`, string(got))
+
+	require.NoError(t, s.Delete("dev"))
+	_, err = os.Stat(filepath.Join(dir, "dev"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Deleting again is fine
+	require.NoError(t, s.Delete("dev"))
+}
+
+func TestStore_RejectsUnsafeNames(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore(filepath.Join(dir, "vms"))
+
+	for _, name := range []string{"", "..", "../escape", "a/b", ".hidden", "-flag"} {
+		assert.Error(t, s.Save(name, "", nil), name)
+		assert.Error(t, s.Delete(name), name)
+		_, err := s.Spec(name)
+		assert.True(t, errors.Is(err, os.ErrNotExist), name)
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "nothing written outside the store")
+}
+
+func TestStore_Copy(t *testing.T) {
+	s := NewStore(t.TempDir())
+
+	err := s.Copy("dev", "dev-copy", nil)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	require.NoError(t, s.Save("dev", "#cloud-config\n", map[string]interface{}{"name": "dev", "cpu": 2, "mem": "4G"}))
+	require.NoError(t, s.Copy("dev", "dev-copy", map[string]interface{}{"mem": "8G"}))
+
+	got, err := s.Spec("dev-copy")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "dev-copy", "cpu": 2, "mem": "8G"}`, string(got))
+	cloudInit, err := s.CloudInit("dev-copy")
+	require.NoError(t, err)
+	assert.Equal(t, "#cloud-config\n", cloudInit)
+
+	// The source is untouched
+	got, err = s.Spec("dev")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "dev", "cpu": 2, "mem": "4G"}`, string(got))
+}
+
+func TestStore_SSHAgent(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore(dir)
+
+	_, ok, err := s.SSHAgentVM("s3cret")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, s.Save("dev", "#cloud-config\n", map[string]string{"name": "dev"}))
+	require.NoError(t, s.GrantSSHAgent("dev", "s3cret"))
+
+	vm, ok, err := s.SSHAgentVM("s3cret")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "dev", vm)
+
+	for _, secret := range []string{"", "other", "s3cre"} {
+		_, ok, err = s.SSHAgentVM(secret)
+		require.NoError(t, err)
+		assert.False(t, ok, secret)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "dev", sshAgentFile))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	require.NoError(t, s.RevokeSSHAgent("dev"))
+	require.NoError(t, s.RevokeSSHAgent("dev"))
+	_, ok, err = s.SSHAgentVM("s3cret")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	// Deleting the record revokes it too
+	require.NoError(t, s.GrantSSHAgent("dev", "s3cret"))
+	require.NoError(t, s.Delete("dev"))
+	_, ok, err = s.SSHAgentVM("s3cret")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,184 @@
+package watchdog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/config"
+	"github.com/mjshashank/dabbi/internal/multipass"
+)
+
+const stopLogFile = "activity.json"
+
+// StopLog records when VMs were stopped or suspended, on the host in
+// ~/.dabbi/activity.json. The in-VM checkpoint lives in /tmp and can't be read
+// while a VM is down, so this is the only activity record for stopped VMs.
+type StopLog struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewStopLog creates a stop log backed by the given file
+func NewStopLog(path string) *StopLog {
+	return &StopLog{path: path}
+}
+
+// DefaultStopLogPath returns the path to the stop log (~/.dabbi/activity.json)
+func DefaultStopLogPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, config.ConfigDir, stopLogFile), nil
+}
+
+// StoppedAt returns when a VM was last stopped by dabbi, if known
+func (l *StopLog) StoppedAt(vmName string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		return time.Time{}, false
+	}
+	t, ok := entries[vmName]
+	return t, ok
+}
+
+// Record notes that a VM was stopped at t
+func (l *StopLog) Record(vmName string, t time.Time) error {
+	return l.update(func(entries map[string]time.Time) {
+		entries[vmName] = t.UTC()
+	})
+}
+
+// Forget drops a VM's entry (it was started again or deleted)
+func (l *StopLog) Forget(vmName string) error {
+	return l.update(func(entries map[string]time.Time) {
+		delete(entries, vmName)
+	})
+}
+
+func (l *StopLog) update(fn func(entries map[string]time.Time)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		return err
+	}
+	fn(entries)
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+func (l *StopLog) load() (map[string]time.Time, error) {
+	entries := make(map[string]time.Time)
+
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", l.path, err)
+	}
+	return entries, nil
+}
+
+// stopTrackingClient records lifecycle changes in a StopLog
+type stopTrackingClient struct {
+	multipass.Client
+	log *StopLog
+}
+
+// TrackStops wraps a multipass client so that stopping or suspending a VM
+// records the time in log, and starting or purging it clears the entry
+func TrackStops(mp multipass.Client, log *StopLog) multipass.Client {
+	return &stopTrackingClient{Client: mp, log: log}
+}
+
+func (c *stopTrackingClient) Stop(name string) error {
+	if err := c.Client.Stop(name); err != nil {
+		return err
+	}
+	_ = c.log.Record(name, time.Now())
+	return nil
+}
+
+func (c *stopTrackingClient) StopWithOptions(name string, force bool, timeout time.Duration) error {
+	if err := c.Client.StopWithOptions(name, force, timeout); err != nil {
+		return err
+	}
+	_ = c.log.Record(name, time.Now())
+	return nil
+}
+
+func (c *stopTrackingClient) Suspend(name string) error {
+	if err := c.Client.Suspend(name); err != nil {
+		return err
+	}
+	_ = c.log.Record(name, time.Now())
+	return nil
+}
+
+func (c *stopTrackingClient) Start(name string) error {
+	if err := c.Client.Start(name); err != nil {
+		return err
+	}
+	_ = c.log.Forget(name)
+	return nil
+}
+
+func (c *stopTrackingClient) Restart(name string) error {
+	if err := c.Client.Restart(name); err != nil {
+		return err
+	}
+	_ = c.log.Forget(name)
+	return nil
+}
+
+func (c *stopTrackingClient) Delete(name string, purge bool) error {
+	if err := c.Client.Delete(name, purge); err != nil {
+		return err
+	}
+	if purge {
+		_ = c.log.Forget(name)
+	}
+	return nil
+}
+
+// LastActivity returns when a VM was last seen active: the watchdog
+// checkpoint for a running VM, or the recorded stop time otherwise
+func LastActivity(mp multipass.Client, log *StopLog, vm multipass.ListInstance) (time.Time, bool) {
+	if vm.State == multipass.StateRunning {
+		cp, err := readCheckpoint(mp, vm.Name)
+		if err != nil {
+			return time.Time{}, false
+		}
+		t, err := time.Parse(time.RFC3339, cp.Timestamp)
+		return t, err == nil
+	}
+
+	if log == nil {
+		return time.Time{}, false
+	}
+	return log.StoppedAt(vm.Name)
+}
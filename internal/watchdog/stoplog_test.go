@@ -0,0 +1,83 @@
+package watchdog
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjshashank/dabbi/internal/multipass"
+	"github.com/mjshashank/dabbi/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStopLog(t *testing.T) *StopLog {
+	return NewStopLog(filepath.Join(t.TempDir(), "activity.json"))
+}
+
+func TestTrackStops(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Stop", "vm1").Return(nil)
+	mockMP.On("Suspend", "vm2").Return(nil)
+	mockMP.On("Start", "vm1").Return(nil)
+	mockMP.On("Delete", "vm2", false).Return(nil)
+	mockMP.On("Delete", "vm2", true).Return(nil)
+	mockMP.On("Stop", "broken").Return(errors.New("stop failed"))
+
+	log := newTestStopLog(t)
+	mp := TrackStops(mockMP, log)
+
+	require.NoError(t, mp.Stop("vm1"))
+	require.NoError(t, mp.Suspend("vm2"))
+	assert.Error(t, mp.Stop("broken"))
+
+	stoppedAt, ok := log.StoppedAt("vm1")
+	require.True(t, ok)
+	assert.WithinDuration(t, time.Now(), stoppedAt, time.Minute)
+	_, ok = log.StoppedAt("vm2")
+	assert.True(t, ok)
+	_, ok = log.StoppedAt("broken")
+	assert.False(t, ok, "failed stops are not recorded")
+
+	// Starting clears the entry
+	require.NoError(t, mp.Start("vm1"))
+	_, ok = log.StoppedAt("vm1")
+	assert.False(t, ok)
+
+	// A recoverable delete keeps it, a purge clears it
+	require.NoError(t, mp.Delete("vm2", false))
+	_, ok = log.StoppedAt("vm2")
+	assert.True(t, ok)
+	require.NoError(t, mp.Delete("vm2", true))
+	_, ok = log.StoppedAt("vm2")
+	assert.False(t, ok)
+
+	mockMP.AssertExpectations(t)
+}
+
+func TestLastActivity(t *testing.T) {
+	log := newTestStopLog(t)
+	stoppedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, log.Record("stopped-vm", stoppedAt))
+
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("Exec", "running-vm", []string{"cat", CheckpointPath}).
+		Return(`{"timestamp":"2024-02-01T00:00:00Z","rx_bytes":1,"tx_bytes":2}`, nil)
+	mockMP.On("Exec", "fresh-vm", []string{"cat", CheckpointPath}).
+		Return("", errors.New("no such file"))
+
+	got, ok := LastActivity(mockMP, log, multipass.ListInstance{Name: "running-vm", State: multipass.StateRunning})
+	require.True(t, ok)
+	assert.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), got)
+
+	_, ok = LastActivity(mockMP, log, multipass.ListInstance{Name: "fresh-vm", State: multipass.StateRunning})
+	assert.False(t, ok)
+
+	got, ok = LastActivity(mockMP, log, multipass.ListInstance{Name: "stopped-vm", State: multipass.StateStopped})
+	require.True(t, ok)
+	assert.True(t, stoppedAt.Equal(got))
+
+	_, ok = LastActivity(mockMP, log, multipass.ListInstance{Name: "unknown-vm", State: multipass.StateStopped})
+	assert.False(t, ok)
+}
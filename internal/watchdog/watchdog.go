@@ -1,22 +1,54 @@
 package watchdog
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
-	"strconv"
-	"strings"
+	"math"
+	"sync"
 	"time"
 
+	"github.com/mjshashank/dabbi/internal/labels"
 	"github.com/mjshashank/dabbi/internal/multipass"
 )
 
 const (
-	checkpointPath       = "/tmp/dabbi-activity.json"
-	loadAverageThreshold = 0.1    // Consider VM active if 1-min load avg exceeds this
-	networkNoiseBytes    = 100000 // ~100KB/min threshold to filter out background noise (DHCP, NTP, etc.)
+	// CheckpointPath is where the watchdog records activity inside each VM
+	CheckpointPath = "/tmp/dabbi-activity.json"
+
+	// Default activity thresholds, see SetThresholds
+	DefaultLoadThreshold    = 0.1    // Consider VM active if 1-min load avg exceeds this
+	DefaultNoiseBytesPerMin = 100000 // ~100KB/min threshold to filter out background noise (DHCP, NTP, etc.)
+
+	// stopTimeout is how long an idle VM gets to shut down cleanly before
+	// it's powered off, so a hung guest doesn't keep running forever
+	stopTimeout = 2 * time.Minute
+
+	// Bounds for the inactivity timeout
+	MinTimeout = 1 * time.Minute
+	MaxTimeout = 7 * 24 * time.Hour
+)
+
+// Actions the watchdog can take on an inactive VM
+const (
+	ActionStop    = "stop"    // full shutdown (default)
+	ActionSuspend = "suspend" // keep memory state, resumes much faster
 )
 
+// Decision outcomes besides ActionStop and ActionSuspend
+const (
+	DecisionKeep = "keep" // VM is active or still within the timeout
+	DecisionSkip = "skip" // VM couldn't be checked this round
+)
+
+// Decision records what one check decided for a running VM
+type Decision struct {
+	VM     string `json:"vm"`
+	Action string `json:"action"` // keep, skip, stop, or suspend
+	Reason string `json:"reason"`
+}
+
 // checkpoint stores activity state inside the VM
 type checkpoint struct {
 	Timestamp string `json:"timestamp"`
@@ -24,21 +56,20 @@ type checkpoint struct {
 	TxBytes   uint64 `json:"tx_bytes"`
 }
 
-// activityStats holds all activity indicators queried from a VM
-type activityStats struct {
-	RxBytes         uint64
-	TxBytes         uint64
-	PTYIdleSeconds  int     // Seconds since last PTY activity (-1 if no PTY)
-	LoadAverage1Min float64
-}
-
 // Watchdog monitors VM activity and stops inactive VMs.
 // Activity is determined by: PTY sessions, CPU load, or network traffic.
 // State is stored inside each VM at /tmp/dabbi-activity.json, making the daemon stateless.
 type Watchdog struct {
-	timeout time.Duration
-	mp      multipass.Client
-	stopCh  chan struct{}
+	mu            sync.RWMutex
+	checkMu       sync.Mutex // serializes ticker and on-demand checks
+	timeout       time.Duration
+	action        string
+	loadThreshold float64 // 1-min load average above which a VM is active
+	noiseBytes    uint64  // network traffic at or below this is background noise
+	mp            multipass.Client
+	labels        *labels.Store       // pinned VMs are never stopped (nil = none pinned)
+	onShutdown    func(vmName string) // called after a VM is stopped or suspended (nil = none)
+	stopCh        chan struct{}
 }
 
 // New creates a new watchdog that monitors VMs for inactivity
@@ -57,11 +88,126 @@ func (w *Watchdog) Stop() {
 	close(w.stopCh)
 }
 
+// SetLabels sets the store read for pinned VMs (see labels.PinnedKey)
+func (w *Watchdog) SetLabels(ls *labels.Store) {
+	w.mu.Lock()
+	w.labels = ls
+	w.mu.Unlock()
+}
+
+// SetOnShutdown sets a function called after the watchdog stops or
+// suspends a VM, e.g. to close the daemon's listeners for it
+func (w *Watchdog) SetOnShutdown(fn func(vmName string)) {
+	w.mu.Lock()
+	w.onShutdown = fn
+	w.mu.Unlock()
+}
+
+// shutDown runs the OnShutdown hook, if any, for a VM the watchdog stopped
+// or suspended
+func (w *Watchdog) shutDown(vmName string) {
+	w.mu.RLock()
+	fn := w.onShutdown
+	w.mu.RUnlock()
+	if fn != nil {
+		fn(vmName)
+	}
+}
+
 // GetTimeout returns the inactivity timeout
 func (w *Watchdog) GetTimeout() time.Duration {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
 	return w.timeout
 }
 
+// SetTimeout changes the inactivity timeout; takes effect on the next check
+func (w *Watchdog) SetTimeout(d time.Duration) error {
+	if err := ValidateTimeout(d); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.timeout = d
+	w.mu.Unlock()
+	return nil
+}
+
+// ValidateTimeout checks that an inactivity timeout is whole minutes and within bounds
+func ValidateTimeout(d time.Duration) error {
+	if d < MinTimeout || d > MaxTimeout {
+		return fmt.Errorf("timeout must be between %v and %v, got %v", MinTimeout, MaxTimeout, d)
+	}
+	if d%time.Minute != 0 {
+		return fmt.Errorf("timeout must be a whole number of minutes, got %v", d)
+	}
+	return nil
+}
+
+// SetAction sets what happens to inactive VMs: "stop" (default) or "suspend"
+func (w *Watchdog) SetAction(action string) error {
+	switch action {
+	case "", ActionStop:
+		action = ActionStop
+	case ActionSuspend:
+	default:
+		return fmt.Errorf("invalid watchdog action: %q (must be stop or suspend)", action)
+	}
+
+	w.mu.Lock()
+	w.action = action
+	w.mu.Unlock()
+	return nil
+}
+
+// GetAction returns the action taken on inactive VMs
+func (w *Watchdog) GetAction() string {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.action == "" {
+		return ActionStop
+	}
+	return w.action
+}
+
+// SetThresholds sets the 1-minute load average above which a VM counts as
+// active, and the network traffic (bytes per minute) that counts as
+// background noise rather than use. Zero keeps a default.
+func (w *Watchdog) SetThresholds(load float64, noiseBytesPerMin int) error {
+	if load == 0 {
+		load = DefaultLoadThreshold
+	}
+	if noiseBytesPerMin == 0 {
+		noiseBytesPerMin = DefaultNoiseBytesPerMin
+	}
+	if load < 0 {
+		return fmt.Errorf("invalid watchdog load threshold: %v (must be positive)", load)
+	}
+	if noiseBytesPerMin < 0 {
+		return fmt.Errorf("invalid watchdog noise threshold: %d bytes (must be positive)", noiseBytesPerMin)
+	}
+
+	w.mu.Lock()
+	w.loadThreshold = load
+	w.noiseBytes = uint64(noiseBytesPerMin)
+	w.mu.Unlock()
+	return nil
+}
+
+// thresholds returns the load average and network noise thresholds
+func (w *Watchdog) thresholds() (load float64, noiseBytes uint64) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	load, noiseBytes = w.loadThreshold, w.noiseBytes
+	if load == 0 {
+		load = DefaultLoadThreshold
+	}
+	if noiseBytes == 0 {
+		noiseBytes = DefaultNoiseBytesPerMin
+	}
+	return load, noiseBytes
+}
+
 // run is the main watchdog loop
 func (w *Watchdog) run() {
 	ticker := time.NewTicker(1 * time.Minute)
@@ -72,36 +218,74 @@ func (w *Watchdog) run() {
 		case <-w.stopCh:
 			return
 		case <-ticker.C:
-			w.checkAllVMs()
+			_, _ = w.checkAllVMs()
 		}
 	}
 }
 
+// CheckNow runs one check of all running VMs immediately, instead of waiting
+// for the next tick, and returns what was decided for each
+func (w *Watchdog) CheckNow() ([]Decision, error) {
+	return w.checkAllVMs()
+}
+
 // checkAllVMs queries all running VMs and stops inactive ones
-func (w *Watchdog) checkAllVMs() {
+func (w *Watchdog) checkAllVMs() ([]Decision, error) {
+	w.checkMu.Lock()
+	defer w.checkMu.Unlock()
+
 	vms, err := w.mp.List()
 	if err != nil {
-		return
+		return nil, err
 	}
 
+	pinned, pinErr := w.pinned()
+	decisions := []Decision{}
 	for _, vm := range vms {
-		if vm.State == multipass.StateRunning {
-			w.checkVM(vm.Name)
+		if vm.State != multipass.StateRunning {
+			continue
 		}
+		// Stopping a pinned VM is worse than waiting for the next tick
+		if pinErr != nil {
+			decisions = append(decisions, Decision{VM: vm.Name, Action: DecisionSkip, Reason: fmt.Sprintf("could not read pinned VMs: %v", pinErr)})
+			continue
+		}
+		if pinned[vm.Name] {
+			decisions = append(decisions, Decision{VM: vm.Name, Action: DecisionKeep, Reason: "pinned"})
+			continue
+		}
+		decisions = append(decisions, w.checkVM(vm.Name))
+	}
+	return decisions, nil
+}
+
+// pinned returns the VMs to leave running whatever their activity
+func (w *Watchdog) pinned() (map[string]bool, error) {
+	w.mu.RLock()
+	ls := w.labels
+	w.mu.RUnlock()
+	if ls == nil {
+		return nil, nil
 	}
+	return ls.Pinned()
 }
 
 // checkVM checks a single VM for inactivity using hybrid detection
-func (w *Watchdog) checkVM(vmName string) {
+func (w *Watchdog) checkVM(vmName string) Decision {
+	keep := func(reason string) Decision {
+		return Decision{VM: vmName, Action: DecisionKeep, Reason: reason}
+	}
+
 	stats, err := w.getActivityStats(vmName)
 	if err != nil {
-		return // Skip this VM, try again next tick
+		// Skip this VM, try again next tick
+		return Decision{VM: vmName, Action: DecisionSkip, Reason: fmt.Sprintf("could not read activity: %v", err)}
 	}
 
 	// Check immediate activity indicators (no history needed)
 	if w.hasImmediateActivity(stats) {
 		w.writeCheckpoint(vmName, stats.RxBytes, stats.TxBytes)
-		return
+		return keep("active terminal or CPU load")
 	}
 
 	// Check network stats against checkpoint
@@ -109,40 +293,74 @@ func (w *Watchdog) checkVM(vmName string) {
 	if err != nil {
 		// No checkpoint exists - create initial one
 		w.writeCheckpoint(vmName, stats.RxBytes, stats.TxBytes)
-		return
+		return keep("no checkpoint yet")
 	}
 
 	checkpointTime, err := time.Parse(time.RFC3339, prev.Timestamp)
 	if err != nil {
 		w.writeCheckpoint(vmName, stats.RxBytes, stats.TxBytes)
-		return
+		return keep("checkpoint was unreadable, reset")
 	}
 
-	// Check if network stats changed significantly (above background noise)
+	// Check if network traffic since the checkpoint averages above
+	// background noise. The checkpoint only moves on activity, so the
+	// traffic is spread over every minute since then (at least one).
+	_, noiseBytes := w.thresholds()
 	totalDelta := absDiff(stats.RxBytes, prev.RxBytes) + absDiff(stats.TxBytes, prev.TxBytes)
-	if totalDelta > networkNoiseBytes {
+	elapsed := time.Since(checkpointTime)
+	if float64(totalDelta)/math.Max(elapsed.Minutes(), 1) > float64(noiseBytes) {
 		w.writeCheckpoint(vmName, stats.RxBytes, stats.TxBytes)
-		return
+		return keep("network activity")
 	}
 
 	// No significant activity - check if timeout exceeded
-	if time.Since(checkpointTime) > w.timeout {
-		log.Printf("[watchdog] stopping inactive VM: %s", vmName)
+	idle := elapsed.Truncate(time.Second)
+	timeout := w.GetTimeout()
+	if idle > timeout {
+		action := w.shutdownVM(vmName)
+		return Decision{VM: vmName, Action: action, Reason: fmt.Sprintf("idle for %v (timeout %v)", idle, timeout)}
+	}
+	return keep(fmt.Sprintf("idle for %v (timeout %v)", idle, timeout))
+}
+
+// shutdownVM stops or suspends an inactive VM depending on the configured
+// action, and returns the action taken
+func (w *Watchdog) shutdownVM(vmName string) string {
+	if w.GetAction() == ActionSuspend {
+		log.Printf("[watchdog] suspending inactive VM: %s", vmName)
+		// Suspend preserves /tmp, so drop the checkpoint; otherwise the stale
+		// timestamp would get the VM suspended again right after it resumes
+		w.clearCheckpoint(vmName)
 		go func(name string) {
-			_ = w.mp.Stop(name)
+			if err := w.mp.Suspend(name); err != nil {
+				log.Printf("[watchdog] failed to suspend %s: %v", name, err)
+				return
+			}
+			w.shutDown(name)
 		}(vmName)
+		return ActionSuspend
 	}
+
+	log.Printf("[watchdog] stopping inactive VM: %s", vmName)
+	go func(name string) {
+		if err := w.mp.StopWithOptions(name, true, stopTimeout); err != nil {
+			log.Printf("[watchdog] failed to stop %s: %v", name, err)
+			return
+		}
+		w.shutDown(name)
+	}(vmName)
+	return ActionStop
 }
 
 // hasImmediateActivity checks for activity indicators that don't need history
-func (w *Watchdog) hasImmediateActivity(stats *activityStats) bool {
+func (w *Watchdog) hasImmediateActivity(stats *multipass.ActivityStats) bool {
 	// Active PTY with recent activity (idle time < timeout)
-	if stats.PTYIdleSeconds >= 0 && stats.PTYIdleSeconds < int(w.timeout.Seconds()) {
+	if stats.PTYIdleSeconds >= 0 && stats.PTYIdleSeconds < int(w.GetTimeout().Seconds()) {
 		return true
 	}
 
 	// High load average indicates CPU work
-	if stats.LoadAverage1Min > loadAverageThreshold {
+	if load, _ := w.thresholds(); stats.LoadAverage1Min > load {
 		return true
 	}
 
@@ -150,40 +368,17 @@ func (w *Watchdog) hasImmediateActivity(stats *activityStats) bool {
 }
 
 // getActivityStats queries all activity indicators from the VM in one exec call
-func (w *Watchdog) getActivityStats(vmName string) (*activityStats, error) {
-	// Combined command to get all stats efficiently:
-	// 1. Network bytes from /proc/net/dev
-	// 2. PTY idle time in seconds (min across all PTYs, -1 if none)
-	// 3. Load average
-	cmd := `awk 'NR>2 {rx+=$2; tx+=$10} END {print rx, tx}' /proc/net/dev; ` +
-		`now=$(date +%s); idle=-1; for p in /dev/pts/[0-9]*; do [ -e "$p" ] && { t=$(stat -c %Y "$p"); i=$((now-t)); [ $idle -lt 0 ] || [ $i -lt $idle ] && idle=$i; }; done; echo $idle; ` +
-		`cut -d' ' -f1 /proc/loadavg`
-
-	output, err := w.mp.Exec(vmName, "sh", "-c", cmd)
-	if err != nil {
-		return nil, err
-	}
-
-	lines := strings.Split(strings.TrimSpace(output), "\n")
-	if len(lines) != 3 {
-		return nil, fmt.Errorf("unexpected output: %s", output)
-	}
-
-	stats := &activityStats{}
-
-	if parts := strings.Fields(lines[0]); len(parts) == 2 {
-		stats.RxBytes, _ = strconv.ParseUint(parts[0], 10, 64)
-		stats.TxBytes, _ = strconv.ParseUint(parts[1], 10, 64)
-	}
-	stats.PTYIdleSeconds, _ = strconv.Atoi(strings.TrimSpace(lines[1]))
-	stats.LoadAverage1Min, _ = strconv.ParseFloat(strings.TrimSpace(lines[2]), 64)
-
-	return stats, nil
+func (w *Watchdog) getActivityStats(vmName string) (*multipass.ActivityStats, error) {
+	return multipass.CollectActivity(w.mp, vmName)
 }
 
 // readCheckpoint reads the activity checkpoint from the VM
 func (w *Watchdog) readCheckpoint(vmName string) (*checkpoint, error) {
-	output, err := w.mp.Exec(vmName, "cat", checkpointPath)
+	return readCheckpoint(w.mp, vmName)
+}
+
+func readCheckpoint(mp multipass.Client, vmName string) (*checkpoint, error) {
+	output, err := mp.Exec(vmName, "cat", CheckpointPath)
 	if err != nil {
 		return nil, err
 	}
@@ -208,10 +403,16 @@ func (w *Watchdog) writeCheckpoint(vmName string, rxBytes, txBytes uint64) {
 		return
 	}
 
-	cmd := fmt.Sprintf("echo '%s' > %s", string(data), checkpointPath)
+	// Base64 keeps the payload inert whatever it contains
+	cmd := fmt.Sprintf("echo %s | base64 -d > %s", base64.StdEncoding.EncodeToString(data), CheckpointPath)
 	_, _ = w.mp.Exec(vmName, "sh", "-c", cmd)
 }
 
+// clearCheckpoint removes the activity checkpoint from the VM
+func (w *Watchdog) clearCheckpoint(vmName string) {
+	_, _ = w.mp.Exec(vmName, "rm", "-f", CheckpointPath)
+}
+
 // absDiff returns the absolute difference between two uint64 values
 func absDiff(a, b uint64) uint64 {
 	if a > b {
@@ -1,10 +1,15 @@
 package watchdog
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/mjshashank/dabbi/internal/labels"
 	"github.com/mjshashank/dabbi/internal/multipass"
 	"github.com/mjshashank/dabbi/internal/testutil"
 	"github.com/stretchr/testify/assert"
@@ -65,12 +70,12 @@ func TestHasImmediateActivity(t *testing.T) {
 
 	tests := []struct {
 		name   string
-		stats  *activityStats
+		stats  *multipass.ActivityStats
 		expect bool
 	}{
 		{
 			name: "active PTY",
-			stats: &activityStats{
+			stats: &multipass.ActivityStats{
 				PTYIdleSeconds:  60, // 1 minute, less than 30 min timeout
 				LoadAverage1Min: 0.01,
 			},
@@ -78,7 +83,7 @@ func TestHasImmediateActivity(t *testing.T) {
 		},
 		{
 			name: "high CPU load",
-			stats: &activityStats{
+			stats: &multipass.ActivityStats{
 				PTYIdleSeconds:  -1, // No PTY
 				LoadAverage1Min: 0.5,
 			},
@@ -86,7 +91,7 @@ func TestHasImmediateActivity(t *testing.T) {
 		},
 		{
 			name: "no PTY, low load",
-			stats: &activityStats{
+			stats: &multipass.ActivityStats{
 				PTYIdleSeconds:  -1,
 				LoadAverage1Min: 0.01,
 			},
@@ -94,7 +99,7 @@ func TestHasImmediateActivity(t *testing.T) {
 		},
 		{
 			name: "stale PTY",
-			stats: &activityStats{
+			stats: &multipass.ActivityStats{
 				PTYIdleSeconds:  3600, // 1 hour, more than 30 min timeout
 				LoadAverage1Min: 0.01,
 			},
@@ -102,17 +107,17 @@ func TestHasImmediateActivity(t *testing.T) {
 		},
 		{
 			name: "exactly at threshold",
-			stats: &activityStats{
+			stats: &multipass.ActivityStats{
 				PTYIdleSeconds:  -1,
-				LoadAverage1Min: loadAverageThreshold,
+				LoadAverage1Min: DefaultLoadThreshold,
 			},
 			expect: false,
 		},
 		{
 			name: "just above threshold",
-			stats: &activityStats{
+			stats: &multipass.ActivityStats{
 				PTYIdleSeconds:  -1,
-				LoadAverage1Min: loadAverageThreshold + 0.01,
+				LoadAverage1Min: DefaultLoadThreshold + 0.01,
 			},
 			expect: true,
 		},
@@ -140,7 +145,7 @@ func TestCheckAllVMs(t *testing.T) {
 	mockMP.On("Exec", "running-vm", mock.MatchedBy(func(cmd []string) bool {
 		return len(cmd) >= 2 && cmd[0] == "sh" && cmd[1] == "-c"
 	})).Return("1000 2000\n60\n0.5", nil).Maybe()
-	mockMP.On("Exec", "running-vm", []string{"cat", checkpointPath}).Return("", nil).Maybe()
+	mockMP.On("Exec", "running-vm", []string{"cat", CheckpointPath}).Return("", nil).Maybe()
 
 	w := &Watchdog{
 		timeout: 30 * time.Minute,
@@ -168,8 +173,9 @@ func TestCheckVM_WithImmediateActivity(t *testing.T) {
 		stopCh:  make(chan struct{}),
 	}
 
-	w.checkVM("active-vm")
+	d := w.checkVM("active-vm")
 	// Should not stop VM since it has activity
+	assert.Equal(t, DecisionKeep, d.Action)
 }
 
 func TestReadCheckpoint(t *testing.T) {
@@ -182,7 +188,7 @@ func TestReadCheckpoint(t *testing.T) {
 	}
 	cpJSON, _ := json.Marshal(cp)
 
-	mockMP.On("Exec", "test-vm", []string{"cat", checkpointPath}).Return(string(cpJSON), nil)
+	mockMP.On("Exec", "test-vm", []string{"cat", CheckpointPath}).Return(string(cpJSON), nil)
 
 	w := &Watchdog{
 		timeout: 30 * time.Minute,
@@ -200,7 +206,7 @@ func TestReadCheckpoint(t *testing.T) {
 
 func TestReadCheckpoint_Error(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
-	mockMP.On("Exec", "test-vm", []string{"cat", checkpointPath}).Return("", assert.AnError)
+	mockMP.On("Exec", "test-vm", []string{"cat", CheckpointPath}).Return("", assert.AnError)
 
 	w := &Watchdog{
 		timeout: 30 * time.Minute,
@@ -215,7 +221,7 @@ func TestReadCheckpoint_Error(t *testing.T) {
 
 func TestReadCheckpoint_InvalidJSON(t *testing.T) {
 	mockMP := new(testutil.MockMultipassClient)
-	mockMP.On("Exec", "test-vm", []string{"cat", checkpointPath}).Return("not valid json", nil)
+	mockMP.On("Exec", "test-vm", []string{"cat", CheckpointPath}).Return("not valid json", nil)
 
 	w := &Watchdog{
 		timeout: 30 * time.Minute,
@@ -287,3 +293,318 @@ func TestGetActivityStats_InvalidOutput(t *testing.T) {
 	assert.Nil(t, stats)
 	assert.Contains(t, err.Error(), "unexpected output")
 }
+
+func TestWatchdog_SetAction(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	w := New(mockMP, 30*time.Minute)
+	defer w.Stop()
+
+	// Defaults to stop
+	assert.Equal(t, ActionStop, w.GetAction())
+
+	require.NoError(t, w.SetAction(ActionSuspend))
+	assert.Equal(t, ActionSuspend, w.GetAction())
+
+	require.NoError(t, w.SetAction(""))
+	assert.Equal(t, ActionStop, w.GetAction())
+
+	err := w.SetAction("hibernate")
+	assert.Error(t, err)
+	assert.Equal(t, ActionStop, w.GetAction())
+}
+
+func TestWatchdog_SetThresholds(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	w := New(mockMP, 30*time.Minute)
+	defer w.Stop()
+
+	load, noise := w.thresholds()
+	assert.Equal(t, DefaultLoadThreshold, load)
+	assert.Equal(t, uint64(DefaultNoiseBytesPerMin), noise)
+
+	require.NoError(t, w.SetThresholds(1.5, 0))
+	load, noise = w.thresholds()
+	assert.Equal(t, 1.5, load)
+	assert.Equal(t, uint64(DefaultNoiseBytesPerMin), noise)
+
+	assert.Error(t, w.SetThresholds(-0.5, 0))
+	assert.Error(t, w.SetThresholds(0, -1))
+	load, _ = w.thresholds()
+	assert.Equal(t, 1.5, load)
+}
+
+func TestCheckVM_CustomThresholds(t *testing.T) {
+	// A database VM idling at load 0.5 with 50KB of traffic since the
+	// stale checkpoint
+	newBusyVM := func() *Watchdog {
+		mockMP := new(testutil.MockMultipassClient)
+		cpJSON, _ := json.Marshal(checkpoint{
+			Timestamp: time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339),
+			RxBytes:   1000,
+			TxBytes:   2000,
+		})
+		mockMP.On("Exec", "db-vm", mock.MatchedBy(func(cmd []string) bool {
+			return len(cmd) >= 2 && cmd[0] == "sh" && cmd[1] == "-c"
+		})).Return("51000 2000\n-1\n0.5", nil)
+		mockMP.On("Exec", "db-vm", []string{"cat", CheckpointPath}).Return(string(cpJSON), nil)
+		mockMP.On("StopWithOptions", "db-vm", true, stopTimeout).Return(nil).Maybe()
+		return &Watchdog{timeout: 30 * time.Minute, mp: mockMP, stopCh: make(chan struct{})}
+	}
+
+	w := newBusyVM()
+	assert.Equal(t, Decision{VM: "db-vm", Action: DecisionKeep, Reason: "active terminal or CPU load"}, w.checkVM("db-vm"))
+
+	// Its idle load no longer counts as activity
+	w = newBusyVM()
+	require.NoError(t, w.SetThresholds(1, 0))
+	assert.Equal(t, ActionStop, w.checkVM("db-vm").Action)
+
+	// The noise threshold is per minute: 50KB over two hours is ~417
+	// bytes a minute, so it's activity below that rate but not above it
+	w = newBusyVM()
+	require.NoError(t, w.SetThresholds(1, 10000))
+	assert.Equal(t, ActionStop, w.checkVM("db-vm").Action)
+
+	w = newBusyVM()
+	require.NoError(t, w.SetThresholds(1, 400))
+	assert.Equal(t, Decision{VM: "db-vm", Action: DecisionKeep, Reason: "network activity"}, w.checkVM("db-vm"))
+}
+
+// staleCheckpointMocks sets up an idle VM whose checkpoint is older than the timeout
+func staleCheckpointMocks(mockMP *testutil.MockMultipassClient, vmName string) {
+	cp := checkpoint{
+		Timestamp: time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339),
+		RxBytes:   1000,
+		TxBytes:   2000,
+	}
+	cpJSON, _ := json.Marshal(cp)
+
+	mockMP.On("Exec", vmName, mock.MatchedBy(func(cmd []string) bool {
+		return len(cmd) >= 2 && cmd[0] == "sh" && cmd[1] == "-c"
+	})).Return("1000 2000\n-1\n0.01", nil)
+	mockMP.On("Exec", vmName, []string{"cat", CheckpointPath}).Return(string(cpJSON), nil)
+}
+
+func TestCheckVM_InactiveStops(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	staleCheckpointMocks(mockMP, "idle-vm")
+
+	stopped := make(chan struct{})
+	mockMP.On("StopWithOptions", "idle-vm", true, stopTimeout).Return(nil).Run(func(mock.Arguments) { close(stopped) })
+
+	w := &Watchdog{
+		timeout: 30 * time.Minute,
+		mp:      mockMP,
+		stopCh:  make(chan struct{}),
+	}
+
+	d := w.checkVM("idle-vm")
+	assert.Equal(t, Decision{VM: "idle-vm", Action: ActionStop, Reason: d.Reason}, d)
+	assert.Contains(t, d.Reason, "timeout 30m0s")
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected idle VM to be stopped")
+	}
+	mockMP.AssertNotCalled(t, "Suspend", "idle-vm")
+}
+
+func TestCheckVM_InactiveRunsShutdownHook(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  string
+		stopErr error
+		want    bool
+	}{
+		{"stopped", ActionStop, nil, true},
+		{"suspended", ActionSuspend, nil, true},
+		{"stop failed", ActionStop, errors.New("stop failed"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockMP := new(testutil.MockMultipassClient)
+			staleCheckpointMocks(mockMP, "idle-vm")
+			mockMP.On("Exec", "idle-vm", []string{"rm", "-f", CheckpointPath}).Return("", nil)
+			done := make(chan struct{})
+			mockMP.On("StopWithOptions", "idle-vm", true, stopTimeout).Return(tt.stopErr).Run(func(mock.Arguments) { close(done) })
+			mockMP.On("Suspend", "idle-vm").Return(tt.stopErr).Run(func(mock.Arguments) { close(done) })
+
+			hooked := make(chan string, 1)
+			w := &Watchdog{
+				timeout: 30 * time.Minute,
+				action:  tt.action,
+				mp:      mockMP,
+				stopCh:  make(chan struct{}),
+			}
+			w.SetOnShutdown(func(vmName string) { hooked <- vmName })
+
+			w.checkVM("idle-vm")
+			<-done
+
+			select {
+			case name := <-hooked:
+				assert.True(t, tt.want, "hook ran after a failed shutdown")
+				assert.Equal(t, "idle-vm", name)
+			case <-time.After(100 * time.Millisecond):
+				assert.False(t, tt.want, "expected the shutdown hook to run")
+			}
+		})
+	}
+}
+
+func TestCheckVM_InactiveSuspends(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	staleCheckpointMocks(mockMP, "idle-vm")
+	mockMP.On("Exec", "idle-vm", []string{"rm", "-f", CheckpointPath}).Return("", nil)
+
+	suspended := make(chan struct{})
+	mockMP.On("Suspend", "idle-vm").Return(nil).Run(func(mock.Arguments) { close(suspended) })
+
+	w := &Watchdog{
+		timeout: 30 * time.Minute,
+		action:  ActionSuspend,
+		mp:      mockMP,
+		stopCh:  make(chan struct{}),
+	}
+
+	w.checkVM("idle-vm")
+
+	select {
+	case <-suspended:
+	case <-time.After(time.Second):
+		t.Fatal("expected idle VM to be suspended")
+	}
+
+	// Checkpoint must be cleared so the VM isn't re-suspended right after resume
+	mockMP.AssertCalled(t, "Exec", "idle-vm", []string{"rm", "-f", CheckpointPath})
+	mockMP.AssertNotCalled(t, "Stop", "idle-vm")
+	mockMP.AssertNotCalled(t, "StopWithOptions", "idle-vm", mock.Anything, mock.Anything)
+}
+
+func TestCheckAllVMs_SkipsSuspended(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "suspended-vm", State: multipass.StateSuspended},
+	}, nil)
+
+	w := &Watchdog{
+		timeout: 30 * time.Minute,
+		action:  ActionSuspend,
+		mp:      mockMP,
+		stopCh:  make(chan struct{}),
+	}
+
+	w.checkAllVMs()
+
+	mockMP.AssertNotCalled(t, "Exec", "suspended-vm", mock.Anything)
+}
+
+func TestCheckNow(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "active-vm", State: multipass.StateRunning},
+		{Name: "broken-vm", State: multipass.StateRunning},
+		{Name: "stopped-vm", State: multipass.StateStopped},
+	}, nil)
+	mockMP.On("Exec", "active-vm", mock.MatchedBy(func(cmd []string) bool {
+		return len(cmd) >= 2 && cmd[0] == "sh" && cmd[1] == "-c"
+	})).Return("1000 2000\n-1\n0.8", nil)
+	mockMP.On("Exec", "broken-vm", mock.Anything).Return("", errors.New("exec failed"))
+
+	w := &Watchdog{
+		timeout: 30 * time.Minute,
+		mp:      mockMP,
+		stopCh:  make(chan struct{}),
+	}
+
+	decisions, err := w.CheckNow()
+	require.NoError(t, err)
+	require.Len(t, decisions, 2)
+	assert.Equal(t, "active-vm", decisions[0].VM)
+	assert.Equal(t, DecisionKeep, decisions[0].Action)
+	assert.Equal(t, "broken-vm", decisions[1].VM)
+	assert.Equal(t, DecisionSkip, decisions[1].Action)
+	assert.Contains(t, decisions[1].Reason, "exec failed")
+}
+
+func TestCheckNow_SkipsPinned(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return([]multipass.ListInstance{
+		{Name: "pinned-vm", State: multipass.StateRunning},
+	}, nil)
+
+	ls := labels.NewStore(filepath.Join(t.TempDir(), "labels.json"))
+	require.NoError(t, ls.Mark("pinned-vm", labels.PinnedKey))
+
+	w := &Watchdog{
+		timeout: 30 * time.Minute,
+		mp:      mockMP,
+		stopCh:  make(chan struct{}),
+	}
+	w.SetLabels(ls)
+
+	decisions, err := w.CheckNow()
+	require.NoError(t, err)
+	assert.Equal(t, []Decision{{VM: "pinned-vm", Action: DecisionKeep, Reason: "pinned"}}, decisions)
+	mockMP.AssertNotCalled(t, "Exec", "pinned-vm", mock.Anything)
+	mockMP.AssertNotCalled(t, "Stop", "pinned-vm")
+	mockMP.AssertNotCalled(t, "StopWithOptions", "pinned-vm", mock.Anything, mock.Anything)
+}
+
+func TestCheckNow_ListError(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	mockMP.On("List").Return(nil, errors.New("multipass unavailable"))
+
+	w := &Watchdog{
+		timeout: 30 * time.Minute,
+		mp:      mockMP,
+		stopCh:  make(chan struct{}),
+	}
+
+	_, err := w.CheckNow()
+	assert.Error(t, err)
+}
+
+func TestWatchdog_SetTimeout(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	w := New(mockMP, 30*time.Minute)
+	defer w.Stop()
+
+	require.NoError(t, w.SetTimeout(45*time.Minute))
+	assert.Equal(t, 45*time.Minute, w.GetTimeout())
+
+	// Invalid values leave the timeout unchanged
+	assert.Error(t, w.SetTimeout(0))
+	assert.Error(t, w.SetTimeout(-time.Minute))
+	assert.Error(t, w.SetTimeout(90*time.Second))
+	assert.Error(t, w.SetTimeout(MaxTimeout+time.Minute))
+	assert.Equal(t, 45*time.Minute, w.GetTimeout())
+}
+
+func TestWriteCheckpoint_EncodesPayload(t *testing.T) {
+	mockMP := new(testutil.MockMultipassClient)
+	var script string
+	mockMP.On("Exec", "test-vm", mock.MatchedBy(func(cmd []string) bool {
+		return len(cmd) == 3 && cmd[0] == "sh" && cmd[1] == "-c"
+	})).Run(func(args mock.Arguments) {
+		script = args.Get(1).([]string)[2]
+	}).Return("", nil)
+
+	w := &Watchdog{timeout: 30 * time.Minute, mp: mockMP, stopCh: make(chan struct{})}
+	w.writeCheckpoint("test-vm", 1234, 5678)
+
+	// The JSON never appears in the script, only its base64 encoding
+	assert.NotContains(t, script, "'")
+	assert.NotContains(t, script, `"`)
+	fields := strings.Fields(script)
+	require.Equal(t, []string{"echo", fields[1], "|", "base64", "-d", ">", CheckpointPath}, fields)
+
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	require.NoError(t, err)
+	var cp checkpoint
+	require.NoError(t, json.Unmarshal(data, &cp))
+	assert.Equal(t, uint64(1234), cp.RxBytes)
+	assert.Equal(t, uint64(5678), cp.TxBytes)
+}
@@ -47,7 +47,7 @@ export const handlers = [
     if (body.token === 'valid-token') {
       return HttpResponse.json({ status: 'ok' })
     }
-    return HttpResponse.json({ error: 'Invalid token' }, { status: 401 })
+    return HttpResponse.json({ error: { code: 'UNAUTHORIZED', message: 'Invalid token' } }, { status: 401 })
   }),
 
   http.post('/api/auth/logout', () => {
@@ -64,7 +64,7 @@ export const handlers = [
     if (vm) {
       return HttpResponse.json({ ...mockVMInfo, ...vm })
     }
-    return HttpResponse.json({ error: 'VM not found' }, { status: 404 })
+    return HttpResponse.json({ error: { code: 'VM_NOT_FOUND', message: 'VM not found' } }, { status: 404 })
   }),
 
   http.post('/api/vms', async ({ request }) => {
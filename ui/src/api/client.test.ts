@@ -1,5 +1,5 @@
 import { describe, it, expect, beforeEach } from 'vitest'
-import { api } from './client'
+import { api, APIError } from './client'
 import { server } from '../__tests__/setup'
 import { http, HttpResponse } from 'msw'
 
@@ -32,7 +32,7 @@ describe('APIClient', () => {
     it('should throw on server error', async () => {
       server.use(
         http.post('/api/auth/login', () => {
-          return HttpResponse.json({ error: 'Server error' }, { status: 500 })
+          return HttpResponse.json({ error: { code: 'INTERNAL_ERROR', message: 'Server error' } }, { status: 500 })
         })
       )
       await expect(api.login('test')).rejects.toThrow('Server error')
@@ -64,7 +64,7 @@ describe('APIClient', () => {
     it('should throw on error', async () => {
       server.use(
         http.get('/api/vms', () => {
-          return HttpResponse.json({ error: 'Unauthorized' }, { status: 401 })
+          return HttpResponse.json({ error: { code: 'UNAUTHORIZED', message: 'Unauthorized' } }, { status: 401 })
         })
       )
       await expect(api.listVMs()).rejects.toThrow('Unauthorized')
@@ -82,7 +82,7 @@ describe('APIClient', () => {
       server.use(
         http.get('/api/vms/:name', ({ params }) => {
           if (params.name === 'nonexistent') {
-            return HttpResponse.json({ error: 'VM not found' }, { status: 404 })
+            return HttpResponse.json({ error: { code: 'VM_NOT_FOUND', message: 'VM not found' } }, { status: 404 })
           }
           return HttpResponse.json({})
         })
@@ -275,6 +275,23 @@ describe('APIClient', () => {
       await expect(api.listVMs()).rejects.toThrow('Custom error message')
     })
 
+    it('should expose structured error code and status', async () => {
+      server.use(
+        http.get('/api/vms/:name', () => {
+          return HttpResponse.json(
+            { error: { code: 'VM_NOT_RUNNING', message: 'VM is not running', request_id: 'trace-1' } },
+            { status: 400 }
+          )
+        })
+      )
+      const err = await api.getVM('test-vm').catch((e) => e)
+      expect(err).toBeInstanceOf(APIError)
+      expect(err.message).toBe('VM is not running')
+      expect(err.code).toBe('VM_NOT_RUNNING')
+      expect(err.status).toBe(400)
+      expect(err.requestId).toBe('trace-1')
+    })
+
     it('should handle plain text error response', async () => {
       server.use(
         http.get('/api/vms', () => {
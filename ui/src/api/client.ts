@@ -1,5 +1,61 @@
 const API_BASE = '/api'
 
+// Error codes returned by the API in {"error": {"code", "message"}}
+export type APIErrorCode =
+  | 'INVALID_REQUEST'
+  | 'INVALID_CONFIG'
+  | 'VM_NOT_FOUND'
+  | 'VM_NOT_RUNNING'
+  | 'NOT_FOUND'
+  | 'UPLOAD_TOO_LARGE'
+  | 'UNAVAILABLE'
+  | 'VM_EXISTS'
+  | 'NO_RESOURCES'
+  | 'IMAGE_FAILED'
+  | 'LIMIT_EXCEEDED'
+  | 'INTERNAL_ERROR'
+  | 'UNAUTHORIZED'
+  | 'METHOD_NOT_ALLOWED'
+
+// Error thrown for non-2xx responses; branch on `code` rather than the message
+export class APIError extends Error {
+  code?: APIErrorCode
+  status: number
+  hint?: string // what the user can do about it, when known
+  requestId?: string // matches the daemon's log line for the request
+
+  constructor(message: string, status: number, code?: APIErrorCode, hint?: string, requestId?: string) {
+    super(message)
+    this.name = 'APIError'
+    this.status = status
+    this.code = code
+    this.hint = hint
+    this.requestId = requestId
+  }
+}
+
+async function parseError(res: Response, fallback?: string): Promise<APIError> {
+  const text = await res.text()
+  let message = text
+  let code: APIErrorCode | undefined
+  let hint: string | undefined
+  let requestId = res.headers.get('X-Request-ID') || undefined
+  try {
+    const json = JSON.parse(text)
+    if (json.error && typeof json.error === 'object') {
+      message = json.error.message || text
+      code = json.error.code
+      hint = json.error.hint
+      requestId = json.error.request_id || requestId
+    } else {
+      message = json.error || text
+    }
+  } catch {
+    // Use raw text (e.g. proxy errors)
+  }
+  return new APIError(message || fallback || res.statusText, res.status, code, hint, requestId)
+}
+
 class APIClient {
   private token: string = ''
 
@@ -20,8 +76,7 @@ class APIClient {
       body: JSON.stringify({ token }),
     })
     if (!res.ok) {
-      const data = await res.json().catch(() => ({}))
-      throw new Error(data.error || 'Login failed')
+      throw await parseError(res, 'Login failed')
     }
     this.token = token
   }
@@ -50,15 +105,7 @@ class APIClient {
     })
 
     if (!res.ok) {
-      const text = await res.text()
-      let message = text
-      try {
-        const json = JSON.parse(text)
-        message = json.error || text
-      } catch {
-        // Use raw text
-      }
-      throw new Error(message || res.statusText)
+      throw await parseError(res)
     }
 
     const text = await res.text()
@@ -71,32 +118,104 @@ class APIClient {
     return this.request<VMDefaults>('GET', '/defaults')
   }
 
+  // Omitted fields are left unchanged; image: '' or cloud_init: '' clears it
+  setDefaults(defaults: Partial<VMDefaults>) {
+    return this.request<VMDefaults>('PUT', '/defaults', defaults)
+  }
+
   // VMs
-  listVMs() {
-    return this.request<VM[]>('GET', '/vms')
+  // activity adds last_activity/idle_seconds to each VM (one exec per running VM)
+  listVMs(opts: { activity?: boolean } = {}) {
+    return this.request<VM[]>('GET', opts.activity ? '/vms?activity=true' : '/vms')
   }
 
   getVM(name: string) {
     return this.request<VMInfo>('GET', `/vms/${name}`)
   }
 
+  getVMLabels(name: string) {
+    return this.request<Record<string, string>>('GET', `/vms/${name}/labels`)
+  }
+
+  setVMLabels(name: string, labels: Record<string, string>) {
+    return this.request<Record<string, string>>('PUT', `/vms/${name}/labels`, labels)
+  }
+
   createVM(data: CreateVMRequest) {
     return this.request<{ status: string; name: string }>('POST', '/vms', data)
   }
 
+  // Returns immediately; poll getJob until status is ready or failed
+  createVMAsync(data: CreateVMRequest) {
+    return this.request<Job>('POST', '/vms?async=true', data)
+  }
+
+  // Render the cloud-init a create request would launch with, without launching
+  previewCloudInit(data: CreateVMRequest) {
+    return this.request<{ cloud_init: string }>('POST', '/vms/cloud-init/preview', data)
+  }
+
+  // What a VM was launched with; 404 for VMs created without a record
+  getVMSpec(name: string) {
+    return this.request<{ spec: CreateVMRequest; cloud_init: string }>('GET', `/vms/${name}/spec`)
+  }
+
+  getJob(id: string) {
+    return this.request<Job>('GET', `/jobs/${id}`)
+  }
+
   deleteVM(name: string) {
     return this.request<{ status: string }>('DELETE', `/vms/${name}`)
   }
 
+  // Pinned VMs are never pruned or stopped by the watchdog
+  pinVM(name: string) {
+    return this.request<{ pinned: boolean }>('POST', `/vms/${name}/pin`)
+  }
+
+  unpinVM(name: string) {
+    return this.request<{ pinned: boolean }>('DELETE', `/vms/${name}/pin`)
+  }
+
+  // Stop waiting for a VM the proxy is waking (404 if it isn't)
+  cancelWake(name: string) {
+    return this.request<{ status: string; name: string }>('POST', `/vms/${name}/wake/cancel`)
+  }
+
+  // Start or stop many VMs; per-VM failures are in the results
+  bulkVMs(data: BulkRequest) {
+    return this.request<{ results: BulkResult[] }>('POST', '/vms/bulk', data)
+  }
+
+  // Run several GETs in one round trip; paths are relative to /api, e.g.
+  // '/vms/dev'. Results come back in order, each with its own status.
+  batch(paths: string[]) {
+    return this.request<BatchResult[]>(
+      'POST',
+      '/batch',
+      paths.map((path) => ({ method: 'GET', path: API_BASE + path }))
+    )
+  }
+
+  pruneVMs(data: PruneRequest) {
+    return this.request<PruneResponse>('POST', '/vms/prune', data)
+  }
+
+  // Run the idle check now; idle VMs past the timeout are stopped/suspended
+  checkWatchdog() {
+    return this.request<WatchdogCheckResponse>('POST', '/watchdog/check')
+  }
+
   startVM(name: string) {
     return this.request<{ status: string }>('POST', `/vms/${name}/state`, {
       action: 'start',
     })
   }
 
-  stopVM(name: string) {
+  stopVM(name: string, force = false) {
     return this.request<{ status: string }>('POST', `/vms/${name}/state`, {
       action: 'stop',
+      ...(force && { force }),
     })
   }
 
@@ -106,19 +225,47 @@ class APIClient {
     })
   }
 
-  cloneVM(name: string, newName: string) {
+  cloneVM(name: string, newName: string, options: CloneOptions = {}) {
     return this.request<{ status: string; name: string }>(
       'POST',
       `/vms/${name}/clone`,
-      { new_name: newName }
+      { new_name: newName, ...options }
     )
   }
 
+  // Delete and relaunch from the recorded spec; disk contents are lost
+  recreateVM(name: string) {
+    return this.request<{ status: string; name: string }>('POST', `/vms/${name}/recreate`)
+  }
+
+  exportVM(name: string) {
+    return this.request<VMBundle>('GET', `/vms/${name}/export`)
+  }
+
+  // name overrides the VM name stored in the bundle
+  importVM(bundle: VMBundle, name?: string) {
+    const query = name ? `?name=${encodeURIComponent(name)}` : ''
+    return this.request<ImportResponse>('POST', `/vms/import${query}`, bundle)
+  }
+
+  // Host
+  listHostNetworks() {
+    return this.request<HostNetwork[]>('GET', '/host/networks')
+  }
+
   // Snapshots
   listSnapshots(vmName: string) {
     return this.request<Record<string, Snapshot>>('GET', `/vms/${vmName}/snapshots`)
   }
 
+  listAllSnapshots() {
+    return this.request<Record<string, Record<string, Snapshot>>>('GET', '/snapshots')
+  }
+
+  getSnapshotTree(vmName: string) {
+    return this.request<SnapshotTree>('GET', `/vms/${vmName}/snapshots/tree`)
+  }
+
   createSnapshot(vmName: string, snapshotName?: string) {
     return this.request<{ status: string }>(
       'POST',
@@ -162,15 +309,7 @@ class APIClient {
       }
     )
     if (!res.ok) {
-      const text = await res.text()
-      let message = text
-      try {
-        const json = JSON.parse(text)
-        message = json.error || text
-      } catch {
-        // Use raw text
-      }
-      throw new Error(message || res.statusText)
+      throw await parseError(res)
     }
   }
 
@@ -182,15 +321,30 @@ class APIClient {
       }
     )
     if (!res.ok) {
-      const text = await res.text()
-      let message = text
-      try {
-        const json = JSON.parse(text)
-        message = json.error || text
-      } catch {
-        // Use raw text
+      throw await parseError(res)
+    }
+    return res.blob()
+  }
+
+  // Audit log
+  listAudit(limit?: number) {
+    return this.request<AuditEntry[]>('GET', limit ? `/audit?limit=${limit}` : '/audit')
+  }
+
+  // Shell recordings
+  listRecordings(vmName: string) {
+    return this.request<RecordingInfo[]>('GET', `/vms/${vmName}/recordings`)
+  }
+
+  async downloadRecording(vmName: string, file: string): Promise<Blob> {
+    const res = await fetch(
+      `${API_BASE}/vms/${vmName}/recordings/${encodeURIComponent(file)}`,
+      {
+        credentials: 'include',
       }
-      throw new Error(message || res.statusText)
+    )
+    if (!res.ok) {
+      throw await parseError(res)
     }
     return res.blob()
   }
@@ -200,6 +354,11 @@ class APIClient {
     return this.request<MountEntry[]>('GET', `/vms/${vmName}/mounts`)
   }
 
+  // Every VM's mounts; VMs that couldn't be queried are in errors
+  listAllMounts() {
+    return this.request<AllMountsResponse>('GET', '/mounts')
+  }
+
   addMount(vmName: string, hostPath: string, vmPath: string) {
     return this.request<{ status: string }>('POST', `/vms/${vmName}/mounts`, {
       host_path: hostPath,
@@ -214,15 +373,26 @@ class APIClient {
     )
   }
 
+  restoreMounts(vmName: string) {
+    return this.request<{ results: MountRestoreResult[] }>(
+      'POST',
+      `/vms/${vmName}/mounts/restore`
+    )
+  }
+
   // Tunnels
-  listTunnels() {
-    return this.request<TunnelInfo[]>('GET', '/tunnels')
+  listTunnels(vm?: string) {
+    const query = vm ? `?vm=${encodeURIComponent(vm)}` : ''
+    return this.request<TunnelInfo[]>('GET', `/tunnels${query}`)
   }
 
-  createTunnel(vmName: string, vmPort: number) {
+  // stable derives the host port from the VM name and port
+  createTunnel(vmName: string, vmPort: number, rateLimitKBps?: number, stable?: boolean) {
     return this.request<TunnelInfo>('POST', '/tunnels', {
       vm_name: vmName,
       vm_port: vmPort,
+      rate_limit_kbps: rateLimitKBps,
+      stable,
     })
   }
 
@@ -254,6 +424,36 @@ class APIClient {
     )
   }
 
+  pauseNetwork(vmName: string) {
+    return this.request<{ status: string }>('POST', `/vms/${vmName}/network/pause`)
+  }
+
+  resumeNetwork(vmName: string) {
+    return this.request<{ status: string }>('POST', `/vms/${vmName}/network/resume`)
+  }
+
+  // Checks from inside the VM which hosts it can reach (host:port for TCP)
+  testNetwork(vmName: string, hosts: string[], timeoutSecs?: number) {
+    return this.request<NetworkTestResponse>('POST', `/vms/${vmName}/network/test`, {
+      hosts,
+      ...(timeoutSecs && { timeout_secs: timeoutSecs }),
+    })
+  }
+
+  // Compares the VM's live iptables rules against its stored config
+  verifyNetwork(vmName: string) {
+    return this.request<NetworkVerifyResponse>('GET', `/vms/${vmName}/network/verify`)
+  }
+
+  // Applies one config to many VMs; only running ones get it
+  applyNetworkBulk(names: string[], config: NetworkConfig, parallel?: number) {
+    return this.request<{ results: BulkResult[] }>('POST', '/network/apply-bulk', {
+      names,
+      config,
+      ...(parallel && { parallel }),
+    })
+  }
+
   getNetworkDefaults() {
     return this.request<NetworkConfig>('GET', '/network/defaults')
   }
@@ -266,10 +466,38 @@ class APIClient {
     )
   }
 
+  // Boot/console log: dmesg while the VM can run commands, else the
+  // host-side multipass log
+  getConsoleLog(vmName: string, lines?: number) {
+    const query = lines ? `?lines=${lines}` : ''
+    return this.request<ConsoleLog>('GET', `/vms/${vmName}/console${query}`)
+  }
+
+  // Progress of the first-boot tool install: running, complete, failed, or unknown
+  getReady(vmName: string) {
+    return this.request<ReadyStatus>('GET', `/vms/${vmName}/ready`)
+  }
+
+  // WebSocket URL of a VM's live metrics; each message is a MetricsSample
+  metricsStreamURL(vmName: string, intervalSecs?: number) {
+    const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:'
+    const query = intervalSecs ? `?interval=${intervalSecs}` : ''
+    return `${protocol}//${window.location.host}/api/vms/${vmName}/metrics/stream${query}`
+  }
+
   // Agent
   getAgentURL(vmName: string) {
     return this.request<{ url: string }>('GET', `/vms/${vmName}/agent-url`)
   }
+
+  getAgentStatus(vmName: string) {
+    return this.request<AgentStatus>('GET', `/vms/${vmName}/agent-status`)
+  }
+
+  // Host ports held by agent listeners, and the range they come from
+  listAgents() {
+    return this.request<AgentsResponse>('GET', '/agents')
+  }
 }
 
 export const api = new APIClient()
@@ -280,6 +508,75 @@ export interface VM {
   state: string
   ipv4: string[]
   release: string
+  labels?: Record<string, string>
+  pinned: boolean // excluded from prune and auto-shutdown
+  last_activity?: string // only with listVMs({ activity: true })
+  idle_seconds?: number
+}
+
+// Reproducible VM setup from exportVM (disk contents not included)
+export interface VMBundle {
+  version: number
+  name: string
+  cpu?: number
+  mem?: string
+  disk?: string
+  image?: string
+  network?: NetworkConfig
+  mounts?: MountEntry[]
+  labels?: Record<string, string>
+}
+
+export interface ImportResponse {
+  status: string
+  name: string
+  failed?: Record<string, string> // vm path -> why the mount failed
+}
+
+export interface PruneRequest {
+  stopped?: boolean
+  older_than?: string // e.g. "7d", "12h"
+  dry_run?: boolean
+}
+
+export interface PruneResponse {
+  dry_run: boolean
+  pruned: { name: string; state: string; last_active?: string }[]
+  failed?: Record<string, string>
+}
+
+export interface BulkRequest {
+  action: 'start' | 'stop'
+  names?: string[]
+  all?: boolean
+  skip_user_stops?: boolean
+  parallel?: number
+}
+
+export interface BulkResult {
+  name: string
+  status: 'ok' | 'skipped' | 'failed'
+  detail?: string
+}
+
+export interface BatchResult<T = unknown> {
+  status: number
+  body?: T
+}
+
+export interface Job {
+  id: string
+  vm: string
+  status: 'launching' | 'installing' | 'ready' | 'failed'
+  last_log?: string
+  error?: string
+  hint?: string
+  created_at: string
+  updated_at: string
+}
+
+export interface WatchdogCheckResponse {
+  decisions: { vm: string; action: 'keep' | 'skip' | 'stop' | 'suspend'; reason: string }[]
 }
 
 export interface VMInfo {
@@ -290,10 +587,16 @@ export interface VMInfo {
   ipv4: string[]
   load: number[]
   memory: { total: number; used: number }
-  mounts: Record<string, { source_path: string }>
+  mounts: Record<
+    string,
+    { source_path: string; uid_mappings?: string[]; gid_mappings?: string[] }
+  >
   release: string
   snapshot_count: string
   state: string
+  pinned: boolean
+  last_activity?: string // watchdog checkpoint (running) or stop time (stopped)
+  idle_seconds?: number
 }
 
 export interface CreateVMRequest {
@@ -302,7 +605,88 @@ export interface CreateVMRequest {
   mem?: string
   disk?: string
   image?: string
+  image_checksum?: string
+  networks?: string[]
   network?: NetworkConfig
+  packages?: string[] // extra apt packages for this VM
+  forward_ssh_agent?: boolean // relay the daemon's SSH agent into the VM
+  netplan?: string // path to a netplan config on the host
+}
+
+// Health of the opencode agent inside a VM
+export interface AgentStatus {
+  service_active: boolean
+  port_open: boolean
+}
+
+// One reading from the metrics stream; rates are since the previous sample
+export interface MetricsSample {
+  time: string
+  cpu_percent: number
+  mem_used_bytes: number
+  mem_total_bytes: number
+  load_1m: number
+  rx_bytes: number
+  tx_bytes: number
+  rx_bytes_per_sec: number
+  tx_bytes_per_sec: number
+  error?: string
+}
+
+export interface ConsoleLog {
+  vm: string
+  source: string // "dmesg" or the host log file read
+  note?: string // why the VM's own log wasn't used
+  lines: string[]
+}
+
+export interface NetworkTestResponse {
+  vm: string
+  results: {
+    host: string
+    reachable: boolean
+    http_status?: number
+    error?: string
+  }[]
+  reachable: number
+  blocked: number
+}
+
+export interface NetworkVerifyResponse {
+  vm: string
+  in_sync: boolean
+  drift: {
+    kind: 'missing' | 'unexpected'
+    rule: {
+      chain: string
+      policy?: boolean
+      dest?: string
+      target: string
+      extra?: string
+      ipv6?: boolean
+    }
+  }[]
+}
+
+export interface ReadyStatus {
+  vm: string
+  ready: boolean // the install completed
+  status: 'running' | 'complete' | 'failed' | 'unknown'
+  updated_at?: string
+  error?: string // the command that failed
+}
+
+export interface AgentsResponse {
+  base_port: number
+  port_range: number
+  agents: { vm: string; port: number; running: boolean }[]
+}
+
+// Host network interfaces available for bridged VM NICs
+export interface HostNetwork {
+  name: string
+  type: string
+  description: string
 }
 
 // Network types
@@ -317,6 +701,9 @@ export interface NetworkRule {
 export interface NetworkConfig {
   mode: NetworkMode
   rules?: NetworkRule[]
+  dns_servers?: string[] // resolvers allowed in allowlist mode (default: the VM's own)
+  scope?: 'vm' | 'host' // where the rules are enforced (default: vm; host needs a Linux host)
+  paused?: boolean // restrictions lifted until resumed or the VM restarts
 }
 
 export interface Snapshot {
@@ -324,6 +711,44 @@ export interface Snapshot {
   parent: string
 }
 
+export interface CloneOptions {
+  source_snapshot?: string
+  cpu?: number
+  mem?: string
+  disk?: string
+}
+
+export interface SnapshotNode {
+  name: string
+  comment?: string
+  children: SnapshotNode[]
+}
+
+export interface SnapshotTree {
+  roots: SnapshotNode[]
+  orphans?: string[]
+  cycles?: string[]
+}
+
+export interface AuditEntry {
+  time: string
+  source: 'api' | 'cli'
+  action: string
+  vm?: string
+  detail?: string
+  auth?: string
+  client_ip?: string
+  status?: number
+  result: 'ok' | 'error'
+  error?: string
+}
+
+export interface RecordingInfo {
+  name: string
+  size: number
+  mod_time: string
+}
+
 export interface FileEntry {
   name: string
   is_dir: boolean
@@ -336,19 +761,45 @@ export interface FilesResponse {
   entries: FileEntry[]
 }
 
+export interface HostMount {
+  vm: string
+  host_path: string
+  vm_path: string
+  host_path_exists: boolean // false when the host directory was moved or deleted
+}
+
+export interface AllMountsResponse {
+  mounts: HostMount[]
+  errors?: { vm: string; error: string }[]
+}
+
 export interface MountEntry {
   host_path: string
   vm_path: string
+  uid_maps?: string[]
+  gid_maps?: string[]
+  type?: 'classic' | 'native'
+}
+
+export interface MountRestoreResult {
+  host_path: string
+  vm_path: string
+  status: 'mounted' | 'skipped' | 'failed'
+  detail?: string
 }
 
 export interface TunnelInfo {
   host_port: number
   vm_name: string
   vm_port: number
+  rate_limit_kbps?: number
+  stable?: boolean // host port derived from the VM name and port
 }
 
 export interface VMDefaults {
   cpu: number
   mem: string
   disk: string
+  image?: string
+  cloud_init?: string // host path of the default cloud-init file
 }
@@ -164,12 +164,12 @@ export default function CloneVMModal({
                 value={newName}
                 onChange={(e) => setNewName(e.target.value)}
                 placeholder={`${sourceName}-clone`}
-                pattern="[a-zA-Z][a-zA-Z0-9-]*"
+                pattern="(?!.*-[0-9]+$)[a-zA-Z][a-zA-Z0-9-]*"
                 required
                 autoComplete="off"
               />
               <span className="form-hint">
-                Letters, numbers, hyphens. Must start with a letter.
+                Letters, numbers, hyphens. Must start with a letter and not end in a -number.
               </span>
             </div>
 
@@ -1,5 +1,5 @@
 import { useState, useEffect, useRef } from 'react'
-import { api, NetworkMode, NetworkRule } from '../api/client'
+import { api, APIError, NetworkMode, NetworkRule } from '../api/client'
 
 interface CreateVMModalProps {
   onClose: () => void
@@ -20,6 +20,17 @@ function parseError(err: unknown): FormError {
   // Extract message from Error objects
   const message = err instanceof Error ? err.message : String(err)
 
+  // Structured API errors carry a code
+  if (err instanceof APIError && err.code) {
+    switch (err.code) {
+      case 'INVALID_REQUEST':
+      case 'INVALID_CONFIG':
+        return { message, type: 'validation' }
+      case 'UNAUTHORIZED':
+        return { message: 'Session expired. Please sign in again.', type: 'server' }
+    }
+  }
+
   // Categorize common errors
   if (message.includes('already exists') || message.includes('duplicate')) {
     return { message: `A VM with this name already exists.`, type: 'validation' }
@@ -220,11 +231,11 @@ export default function CreateVMModal({ onClose, onCreated }: CreateVMModalProps
                 value={name}
                 onChange={(e) => setName(e.target.value)}
                 placeholder="my-vm"
-                pattern="[a-zA-Z][a-zA-Z0-9-]*"
+                pattern="(?!.*-[0-9]+$)[a-zA-Z][a-zA-Z0-9-]*"
                 required
                 autoComplete="off"
               />
-              <span className="form-hint">Letters, numbers, hyphens. Must start with a letter.</span>
+              <span className="form-hint">Letters, numbers, hyphens. Must start with a letter and not end in a -number.</span>
             </div>
 
             <div className="form-row">
@@ -1,5 +1,6 @@
 import { useState, useEffect, useCallback } from 'react'
 import { api, FileEntry } from '../api/client'
+import { formatBytes } from '../utils/format'
 
 interface FileBrowserProps {
   vmName: string
@@ -57,14 +58,7 @@ export default function FileBrowser({ vmName, isRunning }: FileBrowserProps) {
 
   const formatSize = (bytes: number) => {
     if (bytes === 0) return '-'
-    const units = ['B', 'KB', 'MB', 'GB']
-    let i = 0
-    let value = bytes
-    while (value >= 1024 && i < units.length - 1) {
-      value /= 1024
-      i++
-    }
-    return `${value.toFixed(1)} ${units[i]}`
+    return formatBytes(bytes)
   }
 
   const formatMode = (mode: string) => {
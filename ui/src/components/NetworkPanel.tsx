@@ -1,5 +1,5 @@
 import { useState, useEffect, useCallback } from 'react'
-import { api, NetworkConfig, NetworkRule, NetworkMode } from '../api/client'
+import { api, APIError, NetworkConfig, NetworkRule, NetworkMode } from '../api/client'
 
 interface NetworkPanelProps {
   vmName: string
@@ -40,7 +40,7 @@ export default function NetworkPanel({ vmName, isRunning }: NetworkPanelProps) {
       setHasChanges(false)
     } catch (err) {
       const msg = err instanceof Error ? err.message : String(err)
-      if (!msg.includes('must be running')) {
+      if (!(err instanceof APIError && err.code === 'VM_NOT_RUNNING')) {
         setError(`Failed to load network config: ${msg}`)
       }
     } finally {
@@ -9,6 +9,10 @@ import '@xterm/xterm/css/xterm.css'
 
 const TERMINAL_FONT = '"IBM Plex Mono", monospace'
 
+// Shell session IDs are kept per tab so a reload or reconnect reattaches
+// to the same shell while the daemon still holds it
+const sessionKey = (vmName: string) => `dabbi-shell-session-${vmName}`
+
 interface TerminalProps {
   vmName: string
   isRunning: boolean
@@ -28,7 +32,11 @@ export default function Terminal({ vmName, isRunning }: TerminalProps) {
     const { cols, rows } = term
 
     const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:'
-    const wsUrl = `${protocol}//${window.location.host}/api/vms/${vmName}/shell?cols=${cols}&rows=${rows}`
+    let wsUrl = `${protocol}//${window.location.host}/api/vms/${vmName}/shell?cols=${cols}&rows=${rows}`
+    const sessionId = sessionStorage.getItem(sessionKey(vmName))
+    if (sessionId) {
+      wsUrl += `&session=${encodeURIComponent(sessionId)}`
+    }
 
     const ws = new WebSocket(wsUrl)
     ws.binaryType = 'arraybuffer'
@@ -47,6 +55,17 @@ export default function Terminal({ vmName, isRunning }: TerminalProps) {
 
     ws.onmessage = (event) => {
       if (typeof event.data === 'string') {
+        if (event.data.startsWith('{')) {
+          try {
+            const msg = JSON.parse(event.data)
+            if (msg.type === 'session') {
+              sessionStorage.setItem(sessionKey(vmName), msg.id)
+              return
+            }
+          } catch {
+            // Not a control message
+          }
+        }
         term.write(event.data)
       } else if (event.data instanceof ArrayBuffer) {
         // Use stream: true to handle partial UTF-8 sequences at message boundaries
@@ -155,7 +174,9 @@ export default function Terminal({ vmName, isRunning }: TerminalProps) {
 
       cleanup = () => {
         window.removeEventListener('resize', handleResize)
-        wsRef.current?.close()
+        // A clean close ends the shell on the daemon, so forget the session
+        sessionStorage.removeItem(sessionKey(vmName))
+        wsRef.current?.close(1000)
         term?.dispose()
       }
     })
@@ -165,6 +186,7 @@ export default function Terminal({ vmName, isRunning }: TerminalProps) {
 
   const handleReconnect = () => {
     if (xtermRef.current && fitAddonRef.current) {
+      // When resuming, the daemon replays recent output onto the cleared screen
       xtermRef.current.clear()
       connectWebSocket(xtermRef.current, fitAddonRef.current)
     }
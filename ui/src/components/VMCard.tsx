@@ -21,7 +21,14 @@ export default function VMCard({ vm, onAction }: VMCardProps) {
   return (
     <div className="vm-card" onClick={handleClick}>
       <div className="vm-card-header">
-        <h3>{vm.name}</h3>
+        <h3>
+          {vm.name}
+          {vm.pinned && (
+            <span className="vm-pinned" title="Pinned: excluded from prune and auto-shutdown">
+              {' '}🔒
+            </span>
+          )}
+        </h3>
         <span className={`state state-${vm.state.toLowerCase()}`}>
           {vm.state}
         </span>
@@ -77,6 +84,9 @@ export default function VMCard({ vm, onAction }: VMCardProps) {
           font-size: 18px;
           font-weight: 600;
         }
+        .vm-pinned {
+          font-size: 14px;
+        }
         .state {
           padding: 4px 12px;
           border-radius: 20px;
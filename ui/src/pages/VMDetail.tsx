@@ -1,6 +1,6 @@
 import { useState, useEffect, useCallback } from 'react'
 import { useParams, useNavigate, useSearchParams } from 'react-router-dom'
-import { api, VMInfo } from '../api/client'
+import { api, AgentStatus, VMInfo } from '../api/client'
 import SnapshotPanel from '../components/SnapshotPanel'
 import TunnelsPanel from '../components/TunnelsPanel'
 import MountsPanel from '../components/MountsPanel'
@@ -8,6 +8,7 @@ import NetworkPanel from '../components/NetworkPanel'
 import CloneVMModal from '../components/CloneVMModal'
 import ConfirmModal from '../components/ConfirmModal'
 import Tooltip from '../components/Tooltip'
+import { formatBytes } from '../utils/format'
 
 type Tab = 'snapshots' | 'tunnels' | 'mounts' | 'network'
 
@@ -141,6 +142,7 @@ export default function VMDetail() {
   // Counts for tabs
   const [tunnelCount, setTunnelCount] = useState(0)
   const [mountCount, setMountCount] = useState(0)
+  const [agentStatus, setAgentStatus] = useState<AgentStatus | null>(null)
 
   // Get initial tab from URL query param
   const urlTab = searchParams.get('tab') as Tab | null
@@ -188,6 +190,27 @@ export default function VMDetail() {
     return () => clearInterval(interval)
   }, [loadVM, loadTunnelCount])
 
+  // Agent health is only meaningful while the VM is running
+  const vmRunning = vm?.state === 'Running'
+  useEffect(() => {
+    if (!name || !vmRunning) {
+      setAgentStatus(null)
+      return
+    }
+    let cancelled = false
+    const check = () => {
+      api.getAgentStatus(name)
+        .then((status) => { if (!cancelled) setAgentStatus(status) })
+        .catch(() => { if (!cancelled) setAgentStatus(null) })
+    }
+    check()
+    const interval = setInterval(check, 15000)
+    return () => {
+      cancelled = true
+      clearInterval(interval)
+    }
+  }, [name, vmRunning])
+
   const handleTabChange = (tab: Tab) => {
     setActiveTab(tab)
     setSearchParams({ tab })
@@ -310,17 +333,6 @@ export default function VMDetail() {
 
   if (!vm) return null
 
-  const formatBytes = (bytes: number) => {
-    const units = ['B', 'KB', 'MB', 'GB']
-    let i = 0
-    let value = bytes
-    while (value >= 1024 && i < units.length - 1) {
-      value /= 1024
-      i++
-    }
-    return `${value.toFixed(1)} ${units[i]}`
-  }
-
   const memoryPercent = vm.memory.total > 0
     ? Math.round((vm.memory.used / vm.memory.total) * 100)
     : 0
@@ -460,7 +472,16 @@ export default function VMDetail() {
             disabled={!isRunning}
           >
             <AgentIcon />
-            <span className="quick-btn-label">Agent</span>
+            <span className="quick-btn-label">
+              Agent
+              {agentStatus && (
+                <span className={`agent-status ${agentStatus.service_active && agentStatus.port_open ? 'ok' : 'down'}`}>
+                  {agentStatus.service_active && agentStatus.port_open
+                    ? 'running'
+                    : agentStatus.service_active ? 'starting' : 'stopped'}
+                </span>
+              )}
+            </span>
             <ExternalLinkIcon />
           </button>
         </Tooltip>
@@ -879,6 +900,16 @@ export default function VMDetail() {
           color: #9c27b0;
         }
 
+        .agent-status {
+          margin-left: 8px;
+          font-size: 11px;
+          color: var(--text-secondary);
+        }
+
+        .agent-status.ok {
+          color: var(--success);
+        }
+
         /* Resource Cards - 4 columns */
         .resource-cards {
           display: grid;
@@ -0,0 +1,13 @@
+// Human-readable byte sizes using binary units, e.g. "4.0 GiB"
+// (matches multipass.FormatBytes on the Go side)
+export function formatBytes(bytes: number): string {
+  const units = ['B', 'KiB', 'MiB', 'GiB', 'TiB']
+  if (bytes < 1024) return `${bytes} B`
+  let i = 0
+  let value = bytes
+  while (value >= 1024 && i < units.length - 1) {
+    value /= 1024
+    i++
+  }
+  return `${value.toFixed(1)} ${units[i]}`
+}